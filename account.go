@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/austinwklein/whisper/auth"
+	"github.com/austinwklein/whisper/config"
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const accountUsage = `usage: whisper account create --username <name> --password-file <file|-> [--full-name <name>] [--db <path>]
+       whisper account split [--db <path>] [--keep-identity <username>]`
+
+// runAccountCommand handles `whisper account ...` without starting the P2P host,
+// so accounts can be provisioned from scripts and CI
+func runAccountCommand(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(accountUsage)
+	}
+	switch args[0] {
+	case "create":
+		return runAccountCreate(cfg, args[1:])
+	case "split":
+		return runAccountSplit(cfg, args[1:])
+	}
+	return errors.New(accountUsage)
+}
+
+// runAccountCreate handles `whisper account create`
+func runAccountCreate(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("account create", flag.ContinueOnError)
+	username := fs.String("username", "", "username for the new account")
+	passwordFile := fs.String("password-file", "", "file containing the password, or - for stdin")
+	fullName := fs.String("full-name", "", "display name (defaults to the username)")
+	dbPath := fs.String("db", cfg.DBPath, "database to create the account in")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *username == "" || *passwordFile == "" {
+		return errors.New("--username and --password-file are required")
+	}
+	if *dbPath == cfg.DBPath {
+		if err := checkAccountDir(cfg, *username); err != nil {
+			return err
+		}
+	}
+	if *fullName == "" {
+		*fullName = *username
+	}
+
+	password, err := readPasswordFile(*passwordFile)
+	if err != nil {
+		return err
+	}
+
+	store, err := storage.NewSQLiteStorage(*dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to open storage: %w", err)
+	}
+	defer store.Close()
+
+	user, err := provisionAccount(context.Background(), cfg, store, *username, password, *fullName)
+	if err != nil {
+		return err
+	}
+
+	i18n.Printf("✓ Created account %s (peer ID %s)\n", user.Username, user.PeerID)
+	return nil
+}
+
+// runAccountSplit handles `whisper account split`: it copies every account
+// in a shared database into its own directory, DataDir/<username>, holding
+// only that account's messages, friends, conferences and settings. One
+// account keeps the node identity; each other gets a new one, so its friends
+// are asked to trust it again. The shared database is left as it was.
+func runAccountSplit(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("account split", flag.ContinueOnError)
+	dbPath := fs.String("db", cfg.DBPath, "shared database to split")
+	keepIdentity := fs.String("keep-identity", "", "account that keeps the node identity (defaults to the oldest)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New(accountUsage)
+	}
+
+	ctx := context.Background()
+	store, err := storage.NewSQLiteStorage(*dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to open storage: %w", err)
+	}
+	defer store.Close()
+
+	accounts, err := store.GetLocalUsers(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list accounts: %w", err)
+	}
+	if len(accounts) == 0 {
+		return fmt.Errorf("no accounts in %s", *dbPath)
+	}
+
+	// Accounts with a key of their own take it along; only those bound to the
+	// node identity compete for it
+	ownKey := make(map[int64]bool)
+	var keeper *storage.User
+	for _, account := range accounts {
+		if err := config.CheckAccountName(account.Username); err != nil {
+			return fmt.Errorf("can't split out %s: %w", account.Username, err)
+		}
+		key, err := store.GetAccountKey(ctx, account.ID)
+		if err != nil {
+			return fmt.Errorf("failed to load %s's identity: %w", account.Username, err)
+		}
+		if key != nil {
+			clear(key)
+			ownKey[account.ID] = true
+			continue
+		}
+		if *keepIdentity != "" && strings.EqualFold(account.Username, *keepIdentity) {
+			keeper = account
+		}
+		if *keepIdentity == "" && (keeper == nil || account.ID < keeper.ID) {
+			keeper = account
+		}
+	}
+	if keeper == nil && *keepIdentity != "" {
+		return fmt.Errorf("no account %s bound to the node identity in %s", *keepIdentity, *dbPath)
+	}
+
+	for _, account := range accounts {
+		dest := absPath(config.AccountDBPath(cfg.DataDir, account.Username))
+		if _, err := os.Stat(dest); err == nil {
+			i18n.Printf("%s already has its own directory (%s); skipped\n", account.Username, filepath.Dir(dest))
+			continue
+		}
+		keeps := ownKey[account.ID] || (keeper != nil && account.ID == keeper.ID)
+		if err := store.ExportAccount(ctx, account.ID, dest, keeps); err != nil {
+			return fmt.Errorf("failed to split out %s: %w", account.Username, err)
+		}
+		if keeps {
+			i18n.Printf("✓ %s → %s (peer ID %s, unchanged)\n", account.Username, filepath.Dir(dest), account.PeerID)
+			continue
+		}
+		peerID, err := rebindIdentity(ctx, cfg, dest, account.ID)
+		if err != nil {
+			return fmt.Errorf("failed to give %s a new identity: %w", account.Username, err)
+		}
+		i18n.Printf("✓ %s → %s (new peer ID %s; friends confirm it with 'trust %s')\n", account.Username, filepath.Dir(dest), peerID, account.Username)
+	}
+
+	i18n.Println("Start each account with: whisper --account <username>")
+	i18n.Printf("%s was left as it was; remove it once every account works on its own\n", *dbPath)
+	return nil
+}
+
+// rebindIdentity creates a node identity in a split-out database that has
+// none and moves its account to the new peer ID
+func rebindIdentity(ctx context.Context, cfg *config.Config, dbPath string, userID int64) (string, error) {
+	store, err := storage.NewSQLiteStorage(dbPath)
+	if err != nil {
+		return "", err
+	}
+	defer store.Close()
+
+	identity, err := identityStore(cfg, store)
+	if err != nil {
+		return "", err
+	}
+	privKey, err := p2p.LoadOrCreateIdentity(ctx, identity)
+	if err != nil {
+		return "", err
+	}
+	peerID, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to derive peer ID: %w", err)
+	}
+	user, err := store.GetUserByID(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	user.PeerID = peerID.String()
+	if err := store.UpdateUser(ctx, user); err != nil {
+		return "", err
+	}
+	return user.PeerID, nil
+}
+
+// identityStore returns where the node identity in store is read and saved:
+// sealed with the passphrase in cfg.IdentityPassphraseFile if one is set
+func identityStore(cfg *config.Config, store p2p.IdentityStore) (p2p.IdentityStore, error) {
+	if cfg.IdentityPassphraseFile == "" {
+		return store, nil
+	}
+	passphrase, err := readPasswordFile(cfg.IdentityPassphraseFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the identity passphrase: %w", err)
+	}
+	return p2p.SealIdentity(store, passphrase), nil
+}
+
+// checkAccountDir refuses to put a second account in an account's own
+// directory, which holds that account alone
+func checkAccountDir(cfg *config.Config, username string) error {
+	if cfg.Account == "" || strings.EqualFold(username, cfg.Account) {
+		return nil
+	}
+	return fmt.Errorf("this is %s's data directory - start whisper with --account %s to give %s its own", cfg.Account, username, username)
+}
+
+// provisionAccount creates an account with an identity of its own. The first
+// account is bound to the node identity stored in store, creating that
+// identity if this is a fresh database; later ones get a key of their own, so
+// no two accounts share a peer ID. Guests, whose accounts only live as long
+// as the node, all share the node identity.
+func provisionAccount(ctx context.Context, cfg *config.Config, store storage.Storage, username, password, fullName string) (*storage.User, error) {
+	identity, err := identityStore(cfg, store)
+	if err != nil {
+		return nil, err
+	}
+	privKey, err := p2p.LoadOrCreateIdentity(ctx, identity)
+	if err != nil {
+		return nil, err
+	}
+	peerID, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive peer ID: %w", err)
+	}
+
+	accounts, err := store.GetLocalUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list accounts: %w", err)
+	}
+	bound := slices.ContainsFunc(accounts, func(account *storage.User) bool { return account.PeerID == peerID.String() })
+	if cfg.Guest || !bound {
+		return auth.NewAuthService(store).CreateAccount(ctx, username, password, fullName, peerID.String())
+	}
+
+	privKey, key, err := p2p.NewIdentity()
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	if peerID, err = peer.IDFromPrivateKey(privKey); err != nil {
+		return nil, fmt.Errorf("failed to derive peer ID: %w", err)
+	}
+	user, err := auth.NewAuthService(store).CreateAccount(ctx, username, password, fullName, peerID.String())
+	if err != nil {
+		return nil, err
+	}
+	identity, err = identityStore(cfg, accountKeyStore{store: store, userID: user.ID})
+	if err == nil {
+		err = identity.SaveIdentityKey(ctx, key)
+	}
+	if err != nil {
+		store.DeleteAccount(ctx, user.ID)
+		return nil, fmt.Errorf("failed to save the account's identity: %w", err)
+	}
+	return user, nil
+}
+
+// startIdentity returns the identity a node starts with: that of the account
+// it logs in to first, if that account has a key of its own, else the node
+// identity. owner is the account whose key it is, or 0 for the node identity.
+func startIdentity(ctx context.Context, cfg *config.Config, store storage.Storage, username string) (identity p2p.IdentityStore, owner int64, err error) {
+	if username != "" {
+		if user, err := store.GetUserByUsername(ctx, username); err == nil && !user.IsRemote() {
+			if owner, err = identityOwner(ctx, store, user); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	if owner == 0 {
+		identity, err = identityStore(cfg, store)
+	} else {
+		identity, err = identityStore(cfg, accountKeyStore{store: store, userID: owner})
+	}
+	return identity, owner, err
+}
+
+// identityOwner returns user.ID if the account has an identity key of its
+// own, or 0 if it uses the node identity
+func identityOwner(ctx context.Context, store storage.Storage, user *storage.User) (int64, error) {
+	key, err := store.GetAccountKey(ctx, user.ID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load %s's identity: %w", user.Username, err)
+	}
+	if key == nil {
+		return 0, nil
+	}
+	clear(key)
+	return user.ID, nil
+}
+
+// accountKeyStore is an identity store for one local account's own key
+type accountKeyStore struct {
+	store  storage.Storage
+	userID int64
+}
+
+func (k accountKeyStore) GetIdentityKey(ctx context.Context) ([]byte, error) {
+	return k.store.GetAccountKey(ctx, k.userID)
+}
+
+func (k accountKeyStore) SaveIdentityKey(ctx context.Context, key []byte) error {
+	return k.store.SaveAccountKey(ctx, k.userID, key)
+}
+
+// readPasswordFile reads a password from a file (or stdin for "-"), ignoring a trailing newline
+func readPasswordFile(path string) (string, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file: %w", err)
+	}
+
+	password := strings.TrimRight(string(data), "\r\n")
+	if password == "" {
+		return "", errors.New("password file is empty")
+	}
+	return password, nil
+}
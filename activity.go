@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+)
+
+const (
+	// awayLimit is how many entries the login summary shows
+	awayLimit = 10
+
+	// activityPageSize is how many entries each page of `activity` shows
+	activityPageSize = 20
+)
+
+// ActivityFeed returns a page of the current user's activity feed, newest
+// first, starting before beforeID (0 for the newest)
+func (a *App) ActivityFeed(ctx context.Context, beforeID int64, limit int) ([]*storage.Activity, error) {
+	user, err := a.auth.CurrentUser()
+	if err != nil {
+		return nil, err
+	}
+	return a.storage.GetActivityFeed(ctx, user.ID, beforeID, limit)
+}
+
+// CatchUpSummary counts what is waiting for the current user: unread
+// messages, friend requests, conferences with unread messages and activity
+// not seen yet
+func (a *App) CatchUpSummary(ctx context.Context) (*storage.CatchUpSummary, error) {
+	user, err := a.auth.CurrentUser()
+	if err != nil {
+		return nil, err
+	}
+	return a.storage.GetCatchUpSummary(ctx, user.ID)
+}
+
+// showAway summarizes what is waiting for the user and what happened since
+// they last looked at their activity feed, and marks the feed seen
+func (a *App) showAway(ctx context.Context, user *storage.User) {
+	summary, err := a.storage.GetCatchUpSummary(ctx, user.ID)
+	if err != nil {
+		i18n.Printf("Warning: Failed to load activity: %v\n", err)
+		return
+	}
+	if summary.Empty() {
+		return
+	}
+
+	i18n.Println("\n=== While You Were Away ===")
+	if summary.UnreadMessages > 0 {
+		i18n.Printf("📨 %d new message(s) from %d friend(s) - type 'unread'\n", summary.UnreadMessages, summary.UnreadFrom)
+	}
+	if summary.PendingRequests > 0 {
+		i18n.Printf("🤝 %d pending friend request(s) - type 'requests'\n", summary.PendingRequests)
+	}
+	if len(summary.Conferences) > 0 {
+		i18n.Printf("📢 Unread messages in %d conference(s):\n", len(summary.Conferences))
+		for _, conf := range summary.Conferences {
+			i18n.Printf("   %s (#%d): %d - 'conf-history %d'\n", conf.Name, conf.ConferenceID, conf.Unread, conf.ConferenceID)
+		}
+	}
+
+	unseen := summary.UnseenActivity
+	if unseen == 0 {
+		return
+	}
+	feed, err := a.storage.GetActivityFeed(ctx, user.ID, 0, min(unseen, awayLimit))
+	if err != nil || len(feed) == 0 {
+		return
+	}
+	i18n.Println()
+	for _, activity := range feed {
+		printActivity(activity)
+	}
+	if unseen > len(feed) {
+		i18n.Printf("...and %d more - type 'activity' to see everything\n", unseen-len(feed))
+	}
+	if err := a.storage.MarkActivitySeen(ctx, user.ID, feed[0].ID); err != nil {
+		i18n.Printf("Warning: Failed to mark activity as seen: %v\n", err)
+	}
+}
+
+// handleActivityCommand handles `activity [before-id]`, showing a page of the
+// activity feed and marking it seen
+func (a *App) handleActivityCommand(ctx context.Context, user *storage.User, parts []string) {
+	var beforeID int64
+	if len(parts) > 1 {
+		id, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || id <= 0 || len(parts) > 2 {
+			i18n.Println("Usage: activity [before-id]")
+			return
+		}
+		beforeID = id
+	}
+
+	feed, err := a.storage.GetActivityFeed(ctx, user.ID, beforeID, activityPageSize)
+	if err != nil {
+		i18n.Printf("Failed to get activity: %v\n", err)
+		return
+	}
+	if len(feed) == 0 {
+		i18n.Println("No activity")
+		return
+	}
+
+	i18n.Println("\n=== Activity ===")
+	for _, activity := range feed {
+		printActivity(activity)
+	}
+	if len(feed) == activityPageSize {
+		i18n.Printf("Older: activity %d\n", feed[len(feed)-1].ID)
+	}
+	if err := a.storage.MarkActivitySeen(ctx, user.ID, feed[0].ID); err != nil {
+		i18n.Printf("Warning: Failed to mark activity as seen: %v\n", err)
+	}
+}
+
+// printActivity prints one activity entry, with a dot on ones not seen yet
+func printActivity(activity *storage.Activity) {
+	mark := " "
+	if !activity.Seen {
+		mark = "●"
+	}
+	when := activity.CreatedAt.Local().Format("Jan 2 15:04")
+
+	switch activity.Kind {
+	case storage.ActivityFriendRequest:
+		i18n.Printf("%s %s  📨 %s sent you a friend request - 'accept %s' or 'reject %s'\n", mark, when, activity.Name, activity.Name, activity.Name)
+		if activity.Detail != "" {
+			i18n.Printf("   Message: %s\n", activity.Detail)
+		}
+	case storage.ActivityFriendAdded:
+		i18n.Printf("%s %s  🤝 You are now friends with %s\n", mark, when, activity.Name)
+	case storage.ActivityMissedMessages:
+		if activity.Count == 1 {
+			i18n.Printf("%s %s  📨 Message from %s: %s\n", mark, when, activity.Name, activity.Detail)
+		} else {
+			i18n.Printf("%s %s  📨 %d messages from %s, the latest: %s\n", mark, when, activity.Count, activity.Name, activity.Detail)
+		}
+	case storage.ActivityConferenceInvite:
+		i18n.Printf("%s %s  📢 %s invited you to '%s' - 'join-conf %d'\n", mark, when, activity.Name, activity.Detail, activity.ConferenceID)
+	}
+}
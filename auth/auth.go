@@ -4,7 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/austinwklein/whisper/p2p"
 	"github.com/austinwklein/whisper/storage"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -15,13 +19,24 @@ var (
 	ErrUserNotFound     = errors.New("user not found")
 	ErrNotAuthenticated = errors.New("not authenticated")
 	ErrWeakPassword     = errors.New("password must be at least 8 characters")
+	ErrAmbiguousUser    = errors.New("username is ambiguous")
+	ErrInvalidUsername  = fmt.Errorf("usernames must be 1-%d characters without spaces", p2p.MaxUsernameLength)
 )
 
+// maxUsernameSuggestions caps how many candidates are offered for an unknown username
+const maxUsernameSuggestions = 5
+
 // AuthService handles user authentication
 type AuthService struct {
 	storage       storage.Storage
 	currentUser   *storage.User
 	authenticated bool
+
+	lockMu        sync.Mutex // Guards the lock fields below; the auto-lock timer runs on its own goroutine
+	locked        bool       // Logged in but locked until the password or PIN is entered
+	pinHash       []byte     // Optional session PIN for unlocking
+	failedUnlocks int        // Wrong passwords or PINs entered in a row
+	unlockAfter   time.Time  // No unlock attempt is checked before this
 }
 
 // NewAuthService creates a new authentication service
@@ -34,36 +49,43 @@ func NewAuthService(store storage.Storage) *AuthService {
 
 // Register creates a new user account
 func (a *AuthService) Register(ctx context.Context, username, password, fullName, peerID string) error {
+	_, err := a.CreateAccount(ctx, username, password, fullName, peerID)
+	return err
+}
+
+// CreateAccount creates a new user account bound to peerID and returns it.
+// It needs no login or running host, so scripts can provision accounts headlessly.
+func (a *AuthService) CreateAccount(ctx context.Context, username, password, fullName, peerID string) (*storage.User, error) {
 	// Validate input
 	if username == "" {
-		return errors.New("username is required")
+		return nil, errors.New("username is required")
 	}
 	if password == "" {
-		return errors.New("password is required")
+		return nil, errors.New("password is required")
 	}
 	if len(password) < 8 {
-		return ErrWeakPassword
+		return nil, ErrWeakPassword
 	}
 	if fullName == "" {
-		return errors.New("full name is required")
+		return nil, errors.New("full name is required")
 	}
 	if peerID == "" {
-		return errors.New("peer ID is required")
+		return nil, errors.New("peer ID is required")
 	}
 
 	// Check if user already exists
-	existingUser, err := a.storage.GetUserByUsername(ctx, username)
-	if err != nil {
-		return fmt.Errorf("failed to check user existence: %w", err)
+	_, err := a.storage.GetUserByUsername(ctx, username)
+	if err == nil {
+		return nil, ErrUserExists
 	}
-	if existingUser != nil {
-		return ErrUserExists
+	if !errors.Is(err, storage.ErrNotFound) {
+		return nil, fmt.Errorf("failed to check user existence: %w", err)
 	}
 
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return fmt.Errorf("failed to hash password: %w", err)
+		return nil, fmt.Errorf("failed to hash password: %w", err)
 	}
 
 	// Create user
@@ -75,22 +97,26 @@ func (a *AuthService) Register(ctx context.Context, username, password, fullName
 	}
 
 	if err := a.storage.CreateUser(ctx, user); err != nil {
-		return fmt.Errorf("failed to create user: %w", err)
+		return nil, fmt.Errorf("failed to create user: %w", err)
 	}
 
-	return nil
+	return user, nil
 }
 
 // Login authenticates a user
 func (a *AuthService) Login(ctx context.Context, username, password string) (*storage.User, error) {
 	// Get user from storage
 	user, err := a.storage.GetUserByUsername(ctx, username)
+	if errors.Is(err, storage.ErrNotFound) {
+		// The account may have been renamed recently
+		user, err = a.storage.GetUserByAlias(ctx, username)
+		if errors.Is(err, storage.ErrNotFound) || (err == nil && user.IsRemote()) {
+			return nil, ErrUserNotFound
+		}
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
-	if user == nil {
-		return nil, ErrUserNotFound
-	}
 
 	// Verify password
 	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
@@ -109,6 +135,11 @@ func (a *AuthService) Login(ctx context.Context, username, password string) (*st
 func (a *AuthService) Logout() {
 	a.currentUser = nil
 	a.authenticated = false
+
+	a.lockMu.Lock()
+	a.unlock()
+	a.pinHash = nil
+	a.lockMu.Unlock()
 }
 
 // CurrentUser returns the currently authenticated user
@@ -156,15 +187,73 @@ func (a *AuthService) ChangePassword(ctx context.Context, oldPassword, newPasswo
 	return nil
 }
 
+// ChangeUsername renames the logged-in account. Its old username keeps
+// resolving to it for storage.UsernameAliasLifetime, while friends catch up.
+func (a *AuthService) ChangeUsername(ctx context.Context, username string) error {
+	if !a.authenticated {
+		return ErrNotAuthenticated
+	}
+	if username == "" || len(username) > p2p.MaxUsernameLength || strings.ContainsAny(username, " \t") {
+		return ErrInvalidUsername
+	}
+	if username == a.currentUser.Username {
+		return nil
+	}
+
+	err := a.storage.RenameAccount(ctx, a.currentUser.ID, username)
+	if errors.Is(err, storage.ErrHandleTaken) {
+		return ErrUserExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rename account: %w", err)
+	}
+	a.currentUser.Username = username
+	return nil
+}
+
+// CheckPassword verifies the current user's password, for confirming
+// actions that can't be undone
+func (a *AuthService) CheckPassword(password string) error {
+	if !a.authenticated || a.currentUser == nil {
+		return ErrNotAuthenticated
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(a.currentUser.PasswordHash), []byte(password)); err != nil {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// DeleteAccount deletes the logged-in account and everything stored for it,
+// then logs out. The password is asked for again to confirm.
+func (a *AuthService) DeleteAccount(ctx context.Context, password string) error {
+	if err := a.CheckPassword(password); err != nil {
+		return err
+	}
+	if err := a.storage.DeleteAccount(ctx, a.currentUser.ID); err != nil {
+		return fmt.Errorf("failed to delete account: %w", err)
+	}
+	a.Logout()
+	return nil
+}
+
+// LocalAccounts returns the accounts that can log in on this node
+func (a *AuthService) LocalAccounts(ctx context.Context) ([]*storage.User, error) {
+	users, err := a.storage.GetLocalUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list accounts: %w", err)
+	}
+	return users, nil
+}
+
 // GetUserByPeerID retrieves a user by their peer ID
 func (a *AuthService) GetUserByPeerID(ctx context.Context, peerID string) (*storage.User, error) {
 	user, err := a.storage.GetUserByPeerID(ctx, peerID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrUserNotFound
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user by peer ID: %w", err)
 	}
-	if user == nil {
-		return nil, ErrUserNotFound
-	}
 	return user, nil
 }
 
@@ -180,3 +269,54 @@ func (a *AuthService) SearchUsers(ctx context.Context, name string) ([]*storage.
 	}
 	return users, nil
 }
+
+// ResolveUsername finds the user a typed username refers to. An exact match wins;
+// otherwise the name is matched ignoring case. Returns ErrAmbiguousUser when
+// several accounts differ only by case, and ErrUserNotFound (with prefix
+// suggestions, if any) when nothing matches.
+func (a *AuthService) ResolveUsername(ctx context.Context, name string) (*storage.User, error) {
+	user, err := a.storage.GetUserByUsername(ctx, name)
+	switch {
+	case err == nil:
+		return user, nil
+	case !errors.Is(err, storage.ErrNotFound):
+		return nil, fmt.Errorf("failed to look up user: %w", err)
+	}
+
+	// A username given up in a recent rename still finds its owner
+	user, err = a.storage.GetUserByAlias(ctx, name)
+	switch {
+	case err == nil:
+		return user, nil
+	case !errors.Is(err, storage.ErrNotFound):
+		return nil, fmt.Errorf("failed to look up user: %w", err)
+	}
+
+	matches, err := a.storage.GetUsersByUsernameFold(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up user: %w", err)
+	}
+	switch len(matches) {
+	case 1:
+		return matches[0], nil
+	case 0:
+		// fall through to suggestions below
+	default:
+		return nil, fmt.Errorf("%w: '%s' could be %s", ErrAmbiguousUser, name, joinUsernames(matches))
+	}
+
+	suggestions, err := a.storage.SearchUsersByUsernamePrefix(ctx, name, maxUsernameSuggestions)
+	if err != nil || len(suggestions) == 0 {
+		return nil, ErrUserNotFound
+	}
+	return nil, fmt.Errorf("%w: did you mean %s?", ErrUserNotFound, joinUsernames(suggestions))
+}
+
+// joinUsernames formats usernames as a readable list
+func joinUsernames(users []*storage.User) string {
+	names := make([]string, len(users))
+	for i, user := range users {
+		names[i] = user.Username
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// minPINLength is the shortest PIN accepted for unlocking
+	minPINLength = 6
+
+	// maxPINAttempts is how many failed unlocks in a row turn the PIN off,
+	// leaving only the account password
+	maxPINAttempts = 5
+
+	// unlockDelay is how long the first failed unlock blocks the next
+	// attempt; each further failure doubles it, up to maxUnlockDelay
+	unlockDelay    = time.Second
+	maxUnlockDelay = 5 * time.Minute
+)
+
+var (
+	ErrLocked      = errors.New("app is locked")
+	ErrNotLocked   = errors.New("app is not locked")
+	ErrInvalidPIN  = fmt.Errorf("PIN must be at least %d characters", minPINLength)
+	ErrUnlockWait  = errors.New("too many failed attempts")
+	ErrPINDisabled = errors.New("too many failed attempts; the PIN no longer unlocks, use the account password")
+)
+
+// now returns the current time; tests replace it
+var now = time.Now
+
+// Lock locks the session; the user stays logged in but must unlock to continue
+func (a *AuthService) Lock() error {
+	a.lockMu.Lock()
+	defer a.lockMu.Unlock()
+
+	if !a.authenticated || a.currentUser == nil {
+		return ErrNotAuthenticated
+	}
+	a.locked = true
+	return nil
+}
+
+// Unlock resumes a locked session using the account password or the lock PIN.
+// Each failure makes the next attempt wait longer, and after maxPINAttempts
+// failures in a row the PIN is dropped so only the password works.
+func (a *AuthService) Unlock(secret string) error {
+	a.lockMu.Lock()
+	defer a.lockMu.Unlock()
+
+	if !a.locked {
+		return ErrNotLocked
+	}
+	if wait := a.unlockAfter.Sub(now()); wait > 0 {
+		return fmt.Errorf("%w; try again in %s", ErrUnlockWait, wait.Round(time.Second))
+	}
+
+	if a.pinHash != nil && bcrypt.CompareHashAndPassword(a.pinHash, []byte(secret)) == nil {
+		a.unlock()
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(a.currentUser.PasswordHash), []byte(secret)) == nil {
+		a.unlock()
+		return nil
+	}
+
+	a.failedUnlocks++
+	a.unlockAfter = now().Add(unlockBackoff(a.failedUnlocks))
+	if a.pinHash != nil && a.failedUnlocks >= maxPINAttempts {
+		a.pinHash = nil
+		return ErrPINDisabled
+	}
+	return ErrInvalidPassword
+}
+
+// unlock clears the lock and the failed attempts; lockMu must be held
+func (a *AuthService) unlock() {
+	a.locked = false
+	a.failedUnlocks = 0
+	a.unlockAfter = time.Time{}
+}
+
+// unlockBackoff returns how long to refuse unlocking after the given number
+// of failures in a row
+func unlockBackoff(failures int) time.Duration {
+	delay := unlockDelay
+	for i := 1; i < failures && delay < maxUnlockDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxUnlockDelay)
+}
+
+// IsLocked returns true while the session is locked
+func (a *AuthService) IsLocked() bool {
+	a.lockMu.Lock()
+	defer a.lockMu.Unlock()
+	return a.locked
+}
+
+// SetLockPIN sets a PIN that can unlock the session instead of the password.
+// The PIN only lives in memory for this session; an empty PIN removes it.
+func (a *AuthService) SetLockPIN(pin string) error {
+	a.lockMu.Lock()
+	defer a.lockMu.Unlock()
+
+	if !a.authenticated || a.currentUser == nil {
+		return ErrNotAuthenticated
+	}
+	if a.locked {
+		return ErrLocked
+	}
+	if pin == "" {
+		a.pinHash = nil
+		return nil
+	}
+	if len(pin) < minPINLength {
+		return ErrInvalidPIN
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(pin), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	a.pinHash = hash
+	return nil
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/austinwklein/whisper/storage"
+)
+
+const (
+	testPassword = "correct horse"
+	testPIN      = "482916"
+)
+
+// newLockedSession logs alice in with a PIN set, locks the session and
+// returns it with a clock the test moves by hand
+func newLockedSession(t *testing.T) (*AuthService, *time.Time) {
+	t.Helper()
+	store, err := storage.NewMemoryStorage()
+	if err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	clock := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	saved := now
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = saved })
+
+	a := NewAuthService(store)
+	ctx := context.Background()
+	if _, err := a.CreateAccount(ctx, "alice", testPassword, "Alice", "peer-alice"); err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+	if _, err := a.Login(ctx, "alice", testPassword); err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	if err := a.SetLockPIN(testPIN); err != nil {
+		t.Fatalf("failed to set PIN: %v", err)
+	}
+	if err := a.Lock(); err != nil {
+		t.Fatalf("failed to lock: %v", err)
+	}
+	return a, &clock
+}
+
+func TestSetLockPINLength(t *testing.T) {
+	a, _ := newLockedSession(t)
+	if err := a.SetLockPIN("123456"); !errors.Is(err, ErrLocked) {
+		t.Errorf("setting a PIN while locked = %v, want ErrLocked", err)
+	}
+	if err := a.Unlock(testPIN); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+
+	for _, pin := range []string{"1", "1234", "12345"} {
+		if err := a.SetLockPIN(pin); !errors.Is(err, ErrInvalidPIN) {
+			t.Errorf("SetLockPIN(%q) = %v, want ErrInvalidPIN", pin, err)
+		}
+	}
+	if err := a.SetLockPIN("123456"); err != nil {
+		t.Errorf("SetLockPIN of %d characters: %v", minPINLength, err)
+	}
+}
+
+func TestUnlockBacksOff(t *testing.T) {
+	a, clock := newLockedSession(t)
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+	for i, delay := range want {
+		if err := a.Unlock("000000"); !errors.Is(err, ErrInvalidPassword) {
+			t.Fatalf("wrong PIN %d = %v, want ErrInvalidPassword", i+1, err)
+		}
+		// Even the right PIN is refused until the delay has passed
+		*clock = clock.Add(delay - time.Millisecond)
+		if err := a.Unlock(testPIN); !errors.Is(err, ErrUnlockWait) {
+			t.Fatalf("attempt %s after failure %d = %v, want ErrUnlockWait", delay-time.Millisecond, i+1, err)
+		}
+		*clock = clock.Add(time.Millisecond)
+	}
+	if !a.IsLocked() {
+		t.Fatal("unlocked by a refused attempt")
+	}
+
+	if err := a.Unlock(testPIN); err != nil {
+		t.Fatalf("unlock after waiting: %v", err)
+	}
+	if err := a.Lock(); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	if err := a.Unlock("000000"); !errors.Is(err, ErrInvalidPassword) {
+		t.Fatalf("wrong PIN = %v", err)
+	}
+	*clock = clock.Add(time.Second)
+	if err := a.Unlock(testPIN); err != nil {
+		t.Errorf("a successful unlock didn't reset the delay: %v", err)
+	}
+}
+
+func TestUnlockDisablesPINAfterFailures(t *testing.T) {
+	a, clock := newLockedSession(t)
+
+	for i := 1; i <= maxPINAttempts; i++ {
+		err := a.Unlock("000000")
+		*clock = clock.Add(maxUnlockDelay)
+		if i < maxPINAttempts && !errors.Is(err, ErrInvalidPassword) {
+			t.Fatalf("failure %d = %v, want ErrInvalidPassword", i, err)
+		}
+		if i == maxPINAttempts && !errors.Is(err, ErrPINDisabled) {
+			t.Fatalf("failure %d = %v, want ErrPINDisabled", i, err)
+		}
+	}
+
+	if err := a.Unlock(testPIN); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("right PIN after the cap = %v, want ErrInvalidPassword", err)
+	}
+	*clock = clock.Add(maxUnlockDelay)
+	if err := a.Unlock(testPassword); err != nil {
+		t.Fatalf("password after the cap: %v", err)
+	}
+	if a.IsLocked() {
+		t.Error("still locked after the password was entered")
+	}
+}
+
+func TestUnlockBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{5, 16 * time.Second},
+		{9, 256 * time.Second},
+		{10, maxUnlockDelay},
+		{1000, maxUnlockDelay},
+	}
+	for _, tt := range tests {
+		if got := unlockBackoff(tt.failures); got != tt.want {
+			t.Errorf("unlockBackoff(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Auto-dial modes, from most to least eager
+const (
+	autoDialNormal    = "normal"    // Dial on login, on send and after drops; known addresses, then DHT, then relays
+	autoDialBandwidth = "bandwidth" // As normal, but only at known addresses
+	autoDialBattery   = "battery"   // Dial only when sending a message
+	autoDialOff       = "off"       // Never dial automatically
+)
+
+var autoDialModes = []string{autoDialNormal, autoDialBandwidth, autoDialBattery, autoDialOff}
+
+// What prompted an automatic dial
+const (
+	dialOnLogin   = "login"   // The user logged in
+	dialOnCompose = "compose" // The user sent the friend a message
+	dialOnRedial  = "redial"  // The friend's connection was found dead
+)
+
+// autoDialTimeout bounds each route tried for one friend
+const autoDialTimeout = 15 * time.Second
+
+// composeDialTimeout bounds the whole dial made while sending, which the user waits for
+const composeDialTimeout = 20 * time.Second
+
+// errNoRoute is returned when every allowed route to a friend failed or there was none
+var errNoRoute = errors.New("no route to friend")
+
+// validAutoDialMode reports whether mode is one of the auto-dial modes
+func validAutoDialMode(mode string) bool {
+	for _, m := range autoDialModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// autoDialMode returns the current auto-dial mode
+func (a *App) autoDialMode() string {
+	a.autoDialMu.Lock()
+	defer a.autoDialMu.Unlock()
+	return a.dialMode
+}
+
+// setAutoDialMode switches the auto-dial mode; the autodial_mode setting
+// calls it whenever it changes
+func (a *App) setAutoDialMode(mode string) error {
+	if !validAutoDialMode(mode) {
+		return fmt.Errorf("unknown mode %q (want %s)", mode, strings.Join(autoDialModes, ", "))
+	}
+	a.autoDialMu.Lock()
+	defer a.autoDialMu.Unlock()
+	a.dialMode = mode
+	return nil
+}
+
+// autoDialAllowed reports whether the policy lets trigger dial friend
+func (a *App) autoDialAllowed(friend *storage.Friend, trigger string) bool {
+	if !friend.AutoDial {
+		return false
+	}
+	switch a.autoDialMode() {
+	case autoDialNormal, autoDialBandwidth:
+		return true
+	case autoDialBattery:
+		return trigger == dialOnCompose
+	default:
+		return false
+	}
+}
+
+// dialFriend tries to connect a friend over each route the mode allows,
+// cheapest first: addresses earlier dials worked on, the addresses they last
+// advertised, a DHT lookup, then a circuit through each configured relay they
+// are registered at. A relayed connection is limited, but lets hole punching
+// upgrade it to a direct one.
+func (a *App) dialFriend(ctx context.Context, friend *storage.Friend) error {
+	pid, err := peer.Decode(friend.PeerID)
+	if err != nil {
+		return fmt.Errorf("invalid peer ID: %w", err)
+	}
+	if a.p2p.IsConnected(pid) {
+		return nil
+	}
+	mode := a.autoDialMode()
+
+	lastErr := errNoRoute
+	confirmed, advertised := a.dialAddrs(ctx, pid)
+	for _, addrs := range [][]string{confirmed, advertised} {
+		if len(addrs) == 0 {
+			continue
+		}
+		dialCtx, cancel := context.WithTimeout(ctx, autoDialTimeout)
+		lastErr = a.p2p.ConnectToKnownPeer(dialCtx, pid, addrs)
+		cancel()
+		if lastErr == nil {
+			return nil
+		}
+	}
+	if mode == autoDialBandwidth {
+		return lastErr
+	}
+
+	// Without addresses ConnectToKnownPeer looks the peer up on the DHT
+	dialCtx, cancel := context.WithTimeout(ctx, autoDialTimeout)
+	lastErr = a.p2p.ConnectToKnownPeer(dialCtx, pid, nil)
+	cancel()
+	if lastErr == nil {
+		return nil
+	}
+
+	contact, err := a.storage.GetUserByID(ctx, friend.FriendID)
+	if err != nil {
+		return lastErr
+	}
+	for _, address := range a.rendezvousManager.Addresses(contact.RemoteName()) {
+		dialCtx, cancel := context.WithTimeout(ctx, autoDialTimeout)
+		info, err := a.rendezvousManager.Resolve(dialCtx, address)
+		if err == nil && info.ID != pid {
+			err = fmt.Errorf("%s now belongs to a different peer", address)
+		}
+		if err == nil {
+			err = a.p2p.Host().Connect(network.WithAllowLimitedConn(dialCtx, "auto-dial"), info)
+		}
+		cancel()
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+// dialAddrs returns the addresses to dial a peer on: those earlier dials
+// worked on, most recently successful first, and the others it last advertised
+func (a *App) dialAddrs(ctx context.Context, pid peer.ID) (confirmed, advertised []string) {
+	seen := make(map[string]bool)
+	if addrs, err := a.storage.GetDialAddrs(ctx, pid.String()); err == nil {
+		for _, addr := range addrs {
+			seen[addr.Addr] = true
+			confirmed = append(confirmed, addr.Addr)
+		}
+	}
+
+	var known []string
+	if peer, err := a.storage.GetKnownPeer(ctx, pid.String()); err == nil && peer != nil {
+		json.Unmarshal([]byte(peer.Addrs), &known)
+	}
+	for _, addr := range known {
+		if !seen[addr] {
+			seen[addr] = true
+			advertised = append(advertised, addr)
+		}
+	}
+	return confirmed, advertised
+}
+
+// friendByPeer returns the logged-in user's friendship with the owner of pid,
+// or nil if there is none
+func (a *App) friendByPeer(ctx context.Context, pid peer.ID) *storage.Friend {
+	user, err := a.auth.CurrentUser()
+	if err != nil || user == nil {
+		return nil
+	}
+	contact, err := a.storage.GetUserByPeerID(ctx, pid.String())
+	if err != nil {
+		return nil
+	}
+	friend, err := a.storage.GetFriendRequest(ctx, user.ID, contact.ID)
+	if err != nil || friend == nil || friend.Status != "accepted" {
+		return nil
+	}
+	return friend
+}
+
+// dialBeforeSend is the message manager's dial handler: it tries to connect an
+// offline friend the user is messaging, if the policy allows
+func (a *App) dialBeforeSend(ctx context.Context, contact *storage.User) bool {
+	pid, err := peer.Decode(contact.PeerID)
+	if err != nil {
+		return false
+	}
+	friend := a.friendByPeer(ctx, pid)
+	if friend == nil || !a.autoDialAllowed(friend, dialOnCompose) {
+		return false
+	}
+
+	i18n.Printf("Dialing %s...\n", contact.Username)
+	dialCtx, cancel := context.WithTimeout(ctx, composeDialTimeout)
+	defer cancel()
+	return a.dialFriend(dialCtx, friend) == nil
+}
+
+// showAutoDial prints the auto-dial mode and the friends excluded from it
+func (a *App) showAutoDial(ctx context.Context, user *storage.User) {
+	i18n.Printf("Auto-dial mode: %s\n", a.autoDialMode())
+
+	friendList, err := a.friendManager.GetFriends(ctx, user.ID)
+	if err != nil {
+		i18n.Printf("Failed to load friends: %v\n", err)
+		return
+	}
+	var excluded []string
+	for _, friend := range friendList {
+		if !friend.AutoDial {
+			excluded = append(excluded, friend.Username)
+		}
+	}
+	if len(excluded) > 0 {
+		i18n.Printf("Never dialed automatically: %s\n", strings.Join(excluded, ", "))
+	}
+	i18n.Println("Usage: autodial mode <normal|bandwidth|battery|off>")
+	i18n.Println("       autodial <on|off> <username>")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+)
+
+// acceptAllRequests handles `accept --all`
+func (a *App) acceptAllRequests(ctx context.Context, user *storage.User) {
+	accepted, err := a.friendManager.AcceptAllFriendRequests(ctx, user)
+	if err != nil {
+		i18n.Printf("Failed to accept friend request: %v\n", err)
+		return
+	}
+	if len(accepted) == 0 {
+		i18n.Println("No pending friend requests")
+		return
+	}
+	i18n.Printf("✓ Accepted %d friend request(s):\n", len(accepted))
+	for _, request := range accepted {
+		i18n.Printf("  %s (%s)\n", request.FullName, request.Username)
+	}
+}
+
+// rejectAllRequests handles `reject --all`
+func (a *App) rejectAllRequests(ctx context.Context, user *storage.User) {
+	rejected, err := a.friendManager.RejectAllFriendRequests(ctx, user)
+	if err != nil {
+		i18n.Printf("Failed to reject friend request: %v\n", err)
+		return
+	}
+	if len(rejected) == 0 {
+		i18n.Println("No pending friend requests")
+		return
+	}
+	i18n.Printf("✓ Rejected %d friend request(s):\n", len(rejected))
+	for _, request := range rejected {
+		i18n.Printf("  %s (%s)\n", request.FullName, request.Username)
+	}
+}
+
+// handleMarkReadCommand handles `mark-read <username|conf-id>`, marking a
+// whole conversation or conference read without showing it
+func (a *App) handleMarkReadCommand(ctx context.Context, user *storage.User, parts []string) {
+	if len(parts) != 2 {
+		i18n.Println("Usage: mark-read <username|conf-id>")
+		return
+	}
+
+	if conf, err := a.conferenceByArg(ctx, parts[1]); err == nil {
+		if err := a.conferenceManager.MarkRead(ctx, user.ID, conf.ID); err != nil {
+			i18n.Printf("Failed to mark messages as read: %v\n", err)
+			return
+		}
+		i18n.Printf("✓ Marked '%s' as read\n", conf.Name)
+		return
+	}
+
+	username, ok := a.resolveUsername(ctx, parts[1])
+	if !ok {
+		return
+	}
+	if err := a.messageManager.MarkAsRead(ctx, user, username); err != nil {
+		i18n.Printf("Failed to mark messages as read: %v\n", err)
+		return
+	}
+	i18n.Printf("✓ Marked messages from %s as read\n", username)
+}
+
+// handleDeleteChatCommand handles `delete-chat <username>`, hiding a whole
+// conversation from the user's history
+func (a *App) handleDeleteChatCommand(ctx context.Context, user *storage.User, parts []string) {
+	if len(parts) != 2 {
+		i18n.Println("Usage: delete-chat <username>")
+		i18n.Println("Hides the whole conversation from your history only (the other person keeps it)")
+		return
+	}
+	username, ok := a.resolveUsername(ctx, parts[1])
+	if !ok {
+		return
+	}
+	contact, err := a.storage.GetUserByUsername(ctx, username)
+	if err != nil {
+		i18n.Printf("User not found: %v\n", err)
+		return
+	}
+
+	hidden, err := a.messageManager.DeleteConversation(ctx, user.ID, contact.ID)
+	if err != nil {
+		i18n.Printf("Failed to delete conversation: %v\n", err)
+		return
+	}
+	i18n.Printf("✓ Deleted %d message(s) with %s for you\n", hidden, contact.Username)
+}
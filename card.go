@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/skip2/go-qrcode"
+)
+
+// maxCardAddrs caps how many addresses the identity card lists
+const maxCardAddrs = 3
+
+// printIdentityCard prints a card a user can paste or show to friends: who they
+// are, how to reach them, and a QR code of the best address for 'connect'
+func (a *App) printIdentityCard(user *storage.User) {
+	reach := a.p2p.Reachability()
+
+	lines := []string{
+		i18n.T("Whisper identity card"),
+		"",
+		i18n.Sprintf("Name:        %s (@%s)", user.FullName, user.Username),
+		i18n.Sprintf("Peer ID:     %s", reach.PeerID),
+	}
+	if reach.Fingerprint != "" {
+		lines = append(lines, i18n.Sprintf("Fingerprint: %s", reach.Fingerprint))
+	}
+
+	for _, address := range a.rendezvousManager.Addresses(user.Username) {
+		lines = append(lines, i18n.Sprintf("Add me as:   %s", address))
+	}
+
+	switch {
+	case reach.Public:
+		lines = append(lines, i18n.T("Reachable:   publicly"))
+	case reach.Relayed:
+		lines = append(lines, i18n.T("Reachable:   through a relay"))
+	default:
+		lines = append(lines, i18n.T("Reachable:   local network only"))
+	}
+
+	addrs := reach.Addrs
+	if len(addrs) > maxCardAddrs {
+		addrs = addrs[:maxCardAddrs]
+	}
+	if len(addrs) > 0 {
+		lines = append(lines, "", i18n.T("Connect with:"))
+		for _, addr := range addrs {
+			lines = append(lines, "  "+addr)
+		}
+	}
+
+	width := 0
+	for _, line := range lines {
+		if n := len([]rune(line)); n > width {
+			width = n
+		}
+	}
+	rule := strings.Repeat("─", width+2)
+	i18n.Printf("╭%s╮\n", rule)
+	for _, line := range lines {
+		i18n.Printf("│ %s%s │\n", line, strings.Repeat(" ", width-len([]rune(line))))
+	}
+	i18n.Printf("╰%s╯\n", rule)
+
+	if len(addrs) == 0 {
+		i18n.Println("No listen addresses yet - try again once the node is connected")
+		return
+	}
+
+	qr, err := qrcode.New(addrs[0], qrcode.Low)
+	if err != nil {
+		i18n.Printf("Warning: Failed to render QR code: %v\n", err)
+		return
+	}
+	i18n.Print(qrString(qr))
+	i18n.Println("Scan or paste the first address, then run: connect <address>")
+}
+
+// qrString renders a QR code for the terminal: half blocks normally, or two
+// characters per module in ASCII mode, where the blocks can't be shown
+func qrString(qr *qrcode.QRCode) string {
+	if !i18n.ASCII() {
+		return qr.ToSmallString(false)
+	}
+	var b strings.Builder
+	for _, row := range qr.Bitmap() {
+		for _, dark := range row {
+			if dark {
+				b.WriteString("##")
+			} else {
+				b.WriteString("  ")
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// printConnectString prints a line a friend can paste straight into whisper,
+// followed by the other shareable addresses, best first
+func printConnectString(h *p2p.P2PHost) {
+	addrs := h.ShareableAddrs()
+	if len(addrs) == 0 {
+		i18n.Println("\nNo listen addresses yet")
+		return
+	}
+
+	i18n.Println("\nShare this with a friend:")
+	i18n.Printf("  connect %s\n", addrs[0])
+	if len(addrs) > 1 {
+		i18n.Println("Other addresses:")
+		for _, addr := range addrs[1:] {
+			i18n.Printf("  %s\n", addr)
+		}
+	}
+}
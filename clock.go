@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// checkPeerClock measures how far a newly identified peer's clock is from
+// ours and warns when a contact's is badly off. Their message times are
+// corrected either way (see p2p.NormalizeTimestamp).
+func (a *App) checkPeerClock(ctx context.Context, pid peer.ID) {
+	skew, err := a.p2p.MeasureClockSkew(ctx, pid)
+	if err != nil || (skew <= p2p.ClockSkewTolerance && skew >= -p2p.ClockSkewTolerance) {
+		return // Older peers don't answer; close enough needs no warning
+	}
+
+	contact, err := a.storage.GetUserByPeerID(ctx, pid.String())
+	if err != nil || !contact.IsRemote() {
+		return
+	}
+	if skew > 0 {
+		i18n.Printf("\n⚠️  %s's clock is %s ahead of yours; times on their messages are adjusted\n> ", contact.Username, skew.Round(time.Second))
+	} else {
+		i18n.Printf("\n⚠️  %s's clock is %s behind yours; times on their messages are adjusted\n> ", contact.Username, (-skew).Round(time.Second))
+	}
+}
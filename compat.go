@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+)
+
+// checkPeerCompatibility warns when a newly identified contact's node doesn't
+// speak a protocol whisper can't work without, naming the release it runs.
+// Each contact is warned about once per version it runs.
+func (a *App) checkPeerCompatibility(ctx context.Context, info *p2p.PeerInfo) {
+	missing := a.p2p.MissingProtocols(info.ID)
+	if len(missing) == 0 {
+		return
+	}
+
+	contact, err := a.storage.GetUserByPeerID(ctx, info.ID.String())
+	if err != nil || !contact.IsRemote() {
+		return
+	}
+
+	a.compatMu.Lock()
+	warned, ok := a.compatWarned[info.ID.String()]
+	a.compatWarned[info.ID.String()] = info.Version
+	a.compatMu.Unlock()
+	if ok && warned == info.Version {
+		return
+	}
+
+	names := make([]string, len(missing))
+	for i, id := range missing {
+		names[i] = string(id)
+	}
+	if info.Version == "" {
+		i18n.Printf("\n⚠️  %s runs an older Whisper that doesn't speak %s - ask them to update\n> ", contact.Username, strings.Join(names, ", "))
+		return
+	}
+	i18n.Printf("\n⚠️  %s runs Whisper %s, which doesn't speak %s - ask them to update\n> ", contact.Username, info.Version, strings.Join(names, ", "))
+}
+
+// peerVersion describes the Whisper release and platform a peer last
+// identified with, for listings
+func peerVersion(version, platform string) string {
+	switch {
+	case version == "":
+		return i18n.T("unknown version")
+	case platform == "":
+		return version
+	}
+	return version + " (" + platform + ")"
+}
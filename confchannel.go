@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/austinwklein/whisper/conference"
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+)
+
+// confChannelUsage lists the conf-channel subcommands
+const confChannelUsage = `Usage:
+  conf-channel create <conf-id> <name>
+  conf-channel list <conf-id>
+  conf-channel msg <conf-id> <name> <message>
+  conf-channel history <conf-id> <name> [limit]`
+
+// runConfChannel handles the conf-channel subcommands
+func (a *App) runConfChannel(ctx context.Context, currentUser *storage.User, args []string) {
+	if len(args) < 2 {
+		i18n.Println(confChannelUsage)
+		return
+	}
+
+	var confID int64
+	if _, err := fmt.Sscanf(args[1], "%d", &confID); err != nil {
+		i18n.Println(confChannelUsage)
+		return
+	}
+	conf, err := a.storage.GetConference(ctx, confID)
+	if err != nil {
+		i18n.Printf("Conference not found\n")
+		return
+	}
+
+	switch args[0] {
+	case "create":
+		if len(args) < 3 {
+			i18n.Println("Usage: conf-channel create <conf-id> <name>")
+			return
+		}
+		name := strings.TrimPrefix(args[2], "#")
+		if err := a.conferenceManager.CreateChannel(ctx, currentUser, confID, name); err != nil {
+			i18n.Printf("Failed to create channel: %v\n", err)
+			return
+		}
+		i18n.Printf("✓ Channel #%s created in '%s'\n", name, conf.Name)
+
+	case "list":
+		channels, err := a.conferenceManager.GetChannels(ctx, confID)
+		if err != nil {
+			i18n.Printf("Failed to get channels: %v\n", err)
+			return
+		}
+		i18n.Printf("Channels in '%s' (%d):\n", conf.Name, len(channels)+1)
+		i18n.Printf("  #%s (use conf-msg / conf-history)\n", conference.MainChannelName)
+		for _, ch := range channels {
+			i18n.Printf("  #%s\n", ch.Name)
+		}
+
+	case "msg":
+		if len(args) < 4 {
+			i18n.Println("Usage: conf-channel msg <conf-id> <name> <message>")
+			return
+		}
+		name := strings.TrimPrefix(args[2], "#")
+		message := strings.Join(args[3:], " ")
+		err := a.conferenceManager.SendChannelMessage(ctx, currentUser, confID, name, message)
+		if errors.Is(err, conference.ErrRateLimited) {
+			i18n.Printf("⏱️  %v\n", err)
+			return
+		}
+		if err != nil {
+			i18n.Printf("Failed to send message: %v\n", err)
+			return
+		}
+		i18n.Printf("✓ Message sent to #%s\n", name)
+
+	case "history":
+		if len(args) < 3 {
+			i18n.Println("Usage: conf-channel history <conf-id> <name> [limit]")
+			return
+		}
+		display := strings.TrimPrefix(args[2], "#")
+		name := display
+		if name == conference.MainChannelName {
+			name = "" // The main channel is stored without a name
+		}
+		limit := 20
+		if len(args) >= 4 {
+			fmt.Sscanf(args[3], "%d", &limit)
+		}
+
+		messages, err := a.conferenceManager.GetChannelMessages(ctx, confID, name, limit)
+		if err != nil {
+			i18n.Printf("Failed to get messages: %v\n", err)
+			return
+		}
+		if len(messages) == 0 {
+			i18n.Printf("No messages in #%s\n", display)
+			return
+		}
+		i18n.Printf("\n=== Conference: %s #%s (%d messages) ===\n", conf.Name, display, len(messages))
+		a.printConferenceMessages(ctx, messages)
+
+	default:
+		i18n.Println(confChannelUsage)
+	}
+}
+
+// printConferenceMessages prints conference messages given newest first, oldest at the top
+func (a *App) printConferenceMessages(ctx context.Context, messages []*storage.ConferenceMessage) {
+	for i := len(messages) - 1; i >= 0; i-- {
+		msg := messages[i]
+		timestamp := msg.CreatedAt.Format("15:04:05")
+
+		if msg.IsSystem() {
+			i18n.Printf("[%s] *** %s ***\n", timestamp, msg.Content)
+			continue
+		}
+
+		// Try to get username from peer ID
+		fromUsername := msg.FromPeerID[:8] + "..." // Fallback
+		fromUser, err := a.storage.GetUserByPeerID(ctx, msg.FromPeerID)
+		if err == nil {
+			fromUsername = fromUser.FullName
+		}
+
+		i18n.Printf("[%s] #%d %s: %s\n", timestamp, msg.ID, fromUsername, msg.Content)
+	}
+	i18n.Println()
+}
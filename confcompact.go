@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+)
+
+// compactionInterval is how often old conference history is compacted
+const compactionInterval = time.Hour
+
+// compactConferences compacts the history of the user's conferences now and
+// then every compactionInterval, until the session ends
+func (a *App) compactConferences(ctx context.Context, user *storage.User) {
+	ticker := time.NewTicker(compactionInterval)
+	defer ticker.Stop()
+
+	for {
+		replaced, err := a.conferenceManager.CompactHistory(ctx, user.ID)
+		if err != nil && ctx.Err() == nil {
+			i18n.Printf("\nWarning: Failed to compact conference history: %v\n> ", err)
+		}
+		if replaced > 0 {
+			i18n.Printf("\n📢 Compacted %d old conference message(s)\n> ", replaced)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runConfCompact compacts one conference's history now, keeping the given
+// number of days or WHISPER_CONF_COMPACT_DAYS
+func (a *App) runConfCompact(ctx context.Context, args []string) {
+	const usage = "Usage: conf-compact <conf-id> [days]"
+	if len(args) < 1 {
+		i18n.Println(usage)
+		return
+	}
+	var confID int64
+	if _, err := fmt.Sscanf(args[0], "%d", &confID); err != nil {
+		i18n.Println(usage)
+		return
+	}
+	days := a.conferenceManager.CompactionDays()
+	if len(args) > 1 {
+		if _, err := fmt.Sscanf(args[1], "%d", &days); err != nil || days < 0 {
+			i18n.Println(usage)
+			return
+		}
+	}
+	if days <= 0 {
+		i18n.Println("Compaction is off - give a number of days, or set WHISPER_CONF_COMPACT_DAYS")
+		return
+	}
+
+	replaced, err := a.conferenceManager.CompactConference(ctx, confID, days)
+	if err != nil {
+		i18n.Printf("Failed to compact conference history: %v\n", err)
+		return
+	}
+	if replaced == 0 {
+		i18n.Printf("✓ Nothing older than %d day(s) to compact\n", days)
+		return
+	}
+	i18n.Printf("✓ Replaced %d message(s) older than %d day(s) with summaries\n", replaced, days)
+}
+
+// runConfSummaries shows the summaries standing in for a conference's
+// compacted history, oldest first
+func (a *App) runConfSummaries(ctx context.Context, args []string) {
+	const usage = "Usage: conf-summaries <conf-id>"
+	if len(args) < 1 {
+		i18n.Println(usage)
+		return
+	}
+	var confID int64
+	if _, err := fmt.Sscanf(args[0], "%d", &confID); err != nil {
+		i18n.Println(usage)
+		return
+	}
+	conf, err := a.storage.GetConference(ctx, confID)
+	if err != nil {
+		i18n.Printf("Conference not found\n")
+		return
+	}
+
+	summaries, err := a.conferenceManager.GetSummaries(ctx, confID)
+	if err != nil {
+		i18n.Printf("Failed to get summaries: %v\n", err)
+		return
+	}
+	if len(summaries) == 0 {
+		i18n.Printf("No compacted history in conference '%s'\n", conf.Name)
+		return
+	}
+
+	i18n.Printf("\n=== Conference: %s (%d summaries) ===\n", conf.Name, len(summaries))
+	for _, summary := range summaries {
+		channel := ""
+		if summary.Channel != "" {
+			channel = "#" + summary.Channel + " "
+		}
+		i18n.Printf("[%s] %s%d message(s) from %s to %s, %s\n", summary.StartedAt.Local().Format("2006-01-02"), channel, summary.Messages,
+			summary.StartedAt.Local().Format("15:04"), summary.EndedAt.Local().Format("15:04"), summary.Policy)
+		if summary.Content != "" {
+			i18n.Printf("  %s\n", summary.Content)
+		}
+	}
+	i18n.Println()
+}
@@ -0,0 +1,152 @@
+package conference
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// admissionTimeout bounds one admission exchange with the conference owner
+const admissionTimeout = 15 * time.Second
+
+// Admission errors
+var (
+	ErrNotOwner     = errors.New("only the conference owner can do that")
+	ErrOwnerUnknown = errors.New("conference owner is unknown - ask a member for a new invite")
+)
+
+// SetDefaultMaxParticipants sets the participant limit given to new
+// conferences (0 = unlimited); conferences that already exist keep theirs
+func (m *Manager) SetDefaultMaxParticipants(max int) {
+	m.maxDefault.Store(int64(max))
+}
+
+// SetMaxParticipants changes a conference's participant limit (0 = unlimited).
+// Lowering it below the current size removes nobody; it only stops new admissions.
+func (m *Manager) SetMaxParticipants(ctx context.Context, currentUser *storage.User, conferenceID int64, max int) error {
+	if max < 0 {
+		return fmt.Errorf("limit cannot be negative")
+	}
+
+	conf, err := m.getConference(ctx, conferenceID)
+	if err != nil {
+		return err
+	}
+	if conf.CreatorID != currentUser.ID {
+		return ErrNotOwner
+	}
+
+	if err := m.storage.SetConferenceMaxParticipants(ctx, conferenceID, max); err != nil {
+		return fmt.Errorf("failed to save limit: %w", err)
+	}
+	return nil
+}
+
+// ownerPeerID returns the peer ID of a conference's creator, or "" if we don't know them
+func (m *Manager) ownerPeerID(ctx context.Context, conf *storage.Conference) string {
+	owner, err := m.storage.GetUserByID(ctx, conf.CreatorID)
+	if err != nil {
+		return ""
+	}
+	return owner.PeerID
+}
+
+// requestAdmission redeems an invite with the conference owner and returns the
+// membership set it sent back, which includes our admission
+func (m *Manager) requestAdmission(ctx context.Context, currentUser *storage.User, conf *storage.Conference) ([]*MembershipEntry, error) {
+	ownerID := m.ownerOf(ctx, conf.ID)
+	if ownerID == "" {
+		return nil, ErrOwnerUnknown
+	}
+
+	owner, err := peer.Decode(ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid owner peer ID: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, admissionTimeout)
+	defer cancel()
+
+	stream, err := m.host.NewStream(ctx, owner, ProtocolConferenceAdmissionV2, ProtocolConferenceAdmission)
+	if err != nil {
+		return nil, fmt.Errorf("the conference owner must be online to admit you: %w", err)
+	}
+
+	response, err := RequestAdmission(ctx, stream, &AdmissionRequest{
+		ConferenceID: conf.ID,
+		Username:     currentUser.Username,
+		PeerID:       currentUser.PeerID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !response.Admitted {
+		return nil, fmt.Errorf("admission refused: %s", response.Reason)
+	}
+	return response.Entries, nil
+}
+
+// handleAdmissionRequest admits a peer to a conference we own while it has room.
+// The owner is the only replica that adds other members, so the limit holds
+// however many invites are out.
+func (m *Manager) handleAdmissionRequest(request *AdmissionRequest, fromPeer peer.ID) *AdmissionResponse {
+	if request.PeerID != fromPeer.String() {
+		return &AdmissionResponse{Reason: "peer ID does not match sender"}
+	}
+
+	ctx := context.Background()
+	conf, err := m.storage.GetConference(ctx, request.ConferenceID)
+	if err != nil || m.currentUserID == 0 || conf.CreatorID != m.currentUserID {
+		return &AdmissionResponse{Reason: "not the owner of this conference"}
+	}
+
+	m.admitMu.Lock()
+	defer m.admitMu.Unlock()
+
+	ms, err := m.loadMembership(ctx, conf.ID)
+	if err != nil {
+		return &AdmissionResponse{Reason: "owner failed to load membership"}
+	}
+
+	if !ms.Contains(request.PeerID) {
+		if conf.MaxParticipants > 0 && len(ms.Members()) >= conf.MaxParticipants {
+			i18n.Printf("\n🚫 %s asked to join '%s', but it is full (%d/%d)\n> ",
+				request.Username, conf.Name, len(ms.Members()), conf.MaxParticipants)
+			return &AdmissionResponse{Reason: fmt.Sprintf("conference is full (%d/%d)", len(ms.Members()), conf.MaxParticipants)}
+		}
+
+		err := m.updateMembership(ctx, conf.ID, func(ms *Membership) []*MembershipEntry {
+			return []*MembershipEntry{ms.Add(request.PeerID, request.Username)}
+		})
+		if err != nil {
+			i18n.Printf("Warning: Failed to admit %s: %v\n", request.Username, err)
+			return &AdmissionResponse{Reason: "owner failed to record admission"}
+		}
+
+		if ms, err = m.loadMembership(ctx, conf.ID); err != nil {
+			return &AdmissionResponse{Reason: "owner failed to load membership"}
+		}
+	}
+
+	return &AdmissionResponse{Admitted: true, Entries: ms.Entries()}
+}
+
+// isAdmitted reports whether a peer may post in a conference. Our own messages
+// always pass, as does everything in a conference whose membership set we
+// have not replicated yet.
+func (m *Manager) isAdmitted(conferenceID int64, from peer.ID) bool {
+	if from == m.host.ID() {
+		return true
+	}
+
+	ms, err := m.loadMembership(context.Background(), conferenceID)
+	if err != nil || len(ms.entries) == 0 {
+		return true
+	}
+	return ms.Contains(from.String())
+}
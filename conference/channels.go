@@ -0,0 +1,195 @@
+package conference
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+)
+
+const (
+	// MaxChannels caps the named channels one conference may have
+	MaxChannels = 64
+
+	// MaxChannelNameLength caps a channel name
+	MaxChannelNameLength = 32
+
+	// MainChannelName is how the conference's own topic is shown next to its channels
+	MainChannelName = "main"
+)
+
+// Channel errors
+var (
+	ErrInvalidChannelName = errors.New("channel names use lowercase letters, digits, '-' and '_' (up to 32)")
+	ErrUnknownChannel     = errors.New("no such channel in this conference - see 'conf-channel list'")
+	ErrTooManyChannels    = fmt.Errorf("conference already has %d channels", MaxChannels)
+)
+
+var channelNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// ValidateChannelName checks a channel name. The main channel has no name on the
+// wire, so "main" itself is reserved.
+func ValidateChannelName(name string) error {
+	if len(name) > MaxChannelNameLength || !channelNamePattern.MatchString(name) || name == MainChannelName {
+		return ErrInvalidChannelName
+	}
+	return nil
+}
+
+// CreateChannel adds a named channel to a conference. Channels are replicated with
+// the membership set, so every member learns of it and subscribes; membership is
+// the conference's own.
+func (m *Manager) CreateChannel(ctx context.Context, currentUser *storage.User, conferenceID int64, name string) error {
+	if err := ValidateChannelName(name); err != nil {
+		return err
+	}
+	if !m.topics.isSubscribed(conferenceID) {
+		return fmt.Errorf("not subscribed to conference - use 'join-conf %d' first", conferenceID)
+	}
+	if m.observing(ctx, conferenceID, currentUser.PeerID) {
+		return ErrObserver
+	}
+
+	channels, err := m.storage.GetConferenceChannels(ctx, conferenceID)
+	if err != nil {
+		return fmt.Errorf("failed to get channels: %w", err)
+	}
+	for _, ch := range channels {
+		if ch.Name == name {
+			return fmt.Errorf("channel #%s already exists", name)
+		}
+	}
+	if len(channels) >= MaxChannels {
+		return ErrTooManyChannels
+	}
+
+	if _, err := m.storage.AddConferenceChannel(ctx, conferenceID, name); err != nil {
+		return fmt.Errorf("failed to save channel: %w", err)
+	}
+	if err := m.subscribeChannel(ctx, conferenceID, name); err != nil {
+		return err
+	}
+	if err := m.broadcastMembership(ctx, conferenceID); err != nil {
+		i18n.Printf("Warning: Failed to announce channel: %v\n", err)
+	}
+
+	m.publishSystemMessage(ctx, currentUser, conferenceID, fmt.Sprintf("%s created channel #%s", currentUser.FullName, name))
+	return nil
+}
+
+// GetChannels returns a conference's named channels
+func (m *Manager) GetChannels(ctx context.Context, conferenceID int64) ([]*storage.ConferenceChannel, error) {
+	return m.storage.GetConferenceChannels(ctx, conferenceID)
+}
+
+// SendChannelMessage sends a message to a named channel of a conference
+func (m *Manager) SendChannelMessage(ctx context.Context, currentUser *storage.User, conferenceID int64, channel, content string) error {
+	if len(content) > p2p.MaxContentLength {
+		return p2p.ErrContentTooLong
+	}
+	if err := ValidateChannelName(channel); err != nil {
+		return err
+	}
+
+	participant, err := m.storage.GetConferenceParticipant(ctx, conferenceID, currentUser.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get participant: %w", err)
+	}
+	if participant == nil || !participant.Active {
+		return fmt.Errorf("you are not a participant in this conference")
+	}
+	if m.observing(ctx, conferenceID, currentUser.PeerID) {
+		return ErrObserver
+	}
+
+	if err := m.checkPostRate(ctx, currentUser, conferenceID); err != nil {
+		return err
+	}
+
+	return m.publish(ctx, currentUser, conferenceID, channel, content, storage.MessageKindUser)
+}
+
+// GetChannelMessages returns the latest messages in one channel; the empty name is the main channel
+func (m *Manager) GetChannelMessages(ctx context.Context, conferenceID int64, channel string, limit int) ([]*storage.ConferenceMessage, error) {
+	m.writer.flush(ctx)
+	return m.storage.GetChannelMessages(ctx, conferenceID, channel, limit)
+}
+
+// channelNames returns the names of a conference's channels
+func (m *Manager) channelNames(ctx context.Context, conferenceID int64) ([]string, error) {
+	channels, err := m.storage.GetConferenceChannels(ctx, conferenceID)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(channels))
+	for _, ch := range channels {
+		names = append(names, ch.Name)
+	}
+	return names, nil
+}
+
+// subscribeChannels joins every known channel of a freshly subscribed conference
+func (m *Manager) subscribeChannels(ctx context.Context, conferenceID int64) {
+	names, err := m.channelNames(ctx, conferenceID)
+	if err != nil {
+		i18n.Printf("Warning: Failed to load channels: %v\n", err)
+		return
+	}
+	for _, name := range names {
+		if err := m.subscribeChannel(ctx, conferenceID, name); err != nil {
+			i18n.Printf("Warning: Failed to subscribe to #%s: %v\n", name, err)
+		}
+	}
+}
+
+// subscribeChannel joins one channel's topic and starts its listener
+func (m *Manager) subscribeChannel(ctx context.Context, conferenceID int64, name string) error {
+	ch, listenCtx, err := m.topics.subscribeChannel(conferenceID, name)
+	if err != nil {
+		return err
+	}
+	if ch != nil {
+		go m.listenToConference(listenCtx, conferenceID, ch.sub)
+	}
+	return nil
+}
+
+// mergeChannels records and subscribes to channels learned from another member's
+// state. It reports whether that state already listed every channel we know.
+func (m *Manager) mergeChannels(ctx context.Context, conferenceID int64, remote []string) bool {
+	known, err := m.channelNames(ctx, conferenceID)
+	if err != nil {
+		i18n.Printf("Warning: Failed to load channels: %v\n", err)
+		return true
+	}
+
+	seen := make(map[string]bool, len(remote))
+	for _, name := range remote {
+		seen[name] = true
+		if len(known) >= MaxChannels {
+			continue
+		}
+		added, err := m.storage.AddConferenceChannel(ctx, conferenceID, name)
+		if err != nil {
+			i18n.Printf("Warning: Failed to save channel #%s: %v\n", name, err)
+			continue
+		}
+		if added {
+			known = append(known, name)
+			if err := m.subscribeChannel(ctx, conferenceID, name); err != nil {
+				i18n.Printf("Warning: Failed to subscribe to #%s: %v\n", name, err)
+			}
+		}
+	}
+
+	for _, name := range known {
+		if !seen[name] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,236 @@
+package conference
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/austinwklein/whisper/storage"
+)
+
+// CompactionTruncate is the built-in compaction policy: old messages are
+// dropped, leaving only a count of them in their place
+const CompactionTruncate = "truncate"
+
+// compactionPage is how many old messages one compaction pass reads at a time
+const compactionPage = 2000
+
+// ErrUnknownCompaction is returned for a compaction policy no compactor is
+// registered under
+var ErrUnknownCompaction = errors.New("unknown compaction policy")
+
+// Compactor turns a stretch of old conference history into the summary kept
+// in its place. Plugins register one with RegisterCompactor and it is chosen
+// by name with SetCompaction.
+type Compactor interface {
+	// Summarize is given one day of one channel's messages, oldest first,
+	// and returns the text to keep once they are deleted; empty keeps only
+	// how many there were and when
+	Summarize(ctx context.Context, conf *storage.Conference, channel string, messages []*storage.ConferenceMessage) (string, error)
+}
+
+// CompactorFunc lets an ordinary function be used as a Compactor
+type CompactorFunc func(ctx context.Context, conf *storage.Conference, channel string, messages []*storage.ConferenceMessage) (string, error)
+
+// Summarize calls f
+func (f CompactorFunc) Summarize(ctx context.Context, conf *storage.Conference, channel string, messages []*storage.ConferenceMessage) (string, error) {
+	return f(ctx, conf, channel, messages)
+}
+
+// truncate is the CompactionTruncate policy
+func truncate(ctx context.Context, conf *storage.Conference, channel string, messages []*storage.ConferenceMessage) (string, error) {
+	return "", nil
+}
+
+// compaction is the configured policy and how many days of history it leaves alone
+type compaction struct {
+	policy   string
+	keepDays int
+}
+
+// RegisterCompactor makes a compaction policy available under name,
+// replacing any registered under it before
+func (m *Manager) RegisterCompactor(name string, c Compactor) {
+	m.compactMu.Lock()
+	defer m.compactMu.Unlock()
+	m.compactors[name] = c
+}
+
+// SetCompaction sets how old history is compacted: every day of messages
+// older than keepDays is replaced by a summary written by the named policy.
+// keepDays 0 turns compaction off.
+func (m *Manager) SetCompaction(policy string, keepDays int) error {
+	m.compactMu.Lock()
+	defer m.compactMu.Unlock()
+	if _, ok := m.compactors[policy]; !ok {
+		return fmt.Errorf("%w %q", ErrUnknownCompaction, policy)
+	}
+	m.compaction = compaction{policy: policy, keepDays: keepDays}
+	return nil
+}
+
+// CompactionDays returns how many days of history compaction leaves alone (0 = off)
+func (m *Manager) CompactionDays() int {
+	m.compactMu.Lock()
+	defer m.compactMu.Unlock()
+	return m.compaction.keepDays
+}
+
+// CompactHistory compacts the history of every conference the user is in,
+// returning how many messages were replaced
+func (m *Manager) CompactHistory(ctx context.Context, userID int64) (int, error) {
+	m.compactMu.Lock()
+	keepDays := m.compaction.keepDays
+	m.compactMu.Unlock()
+	if keepDays <= 0 {
+		return 0, nil
+	}
+
+	conferences, err := m.storage.GetUserConferences(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, conf := range conferences {
+		n, err := m.CompactConference(ctx, conf.ID, keepDays)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("failed to compact conference %d: %w", conf.ID, err)
+		}
+	}
+	return total, nil
+}
+
+// CompactConference replaces each day of a conference's history older than
+// keepDays with a summary from the configured policy, channel by channel, and
+// returns how many messages were replaced. Days are counted in local time and
+// only whole days are compacted.
+func (m *Manager) CompactConference(ctx context.Context, conferenceID int64, keepDays int) (int, error) {
+	m.compactMu.Lock()
+	policy := m.compaction.policy
+	compactor := m.compactors[policy]
+	m.compactMu.Unlock()
+	if compactor == nil {
+		return 0, fmt.Errorf("%w %q", ErrUnknownCompaction, policy)
+	}
+
+	conf, err := m.getConference(ctx, conferenceID)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	cutoff := time.Date(now.Year(), now.Month(), now.Day()-keepDays, 0, 0, 0, 0, now.Location())
+
+	// Messages still waiting in the writer belong to the history too
+	m.writer.flush(ctx)
+	replaced := 0
+	for {
+		page, err := m.storage.GetConferenceMessagesBefore(ctx, conferenceID, cutoff, compactionPage)
+		if err != nil {
+			return replaced, err
+		}
+		if len(page) == 0 {
+			return replaced, nil
+		}
+
+		days := groupByDay(page)
+		// A full page may have cut the last day short; it comes first in
+		// the next page, unless it fills a page by itself
+		if len(page) == compactionPage && len(days) > 1 {
+			days = days[:len(days)-1]
+		}
+		for _, day := range days {
+			content, err := compactor.Summarize(ctx, conf, day.channel, day.messages)
+			if err != nil {
+				return replaced, fmt.Errorf("%s policy failed: %w", policy, err)
+			}
+			first, last := day.messages[0], day.messages[len(day.messages)-1]
+			summary := &storage.ConferenceSummary{
+				ConferenceID: conferenceID,
+				Channel:      day.channel,
+				FromLamport:  first.Lamport,
+				ToLamport:    last.Lamport,
+				StartedAt:    first.CreatedAt,
+				EndedAt:      last.CreatedAt,
+				Policy:       policy,
+				Content:      content,
+			}
+			if err := m.storage.ReplaceConferenceMessages(ctx, summary); err != nil {
+				return replaced, err
+			}
+			replaced += summary.Messages
+			m.noteCompacted(conferenceID, summary.ToLamport)
+		}
+	}
+}
+
+// GetSummaries returns the summaries standing in for a conference's compacted history
+func (m *Manager) GetSummaries(ctx context.Context, conferenceID int64) ([]*storage.ConferenceSummary, error) {
+	return m.storage.GetConferenceSummaries(ctx, conferenceID)
+}
+
+// historyDay is one channel's messages from one day
+type historyDay struct {
+	channel  string
+	date     string
+	messages []*storage.ConferenceMessage
+}
+
+// groupByDay splits messages, oldest first, into one group per channel and
+// local day, ordered by the logical clock of each group's first message
+func groupByDay(messages []*storage.ConferenceMessage) []*historyDay {
+	index := make(map[string]*historyDay)
+	days := []*historyDay{}
+	for _, msg := range messages {
+		date := msg.CreatedAt.Local().Format("2006-01-02")
+		key := msg.Channel + "\x00" + date
+		day, ok := index[key]
+		if !ok {
+			day = &historyDay{channel: msg.Channel, date: date}
+			index[key] = day
+			days = append(days, day)
+		}
+		day.messages = append(day.messages, msg)
+	}
+	sort.SliceStable(days, func(i, j int) bool {
+		return days[i].messages[0].Lamport < days[j].messages[0].Lamport
+	})
+	return days
+}
+
+// compactedThrough returns the newest logical clock value compaction has
+// replaced in a conference; messages at or before it arriving again from
+// other members' history are not stored
+func (m *Manager) compactedThrough(ctx context.Context, conferenceID int64) int64 {
+	m.compactMu.Lock()
+	through, ok := m.compacted[conferenceID]
+	m.compactMu.Unlock()
+	if ok {
+		return through
+	}
+
+	summaries, err := m.storage.GetConferenceSummaries(ctx, conferenceID)
+	if err != nil {
+		return 0
+	}
+	for _, summary := range summaries {
+		m.noteCompacted(conferenceID, summary.ToLamport)
+	}
+	m.compactMu.Lock()
+	defer m.compactMu.Unlock()
+	if _, ok := m.compacted[conferenceID]; !ok {
+		m.compacted[conferenceID] = 0
+	}
+	return m.compacted[conferenceID]
+}
+
+// noteCompacted records that history up to lamport has been compacted
+func (m *Manager) noteCompacted(conferenceID, lamport int64) {
+	m.compactMu.Lock()
+	defer m.compactMu.Unlock()
+	if lamport > m.compacted[conferenceID] {
+		m.compacted[conferenceID] = lamport
+	}
+}
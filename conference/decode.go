@@ -0,0 +1,295 @@
+package conference
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+)
+
+const (
+	// MaxConferenceNameLength caps a conference name carried in an invite
+	MaxConferenceNameLength = 128
+
+	// MaxMembershipEntries caps the tagged adds one membership state may carry
+	MaxMembershipEntries = 4096
+
+	// maxTagLength bounds a membership tag; local tags are 32 hex characters
+	maxTagLength = 64
+)
+
+// DecodeConferenceInvite parses and validates a conference invite read from the wire
+func DecodeConferenceInvite(data []byte) (*ConferenceInvite, error) {
+	var invite ConferenceInvite
+	if err := json.Unmarshal(data, &invite); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal conference invite: %w", err)
+	}
+	if err := checkConferenceInvite(&invite); err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+// checkConferenceInvite validates a conference invite in either wire encoding
+func checkConferenceInvite(invite *ConferenceInvite) error {
+	if invite.ConferenceID <= 0 {
+		return fmt.Errorf("invalid conference id %d", invite.ConferenceID)
+	}
+	if err := p2p.CheckTextField("conference_name", invite.ConferenceName, MaxConferenceNameLength, true); err != nil {
+		return err
+	}
+	if err := p2p.CheckTextField("from_username", invite.FromUsername, p2p.MaxUsernameLength, true); err != nil {
+		return err
+	}
+	if err := p2p.CheckTextField("from_full_name", invite.FromFullName, p2p.MaxFullNameLength, false); err != nil {
+		return err
+	}
+	if err := p2p.CheckPeerIDField("from_peer_id", invite.FromPeerID); err != nil {
+		return err
+	}
+	if invite.OwnerPeerID != "" {
+		if err := p2p.CheckPeerIDField("owner_peer_id", invite.OwnerPeerID); err != nil {
+			return err
+		}
+	}
+	return p2p.CheckTextField("message", invite.Message, p2p.MaxNoteLength, false)
+}
+
+// DecodeGossipMessage parses and validates a conference message from the topic or a history response
+func DecodeGossipMessage(data []byte) (*ConferenceGossipMessage, error) {
+	var message ConferenceGossipMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal conference message: %w", err)
+	}
+	if err := checkGossipMessage(&message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// checkGossipMessage validates a conference message in either wire encoding
+func checkGossipMessage(message *ConferenceGossipMessage) error {
+	if message.ConferenceID <= 0 {
+		return fmt.Errorf("invalid conference id %d", message.ConferenceID)
+	}
+	if message.Channel != "" {
+		if err := ValidateChannelName(message.Channel); err != nil {
+			return err
+		}
+	}
+	if err := p2p.CheckTextField("from_username", message.FromUsername, p2p.MaxUsernameLength, true); err != nil {
+		return err
+	}
+	if err := p2p.CheckTextField("from_full_name", message.FromFullName, p2p.MaxFullNameLength, false); err != nil {
+		return err
+	}
+	if err := p2p.CheckPeerIDField("from_peer_id", message.FromPeerID); err != nil {
+		return err
+	}
+	if err := p2p.CheckTextField("content", message.Content, p2p.MaxContentLength, false); err != nil {
+		return err
+	}
+	if message.Kind != "" && message.Kind != storage.MessageKindUser && message.Kind != storage.MessageKindSystem {
+		return fmt.Errorf("unknown message kind %q", message.Kind)
+	}
+	if message.Lamport < 0 || message.Timestamp < 0 {
+		return fmt.Errorf("negative clock or timestamp")
+	}
+	return nil
+}
+
+// DecodeMembershipState parses and validates a membership state from the control topic
+func DecodeMembershipState(data []byte) (*MembershipState, error) {
+	var state MembershipState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal membership state: %w", err)
+	}
+	if err := checkMembershipState(&state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// checkMembershipState validates a membership state in either wire encoding
+func checkMembershipState(state *MembershipState) error {
+	if state.ConferenceID <= 0 {
+		return fmt.Errorf("invalid conference id %d", state.ConferenceID)
+	}
+	if err := p2p.CheckPeerIDField("from_peer_id", state.FromPeerID); err != nil {
+		return err
+	}
+	if err := checkMembershipEntries(state.Entries); err != nil {
+		return err
+	}
+	if len(state.Channels) > MaxChannels {
+		return fmt.Errorf("membership state has more than %d channels", MaxChannels)
+	}
+	for _, channel := range state.Channels {
+		if err := ValidateChannelName(channel); err != nil {
+			return err
+		}
+	}
+	if state.RateLimit != nil {
+		if err := checkRateLimit(state.RateLimit); err != nil {
+			return err
+		}
+	}
+	if state.Observers != nil {
+		if err := checkObservers(state.Observers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodePresenceBeacon parses and validates a beacon from the conference presence topic
+func DecodePresenceBeacon(data []byte) (*PresenceBeacon, error) {
+	var beacon PresenceBeacon
+	if err := json.Unmarshal(data, &beacon); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal presence beacon: %w", err)
+	}
+	if err := checkPresenceBeacon(&beacon); err != nil {
+		return nil, err
+	}
+	return &beacon, nil
+}
+
+// checkPresenceBeacon validates a presence beacon in either wire encoding
+func checkPresenceBeacon(beacon *PresenceBeacon) error {
+	if beacon.ConferenceID <= 0 {
+		return fmt.Errorf("invalid conference id %d", beacon.ConferenceID)
+	}
+	if err := p2p.CheckPeerIDField("from_peer_id", beacon.FromPeerID); err != nil {
+		return err
+	}
+	return p2p.CheckTextField("username", beacon.Username, p2p.MaxUsernameLength, !beacon.Leaving)
+}
+
+// checkObservers validates a conference's observers read from the wire
+func checkObservers(observers *Observers) error {
+	if len(observers.PeerIDs) > MaxMembershipEntries {
+		return fmt.Errorf("membership state has more than %d observers", MaxMembershipEntries)
+	}
+	for _, peerID := range observers.PeerIDs {
+		if err := p2p.CheckPeerIDField("observers", peerID); err != nil {
+			return err
+		}
+	}
+	if observers.Version < 0 {
+		return fmt.Errorf("negative observers version")
+	}
+	return nil
+}
+
+// checkRateLimit validates posting limits read from the wire
+func checkRateLimit(limit *RateLimit) error {
+	maxSeconds := int(MaxRateLimitWindow / time.Second)
+	if limit.Messages < 0 || limit.Messages > MaxRateLimitMessages {
+		return fmt.Errorf("rate limit messages %d out of range", limit.Messages)
+	}
+	if limit.WindowSeconds < 0 || limit.WindowSeconds > maxSeconds {
+		return fmt.Errorf("rate limit window %d out of range", limit.WindowSeconds)
+	}
+	if limit.SlowModeSeconds < 0 || limit.SlowModeSeconds > maxSeconds {
+		return fmt.Errorf("slow mode gap %d out of range", limit.SlowModeSeconds)
+	}
+	if limit.SlowModeUntil < 0 || limit.Version < 0 {
+		return fmt.Errorf("negative slow mode end or rate limit version")
+	}
+	return nil
+}
+
+// checkMembershipEntries validates the entries of a membership set read from the wire
+func checkMembershipEntries(entries []*MembershipEntry) error {
+	if len(entries) > MaxMembershipEntries {
+		return fmt.Errorf("membership state has more than %d entries", MaxMembershipEntries)
+	}
+	for _, entry := range entries {
+		if entry == nil {
+			return fmt.Errorf("null membership entry")
+		}
+		if err := p2p.CheckTextField("tag", entry.Tag, maxTagLength, true); err != nil {
+			return err
+		}
+		if err := p2p.CheckPeerIDField("peer_id", entry.PeerID); err != nil {
+			return err
+		}
+		if err := p2p.CheckTextField("username", entry.Username, p2p.MaxUsernameLength, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodeHistoryRequest parses and validates a history request read from the wire.
+// A missing or oversized limit is clamped to MaxHistoryMessages.
+func DecodeHistoryRequest(data []byte) (*HistoryRequest, error) {
+	var request HistoryRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal history request: %w", err)
+	}
+	if err := checkHistoryRequest(&request); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// checkHistoryRequest validates a history request in either wire encoding,
+// clamping its limit
+func checkHistoryRequest(request *HistoryRequest) error {
+	if request.ConferenceID <= 0 {
+		return fmt.Errorf("invalid conference id %d", request.ConferenceID)
+	}
+	if request.SinceLamport < 0 {
+		return fmt.Errorf("negative since_lamport")
+	}
+	if request.Limit <= 0 || request.Limit > MaxHistoryMessages {
+		request.Limit = MaxHistoryMessages
+	}
+	return nil
+}
+
+// DecodeAdmissionRequest parses and validates an admission request read from the wire
+func DecodeAdmissionRequest(data []byte) (*AdmissionRequest, error) {
+	var request AdmissionRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal admission request: %w", err)
+	}
+	if err := checkAdmissionRequest(&request); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// checkAdmissionRequest validates an admission request in either wire encoding
+func checkAdmissionRequest(request *AdmissionRequest) error {
+	if request.ConferenceID <= 0 {
+		return fmt.Errorf("invalid conference id %d", request.ConferenceID)
+	}
+	if err := p2p.CheckTextField("username", request.Username, p2p.MaxUsernameLength, true); err != nil {
+		return err
+	}
+	return p2p.CheckPeerIDField("peer_id", request.PeerID)
+}
+
+// DecodeAdmissionResponse parses and validates the owner's answer to an admission request
+func DecodeAdmissionResponse(data []byte) (*AdmissionResponse, error) {
+	var response AdmissionResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal admission response: %w", err)
+	}
+	if err := checkAdmissionResponse(&response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// checkAdmissionResponse validates an admission response in either wire encoding
+func checkAdmissionResponse(response *AdmissionResponse) error {
+	if err := p2p.CheckTextField("reason", response.Reason, p2p.MaxNoteLength, false); err != nil {
+		return err
+	}
+	return checkMembershipEntries(response.Entries)
+}
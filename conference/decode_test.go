@@ -0,0 +1,107 @@
+package conference_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/austinwklein/whisper/conference"
+	"github.com/austinwklein/whisper/conformance"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/pb"
+)
+
+// seedVectors adds the wire bytes of every published conformance vector of
+// messageType in the given encoding to a fuzz target's seed corpus
+func seedVectors(f *testing.F, messageType, encoding string) {
+	f.Helper()
+	set, err := conformance.Vectors()
+	if err != nil {
+		f.Fatalf("failed to load vectors: %v", err)
+	}
+	for _, v := range set.Vectors {
+		if v.Message != messageType {
+			continue
+		}
+		switch {
+		case encoding == conformance.EncodingJSON && (v.Encoding == "" || v.Encoding == conformance.EncodingJSON):
+			f.Add([]byte(v.Wire))
+		case encoding == conformance.EncodingProtobuf && v.Encoding == conformance.EncodingProtobuf:
+			wire, err := hex.DecodeString(v.Wire)
+			if err != nil {
+				f.Fatalf("%s: bad hex: %v", v.Name, err)
+			}
+			f.Add(wire)
+		}
+	}
+}
+
+// fuzzDecode checks that decode never panics on arbitrary bytes, and that a
+// message it accepts is accepted again after being encoded
+func fuzzDecode[T any](f *testing.F, decode func(data []byte) (T, error)) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message, err := decode(data)
+		if err != nil {
+			return
+		}
+		again, err := json.Marshal(message)
+		if err != nil {
+			t.Fatalf("failed to encode accepted message: %v", err)
+		}
+		if _, err := decode(again); err != nil {
+			t.Fatalf("accepted %q but rejected its re-encoding %s: %v", data, again, err)
+		}
+	})
+}
+
+func FuzzDecodeConferenceInvite(f *testing.F) {
+	seedVectors(f, "ConferenceInvite", conformance.EncodingJSON)
+	fuzzDecode(f, conference.DecodeConferenceInvite)
+}
+
+func FuzzDecodeGossipMessage(f *testing.F) {
+	seedVectors(f, "ConferenceGossipMessage", conformance.EncodingJSON)
+	fuzzDecode(f, conference.DecodeGossipMessage)
+}
+
+func FuzzDecodeMembershipState(f *testing.F) {
+	seedVectors(f, "MembershipState", conformance.EncodingJSON)
+	fuzzDecode(f, conference.DecodeMembershipState)
+}
+
+func FuzzDecodePresenceBeacon(f *testing.F) {
+	f.Add([]byte(`{"conference_id":1760000000123,"from_peer_id":"12D3KooWK99VoVxNE7XzyBwXEzW7xhK7Gpv85r9F3V3fyKSUKPH5","username":"alice"}`))
+	f.Add([]byte(`{"conference_id":1760000000123,"from_peer_id":"12D3KooWK99VoVxNE7XzyBwXEzW7xhK7Gpv85r9F3V3fyKSUKPH5","leaving":true}`))
+	fuzzDecode(f, conference.DecodePresenceBeacon)
+}
+
+func FuzzDecodeHistoryRequest(f *testing.F) {
+	seedVectors(f, "HistoryRequest", conformance.EncodingJSON)
+	fuzzDecode(f, conference.DecodeHistoryRequest)
+}
+
+func FuzzDecodeAdmissionRequest(f *testing.F) {
+	seedVectors(f, "AdmissionRequest", conformance.EncodingJSON)
+	fuzzDecode(f, conference.DecodeAdmissionRequest)
+}
+
+func FuzzDecodeAdmissionResponse(f *testing.F) {
+	seedVectors(f, "AdmissionResponse", conformance.EncodingJSON)
+	fuzzDecode(f, conference.DecodeAdmissionResponse)
+}
+
+// FuzzDecodeGossipMessageProto reads a conference message off a 2.0.0
+// history stream the way the handler does, through the bounded
+// length-prefixed reader
+func FuzzDecodeGossipMessageProto(f *testing.F) {
+	seedVectors(f, "ConferenceGossipMessage", conformance.EncodingProtobuf)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var wire pb.ConferenceMessage
+		if err := p2p.ReadProtoMessage(bufio.NewReader(bytes.NewReader(data)), &wire); err != nil {
+			return
+		}
+		conference.DecodeGossipMessageProto(&wire)
+	})
+}
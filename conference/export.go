@@ -0,0 +1,175 @@
+package conference
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+)
+
+// ExportFormat selects how a conference transcript is written
+type ExportFormat string
+
+const (
+	ExportJSON     ExportFormat = "json"
+	ExportMarkdown ExportFormat = "md"
+)
+
+// ErrUnknownExportFormat is returned for a transcript format other than json or md
+var ErrUnknownExportFormat = errors.New("transcript format must be json or md")
+
+// ParseExportFormat parses a transcript format name
+func ParseExportFormat(name string) (ExportFormat, error) {
+	switch strings.ToLower(name) {
+	case "json":
+		return ExportJSON, nil
+	case "md", "markdown":
+		return ExportMarkdown, nil
+	}
+	return "", ErrUnknownExportFormat
+}
+
+// transcriptHeader is the JSON transcript's metadata, written ahead of its messages
+type transcriptHeader struct {
+	Conference *storage.Conference `json:"conference"`
+	Members    []transcriptMember  `json:"members"`
+	ExportedAt time.Time           `json:"exported_at"`
+}
+
+// transcriptMember is a current member of an exported conference
+type transcriptMember struct {
+	PeerID   string `json:"peer_id"`
+	Username string `json:"username"`
+}
+
+// ExportTranscript writes a conference's chronological transcript, every
+// channel included, to w and returns how many messages it holds. Messages are
+// streamed from storage, so the size of the room does not matter.
+func (m *Manager) ExportTranscript(ctx context.Context, conferenceID int64, format ExportFormat, w io.Writer) (int, error) {
+	conf, err := m.getConference(ctx, conferenceID)
+	if err != nil {
+		return 0, err
+	}
+	ms, err := m.loadMembership(ctx, conferenceID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load membership: %w", err)
+	}
+	members := []transcriptMember{}
+	for peerID, username := range ms.Members() {
+		members = append(members, transcriptMember{PeerID: peerID, Username: username})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Username < members[j].Username })
+
+	switch format {
+	case ExportJSON:
+		return exportJSON(ctx, m.storage, conf, members, w)
+	case ExportMarkdown:
+		return exportMarkdown(ctx, m.storage, conf, members, w)
+	}
+	return 0, ErrUnknownExportFormat
+}
+
+// exportJSON writes the transcript as one JSON object: the header's fields,
+// then a "messages" array written one entry at a time
+func exportJSON(ctx context.Context, store storage.Storage, conf *storage.Conference, members []transcriptMember, w io.Writer) (int, error) {
+	header, err := json.Marshal(&transcriptHeader{Conference: conf, Members: members, ExportedAt: time.Now()})
+	if err != nil {
+		return 0, err
+	}
+	// Reopen the header object to append the messages array to it
+	if _, err := fmt.Fprintf(w, "%s,\n\"messages\": [", header[:len(header)-1]); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = store.StreamConferenceTranscript(ctx, conf.ID, func(entry *storage.TranscriptEntry) error {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		sep := ",\n  "
+		if count == 0 {
+			sep = "\n  "
+		}
+		count++
+		_, err = fmt.Fprintf(w, "%s%s", sep, data)
+		return err
+	})
+	if err != nil {
+		return count, err
+	}
+	_, err = fmt.Fprint(w, "\n]}\n")
+	return count, err
+}
+
+// exportMarkdown writes the transcript as a Markdown document with a heading
+// per day and one list item per message
+func exportMarkdown(ctx context.Context, store storage.Storage, conf *storage.Conference, members []transcriptMember, w io.Writer) (int, error) {
+	names := make([]string, 0, len(members))
+	for _, member := range members {
+		names = append(names, member.Username)
+	}
+	if _, err := fmt.Fprintf(w, "# %s\n\n%s\n%s\n%s\n",
+		i18n.Sprintf("Conference: %s", conf.Name),
+		i18n.Sprintf("- Conference ID: %d", conf.ID),
+		i18n.Sprintf("- Members: %s", strings.Join(names, ", ")),
+		i18n.Sprintf("- Exported: %s", time.Now().Format("2006-01-02 15:04 MST")),
+	); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	day := ""
+	err := store.StreamConferenceTranscript(ctx, conf.ID, func(entry *storage.TranscriptEntry) error {
+		count++
+		created := entry.CreatedAt.Local()
+		if d := created.Format("2006-01-02"); d != day {
+			day = d
+			if _, err := fmt.Fprintf(w, "\n## %s\n\n", day); err != nil {
+				return err
+			}
+		}
+
+		channel := ""
+		if entry.Channel != "" {
+			channel = " #" + entry.Channel
+		}
+		// Continuation lines stay inside the list item
+		content := strings.ReplaceAll(entry.Content, "\n", "  \n  ")
+		var err error
+		if entry.IsSystem() {
+			_, err = fmt.Fprintf(w, "- `%s`%s *%s*\n", created.Format("15:04:05"), channel, content)
+		} else {
+			_, err = fmt.Fprintf(w, "- `%s`%s **%s**: %s\n", created.Format("15:04:05"), channel, transcriptSender(entry), content)
+		}
+		return err
+	})
+	if err != nil {
+		return count, err
+	}
+	if count == 0 {
+		_, err = fmt.Fprintf(w, "\n%s\n", i18n.T("_No messages._"))
+	}
+	return count, err
+}
+
+// transcriptSender names a message's sender as well as is known: full name
+// and username, username alone, or a shortened peer ID
+func transcriptSender(entry *storage.TranscriptEntry) string {
+	switch {
+	case entry.FullName != "" && entry.Username != "":
+		return fmt.Sprintf("%s (@%s)", entry.FullName, entry.Username)
+	case entry.Username != "":
+		return "@" + entry.Username
+	case len(entry.FromPeerID) > 12:
+		return entry.FromPeerID[:12] + "..."
+	}
+	return entry.FromPeerID
+}
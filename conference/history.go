@@ -0,0 +1,220 @@
+package conference
+
+import (
+	"github.com/austinwklein/whisper/i18n"
+
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// historySyncDelay is how long to wait after subscribing before fetching history,
+// giving the membership roster time to arrive on the control topic
+const historySyncDelay = 3 * time.Second
+
+// SetPersistencePolicy sets how many members of each conference are designated
+// archivers that keep full history and serve it to other members
+func (m *Manager) SetPersistencePolicy(archivers int) {
+	m.archivers = archivers
+}
+
+// Archivers returns the designated archivers for a conference, in preference order.
+// Every replica computes the same list from the converged membership set.
+func (m *Manager) Archivers(ctx context.Context, conferenceID int64) ([]string, error) {
+	ms, err := m.loadMembership(ctx, conferenceID)
+	if err != nil {
+		return nil, err
+	}
+	return selectArchivers(conferenceID, ms.Members(), m.archivers), nil
+}
+
+// selectArchivers ranks members by a per-conference hash and returns the first n
+func selectArchivers(conferenceID int64, members map[string]string, n int) []string {
+	if n <= 0 {
+		return []string{}
+	}
+
+	rank := func(peerID string) string {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%d/%s", conferenceID, peerID)))
+		return hex.EncodeToString(sum[:])
+	}
+
+	peers := make([]string, 0, len(members))
+	for peerID := range members {
+		peers = append(peers, peerID)
+	}
+	sort.Slice(peers, func(i, j int) bool { return rank(peers[i]) < rank(peers[j]) })
+
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+// isArchiver reports whether this node is a designated archiver for the conference
+func (m *Manager) isArchiver(ctx context.Context, conferenceID int64) bool {
+	archivers, err := m.Archivers(ctx, conferenceID)
+	if err != nil {
+		return false
+	}
+	self := m.host.ID().String()
+	for _, a := range archivers {
+		if a == self {
+			return true
+		}
+	}
+	return false
+}
+
+// historySources returns connected members to ask for history, archivers first
+func (m *Manager) historySources(ctx context.Context, conferenceID int64) ([]peer.ID, error) {
+	ms, err := m.loadMembership(ctx, conferenceID)
+	if err != nil {
+		return nil, err
+	}
+
+	members := ms.Members()
+	archivers := selectArchivers(conferenceID, members, m.archivers)
+
+	isArchiver := make(map[string]bool, len(archivers))
+	ordered := make([]string, 0, len(members))
+	for _, a := range archivers {
+		isArchiver[a] = true
+		ordered = append(ordered, a)
+	}
+	others := make([]string, 0, len(members))
+	for peerID := range members {
+		if !isArchiver[peerID] {
+			others = append(others, peerID)
+		}
+	}
+	sort.Strings(others)
+	ordered = append(ordered, others...)
+
+	self := m.host.ID()
+	sources := []peer.ID{}
+	for _, peerIDStr := range ordered {
+		pid, err := peer.Decode(peerIDStr)
+		if err != nil || pid == self {
+			continue
+		}
+		if m.host.Network().Connectedness(pid) != network.Connected {
+			continue
+		}
+		sources = append(sources, pid)
+	}
+	return sources, nil
+}
+
+// syncHistory fetches messages we are missing from the best available member.
+// Archivers fetch the full history they haven't compacted; other members only
+// catch up from their latest message.
+func (m *Manager) syncHistory(ctx context.Context, conferenceID int64) {
+	since := m.compactedThrough(ctx, conferenceID)
+	if !m.isArchiver(ctx, conferenceID) {
+		m.writer.flush(ctx)
+		next, err := m.storage.NextConferenceLamport(ctx, conferenceID)
+		if err != nil {
+			i18n.Printf("Warning: Failed to get conference clock: %v\n", err)
+			return
+		}
+		since = next - 1
+	}
+
+	sources, err := m.historySources(ctx, conferenceID)
+	if err != nil {
+		i18n.Printf("Warning: Failed to choose history source: %v\n", err)
+		return
+	}
+
+	for _, source := range sources {
+		fetched, err := m.fetchHistory(ctx, source, conferenceID, since)
+		if err != nil {
+			continue // Try the next best source
+		}
+		if fetched > 0 {
+			i18n.Printf("\n📢 [Conference] Retrieved %d earlier message(s)\n> ", fetched)
+		}
+		return
+	}
+}
+
+// fetchHistory requests history from one member and stores new messages
+func (m *Manager) fetchHistory(ctx context.Context, source peer.ID, conferenceID, since int64) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	stream, err := m.host.NewStream(ctx, source, ProtocolConferenceHistoryV2, ProtocolConferenceHistory)
+	if err != nil {
+		return 0, err
+	}
+
+	request := &HistoryRequest{
+		ConferenceID: conferenceID,
+		SinceLamport: since,
+		Limit:        MaxHistoryMessages,
+	}
+
+	messages, err := RequestHistory(ctx, stream, request)
+	if err != nil {
+		return 0, err
+	}
+
+	fetched := 0
+	for _, msg := range messages {
+		if msg.ConferenceID != conferenceID {
+			continue
+		}
+		if _, stored := m.storeGossipMessage(ctx, msg); stored {
+			fetched++
+		}
+	}
+	return fetched, nil
+}
+
+// handleHistoryRequest serves stored conference history to a current member
+func (m *Manager) handleHistoryRequest(request *HistoryRequest, fromPeer peer.ID) []*ConferenceGossipMessage {
+	ctx := context.Background()
+
+	// Only members of the conference may read its history
+	ms, err := m.loadMembership(ctx, request.ConferenceID)
+	if err != nil || !ms.Contains(fromPeer.String()) {
+		return nil
+	}
+	members := ms.Members()
+
+	m.writer.flush(ctx)
+	stored, err := m.storage.GetConferenceMessagesSince(ctx, request.ConferenceID, request.SinceLamport, request.Limit)
+	if err != nil {
+		i18n.Printf("Warning: Failed to load conference history: %v\n", err)
+		return nil
+	}
+
+	messages := make([]*ConferenceGossipMessage, 0, len(stored))
+	for _, msg := range stored {
+		username := members[msg.FromPeerID]
+		fullName := username
+		if user, err := m.storage.GetUserByPeerID(ctx, msg.FromPeerID); err == nil {
+			username, fullName = user.Username, user.FullName
+		}
+
+		messages = append(messages, &ConferenceGossipMessage{
+			ConferenceID: msg.ConferenceID,
+			Channel:      msg.Channel,
+			FromUsername: username,
+			FromFullName: fullName,
+			FromPeerID:   msg.FromPeerID,
+			Content:      msg.Content,
+			Kind:         msg.Kind,
+			Lamport:      msg.Lamport,
+			Timestamp:    msg.CreatedAt.Unix(),
+		})
+	}
+	return messages
+}
@@ -2,16 +2,23 @@ package conference
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
 	"github.com/austinwklein/whisper/storage"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
+// ErrConferenceNotFound is returned for conferences this node doesn't know
+var ErrConferenceNotFound = errors.New("conference not found")
+
 // Manager handles conference operations
 type Manager struct {
 	storage       storage.Storage
@@ -19,26 +26,59 @@ type Manager struct {
 	pubsub        *pubsub.PubSub
 	protocol      *Protocol
 	currentUserID int64
-	subscriptions map[int64]*pubsub.Subscription // conference_id -> subscription
-	topics        map[int64]*pubsub.Topic        // conference_id -> topic
+	topics        *topicManager  // Subscribed conference topics
+	writer        *messageWriter // Batches received messages into storage
+	limiter       *rateLimiter   // Holds members to each conference's posting limits
+	archivers     int            // Members per conference that keep full history
+	maxDefault    atomic.Int64   // Participant limit given to new conferences (0 = unlimited)
+	offense       func(pid peer.ID, offense string)
+	locked        func() bool // Reports whether the app is locked, hiding message content
+	presenceShown func() bool // Reports whether members may see we are online
+
+	mu        sync.Mutex                  // Guards invites and cooldowns
+	invites   map[int64]*ConferenceInvite // Latest invite received per conference, for redeeming
+	cooldowns map[int64]bool              // Conferences we'll announce the end of a posting cooldown in
+	admitMu   sync.Mutex                  // Serializes admission decisions so the limit holds
+
+	compactMu  sync.Mutex           // Guards compactors, compaction and compacted
+	compactors map[string]Compactor // Compaction policies by name
+	compaction compaction           // Policy in use and how many days it leaves alone
+	compacted  map[int64]int64      // Newest logical clock value compacted, per conference
+
+	presenceMu sync.Mutex                               // Guards presence
+	presence   map[int64]map[peer.ID]*OnlineParticipant // Members heard beaconing, per conference
 }
 
 // NewManager creates a new conference manager
 func NewManager(store storage.Storage, h host.Host, ps *pubsub.PubSub) *Manager {
 	m := &Manager{
-		storage:       store,
-		host:          h,
-		pubsub:        ps,
-		protocol:      NewProtocol(),
-		subscriptions: make(map[int64]*pubsub.Subscription),
-		topics:        make(map[int64]*pubsub.Topic),
-	}
+		storage:   store,
+		host:      h,
+		pubsub:    ps,
+		protocol:  NewProtocol(),
+		invites:   make(map[int64]*ConferenceInvite),
+		cooldowns: make(map[int64]bool),
+		writer:    newMessageWriter(store),
+		limiter:   newRateLimiter(),
+		compactors: map[string]Compactor{
+			CompactionTruncate: CompactorFunc(truncate),
+		},
+		compaction: compaction{policy: CompactionTruncate},
+		compacted:  make(map[int64]int64),
+		presence:   make(map[int64]map[peer.ID]*OnlineParticipant),
+	}
+	m.topics = newTopicManager(ps, m.isAdmitted, m.isObserver, m.isRateLimited)
 
 	// Set protocol handlers
 	m.protocol.SetInviteHandler(m.handleIncomingInvite)
+	m.protocol.SetHistoryHandler(m.handleHistoryRequest)
+	m.protocol.SetAdmissionHandler(m.handleAdmissionRequest)
+	m.protocol.SetInvalidHandler(func(pid peer.ID) { m.reportOffense(pid, storage.PeerOffenseInvalidMessage) })
 
 	// Register stream handlers
-	h.SetStreamHandler(ProtocolConferenceInvite, m.protocol.HandleConferenceInvite)
+	p2p.HandleStreams(h, m.protocol.HandleConferenceInvite, ProtocolConferenceInviteV2, ProtocolConferenceInvite)
+	p2p.HandleStreams(h, m.protocol.HandleConferenceHistory, ProtocolConferenceHistoryV2, ProtocolConferenceHistory)
+	p2p.HandleStreams(h, m.protocol.HandleConferenceAdmission, ProtocolConferenceAdmissionV2, ProtocolConferenceAdmission)
 
 	return m
 }
@@ -48,6 +88,42 @@ func (m *Manager) SetCurrentUser(userID int64) {
 	m.currentUserID = userID
 }
 
+// SetLockCheck sets a callback reporting whether the app is locked; while it
+// is, notifications of new messages leave out who sent them and what they say
+func (m *Manager) SetLockCheck(locked func() bool) {
+	m.locked = locked
+}
+
+// isLocked reports whether the lock check says the app is locked
+func (m *Manager) isLocked() bool {
+	return m.locked != nil && m.locked()
+}
+
+// SetPresenceCheck sets a callback reporting whether the user shows members
+// they are online; while it says no, no presence beacons are sent
+func (m *Manager) SetPresenceCheck(shown func() bool) {
+	m.presenceShown = shown
+}
+
+// showsPresence reports whether the presence check lets us beacon
+func (m *Manager) showsPresence() bool {
+	return m.presenceShown == nil || m.presenceShown()
+}
+
+// SetOffenseHandler sets the handler told when a peer misbehaves toward us,
+// with the storage.PeerOffense* it committed: a malformed message, or a post
+// over a conference's limits
+func (m *Manager) SetOffenseHandler(handler func(pid peer.ID, offense string)) {
+	m.offense = handler
+}
+
+// reportOffense tells the offense handler about a peer
+func (m *Manager) reportOffense(pid peer.ID, offense string) {
+	if m.offense != nil {
+		m.offense(pid, offense)
+	}
+}
+
 // CreateConference creates a new conference
 func (m *Manager) CreateConference(ctx context.Context, currentUser *storage.User, name string) (*storage.Conference, error) {
 	if m.currentUserID == 0 {
@@ -56,9 +132,10 @@ func (m *Manager) CreateConference(ctx context.Context, currentUser *storage.Use
 
 	// Create conference
 	conf := &storage.Conference{
-		Name:      name,
-		CreatorID: currentUser.ID,
-		CreatedAt: time.Now(),
+		Name:            name,
+		CreatorID:       currentUser.ID,
+		MaxParticipants: int(m.maxDefault.Load()),
+		CreatedAt:       time.Now(),
 	}
 
 	if err := m.storage.CreateConference(ctx, conf); err != nil {
@@ -84,16 +161,67 @@ func (m *Manager) CreateConference(ctx context.Context, currentUser *storage.Use
 		return nil, fmt.Errorf("failed to subscribe to conference: %w", err)
 	}
 
-	fmt.Printf("✓ Conference '%s' created (ID: %d)\n", name, conf.ID)
+	m.addSelfToMembership(ctx, currentUser, conf.ID, nil)
+	m.publishSystemMessage(ctx, currentUser, conf.ID, fmt.Sprintf("%s created the conference", currentUser.FullName))
+
+	i18n.Printf("✓ Conference '%s' created (ID: %d)\n", name, conf.ID)
+	return conf, nil
+}
+
+// conferenceFromInvite stores a conference we were invited to but have no
+// record of, owned by whoever the invite names as its owner
+func (m *Manager) conferenceFromInvite(ctx context.Context, conferenceID int64) (*storage.Conference, error) {
+	m.mu.Lock()
+	invite, ok := m.invites[conferenceID]
+	m.mu.Unlock()
+	if !ok {
+		return nil, ErrConferenceNotFound
+	}
+
+	ownerID := invite.OwnerPeerID
+	if ownerID == "" {
+		ownerID = invite.FromPeerID
+	}
+	owner, err := m.storage.GetUserByPeerID(ctx, ownerID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrOwnerUnknown
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conference owner: %w", err)
+	}
+
+	conf := &storage.Conference{
+		ID:              invite.ConferenceID,
+		Name:            invite.ConferenceName,
+		CreatorID:       owner.ID,
+		MaxParticipants: int(m.maxDefault.Load()),
+		CreatedAt:       time.Now(),
+	}
+	if err := m.storage.CreateConference(ctx, conf); err != nil {
+		return nil, fmt.Errorf("failed to record conference: %w", err)
+	}
+	return conf, nil
+}
+
+// getConference looks up a conference, returning ErrConferenceNotFound if
+// there is no such conference
+func (m *Manager) getConference(ctx context.Context, conferenceID int64) (*storage.Conference, error) {
+	conf, err := m.storage.GetConference(ctx, conferenceID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrConferenceNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conference: %w", err)
+	}
 	return conf, nil
 }
 
 // InviteToConference invites a friend to a conference
 func (m *Manager) InviteToConference(ctx context.Context, currentUser *storage.User, conferenceID int64, friendUsername string) error {
 	// Get the conference
-	conf, err := m.storage.GetConference(ctx, conferenceID)
-	if err != nil || conf == nil {
-		return fmt.Errorf("conference not found")
+	conf, err := m.getConference(ctx, conferenceID)
+	if err != nil {
+		return err
 	}
 
 	// Verify current user is a participant
@@ -116,9 +244,12 @@ func (m *Manager) InviteToConference(ctx context.Context, currentUser *storage.U
 
 	// Get friend
 	friend, err := m.storage.GetUserByUsername(ctx, friendUsername)
-	if err != nil || friend == nil {
+	if errors.Is(err, storage.ErrNotFound) {
 		return fmt.Errorf("user not found: %s", friendUsername)
 	}
+	if err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
 
 	// Check if they're friends
 	friendship, err := m.storage.GetFriendRequest(ctx, currentUser.ID, friend.ID)
@@ -147,7 +278,7 @@ func (m *Manager) InviteToConference(ctx context.Context, currentUser *storage.U
 		return fmt.Errorf("%s is not online - invites require recipient to be connected", friendUsername)
 	}
 
-	stream, err := m.host.NewStream(ctx, friendPeerID, ProtocolConferenceInvite)
+	stream, err := m.host.NewStream(ctx, friendPeerID, ProtocolConferenceInviteV2, ProtocolConferenceInvite)
 	if err != nil {
 		return fmt.Errorf("failed to open stream: %w", err)
 	}
@@ -158,6 +289,7 @@ func (m *Manager) InviteToConference(ctx context.Context, currentUser *storage.U
 		FromUsername:   currentUser.Username,
 		FromFullName:   currentUser.FullName,
 		FromPeerID:     currentUser.PeerID,
+		OwnerPeerID:    m.ownerPeerID(ctx, conf),
 		Message:        fmt.Sprintf("%s invited you to conference '%s'", currentUser.FullName, conf.Name),
 	}
 
@@ -165,47 +297,62 @@ func (m *Manager) InviteToConference(ctx context.Context, currentUser *storage.U
 		return fmt.Errorf("failed to send invite: %w", err)
 	}
 
-	fmt.Printf("✓ Invited %s to conference '%s'\n", friendUsername, conf.Name)
+	i18n.Printf("✓ Invited %s to conference '%s'\n", friendUsername, conf.Name)
 	return nil
 }
 
 // JoinConference joins a conference by ID
 func (m *Manager) JoinConference(ctx context.Context, currentUser *storage.User, conferenceID int64) error {
-	// Get the conference
-	conf, err := m.storage.GetConference(ctx, conferenceID)
-	if err != nil || conf == nil {
-		return fmt.Errorf("conference not found")
+	// Get the conference, or record it from the invite when it is new to us
+	conf, err := m.getConference(ctx, conferenceID)
+	if errors.Is(err, ErrConferenceNotFound) {
+		conf, err = m.conferenceFromInvite(ctx, conferenceID)
+	}
+	if err != nil {
+		return err
 	}
 
 	// Check if already a participant
-	participants, err := m.storage.GetConferenceParticipants(ctx, conferenceID)
+	existing, err := m.storage.GetConferenceParticipant(ctx, conferenceID, currentUser.ID)
 	if err != nil {
-		return fmt.Errorf("failed to get participants: %w", err)
+		return fmt.Errorf("failed to get participant: %w", err)
 	}
 
-	for _, p := range participants {
-		if p.UserID == currentUser.ID {
-			if p.Active {
-				return fmt.Errorf("you are already in this conference")
-			}
-			// Reactivate if previously left
-			p.Active = true
-			// Note: We'd need an UpdateConferenceParticipant method for this
-		}
+	if existing != nil && existing.Active {
+		return fmt.Errorf("you are already in this conference")
 	}
 
-	// Add as participant
-	participant := &storage.ConferenceParticipant{
-		ConferenceID: conf.ID,
-		UserID:       currentUser.ID,
-		PeerID:       currentUser.PeerID,
-		Username:     currentUser.Username,
-		JoinedAt:     time.Now(),
-		Active:       true,
+	// Redeem the invite with the owner, who enforces the participant limit
+	var admitted []*MembershipEntry
+	if conf.CreatorID != currentUser.ID {
+		if admitted, err = m.requestAdmission(ctx, currentUser, conf); err != nil {
+			return err
+		}
 	}
 
-	if err := m.storage.AddConferenceParticipant(ctx, participant); err != nil {
-		return fmt.Errorf("failed to add participant: %w", err)
+	if existing != nil {
+		// Reactivate the previous row so the original join time is kept
+		existing.PeerID = currentUser.PeerID
+		existing.Username = currentUser.Username
+		existing.LeftAt = time.Time{}
+		existing.Active = true
+		if err := m.storage.UpdateConferenceParticipant(ctx, existing); err != nil {
+			return fmt.Errorf("failed to rejoin: %w", err)
+		}
+	} else {
+		// Add as participant
+		participant := &storage.ConferenceParticipant{
+			ConferenceID: conf.ID,
+			UserID:       currentUser.ID,
+			PeerID:       currentUser.PeerID,
+			Username:     currentUser.Username,
+			JoinedAt:     time.Now(),
+			Active:       true,
+		}
+
+		if err := m.storage.AddConferenceParticipant(ctx, participant); err != nil {
+			return fmt.Errorf("failed to add participant: %w", err)
+		}
 	}
 
 	// Subscribe to conference topic
@@ -213,12 +360,20 @@ func (m *Manager) JoinConference(ctx context.Context, currentUser *storage.User,
 		return fmt.Errorf("failed to subscribe: %w", err)
 	}
 
-	fmt.Printf("✓ Joined conference '%s'\n", conf.Name)
+	m.addSelfToMembership(ctx, currentUser, conf.ID, admitted)
+	m.publishSystemMessage(ctx, currentUser, conf.ID, fmt.Sprintf("%s joined the conference", currentUser.FullName))
+
+	i18n.Printf("✓ Joined conference '%s'\n", conf.Name)
 	return nil
 }
 
 // SendMessage sends a message to a conference via GossipSub
 func (m *Manager) SendMessage(ctx context.Context, currentUser *storage.User, conferenceID int64, content string) error {
+	// Members would drop an oversized message on arrival
+	if len(content) > p2p.MaxContentLength {
+		return p2p.ErrContentTooLong
+	}
+
 	// Verify user is a participant
 	participants, err := m.storage.GetConferenceParticipants(ctx, conferenceID)
 	if err != nil {
@@ -236,25 +391,64 @@ func (m *Manager) SendMessage(ctx context.Context, currentUser *storage.User, co
 	if !isParticipant {
 		return fmt.Errorf("you are not a participant in this conference")
 	}
+	if m.observing(ctx, conferenceID, currentUser.PeerID) {
+		return ErrObserver
+	}
+
+	if err := m.checkPostRate(ctx, currentUser, conferenceID); err != nil {
+		return err
+	}
 
+	return m.publish(ctx, currentUser, conferenceID, "", content, storage.MessageKindUser)
+}
+
+// publishSystemMessage broadcasts and records a conference event such as a
+// member joining. Observers' events go unannounced, since members would
+// reject them.
+func (m *Manager) publishSystemMessage(ctx context.Context, currentUser *storage.User, conferenceID int64, content string) {
+	if !m.topics.isSubscribed(conferenceID) {
+		return // Not subscribed, nobody to tell
+	}
+	if m.observing(ctx, conferenceID, currentUser.PeerID) {
+		return
+	}
+	if err := m.publish(ctx, currentUser, conferenceID, "", content, storage.MessageKindSystem); err != nil {
+		i18n.Printf("Warning: Failed to announce conference event: %v\n", err)
+	}
+}
+
+// publish sends a message of the given kind to a conference channel and saves it locally
+func (m *Manager) publish(ctx context.Context, currentUser *storage.User, conferenceID int64, channel, content, kind string) error {
 	// Get topic
-	topic, ok := m.topics[conferenceID]
+	topic, ok := m.topics.channelTopic(conferenceID, channel)
 	if !ok {
+		if channel != "" && m.topics.isSubscribed(conferenceID) {
+			return ErrUnknownChannel
+		}
 		return fmt.Errorf("not subscribed to conference - use 'join-conf %d' first", conferenceID)
 	}
 
+	// Advance the conference's logical clock past everything received
+	m.writer.flush(ctx)
+	lamport, err := m.storage.NextConferenceLamport(ctx, conferenceID)
+	if err != nil {
+		return fmt.Errorf("failed to get logical clock: %w", err)
+	}
+
 	// Create message
 	msg := &ConferenceGossipMessage{
 		ConferenceID: conferenceID,
+		Channel:      channel,
 		FromUsername: currentUser.Username,
 		FromFullName: currentUser.FullName,
 		FromPeerID:   currentUser.PeerID,
 		Content:      content,
+		Kind:         kind,
+		Lamport:      lamport,
 		Timestamp:    time.Now().Unix(),
 	}
 
-	// Marshal to JSON
-	data, err := json.Marshal(msg)
+	data, err := encodeTopicMessage(msg, m.protobufTopics(ctx, conferenceID, topic))
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
@@ -267,14 +461,17 @@ func (m *Manager) SendMessage(ctx context.Context, currentUser *storage.User, co
 	// Save to local database
 	confMsg := &storage.ConferenceMessage{
 		ConferenceID: conferenceID,
+		Channel:      channel,
 		FromUserID:   currentUser.ID,
 		FromPeerID:   currentUser.PeerID,
 		Content:      content,
+		Kind:         kind,
+		Lamport:      lamport,
 		CreatedAt:    time.Now(),
 	}
 
 	if err := m.storage.SaveConferenceMessage(ctx, confMsg); err != nil {
-		fmt.Printf("Warning: Failed to save message locally: %v\n", err)
+		i18n.Printf("Warning: Failed to save message locally: %v\n", err)
 	}
 
 	return nil
@@ -282,38 +479,185 @@ func (m *Manager) SendMessage(ctx context.Context, currentUser *storage.User, co
 
 // SubscribeToConference subscribes to a conference's GossipSub topic
 func (m *Manager) SubscribeToConference(ctx context.Context, currentUser *storage.User, conferenceID int64) error {
-	// Check if already subscribed
-	if _, ok := m.subscriptions[conferenceID]; ok {
+	ct, listenCtx, err := m.topics.subscribe(ctx, conferenceID)
+	if err != nil {
+		return err
+	}
+	if ct == nil {
 		return nil // Already subscribed
 	}
 
-	// Create topic name
-	topicName := fmt.Sprintf("/whisper/conf/%d", conferenceID)
+	// Start listening for messages in background
+	go m.listenToConference(listenCtx, conferenceID, ct.sub)
+	go m.listenToControl(listenCtx, conferenceID, ct.controlSub)
+	go m.listenToPresence(listenCtx, conferenceID, ct.presenceSub)
+	go m.beaconPresence(listenCtx, currentUser, conferenceID)
+	m.subscribeChannels(ctx, conferenceID)
+
+	// Share our view so existing members reply with theirs
+	if err := m.broadcastMembership(ctx, conferenceID); err != nil {
+		i18n.Printf("Warning: Failed to broadcast membership: %v\n", err)
+	}
+
+	// Catch up on history once the roster has had a chance to converge
+	go func() {
+		select {
+		case <-listenCtx.Done():
+		case <-time.After(historySyncDelay):
+			m.syncHistory(listenCtx, conferenceID)
+		}
+	}()
+
+	return nil
+}
 
-	// Join topic
-	topic, err := m.pubsub.Join(topicName)
+// ResubscribeConferences subscribes to every conference the user is an active
+// participant in, so messages flow again after a restart or re-login
+func (m *Manager) ResubscribeConferences(ctx context.Context, currentUser *storage.User) (int, error) {
+	conferences, err := m.storage.GetUserConferences(ctx, currentUser.ID)
 	if err != nil {
-		return fmt.Errorf("failed to join topic: %w", err)
+		return 0, fmt.Errorf("failed to get conferences: %w", err)
+	}
+
+	subscribed := 0
+	for _, conf := range conferences {
+		if m.topics.isSubscribed(conf.ID) {
+			continue
+		}
+		if err := m.SubscribeToConference(ctx, currentUser, conf.ID); err != nil {
+			i18n.Printf("Warning: Failed to resubscribe to conference %d: %v\n", conf.ID, err)
+			continue
+		}
+		subscribed++
 	}
+	return subscribed, nil
+}
 
-	// Subscribe to topic
-	sub, err := topic.Subscribe()
+// UnsubscribeAll leaves every conference topic without changing membership,
+// for use on logout and shutdown
+func (m *Manager) UnsubscribeAll() int {
+	count := m.topics.unsubscribeAll()
+	m.forgetPresence(0)
+	m.writer.flush(context.Background())
+	return count
+}
+
+// loadMembership reads a conference's membership set from storage
+func (m *Manager) loadMembership(ctx context.Context, conferenceID int64) (*Membership, error) {
+	stored, err := m.storage.GetConferenceMembership(ctx, conferenceID)
 	if err != nil {
-		return fmt.Errorf("failed to subscribe: %w", err)
+		return nil, err
 	}
 
-	// Store subscription and topic
-	m.subscriptions[conferenceID] = sub
-	m.topics[conferenceID] = topic
+	entries := make([]*MembershipEntry, 0, len(stored))
+	for _, e := range stored {
+		entries = append(entries, &MembershipEntry{
+			PeerID:   e.PeerID,
+			Username: e.Username,
+			Tag:      e.Tag,
+			Removed:  e.Removed,
+		})
+	}
+	return NewMembership(entries), nil
+}
 
-	// Start listening for messages in background
-	go m.listenToConference(ctx, currentUser, conferenceID, sub)
+// saveMembership persists changed entries of a conference's membership set
+func (m *Manager) saveMembership(ctx context.Context, conferenceID int64, changed []*MembershipEntry) error {
+	stored := make([]*storage.ConferenceMembershipEntry, 0, len(changed))
+	for _, e := range changed {
+		stored = append(stored, &storage.ConferenceMembershipEntry{
+			ConferenceID: conferenceID,
+			PeerID:       e.PeerID,
+			Username:     e.Username,
+			Tag:          e.Tag,
+			Removed:      e.Removed,
+		})
+	}
+	return m.storage.SaveConferenceMembership(ctx, stored)
+}
 
-	return nil
+// addSelfToMembership records the current user's join in the membership set,
+// folding in the set the owner returned on admission
+func (m *Manager) addSelfToMembership(ctx context.Context, currentUser *storage.User, conferenceID int64, admitted []*MembershipEntry) {
+	owner := m.ownerOf(ctx, conferenceID)
+	err := m.updateMembership(ctx, conferenceID, func(ms *Membership) []*MembershipEntry {
+		changed := ms.Merge(admitted, owner, owner)
+		if !ms.Contains(currentUser.PeerID) {
+			changed = append(changed, ms.Add(currentUser.PeerID, currentUser.Username))
+		}
+		return changed
+	})
+	if err != nil {
+		i18n.Printf("Warning: Failed to update membership: %v\n", err)
+	}
 }
 
-// listenToConference listens for messages on a conference subscription
-func (m *Manager) listenToConference(ctx context.Context, currentUser *storage.User, conferenceID int64, sub *pubsub.Subscription) {
+// updateMembership applies a local operation, persists it, and broadcasts the new state
+func (m *Manager) updateMembership(ctx context.Context, conferenceID int64, op func(ms *Membership) []*MembershipEntry) error {
+	ms, err := m.loadMembership(ctx, conferenceID)
+	if err != nil {
+		return fmt.Errorf("failed to load membership: %w", err)
+	}
+
+	changed := op(ms)
+	if len(changed) == 0 {
+		return nil
+	}
+
+	if err := m.saveMembership(ctx, conferenceID, changed); err != nil {
+		return fmt.Errorf("failed to save membership: %w", err)
+	}
+
+	m.reconcileParticipants(ctx, conferenceID, ms)
+	return m.broadcastMembership(ctx, conferenceID)
+}
+
+// broadcastMembership publishes the full membership set on the control topic
+func (m *Manager) broadcastMembership(ctx context.Context, conferenceID int64) error {
+	topic, ok := m.topics.controlTopic(conferenceID)
+	if !ok {
+		return nil // Not subscribed
+	}
+
+	ms, err := m.loadMembership(ctx, conferenceID)
+	if err != nil {
+		return fmt.Errorf("failed to load membership: %w", err)
+	}
+
+	channels, err := m.channelNames(ctx, conferenceID)
+	if err != nil {
+		return fmt.Errorf("failed to load channels: %w", err)
+	}
+
+	rateLimit, err := m.wireRateLimit(ctx, conferenceID)
+	if err != nil {
+		return fmt.Errorf("failed to load rate limit: %w", err)
+	}
+
+	observers, err := m.wireObservers(ctx, conferenceID)
+	if err != nil {
+		return fmt.Errorf("failed to load observers: %w", err)
+	}
+
+	state := &MembershipState{
+		ConferenceID: conferenceID,
+		FromPeerID:   m.host.ID().String(),
+		Entries:      ms.Entries(),
+		Channels:     channels,
+		RateLimit:    rateLimit,
+		Observers:    observers,
+	}
+
+	data, err := encodeTopicMessage(state, m.protobufTopics(ctx, conferenceID, topic))
+	if err != nil {
+		return fmt.Errorf("failed to marshal membership: %w", err)
+	}
+
+	return topic.Publish(ctx, data)
+}
+
+// listenToControl merges membership states gossiped by other members
+func (m *Manager) listenToControl(ctx context.Context, conferenceID int64, sub *pubsub.Subscription) {
 	for {
 		msg, err := sub.Next(ctx)
 		if err != nil {
@@ -321,40 +665,203 @@ func (m *Manager) listenToConference(ctx context.Context, currentUser *storage.U
 			return
 		}
 
-		// Skip messages from self
+		// Skip our own broadcasts
 		if msg.ReceivedFrom == m.host.ID() {
 			continue
 		}
 
-		// Parse message
-		var gossipMsg ConferenceGossipMessage
-		if err := json.Unmarshal(msg.Data, &gossipMsg); err != nil {
-			fmt.Printf("Error parsing conference message: %v\n", err)
+		p2p.Protect("conference membership", msg.ReceivedFrom, func() { m.mergeMembershipState(ctx, conferenceID, msg) })
+	}
+}
+
+// mergeMembershipState merges one gossiped membership state, and answers with
+// ours when the sender is missing something we know
+func (m *Manager) mergeMembershipState(ctx context.Context, conferenceID int64, msg *pubsub.Message) {
+	state, err := decodeTopicMembershipState(msg.Data)
+	if err != nil {
+		i18n.Printf("Error parsing membership state: %v\n", err)
+		return
+	}
+	if state.ConferenceID != conferenceID {
+		return
+	}
+
+	ms, err := m.loadMembership(ctx, conferenceID)
+	if err != nil {
+		i18n.Printf("Warning: Failed to load membership: %v\n", err)
+		return
+	}
+
+	if changed := ms.Merge(state.Entries, msg.GetFrom().String(), m.ownerOf(ctx, conferenceID)); len(changed) > 0 {
+		if err := m.saveMembership(ctx, conferenceID, changed); err != nil {
+			i18n.Printf("Warning: Failed to save membership: %v\n", err)
+			return
+		}
+		m.reconcileParticipants(ctx, conferenceID, ms)
+	}
+
+	channelsCovered := m.mergeChannels(ctx, conferenceID, state.Channels)
+	rateLimitCovered := m.mergeRateLimit(ctx, state)
+	observersCovered := m.mergeObservers(ctx, state)
+
+	// The sender is missing entries, channels, limits or observers we know about - send them our state
+	if !ms.Covers(state.Entries) || !channelsCovered || !rateLimitCovered || !observersCovered {
+		if err := m.broadcastMembership(ctx, conferenceID); err != nil {
+			i18n.Printf("Warning: Failed to broadcast membership: %v\n", err)
+		}
+	}
+}
+
+// reconcileParticipants makes the local participant rows match the membership set
+func (m *Manager) reconcileParticipants(ctx context.Context, conferenceID int64, ms *Membership) {
+	participants, err := m.storage.GetConferenceParticipants(ctx, conferenceID)
+	if err != nil {
+		i18n.Printf("Warning: Failed to get participants: %v\n", err)
+		return
+	}
+
+	active := make(map[string]bool, len(participants))
+	for _, p := range participants {
+		active[p.PeerID] = true
+	}
+
+	// Add members we haven't recorded yet
+	for peerID, username := range ms.Members() {
+		if active[peerID] {
 			continue
 		}
+		participant := &storage.ConferenceParticipant{
+			ConferenceID: conferenceID,
+			PeerID:       peerID,
+			Username:     username,
+			JoinedAt:     time.Now(),
+			Active:       true,
+		}
+		if user, err := m.storage.GetUserByPeerID(ctx, peerID); err == nil {
+			participant.UserID = user.ID
+
+			// Reactivate a member who left and rejoined rather than adding a second row
+			if previous, err := m.storage.GetConferenceParticipant(ctx, conferenceID, user.ID); err == nil && previous != nil {
+				previous.PeerID = peerID
+				previous.Username = username
+				previous.LeftAt = time.Time{}
+				previous.Active = true
+				if err := m.storage.UpdateConferenceParticipant(ctx, previous); err != nil {
+					i18n.Printf("Warning: Failed to reactivate participant %s: %v\n", username, err)
+				}
+				continue
+			}
+		}
+		if err := m.storage.AddConferenceParticipant(ctx, participant); err != nil {
+			i18n.Printf("Warning: Failed to add participant %s: %v\n", username, err)
+		}
+	}
+
+	// Deactivate members whose every observed join has been removed.
+	// Participants the set has never seen (pre-replication rows) are left alone.
+	known := make(map[string]bool)
+	for _, e := range ms.Entries() {
+		known[e.PeerID] = true
+	}
+	for _, p := range participants {
+		if known[p.PeerID] && !ms.Contains(p.PeerID) {
+			if err := m.storage.RemoveConferenceParticipantByPeerID(ctx, conferenceID, p.PeerID); err != nil {
+				i18n.Printf("Warning: Failed to remove participant %s: %v\n", p.Username, err)
+			}
+		}
+	}
+}
 
-		// Save to database
-		confMsg := &storage.ConferenceMessage{
-			ConferenceID: gossipMsg.ConferenceID,
-			FromUserID:   0, // We might not know their user ID
-			FromPeerID:   gossipMsg.FromPeerID,
-			Content:      gossipMsg.Content,
-			CreatedAt:    time.Unix(gossipMsg.Timestamp, 0),
+// listenToConference listens for messages on a conference subscription
+func (m *Manager) listenToConference(ctx context.Context, conferenceID int64, sub *pubsub.Subscription) {
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			// Subscription closed or context canceled
+			return
 		}
 
-		// Try to find user by peer ID
-		fromUser, err := m.storage.GetUserByPeerID(ctx, gossipMsg.FromPeerID)
-		if err == nil && fromUser != nil {
-			confMsg.FromUserID = fromUser.ID
+		// Skip messages from self
+		if msg.ReceivedFrom == m.host.ID() {
+			continue
 		}
 
-		if err := m.storage.SaveConferenceMessage(ctx, confMsg); err != nil {
-			fmt.Printf("Warning: Failed to save conference message: %v\n", err)
+		p2p.Protect("conference message", msg.ReceivedFrom, func() { m.receiveGossipMessage(ctx, msg) })
+	}
+}
+
+// receiveGossipMessage saves and shows one message gossiped on a conference topic
+func (m *Manager) receiveGossipMessage(ctx context.Context, msg *pubsub.Message) {
+	// Parse message
+	gossipMsg, err := decodeTopicMessage(msg.Data)
+	if err != nil {
+		i18n.Printf("Error parsing conference message: %v\n", err)
+		return
+	}
+
+	// Save to database (skipping messages already fetched via history)
+	confMsg, stored := m.storeGossipMessage(ctx, gossipMsg)
+	if !stored {
+		return
+	}
+
+	// Display notification
+	if m.isLocked() {
+		i18n.Printf("\n🔒 New message - unlock to read it\n> ")
+		return
+	}
+	label := i18n.T("Conference")
+	if gossipMsg.Channel != "" {
+		label = i18n.Sprintf("Conference #%s", gossipMsg.Channel)
+	}
+	if confMsg.IsSystem() {
+		i18n.Printf("\n📢 [%s] *** %s ***\n> ", label, gossipMsg.Content)
+		return
+	}
+	i18n.Printf("\n📢 [%s] %s: %s\n> ", label, gossipMsg.FromFullName, gossipMsg.Content)
+}
+
+// storeGossipMessage queues a conference message for saving unless it is already
+// stored or queued
+func (m *Manager) storeGossipMessage(ctx context.Context, gossipMsg *ConferenceGossipMessage) (*storage.ConferenceMessage, bool) {
+	if gossipMsg.Lamport > 0 {
+		if m.writer.has(gossipMsg.ConferenceID, gossipMsg.FromPeerID, gossipMsg.Lamport) {
+			return nil, false
+		}
+		exists, err := m.storage.HasConferenceMessage(ctx, gossipMsg.ConferenceID, gossipMsg.FromPeerID, gossipMsg.Lamport)
+		if err != nil {
+			i18n.Printf("Warning: Failed to check for duplicate conference message: %v\n", err)
+		} else if exists {
+			return nil, false
+		}
+		// History we compacted away isn't taken back from other members
+		if gossipMsg.Lamport <= m.compactedThrough(ctx, gossipMsg.ConferenceID) {
+			return nil, false
 		}
+	}
 
-		// Display notification
-		fmt.Printf("\n📢 [Conference] %s: %s\n> ", gossipMsg.FromFullName, gossipMsg.Content)
+	confMsg := &storage.ConferenceMessage{
+		ConferenceID: gossipMsg.ConferenceID,
+		Channel:      gossipMsg.Channel,
+		FromUserID:   0, // We might not know their user ID
+		FromPeerID:   gossipMsg.FromPeerID,
+		Content:      gossipMsg.Content,
+		Kind:         storage.NormalizeKind(gossipMsg.Kind),
+		Lamport:      gossipMsg.Lamport,
+		CreatedAt:    time.Now(),
+	}
+	if author, err := peer.Decode(gossipMsg.FromPeerID); err == nil {
+		confMsg.CreatedAt = p2p.NormalizeTimestamp(m.host, author, gossipMsg.Timestamp, confMsg.CreatedAt)
 	}
+
+	// Try to find user by peer ID
+	fromUser, err := m.storage.GetUserByPeerID(ctx, gossipMsg.FromPeerID)
+	if err == nil {
+		confMsg.FromUserID = fromUser.ID
+	}
+
+	m.writer.add(confMsg)
+	return confMsg, true
 }
 
 // LeaveConference leaves a conference
@@ -364,21 +871,35 @@ func (m *Manager) LeaveConference(ctx context.Context, currentUser *storage.User
 		return fmt.Errorf("failed to leave conference: %w", err)
 	}
 
-	// Unsubscribe from topic
-	if sub, ok := m.subscriptions[conferenceID]; ok {
-		sub.Cancel()
-		delete(m.subscriptions, conferenceID)
+	// Announce departure while still subscribed
+	m.publishSystemMessage(ctx, currentUser, conferenceID, fmt.Sprintf("%s left the conference", currentUser.FullName))
+
+	// Tombstone our membership so other replicas drop us from the roster
+	if err := m.updateMembership(ctx, conferenceID, func(ms *Membership) []*MembershipEntry {
+		return ms.Remove(currentUser.PeerID)
+	}); err != nil {
+		i18n.Printf("Warning: Failed to update membership: %v\n", err)
 	}
 
-	if topic, ok := m.topics[conferenceID]; ok {
-		topic.Close()
-		delete(m.topics, conferenceID)
+	// Tell members we're gone rather than waiting for our beacon to expire
+	if err := m.publishPresence(ctx, currentUser, conferenceID, true); err != nil {
+		i18n.Printf("Warning: Failed to publish presence: %v\n", err)
 	}
 
-	fmt.Printf("✓ Left conference\n")
+	// Unsubscribe from topics
+	m.topics.unsubscribe(conferenceID)
+	m.forgetPresence(conferenceID)
+
+	i18n.Printf("✓ Left conference\n")
 	return nil
 }
 
+// PendingWrites returns how many received messages are waiting to be written
+// to storage
+func (m *Manager) PendingWrites() int {
+	return m.writer.depth()
+}
+
 // GetConferences returns all conferences the user is in
 func (m *Manager) GetConferences(ctx context.Context, userID int64) ([]*storage.Conference, error) {
 	return m.storage.GetUserConferences(ctx, userID)
@@ -386,9 +907,28 @@ func (m *Manager) GetConferences(ctx context.Context, userID int64) ([]*storage.
 
 // GetConferenceMessages returns messages from a conference
 func (m *Manager) GetConferenceMessages(ctx context.Context, conferenceID int64, limit int) ([]*storage.ConferenceMessage, error) {
+	m.writer.flush(ctx)
 	return m.storage.GetConferenceMessages(ctx, conferenceID, limit)
 }
 
+// MarkRead marks every message received in a conference so far as read by a user
+func (m *Manager) MarkRead(ctx context.Context, userID, conferenceID int64) error {
+	m.writer.flush(ctx)
+	return m.storage.MarkConferenceRead(ctx, userID, conferenceID)
+}
+
+// GetStats summarizes a conference's messages since the given time (zero for all time)
+func (m *Manager) GetStats(ctx context.Context, conferenceID int64, since time.Time) (*storage.ConversationStats, error) {
+	m.writer.flush(ctx)
+	return m.storage.GetConferenceStats(ctx, conferenceID, since)
+}
+
+// DeleteMessageForMe hides a conference message from local history without telling other members
+func (m *Manager) DeleteMessageForMe(ctx context.Context, conferenceID, messageID int64) error {
+	m.writer.flush(ctx)
+	return m.storage.HideConferenceMessage(ctx, conferenceID, messageID)
+}
+
 // GetConferenceParticipants returns participants in a conference
 func (m *Manager) GetConferenceParticipants(ctx context.Context, conferenceID int64) ([]*storage.ConferenceParticipant, error) {
 	return m.storage.GetConferenceParticipants(ctx, conferenceID)
@@ -396,9 +936,27 @@ func (m *Manager) GetConferenceParticipants(ctx context.Context, conferenceID in
 
 // handleIncomingInvite handles incoming conference invitations
 func (m *Manager) handleIncomingInvite(invite *ConferenceInvite, fromPeer peer.ID) {
-	fmt.Printf("\n📨 Conference invite from %s (%s)\n", invite.FromFullName, invite.FromUsername)
-	fmt.Printf("   Conference: %s (ID: %d)\n", invite.ConferenceName, invite.ConferenceID)
-	fmt.Printf("   Message: %s\n", invite.Message)
-	fmt.Printf("   Use 'join-conf %d' to join\n", invite.ConferenceID)
-	fmt.Print("> ")
+	m.mu.Lock()
+	m.invites[invite.ConferenceID] = invite
+	m.mu.Unlock()
+
+	if m.currentUserID != 0 {
+		err := m.storage.RecordActivity(context.Background(), &storage.Activity{
+			UserID:       m.currentUserID,
+			Kind:         storage.ActivityConferenceInvite,
+			PeerID:       fromPeer.String(),
+			Name:         invite.FromUsername,
+			ConferenceID: invite.ConferenceID,
+			Detail:       invite.ConferenceName,
+		})
+		if err != nil {
+			i18n.Printf("Warning: Failed to record activity: %v\n", err)
+		}
+	}
+
+	i18n.Printf("\n📨 Conference invite from %s (%s)\n", invite.FromFullName, invite.FromUsername)
+	i18n.Printf("   Conference: %s (ID: %d)\n", invite.ConferenceName, invite.ConferenceID)
+	i18n.Printf("   Message: %s\n", invite.Message)
+	i18n.Printf("   Use 'join-conf %d' to join\n", invite.ConferenceID)
+	i18n.Print("> ")
 }
@@ -0,0 +1,152 @@
+package conference
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+)
+
+// MembershipEntry is a single tagged add in the membership OR-Set
+type MembershipEntry struct {
+	PeerID   string `json:"peer_id"`
+	Username string `json:"username"`
+	Tag      string `json:"tag"`     // Unique per add operation
+	Removed  bool   `json:"removed"` // Tombstoned by an observed remove
+}
+
+// Membership is an observed-remove set of conference members.
+// Each join adds a fresh tag; a leave tombstones every tag it has observed for
+// that member. A member is present while at least one of its tags is live, so
+// concurrent joins and leaves converge on every replica regardless of order.
+type Membership struct {
+	entries map[string]*MembershipEntry // tag -> entry
+}
+
+// NewMembership creates a membership set from previously stored entries
+func NewMembership(entries []*MembershipEntry) *Membership {
+	ms := &Membership{entries: make(map[string]*MembershipEntry)}
+	ms.merge(entries, func(*MembershipEntry) bool { return true })
+	return ms
+}
+
+// Add records a join for the member and returns the new entry
+func (ms *Membership) Add(peerID, username string) *MembershipEntry {
+	entry := &MembershipEntry{
+		PeerID:   peerID,
+		Username: username,
+		Tag:      newTag(),
+	}
+	ms.entries[entry.Tag] = entry
+	return entry
+}
+
+// Remove tombstones all observed tags for the member and returns the changed entries
+func (ms *Membership) Remove(peerID string) []*MembershipEntry {
+	changed := []*MembershipEntry{}
+	for _, entry := range ms.entries {
+		if entry.PeerID == peerID && !entry.Removed {
+			entry.Removed = true
+			changed = append(changed, entry)
+		}
+	}
+	return changed
+}
+
+// Merge folds entries published by a peer into the set and returns the entries
+// that changed locally. Only the owner admits members, so an add is skipped
+// unless the owner published it; where no owner is known, members may only add
+// themselves. Members may only remove themselves, so a removal of someone
+// else's tag is skipped unless the owner published it.
+func (ms *Membership) Merge(entries []*MembershipEntry, publisher, owner string) []*MembershipEntry {
+	return ms.merge(entries, func(entry *MembershipEntry) bool {
+		if owner != "" && publisher == owner {
+			return true
+		}
+		if entry.Removed {
+			return entry.PeerID == publisher
+		}
+		return owner == "" && entry.PeerID == publisher
+	})
+}
+
+// merge folds remote entries into the set, taking only those accept allows,
+// and returns the entries that changed locally
+func (ms *Membership) merge(entries []*MembershipEntry, accept func(*MembershipEntry) bool) []*MembershipEntry {
+	changed := []*MembershipEntry{}
+	for _, remote := range entries {
+		if remote == nil || remote.Tag == "" || remote.PeerID == "" {
+			continue
+		}
+		if !accept(remote) {
+			// Wait to hear it from the member or the owner
+			continue
+		}
+		local, ok := ms.entries[remote.Tag]
+		if !ok {
+			copied := *remote
+			ms.entries[remote.Tag] = &copied
+			changed = append(changed, &copied)
+			continue
+		}
+		if remote.Removed && !local.Removed {
+			local.Removed = true
+			changed = append(changed, local)
+		}
+	}
+	return changed
+}
+
+// Contains reports whether the member currently has a live tag
+func (ms *Membership) Contains(peerID string) bool {
+	for _, entry := range ms.entries {
+		if entry.PeerID == peerID && !entry.Removed {
+			return true
+		}
+	}
+	return false
+}
+
+// Members returns present members as peer ID -> username
+func (ms *Membership) Members() map[string]string {
+	members := make(map[string]string)
+	for _, entry := range ms.entries {
+		if !entry.Removed {
+			members[entry.PeerID] = entry.Username
+		}
+	}
+	return members
+}
+
+// Entries returns all entries (live and tombstoned) ordered by tag
+func (ms *Membership) Entries() []*MembershipEntry {
+	entries := make([]*MembershipEntry, 0, len(ms.entries))
+	for _, entry := range ms.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Tag < entries[j].Tag })
+	return entries
+}
+
+// Covers reports whether the given entries already include everything in this set
+func (ms *Membership) Covers(entries []*MembershipEntry) bool {
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		if e != nil {
+			seen[e.Tag] = e.Removed
+		}
+	}
+	for tag, entry := range ms.entries {
+		removed, ok := seen[tag]
+		if !ok || (entry.Removed && !removed) {
+			return false
+		}
+	}
+	return true
+}
+
+// newTag returns a random unique tag for an add operation
+func newTag() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
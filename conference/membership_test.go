@@ -0,0 +1,123 @@
+package conference
+
+import (
+	"slices"
+	"sort"
+	"testing"
+)
+
+// memberNames returns the present members' usernames, sorted
+func memberNames(ms *Membership) []string {
+	names := []string{}
+	for _, username := range ms.Members() {
+		names = append(names, username)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// leaveEntries returns a copy of a set's entries with one member's tags removed
+func leaveEntries(ms *Membership, peerID string) []*MembershipEntry {
+	entries := []*MembershipEntry{}
+	for _, entry := range ms.Entries() {
+		copied := *entry
+		if copied.PeerID == peerID {
+			copied.Removed = true
+		}
+		entries = append(entries, &copied)
+	}
+	return entries
+}
+
+func TestMembershipMergeRemovals(t *testing.T) {
+	const owner, alice, mallory = "peer-owner", "peer-alice", "peer-mallory"
+
+	tests := []struct {
+		name      string
+		publisher string
+		leaving   string
+		want      []string
+	}{
+		{"member leaves", alice, alice, []string{"mallory", "owner"}},
+		{"owner removes a member", owner, alice, []string{"mallory", "owner"}},
+		{"member removes someone else", mallory, alice, []string{"alice", "mallory", "owner"}},
+		{"member removes the owner", mallory, owner, []string{"alice", "mallory", "owner"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := NewMembership(nil)
+			ms.Add(owner, "owner")
+			ms.Add(alice, "alice")
+			ms.Add(mallory, "mallory")
+
+			published := leaveEntries(ms, tt.leaving)
+			ms.Merge(published, tt.publisher, owner)
+			if got := memberNames(ms); !slices.Equal(got, tt.want) {
+				t.Errorf("members = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMembershipMergeAdds(t *testing.T) {
+	const owner, alice, mallory = "peer-owner", "peer-alice", "peer-mallory"
+
+	tests := []struct {
+		name      string
+		publisher string
+		owner     string
+		joining   string
+		want      bool
+	}{
+		{"owner admits a member", owner, owner, alice, true},
+		{"member gossips a third peer", mallory, owner, alice, false},
+		{"member adds itself past the owner", alice, owner, alice, false},
+		{"member adds itself with no owner", alice, "", alice, true},
+		{"member adds a third peer with no owner", mallory, "", alice, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			elsewhere := NewMembership(nil)
+			elsewhere.Add(tt.joining, "joining")
+
+			ms := NewMembership(nil)
+			ms.Add(owner, "owner")
+			ms.Merge(elsewhere.Entries(), tt.publisher, tt.owner)
+			if got := ms.Contains(tt.joining); got != tt.want {
+				t.Errorf("contains joining peer = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMembershipMergeSkipsUnseenRemovals checks a member can't tombstone
+// another's tag before we've seen it added, hiding the join for good
+func TestMembershipMergeSkipsUnseenRemovals(t *testing.T) {
+	const owner, alice, mallory = "peer-owner", "peer-alice", "peer-mallory"
+
+	elsewhere := NewMembership(nil)
+	elsewhere.Add(alice, "alice")
+	joined := elsewhere.Entries()
+
+	ms := NewMembership(nil)
+	ms.Add(owner, "owner")
+	if changed := ms.Merge(leaveEntries(elsewhere, alice), mallory, owner); len(changed) != 0 {
+		t.Fatalf("took %d entries removed by someone else", len(changed))
+	}
+	ms.Merge(joined, owner, owner)
+	if !ms.Contains(alice) {
+		t.Error("alice's join was lost to an earlier removal by another member")
+	}
+}
+
+// TestNewMembershipKeepsStoredRemovals checks the set read back from storage
+// keeps every tombstone
+func TestNewMembershipKeepsStoredRemovals(t *testing.T) {
+	ms := NewMembership([]*MembershipEntry{
+		{PeerID: "peer-alice", Username: "alice", Tag: "a", Removed: true},
+		{PeerID: "peer-bob", Username: "bob", Tag: "b"},
+	})
+	if got := memberNames(ms); !slices.Equal(got, []string{"bob"}) {
+		t.Errorf("members = %v, want [bob]", got)
+	}
+}
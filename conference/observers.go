@@ -0,0 +1,184 @@
+package conference
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ErrObserver is returned when an observer tries to post
+var ErrObserver = errors.New("you are an observer in this conference - you can read it but not post")
+
+// Observers carries who may read a conference but not post in it on the
+// control topic. Like RateLimit, every replica sends the version it has but
+// only the owner's copy is applied.
+type Observers struct {
+	PeerIDs []string `json:"peer_ids,omitempty"`
+	Version int64    `json:"version"` // When the owner set it, in Unix nanoseconds
+}
+
+// Demote makes a member an observer (owner only): they keep receiving the
+// conference and can still fetch its history, but members' validators reject
+// their messages
+func (m *Manager) Demote(ctx context.Context, currentUser *storage.User, conferenceID int64, username string) error {
+	return m.setObserver(ctx, currentUser, conferenceID, username, true)
+}
+
+// Promote lets an observer post again (owner only)
+func (m *Manager) Promote(ctx context.Context, currentUser *storage.User, conferenceID int64, username string) error {
+	return m.setObserver(ctx, currentUser, conferenceID, username, false)
+}
+
+// GetObservers returns a conference's observers, or nil if it has none
+func (m *Manager) GetObservers(ctx context.Context, conferenceID int64) (*storage.ConferenceObservers, error) {
+	return m.storage.GetConferenceObservers(ctx, conferenceID)
+}
+
+// setObserver adds a member to or removes them from a conference's
+// observers, stamps the set with a new version and announces it
+func (m *Manager) setObserver(ctx context.Context, currentUser *storage.User, conferenceID int64, username string, observer bool) error {
+	conf, err := m.getConference(ctx, conferenceID)
+	if err != nil {
+		return err
+	}
+	if conf.CreatorID != currentUser.ID {
+		return ErrNotOwner
+	}
+
+	ms, err := m.loadMembership(ctx, conferenceID)
+	if err != nil {
+		return fmt.Errorf("failed to load membership: %w", err)
+	}
+	peerID := ""
+	for id, name := range ms.Members() {
+		if name == username {
+			peerID = id
+			break
+		}
+	}
+	if peerID == "" {
+		return fmt.Errorf("%s is not a member of this conference", username)
+	}
+	if peerID == currentUser.PeerID {
+		return fmt.Errorf("the owner can always post")
+	}
+
+	observers, err := m.storage.GetConferenceObservers(ctx, conferenceID)
+	if err != nil {
+		return fmt.Errorf("failed to load observers: %w", err)
+	}
+	if observers == nil {
+		observers = &storage.ConferenceObservers{ConferenceID: conferenceID}
+	}
+	if observers.Has(peerID) == observer {
+		if observer {
+			return fmt.Errorf("%s is already an observer", username)
+		}
+		return fmt.Errorf("%s is not an observer", username)
+	}
+
+	peerIDs := []string{}
+	for _, id := range observers.PeerIDs {
+		if id != peerID {
+			peerIDs = append(peerIDs, id)
+		}
+	}
+	if observer {
+		peerIDs = append(peerIDs, peerID)
+	}
+	observers.PeerIDs = peerIDs
+	observers.Version = max(time.Now().UnixNano(), observers.Version+1)
+
+	if _, err := m.storage.SaveConferenceObservers(ctx, observers); err != nil {
+		return fmt.Errorf("failed to save observers: %w", err)
+	}
+	if err := m.broadcastMembership(ctx, conferenceID); err != nil {
+		i18n.Printf("Warning: Failed to announce observers: %v\n", err)
+	}
+
+	if observer {
+		m.publishSystemMessage(ctx, currentUser, conferenceID, fmt.Sprintf("%s made %s an observer", currentUser.FullName, username))
+	} else {
+		m.publishSystemMessage(ctx, currentUser, conferenceID, fmt.Sprintf("%s let %s post again", currentUser.FullName, username))
+	}
+	return nil
+}
+
+// observing reports whether a peer is an observer in a conference. The owner
+// never is, whatever the stored set says.
+func (m *Manager) observing(ctx context.Context, conferenceID int64, peerID string) bool {
+	observers, err := m.storage.GetConferenceObservers(ctx, conferenceID)
+	if err != nil || !observers.Has(peerID) {
+		return false
+	}
+	return m.ownerOf(ctx, conferenceID) != peerID
+}
+
+// isObserver reports whether a message's signer is an observer, for the
+// message topic validators
+func (m *Manager) isObserver(conferenceID int64, from peer.ID) bool {
+	return m.observing(context.Background(), conferenceID, from.String())
+}
+
+// wireObservers returns a conference's observers for the control topic, or nil if it has none
+func (m *Manager) wireObservers(ctx context.Context, conferenceID int64) (*Observers, error) {
+	observers, err := m.storage.GetConferenceObservers(ctx, conferenceID)
+	if err != nil || observers == nil {
+		return nil, err
+	}
+	return &Observers{PeerIDs: observers.PeerIDs, Version: observers.Version}, nil
+}
+
+// mergeObservers applies the observers in a membership state if the owner
+// sent them and they are newer than ours, and reports whether the sender is
+// up to date. Only the owner's copy counts, so only the owner resends it.
+func (m *Manager) mergeObservers(ctx context.Context, state *MembershipState) bool {
+	current, err := m.storage.GetConferenceObservers(ctx, state.ConferenceID)
+	if err != nil {
+		i18n.Printf("Warning: Failed to load observers: %v\n", err)
+		return true
+	}
+	var version, remoteVersion int64
+	if current != nil {
+		version = current.Version
+	}
+	if state.Observers != nil {
+		remoteVersion = state.Observers.Version
+	}
+
+	owner := m.ownerOf(ctx, state.ConferenceID)
+	if remoteVersion > version && state.FromPeerID == owner {
+		observers := &storage.ConferenceObservers{
+			ConferenceID: state.ConferenceID,
+			PeerIDs:      state.Observers.PeerIDs,
+			Version:      remoteVersion,
+		}
+		saved, err := m.storage.SaveConferenceObservers(ctx, observers)
+		if err != nil {
+			i18n.Printf("Warning: Failed to save observers: %v\n", err)
+		} else if saved {
+			m.announceObserver(ctx, current, observers)
+		}
+		return true
+	}
+	return owner != m.host.ID().String() || remoteVersion >= version
+}
+
+// announceObserver tells the user if the owner changed whether they can post
+func (m *Manager) announceObserver(ctx context.Context, previous, observers *storage.ConferenceObservers) {
+	self := m.host.ID().String()
+	if previous.Has(self) == observers.Has(self) {
+		return
+	}
+	name := m.conferenceName(ctx, observers.ConferenceID)
+	if observers.Has(self) {
+		i18n.Printf("\n👀 You are now an observer in '%s': you can read it but not post\n> ", name)
+	} else {
+		i18n.Printf("\n✓ You can post in '%s' again\n> ", name)
+	}
+}
@@ -0,0 +1,372 @@
+package conference
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/pb"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/proto"
+)
+
+// Proto returns the invite's protobuf form
+func (i *ConferenceInvite) Proto() proto.Message {
+	return &pb.ConferenceInvite{
+		ConferenceId:   i.ConferenceID,
+		ConferenceName: i.ConferenceName,
+		FromUsername:   i.FromUsername,
+		FromFullName:   i.FromFullName,
+		FromPeerId:     i.FromPeerID,
+		OwnerPeerId:    i.OwnerPeerID,
+		Message:        i.Message,
+	}
+}
+
+// Proto returns the message's protobuf form, as sent in history responses
+func (m *ConferenceGossipMessage) Proto() proto.Message {
+	return &pb.ConferenceMessage{
+		ConferenceId: m.ConferenceID,
+		Channel:      m.Channel,
+		FromUsername: m.FromUsername,
+		FromFullName: m.FromFullName,
+		FromPeerId:   m.FromPeerID,
+		Content:      m.Content,
+		Kind:         m.Kind,
+		Lamport:      m.Lamport,
+		Timestamp:    m.Timestamp,
+	}
+}
+
+// Proto returns the state's protobuf form
+func (s *MembershipState) Proto() proto.Message {
+	wire := &pb.MembershipState{
+		ConferenceId: s.ConferenceID,
+		FromPeerId:   s.FromPeerID,
+		Entries:      protoEntries(s.Entries),
+		Channels:     s.Channels,
+	}
+	if s.RateLimit != nil {
+		wire.RateLimit = &pb.RateLimit{
+			Messages:        int32(s.RateLimit.Messages),
+			WindowSeconds:   int32(s.RateLimit.WindowSeconds),
+			SlowModeSeconds: int32(s.RateLimit.SlowModeSeconds),
+			SlowModeUntil:   s.RateLimit.SlowModeUntil,
+			Version:         s.RateLimit.Version,
+		}
+	}
+	if s.Observers != nil {
+		wire.Observers = &pb.Observers{PeerIds: s.Observers.PeerIDs, Version: s.Observers.Version}
+	}
+	return wire
+}
+
+// Proto returns the beacon's protobuf form
+func (b *PresenceBeacon) Proto() proto.Message {
+	return &pb.PresenceBeacon{
+		ConferenceId: b.ConferenceID,
+		FromPeerId:   b.FromPeerID,
+		Username:     b.Username,
+		Leaving:      b.Leaving,
+		Timestamp:    b.Timestamp,
+	}
+}
+
+// Proto returns the request's protobuf form
+func (r *HistoryRequest) Proto() proto.Message {
+	return &pb.HistoryRequest{ConferenceId: r.ConferenceID, SinceLamport: r.SinceLamport, Limit: int32(r.Limit)}
+}
+
+// Proto returns the request's protobuf form
+func (r *AdmissionRequest) Proto() proto.Message {
+	return &pb.AdmissionRequest{ConferenceId: r.ConferenceID, Username: r.Username, PeerId: r.PeerID}
+}
+
+// Proto returns the response's protobuf form
+func (r *AdmissionResponse) Proto() proto.Message {
+	return &pb.AdmissionResponse{Admitted: r.Admitted, Reason: r.Reason, Entries: protoEntries(r.Entries)}
+}
+
+// protoEntries returns the protobuf form of membership entries
+func protoEntries(entries []*MembershipEntry) []*pb.MembershipEntry {
+	var wire []*pb.MembershipEntry
+	for _, entry := range entries {
+		wire = append(wire, &pb.MembershipEntry{
+			PeerId:   entry.PeerID,
+			Username: entry.Username,
+			Tag:      entry.Tag,
+			Removed:  entry.Removed,
+		})
+	}
+	return wire
+}
+
+// entriesFromProto converts membership entries read from protobuf
+func entriesFromProto(wire []*pb.MembershipEntry) []*MembershipEntry {
+	var entries []*MembershipEntry
+	for _, entry := range wire {
+		entries = append(entries, &MembershipEntry{
+			PeerID:   entry.PeerId,
+			Username: entry.Username,
+			Tag:      entry.Tag,
+			Removed:  entry.Removed,
+		})
+	}
+	return entries
+}
+
+// DecodeConferenceInviteProto validates a conference invite read from a protobuf stream
+func DecodeConferenceInviteProto(wire *pb.ConferenceInvite) (*ConferenceInvite, error) {
+	invite := &ConferenceInvite{
+		ConferenceID:   wire.ConferenceId,
+		ConferenceName: wire.ConferenceName,
+		FromUsername:   wire.FromUsername,
+		FromFullName:   wire.FromFullName,
+		FromPeerID:     wire.FromPeerId,
+		OwnerPeerID:    wire.OwnerPeerId,
+		Message:        wire.Message,
+	}
+	if err := checkConferenceInvite(invite); err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// DecodeGossipMessageProto validates a conference message read from a protobuf history response
+func DecodeGossipMessageProto(wire *pb.ConferenceMessage) (*ConferenceGossipMessage, error) {
+	message := &ConferenceGossipMessage{
+		ConferenceID: wire.ConferenceId,
+		Channel:      wire.Channel,
+		FromUsername: wire.FromUsername,
+		FromFullName: wire.FromFullName,
+		FromPeerID:   wire.FromPeerId,
+		Content:      wire.Content,
+		Kind:         wire.Kind,
+		Lamport:      wire.Lamport,
+		Timestamp:    wire.Timestamp,
+	}
+	if err := checkGossipMessage(message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// DecodeMembershipStateProto validates a membership state read from the control topic as protobuf
+func DecodeMembershipStateProto(wire *pb.MembershipState) (*MembershipState, error) {
+	state := &MembershipState{
+		ConferenceID: wire.ConferenceId,
+		FromPeerID:   wire.FromPeerId,
+		Entries:      entriesFromProto(wire.Entries),
+		Channels:     wire.Channels,
+	}
+	if limit := wire.RateLimit; limit != nil {
+		state.RateLimit = &RateLimit{
+			Messages:        int(limit.Messages),
+			WindowSeconds:   int(limit.WindowSeconds),
+			SlowModeSeconds: int(limit.SlowModeSeconds),
+			SlowModeUntil:   limit.SlowModeUntil,
+			Version:         limit.Version,
+		}
+	}
+	if observers := wire.Observers; observers != nil {
+		state.Observers = &Observers{PeerIDs: observers.PeerIds, Version: observers.Version}
+	}
+	if err := checkMembershipState(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// DecodePresenceBeaconProto validates a beacon read from the presence topic as protobuf
+func DecodePresenceBeaconProto(wire *pb.PresenceBeacon) (*PresenceBeacon, error) {
+	beacon := &PresenceBeacon{
+		ConferenceID: wire.ConferenceId,
+		FromPeerID:   wire.FromPeerId,
+		Username:     wire.Username,
+		Leaving:      wire.Leaving,
+		Timestamp:    wire.Timestamp,
+	}
+	if err := checkPresenceBeacon(beacon); err != nil {
+		return nil, err
+	}
+	return beacon, nil
+}
+
+// DecodeHistoryRequestProto validates a history request read from a protobuf
+// stream. A missing or oversized limit is clamped to MaxHistoryMessages.
+func DecodeHistoryRequestProto(wire *pb.HistoryRequest) (*HistoryRequest, error) {
+	request := &HistoryRequest{ConferenceID: wire.ConferenceId, SinceLamport: wire.SinceLamport, Limit: int(wire.Limit)}
+	if err := checkHistoryRequest(request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// DecodeAdmissionRequestProto validates an admission request read from a protobuf stream
+func DecodeAdmissionRequestProto(wire *pb.AdmissionRequest) (*AdmissionRequest, error) {
+	request := &AdmissionRequest{ConferenceID: wire.ConferenceId, Username: wire.Username, PeerID: wire.PeerId}
+	if err := checkAdmissionRequest(request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// DecodeAdmissionResponseProto validates an admission response read from a protobuf stream
+func DecodeAdmissionResponseProto(wire *pb.AdmissionResponse) (*AdmissionResponse, error) {
+	response := &AdmissionResponse{Admitted: wire.Admitted, Reason: wire.Reason, Entries: entriesFromProto(wire.Entries)}
+	if err := checkAdmissionResponse(response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// readConferenceInvite reads and validates a conference invite from a stream
+func readConferenceInvite(ws *p2p.WireStream) (*ConferenceInvite, error) {
+	var wire pb.ConferenceInvite
+	data, err := ws.ReadMessage(&wire)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Protobuf() {
+		return DecodeConferenceInviteProto(&wire)
+	}
+	return DecodeConferenceInvite(data)
+}
+
+// readGossipMessage reads and validates the next message of a history response
+func readGossipMessage(ws *p2p.WireStream) (*ConferenceGossipMessage, error) {
+	var wire pb.ConferenceMessage
+	data, err := ws.ReadMessage(&wire)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Protobuf() {
+		return DecodeGossipMessageProto(&wire)
+	}
+	return DecodeGossipMessage(data)
+}
+
+// readHistoryRequest reads and validates a history request from a stream
+func readHistoryRequest(ws *p2p.WireStream) (*HistoryRequest, error) {
+	var wire pb.HistoryRequest
+	data, err := ws.ReadMessage(&wire)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Protobuf() {
+		return DecodeHistoryRequestProto(&wire)
+	}
+	return DecodeHistoryRequest(data)
+}
+
+// readAdmissionRequest reads and validates an admission request from a stream
+func readAdmissionRequest(ws *p2p.WireStream) (*AdmissionRequest, error) {
+	var wire pb.AdmissionRequest
+	data, err := ws.ReadMessage(&wire)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Protobuf() {
+		return DecodeAdmissionRequestProto(&wire)
+	}
+	return DecodeAdmissionRequest(data)
+}
+
+// readAdmissionResponse reads and validates the owner's admission decision from a stream
+func readAdmissionResponse(ws *p2p.WireStream) (*AdmissionResponse, error) {
+	var wire pb.AdmissionResponse
+	data, err := ws.ReadMessage(&wire)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Protobuf() {
+		return DecodeAdmissionResponseProto(&wire)
+	}
+	return DecodeAdmissionResponse(data)
+}
+
+// topicJSON reports whether data published on a conference topic is JSON,
+// as older releases publish, rather than protobuf. A JSON object starts with
+// '{', which no protobuf message here can: it would open a group for field 15.
+func topicJSON(data []byte) bool {
+	return len(data) > 0 && data[0] == '{'
+}
+
+// protobufTopics reports whether a conference's topics may carry protobuf:
+// only once every other member, and every peer we share the topic with, lists
+// p2p.CapabilityConfProtobuf. An older node would reject the message and
+// count it against whoever forwarded it. Members we haven't heard from since
+// starting count as older nodes, and with no one on the topic yet there is no
+// reason to leave JSON.
+func (m *Manager) protobufTopics(ctx context.Context, conferenceID int64, topic *pubsub.Topic) bool {
+	peers := topic.ListPeers()
+	if len(peers) == 0 {
+		return false
+	}
+	for _, pid := range peers {
+		if !p2p.PeerSupports(m.host, pid, p2p.CapabilityConfProtobuf) {
+			return false
+		}
+	}
+	ms, err := m.loadMembership(ctx, conferenceID)
+	if err != nil || !ms.Contains(m.host.ID().String()) {
+		return false
+	}
+	for peerID := range ms.Members() {
+		pid, err := peer.Decode(peerID)
+		if err != nil {
+			return false
+		}
+		if pid != m.host.ID() && !p2p.PeerSupports(m.host, pid, p2p.CapabilityConfProtobuf) {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeTopicMessage marshals a message to publish on a conference topic, as
+// protobuf if every member reads it, else as JSON
+func encodeTopicMessage(message p2p.WireMessage, protobuf bool) ([]byte, error) {
+	if protobuf {
+		return proto.Marshal(message.Proto())
+	}
+	return json.Marshal(message)
+}
+
+// decodeTopicMessage reads and validates a message from a conference or channel topic
+func decodeTopicMessage(data []byte) (*ConferenceGossipMessage, error) {
+	if topicJSON(data) {
+		return DecodeGossipMessage(data)
+	}
+	var wire pb.ConferenceMessage
+	if err := proto.Unmarshal(data, &wire); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal conference message: %w", err)
+	}
+	return DecodeGossipMessageProto(&wire)
+}
+
+// decodeTopicMembershipState reads and validates a membership state from the control topic
+func decodeTopicMembershipState(data []byte) (*MembershipState, error) {
+	if topicJSON(data) {
+		return DecodeMembershipState(data)
+	}
+	var wire pb.MembershipState
+	if err := proto.Unmarshal(data, &wire); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal membership state: %w", err)
+	}
+	return DecodeMembershipStateProto(&wire)
+}
+
+// decodeTopicPresenceBeacon reads and validates a beacon from the presence topic
+func decodeTopicPresenceBeacon(data []byte) (*PresenceBeacon, error) {
+	if topicJSON(data) {
+		return DecodePresenceBeacon(data)
+	}
+	var wire pb.PresenceBeacon
+	if err := proto.Unmarshal(data, &wire); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal presence beacon: %w", err)
+	}
+	return DecodePresenceBeaconProto(&wire)
+}
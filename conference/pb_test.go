@@ -0,0 +1,180 @@
+package conference
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+const (
+	alicePeerID = "12D3KooWK99VoVxNE7XzyBwXEzW7xhK7Gpv85r9F3V3fyKSUKPH5"
+	bobPeerID   = "12D3KooWJWoaqZhDaoEFshF7Rh1bpY9ohihFhzcW6d69Lr2NASuq"
+	carolPeerID = "12D3KooWRndVhVZPCiQwHBBBdg769GyrPUW13zxwqQyf9r3ANaba"
+)
+
+// TestTopicMessagesReadInEitherEncoding checks that what is published on
+// conference topics reads back the same as JSON and as protobuf
+func TestTopicMessagesReadInEitherEncoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		message p2p.WireMessage
+		decode  func(data []byte) (p2p.WireMessage, error)
+	}{
+		{
+			"message",
+			&ConferenceGossipMessage{ConferenceID: 7, Channel: "spoilers", FromUsername: "alice", FromPeerID: alicePeerID, Content: "{not json", Kind: "user", Lamport: 3, Timestamp: 1760000000},
+			func(data []byte) (p2p.WireMessage, error) { return decodeTopicMessage(data) },
+		},
+		{
+			"membership",
+			&MembershipState{
+				ConferenceID: 7,
+				FromPeerID:   alicePeerID,
+				Entries: []*MembershipEntry{
+					{PeerID: alicePeerID, Username: "alice", Tag: "a1"},
+					{PeerID: bobPeerID, Username: "bob", Tag: "b1", Removed: true},
+				},
+				Channels:  []string{"spoilers"},
+				RateLimit: &RateLimit{Messages: 5, WindowSeconds: 60, SlowModeSeconds: 10, SlowModeUntil: 1760000600, Version: 2},
+				Observers: &Observers{PeerIDs: []string{bobPeerID}, Version: 1},
+			},
+			func(data []byte) (p2p.WireMessage, error) { return decodeTopicMembershipState(data) },
+		},
+		{
+			"presence",
+			&PresenceBeacon{ConferenceID: 7, FromPeerID: alicePeerID, Username: "alice", Timestamp: 1760000000},
+			func(data []byte) (p2p.WireMessage, error) { return decodeTopicPresenceBeacon(data) },
+		},
+		{
+			"leaving",
+			&PresenceBeacon{ConferenceID: 7, FromPeerID: alicePeerID, Leaving: true, Timestamp: 1760000000},
+			func(data []byte) (p2p.WireMessage, error) { return decodeTopicPresenceBeacon(data) },
+		},
+	}
+	for _, tt := range tests {
+		for _, protobuf := range []bool{false, true} {
+			data, err := encodeTopicMessage(tt.message, protobuf)
+			if err != nil {
+				t.Fatalf("%s: encode (protobuf %v): %v", tt.name, protobuf, err)
+			}
+			if topicJSON(data) == protobuf {
+				t.Errorf("%s: encoded with protobuf %v, read as JSON %v", tt.name, protobuf, topicJSON(data))
+			}
+			decoded, err := tt.decode(data)
+			if err != nil {
+				t.Fatalf("%s: decode (protobuf %v): %v", tt.name, protobuf, err)
+			}
+			if !reflect.DeepEqual(decoded, tt.message) {
+				t.Errorf("%s: decoded (protobuf %v) to %+v, want %+v", tt.name, protobuf, decoded, tt.message)
+			}
+		}
+	}
+}
+
+// TestProtobufTopicsWaitForEveryMember checks a conference only switches to
+// protobuf once every member and topic peer reads it
+func TestProtobufTopicsWaitForEveryMember(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mn.Close() })
+	a, b := mn.Hosts()[0], mn.Hosts()[1]
+	psA, err := pubsub.NewGossipSub(ctx, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	psB, err := pubsub.NewGossipSub(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.NewMemoryStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	m := NewManager(store, a, psA)
+
+	const conferenceID = 1
+	topic, err := psA.Join(presenceTopicName(conferenceID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.protobufTopics(ctx, conferenceID, topic) {
+		t.Error("protobuf with no one on the topic")
+	}
+
+	bTopic, err := psB.Join(presenceTopicName(conferenceID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bSub, err := bTopic.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(topic.ListPeers()) == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("b never showed up on the topic")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// Capabilities are recorded as the identify exchange would
+	supports := func(pid peer.ID, capabilities ...string) {
+		if err := a.Peerstore().Put(pid, "whisper/capabilities", capabilities); err != nil {
+			t.Fatal(err)
+		}
+	}
+	members := []*MembershipEntry{
+		{PeerID: a.ID().String(), Username: "alice", Tag: "a1"},
+		{PeerID: b.ID().String(), Username: "bob", Tag: "b1"},
+	}
+	if err := m.saveMembership(ctx, conferenceID, members); err != nil {
+		t.Fatal(err)
+	}
+	supports(b.ID(), p2p.CapabilityZstd)
+	if m.protobufTopics(ctx, conferenceID, topic) {
+		t.Error("protobuf to a member that only reads JSON")
+	}
+	supports(b.ID(), p2p.CapabilityZstd, p2p.CapabilityConfProtobuf)
+	if !m.protobufTopics(ctx, conferenceID, topic) {
+		t.Error("still JSON once every member reads protobuf")
+	}
+
+	// A member we haven't heard from could be reached through b
+	if err := m.saveMembership(ctx, conferenceID, []*MembershipEntry{{PeerID: carolPeerID, Username: "carol", Tag: "c1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if m.protobufTopics(ctx, conferenceID, topic) {
+		t.Error("protobuf with a member whose capabilities are unknown")
+	}
+	if err := m.saveMembership(ctx, conferenceID, []*MembershipEntry{{PeerID: carolPeerID, Username: "carol", Tag: "c1", Removed: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	m.topics.confs[conferenceID] = &conferenceTopics{presence: topic}
+	if err := m.publishPresence(ctx, &storage.User{Username: "alice"}, conferenceID, false); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	msg, err := bSub.Next(ctx)
+	if err != nil {
+		t.Fatalf("next beacon: %v", err)
+	}
+	if topicJSON(msg.Data) {
+		t.Error("beacon published as JSON once every member reads protobuf")
+	}
+	if beacon, err := decodeTopicPresenceBeacon(msg.Data); err != nil || beacon.Username != "alice" {
+		t.Errorf("beacon = %+v, %v; want alice's", beacon, err)
+	}
+}
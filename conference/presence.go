@@ -0,0 +1,157 @@
+package conference
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// presenceInterval is how often a member beacons on the presence topic
+	// of each conference it is in
+	presenceInterval = 30 * time.Second
+
+	// PresenceTTL is how long after its last beacon a member still counts as
+	// online in a conference; a few beacons may be lost before it expires
+	PresenceTTL = 3 * presenceInterval
+)
+
+// OnlineParticipant is a member heard from on a conference's presence topic
+type OnlineParticipant struct {
+	PeerID   peer.ID
+	Username string
+	LastSeen time.Time // When its latest beacon arrived
+}
+
+// GetOnlineParticipants returns the other members of a conference that have
+// beaconed within PresenceTTL, by username
+func (m *Manager) GetOnlineParticipants(conferenceID int64) []*OnlineParticipant {
+	m.presenceMu.Lock()
+	defer m.presenceMu.Unlock()
+
+	now := time.Now()
+	online := []*OnlineParticipant{}
+	for pid, p := range m.presence[conferenceID] {
+		if now.Sub(p.LastSeen) >= PresenceTTL {
+			delete(m.presence[conferenceID], pid)
+			continue
+		}
+		copied := *p
+		online = append(online, &copied)
+	}
+	sort.Slice(online, func(i, j int) bool { return online[i].Username < online[j].Username })
+	return online
+}
+
+// beaconPresence announces us on a conference's presence topic now and every
+// presenceInterval, until ctx is cancelled. While the user hides their online
+// status it stays quiet, first telling members to drop us if it had beaconed.
+func (m *Manager) beaconPresence(ctx context.Context, currentUser *storage.User, conferenceID int64) {
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+
+	beaconed := false
+	for {
+		shown := m.showsPresence()
+		if shown || beaconed {
+			if err := m.publishPresence(ctx, currentUser, conferenceID, !shown); err != nil && ctx.Err() == nil {
+				i18n.Printf("Warning: Failed to publish presence: %v\n", err)
+			}
+			beaconed = shown
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishPresence sends one beacon to a subscribed conference; a leaving
+// beacon tells members to drop us before our last one expires. Nothing but
+// leaving beacons is sent while the user hides their online status.
+func (m *Manager) publishPresence(ctx context.Context, currentUser *storage.User, conferenceID int64, leaving bool) error {
+	if !leaving && !m.showsPresence() {
+		return nil
+	}
+	topic, ok := m.topics.presenceTopic(conferenceID)
+	if !ok {
+		return fmt.Errorf("not subscribed to conference")
+	}
+
+	beacon := &PresenceBeacon{
+		ConferenceID: conferenceID,
+		FromPeerID:   m.host.ID().String(),
+		Leaving:      leaving,
+		Timestamp:    time.Now().Unix(),
+	}
+	if !leaving {
+		beacon.Username = currentUser.Username
+	}
+	data, err := encodeTopicMessage(beacon, m.protobufTopics(ctx, conferenceID, topic))
+	if err != nil {
+		return fmt.Errorf("failed to marshal presence beacon: %w", err)
+	}
+	return topic.Publish(ctx, data)
+}
+
+// listenToPresence records the beacons other members send on a conference's
+// presence topic
+func (m *Manager) listenToPresence(ctx context.Context, conferenceID int64, sub *pubsub.Subscription) {
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			// Subscription closed or context canceled
+			return
+		}
+
+		// Skip our own beacons
+		if msg.ReceivedFrom == m.host.ID() {
+			continue
+		}
+
+		p2p.Protect("conference presence", msg.ReceivedFrom, func() {
+			beacon, err := decodeTopicPresenceBeacon(msg.Data)
+			if err != nil || beacon.ConferenceID != conferenceID {
+				return
+			}
+			m.notePresence(conferenceID, msg.GetFrom(), beacon)
+		})
+	}
+}
+
+// notePresence marks a member online as of now, or offline if it is leaving
+func (m *Manager) notePresence(conferenceID int64, from peer.ID, beacon *PresenceBeacon) {
+	m.presenceMu.Lock()
+	defer m.presenceMu.Unlock()
+
+	if beacon.Leaving {
+		delete(m.presence[conferenceID], from)
+		return
+	}
+	if m.presence[conferenceID] == nil {
+		m.presence[conferenceID] = make(map[peer.ID]*OnlineParticipant)
+	}
+	m.presence[conferenceID][from] = &OnlineParticipant{PeerID: from, Username: beacon.Username, LastSeen: time.Now()}
+}
+
+// forgetPresence drops who was online in a conference we are no longer in;
+// a zero conferenceID forgets every conference
+func (m *Manager) forgetPresence(conferenceID int64) {
+	m.presenceMu.Lock()
+	defer m.presenceMu.Unlock()
+
+	if conferenceID == 0 {
+		m.presence = make(map[int64]map[peer.ID]*OnlineParticipant)
+		return
+	}
+	delete(m.presence, conferenceID)
+}
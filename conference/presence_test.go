@@ -0,0 +1,68 @@
+package conference
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/austinwklein/whisper/storage"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// TestHiddenPresenceIsNotPublished checks no beacon goes out while the user
+// hides their online status, and that shown and leaving beacons still do
+func TestHiddenPresenceIsNotPublished(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := pubsub.NewGossipSub(ctx, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(nil, h, ps)
+
+	const conferenceID = 1
+	ct, _, err := m.topics.subscribe(ctx, conferenceID)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer m.topics.unsubscribe(conferenceID)
+
+	shown := false
+	m.SetPresenceCheck(func() bool { return shown })
+	user := &storage.User{Username: "hidden"}
+	if err := m.publishPresence(ctx, user, conferenceID, false); err != nil {
+		t.Fatalf("publish while hidden: %v", err)
+	}
+
+	// Our own subscription gets everything we publish, in order
+	shown = true
+	user.Username = "shown"
+	if err := m.publishPresence(ctx, user, conferenceID, false); err != nil {
+		t.Fatalf("publish while shown: %v", err)
+	}
+	if err := m.publishPresence(ctx, user, conferenceID, true); err != nil {
+		t.Fatalf("publish leaving: %v", err)
+	}
+
+	for _, want := range []PresenceBeacon{{Username: "shown"}, {Leaving: true}} {
+		msg, err := ct.presenceSub.Next(ctx)
+		if err != nil {
+			t.Fatalf("next beacon: %v", err)
+		}
+		beacon, err := decodeTopicPresenceBeacon(msg.Data)
+		if err != nil {
+			t.Fatalf("decode beacon: %v", err)
+		}
+		if beacon.Username != want.Username || beacon.Leaving != want.Leaving {
+			t.Errorf("beacon = %+v, want username %q leaving %v", beacon, want.Username, want.Leaving)
+		}
+	}
+}
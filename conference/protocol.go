@@ -1,12 +1,12 @@
 package conference
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
@@ -14,7 +14,20 @@ import (
 
 const (
 	// Protocol IDs for conference management
-	ProtocolConferenceInvite = protocol.ID("/whisper/conference/invite/1.0.0")
+	ProtocolConferenceInvite  = protocol.ID("/whisper/conference/invite/1.0.0")
+	ProtocolConferenceHistory = protocol.ID("/whisper/conference/history/1.0.0")
+
+	// ProtocolConferenceAdmission redeems an invite with the conference owner
+	ProtocolConferenceAdmission = protocol.ID("/whisper/conference/admission/1.0.0")
+
+	// Protobuf versions of the protocols above, preferred when both sides speak
+	// them. Messages on conference topics stay JSON: every subscriber reads them.
+	ProtocolConferenceInviteV2    = protocol.ID("/whisper/conference/invite/2.0.0")
+	ProtocolConferenceHistoryV2   = protocol.ID("/whisper/conference/history/2.0.0")
+	ProtocolConferenceAdmissionV2 = protocol.ID("/whisper/conference/admission/2.0.0")
+
+	// MaxHistoryMessages caps how many messages one history request returns
+	MaxHistoryMessages = 500
 )
 
 // ConferenceInvite represents an invitation to join a conference
@@ -24,22 +37,71 @@ type ConferenceInvite struct {
 	FromUsername   string `json:"from_username"`
 	FromFullName   string `json:"from_full_name"`
 	FromPeerID     string `json:"from_peer_id"`
+	OwnerPeerID    string `json:"owner_peer_id,omitempty"` // Who admits new members
 	Message        string `json:"message,omitempty"`
 }
 
 // ConferenceGossipMessage represents a message broadcast in a conference via GossipSub
 type ConferenceGossipMessage struct {
 	ConferenceID int64  `json:"conference_id"`
+	Channel      string `json:"channel,omitempty"` // Empty for the main channel
 	FromUsername string `json:"from_username"`
 	FromFullName string `json:"from_full_name"`
 	FromPeerID   string `json:"from_peer_id"`
 	Content      string `json:"content"`
+	Kind         string `json:"kind,omitempty"`    // user (default) or system
+	Lamport      int64  `json:"lamport,omitempty"` // Sender's logical clock for the conference
+	Timestamp    int64  `json:"timestamp"`         // Unix timestamp
+}
+
+// MembershipState carries a replica's full membership set on the conference control topic
+type MembershipState struct {
+	ConferenceID int64              `json:"conference_id"`
+	FromPeerID   string             `json:"from_peer_id"`
+	Entries      []*MembershipEntry `json:"entries"`
+	Channels     []string           `json:"channels,omitempty"`   // Grow-only set of channel names
+	RateLimit    *RateLimit         `json:"rate_limit,omitempty"` // Posting limits, applied from the owner only
+	Observers    *Observers         `json:"observers,omitempty"`  // Members who may not post, applied from the owner only
+}
+
+// PresenceBeacon tells the members of a conference that the sender is in the
+// room, or has left it, on the conference presence topic
+type PresenceBeacon struct {
+	ConferenceID int64  `json:"conference_id"`
+	FromPeerID   string `json:"from_peer_id"`
+	Username     string `json:"username,omitempty"` // Empty when leaving
+	Leaving      bool   `json:"leaving,omitempty"`
 	Timestamp    int64  `json:"timestamp"` // Unix timestamp
 }
 
+// HistoryRequest asks a member for conference messages after a logical clock value
+type HistoryRequest struct {
+	ConferenceID int64 `json:"conference_id"`
+	SinceLamport int64 `json:"since_lamport"`
+	Limit        int   `json:"limit"`
+}
+
+// AdmissionRequest asks the conference owner to admit the sender as a member
+type AdmissionRequest struct {
+	ConferenceID int64  `json:"conference_id"`
+	Username     string `json:"username"`
+	PeerID       string `json:"peer_id"`
+}
+
+// AdmissionResponse is the owner's decision. An admitted member also receives
+// the membership set so its first messages pass other members' validators.
+type AdmissionResponse struct {
+	Admitted bool               `json:"admitted"`
+	Reason   string             `json:"reason,omitempty"`
+	Entries  []*MembershipEntry `json:"entries,omitempty"`
+}
+
 // Protocol handles conference invitation protocol
 type Protocol struct {
-	inviteHandler func(invite *ConferenceInvite, fromPeer peer.ID)
+	inviteHandler    func(invite *ConferenceInvite, fromPeer peer.ID)
+	historyHandler   func(request *HistoryRequest, fromPeer peer.ID) []*ConferenceGossipMessage
+	admissionHandler func(request *AdmissionRequest, fromPeer peer.ID) *AdmissionResponse
+	invalidHandler   func(fromPeer peer.ID)
 }
 
 // NewProtocol creates a new conference protocol handler
@@ -52,42 +114,116 @@ func (p *Protocol) SetInviteHandler(handler func(*ConferenceInvite, peer.ID)) {
 	p.inviteHandler = handler
 }
 
+// SetHistoryHandler sets the handler that answers history requests
+func (p *Protocol) SetHistoryHandler(handler func(*HistoryRequest, peer.ID) []*ConferenceGossipMessage) {
+	p.historyHandler = handler
+}
+
+// SetAdmissionHandler sets the handler that decides admission requests
+func (p *Protocol) SetAdmissionHandler(handler func(*AdmissionRequest, peer.ID) *AdmissionResponse) {
+	p.admissionHandler = handler
+}
+
+// SetInvalidHandler sets the handler told about peers that send malformed messages
+func (p *Protocol) SetInvalidHandler(handler func(peer.ID)) {
+	p.invalidHandler = handler
+}
+
 // HandleConferenceInvite handles incoming conference invitations
 func (p *Protocol) HandleConferenceInvite(s network.Stream) {
 	defer s.Close()
 
-	reader := bufio.NewReader(s)
-	data, err := reader.ReadBytes('\n')
-	if err != nil && err != io.EOF {
-		fmt.Printf("Error reading conference invite: %v\n", err)
+	invite, ok := p2p.ReadRequest(p2p.NewWireStream(s), "Error reading conference invite: %v\n", readConferenceInvite, p.invalidHandler)
+	if ok && p.inviteHandler != nil {
+		p.inviteHandler(invite, s.Conn().RemotePeer())
+	}
+}
+
+// SendConferenceInvite sends a conference invitation to a peer
+func SendConferenceInvite(ctx context.Context, s network.Stream, invite *ConferenceInvite) error {
+	defer s.Close()
+
+	if err := p2p.NewWireStream(s).WriteMessage(invite); err != nil {
+		return fmt.Errorf("failed to write invite: %w", err)
+	}
+	return nil
+}
+
+// HandleConferenceHistory answers a history request with the messages, one after another
+func (p *Protocol) HandleConferenceHistory(s network.Stream) {
+	defer s.Close()
+
+	ws := p2p.NewWireStream(s)
+	request, ok := p2p.ReadRequest(ws, "Error reading history request: %v\n", readHistoryRequest, p.invalidHandler)
+	if !ok || p.historyHandler == nil {
 		return
 	}
 
-	var invite ConferenceInvite
-	if err := json.Unmarshal(data, &invite); err != nil {
-		fmt.Printf("Error unmarshaling conference invite: %v\n", err)
+	for _, message := range p.historyHandler(request, s.Conn().RemotePeer()) {
+		if err := ws.WriteMessage(message); err != nil {
+			i18n.Printf("Error writing history message: %v\n", err)
+			return
+		}
+	}
+}
+
+// RequestHistory sends a history request and reads the returned messages
+func RequestHistory(ctx context.Context, s network.Stream, request *HistoryRequest) ([]*ConferenceGossipMessage, error) {
+	defer s.Close()
+
+	ws := p2p.NewWireStream(s)
+	if err := ws.WriteMessage(request); err != nil {
+		return nil, fmt.Errorf("failed to write history request: %w", err)
+	}
+	s.CloseWrite()
+
+	messages := []*ConferenceGossipMessage{}
+	for len(messages) < MaxHistoryMessages {
+		message, err := readGossipMessage(ws)
+		if err == io.EOF {
+			return messages, nil
+		}
+		if err != nil {
+			return messages, fmt.Errorf("failed to read history message: %w", err)
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// HandleConferenceAdmission answers an admission request with the owner's decision
+func (p *Protocol) HandleConferenceAdmission(s network.Stream) {
+	defer s.Close()
+
+	ws := p2p.NewWireStream(s)
+	request, ok := p2p.ReadRequest(ws, "Error reading admission request: %v\n", readAdmissionRequest, p.invalidHandler)
+	if !ok {
 		return
 	}
 
-	if p.inviteHandler != nil {
-		p.inviteHandler(&invite, s.Conn().RemotePeer())
+	response := &AdmissionResponse{Reason: "admission is not available"}
+	if p.admissionHandler != nil {
+		response = p.admissionHandler(request, s.Conn().RemotePeer())
+	}
+
+	if err := ws.WriteMessage(response); err != nil {
+		i18n.Printf("Error writing admission response: %v\n", err)
 	}
 }
 
-// SendConferenceInvite sends a conference invitation to a peer
-func SendConferenceInvite(ctx context.Context, s network.Stream, invite *ConferenceInvite) error {
+// RequestAdmission sends an admission request and reads the owner's decision
+func RequestAdmission(ctx context.Context, s network.Stream, request *AdmissionRequest) (*AdmissionResponse, error) {
 	defer s.Close()
 
-	data, err := json.Marshal(invite)
-	if err != nil {
-		return fmt.Errorf("failed to marshal invite: %w", err)
+	ws := p2p.NewWireStream(s)
+	if err := ws.WriteMessage(request); err != nil {
+		return nil, fmt.Errorf("failed to write admission request: %w", err)
 	}
+	s.CloseWrite()
 
-	data = append(data, '\n')
-	_, err = s.Write(data)
+	response, err := readAdmissionResponse(ws)
 	if err != nil {
-		return fmt.Errorf("failed to write invite: %w", err)
+		return nil, fmt.Errorf("failed to read admission response: %w", err)
 	}
-
-	return nil
+	return response, nil
 }
@@ -0,0 +1,366 @@
+package conference
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// MaxRateLimitMessages caps how many messages a rate limit can allow per window
+	MaxRateLimitMessages = 1000
+
+	// MaxRateLimitWindow caps a rate limit's window and slow mode's gap and length
+	MaxRateLimitWindow = 24 * time.Hour
+
+	// rateLimitSlack is how much sooner than allowed a member's message may
+	// arrive, since delivery delays vary and can bunch up messages that were
+	// sent far enough apart
+	rateLimitSlack = 2 * time.Second
+)
+
+// ErrRateLimited is returned when posting now would break a conference's limits
+var ErrRateLimited = errors.New("you are posting too fast")
+
+// RateLimit carries a conference's posting limits on the control topic. Every
+// replica sends the version it has, but only the owner's copy is applied, so
+// the owner can tell when a member is behind and resend it.
+type RateLimit struct {
+	Messages        int   `json:"messages,omitempty"`          // Per member per window; 0 = unlimited
+	WindowSeconds   int   `json:"window_seconds,omitempty"`    // Length of the window Messages counts over
+	SlowModeSeconds int   `json:"slow_mode_seconds,omitempty"` // Minimum gap between a member's messages in slow mode
+	SlowModeUntil   int64 `json:"slow_mode_until,omitempty"`   // Unix time slow mode ends
+	Version         int64 `json:"version"`                     // When the owner set it, in Unix nanoseconds
+}
+
+// rateLimiter remembers when members recently posted in each conference, to
+// hold them to its limits. The validators and local sends share one, so
+// it is guarded by a mutex.
+type rateLimiter struct {
+	mu    sync.Mutex
+	posts map[int64]map[string][]time.Time // conference_id -> peer ID -> recent post times, oldest first
+}
+
+// newRateLimiter creates a limiter that has seen no posts
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{posts: make(map[int64]map[string][]time.Time)}
+}
+
+// allow returns how long a member must wait before posting under limit, and
+// whether slow mode rather than the rate limit holds them back. If they may
+// post now it records the post and returns 0. A post due within slack is let
+// through.
+func (rl *rateLimiter) allow(conferenceID int64, peerID string, limit *storage.ConferenceRateLimit, now time.Time, slack time.Duration) (time.Duration, bool) {
+	window := time.Duration(limit.WindowSeconds) * time.Second
+	if limit.Messages <= 0 {
+		window = 0
+	}
+	var gap time.Duration
+	if limit.SlowModeActive(now) {
+		gap = time.Duration(limit.SlowModeSeconds) * time.Second
+	}
+	if window <= 0 && gap <= 0 {
+		return 0, false
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	members, ok := rl.posts[conferenceID]
+	if !ok {
+		members = make(map[string][]time.Time)
+		rl.posts[conferenceID] = members
+	}
+
+	// Forget posts too old to matter to either limit
+	posts := members[peerID]
+	for len(posts) > 0 && now.Sub(posts[0]) >= max(window, gap) {
+		posts = posts[1:]
+	}
+
+	var wait time.Duration
+	slowMode := false
+	if window > 0 {
+		recent := posts
+		for len(recent) > 0 && now.Sub(recent[0]) >= window {
+			recent = recent[1:]
+		}
+		if len(recent) >= limit.Messages {
+			wait = recent[len(recent)-limit.Messages].Add(window).Sub(now)
+		}
+	}
+	if gap > 0 && len(posts) > 0 {
+		if next := posts[len(posts)-1].Add(gap).Sub(now); next > wait {
+			wait, slowMode = next, true
+		}
+	}
+
+	if wait <= slack {
+		posts = append(posts, now)
+		wait, slowMode = 0, false
+	}
+	members[peerID] = posts
+	return wait, slowMode
+}
+
+// SetRateLimit limits every member but the owner to messages posts per window
+// in a conference (owner only). Zero messages removes the limit. Slow mode is
+// left as it is.
+func (m *Manager) SetRateLimit(ctx context.Context, currentUser *storage.User, conferenceID int64, messages int, window time.Duration) error {
+	if messages < 0 || messages > MaxRateLimitMessages {
+		return fmt.Errorf("messages per window must be between 0 and %d", MaxRateLimitMessages)
+	}
+	if messages > 0 && (window < time.Second || window > MaxRateLimitWindow) {
+		return fmt.Errorf("window must be between 1s and %s", MaxRateLimitWindow)
+	}
+
+	return m.updateRateLimit(ctx, currentUser, conferenceID, func(limit *storage.ConferenceRateLimit) {
+		limit.Messages = messages
+		limit.WindowSeconds = int(window / time.Second)
+		if messages == 0 {
+			limit.WindowSeconds = 0
+		}
+	})
+}
+
+// SetSlowMode makes every member but the owner wait gap between posts in a
+// conference (owner only), for the next duration or, if it is zero, until
+// turned off. A zero gap turns slow mode off.
+func (m *Manager) SetSlowMode(ctx context.Context, currentUser *storage.User, conferenceID int64, gap, duration time.Duration) error {
+	if gap > 0 && (gap < time.Second || gap > MaxRateLimitWindow) {
+		return fmt.Errorf("gap must be between 1s and %s", MaxRateLimitWindow)
+	}
+	if gap > 0 && duration != 0 && (duration < time.Second || duration > MaxRateLimitWindow) {
+		return fmt.Errorf("slow mode can last between 1s and %s", MaxRateLimitWindow)
+	}
+
+	return m.updateRateLimit(ctx, currentUser, conferenceID, func(limit *storage.ConferenceRateLimit) {
+		limit.SlowModeSeconds = int(gap / time.Second)
+		limit.SlowModeUntil = time.Time{}
+		if gap > 0 && duration > 0 {
+			limit.SlowModeUntil = time.Now().Add(duration)
+		}
+	})
+}
+
+// GetRateLimit returns a conference's posting limits, or nil if it has none
+func (m *Manager) GetRateLimit(ctx context.Context, conferenceID int64) (*storage.ConferenceRateLimit, error) {
+	return m.storage.GetConferenceRateLimit(ctx, conferenceID)
+}
+
+// updateRateLimit applies an owner's change to a conference's limits, stamps
+// it with a new version and announces it on the control topic
+func (m *Manager) updateRateLimit(ctx context.Context, currentUser *storage.User, conferenceID int64, change func(limit *storage.ConferenceRateLimit)) error {
+	conf, err := m.getConference(ctx, conferenceID)
+	if err != nil {
+		return err
+	}
+	if conf.CreatorID != currentUser.ID {
+		return ErrNotOwner
+	}
+
+	limit, err := m.storage.GetConferenceRateLimit(ctx, conferenceID)
+	if err != nil {
+		return fmt.Errorf("failed to load rate limit: %w", err)
+	}
+	if limit == nil {
+		limit = &storage.ConferenceRateLimit{ConferenceID: conferenceID}
+	}
+	change(limit)
+	limit.Version = max(time.Now().UnixNano(), limit.Version+1)
+
+	if _, err := m.storage.SaveConferenceRateLimit(ctx, limit); err != nil {
+		return fmt.Errorf("failed to save rate limit: %w", err)
+	}
+	if err := m.broadcastMembership(ctx, conferenceID); err != nil {
+		i18n.Printf("Warning: Failed to announce rate limit: %v\n", err)
+	}
+	return nil
+}
+
+// checkPostRate returns ErrRateLimited, saying which limit applies and how
+// long to wait, if the current user must wait before posting in a conference,
+// and otherwise counts the post. A refused user is told when the cooldown ends.
+func (m *Manager) checkPostRate(ctx context.Context, currentUser *storage.User, conferenceID int64) error {
+	limit, err := m.storage.GetConferenceRateLimit(ctx, conferenceID)
+	if err != nil {
+		return fmt.Errorf("failed to load rate limit: %w", err)
+	}
+	if limit == nil || m.ownerOf(ctx, conferenceID) == currentUser.PeerID {
+		return nil
+	}
+
+	wait, slowMode := m.limiter.allow(conferenceID, currentUser.PeerID, limit, time.Now(), 0)
+	if wait <= 0 {
+		return nil
+	}
+	wait = (wait + time.Second - 1).Truncate(time.Second)
+
+	name := m.conferenceName(ctx, conferenceID)
+	m.announceCooldownEnd(conferenceID, name, wait)
+	if slowMode {
+		return fmt.Errorf("%w: '%s' is in slow mode (one message every %s); you can post again in %s",
+			ErrRateLimited, name, time.Duration(limit.SlowModeSeconds)*time.Second, wait)
+	}
+	return fmt.Errorf("%w: '%s' allows %d messages per %s; you can post again in %s",
+		ErrRateLimited, name, limit.Messages, time.Duration(limit.WindowSeconds)*time.Second, wait)
+}
+
+// announceCooldownEnd tells the user when they may post in a conference again,
+// once per cooldown however many posts were refused during it
+func (m *Manager) announceCooldownEnd(conferenceID int64, name string, wait time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cooldowns[conferenceID] {
+		return
+	}
+	m.cooldowns[conferenceID] = true
+
+	time.AfterFunc(wait, func() {
+		m.mu.Lock()
+		delete(m.cooldowns, conferenceID)
+		m.mu.Unlock()
+		i18n.Printf("\n⏱️  You can post in '%s' again\n> ", name)
+	})
+}
+
+// conferenceName returns a conference's name, or its ID if it is unknown
+func (m *Manager) conferenceName(ctx context.Context, conferenceID int64) string {
+	if conf, err := m.storage.GetConference(ctx, conferenceID); err == nil {
+		return conf.Name
+	}
+	return fmt.Sprintf("%d", conferenceID)
+}
+
+// isRateLimited reports whether a member's message breaks a conference's
+// limits, counting it if not. Our own messages were checked before sending,
+// and the owner is never limited.
+func (m *Manager) isRateLimited(conferenceID int64, from peer.ID) bool {
+	if from == m.host.ID() {
+		return false
+	}
+
+	ctx := context.Background()
+	limit, err := m.storage.GetConferenceRateLimit(ctx, conferenceID)
+	if err != nil || limit == nil || m.ownerOf(ctx, conferenceID) == from.String() {
+		return false
+	}
+	wait, _ := m.limiter.allow(conferenceID, from.String(), limit, time.Now(), rateLimitSlack)
+	if wait > 0 {
+		m.reportOffense(from, storage.PeerOffenseRateLimited)
+	}
+	return wait > 0
+}
+
+// ownerOf returns the peer ID of a conference's owner, from its invite or its
+// creator, or "" if we don't know them
+func (m *Manager) ownerOf(ctx context.Context, conferenceID int64) string {
+	m.mu.Lock()
+	invite, ok := m.invites[conferenceID]
+	m.mu.Unlock()
+	if ok && invite.OwnerPeerID != "" {
+		return invite.OwnerPeerID
+	}
+
+	conf, err := m.storage.GetConference(ctx, conferenceID)
+	if err != nil {
+		return ""
+	}
+	return m.ownerPeerID(ctx, conf)
+}
+
+// wireRateLimit returns a conference's limits for the control topic, or nil if it has none
+func (m *Manager) wireRateLimit(ctx context.Context, conferenceID int64) (*RateLimit, error) {
+	limit, err := m.storage.GetConferenceRateLimit(ctx, conferenceID)
+	if err != nil || limit == nil {
+		return nil, err
+	}
+	wire := &RateLimit{
+		Messages:        limit.Messages,
+		WindowSeconds:   limit.WindowSeconds,
+		SlowModeSeconds: limit.SlowModeSeconds,
+		Version:         limit.Version,
+	}
+	if !limit.SlowModeUntil.IsZero() {
+		wire.SlowModeUntil = limit.SlowModeUntil.Unix()
+	}
+	return wire, nil
+}
+
+// mergeRateLimit applies the limits in a membership state if the owner sent
+// them and they are newer than ours, and reports whether the sender is up to
+// date. Only the owner's copy counts, so only the owner resends it.
+func (m *Manager) mergeRateLimit(ctx context.Context, state *MembershipState) bool {
+	current, err := m.storage.GetConferenceRateLimit(ctx, state.ConferenceID)
+	if err != nil {
+		i18n.Printf("Warning: Failed to load rate limit: %v\n", err)
+		return true
+	}
+	var version, remoteVersion int64
+	if current != nil {
+		version = current.Version
+	}
+	if state.RateLimit != nil {
+		remoteVersion = state.RateLimit.Version
+	}
+
+	owner := m.ownerOf(ctx, state.ConferenceID)
+	if remoteVersion > version && state.FromPeerID == owner {
+		limit := &storage.ConferenceRateLimit{
+			ConferenceID:    state.ConferenceID,
+			Messages:        state.RateLimit.Messages,
+			WindowSeconds:   state.RateLimit.WindowSeconds,
+			SlowModeSeconds: state.RateLimit.SlowModeSeconds,
+			Version:         remoteVersion,
+		}
+		if state.RateLimit.SlowModeUntil > 0 {
+			limit.SlowModeUntil = time.Unix(state.RateLimit.SlowModeUntil, 0)
+		}
+		saved, err := m.storage.SaveConferenceRateLimit(ctx, limit)
+		if err != nil {
+			i18n.Printf("Warning: Failed to save rate limit: %v\n", err)
+		} else if saved {
+			m.announceRateLimit(ctx, current, limit)
+		}
+		return true
+	}
+	return owner != m.host.ID().String() || remoteVersion >= version
+}
+
+// announceRateLimit tells the user how an owner changed a conference's limits
+func (m *Manager) announceRateLimit(ctx context.Context, previous, limit *storage.ConferenceRateLimit) {
+	name := m.conferenceName(ctx, limit.ConferenceID)
+	if previous == nil {
+		previous = &storage.ConferenceRateLimit{}
+	}
+
+	if limit.Messages != previous.Messages || limit.WindowSeconds != previous.WindowSeconds {
+		if limit.Messages > 0 {
+			i18n.Printf("\n⏱️  '%s' now allows each member %d messages per %s\n> ",
+				name, limit.Messages, time.Duration(limit.WindowSeconds)*time.Second)
+		} else {
+			i18n.Printf("\n⏱️  '%s' no longer limits how fast members post\n> ", name)
+		}
+	}
+
+	if limit.SlowModeSeconds == previous.SlowModeSeconds && limit.SlowModeUntil.Equal(previous.SlowModeUntil) {
+		return
+	}
+	now := time.Now()
+	gap := time.Duration(limit.SlowModeSeconds) * time.Second
+	switch {
+	case limit.SlowModeActive(now) && limit.SlowModeUntil.IsZero():
+		i18n.Printf("\n🐢 Slow mode in '%s': one message every %s\n> ", name, gap)
+	case limit.SlowModeActive(now):
+		i18n.Printf("\n🐢 Slow mode in '%s': one message every %s until %s\n> ",
+			name, gap, limit.SlowModeUntil.Format("15:04"))
+	case previous.SlowModeActive(now):
+		i18n.Printf("\n🐢 Slow mode ended in '%s'\n> ", name)
+	}
+}
@@ -0,0 +1,290 @@
+package conference
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// conferenceTopics holds the pubsub handles for one subscribed conference
+type conferenceTopics struct {
+	topic        *pubsub.Topic
+	sub          *pubsub.Subscription
+	controlTopic *pubsub.Topic
+	controlSub   *pubsub.Subscription
+	presence     *pubsub.Topic
+	presenceSub  *pubsub.Subscription
+	channels     map[string]*channelTopic // Named channels, by name
+	listenCtx    context.Context          // Parent context for the conference's listeners
+	cancel       context.CancelFunc       // Stops the conference's listener goroutines
+}
+
+// channelTopic holds the pubsub handles for one channel of a subscribed conference
+type channelTopic struct {
+	topic *pubsub.Topic
+	sub   *pubsub.Subscription
+}
+
+// topicManager owns every conference topic and subscription. Its state is guarded
+// by a mutex because it is touched from the command loop, stream handlers and
+// listener goroutines alike.
+type topicManager struct {
+	mu        sync.Mutex
+	pubsub    *pubsub.PubSub
+	admitted  admitFunc                   // Membership check used by the topic validators
+	observing admitFunc                   // Observer check used by the message topic validators
+	limited   limitFunc                   // Rate limit check used by the message topic validators
+	confs     map[int64]*conferenceTopics // conference_id -> topics
+}
+
+// newTopicManager creates an empty topic manager
+func newTopicManager(ps *pubsub.PubSub, admitted, observing admitFunc, limited limitFunc) *topicManager {
+	return &topicManager{
+		pubsub:    ps,
+		admitted:  admitted,
+		observing: observing,
+		limited:   limited,
+		confs:     make(map[int64]*conferenceTopics),
+	}
+}
+
+// conferenceTopicName returns the pubsub topic carrying a conference's messages
+func conferenceTopicName(conferenceID int64) string {
+	return fmt.Sprintf("/whisper/conf/%d", conferenceID)
+}
+
+// controlTopicName returns the pubsub topic carrying a conference's membership state
+func controlTopicName(conferenceID int64) string {
+	return fmt.Sprintf("/whisper/conf/%d/control", conferenceID)
+}
+
+// presenceTopicName returns the pubsub topic carrying a conference's presence beacons
+func presenceTopicName(conferenceID int64) string {
+	return fmt.Sprintf("/whisper/conf/%d/presence", conferenceID)
+}
+
+// channelTopicName returns the pubsub topic carrying one channel's messages
+func channelTopicName(conferenceID int64, channel string) string {
+	return fmt.Sprintf("/whisper/conf/%d/ch/%s", conferenceID, channel)
+}
+
+// subscribe joins the message, control and presence topics of a conference. It returns the new handles and a
+// context for their listeners, or nil if the conference is already subscribed.
+func (tm *topicManager) subscribe(ctx context.Context, conferenceID int64) (*conferenceTopics, context.Context, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if _, ok := tm.confs[conferenceID]; ok {
+		return nil, nil, nil // Already subscribed
+	}
+
+	ct := &conferenceTopics{channels: make(map[string]*channelTopic)}
+	var err error
+
+	// Reject malformed or forged messages before they are relayed
+	if err = tm.pubsub.RegisterTopicValidator(conferenceTopicName(conferenceID), validateGossipMessage(conferenceID, "", tm.admitted, tm.observing, tm.limited)); err != nil {
+		return nil, nil, fmt.Errorf("failed to register topic validator: %w", err)
+	}
+	if err = tm.pubsub.RegisterTopicValidator(controlTopicName(conferenceID), validateMembershipState(conferenceID, tm.admitted)); err != nil {
+		tm.release(conferenceID, ct)
+		return nil, nil, fmt.Errorf("failed to register control topic validator: %w", err)
+	}
+	if err = tm.pubsub.RegisterTopicValidator(presenceTopicName(conferenceID), validatePresenceBeacon(conferenceID, tm.admitted)); err != nil {
+		tm.release(conferenceID, ct)
+		return nil, nil, fmt.Errorf("failed to register presence topic validator: %w", err)
+	}
+
+	if ct.topic, err = tm.pubsub.Join(conferenceTopicName(conferenceID)); err != nil {
+		tm.release(conferenceID, ct)
+		return nil, nil, fmt.Errorf("failed to join topic: %w", err)
+	}
+	if ct.sub, err = ct.topic.Subscribe(); err != nil {
+		tm.release(conferenceID, ct)
+		return nil, nil, fmt.Errorf("failed to subscribe: %w", err)
+	}
+
+	// Join the control topic used to replicate membership
+	if ct.controlTopic, err = tm.pubsub.Join(controlTopicName(conferenceID)); err != nil {
+		tm.release(conferenceID, ct)
+		return nil, nil, fmt.Errorf("failed to join control topic: %w", err)
+	}
+	if ct.controlSub, err = ct.controlTopic.Subscribe(); err != nil {
+		tm.release(conferenceID, ct)
+		return nil, nil, fmt.Errorf("failed to subscribe to control topic: %w", err)
+	}
+
+	// Join the presence topic members beacon on while they are in the room
+	if ct.presence, err = tm.pubsub.Join(presenceTopicName(conferenceID)); err != nil {
+		tm.release(conferenceID, ct)
+		return nil, nil, fmt.Errorf("failed to join presence topic: %w", err)
+	}
+	if ct.presenceSub, err = ct.presence.Subscribe(); err != nil {
+		tm.release(conferenceID, ct)
+		return nil, nil, fmt.Errorf("failed to subscribe to presence topic: %w", err)
+	}
+
+	for _, topic := range []*pubsub.Topic{ct.topic, ct.controlTopic, ct.presence} {
+		if err := topic.SetScoreParams(p2p.ConferenceTopicScoreParams()); err != nil {
+			i18n.Printf("Warning: Failed to set topic score params: %v\n", err)
+		}
+	}
+
+	listenCtx, cancel := context.WithCancel(ctx)
+	ct.listenCtx = listenCtx
+	ct.cancel = cancel
+	tm.confs[conferenceID] = ct
+	return ct, listenCtx, nil
+}
+
+// subscribeChannel joins a channel of a subscribed conference. It returns the new
+// handles and the conference's listener context, or nil if the conference isn't
+// subscribed or the channel already is.
+func (tm *topicManager) subscribeChannel(conferenceID int64, channel string) (*channelTopic, context.Context, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	ct, ok := tm.confs[conferenceID]
+	if !ok {
+		return nil, nil, nil
+	}
+	if _, ok := ct.channels[channel]; ok {
+		return nil, nil, nil
+	}
+
+	name := channelTopicName(conferenceID, channel)
+	if err := tm.pubsub.RegisterTopicValidator(name, validateGossipMessage(conferenceID, channel, tm.admitted, tm.observing, tm.limited)); err != nil {
+		return nil, nil, fmt.Errorf("failed to register channel validator: %w", err)
+	}
+
+	ch := &channelTopic{}
+	var err error
+	if ch.topic, err = tm.pubsub.Join(name); err != nil {
+		tm.pubsub.UnregisterTopicValidator(name)
+		return nil, nil, fmt.Errorf("failed to join channel topic: %w", err)
+	}
+	if ch.sub, err = ch.topic.Subscribe(); err != nil {
+		ch.topic.Close()
+		tm.pubsub.UnregisterTopicValidator(name)
+		return nil, nil, fmt.Errorf("failed to subscribe to channel: %w", err)
+	}
+	if err := ch.topic.SetScoreParams(p2p.ConferenceTopicScoreParams()); err != nil {
+		i18n.Printf("Warning: Failed to set topic score params: %v\n", err)
+	}
+
+	ct.channels[channel] = ch
+	return ch, ct.listenCtx, nil
+}
+
+// unsubscribe tears down a conference's topics; it is a no-op if not subscribed
+func (tm *topicManager) unsubscribe(conferenceID int64) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if ct, ok := tm.confs[conferenceID]; ok {
+		tm.release(conferenceID, ct)
+		delete(tm.confs, conferenceID)
+	}
+}
+
+// unsubscribeAll tears down every conference, e.g. on logout or shutdown
+func (tm *topicManager) unsubscribeAll() int {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	count := len(tm.confs)
+	for conferenceID, ct := range tm.confs {
+		tm.release(conferenceID, ct)
+	}
+	tm.confs = make(map[int64]*conferenceTopics)
+	return count
+}
+
+// release cancels subscriptions, closes topics and drops validators; caller holds mu
+func (tm *topicManager) release(conferenceID int64, ct *conferenceTopics) {
+	if ct.cancel != nil {
+		ct.cancel()
+	}
+	if ct.sub != nil {
+		ct.sub.Cancel()
+	}
+	if ct.topic != nil {
+		ct.topic.Close()
+	}
+	if ct.controlSub != nil {
+		ct.controlSub.Cancel()
+	}
+	if ct.controlTopic != nil {
+		ct.controlTopic.Close()
+	}
+	if ct.presenceSub != nil {
+		ct.presenceSub.Cancel()
+	}
+	if ct.presence != nil {
+		ct.presence.Close()
+	}
+	for channel, ch := range ct.channels {
+		ch.sub.Cancel()
+		ch.topic.Close()
+		tm.pubsub.UnregisterTopicValidator(channelTopicName(conferenceID, channel))
+	}
+	tm.pubsub.UnregisterTopicValidator(conferenceTopicName(conferenceID))
+	tm.pubsub.UnregisterTopicValidator(controlTopicName(conferenceID))
+	tm.pubsub.UnregisterTopicValidator(presenceTopicName(conferenceID))
+}
+
+// channelTopic returns the message topic for a channel of a subscribed conference;
+// the empty channel is the conference's main topic
+func (tm *topicManager) channelTopic(conferenceID int64, channel string) (*pubsub.Topic, bool) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	ct, ok := tm.confs[conferenceID]
+	if !ok {
+		return nil, false
+	}
+	if channel == "" {
+		return ct.topic, true
+	}
+	ch, ok := ct.channels[channel]
+	if !ok {
+		return nil, false
+	}
+	return ch.topic, true
+}
+
+// presenceTopic returns the presence topic for a subscribed conference
+func (tm *topicManager) presenceTopic(conferenceID int64) (*pubsub.Topic, bool) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	ct, ok := tm.confs[conferenceID]
+	if !ok {
+		return nil, false
+	}
+	return ct.presence, true
+}
+
+// controlTopic returns the membership topic for a subscribed conference
+func (tm *topicManager) controlTopic(conferenceID int64) (*pubsub.Topic, bool) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	ct, ok := tm.confs[conferenceID]
+	if !ok {
+		return nil, false
+	}
+	return ct.controlTopic, true
+}
+
+// isSubscribed reports whether the conference's topics are joined
+func (tm *topicManager) isSubscribed(conferenceID int64) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	_, ok := tm.confs[conferenceID]
+	return ok
+}
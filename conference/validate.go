@@ -0,0 +1,93 @@
+package conference
+
+import (
+	"context"
+
+	"github.com/austinwklein/whisper/p2p"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// admitFunc reports whether a peer is in a conference's admitted membership
+// set, or whether it holds a role such as observer there
+type admitFunc func(conferenceID int64, from peer.ID) bool
+
+// limitFunc reports whether a message from a peer breaks a conference's
+// posting limits, counting it against them if not
+type limitFunc func(conferenceID int64, from peer.ID) bool
+
+// validateGossipMessage rejects conference messages that fail to decode or that claim
+// to come from someone other than their signer. Rejections count against the
+// forwarding peer's GossipSub score, so spammers fall out of the mesh. Messages
+// from signers outside the admitted membership are dropped without penalty, since
+// a newly admitted member can speak before its admission reaches us, as are
+// messages over the member's rate limit, since relays can't tell them apart
+// from the ones that fit. Messages from observers are rejected: they may read
+// but not post. Channel topics inherit the conference's membership, observers
+// and limits.
+func validateGossipMessage(conferenceID int64, channel string, admitted, observing admitFunc, limited limitFunc) pubsub.ValidatorEx {
+	return recovering("conference message validator", func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		gossipMsg, err := decodeTopicMessage(msg.Data)
+		if err != nil {
+			return pubsub.ValidationReject
+		}
+		if gossipMsg.ConferenceID != conferenceID || gossipMsg.Channel != channel || gossipMsg.FromPeerID != msg.GetFrom().String() {
+			return pubsub.ValidationReject
+		}
+		if !admitted(conferenceID, msg.GetFrom()) {
+			return pubsub.ValidationIgnore
+		}
+		if observing(conferenceID, msg.GetFrom()) {
+			return pubsub.ValidationReject
+		}
+		if limited(conferenceID, msg.GetFrom()) {
+			return pubsub.ValidationIgnore
+		}
+		return pubsub.ValidationAccept
+	})
+}
+
+// validateMembershipState applies the same checks to the control topic
+func validateMembershipState(conferenceID int64, admitted admitFunc) pubsub.ValidatorEx {
+	return recovering("conference membership validator", func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		state, err := decodeTopicMembershipState(msg.Data)
+		if err != nil {
+			return pubsub.ValidationReject
+		}
+		if state.ConferenceID != conferenceID || state.FromPeerID != msg.GetFrom().String() {
+			return pubsub.ValidationReject
+		}
+		if !admitted(conferenceID, msg.GetFrom()) {
+			return pubsub.ValidationIgnore
+		}
+		return pubsub.ValidationAccept
+	})
+}
+
+// validatePresenceBeacon applies the same checks to the presence topic.
+// Observers are in the room too, so their beacons are accepted.
+func validatePresenceBeacon(conferenceID int64, admitted admitFunc) pubsub.ValidatorEx {
+	return recovering("conference presence validator", func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		beacon, err := decodeTopicPresenceBeacon(msg.Data)
+		if err != nil {
+			return pubsub.ValidationReject
+		}
+		if beacon.ConferenceID != conferenceID || beacon.FromPeerID != msg.GetFrom().String() {
+			return pubsub.ValidationReject
+		}
+		if !admitted(conferenceID, msg.GetFrom()) {
+			return pubsub.ValidationIgnore
+		}
+		return pubsub.ValidationAccept
+	})
+}
+
+// recovering drops a message whose validator panicked instead of letting the
+// panic take down the node
+func recovering(name string, validate pubsub.ValidatorEx) pubsub.ValidatorEx {
+	return func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		result := pubsub.ValidationIgnore
+		p2p.Protect(name, msg.GetFrom(), func() { result = validate(ctx, from, msg) })
+		return result
+	}
+}
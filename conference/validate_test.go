@@ -0,0 +1,48 @@
+package conference
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/austinwklein/whisper/p2p"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pubsubpb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestRecoveringValidatorDropsMessage(t *testing.T) {
+	from, err := peer.Decode("12D3KooWK99VoVxNE7XzyBwXEzW7xhK7Gpv85r9F3V3fyKSUKPH5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	msg := &pubsub.Message{Message: &pubsubpb.Message{From: []byte(from), Data: []byte("{}")}}
+	before := len(p2p.DefaultStreamGuard.RecentPanics())
+
+	validate := recovering("test validator", func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		var m map[string]int
+		m["boom"]++ // Panics: assignment to entry in nil map
+		return pubsub.ValidationAccept
+	})
+	if result := validate(context.Background(), from, msg); result != pubsub.ValidationIgnore {
+		t.Errorf("validator that panicked returned %v, want ValidationIgnore", result)
+	}
+
+	recent := p2p.DefaultStreamGuard.RecentPanics()
+	if len(recent) <= before || recent[len(recent)-1].Handler != "test validator" || recent[len(recent)-1].Peer != from {
+		t.Errorf("panic was not recorded: %+v", recent)
+	}
+
+	// Validators that don't panic keep their verdict
+	reject := recovering("test validator", func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		return pubsub.ValidationReject
+	})
+	if result := reject(context.Background(), from, msg); result != pubsub.ValidationReject {
+		t.Errorf("validator returned %v, want ValidationReject", result)
+	}
+}
@@ -0,0 +1,113 @@
+package conference
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+)
+
+const (
+	// writeBatchSize is how many received messages are buffered before they are
+	// written straight away
+	writeBatchSize = 128
+
+	// writeInterval is the longest a received message waits to be written
+	writeInterval = 250 * time.Millisecond
+)
+
+// messageKey identifies a conference message across replicas
+type messageKey struct {
+	conferenceID int64
+	fromPeerID   string
+	lamport      int64
+}
+
+// messageWriter batches received conference messages into one transaction per
+// flush, so a busy room costs a commit every writeInterval rather than one per
+// message. Anything that reads conference messages or the logical clock from
+// storage flushes first, so callers never see a stale table.
+type messageWriter struct {
+	storage storage.Storage
+
+	mu      sync.Mutex
+	pending []*storage.ConferenceMessage
+	queued  map[messageKey]bool // Pending messages, for duplicate checks
+	timer   *time.Timer         // Set while a flush is scheduled
+
+	flushMu sync.Mutex // Keeps batches in order
+}
+
+// newMessageWriter creates a writer on store
+func newMessageWriter(store storage.Storage) *messageWriter {
+	return &messageWriter{
+		storage: store,
+		queued:  make(map[messageKey]bool),
+	}
+}
+
+// add queues a message. A full batch is written before add returns; otherwise
+// it is written within writeInterval.
+func (w *messageWriter) add(msg *storage.ConferenceMessage) {
+	w.mu.Lock()
+	w.pending = append(w.pending, msg)
+	if msg.Lamport > 0 {
+		w.queued[messageKey{msg.ConferenceID, msg.FromPeerID, msg.Lamport}] = true
+	}
+	full := len(w.pending) >= writeBatchSize
+	if !full && w.timer == nil {
+		w.timer = time.AfterFunc(writeInterval, func() {
+			w.flush(context.Background())
+		})
+	}
+	w.mu.Unlock()
+
+	if full {
+		w.flush(context.Background())
+	}
+}
+
+// depth returns how many messages are waiting to be written
+func (w *messageWriter) depth() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending)
+}
+
+// has reports whether a message is waiting to be written
+func (w *messageWriter) has(conferenceID int64, fromPeerID string, lamport int64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.queued[messageKey{conferenceID, fromPeerID, lamport}]
+}
+
+// flush writes every pending message
+func (w *messageWriter) flush(ctx context.Context) {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	batch := w.pending
+	w.pending = nil
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.mu.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := w.storage.SaveConferenceMessages(ctx, batch); err != nil {
+		i18n.Printf("Warning: Failed to save %d conference messages: %v\n", len(batch), err)
+	}
+
+	w.mu.Lock()
+	for _, msg := range batch {
+		delete(w.queued, messageKey{msg.ConferenceID, msg.FromPeerID, msg.Lamport})
+	}
+	w.mu.Unlock()
+}
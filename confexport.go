@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/austinwklein/whisper/conference"
+	"github.com/austinwklein/whisper/i18n"
+)
+
+// exportConference handles `conf-export <conf-id> [json|md] [path]`, writing
+// the conference's transcript to a file (by default in the working directory)
+func (a *App) exportConference(ctx context.Context, args []string) {
+	if len(args) < 1 {
+		i18n.Println("Usage: conf-export <conf-id> [json|md] [path]")
+		i18n.Println("Example: conf-export 1 md standup.md")
+		return
+	}
+	var confID int64
+	if _, err := fmt.Sscanf(args[0], "%d", &confID); err != nil {
+		i18n.Println("Usage: conf-export <conf-id> [json|md] [path]")
+		return
+	}
+
+	format := conference.ExportMarkdown
+	path := ""
+	for _, arg := range args[1:] {
+		if f, err := conference.ParseExportFormat(arg); err == nil {
+			format = f
+		} else {
+			path = arg
+		}
+	}
+	if path == "" {
+		path = fmt.Sprintf("conference-%d-%s.%s", confID, time.Now().Format("20060102-150405"), format)
+	}
+
+	conf, err := a.storage.GetConference(ctx, confID)
+	if err != nil {
+		i18n.Printf("Conference not found\n")
+		return
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		i18n.Printf("Failed to create %s: %v\n", path, err)
+		return
+	}
+	w := bufio.NewWriter(f)
+	count, err := a.conferenceManager.ExportTranscript(ctx, confID, format, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		i18n.Printf("Export failed: %v\n", err)
+		return
+	}
+	i18n.Printf("✓ Exported %d messages from '%s' to %s\n", count, conf.Name, path)
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// AccountDBFile is the database file in an account's directory
+const AccountDBFile = "whisper.db"
+
+// reservedDirs are the names under DataDir that aren't account directories
+var reservedDirs = map[string]bool{
+	"backups":    true,
+	"push-relay": true,
+}
+
+// CheckAccountName reports whether a username can name its own directory
+// under DataDir. An empty name is the shared database and always allowed.
+func CheckAccountName(name string) error {
+	if name == "" {
+		return nil
+	}
+	if strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") || reservedDirs[strings.ToLower(name)] {
+		return fmt.Errorf("%q can't be used as a directory name", name)
+	}
+	return nil
+}
+
+// AccountDBPath returns the database in an account's directory under dataDir
+func AccountDBPath(dataDir, name string) string {
+	return filepath.Join(dataDir, name, AccountDBFile)
+}
+
+// SetAccount switches to an account's own directory. A database set with
+// WHISPER_DB still wins, as it does over the default.
+func (c *Config) SetAccount(name string) error {
+	if name == "" {
+		return fmt.Errorf("an account name is required")
+	}
+	if err := CheckAccountName(name); err != nil {
+		return err
+	}
+	c.useAccount(name)
+	return nil
+}
+
+// useAccount sets the account without checking its name
+func (c *Config) useAccount(name string) {
+	c.Account = name
+	if c.values["WHISPER_DB"] == "" {
+		c.DBPath = AccountDBPath(c.DataDir, name)
+	}
+}
@@ -1,8 +1,11 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 // DefaultDBPath can be overridden at build time with -ldflags
@@ -14,36 +17,440 @@ type Config struct {
 	DataDir  string `json:"data_dir"`
 	LogLevel string `json:"log_level"` // debug, info, warn, error
 	MaxPeers int    `json:"max_peers"`
+
+	// ConferenceArchivers is how many members of each conference keep full
+	// history and serve it to others (0 = every member only keeps what it sees)
+	ConferenceArchivers int `json:"conference_archivers"`
+
+	// ConferenceMaxParticipants is the participant limit given to conferences
+	// this node creates (0 = unlimited); owners can change it per conference
+	ConferenceMaxParticipants int `json:"conference_max_participants"`
+
+	// ConferenceCompactDays is how many days of conference history are kept
+	// as is (0 = all of it); each older day is replaced by a summary written
+	// by the ConferenceCompactPolicy compactor
+	ConferenceCompactDays   int    `json:"conference_compact_days"`
+	ConferenceCompactPolicy string `json:"conference_compact_policy"`
+
+	// ShareIdentity controls whether the logged-in username and full name are
+	// sent to peers on connect so they can show who they're connected to
+	ShareIdentity bool `json:"share_identity"`
+
+	// BackupIntervalHours schedules automatic database backups (0 = disabled);
+	// BackupRetain is how many automatic backups are kept.
+	// BackupPassphraseFile names a file holding the passphrase automatic
+	// backups are encrypted with; without one they leave out the node identity.
+	BackupIntervalHours  int    `json:"backup_interval_hours"`
+	BackupRetain         int    `json:"backup_retain"`
+	BackupPassphraseFile string `json:"backup_passphrase_file"`
+
+	// IdentityPassphraseFile names a file holding the passphrase the node
+	// identity key is encrypted with in the database (empty = stored as is)
+	IdentityPassphraseFile string `json:"identity_passphrase_file"`
+
+	// Storage quotas in MB for direct messages, conference history and backup
+	// files (0 = unlimited). QuotaHistoryPolicy and QuotaBackupsPolicy say what
+	// happens once one is full: prune (delete the oldest) or reject (refuse new)
+	QuotaMessagesMB    int    `json:"quota_messages_mb"`
+	QuotaConferencesMB int    `json:"quota_conferences_mb"`
+	QuotaBackupsMB     int    `json:"quota_backups_mb"`
+	QuotaHistoryPolicy string `json:"quota_history_policy"`
+	QuotaBackupsPolicy string `json:"quota_backups_policy"`
+
+	// WatchdogNoPeersMinutes and WatchdogMaxDialFailures trigger a soft restart
+	// of the P2P stack when it appears wedged (0 disables each check)
+	WatchdogNoPeersMinutes  int `json:"watchdog_no_peers_minutes"`
+	WatchdogMaxDialFailures int `json:"watchdog_max_dial_failures"`
+
+	// KeepaliveSeconds is how often connected friends are pinged to catch dead
+	// connections (0 disables); a friend that misses two pings of
+	// KeepaliveTimeoutSeconds each is marked offline and redialed
+	KeepaliveSeconds        int `json:"keepalive_seconds"`
+	KeepaliveTimeoutSeconds int `json:"keepalive_timeout_seconds"`
+
+	// AutoDialMode is when offline friends are dialed automatically: normal
+	// (on login and when messaging them), battery (only when messaging them),
+	// bandwidth (like normal, but only at known addresses) or off
+	AutoDialMode string `json:"autodial_mode"`
+
+	// Locale is the language of the CLI and notifications, e.g. es or es_MX
+	// (empty = from LC_ALL, LC_MESSAGES or LANG)
+	Locale string `json:"locale"`
+
+	// ASCIIMode is on (plain ASCII instead of emoji and box drawing), off, or
+	// auto (on when the terminal looks unable to show Unicode)
+	ASCIIMode string `json:"ascii_mode"`
+
+	// DHTMode is auto (serve the DHT only when publicly reachable), client or server
+	DHTMode string `json:"dht_mode"`
+
+	// Resource manager limits protecting against peers exhausting streams or memory
+	MaxMemoryMB               int `json:"max_memory_mb"`
+	MaxStreamsPerPeerProtocol int `json:"max_streams_per_peer_protocol"`
+
+	// DiagnosticsAddr is a loopback host:port serving pprof, goroutine dumps,
+	// libp2p introspection and Prometheus metrics over HTTP (empty = disabled)
+	DiagnosticsAddr string `json:"diagnostics_addr"`
+
+	// ControlSocket is the Unix socket a daemon serves 'whisper ctl' on
+	// (empty = control.sock next to the database)
+	ControlSocket string `json:"control_socket"`
+
+	// SlowQueryMs is how long a database operation may take before it is
+	// logged as slow (0 disables the log)
+	SlowQueryMs int `json:"slow_query_ms"`
+
+	// Guest runs with an in-memory identity and database; nothing is saved
+	Guest bool `json:"guest"`
+
+	// Account gives one account its own directory, DataDir/<account>, with a
+	// database and identity no other account shares (empty = the shared
+	// database at DBPath); see account.go
+	Account string `json:"account"`
+
+	// AutoLockMinutes locks the app after this long without a command (0 = disabled)
+	AutoLockMinutes int `json:"auto_lock_minutes"`
+
+	// MessageTTLHours is how long a direct message may wait to be delivered
+	// before it is marked failed and no longer retried (0 = no deadline)
+	MessageTTLHours int `json:"message_ttl_hours"`
+
+	// Relays are full multiaddrs (with /p2p/) of relay nodes used for NAT traversal
+	// and as rendezvous points resolving username@relay addresses
+	Relays []string `json:"relays"`
+
+	// RelayService makes this node relay traffic and keep a rendezvous directory
+	// for others; only useful on a publicly reachable node
+	RelayService bool `json:"relay_service"`
+
+	// Directories are trusted directory servers, as http(s) URLs or multiaddrs
+	// with /p2p/, that usernames are published to and looked up in, in order,
+	// before the DHT and the local database
+	Directories []string `json:"directories"`
+
+	// DirectoryService makes this node a directory server for others over
+	// libp2p, and over HTTP on DirectoryHTTPAddr if set
+	DirectoryService  bool   `json:"directory_service"`
+	DirectoryHTTPAddr string `json:"directory_http_addr"`
+
+	// PushRelay is the multiaddr (with /p2p/) of the push relay friends wake
+	// this node's device through, and PushProvider and PushTarget name the
+	// device: a UnifiedPush endpoint URL, or an APNs or FCM device token
+	PushRelay    string `json:"push_relay"`
+	PushProvider string `json:"push_provider"`
+	PushTarget   string `json:"push_target"`
+
+	// Mailbox is the multiaddr (with /p2p/) of the mailbox server friends
+	// leave messages at while this node is offline
+	Mailbox string `json:"mailbox"`
+
+	// UpdateCheck is where the node looks for newer whisper releases: off
+	// (the default), peers (the versions friends run) or feed (also the
+	// release feed at UpdateFeed, signed with the ed25519 key UpdateKey).
+	// Nothing is ever downloaded; the user is only told.
+	UpdateCheck string `json:"update_check"`
+	UpdateFeed  string `json:"update_feed"`
+	UpdateKey   string `json:"update_key"`
+
+	// File is the config file read for variables not set in the environment
+	// (WHISPER_CONFIG, .env by default); see reload.go
+	File string `json:"file"`
+
+	values map[string]string // The WHISPER_* variables the fields were read from
 }
 
+// LoadConfig reads the configuration from WHISPER_* environment variables,
+// and from the config file for those the environment doesn't set
 func LoadConfig() (*Config, error) {
+	path := os.Getenv("WHISPER_CONFIG")
+	if path == "" {
+		path = DefaultConfigFile
+	}
+	path = expandPath(path)
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	file, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := fromValues(path, merge(file))
+	if err := CheckAccountName(cfg.Account); err != nil {
+		return nil, fmt.Errorf("invalid WHISPER_ACCOUNT: %w", err)
+	}
+	return cfg, nil
+}
+
+// fromValues builds a configuration from WHISPER_* variables over the defaults
+func fromValues(path string, values map[string]string) *Config {
+	get := func(key string) string { return values[key] }
+
 	cfg := &Config{
+		File:   path,
+		values: values,
+
 		Port:     9999,
 		DBPath:   DefaultDBPath,
 		DataDir:  "~/.whisper",
 		LogLevel: "info",
 		MaxPeers: 100,
+
+		ConferenceArchivers:     3,
+		ConferenceCompactPolicy: "truncate",
+		ShareIdentity:           true,
+		BackupIntervalHours:     24,
+		BackupRetain:            7,
+		QuotaHistoryPolicy:      "prune",
+		QuotaBackupsPolicy:      "reject",
+
+		WatchdogNoPeersMinutes:  10,
+		WatchdogMaxDialFailures: 5,
+		SlowQueryMs:             200,
+		KeepaliveSeconds:        30,
+		KeepaliveTimeoutSeconds: 10,
+		AutoDialMode:            "normal",
+		ASCIIMode:               "auto",
+
+		DHTMode:     "auto",
+		UpdateCheck: "off",
+
+		MaxMemoryMB:               256,
+		MaxStreamsPerPeerProtocol: 16,
 	}
 
-	// Override with environment variables
-	if port := os.Getenv("WHISPER_PORT"); port != "" {
+	// Override with the variables that are set
+	if port := get("WHISPER_PORT"); port != "" {
 		p, _ := strconv.Atoi(port)
 		cfg.Port = p
 	}
 
-	if db := os.Getenv("WHISPER_DB"); db != "" {
+	if dir := get("WHISPER_DATA_DIR"); dir != "" {
+		cfg.DataDir = dir
+	}
+
+	if db := get("WHISPER_DB"); db != "" {
 		cfg.DBPath = db
 	}
 
+	if account := get("WHISPER_ACCOUNT"); account != "" {
+		cfg.useAccount(account)
+	}
+
+	if level := get("WHISPER_LOG_LEVEL"); level != "" {
+		cfg.LogLevel = level
+	}
+
+	if archivers := get("WHISPER_CONF_ARCHIVERS"); archivers != "" {
+		n, _ := strconv.Atoi(archivers)
+		cfg.ConferenceArchivers = n
+	}
+
+	if max := get("WHISPER_CONF_MAX_PARTICIPANTS"); max != "" {
+		n, _ := strconv.Atoi(max)
+		cfg.ConferenceMaxParticipants = n
+	}
+
+	if days := get("WHISPER_CONF_COMPACT_DAYS"); days != "" {
+		n, _ := strconv.Atoi(days)
+		cfg.ConferenceCompactDays = n
+	}
+
+	if policy := get("WHISPER_CONF_COMPACT_POLICY"); policy != "" {
+		cfg.ConferenceCompactPolicy = policy
+	}
+
+	if share := get("WHISPER_SHARE_IDENTITY"); share != "" {
+		if v, err := strconv.ParseBool(share); err == nil {
+			cfg.ShareIdentity = v
+		}
+	}
+
+	if interval := get("WHISPER_BACKUP_INTERVAL_HOURS"); interval != "" {
+		n, _ := strconv.Atoi(interval)
+		cfg.BackupIntervalHours = n
+	}
+
+	if retain := get("WHISPER_BACKUP_RETAIN"); retain != "" {
+		n, _ := strconv.Atoi(retain)
+		cfg.BackupRetain = n
+	}
+
+	if path := get("WHISPER_BACKUP_PASSPHRASE_FILE"); path != "" {
+		cfg.BackupPassphraseFile = path
+	}
+
+	if path := get("WHISPER_IDENTITY_PASSPHRASE_FILE"); path != "" {
+		cfg.IdentityPassphraseFile = path
+	}
+
+	if mb := get("WHISPER_QUOTA_MESSAGES_MB"); mb != "" {
+		n, _ := strconv.Atoi(mb)
+		cfg.QuotaMessagesMB = n
+	}
+
+	if mb := get("WHISPER_QUOTA_CONFERENCES_MB"); mb != "" {
+		n, _ := strconv.Atoi(mb)
+		cfg.QuotaConferencesMB = n
+	}
+
+	if mb := get("WHISPER_QUOTA_BACKUPS_MB"); mb != "" {
+		n, _ := strconv.Atoi(mb)
+		cfg.QuotaBackupsMB = n
+	}
+
+	if policy := get("WHISPER_QUOTA_HISTORY_POLICY"); policy != "" {
+		cfg.QuotaHistoryPolicy = policy
+	}
+
+	if policy := get("WHISPER_QUOTA_BACKUPS_POLICY"); policy != "" {
+		cfg.QuotaBackupsPolicy = policy
+	}
+
+	if ms := get("WHISPER_SLOW_QUERY_MS"); ms != "" {
+		n, _ := strconv.Atoi(ms)
+		cfg.SlowQueryMs = n
+	}
+
+	if minutes := get("WHISPER_WATCHDOG_NO_PEERS_MINUTES"); minutes != "" {
+		n, _ := strconv.Atoi(minutes)
+		cfg.WatchdogNoPeersMinutes = n
+	}
+
+	if failures := get("WHISPER_WATCHDOG_MAX_DIAL_FAILURES"); failures != "" {
+		n, _ := strconv.Atoi(failures)
+		cfg.WatchdogMaxDialFailures = n
+	}
+
+	if keepalive := get("WHISPER_KEEPALIVE_SECONDS"); keepalive != "" {
+		n, _ := strconv.Atoi(keepalive)
+		cfg.KeepaliveSeconds = n
+	}
+
+	if timeout := get("WHISPER_KEEPALIVE_TIMEOUT_SECONDS"); timeout != "" {
+		n, _ := strconv.Atoi(timeout)
+		cfg.KeepaliveTimeoutSeconds = n
+	}
+
+	if mode := get("WHISPER_AUTODIAL_MODE"); mode != "" {
+		cfg.AutoDialMode = mode
+	}
+
+	if locale := get("WHISPER_LOCALE"); locale != "" {
+		cfg.Locale = locale
+	}
+
+	if mode := get("WHISPER_ASCII"); mode != "" {
+		cfg.ASCIIMode = mode
+	}
+
+	if socket := get("WHISPER_CONTROL_SOCKET"); socket != "" {
+		cfg.ControlSocket = socket
+	}
+
+	if addr := get("WHISPER_DIAGNOSTICS_ADDR"); addr != "" {
+		cfg.DiagnosticsAddr = addr
+	}
+
+	if mode := get("WHISPER_DHT_MODE"); mode != "" {
+		cfg.DHTMode = mode
+	}
+
+	if memory := get("WHISPER_MAX_MEMORY_MB"); memory != "" {
+		n, _ := strconv.Atoi(memory)
+		cfg.MaxMemoryMB = n
+	}
+
+	if streams := get("WHISPER_MAX_STREAMS_PER_PEER"); streams != "" {
+		n, _ := strconv.Atoi(streams)
+		cfg.MaxStreamsPerPeerProtocol = n
+	}
+
+	if guest := get("WHISPER_GUEST"); guest != "" {
+		if v, err := strconv.ParseBool(guest); err == nil {
+			cfg.Guest = v
+		}
+	}
+
+	if lock := get("WHISPER_AUTO_LOCK_MINUTES"); lock != "" {
+		n, _ := strconv.Atoi(lock)
+		cfg.AutoLockMinutes = n
+	}
+
+	if ttl := get("WHISPER_MESSAGE_TTL_HOURS"); ttl != "" {
+		n, _ := strconv.Atoi(ttl)
+		cfg.MessageTTLHours = n
+	}
+
+	if relays := get("WHISPER_RELAYS"); relays != "" {
+		for _, relay := range strings.Split(relays, ",") {
+			if relay = strings.TrimSpace(relay); relay != "" {
+				cfg.Relays = append(cfg.Relays, relay)
+			}
+		}
+	}
+
+	if service := get("WHISPER_RELAY_SERVICE"); service != "" {
+		if v, err := strconv.ParseBool(service); err == nil {
+			cfg.RelayService = v
+		}
+	}
+
+	if directories := get("WHISPER_DIRECTORIES"); directories != "" {
+		for _, directory := range strings.Split(directories, ",") {
+			if directory = strings.TrimSpace(directory); directory != "" {
+				cfg.Directories = append(cfg.Directories, directory)
+			}
+		}
+	}
+
+	if service := get("WHISPER_DIRECTORY_SERVICE"); service != "" {
+		if v, err := strconv.ParseBool(service); err == nil {
+			cfg.DirectoryService = v
+		}
+	}
+
+	if addr := get("WHISPER_DIRECTORY_HTTP_ADDR"); addr != "" {
+		cfg.DirectoryHTTPAddr = addr
+	}
+
+	if relay := get("WHISPER_PUSH_RELAY"); relay != "" {
+		cfg.PushRelay = relay
+	}
+
+	if provider := get("WHISPER_PUSH_PROVIDER"); provider != "" {
+		cfg.PushProvider = provider
+	}
+
+	if target := get("WHISPER_PUSH_TARGET"); target != "" {
+		cfg.PushTarget = target
+	}
+
+	if mailbox := get("WHISPER_MAILBOX"); mailbox != "" {
+		cfg.Mailbox = mailbox
+	}
+
+	if check := get("WHISPER_UPDATE_CHECK"); check != "" {
+		cfg.UpdateCheck = check
+	}
+
+	if feed := get("WHISPER_UPDATE_FEED"); feed != "" {
+		cfg.UpdateFeed = feed
+	}
+
+	if key := get("WHISPER_UPDATE_KEY"); key != "" {
+		cfg.UpdateKey = key
+	}
+
 	// Create data directory if not exists
 	os.MkdirAll(expandPath(cfg.DataDir), 0700)
 
-	return cfg, nil
+	return cfg
 }
 
 func expandPath(path string) string {
 	// Expand ~ to home directory
-	if path[:2] == "~/" {
+	if strings.HasPrefix(path, "~/") {
 		home, _ := os.UserHomeDir()
 		return home + path[1:]
 	}
@@ -0,0 +1,254 @@
+package config
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultConfigFile is the config file read when WHISPER_CONFIG isn't set
+const DefaultConfigFile = ".env"
+
+// ErrNotReloadable is returned for a config file change that only takes
+// effect when the node starts
+var ErrNotReloadable = errors.New("can't change while the node is running - restart to apply it")
+
+// reloadable are the variables a running node applies when the config file
+// changes, with a check for their values where the config package can vet
+// them. Everything else is read once at startup.
+var reloadable = map[string]func(string) error{
+	"WHISPER_SLOW_QUERY_MS":         checkCount,
+	"WHISPER_MESSAGE_TTL_HOURS":     checkCount,
+	"WHISPER_CONF_MAX_PARTICIPANTS": checkCount,
+	"WHISPER_CONF_COMPACT_DAYS":     checkCount,
+	"WHISPER_CONF_COMPACT_POLICY":   nil,
+	"WHISPER_AUTODIAL_MODE":         nil,
+	"WHISPER_DHT_MODE":              nil,
+	"WHISPER_LOCALE":                nil,
+	"WHISPER_ASCII":                 nil,
+	"WHISPER_PUSH_RELAY":            nil,
+	"WHISPER_PUSH_PROVIDER":         nil,
+	"WHISPER_PUSH_TARGET":           nil,
+	"WHISPER_MAILBOX":               nil,
+	"WHISPER_RELAYS":                nil,
+	"WHISPER_DIRECTORIES":           nil,
+	"WHISPER_UPDATE_CHECK":          nil,
+	"WHISPER_UPDATE_FEED":           nil,
+	"WHISPER_UPDATE_KEY":            nil,
+}
+
+// ConfigReloaded is emitted when the config file changed: Changed names the
+// variables whose new values are now in Config, and Rejected explains each
+// change that was not applied
+type ConfigReloaded struct {
+	Previous *Config
+	Config   *Config
+	Changed  []string
+	Rejected []error
+}
+
+// checkCount accepts an empty value or a whole number of zero or more
+func checkCount(value string) error {
+	if value == "" {
+		return nil
+	}
+	if n, err := strconv.Atoi(value); err != nil || n < 0 {
+		return fmt.Errorf("%q is not a whole number", value)
+	}
+	return nil
+}
+
+// Reload reads the config file again and returns the configuration it gives,
+// keeping the running value of every variable that can't change at runtime
+// or whose new value is invalid
+func Reload(current *Config) (*ConfigReloaded, error) {
+	file, err := readFile(current.File)
+	if err != nil {
+		return nil, err
+	}
+	values := merge(file)
+
+	event := &ConfigReloaded{Previous: current}
+	for _, key := range changedKeys(current.values, values) {
+		check, ok := reloadable[key]
+		switch {
+		case !ok:
+			err = ErrNotReloadable
+		case check != nil:
+			err = check(values[key])
+		default:
+			err = nil
+		}
+		if err != nil {
+			event.Rejected = append(event.Rejected, fmt.Errorf("%s: %w", key, err))
+			if value, ok := current.values[key]; ok {
+				values[key] = value
+			} else {
+				delete(values, key)
+			}
+			continue
+		}
+		event.Changed = append(event.Changed, key)
+	}
+	event.Config = fromValues(current.File, values)
+	return event, nil
+}
+
+// changedKeys returns the variables set differently in two sets, sorted
+func changedKeys(old, new map[string]string) []string {
+	keys := []string{}
+	for key, value := range new {
+		if old[key] != value {
+			keys = append(keys, key)
+		}
+	}
+	for key := range old {
+		if _, ok := new[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// merge returns the WHISPER_* variables in effect: those set in the
+// environment, then those from the config file
+func merge(file map[string]string) map[string]string {
+	values := make(map[string]string)
+	for key, value := range file {
+		if strings.HasPrefix(key, "WHISPER_") && value != "" {
+			values[key] = value
+		}
+	}
+	for _, entry := range os.Environ() {
+		key, value, _ := strings.Cut(entry, "=")
+		if strings.HasPrefix(key, "WHISPER_") && value != "" {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// readFile reads KEY=VALUE lines from a config file in .env format. Blank
+// lines and # comments are skipped, an export prefix and quotes around
+// values are allowed, and a file that doesn't exist reads as empty.
+func readFile(path string) (map[string]string, error) {
+	values := make(map[string]string)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	return values, nil
+}
+
+// Watcher reloads the config file whenever it changes
+type Watcher struct {
+	path string
+
+	mu            sync.Mutex
+	current       *Config
+	modified      time.Time // Modification time of the file last read
+	size          int64
+	reloadHandler func(event *ConfigReloaded)
+}
+
+// NewWatcher creates a watcher for the file cfg was loaded from
+func NewWatcher(cfg *Config) *Watcher {
+	w := &Watcher{path: cfg.File, current: cfg}
+	w.modified, w.size = stat(w.path)
+	return w
+}
+
+// SetReloadHandler sets the handler called with every reload that changed a variable
+func (w *Watcher) SetReloadHandler(handler func(event *ConfigReloaded)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.reloadHandler = handler
+}
+
+// Run checks the file every interval and reloads it when it was modified,
+// until ctx is done
+func (w *Watcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		w.mu.Lock()
+		modified, size := stat(w.path)
+		unchanged := modified.Equal(w.modified) && size == w.size
+		w.mu.Unlock()
+		if unchanged {
+			continue
+		}
+		if _, err := w.Reload(); err != nil {
+			fmt.Printf("Warning: Failed to reload %s: %v\n", w.path, err)
+		}
+	}
+}
+
+// Reload reads the file now, makes the result current and runs the reload
+// handler if any variable changed
+func (w *Watcher) Reload() (*ConfigReloaded, error) {
+	w.mu.Lock()
+	w.modified, w.size = stat(w.path)
+	event, err := Reload(w.current)
+	if err != nil {
+		w.mu.Unlock()
+		return nil, err
+	}
+	w.current = event.Config
+	handler := w.reloadHandler
+	w.mu.Unlock()
+
+	if handler != nil && (len(event.Changed) > 0 || len(event.Rejected) > 0) {
+		handler(event)
+	}
+	return event, nil
+}
+
+// stat returns a file's modification time and size, or zeroes if it doesn't exist
+func stat(path string) (time.Time, int64) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, 0
+	}
+	return info.ModTime(), info.Size()
+}
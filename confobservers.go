@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+)
+
+// runConfDemote makes a conference member an observer, who can read but not post
+func (a *App) runConfDemote(ctx context.Context, currentUser *storage.User, args []string) {
+	if len(args) != 2 {
+		i18n.Println("Usage: conf-demote <conf-id> <username>")
+		return
+	}
+	var confID int64
+	if _, err := fmt.Sscanf(args[0], "%d", &confID); err != nil {
+		i18n.Println("Usage: conf-demote <conf-id> <username>")
+		return
+	}
+
+	if err := a.conferenceManager.Demote(ctx, currentUser, confID, args[1]); err != nil {
+		i18n.Printf("Failed to demote member: %v\n", err)
+		return
+	}
+	i18n.Printf("✓ %s is now an observer: they can read the conference but not post\n", args[1])
+}
+
+// runConfPromote lets an observer post in a conference again
+func (a *App) runConfPromote(ctx context.Context, currentUser *storage.User, args []string) {
+	if len(args) != 2 {
+		i18n.Println("Usage: conf-promote <conf-id> <username>")
+		return
+	}
+	var confID int64
+	if _, err := fmt.Sscanf(args[0], "%d", &confID); err != nil {
+		i18n.Println("Usage: conf-promote <conf-id> <username>")
+		return
+	}
+
+	if err := a.conferenceManager.Promote(ctx, currentUser, confID, args[1]); err != nil {
+		i18n.Printf("Failed to promote member: %v\n", err)
+		return
+	}
+	i18n.Printf("✓ %s can post again\n", args[1])
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/austinwklein/whisper/conformance"
+	"github.com/austinwklein/whisper/i18n"
+)
+
+// runConformanceCommand handles `whisper conformance`, which checks this
+// build's wire decoders against the published test vectors, or against a
+// vectors file given with --vectors
+func runConformanceCommand(args []string) error {
+	fs := flag.NewFlagSet("conformance", flag.ContinueOnError)
+	vectorsPath := fs.String("vectors", "", "vectors file to check (defaults to the published vectors)")
+	verbose := fs.Bool("v", false, "list every vector, not just failures")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("usage: whisper conformance [--vectors <file>] [-v]")
+	}
+
+	set, err := conformance.Vectors()
+	if *vectorsPath != "" {
+		data, readErr := os.ReadFile(*vectorsPath)
+		if readErr != nil {
+			return fmt.Errorf("failed to read vectors: %w", readErr)
+		}
+		set, err = conformance.Load(data)
+	}
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, result := range conformance.Run(set) {
+		if result.Err != nil {
+			failed++
+			i18n.Printf("FAIL %s: %v\n", result.Vector.Name, result.Err)
+		} else if *verbose {
+			i18n.Printf("ok   %s\n", result.Vector.Name)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d vectors failed", failed, len(set.Vectors))
+	}
+	i18n.Printf("✓ All %d vectors passed\n", len(set.Vectors))
+	return nil
+}
@@ -0,0 +1,382 @@
+// Package conformance publishes whisper's wire protocol test vectors and checks
+// an implementation of the protocol against them.
+//
+// vectors.json holds one vector per message example. Each carries the exact
+// bytes sent on the stream (one newline-terminated JSON line, or one
+// length-prefixed protobuf message written as hex), whether a receiver must
+// accept them, and, for accepted ones, the message a decoder has to produce.
+// Other clients can load the file directly; Run checks this module's decoders
+// and encoders against it.
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/austinwklein/whisper/conference"
+	"github.com/austinwklein/whisper/friends"
+	"github.com/austinwklein/whisper/messages"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/pb"
+	"github.com/austinwklein/whisper/rendezvous"
+	"github.com/austinwklein/whisper/search"
+	"google.golang.org/protobuf/proto"
+)
+
+// VectorsVersion is the version of the vector file format. Version 2 added
+// protobuf vectors; version 1 files are still read.
+const VectorsVersion = 2
+
+// Wire encodings of a vector
+const (
+	EncodingJSON     = "json"     // Newline-delimited JSON, protocol version 1.0.0
+	EncodingProtobuf = "protobuf" // Length-prefixed protobuf, protocol version 2.0.0
+)
+
+//go:embed vectors.json
+var vectorsJSON []byte
+
+// Conformance errors
+var (
+	ErrUnknownMessage  = errors.New("unknown message type")
+	ErrNotRejected     = errors.New("invalid message was accepted")
+	ErrUnknownEncoding = errors.New("unknown encoding")
+)
+
+// VectorSet is the contents of a vectors file
+type VectorSet struct {
+	Version int       `json:"version"`
+	Vectors []*Vector `json:"vectors"`
+}
+
+// Vector is one wire message example
+type Vector struct {
+	Name     string          `json:"name"`
+	Protocol string          `json:"protocol"`           // Stream protocol or pubsub topic the message travels on
+	Message  string          `json:"message"`            // Message type, e.g. DirectMessage
+	Encoding string          `json:"encoding,omitempty"` // json (default) or protobuf
+	Wire     string          `json:"wire"`               // Exact bytes on the wire; hex for protobuf
+	Valid    bool            `json:"valid"`              // Whether a receiver must accept the message
+	Decoded  json.RawMessage `json:"decoded,omitempty"`
+	Error    string          `json:"error,omitempty"` // Part of whisper's rejection error; other implementations only need to reject
+	Note     string          `json:"note,omitempty"`
+}
+
+// Result is the outcome of checking one vector
+type Result struct {
+	Vector *Vector
+	Err    error // nil if the implementation conforms
+}
+
+// decoders parse and validate each message type the way a receiving node does.
+// Search and rendezvous messages have no validation beyond their JSON shape.
+var decoders = map[string]func(data []byte) (interface{}, error){
+	"DirectMessage":           func(data []byte) (interface{}, error) { return messages.DecodeDirectMessage(data) },
+	"MessageAck":              func(data []byte) (interface{}, error) { return messages.DecodeMessageAck(data) },
+	"MessageRead":             func(data []byte) (interface{}, error) { return messages.DecodeMessageRead(data) },
+	"MessageReadBatch":        func(data []byte) (interface{}, error) { return messages.DecodeMessageReadBatch(data) },
+	"BackfillRequest":         func(data []byte) (interface{}, error) { return messages.DecodeBackfillRequest(data) },
+	"FriendRequestMessage":    func(data []byte) (interface{}, error) { return friends.DecodeFriendRequest(data) },
+	"FriendResponseMessage":   func(data []byte) (interface{}, error) { return friends.DecodeFriendResponse(data) },
+	"ConferenceInvite":        func(data []byte) (interface{}, error) { return conference.DecodeConferenceInvite(data) },
+	"ConferenceGossipMessage": func(data []byte) (interface{}, error) { return conference.DecodeGossipMessage(data) },
+	"MembershipState":         func(data []byte) (interface{}, error) { return conference.DecodeMembershipState(data) },
+	"PresenceBeacon":          func(data []byte) (interface{}, error) { return conference.DecodePresenceBeacon(data) },
+	"HistoryRequest":          func(data []byte) (interface{}, error) { return conference.DecodeHistoryRequest(data) },
+	"AdmissionRequest":        func(data []byte) (interface{}, error) { return conference.DecodeAdmissionRequest(data) },
+	"AdmissionResponse":       func(data []byte) (interface{}, error) { return conference.DecodeAdmissionResponse(data) },
+	"IdentifyPayload":         func(data []byte) (interface{}, error) { return p2p.DecodeIdentifyPayload(data) },
+	"SearchRequest":           func(data []byte) (interface{}, error) { return decodeJSON(data, &search.SearchRequest{}) },
+	"SearchResponse":          func(data []byte) (interface{}, error) { return decodeJSON(data, &search.SearchResponse{}) },
+	"RegisterRequest":         func(data []byte) (interface{}, error) { return decodeJSON(data, &rendezvous.RegisterRequest{}) },
+	"RegisterResponse":        func(data []byte) (interface{}, error) { return decodeJSON(data, &rendezvous.RegisterResponse{}) },
+	"LookupRequest":           func(data []byte) (interface{}, error) { return decodeJSON(data, &rendezvous.LookupRequest{}) },
+	"LookupResponse":          func(data []byte) (interface{}, error) { return decodeJSON(data, &rendezvous.LookupResponse{}) },
+}
+
+// protoDecoder reads one message type from a protobuf stream
+type protoDecoder struct {
+	message func() proto.Message // An empty message of the type to unmarshal into
+	decode  func(m proto.Message) (interface{}, error)
+}
+
+// protoDecoders covers the messages of the protocols that have a protobuf version
+var protoDecoders = map[string]protoDecoder{
+	"DirectMessage": {
+		func() proto.Message { return &pb.DirectMessage{} },
+		func(m proto.Message) (interface{}, error) {
+			return messages.DecodeDirectMessageProto(m.(*pb.DirectMessage))
+		},
+	},
+	"MessageAck": {
+		func() proto.Message { return &pb.MessageAck{} },
+		func(m proto.Message) (interface{}, error) { return messages.DecodeMessageAckProto(m.(*pb.MessageAck)) },
+	},
+	"MessageRead": {
+		func() proto.Message { return &pb.MessageRead{} },
+		func(m proto.Message) (interface{}, error) {
+			return messages.DecodeMessageReadProto(m.(*pb.MessageRead))
+		},
+	},
+	"MessageReadBatch": {
+		func() proto.Message { return &pb.MessageReadBatch{} },
+		func(m proto.Message) (interface{}, error) {
+			return messages.DecodeMessageReadBatchProto(m.(*pb.MessageReadBatch))
+		},
+	},
+	"BackfillRequest": {
+		func() proto.Message { return &pb.BackfillRequest{} },
+		func(m proto.Message) (interface{}, error) {
+			return messages.DecodeBackfillRequestProto(m.(*pb.BackfillRequest))
+		},
+	},
+	"FriendRequestMessage": {
+		func() proto.Message { return &pb.FriendRequest{} },
+		func(m proto.Message) (interface{}, error) {
+			return friends.DecodeFriendRequestProto(m.(*pb.FriendRequest))
+		},
+	},
+	"FriendResponseMessage": {
+		func() proto.Message { return &pb.FriendResponse{} },
+		func(m proto.Message) (interface{}, error) {
+			return friends.DecodeFriendResponseProto(m.(*pb.FriendResponse))
+		},
+	},
+	"ConferenceInvite": {
+		func() proto.Message { return &pb.ConferenceInvite{} },
+		func(m proto.Message) (interface{}, error) {
+			return conference.DecodeConferenceInviteProto(m.(*pb.ConferenceInvite))
+		},
+	},
+	"ConferenceGossipMessage": {
+		func() proto.Message { return &pb.ConferenceMessage{} },
+		func(m proto.Message) (interface{}, error) {
+			return conference.DecodeGossipMessageProto(m.(*pb.ConferenceMessage))
+		},
+	},
+	"MembershipState": {
+		func() proto.Message { return &pb.MembershipState{} },
+		func(m proto.Message) (interface{}, error) {
+			return conference.DecodeMembershipStateProto(m.(*pb.MembershipState))
+		},
+	},
+	"PresenceBeacon": {
+		func() proto.Message { return &pb.PresenceBeacon{} },
+		func(m proto.Message) (interface{}, error) {
+			return conference.DecodePresenceBeaconProto(m.(*pb.PresenceBeacon))
+		},
+	},
+	"HistoryRequest": {
+		func() proto.Message { return &pb.HistoryRequest{} },
+		func(m proto.Message) (interface{}, error) {
+			return conference.DecodeHistoryRequestProto(m.(*pb.HistoryRequest))
+		},
+	},
+	"AdmissionRequest": {
+		func() proto.Message { return &pb.AdmissionRequest{} },
+		func(m proto.Message) (interface{}, error) {
+			return conference.DecodeAdmissionRequestProto(m.(*pb.AdmissionRequest))
+		},
+	},
+	"AdmissionResponse": {
+		func() proto.Message { return &pb.AdmissionResponse{} },
+		func(m proto.Message) (interface{}, error) {
+			return conference.DecodeAdmissionResponseProto(m.(*pb.AdmissionResponse))
+		},
+	},
+	"IdentifyPayload": {
+		func() proto.Message { return &pb.IdentifyPayload{} },
+		func(m proto.Message) (interface{}, error) {
+			return p2p.DecodeIdentifyPayloadProto(m.(*pb.IdentifyPayload))
+		},
+	},
+}
+
+// decodeJSON unmarshals a message that has no dedicated decoder
+func decodeJSON(data []byte, v interface{}) (interface{}, error) {
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Vectors returns the vectors published with this version of whisper
+func Vectors() (*VectorSet, error) {
+	return Load(vectorsJSON)
+}
+
+// VectorsFile returns the raw contents of the published vectors file
+func VectorsFile() []byte {
+	return vectorsJSON
+}
+
+// Load parses a vectors file
+func Load(data []byte) (*VectorSet, error) {
+	var set VectorSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse vectors: %w", err)
+	}
+	if set.Version < 1 || set.Version > VectorsVersion {
+		return nil, fmt.Errorf("unsupported vectors version %d", set.Version)
+	}
+	return &set, nil
+}
+
+// Run checks every vector in set and returns one result per vector
+func Run(set *VectorSet) []Result {
+	results := make([]Result, 0, len(set.Vectors))
+	for _, v := range set.Vectors {
+		results = append(results, Result{Vector: v, Err: Check(v)})
+	}
+	return results
+}
+
+// Decode reads wire bytes of the given message type as a receiving node
+// does: one line of at most p2p.MaxWireMessageSize bytes, parsed and validated
+func Decode(messageType, wire string) (interface{}, error) {
+	decode, ok := decoders[messageType]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownMessage, messageType)
+	}
+	data, err := p2p.ReadWireMessage(bufio.NewReader(strings.NewReader(wire)))
+	if err != nil {
+		return nil, err
+	}
+	return decode(data)
+}
+
+// DecodeProtobuf reads protobuf wire bytes of the given message type as a
+// receiving node does: one length-prefixed message of at most
+// p2p.MaxWireMessageSize bytes, unmarshaled and validated
+func DecodeProtobuf(messageType string, wire []byte) (interface{}, error) {
+	decoder, ok := protoDecoders[messageType]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownMessage, messageType)
+	}
+	m := decoder.message()
+	if err := p2p.ReadProtoMessage(bufio.NewReader(bytes.NewReader(wire)), m); err != nil {
+		return nil, err
+	}
+	return decoder.decode(m)
+}
+
+// EncodeProtobuf writes a decoded message as length-prefixed protobuf
+func EncodeProtobuf(message interface{}) ([]byte, error) {
+	wm, ok := message.(p2p.WireMessage)
+	if !ok {
+		return nil, fmt.Errorf("%T has no protobuf form", message)
+	}
+	var buf bytes.Buffer
+	if err := p2p.WriteProtoMessage(&buf, wm.Proto()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// codec decodes and encodes the wire bytes of one vector encoding
+type codec struct {
+	decode func(messageType string, wire []byte) (interface{}, error)
+	encode func(message interface{}) ([]byte, error)
+}
+
+var codecs = map[string]codec{
+	EncodingJSON: {
+		decode: func(messageType string, wire []byte) (interface{}, error) { return Decode(messageType, string(wire)) },
+		encode: func(message interface{}) ([]byte, error) {
+			data, err := json.Marshal(message)
+			return append(data, '\n'), err
+		},
+	},
+	EncodingProtobuf: {decode: DecodeProtobuf, encode: EncodeProtobuf},
+}
+
+// wireBytes returns the bytes a vector puts on the wire
+func (v *Vector) wireBytes() ([]byte, error) {
+	if v.Encoding == EncodingProtobuf {
+		return hex.DecodeString(v.Wire)
+	}
+	return []byte(v.Wire), nil
+}
+
+// Check reads a vector's wire bytes as a node would and verifies the outcome.
+// A valid vector must decode to its decoded message, and encoding that message
+// again must decode to the same thing; an invalid one must be rejected.
+func Check(v *Vector) error {
+	encoding := v.Encoding
+	if encoding == "" {
+		encoding = EncodingJSON
+	}
+	c, ok := codecs[encoding]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownEncoding, v.Encoding)
+	}
+	wire, err := v.wireBytes()
+	if err != nil {
+		return fmt.Errorf("invalid wire: %w", err)
+	}
+
+	message, err := c.decode(v.Message, wire)
+	if errors.Is(err, ErrUnknownMessage) {
+		return err
+	}
+	if err == nil {
+		if !v.Valid {
+			return ErrNotRejected
+		}
+		return checkDecoded(v, c, message)
+	}
+
+	if v.Valid {
+		return fmt.Errorf("valid message was rejected: %w", err)
+	}
+	if v.Error != "" && !strings.Contains(err.Error(), v.Error) {
+		return fmt.Errorf("rejected with %q, want an error containing %q", err, v.Error)
+	}
+	return nil
+}
+
+// checkDecoded compares a decoded message with the vector's expectation and
+// round-trips it through the encoder
+func checkDecoded(v *Vector, c codec, message interface{}) error {
+	decoded, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to encode decoded message: %w", err)
+	}
+	if !sameJSON(decoded, v.Decoded) {
+		return fmt.Errorf("decoded to %s, want %s", decoded, v.Decoded)
+	}
+
+	wire, err := c.encode(message)
+	if err != nil {
+		return fmt.Errorf("failed to encode decoded message: %w", err)
+	}
+	again, err := c.decode(v.Message, wire)
+	if err != nil {
+		return fmt.Errorf("re-encoded message was rejected: %w", err)
+	}
+	redecoded, err := json.Marshal(again)
+	if err != nil {
+		return fmt.Errorf("failed to encode decoded message: %w", err)
+	}
+	if !sameJSON(redecoded, decoded) {
+		return fmt.Errorf("round trip changed the message to %s", redecoded)
+	}
+	return nil
+}
+
+// sameJSON reports whether two JSON documents hold the same values, ignoring
+// field order and formatting
+func sameJSON(a, b []byte) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
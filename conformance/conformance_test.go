@@ -0,0 +1,101 @@
+package conformance
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// TestVectors checks every published vector against this module's decoders
+// and encoders, as `whisper conformance` does
+func TestVectors(t *testing.T) {
+	set, err := Vectors()
+	if err != nil {
+		t.Fatalf("failed to load vectors: %v", err)
+	}
+	if set.Version != VectorsVersion {
+		t.Errorf("vectors.json is version %d, want %d", set.Version, VectorsVersion)
+	}
+	for _, v := range set.Vectors {
+		t.Run(v.Name, func(t *testing.T) {
+			if v.Valid && len(v.Decoded) == 0 {
+				t.Fatal("valid vector has no decoded message")
+			}
+			if err := Check(v); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestVectorsCoverEveryMessage fails when a message type a node decodes has
+// no vector, so new messages get published examples
+func TestVectorsCoverEveryMessage(t *testing.T) {
+	set, err := Vectors()
+	if err != nil {
+		t.Fatalf("failed to load vectors: %v", err)
+	}
+	covered := make(map[string]map[string]bool)
+	for _, v := range set.Vectors {
+		encoding := v.Encoding
+		if encoding == "" {
+			encoding = EncodingJSON
+		}
+		if covered[encoding] == nil {
+			covered[encoding] = make(map[string]bool)
+		}
+		covered[encoding][v.Message] = true
+	}
+	for messageType := range decoders {
+		if !covered[EncodingJSON][messageType] {
+			t.Errorf("no JSON vector for %s", messageType)
+		}
+	}
+	for messageType := range protoDecoders {
+		if !covered[EncodingProtobuf][messageType] {
+			t.Errorf("no protobuf vector for %s", messageType)
+		}
+	}
+}
+
+// TestCheckFailsNonconformingVectors makes sure Check would notice a decoder
+// that drifted from the vectors
+func TestCheckFailsNonconformingVectors(t *testing.T) {
+	set, err := Vectors()
+	if err != nil {
+		t.Fatalf("failed to load vectors: %v", err)
+	}
+	var valid, invalid *Vector
+	for _, v := range set.Vectors {
+		switch {
+		case v.Valid && valid == nil:
+			valid = v
+		case !v.Valid && invalid == nil:
+			invalid = v
+		}
+	}
+
+	wrong := *valid
+	wrong.Decoded = json.RawMessage(`{"unexpected":true}`)
+	if err := Check(&wrong); err == nil {
+		t.Errorf("%s: a wrong decoded message passed", valid.Name)
+	}
+
+	accepted := *invalid
+	accepted.Valid = true
+	if err := Check(&accepted); err == nil {
+		t.Errorf("%s: a rejected message passed as valid", invalid.Name)
+	}
+
+	rejected := *valid
+	rejected.Valid = false
+	if err := Check(&rejected); !errors.Is(err, ErrNotRejected) {
+		t.Errorf("%s: Check = %v, want ErrNotRejected", valid.Name, err)
+	}
+
+	unknown := *valid
+	unknown.Message = "NoSuchMessage"
+	if err := Check(&unknown); !errors.Is(err, ErrUnknownMessage) {
+		t.Errorf("Check of an unknown message = %v, want ErrUnknownMessage", err)
+	}
+}
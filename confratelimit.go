@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+)
+
+// runConfRateLimit shows or changes how many messages each member may post
+// per window in a conference
+func (a *App) runConfRateLimit(ctx context.Context, currentUser *storage.User, args []string) {
+	const usage = "Usage: conf-ratelimit <conf-id> [<messages>/<window> | off], e.g. 5/10s"
+	if len(args) < 1 {
+		i18n.Println(usage)
+		return
+	}
+	var confID int64
+	if _, err := fmt.Sscanf(args[0], "%d", &confID); err != nil {
+		i18n.Println(usage)
+		return
+	}
+	if len(args) < 2 {
+		a.printRateLimit(ctx, confID)
+		return
+	}
+
+	messages, window := 0, time.Duration(0)
+	if args[1] != "off" {
+		count, span, ok := strings.Cut(args[1], "/")
+		if !ok {
+			i18n.Println(usage)
+			return
+		}
+		var err error
+		if _, err = fmt.Sscanf(count, "%d", &messages); err == nil {
+			window, err = time.ParseDuration(span)
+		}
+		if err != nil || messages <= 0 {
+			i18n.Println(usage)
+			return
+		}
+	}
+
+	if err := a.conferenceManager.SetRateLimit(ctx, currentUser, confID, messages, window); err != nil {
+		i18n.Printf("Failed to set rate limit: %v\n", err)
+		return
+	}
+	if messages == 0 {
+		i18n.Println("✓ Members can post as fast as they like")
+	} else {
+		i18n.Printf("✓ Each member can post %d messages per %s\n", messages, window.Truncate(time.Second))
+	}
+}
+
+// runConfSlowMode turns slow mode on, for a while or until turned off, or off
+func (a *App) runConfSlowMode(ctx context.Context, currentUser *storage.User, args []string) {
+	const usage = "Usage: conf-slowmode <conf-id> <gap> [duration] | conf-slowmode <conf-id> off, e.g. 30s 10m"
+	if len(args) < 2 {
+		i18n.Println(usage)
+		return
+	}
+	var confID int64
+	if _, err := fmt.Sscanf(args[0], "%d", &confID); err != nil {
+		i18n.Println(usage)
+		return
+	}
+
+	var gap, duration time.Duration
+	if args[1] != "off" {
+		var err error
+		if gap, err = time.ParseDuration(args[1]); err == nil && len(args) > 2 {
+			duration, err = time.ParseDuration(args[2])
+		}
+		if err != nil || gap <= 0 {
+			i18n.Println(usage)
+			return
+		}
+	}
+
+	if err := a.conferenceManager.SetSlowMode(ctx, currentUser, confID, gap, duration); err != nil {
+		i18n.Printf("Failed to set slow mode: %v\n", err)
+		return
+	}
+	switch {
+	case gap == 0:
+		i18n.Println("✓ Slow mode is off")
+	case duration == 0:
+		i18n.Printf("✓ Slow mode on: one message every %s per member until turned off\n", gap.Truncate(time.Second))
+	default:
+		i18n.Printf("✓ Slow mode on: one message every %s per member for %s\n", gap.Truncate(time.Second), duration.Truncate(time.Second))
+	}
+}
+
+// printRateLimit shows a conference's posting limits
+func (a *App) printRateLimit(ctx context.Context, confID int64) {
+	limit, err := a.conferenceManager.GetRateLimit(ctx, confID)
+	if err != nil {
+		i18n.Printf("Failed to get rate limit: %v\n", err)
+		return
+	}
+
+	if limit == nil || limit.Messages == 0 {
+		i18n.Println("Rate limit: none")
+	} else {
+		i18n.Printf("Rate limit: %d messages per %s per member\n", limit.Messages, time.Duration(limit.WindowSeconds)*time.Second)
+	}
+	switch {
+	case limit == nil || !limit.SlowModeActive(time.Now()):
+		i18n.Println("Slow mode: off")
+	case limit.SlowModeUntil.IsZero():
+		i18n.Printf("Slow mode: one message every %s\n", time.Duration(limit.SlowModeSeconds)*time.Second)
+	default:
+		i18n.Printf("Slow mode: one message every %s until %s\n", time.Duration(limit.SlowModeSeconds)*time.Second, limit.SlowModeUntil.Format("15:04"))
+	}
+}
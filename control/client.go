@@ -0,0 +1,170 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// requestTimeout bounds each control request; sending may wait for a dial
+const requestTimeout = 60 * time.Second
+
+// Client talks to a daemon's control API
+type Client struct {
+	http  *http.Client
+	token string
+}
+
+// Dial connects to the daemon serving the socket at socketPath, reading its
+// token. It fails with ErrNotRunning if no daemon has written one.
+func Dial(socketPath string) (*Client, error) {
+	data, err := os.ReadFile(TokenPath(socketPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotRunning
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read control token: %w", err)
+	}
+
+	var dialer net.Dialer
+	return &Client{
+		http: &http.Client{
+			Timeout: requestTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+		token: strings.TrimSpace(string(data)),
+	}, nil
+}
+
+// Status returns the daemon's status
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	var status Status
+	if err := c.do(ctx, http.MethodGet, "/v1/status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Peers returns the daemon's connected peers
+func (c *Client) Peers(ctx context.Context) ([]Peer, error) {
+	var peers []Peer
+	if err := c.do(ctx, http.MethodGet, "/v1/peers", nil, &peers); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// Friends returns the friends of the account the daemon is logged in to
+func (c *Client) Friends(ctx context.Context) ([]Friend, error) {
+	var friends []Friend
+	if err := c.do(ctx, http.MethodGet, "/v1/friends", nil, &friends); err != nil {
+		return nil, err
+	}
+	return friends, nil
+}
+
+// Send has the daemon send a direct message
+func (c *Client) Send(ctx context.Context, to, message string) error {
+	return c.do(ctx, http.MethodPost, "/v1/send", &SendRequest{To: to, Message: message}, nil)
+}
+
+// Health returns the daemon's health. A degraded daemon answers with its
+// Health rather than an error.
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	resp, err := c.send(ctx, http.MethodGet, "/healthz", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil, fmt.Errorf("daemon returned %s", resp.Status)
+	}
+
+	var health Health
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return nil, fmt.Errorf("invalid response from daemon: %w", err)
+	}
+	return &health, nil
+}
+
+// Shutdown asks the daemon to stop gracefully
+func (c *Client) Shutdown(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/v1/shutdown", nil, nil)
+}
+
+// Drain asks the daemon to drain and stop, returning once it is drained
+func (c *Client) Drain(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/v1/drain", nil, nil)
+}
+
+// do makes one request, sending body and decoding the response into out if
+// they are not nil
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	resp, err := c.send(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return ErrUnauthorized
+	case resp.StatusCode >= 300:
+		var failure errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&failure); err != nil || failure.Error == "" {
+			return fmt.Errorf("daemon returned %s", resp.Status)
+		}
+		return errors.New(failure.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response from daemon: %w", err)
+	}
+	return nil
+}
+
+// send makes one request with the token, sending body as JSON if it is not nil
+func (c *Client) send(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	// The host is ignored; the transport always dials the socket
+	req, err := http.NewRequestWithContext(ctx, method, "http://whisper"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return nil, ErrNotRunning
+		}
+		return nil, err
+	}
+	return resp, nil
+}
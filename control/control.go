@@ -0,0 +1,101 @@
+// Package control lets the whisper CLI administer a running daemon. The
+// daemon serves a small JSON API over HTTP on a Unix socket; every request
+// must carry the token the daemon writes next to the socket, which only the
+// daemon's user can read.
+package control
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotRunning is returned when no daemon is listening on the socket
+	ErrNotRunning = errors.New("no whisper daemon is running")
+
+	// ErrUnauthorized is returned when the daemon rejects the control token,
+	// usually because it restarted since the token was read
+	ErrUnauthorized = errors.New("control token rejected")
+
+	// ErrAlreadyRunning is returned when another daemon already serves the socket
+	ErrAlreadyRunning = errors.New("another whisper daemon is already running")
+)
+
+// Status describes a running daemon
+type Status struct {
+	PeerID    string    `json:"peer_id"`
+	Username  string    `json:"username,omitempty"` // Logged-in account, if any
+	Addrs     []string  `json:"addrs"`              // Shareable addresses, best first
+	Peers     int       `json:"peers"`              // Connected peers
+	DHTMode   string    `json:"dht_mode"`
+	StartedAt time.Time `json:"started_at"`
+	Draining  bool      `json:"draining,omitempty"` // Finishing deliveries before it exits
+}
+
+// Peer is one connected peer
+type Peer struct {
+	ID       string `json:"id"`
+	Username string `json:"username,omitempty"`
+	FullName string `json:"full_name,omitempty"`
+}
+
+// Friend is one of the logged-in account's friends
+type Friend struct {
+	Username string    `json:"username"`
+	FullName string    `json:"full_name"`
+	PeerID   string    `json:"peer_id"`
+	Online   bool      `json:"online"`
+	Away     bool      `json:"away,omitempty"` // Online but draining before a restart
+	Unread   int       `json:"unread"`
+	LastSeen time.Time `json:"last_seen,omitempty"`
+}
+
+// HealthCheck is the outcome of one health check
+type HealthCheck struct {
+	Name   string `json:"name"` // database, p2p, dht or disk
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// Health reports whether a node is working. It is degraded if any check
+// failed; queue depths are reported but never fail it.
+type Health struct {
+	Healthy   bool           `json:"healthy"`
+	Checks    []HealthCheck  `json:"checks"`
+	Queues    map[string]int `json:"queues"` // Items waiting, by queue
+	CheckedAt time.Time      `json:"checked_at"`
+}
+
+// SendRequest asks the daemon to send a direct message
+type SendRequest struct {
+	To      string `json:"to"`
+	Message string `json:"message"`
+}
+
+// errorResponse carries a failed request's error
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Backend is what the control API administers: the running node
+type Backend interface {
+	Status(ctx context.Context) (*Status, error)
+	Peers(ctx context.Context) ([]Peer, error)
+	Friends(ctx context.Context) ([]Friend, error)
+	Send(ctx context.Context, to, message string) error
+	Health(ctx context.Context) *Health
+
+	// Shutdown stops the node gracefully, as a stop signal would
+	Shutdown()
+
+	// Drain finishes in-flight deliveries without accepting new ones and
+	// tells peers the node is going away. The server calls Shutdown once it
+	// has answered.
+	Drain(ctx context.Context) error
+}
+
+// TokenPath is where the token for the socket at socketPath is kept
+func TokenPath(socketPath string) string {
+	return socketPath + ".token"
+}
@@ -0,0 +1,222 @@
+package control
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// shutdownTimeout bounds how long open requests may finish once the server stops
+const shutdownTimeout = 5 * time.Second
+
+// maxRequestSize caps request bodies; the largest is a direct message
+const maxRequestSize = 64 << 10
+
+// Server serves the control API for one daemon
+type Server struct {
+	socketPath string
+	token      string
+	backend    Backend
+}
+
+// NewServer creates a control server on the Unix socket at socketPath
+func NewServer(socketPath string, backend Backend) *Server {
+	return &Server{socketPath: socketPath, backend: backend}
+}
+
+// Handler returns the control endpoints. All but /healthz need the token,
+// so liveness probes can use it without one:
+//
+//	GET  /healthz       the node's Health; 200 if healthy, 503 if degraded
+//	GET  /v1/status     the daemon's Status
+//	GET  /v1/peers      connected Peers
+//	GET  /v1/friends    the logged-in account's Friends
+//	POST /v1/send       send a direct message (a SendRequest)
+//	POST /v1/shutdown   stop the daemon gracefully
+//	POST /v1/drain      drain the daemon, then stop it; answers once drained
+func (s *Server) Handler() http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc("GET /v1/status", s.handleStatus)
+	api.HandleFunc("GET /v1/peers", s.handlePeers)
+	api.HandleFunc("GET /v1/friends", s.handleFriends)
+	api.HandleFunc("POST /v1/send", s.handleSend)
+	api.HandleFunc("POST /v1/shutdown", s.handleShutdown)
+	api.HandleFunc("POST /v1/drain", s.handleDrain)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.handleHealth)
+	mux.Handle("/", s.authenticate(api))
+	return mux
+}
+
+// Start writes a fresh token, listens on the socket and serves until ctx is
+// cancelled, then removes the socket and token
+func (s *Server) Start(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(s.socketPath), 0700); err != nil {
+		return fmt.Errorf("failed to create socket directory: %w", err)
+	}
+
+	// A socket left by a daemon that crashed blocks listening; one that still
+	// answers belongs to a daemon that is running
+	if _, err := os.Stat(s.socketPath); err == nil {
+		if conn, err := net.DialTimeout("unix", s.socketPath, time.Second); err == nil {
+			conn.Close()
+			return ErrAlreadyRunning
+		}
+		os.Remove(s.socketPath)
+	}
+
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return fmt.Errorf("failed to generate control token: %w", err)
+	}
+	s.token = hex.EncodeToString(token)
+	if err := os.WriteFile(TokenPath(s.socketPath), []byte(s.token+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write control token: %w", err)
+	}
+
+	listener, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		os.Remove(TokenPath(s.socketPath))
+		return fmt.Errorf("failed to listen on %s: %w", s.socketPath, err)
+	}
+	// The token is the real check; this keeps other users off the socket too
+	os.Chmod(s.socketPath, 0600)
+
+	srv := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+		os.Remove(TokenPath(s.socketPath))
+	}()
+
+	go func() {
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("Warning: Control server stopped: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// authenticate rejects requests without the control token
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleStatus reports the daemon's status
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := s.backend.Status(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, status)
+}
+
+// handleHealth reports the node's health, failing the request when degraded
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	health := s.backend.Health(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if !health.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
+// handlePeers lists connected peers
+func (s *Server) handlePeers(w http.ResponseWriter, r *http.Request) {
+	peers, err := s.backend.Peers(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, peers)
+}
+
+// handleFriends lists the logged-in account's friends
+func (s *Server) handleFriends(w http.ResponseWriter, r *http.Request) {
+	friends, err := s.backend.Friends(r.Context())
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, friends)
+}
+
+// handleSend sends a direct message
+func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
+	var req SendRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid send request: %w", err))
+		return
+	}
+	if req.To == "" || req.Message == "" {
+		writeError(w, http.StatusBadRequest, errors.New("send request needs a recipient and a message"))
+		return
+	}
+	if err := s.backend.Send(r.Context(), req.To, req.Message); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleShutdown stops the daemon once the response is on its way
+func (s *Server) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusAccepted)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	go s.backend.Shutdown()
+}
+
+// handleDrain drains the daemon and stops it once the response is on its
+// way. The drain goes on if the client stops waiting.
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if err := s.backend.Drain(context.WithoutCancel(r.Context())); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	go s.backend.Shutdown()
+}
+
+// writeJSON writes v as JSON
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeError writes err as a JSON error response
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/austinwklein/whisper/config"
+	"github.com/austinwklein/whisper/control"
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const ctlUsage = "usage: whisper ctl <status|peers|friends|send <username> <message>|shutdown|drain>"
+
+// errNotLoggedIn is returned by control requests that need the daemon's account
+var errNotLoggedIn = errors.New("the daemon is not logged in to an account (install it with --username)")
+
+// runCtlCommand handles `whisper ctl ...`, administering a running daemon
+// through its control socket
+func runCtlCommand(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(ctlUsage)
+	}
+	client, err := control.Dial(controlSocketPath(cfg))
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "status":
+		status, err := client.Status(ctx)
+		if err != nil {
+			return err
+		}
+		i18n.Printf("Peer ID:   %s\n", status.PeerID)
+		if status.Username != "" {
+			i18n.Printf("Account:   %s\n", status.Username)
+		} else {
+			i18n.Println("Account:   (not logged in)")
+		}
+		i18n.Printf("Up:        %s (since %s)\n", time.Since(status.StartedAt).Round(time.Second), status.StartedAt.Local().Format("Jan 2 15:04"))
+		i18n.Printf("Peers:     %d connected\n", status.Peers)
+		i18n.Printf("DHT mode:  %s\n", status.DHTMode)
+		if status.Draining {
+			i18n.Println("State:     draining")
+		}
+		for _, addr := range status.Addrs {
+			i18n.Printf("Address:   %s\n", addr)
+		}
+
+	case "peers":
+		peers, err := client.Peers(ctx)
+		if err != nil {
+			return err
+		}
+		if len(peers) == 0 {
+			i18n.Println("No connected peers")
+			return nil
+		}
+		i18n.Printf("Connected peers (%d):\n", len(peers))
+		for i, peer := range peers {
+			if peer.Username != "" {
+				i18n.Printf("  %d. %s (%s) - %s\n", i+1, peer.Username, peer.FullName, peer.ID)
+			} else {
+				i18n.Printf("  %d. %s\n", i+1, peer.ID)
+			}
+		}
+
+	case "friends":
+		friends, err := client.Friends(ctx)
+		if err != nil {
+			return err
+		}
+		if len(friends) == 0 {
+			i18n.Println("You don't have any friends yet")
+			return nil
+		}
+		i18n.Printf("Your friends (%d):\n", len(friends))
+		for i, friend := range friends {
+			statusIcon := "○"
+			if friend.Online {
+				statusIcon = "●"
+			}
+			unread := ""
+			if friend.Unread > 0 {
+				unread = i18n.Sprintf(" [%d unread]", friend.Unread)
+			}
+			lastSeen := ""
+			if friend.Online && friend.Away {
+				statusIcon = "◐"
+				lastSeen = i18n.Sprintf(" - away")
+			} else if !friend.Online && !friend.LastSeen.IsZero() {
+				lastSeen = " - " + formatLastSeen(friend.LastSeen)
+			}
+			i18n.Printf("  %d. %s %s (%s)%s%s\n", i+1, statusIcon, friend.FullName, friend.Username, unread, lastSeen)
+		}
+
+	case "send":
+		if len(args) < 3 {
+			return errors.New("usage: whisper ctl send <username> <message>")
+		}
+		if err := client.Send(ctx, args[1], strings.Join(args[2:], " ")); err != nil {
+			return err
+		}
+		i18n.Printf("✓ Message sent to %s\n", args[1])
+
+	case "shutdown":
+		if err := client.Shutdown(ctx); err != nil {
+			return err
+		}
+		i18n.Println("✓ Daemon is shutting down")
+
+	case "drain":
+		i18n.Println("Draining the daemon...")
+		if err := client.Drain(ctx); err != nil {
+			return err
+		}
+		i18n.Println("✓ Daemon drained and is shutting down")
+
+	default:
+		return errors.New(ctlUsage)
+	}
+	return nil
+}
+
+// daemonControl is the control API's view of a running daemon
+type daemonControl struct {
+	app     *App
+	started time.Time
+}
+
+// Status reports the node and the account it is logged in to
+func (d *daemonControl) Status(ctx context.Context) (*control.Status, error) {
+	a := d.app
+	status := &control.Status{
+		PeerID:    a.p2p.PeerID().String(),
+		Addrs:     a.p2p.ShareableAddrs(),
+		Peers:     len(a.p2p.GetConnectedPeers()),
+		DHTMode:   a.p2p.DHTMode(),
+		StartedAt: d.started,
+		Draining:  a.draining.Load(),
+	}
+	if user, err := a.auth.CurrentUser(); err == nil && user != nil {
+		status.Username = user.Username
+	}
+	return status, nil
+}
+
+// Peers lists the connected peers
+func (d *daemonControl) Peers(ctx context.Context) ([]control.Peer, error) {
+	peers := []control.Peer{}
+	for _, info := range d.app.p2p.GetConnectedPeers() {
+		peers = append(peers, control.Peer{ID: info.ID.String(), Username: info.Username, FullName: info.FullName})
+	}
+	return peers, nil
+}
+
+// Friends lists the logged-in account's friends, online first
+func (d *daemonControl) Friends(ctx context.Context) ([]control.Friend, error) {
+	a := d.app
+	user, err := a.auth.CurrentUser()
+	if err != nil || user == nil {
+		return nil, errNotLoggedIn
+	}
+
+	filter := storage.FriendFilter{SortBy: storage.FriendSortOnline}
+	for _, peer := range a.p2p.GetConnectedPeers() {
+		filter.OnlinePeerIDs = append(filter.OnlinePeerIDs, peer.ID.String())
+	}
+	summaries, err := a.friendManager.GetFriendsFiltered(ctx, user.ID, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	friends := []control.Friend{}
+	for _, summary := range summaries {
+		friend := control.Friend{
+			Username: summary.Username,
+			FullName: summary.FullName,
+			PeerID:   summary.PeerID,
+			Online:   summary.Online,
+			Unread:   summary.UnreadCount,
+			LastSeen: summary.LastSeen,
+		}
+		if pid, err := peer.Decode(summary.PeerID); err == nil && summary.Online {
+			friend.Away = a.p2p.PeerAway(pid)
+		}
+		friends = append(friends, friend)
+	}
+	return friends, nil
+}
+
+// Send sends a direct message from the logged-in account
+func (d *daemonControl) Send(ctx context.Context, to, message string) error {
+	a := d.app
+	user, err := a.auth.CurrentUser()
+	if err != nil || user == nil {
+		return errNotLoggedIn
+	}
+	recipient, err := a.auth.ResolveUsername(ctx, to)
+	if err != nil {
+		return err
+	}
+	return a.messageManager.SendMessage(ctx, user, recipient.Username, message)
+}
+
+// Health checks the node
+func (d *daemonControl) Health(ctx context.Context) *control.Health {
+	return d.app.Health(ctx)
+}
+
+// Shutdown stops the daemon gracefully
+func (d *daemonControl) Shutdown() {
+	i18n.Println("Shutdown requested over the control socket")
+	d.app.quit()
+}
+
+// Drain drains the daemon before the control server stops it
+func (d *daemonControl) Drain(ctx context.Context) error {
+	i18n.Println("Drain requested over the control socket")
+	return d.app.drain(ctx)
+}
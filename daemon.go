@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/austinwklein/whisper/config"
+	"github.com/austinwklein/whisper/control"
+	"github.com/austinwklein/whisper/i18n"
+)
+
+// serviceName is what the daemon is registered as with systemd or Windows
+const serviceName = "whisper"
+
+const daemonUsage = "usage: whisper daemon [run|install|uninstall|start|stop|restart] [--username <name> --password-file <file>]"
+
+var (
+	errServiceUnsupported  = errors.New("installing a service is only supported with systemd and on Windows")
+	errServiceInstalled    = errors.New("the whisper service is already installed (run 'whisper daemon uninstall' first)")
+	errServiceNotInstalled = errors.New("the whisper service is not installed")
+)
+
+// daemonOptions configures a headless run
+type daemonOptions struct {
+	username string // Account to log in at startup, or "" to only keep the node online
+	password string
+}
+
+// runDaemonCommand handles `whisper daemon ...`: running the node headless,
+// registering it with the system's service manager, and starting, stopping
+// or restarting the registered service
+func runDaemonCommand(cfg *config.Config, args []string) error {
+	action := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+
+	fs := flag.NewFlagSet("daemon "+action, flag.ContinueOnError)
+	username := fs.String("username", "", "account to log in at startup")
+	passwordFile := fs.String("password-file", "", "file containing the account's password")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New(daemonUsage)
+	}
+	if (*username == "") != (*passwordFile == "") {
+		return errors.New("--username and --password-file must be given together")
+	}
+
+	switch action {
+	case "run":
+		opts := &daemonOptions{username: *username}
+		if *passwordFile != "" {
+			password, err := readPasswordFile(*passwordFile)
+			if err != nil {
+				return err
+			}
+			opts.password = password
+		}
+		return runDaemon(cfg, opts)
+
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to find the whisper binary: %w", err)
+		}
+		if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+			exe = resolved
+		}
+		daemonArgs := []string{"daemon", "run"}
+		if *username != "" {
+			if *passwordFile == "-" {
+				return errors.New("the service can't read a password from stdin; use a file")
+			}
+			path, err := filepath.Abs(*passwordFile)
+			if err != nil {
+				return err
+			}
+			// Fail now rather than every time the service starts
+			if _, err := readPasswordFile(path); err != nil {
+				return err
+			}
+			daemonArgs = append(daemonArgs, "--username", *username, "--password-file", path)
+		}
+		if err := installService(exe, daemonArgs, serviceEnv(cfg)); err != nil {
+			return err
+		}
+		i18n.Printf("✓ Installed and started the %s service\n", serviceName)
+		return nil
+
+	case "uninstall":
+		if err := uninstallService(); err != nil {
+			return err
+		}
+		i18n.Printf("✓ Stopped and removed the %s service\n", serviceName)
+		return nil
+
+	case "start", "stop", "restart":
+		if err := controlService(action); err != nil {
+			return err
+		}
+		i18n.Printf("✓ Sent %s to the %s service\n", action, serviceName)
+		return nil
+
+	default:
+		return errors.New(daemonUsage)
+	}
+}
+
+// runForeground runs the node until it is interrupted, stopped with SIGTERM or
+// quit. This is how systemd stops and restarts the daemon.
+func runForeground(cfg *config.Config, daemon *daemonOptions) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// Switching to an account with another identity restarts the node as it
+	var login *accountLogin
+	for {
+		login = runNode(ctx, cfg, daemon, login)
+		if login == nil || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// serviceEnv returns the WHISPER_* settings to run the service with: those in
+// the installing shell, and the database path resolved for this user, since a
+// service may run with a different home directory and working directory
+func serviceEnv(cfg *config.Config) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "WHISPER_") && !strings.HasPrefix(kv, "WHISPER_DB=") {
+			env = append(env, kv)
+		}
+	}
+
+	env = append(env, "WHISPER_DB="+absPath(cfg.DBPath))
+
+	sort.Strings(env)
+	return env
+}
+
+// absPath expands a leading ~ in path and makes it absolute
+func absPath(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[2:])
+		}
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return path
+}
+
+// controlSocketPath is where the daemon serves, and 'whisper ctl' finds, the
+// control API
+func controlSocketPath(cfg *config.Config) string {
+	if cfg.ControlSocket != "" {
+		return absPath(cfg.ControlSocket)
+	}
+	return filepath.Join(filepath.Dir(absPath(cfg.DBPath)), "control.sock")
+}
+
+// startDaemon serves the control API for 'whisper ctl' and logs in the
+// daemon's account, if it has one, so its messages and conferences are
+// received while nobody is at the terminal
+func (a *App) startDaemon(ctx context.Context, daemon *daemonOptions) {
+	socketPath := controlSocketPath(a.config)
+	server := control.NewServer(socketPath, &daemonControl{app: a, started: time.Now()})
+	if err := server.Start(ctx); err != nil {
+		log.Fatalf("Failed to start control socket: %v", err)
+	}
+	i18n.Printf("Whisper daemon running (peer ID %s, control socket %s)\n", a.p2p.PeerID(), socketPath)
+	if daemon.username == "" {
+		i18n.Println("No account given; keeping the node online without logging in")
+		return
+	}
+
+	user, err := a.auth.Login(ctx, daemon.username, daemon.password)
+	if err != nil {
+		// Nothing would be received for the account; fail so the service
+		// manager reports it instead of the daemon running uselessly
+		log.Fatalf("Failed to log in as %s: %v", daemon.username, err)
+	}
+	i18n.Printf("✓ Logged in as %s\n", user.Username)
+	a.startSession(ctx, user)
+}
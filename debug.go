@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/reputation"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// handleDebugCommand handles `debug peer <peer-id|username>`, showing what
+// this node knows about a peer and how it is treating it, and `debug panics`
+func (a *App) handleDebugCommand(ctx context.Context, parts []string) {
+	if len(parts) == 2 && parts[1] == "panics" {
+		a.showPanics()
+		return
+	}
+	if len(parts) != 3 || parts[1] != "peer" {
+		i18n.Println("Usage: debug peer <peer-id|username> | debug panics")
+		return
+	}
+
+	pid, err := peer.Decode(parts[2])
+	if err != nil {
+		user, lookupErr := a.storage.GetUserByUsername(ctx, parts[2])
+		if errors.Is(lookupErr, storage.ErrNotFound) {
+			i18n.Printf("No peer or user called %s\n", parts[2])
+			return
+		}
+		if lookupErr != nil {
+			i18n.Printf("User not found: %v\n", lookupErr)
+			return
+		}
+		if pid, err = peer.Decode(user.PeerID); err != nil {
+			i18n.Printf("Invalid peer ID: %v\n", err)
+			return
+		}
+	}
+
+	i18n.Printf("\n=== Peer %s ===\n", pid)
+	known, err := a.storage.GetKnownPeer(ctx, pid.String())
+	if err != nil {
+		i18n.Printf("Failed to get peer: %v\n", err)
+		return
+	}
+	if known != nil && known.Username != "" {
+		i18n.Printf("Username:   %s\n", known.Username)
+	}
+	if a.p2p.IsConnected(pid) {
+		i18n.Println("Connected:  yes")
+	} else {
+		i18n.Println("Connected:  no")
+	}
+	if known != nil && !known.LastSeen.IsZero() {
+		i18n.Printf("Last seen:  %s\n", known.LastSeen.Local().Format("Jan 2 15:04"))
+	}
+	if known != nil {
+		i18n.Printf("Version:    %s\n", peerVersion(known.Version, known.Platform))
+	}
+	if missing := a.p2p.MissingProtocols(pid); len(missing) > 0 {
+		i18n.Println("Missing protocols (incompatible):")
+		for _, id := range missing {
+			i18n.Printf("  %s\n", id)
+		}
+	}
+	if score, ok := a.p2p.PeerScores()[pid]; ok {
+		i18n.Printf("GossipSub:  %.2f\n", score)
+	}
+
+	rep, err := a.reputation.Get(ctx, pid)
+	if err != nil {
+		i18n.Printf("Failed to get reputation: %v\n", err)
+		return
+	}
+	i18n.Printf("Reputation: %.1f (%s)\n", rep.Score, i18n.T(reputation.Status(rep.Score)))
+	i18n.Printf("  Invalid messages:         %d\n", rep.InvalidMessages)
+	i18n.Printf("  Rate limit violations:    %d\n", rep.RateLimited)
+	i18n.Printf("  Rejected friend requests: %d\n", rep.RejectedRequests)
+	if !rep.UpdatedAt.IsZero() {
+		i18n.Printf("  Last offense:             %s\n", rep.UpdatedAt.Local().Format("Jan 2 15:04"))
+	}
+}
+
+// showPanics lists the handler panics recovered since startup, newest first;
+// their stacks are in the log
+func (a *App) showPanics() {
+	panics := p2p.DefaultStreamGuard.RecentPanics()
+	if len(panics) == 0 {
+		i18n.Println("No handler has panicked")
+		return
+	}
+	i18n.Printf("\n=== Recovered panics (%d) ===\n", len(panics))
+	for i := len(panics) - 1; i >= 0; i-- {
+		event := panics[i]
+		i18n.Printf("[%s] %s: %s\n", event.Time.Local().Format("Jan 2 15:04:05"), event.Handler, event.Value)
+		if event.Peer != "" {
+			i18n.Printf("  from %s\n", event.Peer)
+		}
+	}
+	i18n.Println()
+}
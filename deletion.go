@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+)
+
+// handleDeleteAccountCommand handles `delete-account [--password-file <file>]`,
+// asking for the password unless it is given: friends are
+// told the account is gone, its names are released from the relays and
+// directories, and everything stored for it on this node is wiped
+func (a *App) handleDeleteAccountCommand(ctx context.Context, user *storage.User, parts []string) {
+	password, err := a.passwordArg(parts[1:], i18n.T("Password: "))
+	if errors.Is(err, errPasswordArgs) {
+		i18n.Println("Usage: delete-account [--password-file <file>]")
+		return
+	}
+	if err == nil {
+		err = a.auth.CheckPassword(password)
+	}
+	if err != nil {
+		i18n.Printf("Failed to delete account: %v\n", err)
+		return
+	}
+
+	// Tell friends first, while the account and its friend list still exist
+	delivered, queued, err := a.friendManager.AnnounceAccountDeleted(ctx, user)
+	if err != nil {
+		i18n.Printf("Failed to delete account: %v\n", err)
+		return
+	}
+
+	names := []string{user.Username}
+	aliases, err := a.storage.GetUsernameAliases(ctx, user.ID)
+	if err != nil {
+		i18n.Printf("Warning: Failed to get former usernames: %v\n", err)
+	}
+	for _, alias := range aliases {
+		names = append(names, alias.Username)
+	}
+
+	// Stop advertising the names before giving them up
+	username := user.Username
+	a.stopSession()
+	for _, name := range names {
+		if a.rendezvousManager.Enabled() {
+			if err := a.rendezvousManager.Release(ctx, name); err != nil {
+				i18n.Printf("Warning: Failed to release %s from relays: %v\n", name, err)
+			}
+		}
+		if a.directoryClient.Enabled() {
+			if err := a.directoryClient.Revoke(ctx, name); err != nil {
+				i18n.Printf("Warning: Failed to remove %s from directories: %v\n", name, err)
+			}
+		}
+	}
+
+	if err := a.auth.DeleteAccount(ctx, parts[1]); err != nil {
+		i18n.Printf("Failed to delete account: %v\n", err)
+		// Still logged in; pick the session back up
+		if current, err := a.auth.CurrentUser(); err == nil {
+			a.startSession(ctx, current)
+		}
+		return
+	}
+
+	i18n.Printf("✓ Deleted account %s\n", username)
+	i18n.Printf("Told %d friend(s) now; %d more will be told when they next connect\n", delivered, queued)
+}
+
+// onContactDeleted reports a friend who deleted their account
+func (a *App) onContactDeleted(contact *storage.User) {
+	i18n.Printf("\n🗑  %s (%s) deleted their account\n> ", contact.Username, contact.FullName)
+}
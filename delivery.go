@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/messages"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+)
+
+// runMsgStatus shows where a sent message stands and why the tries at
+// delivering it have failed
+func (a *App) runMsgStatus(ctx context.Context, currentUser *storage.User, args []string) {
+	const usage = "Usage: msg-status <message-id>"
+	if len(args) < 1 {
+		i18n.Println(usage)
+		return
+	}
+	var messageID int64
+	if _, err := fmt.Sscanf(args[0], "%d", &messageID); err != nil {
+		i18n.Println(usage)
+		return
+	}
+
+	status, err := a.messageManager.GetDeliveryStatus(ctx, currentUser, messageID)
+	if errors.Is(err, storage.ErrMessageNotFound) || errors.Is(err, messages.ErrNotSent) {
+		i18n.Printf("%v\n", err)
+		return
+	}
+	if err != nil {
+		i18n.Printf("Failed to get delivery status: %v\n", err)
+		return
+	}
+
+	msg := status.Message
+	i18n.Printf("\n=== Message #%d to %s ===\n", msg.ID, status.To.Username)
+	i18n.Printf("Sent:   %s\n", msg.CreatedAt.Local().Format("Jan 2 15:04"))
+	switch status.State {
+	case messages.DeliveryRead:
+		i18n.Printf("Status: ✓✓ read %s\n", msg.ReadAt.Local().Format("Jan 2 15:04"))
+	case messages.DeliveryDelivered:
+		i18n.Printf("Status: ✓ delivered %s\n", msg.DeliveredAt.Local().Format("Jan 2 15:04"))
+	case messages.DeliveryFailed:
+		i18n.Printf("Status: ✗ given up %s\n", msg.FailedAt.Local().Format("Jan 2 15:04"))
+	default:
+		i18n.Println("Status: not delivered yet")
+		if !msg.ExpiresAt.IsZero() {
+			i18n.Printf("Gives up: %s\n", msg.ExpiresAt.Local().Format("Jan 2 15:04"))
+		}
+	}
+
+	if len(status.Attempts) > 0 {
+		i18n.Printf("Failed tries (%d):\n", len(status.Attempts))
+		for _, attempt := range status.Attempts {
+			if attempt.Detail != "" {
+				i18n.Printf("  %s  %-11s %s\n", attempt.AttemptedAt.Local().Format("Jan 2 15:04:05"), attempt.Reason, attempt.Detail)
+			} else {
+				i18n.Printf("  %s  %s\n", attempt.AttemptedAt.Local().Format("Jan 2 15:04:05"), attempt.Reason)
+			}
+		}
+		if status.State == messages.DeliveryPending || status.State == messages.DeliveryFailed {
+			i18n.Printf("Hint: %s\n", messages.DeliveryHint(status.LastFailure().Reason, status.To.Username))
+			if status.LastFailure().Reason == storage.DeliveryUnsupported {
+				if known, err := a.storage.GetKnownPeer(ctx, status.To.PeerID); err == nil && known != nil {
+					i18n.Printf("      They run Whisper %s; you run %s\n", peerVersion(known.Version, known.Platform), p2p.Version)
+				}
+			}
+		}
+	}
+	i18n.Println()
+}
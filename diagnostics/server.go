@@ -0,0 +1,175 @@
+// Package diagnostics serves runtime and libp2p debugging endpoints over HTTP
+// on a loopback address, for chasing hangs and memory growth in nodes that
+// have been running for a long time.
+package diagnostics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rpprof "runtime/pprof"
+	"time"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ErrNotLoopback is returned when asked to listen anywhere but this machine;
+// the endpoints expose memory contents and peer details
+var ErrNotLoopback = errors.New("diagnostics server must listen on a loopback address")
+
+// shutdownTimeout bounds how long open requests may finish once the server stops
+const shutdownTimeout = 5 * time.Second
+
+// Server is the diagnostics HTTP server
+type Server struct {
+	addr string
+	host *p2p.P2PHost
+}
+
+// RuntimeStats summarizes the Go runtime's goroutines and memory
+type RuntimeStats struct {
+	Goroutines    int           `json:"goroutines"`
+	HeapAlloc     uint64        `json:"heap_alloc"`
+	HeapInuse     uint64        `json:"heap_inuse"`
+	HeapObjects   uint64        `json:"heap_objects"`
+	Sys           uint64        `json:"sys"`
+	NumGC         uint32        `json:"num_gc"`
+	LastGC        time.Time     `json:"last_gc"`
+	PauseTotal    time.Duration `json:"pause_total"`
+	GOMAXPROCS    int           `json:"gomaxprocs"`
+	UptimeSeconds int64         `json:"uptime_seconds"`
+}
+
+// started is when the process started, for the uptime report
+var started = time.Now()
+
+// NewServer creates a diagnostics server for addr (host:port), which must be
+// on a loopback interface
+func NewServer(addr string, h *p2p.P2PHost) (*Server, error) {
+	hostname, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid diagnostics address: %w", err)
+	}
+	if hostname != "localhost" {
+		ip := net.ParseIP(hostname)
+		if ip == nil || !ip.IsLoopback() {
+			return nil, ErrNotLoopback
+		}
+	}
+	return &Server{addr: addr, host: h}, nil
+}
+
+// Handler returns the diagnostics endpoints:
+//
+//	/debug/pprof/       profiles (heap, goroutine, profile, trace, ...)
+//	/debug/goroutines   full stack dump of every goroutine
+//	/debug/runtime      goroutine count, heap and GC figures as JSON
+//	/debug/libp2p       connections, streams, protocols, DHT and resource use as JSON
+//	/debug/eventbus     events waiting in each libp2p event bus subscriber as JSON
+//	/debug/panics       recent handler panics the node recovered from, with stacks, as JSON
+//	/metrics            Prometheus metrics, including libp2p's
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/goroutines", s.handleGoroutines)
+	mux.HandleFunc("/debug/runtime", s.handleRuntime)
+	mux.HandleFunc("/debug/libp2p", s.handleLibp2p)
+	mux.HandleFunc("/debug/eventbus", s.handleEventBus)
+	mux.HandleFunc("/debug/panics", s.handlePanics)
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+// Start listens on the server's address and serves until ctx is cancelled
+func (s *Server) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
+	}
+
+	srv := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	go func() {
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("Warning: Diagnostics server stopped: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// handleGoroutines writes every goroutine's stack, as a panic would print them
+func (s *Server) handleGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rpprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// handleRuntime reports goroutine and memory figures
+func (s *Server) handleRuntime(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	stats := &RuntimeStats{
+		Goroutines:    runtime.NumGoroutine(),
+		HeapAlloc:     mem.HeapAlloc,
+		HeapInuse:     mem.HeapInuse,
+		HeapObjects:   mem.HeapObjects,
+		Sys:           mem.Sys,
+		NumGC:         mem.NumGC,
+		PauseTotal:    time.Duration(mem.PauseTotalNs),
+		GOMAXPROCS:    runtime.GOMAXPROCS(0),
+		UptimeSeconds: int64(time.Since(started).Seconds()),
+	}
+	if mem.LastGC > 0 {
+		stats.LastGC = time.Unix(0, int64(mem.LastGC))
+	}
+	writeJSON(w, stats)
+}
+
+// handleLibp2p reports the host's connections, streams and subsystems
+func (s *Server) handleLibp2p(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.host.Snapshot())
+}
+
+// handleEventBus reports the event bus subscribers' backlogs
+func (s *Server) handleEventBus(w http.ResponseWriter, r *http.Request) {
+	backlog, err := p2p.EventBusBacklog()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, backlog)
+}
+
+// handlePanics reports the handler panics the node recovered from
+func (s *Server) handlePanics(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, p2p.DefaultStreamGuard.RecentPanics())
+}
+
+// writeJSON writes v as indented JSON
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,335 @@
+package directory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// endpoint is one trusted directory and the transport used to reach it
+type endpoint interface {
+	String() string
+	publish(ctx context.Context, record *Record) error
+	lookup(ctx context.Context, username string) (*Record, error) // nil, nil if not found
+}
+
+// Client publishes the local user's record to the trusted directories and
+// looks usernames up in them, in the order they were configured
+type Client struct {
+	host host.Host
+
+	mu        sync.RWMutex
+	endpoints []endpoint
+	changed   chan struct{} // Closed and replaced when the directories change
+}
+
+// NewClient creates a client for the given directories, each either an
+// http(s):// URL or a libp2p multiaddr with /p2p/
+func NewClient(h host.Host, directories []string) (*Client, error) {
+	c := &Client{host: h, changed: make(chan struct{})}
+	if err := c.SetDirectories(directories); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SetDirectories replaces the directories in use. Usernames kept published
+// are sent to the new directories right away; records in directories no
+// longer used expire. On error the directories are left as they were.
+func (c *Client) SetDirectories(directories []string) error {
+	endpoints := []endpoint{}
+	for _, directory := range directories {
+		if strings.HasPrefix(directory, "http://") || strings.HasPrefix(directory, "https://") {
+			base, err := url.Parse(strings.TrimSuffix(directory, "/"))
+			if err != nil {
+				return fmt.Errorf("invalid directory %q: %w", directory, err)
+			}
+			endpoints = append(endpoints, &httpEndpoint{base: base, client: &http.Client{Timeout: requestTimeout}})
+			continue
+		}
+
+		infos, err := p2p.ParsePeerAddrs([]string{directory})
+		if err != nil {
+			return fmt.Errorf("invalid directory %q: %w", directory, err)
+		}
+		endpoints = append(endpoints, &p2pEndpoint{host: c.host, info: infos[0]})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.endpoints = endpoints
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return nil
+}
+
+// endpointList returns the configured directories in lookup order
+func (c *Client) endpointList() []endpoint {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.endpoints
+}
+
+// Enabled reports whether any directories are configured
+func (c *Client) Enabled() bool {
+	return len(c.endpointList()) > 0
+}
+
+// Directories returns the configured directories in lookup order
+func (c *Client) Directories() []string {
+	endpoints := c.endpointList()
+	names := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		names = append(names, e.String())
+	}
+	return names
+}
+
+// Publish signs a record giving username to this node and sends it to every
+// directory. It succeeds if at least one directory stored it.
+func (c *Client) Publish(ctx context.Context, username string, addrs []string) error {
+	endpoints := c.endpointList()
+	if len(endpoints) == 0 {
+		return ErrNoDirectories
+	}
+	privKey := c.host.Peerstore().PrivKey(c.host.ID())
+	if privKey == nil {
+		return p2p.ErrNoPrivateKey
+	}
+	record, err := NewRecord(privKey, username, addrs, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	published := 0
+	for _, e := range endpoints {
+		if err := e.publish(ctx, record); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e, err))
+			continue
+		}
+		published++
+	}
+	if published == 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// Revoke tells every directory this node gives username up. Directories that
+// can't be reached drop the record when it expires.
+func (c *Client) Revoke(ctx context.Context, username string) error {
+	endpoints := c.endpointList()
+	if len(endpoints) == 0 {
+		return ErrNoDirectories
+	}
+	privKey := c.host.Peerstore().PrivKey(c.host.ID())
+	if privKey == nil {
+		return p2p.ErrNoPrivateKey
+	}
+	record, err := NewRevocation(privKey, username, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, e := range endpoints {
+		if err := e.publish(ctx, record); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// KeepPublished publishes username now and republishes it until ctx is done,
+// with the addresses addrs returns at the time, and again whenever the
+// directories change. With no directories it waits for some.
+func (c *Client) KeepPublished(ctx context.Context, username string, addrs func() []string) {
+	ticker := time.NewTicker(republishInterval)
+	defer ticker.Stop()
+
+	for {
+		c.mu.RLock()
+		changed := c.changed
+		c.mu.RUnlock()
+
+		if err := c.Publish(ctx, username, addrs()); err != nil && !errors.Is(err, ErrNoDirectories) && ctx.Err() == nil {
+			fmt.Printf("Warning: Failed to publish to directories: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-changed:
+		}
+	}
+}
+
+// Lookup asks each directory in turn for username and returns the first
+// record that verifies and names it. Directories that fail or return a bad
+// record are skipped; ErrNotFound means none had a valid one.
+func (c *Client) Lookup(ctx context.Context, username string) (*Record, error) {
+	endpoints := c.endpointList()
+	if len(endpoints) == 0 {
+		return nil, ErrNoDirectories
+	}
+
+	var errs []error
+	for _, e := range endpoints {
+		record, err := e.lookup(ctx, username)
+		if err == nil && record != nil {
+			err = record.Verify(time.Now())
+			if err == nil && !strings.EqualFold(record.Username, username) {
+				err = fmt.Errorf("%w: returned for a different username", ErrInvalidRecord)
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e, err))
+			continue
+		}
+		if record != nil {
+			return record, nil
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%w (%v)", ErrNotFound, errors.Join(errs...))
+	}
+	return nil, ErrNotFound
+}
+
+// p2pEndpoint reaches a directory over the libp2p directory protocols
+type p2pEndpoint struct {
+	host host.Host
+	info peer.AddrInfo
+}
+
+func (e *p2pEndpoint) String() string {
+	return e.info.ID.String()
+}
+
+// publish sends a record to the directory
+func (e *p2pEndpoint) publish(ctx context.Context, record *Record) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	if err := e.host.Connect(ctx, e.info); err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	stream, err := e.host.NewStream(ctx, e.info.ID, ProtocolPublish)
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+
+	response, err := SendPublishRequest(ctx, stream, &PublishRequest{Record: record})
+	if err != nil {
+		return err
+	}
+	if !response.OK {
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+// lookup asks the directory for a username's record
+func (e *p2pEndpoint) lookup(ctx context.Context, username string) (*Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	if err := e.host.Connect(ctx, e.info); err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	stream, err := e.host.NewStream(ctx, e.info.ID, ProtocolLookup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+
+	response, err := SendLookupRequest(ctx, stream, &LookupRequest{Username: username})
+	if err != nil {
+		return nil, err
+	}
+	if !response.Found || response.Record == nil {
+		return nil, nil
+	}
+	return response.Record, nil
+}
+
+// httpEndpoint reaches a directory over its HTTP API
+type httpEndpoint struct {
+	base   *url.URL
+	client *http.Client
+}
+
+func (e *httpEndpoint) String() string {
+	return e.base.String()
+}
+
+// publish posts a record to the directory
+func (e *httpEndpoint) publish(ctx context.Context, record *Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.base.JoinPath("v1", "records").String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return httpError(resp)
+	}
+	return nil
+}
+
+// lookup fetches a username's record from the directory
+func (e *httpEndpoint) lookup(ctx context.Context, username string) (*Record, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.base.JoinPath("v1", "records", username).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode >= 300:
+		return nil, httpError(resp)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRecordSize+1))
+	if err != nil {
+		return nil, err
+	}
+	return decodeRecord(data, time.Now())
+}
+
+// httpError turns a failed response into an error carrying the server's message
+func httpError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if message := strings.TrimSpace(string(body)); message != "" {
+		return fmt.Errorf("directory returned %s: %s", resp.Status, message)
+	}
+	return fmt.Errorf("directory returned %s", resp.Status)
+}
@@ -0,0 +1,190 @@
+// Package directory implements optional, user-run directory servers that map
+// usernames to peer records. Each record is signed by the key behind its peer
+// ID, so a directory can lose or withhold records but never forge them.
+// Directories are reached over libp2p or plain HTTP; clients list the ones
+// they trust and query them in order before falling back to the DHT and the
+// local database.
+package directory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// RecordTTL is how long a published record stays valid
+	RecordTTL = 24 * time.Hour
+
+	// republishInterval is how often a node refreshes its record; well within
+	// RecordTTL so directories that restarted relearn it quickly
+	republishInterval = time.Hour
+
+	// requestTimeout bounds one publish or lookup exchange with a directory
+	requestTimeout = 10 * time.Second
+
+	// maxClockSkew is how far in the future a record may claim to be issued
+	maxClockSkew = 10 * time.Minute
+
+	// maxRecordAddrs caps the addresses a record may carry
+	maxRecordAddrs = 16
+
+	// maxRecordSize bounds a record accepted from the network
+	maxRecordSize = 8 * 1024
+)
+
+var (
+	ErrInvalidRecord = errors.New("invalid directory record")
+	ErrNameTaken     = errors.New("username is held by another peer at this directory")
+	ErrStaleRecord   = errors.New("directory already has a newer record")
+	ErrNotFound      = errors.New("username not found in any directory")
+	ErrNoDirectories = errors.New("no directories configured (see WHISPER_DIRECTORIES)")
+	ErrDirectoryFull = errors.New("directory is full")
+)
+
+// Record is a user's signed claim that a username belongs to a peer,
+// reachable at the listed addresses until Expires
+type Record struct {
+	Username  string   `json:"username"`
+	PeerID    string   `json:"peer_id"`
+	Addrs     []string `json:"addrs,omitempty"`
+	Issued    int64    `json:"issued"`            // Unix timestamp; newer records replace older ones
+	Expires   int64    `json:"expires"`           // Unix timestamp
+	Revoked   bool     `json:"revoked,omitempty"` // The peer gives the username up
+	Signature []byte   `json:"signature"`
+}
+
+// signedBytes returns the bytes covered by the signature
+func (r *Record) signedBytes() []byte {
+	signed := fmt.Sprintf("whisper-directory:%s:%s:%d:%d:%s",
+		strings.ToLower(r.Username), r.PeerID, r.Issued, r.Expires, strings.Join(r.Addrs, ","))
+	if r.Revoked {
+		signed += ":revoked"
+	}
+	return []byte(signed)
+}
+
+// NewRecord signs a record giving username to the key's peer ID
+func NewRecord(privKey crypto.PrivKey, username string, addrs []string, now time.Time) (*Record, error) {
+	id, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive peer ID: %w", err)
+	}
+	if len(addrs) > maxRecordAddrs {
+		addrs = addrs[:maxRecordAddrs]
+	}
+
+	record := &Record{
+		Username: username,
+		PeerID:   id.String(),
+		Addrs:    addrs,
+		Issued:   now.Unix(),
+		Expires:  now.Add(RecordTTL).Unix(),
+	}
+	record.Signature, err = privKey.Sign(record.signedBytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign directory record: %w", err)
+	}
+	return record, nil
+}
+
+// NewRevocation signs a record giving up username, so directories drop the
+// key's claim on it before the claim expires
+func NewRevocation(privKey crypto.PrivKey, username string, now time.Time) (*Record, error) {
+	id, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive peer ID: %w", err)
+	}
+
+	record := &Record{
+		Username: username,
+		PeerID:   id.String(),
+		Issued:   now.Unix(),
+		Expires:  now.Add(RecordTTL).Unix(),
+		Revoked:  true,
+	}
+	record.Signature, err = privKey.Sign(record.signedBytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign directory revocation: %w", err)
+	}
+	return record, nil
+}
+
+// Verify checks the record's fields, lifetime and signature against the key
+// embedded in its peer ID
+func (r *Record) Verify(now time.Time) error {
+	if err := p2p.CheckTextField("username", r.Username, p2p.MaxUsernameLength, true); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	if len(r.Addrs) > maxRecordAddrs {
+		return fmt.Errorf("%w: too many addresses", ErrInvalidRecord)
+	}
+	if time.Unix(r.Issued, 0).After(now.Add(maxClockSkew)) {
+		return fmt.Errorf("%w: issued in the future", ErrInvalidRecord)
+	}
+	if r.Expired(now) {
+		return fmt.Errorf("%w: expired", ErrInvalidRecord)
+	}
+
+	id, err := peer.Decode(r.PeerID)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	pubKey, err := id.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	ok, err := pubKey.Verify(r.signedBytes(), r.Signature)
+	if err != nil || !ok {
+		return fmt.Errorf("%w: bad signature", ErrInvalidRecord)
+	}
+	return nil
+}
+
+// Expired reports whether the record's lifetime has passed
+func (r *Record) Expired(now time.Time) bool {
+	return !now.Before(time.Unix(r.Expires, 0))
+}
+
+// AddrInfo returns the peer and addresses the record points at, skipping
+// addresses that don't parse or that name a different peer
+func (r *Record) AddrInfo() (peer.AddrInfo, error) {
+	id, err := peer.Decode(r.PeerID)
+	if err != nil {
+		return peer.AddrInfo{}, fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	info := peer.AddrInfo{ID: id}
+	for _, addr := range r.Addrs {
+		maddr, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			continue
+		}
+		transport, addrID := peer.SplitAddr(maddr)
+		if transport != nil && (addrID == "" || addrID == id) {
+			info.Addrs = append(info.Addrs, transport)
+		}
+	}
+	return info, nil
+}
+
+// decodeRecord parses a record received from the network and verifies it
+func decodeRecord(data []byte, now time.Time) (*Record, error) {
+	if len(data) > maxRecordSize {
+		return nil, fmt.Errorf("%w: too large", ErrInvalidRecord)
+	}
+	var record Record
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	if err := record.Verify(now); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
@@ -0,0 +1,168 @@
+package directory
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// Protocol IDs
+	ProtocolPublish = protocol.ID("/whisper/directory/publish/1.0.0")
+	ProtocolLookup  = protocol.ID("/whisper/directory/lookup/1.0.0")
+)
+
+// PublishRequest asks a directory to store a signed record
+type PublishRequest struct {
+	Record *Record `json:"record"`
+}
+
+// PublishResponse reports whether the directory stored the record
+type PublishResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// LookupRequest asks a directory for the record holding a username
+type LookupRequest struct {
+	Username string `json:"username"`
+}
+
+// LookupResponse carries the record, if the directory has one
+type LookupResponse struct {
+	Found  bool    `json:"found"`
+	Record *Record `json:"record,omitempty"`
+}
+
+// Protocol handles the directory protocols
+type Protocol struct {
+	publishHandler func(request *PublishRequest, fromPeer peer.ID) *PublishResponse
+	lookupHandler  func(request *LookupRequest, fromPeer peer.ID) *LookupResponse
+}
+
+// NewProtocol creates a new directory protocol handler
+func NewProtocol() *Protocol {
+	return &Protocol{}
+}
+
+// SetPublishHandler sets the handler that answers publish requests
+func (p *Protocol) SetPublishHandler(handler func(*PublishRequest, peer.ID) *PublishResponse) {
+	p.publishHandler = handler
+}
+
+// SetLookupHandler sets the handler that answers lookup requests
+func (p *Protocol) SetLookupHandler(handler func(*LookupRequest, peer.ID) *LookupResponse) {
+	p.lookupHandler = handler
+}
+
+// HandlePublish answers an incoming publish request
+func (p *Protocol) HandlePublish(s network.Stream) {
+	defer s.Close()
+
+	data, err := p2p.ReadWireMessage(bufio.NewReader(s))
+	if err != nil {
+		fmt.Printf("Error reading directory publish request: %v\n", err)
+		return
+	}
+
+	var request PublishRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		fmt.Printf("Error unmarshaling directory publish request: %v\n", err)
+		return
+	}
+
+	response := &PublishResponse{Error: "publishing not supported"}
+	if request.Record == nil {
+		response = &PublishResponse{Error: "missing record"}
+	} else if p.publishHandler != nil {
+		response = p.publishHandler(&request, s.Conn().RemotePeer())
+	}
+	writeResponse(s, response)
+}
+
+// HandleLookup answers an incoming lookup request
+func (p *Protocol) HandleLookup(s network.Stream) {
+	defer s.Close()
+
+	data, err := p2p.ReadWireMessage(bufio.NewReader(s))
+	if err != nil {
+		fmt.Printf("Error reading directory lookup request: %v\n", err)
+		return
+	}
+
+	var request LookupRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		fmt.Printf("Error unmarshaling directory lookup request: %v\n", err)
+		return
+	}
+
+	response := &LookupResponse{}
+	if p.lookupHandler != nil && p2p.CheckTextField("username", request.Username, p2p.MaxUsernameLength, true) == nil {
+		response = p.lookupHandler(&request, s.Conn().RemotePeer())
+	}
+	writeResponse(s, response)
+}
+
+// writeResponse writes one JSON response line
+func writeResponse(s network.Stream, response interface{}) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		fmt.Printf("Error marshaling directory response: %v\n", err)
+		return
+	}
+
+	data = append(data, '\n')
+	if _, err := s.Write(data); err != nil {
+		fmt.Printf("Error writing directory response: %v\n", err)
+	}
+}
+
+// SendPublishRequest sends a publish request and reads the response
+func SendPublishRequest(ctx context.Context, s network.Stream, request *PublishRequest) (*PublishResponse, error) {
+	var response PublishResponse
+	if err := roundTrip(s, request, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// SendLookupRequest sends a lookup request and reads the response. The record
+// is returned as received; callers verify it.
+func SendLookupRequest(ctx context.Context, s network.Stream, request *LookupRequest) (*LookupResponse, error) {
+	var response LookupResponse
+	if err := roundTrip(s, request, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// roundTrip writes a request line and reads one response line
+func roundTrip(s network.Stream, request, response interface{}) error {
+	defer s.Close()
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	data = append(data, '\n')
+	if _, err := s.Write(data); err != nil {
+		return fmt.Errorf("failed to write request: %w", err)
+	}
+	s.CloseWrite()
+
+	data, err = p2p.ReadWireMessage(bufio.NewReader(s))
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if err := json.Unmarshal(data, response); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return nil
+}
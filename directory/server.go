@@ -0,0 +1,193 @@
+package directory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// maxRecords caps the records a directory keeps in memory
+const maxRecords = 100000
+
+// shutdownTimeout bounds how long open HTTP requests may finish once the server stops
+const shutdownTimeout = 5 * time.Second
+
+// Server is a directory: it keeps the newest valid record for each username
+// and answers lookups over libp2p and, optionally, HTTP. Records live in
+// memory; owners republish them often enough to repopulate a restarted server.
+type Server struct {
+	protocol *Protocol
+
+	mu      sync.Mutex
+	records map[string]*Record // lowercased username -> newest record
+}
+
+// NewServer creates a directory serving the directory protocols on h
+func NewServer(h host.Host) *Server {
+	s := &Server{
+		protocol: NewProtocol(),
+		records:  make(map[string]*Record),
+	}
+	s.protocol.SetPublishHandler(s.handlePublish)
+	s.protocol.SetLookupHandler(s.handleLookup)
+
+	p2p.HandleStreams(h, s.protocol.HandlePublish, ProtocolPublish)
+	p2p.HandleStreams(h, s.protocol.HandleLookup, ProtocolLookup)
+	return s
+}
+
+// Publish stores a record after verifying it. A username stays with its peer
+// until that peer's record expires or it sends a revocation, and a peer can
+// only replace its record with a newer one.
+func (s *Server) Publish(record *Record) error {
+	now := time.Now()
+	if err := record.Verify(now); err != nil {
+		return err
+	}
+	key := strings.ToLower(record.Username)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.records[key]
+	if ok && !existing.Expired(now) {
+		if existing.PeerID != record.PeerID {
+			return ErrNameTaken
+		}
+		if existing.Issued >= record.Issued {
+			return ErrStaleRecord
+		}
+	}
+	if record.Revoked {
+		delete(s.records, key)
+		return nil
+	}
+	if !ok && len(s.records) >= maxRecords {
+		s.pruneExpired(now)
+		if len(s.records) >= maxRecords {
+			return ErrDirectoryFull
+		}
+	}
+	s.records[key] = record
+	return nil
+}
+
+// Lookup returns the live record holding username, or nil
+func (s *Server) Lookup(username string) *Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[strings.ToLower(username)]
+	if !ok || record.Expired(time.Now()) {
+		return nil
+	}
+	return record
+}
+
+// pruneExpired drops expired records; caller holds mu
+func (s *Server) pruneExpired(now time.Time) {
+	for key, record := range s.records {
+		if record.Expired(now) {
+			delete(s.records, key)
+		}
+	}
+}
+
+// handlePublish stores a record published over libp2p
+func (s *Server) handlePublish(request *PublishRequest, fromPeer peer.ID) *PublishResponse {
+	if err := s.Publish(request.Record); err != nil {
+		return &PublishResponse{Error: err.Error()}
+	}
+	return &PublishResponse{OK: true}
+}
+
+// handleLookup answers a lookup made over libp2p
+func (s *Server) handleLookup(request *LookupRequest, fromPeer peer.ID) *LookupResponse {
+	record := s.Lookup(request.Username)
+	if record == nil {
+		return &LookupResponse{}
+	}
+	return &LookupResponse{Found: true, Record: record}
+}
+
+// Handler returns the HTTP API:
+//
+//	GET  /v1/records/{username}   the record holding username (404 if none)
+//	POST /v1/records              publish a signed Record
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/records/{username}", s.handleHTTPLookup)
+	mux.HandleFunc("POST /v1/records", s.handleHTTPPublish)
+	return mux
+}
+
+// ListenHTTP listens on addr and serves the HTTP API in the background until
+// ctx is cancelled
+func (s *Server) ListenHTTP(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	srv := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	go func() {
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("Warning: Directory HTTP server stopped: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// handleHTTPLookup returns the record holding a username
+func (s *Server) handleHTTPLookup(w http.ResponseWriter, r *http.Request) {
+	record := s.Lookup(r.PathValue("username"))
+	if record == nil {
+		http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(record)
+}
+
+// handleHTTPPublish stores a record posted as JSON
+func (s *Server) handleHTTPPublish(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRecordSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	record, err := decodeRecord(data, time.Now())
+	if err == nil {
+		err = s.Publish(record)
+	}
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, ErrNameTaken), errors.Is(err, ErrStaleRecord):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrDirectoryFull):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// freeDiskSpace returns the bytes available to this user on the filesystem
+// holding path
+func freeDiskSpace(path string) (uint64, error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil {
+		return 0, err
+	}
+	return fs.Bavail * uint64(fs.Bsize), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+)
+
+const (
+	// drainTimeout bounds a drain from start to exit; streams still open by
+	// then are cut off, and their peers retry once the node is back
+	drainTimeout = 30 * time.Second
+
+	// drainPoll is how often draining checks for open streams
+	drainPoll = 100 * time.Millisecond
+)
+
+// errDraining is returned when a drain is asked for while one is under way
+var errDraining = errors.New("the node is already draining")
+
+// drain readies the node to stop without losing messages, for planned
+// restarts: it tells connected peers it is going away, refreshes its
+// last-seen record, refuses new streams so peers keep their messages queued,
+// waits for open deliveries to finish and saves received direct messages held
+// back for ordering and received conference messages.
+// The caller stops the node afterwards.
+func (a *App) drain(ctx context.Context) error {
+	if !a.draining.CompareAndSwap(false, true) {
+		return errDraining
+	}
+	ctx, cancel := context.WithTimeout(ctx, drainTimeout)
+	defer cancel()
+
+	i18n.Println("Draining: telling peers this node is going away...")
+	a.p2p.SetAway(ctx)
+	if user, err := a.auth.CurrentUser(); err == nil && user != nil && a.onlineVisibility(ctx, user.ID) == visibleEveryone {
+		if err := a.p2p.PublishPresence(ctx); err != nil {
+			i18n.Printf("Warning: Failed to publish presence: %v\n", err)
+		}
+	}
+
+	a.p2p.StopInbound()
+	if open := a.p2p.OpenStreams(); open > 0 {
+		i18n.Printf("Draining: waiting for %d stream(s) to finish...\n", open)
+	}
+	for open := a.p2p.OpenStreams(); open > 0; open = a.p2p.OpenStreams() {
+		if ctx.Err() != nil {
+			i18n.Printf("Warning: %d stream(s) still open after %s; stopping anyway\n", open, drainTimeout)
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(drainPoll):
+		}
+	}
+
+	a.messageManager.ReleaseHeld()
+	a.conferenceManager.UnsubscribeAll()
+	i18n.Println("✓ Drained")
+	return nil
+}
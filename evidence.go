@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/austinwklein/whisper/conference"
+	"github.com/austinwklein/whisper/evidence"
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+)
+
+// evidenceExportUsage describes evidence-export
+const evidenceExportUsage = `Usage:
+  evidence-export friend <username> [--password-file <file>] [path]
+  evidence-export conf <conf-id> [--password-file <file>] [path]
+Without --password-file you are asked for your password, which isn't shown`
+
+// handleEvidenceExportCommand handles evidence-export: a complete, signed and
+// hash-chained archive of a direct conversation or a conference, for keeping
+// as a record. Unlike conf-export it includes messages the user hid, and
+// needs the account password; conferences can only be archived by their owner.
+func (a *App) handleEvidenceExportCommand(ctx context.Context, user *storage.User, parts []string) {
+	if len(parts) < 3 || (parts[1] != "friend" && parts[1] != "conf") {
+		i18n.Println(evidenceExportUsage)
+		return
+	}
+
+	// Whatever follows the password file, if any, is the path
+	rest, passwordArgs := parts[3:], []string{}
+	if len(rest) > 0 && rest[0] == "--password-file" {
+		if len(rest) < 2 {
+			i18n.Println(evidenceExportUsage)
+			return
+		}
+		passwordArgs, rest = rest[:2], rest[2:]
+	}
+	if len(rest) > 1 {
+		i18n.Println(evidenceExportUsage)
+		return
+	}
+	password, err := a.passwordArg(passwordArgs, i18n.T("Password: "))
+	if err != nil {
+		i18n.Printf("Export failed: %v\n", err)
+		return
+	}
+	if err := a.auth.CheckPassword(password); err != nil {
+		i18n.Printf("Export failed: %v\n", err)
+		return
+	}
+
+	key := a.p2p.Host().Peerstore().PrivKey(a.p2p.Host().ID())
+	if key == nil {
+		i18n.Printf("Export failed: %v\n", p2p.ErrNoPrivateKey)
+		return
+	}
+
+	path := ""
+	if len(rest) > 0 {
+		path = rest[0]
+	}
+
+	var header *evidence.Header
+	var stream func(aw *evidence.Writer) error
+	switch parts[1] {
+	case "friend":
+		contact, err := a.storage.GetUserByUsername(ctx, parts[2])
+		if errors.Is(err, storage.ErrNotFound) {
+			i18n.Printf("User not found: %v\n", err)
+			return
+		}
+		if err != nil {
+			i18n.Printf("Export failed: %v\n", err)
+			return
+		}
+		header = &evidence.Header{
+			Kind:           evidence.KindDirect,
+			Conversation:   contact.Username,
+			ConversationID: contact.PeerID,
+			Participants: []evidence.Participant{
+				{PeerID: user.PeerID, Username: user.Username},
+				{PeerID: contact.PeerID, Username: contact.Username},
+			},
+		}
+		stream = func(aw *evidence.Writer) error {
+			return a.streamConversationEvidence(ctx, user, contact, aw)
+		}
+		if path == "" {
+			path = fmt.Sprintf("evidence-%s-%s.jsonl", contact.Username, time.Now().Format("20060102-150405"))
+		}
+
+	case "conf":
+		confID, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			i18n.Println(evidenceExportUsage)
+			return
+		}
+		conf, err := a.storage.GetConference(ctx, confID)
+		if errors.Is(err, storage.ErrNotFound) {
+			i18n.Printf("Conference not found\n")
+			return
+		}
+		if err != nil {
+			i18n.Printf("Export failed: %v\n", err)
+			return
+		}
+		if conf.CreatorID != user.ID {
+			i18n.Printf("Export failed: %v\n", conference.ErrNotOwner)
+			return
+		}
+		header, err = a.conferenceEvidenceHeader(ctx, conf)
+		if err != nil {
+			i18n.Printf("Export failed: %v\n", err)
+			return
+		}
+		stream = func(aw *evidence.Writer) error {
+			return a.streamConferenceEvidence(ctx, conf, aw)
+		}
+		if path == "" {
+			path = fmt.Sprintf("evidence-conference-%d-%s.jsonl", conf.ID, time.Now().Format("20060102-150405"))
+		}
+	}
+	header.ExportedAt = time.Now()
+
+	// The archive holds everything, hidden messages included, so only the user may read it
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		i18n.Printf("Failed to create %s: %v\n", path, err)
+		return
+	}
+	w := bufio.NewWriter(f)
+	count := 0
+	aw, err := evidence.NewWriter(w, key, header)
+	if err == nil {
+		err = stream(aw)
+		count = aw.Entries()
+	}
+	if err == nil {
+		err = aw.Seal()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		i18n.Printf("Export failed: %v\n", err)
+		return
+	}
+	i18n.Printf("✓ Archived %d messages with %s to %s\n", count, header.Conversation, path)
+	i18n.Printf("Check it with: whisper evidence-verify %s\n", path)
+}
+
+// streamConversationEvidence adds every message of a direct conversation to an archive
+func (a *App) streamConversationEvidence(ctx context.Context, user, contact *storage.User, aw *evidence.Writer) error {
+	return a.storage.StreamConversationRecord(ctx, user.ID, contact.ID, func(msg *storage.Message, hidden bool) error {
+		from := contact.Username
+		if msg.FromUserID == user.ID {
+			from = user.Username
+		}
+		return aw.Add(&evidence.Entry{
+			MessageID:  msg.ID,
+			FromPeerID: msg.FromPeerID,
+			FromName:   from,
+			Kind:       storage.NormalizeKind(msg.Kind),
+			Content:    msg.Content,
+			Lamport:    msg.Lamport,
+			SentAt:     msg.CreatedAt.UTC(),
+			Hidden:     hidden,
+		})
+	})
+}
+
+// conferenceEvidenceHeader describes a conference and everyone who took part in it
+func (a *App) conferenceEvidenceHeader(ctx context.Context, conf *storage.Conference) (*evidence.Header, error) {
+	participants, err := a.conferenceManager.GetConferenceParticipants(ctx, conf.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get participants: %w", err)
+	}
+	header := &evidence.Header{
+		Kind:           evidence.KindConference,
+		Conversation:   conf.Name,
+		ConversationID: strconv.FormatInt(conf.ID, 10),
+		Participants:   []evidence.Participant{},
+	}
+	for _, p := range participants {
+		header.Participants = append(header.Participants, evidence.Participant{PeerID: p.PeerID, Username: p.Username})
+	}
+	return header, nil
+}
+
+// streamConferenceEvidence adds every message of a conference, every channel
+// included, to an archive
+func (a *App) streamConferenceEvidence(ctx context.Context, conf *storage.Conference, aw *evidence.Writer) error {
+	return a.storage.StreamConferenceRecord(ctx, conf.ID, func(entry *storage.TranscriptEntry) error {
+		return aw.Add(&evidence.Entry{
+			MessageID:  entry.ID,
+			FromPeerID: entry.FromPeerID,
+			FromName:   entry.Username,
+			Channel:    entry.Channel,
+			Kind:       storage.NormalizeKind(entry.Kind),
+			Content:    entry.Content,
+			Lamport:    entry.Lamport,
+			SentAt:     entry.CreatedAt.UTC(),
+			Hidden:     entry.Hidden,
+		})
+	})
+}
+
+// verifyEvidence checks an archive and describes it
+func verifyEvidence(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	report, err := evidence.Verify(f)
+	if err != nil {
+		return err
+	}
+
+	h := report.Header
+	i18n.Printf("✓ %s is intact and sealed by %s\n", path, h.ExportedBy)
+	i18n.Printf("  Conversation: %s (%s %s)\n", h.Conversation, h.Kind, h.ConversationID)
+	i18n.Printf("  Exported:     %s\n", h.ExportedAt.Local().Format("2006-01-02 15:04:05"))
+	i18n.Printf("  Messages:     %d\n", report.Entries)
+	if report.Entries > 0 {
+		i18n.Printf("  Covering:     %s to %s\n", report.First.Local().Format("2006-01-02 15:04"), report.Last.Local().Format("2006-01-02 15:04"))
+	}
+	i18n.Printf("  Seal:         %s\n", report.Head)
+	return nil
+}
+
+// runEvidenceVerifyCommand handles `whisper evidence-verify <archive>`, which
+// needs no account or running node
+func runEvidenceVerifyCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: whisper evidence-verify <archive>")
+	}
+	return verifyEvidence(args[0])
+}
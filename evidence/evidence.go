@@ -0,0 +1,296 @@
+// Package evidence writes and verifies tamper-evident conversation archives,
+// for keeping a record that can be shown to a third party. An archive is JSON
+// Lines: a header describing the conversation and who exported it, one entry
+// per message, and a seal. Every line after the header carries the SHA-256 of
+// the line before it, so editing, removing or reordering any line breaks the
+// chain, and the seal signs the last hash with the exporter's identity key.
+package evidence
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Format names the archive layout; it is part of every header and seal
+const Format = "whisper-evidence/1"
+
+// Record types, one per line
+const (
+	RecordHeader = "header"
+	RecordEntry  = "entry"
+	RecordSeal   = "seal"
+)
+
+// Conversation kinds
+const (
+	KindDirect     = "direct"
+	KindConference = "conference"
+)
+
+// Verification errors
+var (
+	ErrMalformed    = errors.New("archive is malformed")
+	ErrBrokenChain  = errors.New("hash chain is broken - the archive was altered")
+	ErrBadSignature = errors.New("seal signature does not match the exporter's key")
+	ErrUnsealed     = errors.New("archive has no seal - it is incomplete")
+)
+
+// Header opens an archive
+type Header struct {
+	Type           string        `json:"type"`
+	Format         string        `json:"format"`
+	Kind           string        `json:"kind"`            // direct or conference
+	Conversation   string        `json:"conversation"`    // Friend's username, or conference name
+	ConversationID string        `json:"conversation_id"` // Friend's peer ID, or conference ID
+	Participants   []Participant `json:"participants"`
+	ExportedBy     string        `json:"exported_by"` // Exporter's peer ID
+	PublicKey      string        `json:"public_key"`  // Exporter's public key, base64, that checks the seal
+	ExportedAt     time.Time     `json:"exported_at"`
+}
+
+// Participant is someone taking part in the exported conversation
+type Participant struct {
+	PeerID   string `json:"peer_id"`
+	Username string `json:"username"`
+}
+
+// Entry is one message of the conversation
+type Entry struct {
+	Type       string    `json:"type"`
+	Seq        int       `json:"seq"`  // Position in the archive, from 1
+	Prev       string    `json:"prev"` // SHA-256 of the previous line, hex
+	MessageID  int64     `json:"message_id"`
+	FromPeerID string    `json:"from_peer_id"`
+	FromName   string    `json:"from_name,omitempty"`
+	Channel    string    `json:"channel,omitempty"`
+	Kind       string    `json:"kind"`
+	Content    string    `json:"content"`
+	Lamport    int64     `json:"lamport"`
+	SentAt     time.Time `json:"sent_at"`
+	Hidden     bool      `json:"hidden,omitempty"` // Deleted from the exporter's own history
+}
+
+// Seal closes an archive
+type Seal struct {
+	Type      string `json:"type"`
+	Entries   int    `json:"entries"`
+	Head      string `json:"head"`      // SHA-256 of the last line before the seal, hex
+	Signature string `json:"signature"` // Exporter's signature over sealPayload, base64
+}
+
+// Writer writes an archive line by line
+type Writer struct {
+	w       io.Writer
+	key     crypto.PrivKey
+	prev    string // Hash of the last line written
+	entries int
+}
+
+// NewWriter starts an archive on w, signed with key, by writing its header.
+// The header's type, format, exporter and public key are filled in.
+func NewWriter(w io.Writer, key crypto.PrivKey, header *Header) (*Writer, error) {
+	pub, err := crypto.MarshalPublicKey(key.GetPublic())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key: %w", err)
+	}
+	exporter, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive peer ID: %w", err)
+	}
+
+	header.Type = RecordHeader
+	header.Format = Format
+	header.ExportedBy = exporter.String()
+	header.PublicKey = base64.StdEncoding.EncodeToString(pub)
+
+	aw := &Writer{w: w, key: key}
+	if err := aw.writeLine(header); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+// Add appends a message, chained to the line before it
+func (aw *Writer) Add(entry *Entry) error {
+	aw.entries++
+	entry.Type = RecordEntry
+	entry.Seq = aw.entries
+	entry.Prev = aw.prev
+	return aw.writeLine(entry)
+}
+
+// Seal signs the chain and ends the archive; nothing may be added after it
+func (aw *Writer) Seal() error {
+	sig, err := aw.key.Sign(sealPayload(aw.entries, aw.prev))
+	if err != nil {
+		return fmt.Errorf("failed to sign archive: %w", err)
+	}
+	return aw.writeLine(&Seal{
+		Type:      RecordSeal,
+		Entries:   aw.entries,
+		Head:      aw.prev,
+		Signature: base64.StdEncoding.EncodeToString(sig),
+	})
+}
+
+// Entries returns how many messages have been added
+func (aw *Writer) Entries() int {
+	return aw.entries
+}
+
+// writeLine writes a record as one line and remembers its hash
+func (aw *Writer) writeLine(record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := aw.w.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	aw.prev = lineHash(data)
+	return nil
+}
+
+// Report describes an archive that verified
+type Report struct {
+	Header  *Header
+	Entries int
+	Head    string // Hash the seal signs
+	First   time.Time
+	Last    time.Time
+}
+
+// Verify reads a whole archive and checks its hash chain and seal. The
+// returned error says which line failed and wraps one of the verification
+// errors.
+func Verify(r io.Reader) (*Report, error) {
+	br := bufio.NewReader(r)
+	var report Report
+	var pub crypto.PubKey
+	var prev string
+	sealed := false
+
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			line = line[:len(line)-1]
+		}
+		if sealed {
+			return nil, fmt.Errorf("line %d: %w: data after the seal", n, ErrMalformed)
+		}
+
+		var record struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w: %v", n, ErrMalformed, err)
+		}
+		if (n == 1) != (record.Type == RecordHeader) {
+			return nil, fmt.Errorf("line %d: %w: the header must come first, once", n, ErrMalformed)
+		}
+
+		switch record.Type {
+		case RecordHeader:
+			header := &Header{}
+			if err := json.Unmarshal(line, header); err != nil {
+				return nil, fmt.Errorf("line %d: %w: %v", n, ErrMalformed, err)
+			}
+			if header.Format != Format {
+				return nil, fmt.Errorf("line %d: %w: unsupported format %q", n, ErrMalformed, header.Format)
+			}
+			if pub, err = exporterKey(header); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			report.Header = header
+
+		case RecordEntry:
+			var entry Entry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				return nil, fmt.Errorf("line %d: %w: %v", n, ErrMalformed, err)
+			}
+			if entry.Prev != prev || entry.Seq != report.Entries+1 {
+				return nil, fmt.Errorf("line %d: %w", n, ErrBrokenChain)
+			}
+			report.Entries++
+			if report.First.IsZero() {
+				report.First = entry.SentAt
+			}
+			report.Last = entry.SentAt
+
+		case RecordSeal:
+			var seal Seal
+			if err := json.Unmarshal(line, &seal); err != nil {
+				return nil, fmt.Errorf("line %d: %w: %v", n, ErrMalformed, err)
+			}
+			if seal.Head != prev || seal.Entries != report.Entries {
+				return nil, fmt.Errorf("line %d: %w", n, ErrBrokenChain)
+			}
+			sig, err := base64.StdEncoding.DecodeString(seal.Signature)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w: %v", n, ErrMalformed, err)
+			}
+			if ok, err := pub.Verify(sealPayload(seal.Entries, seal.Head), sig); err != nil || !ok {
+				return nil, fmt.Errorf("line %d: %w", n, ErrBadSignature)
+			}
+			report.Head = seal.Head
+			sealed = true
+
+		default:
+			return nil, fmt.Errorf("line %d: %w: unknown record type %q", n, ErrMalformed, record.Type)
+		}
+		prev = lineHash(line)
+	}
+
+	if report.Header == nil {
+		return nil, fmt.Errorf("%w: empty archive", ErrMalformed)
+	}
+	if !sealed {
+		return nil, ErrUnsealed
+	}
+	return &report, nil
+}
+
+// exporterKey decodes the header's public key and checks it belongs to the
+// peer named as the exporter
+func exporterKey(header *Header) (crypto.PubKey, error) {
+	data, err := base64.StdEncoding.DecodeString(header.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid public key: %v", ErrMalformed, err)
+	}
+	pub, err := crypto.UnmarshalPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid public key: %v", ErrMalformed, err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil || id.String() != header.ExportedBy {
+		return nil, fmt.Errorf("%w: public key does not belong to %s", ErrBadSignature, header.ExportedBy)
+	}
+	return pub, nil
+}
+
+// sealPayload is what the seal signs
+func sealPayload(entries int, head string) []byte {
+	return []byte(fmt.Sprintf("%s\n%d\n%s", Format, entries, head))
+}
+
+// lineHash returns the hex SHA-256 of a line without its newline
+func lineHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
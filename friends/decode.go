@@ -0,0 +1,91 @@
+package friends
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/austinwklein/whisper/p2p"
+)
+
+// DecodeFriendRequest parses and validates a friend request read from the wire
+func DecodeFriendRequest(data []byte) (*FriendRequestMessage, error) {
+	var request FriendRequestMessage
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal friend request: %w", err)
+	}
+	if err := checkFriendRequest(&request); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// checkFriendRequest validates a friend request in either wire encoding
+func checkFriendRequest(request *FriendRequestMessage) error {
+	if err := p2p.CheckTextField("from_username", request.FromUsername, p2p.MaxUsernameLength, true); err != nil {
+		return err
+	}
+	if err := p2p.CheckTextField("from_full_name", request.FromFullName, p2p.MaxFullNameLength, false); err != nil {
+		return err
+	}
+	if err := p2p.CheckPeerIDField("from_peer_id", request.FromPeerID); err != nil {
+		return err
+	}
+	return p2p.CheckTextField("message", request.Message, p2p.MaxNoteLength, false)
+}
+
+// DecodeFriendResponse parses and validates a friend accept or reject read from the wire
+func DecodeFriendResponse(data []byte) (*FriendResponseMessage, error) {
+	var response FriendResponseMessage
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal friend response: %w", err)
+	}
+	if err := checkFriendResponse(&response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// checkFriendResponse validates a friend accept or reject in either wire encoding
+func checkFriendResponse(response *FriendResponseMessage) error {
+	if err := p2p.CheckTextField("username", response.Username, p2p.MaxUsernameLength, true); err != nil {
+		return err
+	}
+	if err := p2p.CheckTextField("full_name", response.FullName, p2p.MaxFullNameLength, false); err != nil {
+		return err
+	}
+	if err := p2p.CheckPeerIDField("peer_id", response.PeerID); err != nil {
+		return err
+	}
+	return p2p.CheckTextField("message", response.Message, p2p.MaxNoteLength, false)
+}
+
+// DecodeProfile parses and validates a profile announcement read from the wire
+func DecodeProfile(data []byte) (*ProfileMessage, error) {
+	var message ProfileMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal profile: %w", err)
+	}
+	if err := p2p.CheckTextField("username", message.Username, p2p.MaxUsernameLength, true); err != nil {
+		return nil, err
+	}
+	if err := p2p.CheckTextField("full_name", message.FullName, p2p.MaxFullNameLength, false); err != nil {
+		return nil, err
+	}
+	if err := p2p.CheckTextField("status_message", message.StatusMessage, p2p.MaxStatusLength, false); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// DecodeAccountDeletedNotice parses an account deletion notice read from the
+// wire and checks its signature
+func DecodeAccountDeletedNotice(data []byte) (*AccountDeletedNotice, error) {
+	var notice AccountDeletedNotice
+	if err := json.Unmarshal(data, &notice); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal account deletion notice: %w", err)
+	}
+	if err := notice.Verify(); err != nil {
+		return nil, err
+	}
+	return &notice, nil
+}
@@ -0,0 +1,101 @@
+package friends_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/austinwklein/whisper/conformance"
+	"github.com/austinwklein/whisper/friends"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/pb"
+)
+
+// seedVectors adds the wire bytes of every published conformance vector of
+// messageType in the given encoding to a fuzz target's seed corpus
+func seedVectors(f *testing.F, messageType, encoding string) {
+	f.Helper()
+	set, err := conformance.Vectors()
+	if err != nil {
+		f.Fatalf("failed to load vectors: %v", err)
+	}
+	for _, v := range set.Vectors {
+		if v.Message != messageType {
+			continue
+		}
+		switch {
+		case encoding == conformance.EncodingJSON && (v.Encoding == "" || v.Encoding == conformance.EncodingJSON):
+			f.Add([]byte(v.Wire))
+		case encoding == conformance.EncodingProtobuf && v.Encoding == conformance.EncodingProtobuf:
+			wire, err := hex.DecodeString(v.Wire)
+			if err != nil {
+				f.Fatalf("%s: bad hex: %v", v.Name, err)
+			}
+			f.Add(wire)
+		}
+	}
+}
+
+// fuzzDecode checks that decode never panics on arbitrary bytes, and that a
+// message it accepts is accepted again after being encoded
+func fuzzDecode[T any](f *testing.F, decode func(data []byte) (T, error)) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message, err := decode(data)
+		if err != nil {
+			return
+		}
+		again, err := json.Marshal(message)
+		if err != nil {
+			t.Fatalf("failed to encode accepted message: %v", err)
+		}
+		if _, err := decode(again); err != nil {
+			t.Fatalf("accepted %q but rejected its re-encoding %s: %v", data, again, err)
+		}
+	})
+}
+
+func FuzzDecodeFriendRequest(f *testing.F) {
+	seedVectors(f, "FriendRequestMessage", conformance.EncodingJSON)
+	fuzzDecode(f, friends.DecodeFriendRequest)
+}
+
+func FuzzDecodeFriendResponse(f *testing.F) {
+	seedVectors(f, "FriendResponseMessage", conformance.EncodingJSON)
+	fuzzDecode(f, friends.DecodeFriendResponse)
+}
+
+func FuzzDecodeProfile(f *testing.F) {
+	f.Add([]byte(`{"username":"alice","full_name":"Alice Liddell","status_message":"down the rabbit hole"}`))
+	fuzzDecode(f, friends.DecodeProfile)
+}
+
+func FuzzDecodeAccountDeletedNotice(f *testing.F) {
+	f.Add([]byte(`{"username":"alice","peer_id":"12D3KooWK99VoVxNE7XzyBwXEzW7xhK7Gpv85r9F3V3fyKSUKPH5","signature":"AAAA"}`))
+	fuzzDecode(f, friends.DecodeAccountDeletedNotice)
+}
+
+func FuzzDecodeRosterRequest(f *testing.F) {
+	f.Add([]byte(`{"username":"alice","full_name":"Alice Liddell","note":"new laptop"}`))
+	fuzzDecode(f, friends.DecodeRosterRequest)
+}
+
+func FuzzDecodeRoster(f *testing.F) {
+	f.Add([]byte(`{"username":"bob","entries":[{"username":"alice","peer_id":"12D3KooWK99VoVxNE7XzyBwXEzW7xhK7Gpv85r9F3V3fyKSUKPH5"}]}`))
+	f.Add([]byte(`{"username":"bob","declined":"not now"}`))
+	fuzzDecode(f, friends.DecodeRoster)
+}
+
+// FuzzDecodeFriendRequestProto reads a friend request off a 2.0.0 stream the
+// way the handler does, through the bounded length-prefixed reader
+func FuzzDecodeFriendRequestProto(f *testing.F) {
+	seedVectors(f, "FriendRequestMessage", conformance.EncodingProtobuf)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var wire pb.FriendRequest
+		if err := p2p.ReadProtoMessage(bufio.NewReader(bytes.NewReader(data)), &wire); err != nil {
+			return
+		}
+		friends.DecodeFriendRequestProto(&wire)
+	})
+}
@@ -0,0 +1,172 @@
+package friends
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ErrInvalidNotice is returned for account deletion notices that are
+// malformed or not signed by the peer they name
+var ErrInvalidNotice = errors.New("invalid account deletion notice")
+
+// AccountDeletedNotice tells friends an account is gone. It is signed by the
+// key behind the account's peer ID, so only the account's own node can send it.
+type AccountDeletedNotice struct {
+	Username  string `json:"username"`
+	PeerID    string `json:"peer_id"`
+	DeletedAt int64  `json:"deleted_at"` // Unix seconds
+	Signature []byte `json:"signature"`
+}
+
+// signedBytes returns the bytes covered by the signature
+func (n *AccountDeletedNotice) signedBytes() []byte {
+	return []byte(fmt.Sprintf("whisper-account-deleted:%s:%s:%d", n.Username, n.PeerID, n.DeletedAt))
+}
+
+// NewAccountDeletedNotice signs a notice that username, on the node behind
+// privKey, was deleted at now
+func NewAccountDeletedNotice(privKey crypto.PrivKey, username string, now time.Time) (*AccountDeletedNotice, error) {
+	id, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive peer ID: %w", err)
+	}
+
+	notice := &AccountDeletedNotice{
+		Username:  username,
+		PeerID:    id.String(),
+		DeletedAt: now.Unix(),
+	}
+	notice.Signature, err = privKey.Sign(notice.signedBytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign account deletion notice: %w", err)
+	}
+	return notice, nil
+}
+
+// Verify checks the notice's fields and its signature against the key
+// embedded in its peer ID
+func (n *AccountDeletedNotice) Verify() error {
+	if err := p2p.CheckTextField("username", n.Username, p2p.MaxUsernameLength, true); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidNotice, err)
+	}
+	id, err := peer.Decode(n.PeerID)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidNotice, err)
+	}
+	pubKey, err := id.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidNotice, err)
+	}
+	ok, err := pubKey.Verify(n.signedBytes(), n.Signature)
+	if err != nil || !ok {
+		return fmt.Errorf("%w: bad signature", ErrInvalidNotice)
+	}
+	return nil
+}
+
+// SetContactDeletedHandler sets a callback for when a friend deletes their account
+func (m *Manager) SetContactDeletedHandler(handler func(contact *storage.User)) {
+	m.contactDeletedHandler = handler
+}
+
+// AnnounceAccountDeleted tells the current user's friends their account is
+// being deleted. Connected friends are told now; a notice for each of the
+// others is kept and delivered when they next connect (see
+// DeliverDeletionNotice), so it outlives the account itself.
+func (m *Manager) AnnounceAccountDeleted(ctx context.Context, currentUser *storage.User) (delivered, queued int, err error) {
+	if m.currentUserID == 0 {
+		return 0, 0, ErrNotAuthenticated
+	}
+
+	notice, err := NewAccountDeletedNotice(m.host.Peerstore().PrivKey(m.host.ID()), currentUser.Username, time.Now())
+	if err != nil {
+		return 0, 0, err
+	}
+	data, err := json.Marshal(notice)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to marshal account deletion notice: %w", err)
+	}
+
+	friends, err := m.storage.GetFriends(ctx, currentUser.ID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get friends: %w", err)
+	}
+	for _, friend := range friends {
+		peerID, err := peer.Decode(friend.PeerID)
+		if err != nil {
+			continue
+		}
+		if m.host.Network().Connectedness(peerID) == network.Connected {
+			if err := m.sendAccountDeleted(ctx, peerID, notice); err == nil {
+				delivered++
+				continue
+			}
+		}
+		if err := m.storage.SaveDeletionNotice(ctx, &storage.DeletionNotice{PeerID: friend.PeerID, Notice: string(data)}); err != nil {
+			return delivered, queued, fmt.Errorf("failed to queue account deletion notice: %w", err)
+		}
+		queued++
+	}
+	return delivered, queued, nil
+}
+
+// DeliverDeletionNotice sends a peer the account deletion notice waiting for
+// them, if any, and forgets it once sent
+func (m *Manager) DeliverDeletionNotice(ctx context.Context, peerID peer.ID) {
+	saved, err := m.storage.GetDeletionNotice(ctx, peerID.String())
+	if err != nil || saved == nil {
+		return
+	}
+	var notice AccountDeletedNotice
+	if err := json.Unmarshal([]byte(saved.Notice), &notice); err != nil {
+		m.storage.DeleteDeletionNotice(ctx, peerID.String())
+		return
+	}
+	if err := m.sendAccountDeleted(ctx, peerID, &notice); err != nil {
+		return
+	}
+	if err := m.storage.DeleteDeletionNotice(ctx, peerID.String()); err != nil {
+		i18n.Printf("Warning: Failed to clear account deletion notice: %v\n", err)
+	}
+}
+
+// sendAccountDeleted opens a stream to a peer and sends them a notice
+func (m *Manager) sendAccountDeleted(ctx context.Context, peerID peer.ID, notice *AccountDeletedNotice) error {
+	stream, err := m.host.NewStream(ctx, peerID, ProtocolAccountDeleted)
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+	return SendAccountDeletedNotice(ctx, stream, notice)
+}
+
+// handleAccountDeleted marks a friend who deleted their account, so nothing
+// more is queued or retried for them
+func (m *Manager) handleAccountDeleted(notice *AccountDeletedNotice, fromPeer peer.ID) {
+	ctx := context.Background()
+	if notice.PeerID != fromPeer.String() {
+		return
+	}
+
+	contact, err := m.storage.GetUserByPeerID(ctx, notice.PeerID)
+	if err != nil || !contact.IsRemote() || contact.RemoteName() != notice.Username {
+		return
+	}
+	if err := m.storage.MarkContactDeleted(ctx, notice.PeerID); err != nil {
+		i18n.Printf("Warning: Failed to mark %s as deleted: %v\n", contact.Username, err)
+		return
+	}
+
+	if m.contactDeletedHandler != nil {
+		m.contactDeletedHandler(contact)
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
 	"github.com/austinwklein/whisper/storage"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -17,6 +21,11 @@ var (
 	ErrPendingRequest   = errors.New("friend request already pending")
 	ErrRequestNotFound  = errors.New("friend request not found")
 	ErrCannotAddSelf    = errors.New("cannot add yourself as friend")
+	ErrNotFriends       = errors.New("not friends with this user")
+	ErrAlreadyTrusted   = errors.New("identity is already trusted")
+	ErrInvalidName      = fmt.Errorf("names must be 1-%d characters without spaces", p2p.MaxUsernameLength)
+	ErrInvalidFullName  = fmt.Errorf("full names must be 1-%d bytes", p2p.MaxFullNameLength)
+	ErrInvalidStatus    = fmt.Errorf("status messages must be at most %d bytes", p2p.MaxStatusLength)
 )
 
 // Manager handles friend operations
@@ -25,6 +34,21 @@ type Manager struct {
 	host          host.Host
 	protocol      *Protocol
 	currentUserID int64
+
+	sentRequestHandler    func(request *storage.Friend) // Told when a sent request is answered
+	contactUpdatedHandler func(update *ContactUpdated)  // Told when a friend's profile changes
+	contactDeletedHandler func(contact *storage.User)   // Told when a friend deletes their account
+	requestPolicy         func(ctx context.Context, from peer.ID) bool
+	offenseHandler        func(pid peer.ID, offense string) // Told when a peer misbehaves
+
+	// requestMu serializes checking for and recording requests, so a request
+	// we send and one arriving from the same peer always see each other
+	requestMu sync.Mutex
+	sentTo    map[peer.ID]bool // Requests sent to peers we had no contact record for
+
+	rosterMu       sync.Mutex
+	rosterRequests map[peer.ID]*PendingRoster // Friend list requests awaiting the user's answer
+	rosterAsked    map[peer.ID]time.Time      // Peers we asked for our friend list, and when
 }
 
 // NewManager creates a new friend manager
@@ -35,17 +59,34 @@ func NewManager(store storage.Storage, h host.Host) *Manager {
 		storage:  store,
 		host:     h,
 		protocol: protocol,
+		sentTo:   make(map[peer.ID]bool),
+
+		rosterRequests: make(map[peer.ID]*PendingRoster),
+		rosterAsked:    make(map[peer.ID]time.Time),
 	}
 
 	// Set up protocol handlers
 	protocol.SetRequestHandler(mgr.handleIncomingRequest)
 	protocol.SetAcceptHandler(mgr.handleIncomingAccept)
 	protocol.SetRejectHandler(mgr.handleIncomingReject)
+	protocol.SetProfileHandler(mgr.handleProfile)
+	protocol.SetAccountDeletedHandler(mgr.handleAccountDeleted)
+	protocol.SetRosterRequestHandler(mgr.handleRosterRequest)
+	protocol.SetRosterHandler(mgr.handleRoster)
+	protocol.SetInvalidHandler(func(pid peer.ID) { mgr.reportOffense(pid, storage.PeerOffenseInvalidMessage) })
 
 	// Register stream handlers
-	h.SetStreamHandler(ProtocolFriendRequest, protocol.HandleFriendRequest)
-	h.SetStreamHandler(ProtocolFriendAccept, protocol.HandleFriendAccept)
-	h.SetStreamHandler(ProtocolFriendReject, protocol.HandleFriendReject)
+	p2p.HandleStreams(h, protocol.HandleFriendRequest, ProtocolFriendRequestV2, ProtocolFriendRequest)
+	p2p.HandleStreams(h, protocol.HandleFriendAccept, ProtocolFriendAcceptV2, ProtocolFriendAccept)
+	p2p.HandleStreams(h, protocol.HandleFriendReject, ProtocolFriendRejectV2, ProtocolFriendReject)
+	p2p.HandleStreams(h, protocol.HandleProfile, ProtocolProfile)
+	p2p.HandleStreams(h, protocol.HandleAccountDeleted, ProtocolAccountDeleted)
+	p2p.HandleStreams(h, protocol.HandleRosterRequest, ProtocolRosterRequest)
+	p2p.HandleStreams(h, protocol.HandleRoster, ProtocolRoster)
+
+	// Friends who can't exchange requests can't become friends at all
+	p2p.RequireProtocol(ProtocolFriendRequestV2, ProtocolFriendRequest)
+	p2p.RequireProtocol(ProtocolFriendAcceptV2, ProtocolFriendAccept)
 
 	return mgr
 }
@@ -55,6 +96,48 @@ func (m *Manager) SetCurrentUser(userID int64) {
 	m.currentUserID = userID
 }
 
+// SetSentRequestHandler sets a callback for when a request the current user sent
+// is accepted or rejected. Without one, the manager prints the answer itself.
+func (m *Manager) SetSentRequestHandler(handler func(request *storage.Friend)) {
+	m.sentRequestHandler = handler
+}
+
+// SetRequestPolicy sets a callback reporting whether friend requests from a
+// peer are wanted; without one they always are. Unwanted requests are dropped.
+func (m *Manager) SetRequestPolicy(handler func(ctx context.Context, from peer.ID) bool) {
+	m.requestPolicy = handler
+}
+
+// SetOffenseHandler sets the handler told when a peer misbehaves toward us,
+// with the storage.PeerOffense* it committed: a malformed message, or a
+// friend request the user rejected
+func (m *Manager) SetOffenseHandler(handler func(pid peer.ID, offense string)) {
+	m.offenseHandler = handler
+}
+
+// reportOffense tells the offense handler about a peer
+func (m *Manager) reportOffense(pid peer.ID, offense string) {
+	if m.offenseHandler != nil {
+		m.offenseHandler(pid, offense)
+	}
+}
+
+// SendFriendRequestTo sends a friend request to a peer known only by the
+// username they go by, e.g. from a conference roster. They are recorded as a
+// contact first, so the request shows in 'sent-requests'.
+func (m *Manager) SendFriendRequestTo(ctx context.Context, currentUser *storage.User, targetPeerID peer.ID, username string) error {
+	if m.currentUserID == 0 {
+		return ErrNotAuthenticated
+	}
+	if targetPeerID.String() == currentUser.PeerID {
+		return ErrCannotAddSelf
+	}
+	if _, err := m.contactFor(ctx, targetPeerID, username, username); err != nil {
+		return fmt.Errorf("failed to record contact: %w", err)
+	}
+	return m.SendFriendRequest(ctx, currentUser, targetPeerID)
+}
+
 // SendFriendRequest sends a friend request to another user
 func (m *Manager) SendFriendRequest(ctx context.Context, currentUser *storage.User, targetPeerID peer.ID) error {
 	if m.currentUserID == 0 {
@@ -66,21 +149,43 @@ func (m *Manager) SendFriendRequest(ctx context.Context, currentUser *storage.Us
 		return ErrCannotAddSelf
 	}
 
-	// Check if target user exists in our local database
+	// Check if target user exists in our local database. A peer we have only
+	// identified becomes a contact now, so the request shows in 'sent-requests'.
 	targetUser, err := m.storage.GetUserByPeerID(ctx, targetPeerID.String())
-	if err == nil && targetUser != nil {
+	if errors.Is(err, storage.ErrNotFound) {
+		if known, _ := m.storage.GetKnownPeer(ctx, targetPeerID.String()); known != nil && known.Username != "" {
+			targetUser, err = m.contactFor(ctx, targetPeerID, known.Username, known.Username)
+		}
+	}
+	known := err == nil
+	m.requestMu.Lock()
+	if known {
 		// Target user exists locally - check if already friends or request pending
 		existingFriend, err := m.storage.GetFriendRequest(ctx, currentUser.ID, targetUser.ID)
 		if err != nil {
+			m.requestMu.Unlock()
 			return fmt.Errorf("failed to check existing friendship: %w", err)
 		}
 		if existingFriend != nil {
+			m.requestMu.Unlock()
 			if existingFriend.Status == "accepted" {
 				return ErrAlreadyFriends
 			}
 			return ErrPendingRequest
 		}
 
+		// They already asked us - adding them back accepts their request
+		incoming, err := m.storage.GetFriendRequest(ctx, targetUser.ID, currentUser.ID)
+		if err != nil {
+			m.requestMu.Unlock()
+			return fmt.Errorf("failed to check existing friendship: %w", err)
+		}
+		if incoming != nil && incoming.Status == "pending" {
+			m.requestMu.Unlock()
+			i18n.Printf("%s already sent you a friend request - accepting it\n", targetUser.FullName)
+			return m.acceptRequest(ctx, currentUser, incoming)
+		}
+
 		// Create friend request in database
 		friend := &storage.Friend{
 			UserID:   currentUser.ID,
@@ -92,14 +197,19 @@ func (m *Manager) SendFriendRequest(ctx context.Context, currentUser *storage.Us
 		}
 
 		if err := m.storage.CreateFriendRequest(ctx, friend); err != nil {
+			m.requestMu.Unlock()
 			return fmt.Errorf("failed to create friend request: %w", err)
 		}
+	} else {
+		// If target user isn't known at all, we'll still send the P2P request
+		// The receiving side will handle creating the user record and friendship.
+		// Remember it, so a request crossing ours is recognized as mutual.
+		m.sentTo[targetPeerID] = true
 	}
-	// If target user doesn't exist locally, we'll still send the P2P request
-	// The receiving side will handle creating the user record and friendship
+	m.requestMu.Unlock()
 
 	// Send friend request over P2P
-	stream, err := m.host.NewStream(ctx, targetPeerID, ProtocolFriendRequest)
+	stream, err := m.host.NewStream(ctx, targetPeerID, ProtocolFriendRequestV2, ProtocolFriendRequest)
 	if err != nil {
 		return fmt.Errorf("failed to open stream: %w", err)
 	}
@@ -115,198 +225,549 @@ func (m *Manager) SendFriendRequest(ctx context.Context, currentUser *storage.Us
 		return fmt.Errorf("failed to send friend request: %w", err)
 	}
 
-	if targetUser != nil {
-		fmt.Printf("✓ Friend request sent to %s (%s)\n", targetUser.FullName, targetUser.Username)
+	if known {
+		i18n.Printf("✓ Friend request sent to %s (%s)\n", targetUser.FullName, targetUser.Username)
 	} else {
-		fmt.Printf("✓ Friend request sent to peer %s\n", targetPeerID.String()[:16]+"...")
+		i18n.Printf("✓ Friend request sent to peer %s\n", targetPeerID.String()[:16]+"...")
 	}
 	return nil
 }
 
-// AcceptFriendRequest accepts a pending friend request
+// AcceptFriendRequest accepts the pending friend request from a username
 func (m *Manager) AcceptFriendRequest(ctx context.Context, currentUser *storage.User, fromUsername string) error {
 	if m.currentUserID == 0 {
 		return ErrNotAuthenticated
 	}
 
-	// Get the requesting user
-	fromUser, err := m.storage.GetUserByUsername(ctx, fromUsername)
+	friendRequest, err := m.incomingRequestFrom(ctx, currentUser, fromUsername)
 	if err != nil {
-		return fmt.Errorf("failed to get user: %w", err)
+		return err
 	}
-	if fromUser == nil {
-		return errors.New("requesting user not found")
+	return m.acceptRequest(ctx, currentUser, friendRequest)
+}
+
+// AcceptFriendRequestByID accepts a pending friend request by the ID shown in 'requests'
+func (m *Manager) AcceptFriendRequestByID(ctx context.Context, currentUser *storage.User, requestID int64) error {
+	if m.currentUserID == 0 {
+		return ErrNotAuthenticated
+	}
+
+	friendRequest, err := m.incomingRequest(ctx, currentUser, requestID)
+	if err != nil {
+		return err
+	}
+	return m.acceptRequest(ctx, currentUser, friendRequest)
+}
+
+// RejectFriendRequest rejects the pending friend request from a username
+func (m *Manager) RejectFriendRequest(ctx context.Context, currentUser *storage.User, fromUsername string) error {
+	if m.currentUserID == 0 {
+		return ErrNotAuthenticated
+	}
+
+	friendRequest, err := m.incomingRequestFrom(ctx, currentUser, fromUsername)
+	if err != nil {
+		return err
+	}
+	return m.rejectRequest(ctx, currentUser, friendRequest)
+}
+
+// RejectFriendRequestByID rejects a pending friend request by the ID shown in 'requests'
+func (m *Manager) RejectFriendRequestByID(ctx context.Context, currentUser *storage.User, requestID int64) error {
+	if m.currentUserID == 0 {
+		return ErrNotAuthenticated
+	}
+
+	friendRequest, err := m.incomingRequest(ctx, currentUser, requestID)
+	if err != nil {
+		return err
+	}
+	return m.rejectRequest(ctx, currentUser, friendRequest)
+}
+
+// incomingRequestFrom finds the friend request a username sent the current user
+func (m *Manager) incomingRequestFrom(ctx context.Context, currentUser *storage.User, fromUsername string) (*storage.Friend, error) {
+	fromUser, err := m.storage.GetUserByUsername(ctx, fromUsername)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, errors.New("requesting user not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
 
-	// Get the friend request (where fromUser sent request to currentUser)
 	friendRequest, err := m.storage.GetFriendRequest(ctx, fromUser.ID, currentUser.ID)
 	if err != nil {
-		return fmt.Errorf("failed to get friend request: %w", err)
+		return nil, fmt.Errorf("failed to get friend request: %w", err)
 	}
 	if friendRequest == nil {
-		return ErrRequestNotFound
+		return nil, ErrRequestNotFound
+	}
+	return friendRequest, nil
+}
+
+// incomingRequest loads a friend request by ID, making sure it was sent to the current user
+func (m *Manager) incomingRequest(ctx context.Context, currentUser *storage.User, requestID int64) (*storage.Friend, error) {
+	friendRequest, err := m.storage.GetFriendRequestByID(ctx, requestID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get friend request: %w", err)
 	}
+	if friendRequest == nil || friendRequest.FriendID != currentUser.ID {
+		return nil, ErrRequestNotFound
+	}
+	return friendRequest, nil
+}
 
+// acceptRequest accepts a pending request sent to the current user and tells the sender
+func (m *Manager) acceptRequest(ctx context.Context, currentUser *storage.User, friendRequest *storage.Friend) error {
 	if friendRequest.Status != "pending" {
 		return errors.New("request is not pending")
 	}
 
-	// Update request status
-	friendRequest.Status = "accepted"
-	now := time.Now()
-	friendRequest.AcceptedAt = now
+	fromUser, err := m.storage.GetUserByID(ctx, friendRequest.UserID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return errors.New("requesting user not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
 
-	if err := m.storage.UpdateFriendRequest(ctx, friendRequest); err != nil {
-		return fmt.Errorf("failed to update friend request: %w", err)
+	// Mark both directions accepted. If we had also asked them, our own
+	// request is already stored and is accepted rather than duplicated.
+	m.requestMu.Lock()
+	err = m.establishFriendship(ctx, currentUser, fromUser)
+	m.requestMu.Unlock()
+	if err != nil {
+		return err
 	}
 
-	// Create reciprocal friendship (currentUser -> fromUser)
-	reciprocalFriend := &storage.Friend{
-		UserID:     currentUser.ID,
-		FriendID:   fromUser.ID,
-		PeerID:     fromUser.PeerID,
-		Username:   fromUser.Username,
-		FullName:   fromUser.FullName,
-		Status:     "accepted",
-		AcceptedAt: now,
+	if err := m.sendAccept(ctx, currentUser, fromUser); err != nil {
+		return err
 	}
 
-	if err := m.storage.CreateFriendRequest(ctx, reciprocalFriend); err != nil {
-		return fmt.Errorf("failed to create reciprocal friendship: %w", err)
+	m.recordSystemMessage(ctx, currentUser, fromUser, fmt.Sprintf("You are now friends with %s.", fromUser.FullName))
+
+	i18n.Printf("✓ Accepted friend request from %s\n", fromUser.FullName)
+	return nil
+}
+
+// establishFriendship marks the friendship accepted in both directions,
+// creating whichever rows don't exist yet. Callers hold requestMu.
+func (m *Manager) establishFriendship(ctx context.Context, currentUser, contact *storage.User) error {
+	now := time.Now()
+	for _, pair := range [][2]*storage.User{{contact, currentUser}, {currentUser, contact}} {
+		from, to := pair[0], pair[1]
+		row, err := m.storage.GetFriendRequest(ctx, from.ID, to.ID)
+		if err != nil {
+			return fmt.Errorf("failed to get friend request: %w", err)
+		}
+		if row == nil {
+			// Both directions hold the contact's details
+			row = &storage.Friend{
+				UserID:        from.ID,
+				FriendID:      to.ID,
+				PeerID:        contact.PeerID,
+				Username:      contact.Username,
+				FullName:      contact.FullName,
+				StatusMessage: contact.StatusMessage,
+				Status:        "accepted",
+				AcceptedAt:    now,
+			}
+			if err := m.storage.CreateFriendRequest(ctx, row); err != nil {
+				return fmt.Errorf("failed to create friendship: %w", err)
+			}
+			continue
+		}
+		if row.Status != "accepted" {
+			row.Status = "accepted"
+			row.AcceptedAt = now
+			if err := m.storage.UpdateFriendRequest(ctx, row); err != nil {
+				return fmt.Errorf("failed to update friend request: %w", err)
+			}
+		}
 	}
+	return nil
+}
 
-	// Send acceptance notification
-	peerID, err := peer.Decode(fromUser.PeerID)
+// sendAccept tells a contact we accepted their request. Failing to reach them
+// is only a warning: the friendship is stored either way.
+func (m *Manager) sendAccept(ctx context.Context, currentUser, contact *storage.User) error {
+	peerID, err := peer.Decode(contact.PeerID)
 	if err != nil {
 		return fmt.Errorf("invalid peer ID: %w", err)
 	}
 
-	stream, err := m.host.NewStream(ctx, peerID, ProtocolFriendAccept)
+	stream, err := m.host.NewStream(ctx, peerID, ProtocolFriendAcceptV2, ProtocolFriendAccept)
 	if err != nil {
 		// Not fatal if we can't notify - friendship is still established
-		fmt.Printf("Warning: Could not notify peer of acceptance: %v\n", err)
-	} else {
-		response := &FriendResponseMessage{
-			Accepted: true,
-			Username: currentUser.Username,
-			FullName: currentUser.FullName,
-			PeerID:   currentUser.PeerID,
-			Message:  fmt.Sprintf("%s accepted your friend request", currentUser.FullName),
-		}
-		SendFriendResponse(ctx, stream, response)
+		i18n.Printf("Warning: Could not notify peer of acceptance: %v\n", err)
+		return nil
 	}
+	response := &FriendResponseMessage{
+		Accepted: true,
+		Username: currentUser.Username,
+		FullName: currentUser.FullName,
+		PeerID:   currentUser.PeerID,
+		Message:  fmt.Sprintf("%s accepted your friend request", currentUser.FullName),
+	}
+	SendFriendResponse(ctx, stream, response)
+	return nil
+}
 
-	fmt.Printf("✓ Accepted friend request from %s\n", fromUser.FullName)
+// rejectRequest rejects a pending request sent to the current user and tells the sender
+func (m *Manager) rejectRequest(ctx context.Context, currentUser *storage.User, friendRequest *storage.Friend) error {
+	if friendRequest.Status != "pending" {
+		return errors.New("request is not pending")
+	}
+
+	fromUser, err := m.storage.GetUserByID(ctx, friendRequest.UserID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return errors.New("requesting user not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+
+	// Update request status
+	friendRequest.Status = "rejected"
+	if err := m.storage.UpdateFriendRequest(ctx, friendRequest); err != nil {
+		return fmt.Errorf("failed to update friend request: %w", err)
+	}
+
+	if err := m.sendReject(ctx, currentUser, fromUser); err != nil {
+		return err
+	}
+
+	i18n.Printf("✓ Rejected friend request from %s\n", fromUser.FullName)
 	return nil
 }
 
-// RejectFriendRequest rejects a pending friend request
-func (m *Manager) RejectFriendRequest(ctx context.Context, currentUser *storage.User, fromUsername string) error {
+// sendReject tells a contact we declined their request, and counts it against
+// their reputation. Failing to reach them is only a warning: the request stays
+// rejected either way.
+func (m *Manager) sendReject(ctx context.Context, currentUser, contact *storage.User) error {
+	peerID, err := peer.Decode(contact.PeerID)
+	if err != nil {
+		return fmt.Errorf("invalid peer ID: %w", err)
+	}
+	m.reportOffense(peerID, storage.PeerOffenseRejectedRequest)
+
+	stream, err := m.host.NewStream(ctx, peerID, ProtocolFriendRejectV2, ProtocolFriendReject)
+	if err != nil {
+		i18n.Printf("Warning: Could not notify peer of rejection: %v\n", err)
+		return nil
+	}
+	response := &FriendResponseMessage{
+		Accepted: false,
+		Username: currentUser.Username,
+		FullName: currentUser.FullName,
+		PeerID:   currentUser.PeerID,
+		Message:  "Friend request was declined",
+	}
+	SendFriendResponse(ctx, stream, response)
+	return nil
+}
+
+// AcceptAllFriendRequests accepts every pending request sent to the current
+// user at once, tells each sender and returns the accepted requests
+func (m *Manager) AcceptAllFriendRequests(ctx context.Context, currentUser *storage.User) ([]*storage.Friend, error) {
 	if m.currentUserID == 0 {
-		return ErrNotAuthenticated
+		return nil, ErrNotAuthenticated
 	}
 
-	// Get the requesting user
-	fromUser, err := m.storage.GetUserByUsername(ctx, fromUsername)
+	m.requestMu.Lock()
+	accepted, err := m.storage.AcceptAllFriendRequests(ctx, currentUser.ID)
+	m.requestMu.Unlock()
 	if err != nil {
-		return fmt.Errorf("failed to get user: %w", err)
+		return nil, fmt.Errorf("failed to accept friend requests: %w", err)
 	}
-	if fromUser == nil {
-		return errors.New("requesting user not found")
+
+	for _, request := range accepted {
+		contact, err := m.storage.GetUserByID(ctx, request.UserID)
+		if err != nil {
+			continue
+		}
+		if err := m.sendAccept(ctx, currentUser, contact); err != nil {
+			i18n.Printf("Warning: Could not notify peer of acceptance: %v\n", err)
+		}
+		m.recordSystemMessage(ctx, currentUser, contact, fmt.Sprintf("You are now friends with %s.", contact.FullName))
 	}
+	return accepted, nil
+}
 
-	// Get the friend request
-	friendRequest, err := m.storage.GetFriendRequest(ctx, fromUser.ID, currentUser.ID)
+// RejectAllFriendRequests rejects every pending request sent to the current
+// user at once, tells each sender and returns the rejected requests
+func (m *Manager) RejectAllFriendRequests(ctx context.Context, currentUser *storage.User) ([]*storage.Friend, error) {
+	if m.currentUserID == 0 {
+		return nil, ErrNotAuthenticated
+	}
+
+	rejected, err := m.storage.RejectAllFriendRequests(ctx, currentUser.ID)
 	if err != nil {
-		return fmt.Errorf("failed to get friend request: %w", err)
+		return nil, fmt.Errorf("failed to reject friend requests: %w", err)
 	}
-	if friendRequest == nil {
-		return ErrRequestNotFound
+
+	for _, request := range rejected {
+		contact, err := m.storage.GetUserByID(ctx, request.UserID)
+		if err != nil {
+			continue
+		}
+		if err := m.sendReject(ctx, currentUser, contact); err != nil {
+			i18n.Printf("Warning: Could not notify peer of rejection: %v\n", err)
+		}
 	}
+	return rejected, nil
+}
 
-	if friendRequest.Status != "pending" {
-		return errors.New("request is not pending")
+// RenameContact changes the name a contact is shown and addressed by locally.
+// They keep their own username; messages to them still use it.
+func (m *Manager) RenameContact(ctx context.Context, username, newName string) error {
+	if newName == "" || len(newName) > p2p.MaxUsernameLength || strings.ContainsAny(newName, " \t") {
+		return ErrInvalidName
 	}
 
-	// Update request status
-	friendRequest.Status = "rejected"
-	if err := m.storage.UpdateFriendRequest(ctx, friendRequest); err != nil {
-		return fmt.Errorf("failed to update friend request: %w", err)
+	contact, err := m.storage.GetUserByUsername(ctx, username)
+	if errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("user '%s' not found", username)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up user: %w", err)
 	}
+	return m.storage.RenameContact(ctx, contact.ID, newName)
+}
 
-	// Send rejection notification
-	peerID, err := peer.Decode(fromUser.PeerID)
+// SetAutoDial turns automatic dialing of a friend on or off
+func (m *Manager) SetAutoDial(ctx context.Context, currentUser *storage.User, username string, enabled bool) error {
+	friendUser, err := m.storage.GetUserByUsername(ctx, username)
+	if errors.Is(err, storage.ErrNotFound) {
+		return ErrNotFriends
+	}
 	if err != nil {
-		return fmt.Errorf("invalid peer ID: %w", err)
+		return fmt.Errorf("failed to look up user: %w", err)
+	}
+
+	err = m.storage.SetFriendAutoDial(ctx, currentUser.ID, friendUser.ID, enabled)
+	if errors.Is(err, storage.ErrNotFriends) {
+		return ErrNotFriends
 	}
+	return err
+}
 
-	stream, err := m.host.NewStream(ctx, peerID, ProtocolFriendReject)
+// GetNameCollisions returns users registered under the same username as someone
+// else, grouped by that username
+func (m *Manager) GetNameCollisions(ctx context.Context) ([]*storage.User, error) {
+	return m.storage.GetUsernameCollisions(ctx)
+}
+
+// TrustFriend accepts the identity that claimed to be a friend, so messages
+// go to it from now on. The caller releases the messages held from it.
+func (m *Manager) TrustFriend(ctx context.Context, currentUser *storage.User, username string) error {
+	if m.currentUserID == 0 {
+		return ErrNotAuthenticated
+	}
+
+	friendUser, err := m.storage.GetUserByUsername(ctx, username)
+	if errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("user '%s' not found", username)
+	}
 	if err != nil {
-		fmt.Printf("Warning: Could not notify peer of rejection: %v\n", err)
-	} else {
-		response := &FriendResponseMessage{
-			Accepted: false,
-			Username: currentUser.Username,
-			FullName: currentUser.FullName,
-			PeerID:   currentUser.PeerID,
-			Message:  "Friend request was declined",
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+
+	// Trust the identity that has claimed to be them, if one has
+	candidate, err := m.storage.GetIdentityCandidate(ctx, friendUser.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get changed identity: %w", err)
+	}
+
+	// Update both directions of the friendship to the new peer ID
+	found, updated := false, false
+	for _, pair := range [][2]int64{{currentUser.ID, friendUser.ID}, {friendUser.ID, currentUser.ID}} {
+		friendship, err := m.storage.GetFriendRequest(ctx, pair[0], pair[1])
+		if err != nil {
+			return fmt.Errorf("failed to get friendship: %w", err)
+		}
+		if friendship == nil || friendship.Status != "accepted" {
+			continue
+		}
+		found = true
+		if candidate != nil {
+			friendUser.PeerID = candidate.PeerID
+		}
+		if friendship.PeerID == friendUser.PeerID {
+			continue
+		}
+		friendship.PeerID = friendUser.PeerID
+		if err := m.storage.UpdateFriendRequest(ctx, friendship); err != nil {
+			return fmt.Errorf("failed to update friendship: %w", err)
+		}
+		updated = true
+	}
+
+	if !found {
+		return ErrNotFriends
+	}
+	if !updated {
+		return ErrAlreadyTrusted
+	}
+	if candidate != nil {
+		if err := m.storage.UpdateUser(ctx, friendUser); err != nil {
+			return fmt.Errorf("failed to update peer ID: %w", err)
+		}
+		if err := m.storage.ClearIdentityCandidate(ctx, friendUser.ID); err != nil {
+			i18n.Printf("Warning: Failed to clear changed identity: %v\n", err)
 		}
-		SendFriendResponse(ctx, stream, response)
 	}
 
-	fmt.Printf("✓ Rejected friend request from %s\n", fromUser.FullName)
+	m.recordSystemMessage(ctx, currentUser, friendUser, fmt.Sprintf("You marked %s's new safety number as trusted.", friendUser.Username))
+
+	i18n.Printf("✓ Trusted new identity for %s (%s)\n", friendUser.FullName, friendUser.Username)
 	return nil
 }
 
+// recordSystemMessage inserts a system message into the conversation with a contact
+func (m *Manager) recordSystemMessage(ctx context.Context, currentUser, contact *storage.User, content string) {
+	notice := &storage.Message{
+		FromUserID: contact.ID,
+		ToUserID:   currentUser.ID,
+		FromPeerID: contact.PeerID,
+		ToPeerID:   currentUser.PeerID,
+		Content:    content,
+		Kind:       storage.MessageKindSystem,
+		Delivered:  true,
+		Read:       true,
+		CreatedAt:  time.Now(),
+	}
+	if err := m.storage.SaveMessage(ctx, notice); err != nil {
+		i18n.Printf("Warning: Failed to record event in history: %v\n", err)
+	}
+}
+
+// contactActivity describes something a contact did, for the activity feed
+func contactActivity(kind string, contact *storage.User) *storage.Activity {
+	return &storage.Activity{Kind: kind, PeerID: contact.PeerID, Name: contact.Username}
+}
+
+// recordActivity adds an entry to the current user's activity feed
+func (m *Manager) recordActivity(ctx context.Context, currentUser *storage.User, activity *storage.Activity) {
+	activity.UserID = currentUser.ID
+	if err := m.storage.RecordActivity(ctx, activity); err != nil {
+		i18n.Printf("Warning: Failed to record activity: %v\n", err)
+	}
+}
+
 // GetFriends returns all accepted friends
 func (m *Manager) GetFriends(ctx context.Context, userID int64) ([]*storage.Friend, error) {
 	return m.storage.GetFriends(ctx, userID)
 }
 
+// GetFriendsFiltered returns friends with conversation details, filtered and sorted
+func (m *Manager) GetFriendsFiltered(ctx context.Context, userID int64, filter storage.FriendFilter) ([]*storage.FriendSummary, error) {
+	return m.storage.GetFriendsFiltered(ctx, userID, filter)
+}
+
 // GetPendingRequests returns all pending friend requests for a user
 func (m *Manager) GetPendingRequests(ctx context.Context, userID int64) ([]*storage.Friend, error) {
 	return m.storage.GetPendingFriendRequests(ctx, userID)
 }
 
+// GetSentRequests returns the friend requests a user has sent, newest first
+func (m *Manager) GetSentRequests(ctx context.Context, userID int64) ([]*storage.Friend, error) {
+	return m.storage.GetOutgoingFriendRequests(ctx, userID)
+}
+
+// contactFor returns the contact record for a peer, creating it if needed.
+// Contacts are keyed by peer ID: a second peer registered under a name we
+// already know is stored under a disambiguated handle (bob#1a2b) instead of
+// being mistaken for the first.
+func (m *Manager) contactFor(ctx context.Context, p peer.ID, username, fullName string) (*storage.User, error) {
+	contact, err := m.storage.GetUserByPeerID(ctx, p.String())
+	if err == nil {
+		return contact, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+
+	handle, err := m.storage.ContactHandle(ctx, username, p.String())
+	if err != nil {
+		return nil, err
+	}
+	contact = &storage.User{
+		Username:     handle,
+		PasswordHash: storage.RemoteUserPasswordHash, // Placeholder - they registered on another peer
+		FullName:     fullName,
+		PeerID:       p.String(),
+	}
+	if handle != username {
+		contact.RemoteUsername = username
+		i18n.Printf("\n⚠️  Another user is already known as '%s'; showing %s (%s) as '%s'\n", username, fullName, p.String()[:16]+"...", handle)
+		i18n.Printf("   Use 'rename %s <name>' to pick a different name\n> ", handle)
+	}
+	if err := m.storage.CreateUser(ctx, contact); err != nil {
+		return nil, err
+	}
+	return contact, nil
+}
+
 // Protocol message handlers
 func (m *Manager) handleIncomingRequest(request *FriendRequestMessage, fromPeer peer.ID) {
 	ctx := context.Background()
+	if m.requestPolicy != nil && !m.requestPolicy(ctx, fromPeer) {
+		return
+	}
 
-	// First, check if this user exists in our database, if not create them
-	fromUser, err := m.storage.GetUserByUsername(ctx, request.FromUsername)
-	if err != nil || fromUser == nil {
-		// User doesn't exist - this is normal in P2P when someone contacts us
-		// Create a basic user record so we can store the friend request
-		fromUser = &storage.User{
-			Username:     request.FromUsername,
-			PasswordHash: "P2P_REMOTE_USER", // Placeholder - they registered on another peer
-			FullName:     request.FromFullName,
-			PeerID:       request.FromPeerID,
-		}
-		if err := m.storage.CreateUser(ctx, fromUser); err != nil {
-			fmt.Printf("Error creating user record for %s: %v\n", request.FromUsername, err)
-			return
-		}
+	// Find or create the sender's contact record; this is normal in P2P when someone contacts us
+	fromUser, err := m.contactFor(ctx, fromPeer, request.FromUsername, request.FromFullName)
+	if err != nil {
+		i18n.Printf("Error creating user record for %s: %v\n", request.FromUsername, err)
+		return
 	}
 
 	// Get current user
 	if m.currentUserID == 0 {
-		fmt.Printf("\n📨 Friend request from %s (%s) - login to accept/reject\n", request.FromFullName, request.FromUsername)
+		i18n.Printf("\n📨 Friend request from %s (%s) - login to accept/reject\n", request.FromFullName, fromUser.Username)
 		return
 	}
 
 	currentUser, err := m.storage.GetUserByID(ctx, m.currentUserID)
-	if err != nil || currentUser == nil {
-		fmt.Printf("Error: Could not get current user\n")
+	if err != nil {
+		i18n.Printf("Error: Could not get current user\n")
 		return
 	}
 
 	// If fromUser exists in DB, create the friend request record
 	if fromUser != nil && fromUser.ID > 0 {
+		m.requestMu.Lock()
+
+		// Our requests crossed: we asked them while their request was on its
+		// way. Both of us want the friendship, so accept it straight away.
+		outgoing, _ := m.storage.GetFriendRequest(ctx, currentUser.ID, fromUser.ID)
+		sentUnrecorded := m.sentTo[fromPeer]
+		delete(m.sentTo, fromPeer)
+		if outgoing == nil && sentUnrecorded {
+			// Record the request we sent before knowing them, ahead of theirs
+			outgoing = &storage.Friend{
+				UserID:   currentUser.ID,
+				FriendID: fromUser.ID,
+				PeerID:   fromUser.PeerID,
+				Username: fromUser.Username,
+				FullName: fromUser.FullName,
+				Status:   "pending",
+			}
+			if err := m.storage.CreateFriendRequest(ctx, outgoing); err != nil {
+				i18n.Printf("Warning: Failed to record friend request: %v\n", err)
+			}
+		}
+		if outgoing != nil && outgoing.Status == "pending" {
+			m.acceptMutualRequest(ctx, currentUser, fromUser)
+			return
+		}
+
 		// Check if request already exists
 		existing, _ := m.storage.GetFriendRequest(ctx, fromUser.ID, currentUser.ID)
 		if existing != nil {
-			fmt.Printf("\n📨 Friend request from %s (%s) already exists\n", request.FromFullName, request.FromUsername)
+			m.requestMu.Unlock()
+			i18n.Printf("\n📨 Friend request from %s (%s) already exists\n", request.FromFullName, fromUser.Username)
 			return
 		}
 
@@ -321,65 +782,130 @@ func (m *Manager) handleIncomingRequest(request *FriendRequestMessage, fromPeer
 		}
 
 		if err := m.storage.CreateFriendRequest(ctx, friendReq); err != nil {
-			fmt.Printf("Error saving friend request: %v\n", err)
+			i18n.Printf("Error saving friend request: %v\n", err)
+		} else {
+			activity := contactActivity(storage.ActivityFriendRequest, fromUser)
+			activity.Detail = request.Message
+			m.recordActivity(ctx, currentUser, activity)
 		}
+		m.requestMu.Unlock()
+	}
+
+	i18n.Printf("\n📨 Friend request from %s (%s)\n", request.FromFullName, fromUser.Username)
+	i18n.Printf("   Message: %s\n", request.Message)
+	i18n.Printf("   Use 'accept %s' or 'reject %s'\n", fromUser.Username, fromUser.Username)
+	i18n.Print("> ")
+}
+
+// acceptMutualRequest settles two requests that crossed into one friendship,
+// stored the same way on both sides whichever of us gets here first. Called
+// with requestMu held; releases it.
+func (m *Manager) acceptMutualRequest(ctx context.Context, currentUser, contact *storage.User) {
+	err := m.establishFriendship(ctx, currentUser, contact)
+	m.requestMu.Unlock()
+	if err != nil {
+		i18n.Printf("\nError accepting mutual friend request from %s: %v\n> ", contact.Username, err)
+		return
+	}
+
+	// They may not have seen our request yet; the accept settles their side
+	if err := m.sendAccept(ctx, currentUser, contact); err != nil {
+		i18n.Printf("Warning: Could not notify peer of acceptance: %v\n", err)
 	}
 
-	fmt.Printf("\n📨 Friend request from %s (%s)\n", request.FromFullName, request.FromUsername)
-	fmt.Printf("   Message: %s\n", request.Message)
-	fmt.Printf("   Use 'accept %s' or 'reject %s'\n", request.FromUsername, request.FromUsername)
-	fmt.Print("> ")
+	m.recordSystemMessage(ctx, currentUser, contact, fmt.Sprintf("You are now friends with %s.", contact.FullName))
+	m.recordActivity(ctx, currentUser, contactActivity(storage.ActivityFriendAdded, contact))
+
+	if m.sentRequestHandler != nil {
+		if sent, _ := m.storage.GetFriendRequest(ctx, currentUser.ID, contact.ID); sent != nil {
+			m.sentRequestHandler(sent)
+			return
+		}
+	}
+	i18n.Printf("\n🤝 You and %s sent each other friend requests\n", contact.FullName)
+	i18n.Printf("   You are now friends with %s (%s)\n", contact.FullName, contact.Username)
+	i18n.Print("> ")
 }
 
 func (m *Manager) handleIncomingAccept(response *FriendResponseMessage, fromPeer peer.ID) {
 	ctx := context.Background()
 
 	// Ensure the accepting user exists in our database
-	acceptingUser, err := m.storage.GetUserByUsername(ctx, response.Username)
-	if err != nil || acceptingUser == nil {
-		// Create user record for the accepting user
-		acceptingUser = &storage.User{
-			Username:     response.Username,
-			PasswordHash: "P2P_REMOTE_USER",
-			FullName:     response.FullName,
-			PeerID:       response.PeerID,
-		}
-		if err := m.storage.CreateUser(ctx, acceptingUser); err != nil {
-			fmt.Printf("Error creating user record for %s: %v\n", response.Username, err)
-			return
-		}
+	acceptingUser, err := m.contactFor(ctx, fromPeer, response.Username, response.FullName)
+	if err != nil {
+		i18n.Printf("Error creating user record for %s: %v\n", response.Username, err)
+		return
 	}
 
 	// Get current user
 	if m.currentUserID == 0 {
-		fmt.Printf("\n✓ %s accepted your friend request!\n", response.FullName)
-		fmt.Printf("   You are now friends with %s (%s)\n", response.FullName, response.Username)
-		fmt.Print("> ")
+		i18n.Printf("\n✓ %s accepted your friend request!\n", response.FullName)
+		i18n.Printf("   You are now friends with %s (%s)\n", response.FullName, acceptingUser.Username)
+		i18n.Print("> ")
 		return
 	}
 
 	currentUser, err := m.storage.GetUserByID(ctx, m.currentUserID)
-	if err != nil || currentUser == nil {
-		fmt.Printf("\n✓ %s accepted your friend request!\n", response.FullName)
-		fmt.Printf("   You are now friends with %s (%s)\n", response.FullName, response.Username)
-		fmt.Print("> ")
+	if err != nil {
+		i18n.Printf("\n✓ %s accepted your friend request!\n", response.FullName)
+		i18n.Printf("   You are now friends with %s (%s)\n", response.FullName, acceptingUser.Username)
+		i18n.Print("> ")
 		return
 	}
 
+	// A contact added from an identify record only had their username as a name
+	if response.FullName != "" && acceptingUser.FullName != response.FullName {
+		acceptingUser.FullName = response.FullName
+		if err := m.storage.UpdateUser(ctx, acceptingUser); err != nil {
+			i18n.Printf("Warning: Failed to update %s's name: %v\n", acceptingUser.Username, err)
+		}
+	}
+
+	m.requestMu.Lock()
+	delete(m.sentTo, fromPeer)
+
 	// Create bidirectional friendship records if they don't exist
-	// 1. Current user -> Accepting user (this should already exist as "pending")
+	// 1. Current user -> Accepting user (our sent request, normally "pending").
+	// A request sent before we knew the peer has no row yet; record it now.
 	existingRequest, _ := m.storage.GetFriendRequest(ctx, currentUser.ID, acceptingUser.ID)
-	if existingRequest != nil && existingRequest.Status == "pending" {
+	reciprocalFriend, _ := m.storage.GetFriendRequest(ctx, acceptingUser.ID, currentUser.ID)
+	if existingRequest != nil && existingRequest.Status == "accepted" && reciprocalFriend != nil && reciprocalFriend.Status == "accepted" {
+		// Already friends - the second accept of a mutual request
+		m.requestMu.Unlock()
+		return
+	}
+	if existingRequest == nil {
+		existingRequest = &storage.Friend{
+			UserID:   currentUser.ID,
+			FriendID: acceptingUser.ID,
+			PeerID:   acceptingUser.PeerID,
+			Username: acceptingUser.Username,
+			FullName: acceptingUser.FullName,
+			Status:   "pending",
+		}
+		if err := m.storage.CreateFriendRequest(ctx, existingRequest); err != nil {
+			i18n.Printf("Warning: Failed to record friend request: %v\n", err)
+		}
+	}
+	answered := existingRequest.Status == "pending"
+	if answered {
 		existingRequest.Status = "accepted"
-		now := time.Now()
-		existingRequest.AcceptedAt = now
+		existingRequest.AcceptedAt = time.Now()
+		existingRequest.FullName = acceptingUser.FullName
 		if err := m.storage.UpdateFriendRequest(ctx, existingRequest); err != nil {
-			fmt.Printf("Warning: Failed to update friend request: %v\n", err)
+			i18n.Printf("Warning: Failed to update friend request: %v\n", err)
 		}
 	}
 
-	// 2. Accepting user -> Current user (reciprocal friendship)
-	reciprocalFriend, _ := m.storage.GetFriendRequest(ctx, acceptingUser.ID, currentUser.ID)
+	// 2. Accepting user -> Current user (reciprocal friendship). If they had
+	// also asked us, their pending request is settled by this accept too.
+	if reciprocalFriend != nil && reciprocalFriend.Status == "pending" {
+		reciprocalFriend.Status = "accepted"
+		reciprocalFriend.AcceptedAt = time.Now()
+		if err := m.storage.UpdateFriendRequest(ctx, reciprocalFriend); err != nil {
+			i18n.Printf("Warning: Failed to update friend request: %v\n", err)
+		}
+	}
 	if reciprocalFriend == nil {
 		reciprocalFriend = &storage.Friend{
 			UserID:     acceptingUser.ID,
@@ -391,16 +917,66 @@ func (m *Manager) handleIncomingAccept(response *FriendResponseMessage, fromPeer
 			AcceptedAt: time.Now(),
 		}
 		if err := m.storage.CreateFriendRequest(ctx, reciprocalFriend); err != nil {
-			fmt.Printf("Warning: Failed to create reciprocal friendship: %v\n", err)
+			i18n.Printf("Warning: Failed to create reciprocal friendship: %v\n", err)
 		}
 	}
+	m.requestMu.Unlock()
 
-	fmt.Printf("\n✓ %s accepted your friend request!\n", response.FullName)
-	fmt.Printf("   You are now friends with %s (%s)\n", response.FullName, response.Username)
-	fmt.Print("> ")
+	m.recordSystemMessage(ctx, currentUser, acceptingUser, fmt.Sprintf("You are now friends with %s.", acceptingUser.FullName))
+	m.recordActivity(ctx, currentUser, contactActivity(storage.ActivityFriendAdded, acceptingUser))
+
+	if answered && m.sentRequestHandler != nil {
+		m.sentRequestHandler(existingRequest)
+		return
+	}
+	i18n.Printf("\n✓ %s accepted your friend request!\n", response.FullName)
+	i18n.Printf("   You are now friends with %s (%s)\n", response.FullName, acceptingUser.Username)
+	i18n.Print("> ")
 }
 
 func (m *Manager) handleIncomingReject(response *FriendResponseMessage, fromPeer peer.ID) {
-	fmt.Printf("\n✗ %s declined your friend request\n", response.FullName)
-	fmt.Print("> ")
+	ctx := context.Background()
+
+	m.requestMu.Lock()
+	delete(m.sentTo, fromPeer)
+	m.requestMu.Unlock()
+
+	// Mark our sent request rejected so 'sent-requests' shows the answer,
+	// recording it first if it was sent before we knew the peer
+	var request *storage.Friend
+	if m.currentUserID != 0 {
+		if contact, err := m.contactFor(ctx, fromPeer, response.Username, response.FullName); err == nil {
+			request, _ = m.storage.GetFriendRequest(ctx, m.currentUserID, contact.ID)
+			if request == nil {
+				request = &storage.Friend{
+					UserID:   m.currentUserID,
+					FriendID: contact.ID,
+					PeerID:   contact.PeerID,
+					Username: contact.Username,
+					FullName: contact.FullName,
+					Status:   "pending",
+				}
+				if err := m.storage.CreateFriendRequest(ctx, request); err != nil {
+					i18n.Printf("Warning: Failed to record friend request: %v\n", err)
+					request = nil
+				}
+			}
+		}
+	}
+	if request != nil && request.Status == "pending" {
+		request.Status = "rejected"
+		if err := m.storage.UpdateFriendRequest(ctx, request); err != nil {
+			i18n.Printf("Warning: Failed to update friend request: %v\n", err)
+		}
+		if m.sentRequestHandler != nil {
+			if updated, _ := m.storage.GetFriendRequestByID(ctx, request.ID); updated != nil {
+				request = updated
+			}
+			m.sentRequestHandler(request)
+			return
+		}
+	}
+
+	i18n.Printf("\n✗ %s declined your friend request\n", response.FullName)
+	i18n.Print("> ")
 }
@@ -0,0 +1,83 @@
+package friends
+
+import (
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// Proto returns the request's protobuf form
+func (r *FriendRequestMessage) Proto() proto.Message {
+	return &pb.FriendRequest{
+		FromUsername: r.FromUsername,
+		FromFullName: r.FromFullName,
+		FromPeerId:   r.FromPeerID,
+		Message:      r.Message,
+	}
+}
+
+// Proto returns the response's protobuf form
+func (r *FriendResponseMessage) Proto() proto.Message {
+	return &pb.FriendResponse{
+		Accepted: r.Accepted,
+		Username: r.Username,
+		FullName: r.FullName,
+		PeerId:   r.PeerID,
+		Message:  r.Message,
+	}
+}
+
+// DecodeFriendRequestProto validates a friend request read from a protobuf stream
+func DecodeFriendRequestProto(wire *pb.FriendRequest) (*FriendRequestMessage, error) {
+	request := &FriendRequestMessage{
+		FromUsername: wire.FromUsername,
+		FromFullName: wire.FromFullName,
+		FromPeerID:   wire.FromPeerId,
+		Message:      wire.Message,
+	}
+	if err := checkFriendRequest(request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// DecodeFriendResponseProto validates a friend accept or reject read from a protobuf stream
+func DecodeFriendResponseProto(wire *pb.FriendResponse) (*FriendResponseMessage, error) {
+	response := &FriendResponseMessage{
+		Accepted: wire.Accepted,
+		Username: wire.Username,
+		FullName: wire.FullName,
+		PeerID:   wire.PeerId,
+		Message:  wire.Message,
+	}
+	if err := checkFriendResponse(response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// readFriendRequest reads and validates a friend request from a stream
+func readFriendRequest(ws *p2p.WireStream) (*FriendRequestMessage, error) {
+	var wire pb.FriendRequest
+	data, err := ws.ReadMessage(&wire)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Protobuf() {
+		return DecodeFriendRequestProto(&wire)
+	}
+	return DecodeFriendRequest(data)
+}
+
+// readFriendResponse reads and validates a friend accept or reject from a stream
+func readFriendResponse(ws *p2p.WireStream) (*FriendResponseMessage, error) {
+	var wire pb.FriendResponse
+	data, err := ws.ReadMessage(&wire)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Protobuf() {
+		return DecodeFriendResponseProto(&wire)
+	}
+	return DecodeFriendResponse(data)
+}
@@ -0,0 +1,176 @@
+package friends
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ContactUpdated reports a friend who announced a new username, full name or status
+type ContactUpdated struct {
+	Contact          *storage.User // The friend, with their new details
+	OldUsername      string        // The username they went by on their own node
+	OldHandle        string        // The name they were shown by here
+	OldFullName      string
+	OldStatusMessage string
+}
+
+// UsernameChanged reports whether the friend renamed their account
+func (u *ContactUpdated) UsernameChanged() bool {
+	return u.Contact.RemoteName() != u.OldUsername
+}
+
+// NameChanged reports whether the friend's full name changed
+func (u *ContactUpdated) NameChanged() bool {
+	return u.Contact.FullName != u.OldFullName
+}
+
+// StatusChanged reports whether the friend's status message changed
+func (u *ContactUpdated) StatusChanged() bool {
+	return u.Contact.StatusMessage != u.OldStatusMessage
+}
+
+// SetContactUpdatedHandler sets a callback for when a friend's profile changes
+func (m *Manager) SetContactUpdatedHandler(handler func(update *ContactUpdated)) {
+	m.contactUpdatedHandler = handler
+}
+
+// UpdateProfile changes the current user's full name and status message and
+// announces them to connected friends. Friends who are offline get the new
+// profile when they next connect; see SendProfile.
+func (m *Manager) UpdateProfile(ctx context.Context, currentUser *storage.User, fullName, statusMessage string) error {
+	if m.currentUserID == 0 {
+		return ErrNotAuthenticated
+	}
+	fullName, statusMessage = strings.TrimSpace(fullName), strings.TrimSpace(statusMessage)
+	if fullName == "" || len(fullName) > p2p.MaxFullNameLength || !utf8.ValidString(fullName) {
+		return ErrInvalidFullName
+	}
+	if len(statusMessage) > p2p.MaxStatusLength || !utf8.ValidString(statusMessage) {
+		return ErrInvalidStatus
+	}
+	if fullName == currentUser.FullName && statusMessage == currentUser.StatusMessage {
+		return nil
+	}
+
+	oldFullName, oldStatus := currentUser.FullName, currentUser.StatusMessage
+	currentUser.FullName, currentUser.StatusMessage = fullName, statusMessage
+	if err := m.storage.UpdateUser(ctx, currentUser); err != nil {
+		currentUser.FullName, currentUser.StatusMessage = oldFullName, oldStatus
+		return fmt.Errorf("failed to update profile: %w", err)
+	}
+
+	m.BroadcastProfile(ctx, currentUser)
+	return nil
+}
+
+// BroadcastProfile announces the current user's profile to every connected friend
+func (m *Manager) BroadcastProfile(ctx context.Context, currentUser *storage.User) {
+	friends, err := m.storage.GetFriends(ctx, currentUser.ID)
+	if err != nil {
+		i18n.Printf("Warning: Failed to get friends: %v\n", err)
+		return
+	}
+	for _, friend := range friends {
+		peerID, err := peer.Decode(friend.PeerID)
+		if err != nil || m.host.Network().Connectedness(peerID) != network.Connected {
+			continue
+		}
+		go m.SendProfile(context.WithoutCancel(ctx), currentUser, peerID)
+	}
+}
+
+// SendProfile announces the current user's profile to one friend. It is also
+// sent whenever a friend connects, so changes made while they were offline
+// reach them. Peers running older versions don't speak the protocol; that's fine.
+func (m *Manager) SendProfile(ctx context.Context, currentUser *storage.User, peerID peer.ID) error {
+	contact, err := m.storage.GetUserByPeerID(ctx, peerID.String())
+	if err != nil {
+		return ErrNotFriends
+	}
+	friendship, err := m.storage.GetFriendRequest(ctx, currentUser.ID, contact.ID)
+	if err != nil || friendship == nil || friendship.Status != "accepted" {
+		return ErrNotFriends
+	}
+
+	stream, err := m.host.NewStream(ctx, peerID, ProtocolProfile)
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+	return SendProfile(ctx, stream, &ProfileMessage{
+		Username:      currentUser.Username,
+		FullName:      currentUser.FullName,
+		StatusMessage: currentUser.StatusMessage,
+	})
+}
+
+// handleProfile reconciles a profile announced by a friend with the copies
+// kept in the users and friends tables, and reports what changed
+func (m *Manager) handleProfile(message *ProfileMessage, fromPeer peer.ID) {
+	ctx := context.Background()
+	if m.currentUserID == 0 {
+		return
+	}
+
+	contact, err := m.storage.GetUserByPeerID(ctx, fromPeer.String())
+	if err != nil || !contact.IsRemote() {
+		return
+	}
+	friendship, err := m.storage.GetFriendRequest(ctx, m.currentUserID, contact.ID)
+	if err != nil || friendship == nil || friendship.Status != "accepted" {
+		return
+	}
+
+	update := &ContactUpdated{
+		Contact:          contact,
+		OldUsername:      contact.RemoteName(),
+		OldHandle:        contact.Username,
+		OldFullName:      contact.FullName,
+		OldStatusMessage: contact.StatusMessage,
+	}
+
+	if message.Username != contact.RemoteName() {
+		// Follow the rename unless we chose our own name for them; their old
+		// name keeps working here for a while either way
+		handle := contact.Username
+		if contact.Username == contact.RemoteName() {
+			if handle, err = m.storage.ContactHandle(ctx, message.Username, contact.PeerID); err != nil {
+				i18n.Printf("Warning: Failed to rename %s: %v\n", contact.Username, err)
+				return
+			}
+		}
+		if err := m.storage.RecordContactRename(ctx, contact.ID, message.Username, handle); err != nil {
+			i18n.Printf("Warning: Failed to rename %s: %v\n", contact.Username, err)
+			return
+		}
+		contact.Username, contact.RemoteUsername = handle, ""
+		if handle != message.Username {
+			contact.RemoteUsername = message.Username
+		}
+	}
+
+	// An empty name would leave nothing to show them by; keep the one we have
+	fullName := message.FullName
+	if fullName == "" {
+		fullName = contact.FullName
+	}
+	if fullName != contact.FullName || message.StatusMessage != contact.StatusMessage ||
+		fullName != friendship.FullName || message.StatusMessage != friendship.StatusMessage {
+		if err := m.storage.UpdateContactProfile(ctx, contact.ID, fullName, message.StatusMessage); err != nil {
+			i18n.Printf("Warning: Failed to update %s's profile: %v\n", contact.Username, err)
+			return
+		}
+		contact.FullName, contact.StatusMessage = fullName, message.StatusMessage
+	}
+
+	if m.contactUpdatedHandler != nil && (update.UsernameChanged() || update.NameChanged() || update.StatusChanged()) {
+		m.contactUpdatedHandler(update)
+	}
+}
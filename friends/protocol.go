@@ -1,12 +1,11 @@
 package friends
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 
+	"github.com/austinwklein/whisper/p2p"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
@@ -17,6 +16,23 @@ const (
 	ProtocolFriendRequest = protocol.ID("/whisper/friend/request/1.0.0")
 	ProtocolFriendAccept  = protocol.ID("/whisper/friend/accept/1.0.0")
 	ProtocolFriendReject  = protocol.ID("/whisper/friend/reject/1.0.0")
+
+	// Protobuf versions of the protocols above, preferred when both sides speak them
+	ProtocolFriendRequestV2 = protocol.ID("/whisper/friend/request/2.0.0")
+	ProtocolFriendAcceptV2  = protocol.ID("/whisper/friend/accept/2.0.0")
+	ProtocolFriendRejectV2  = protocol.ID("/whisper/friend/reject/2.0.0")
+
+	// ProtocolProfile carries a user's name and status to friends when they change
+	ProtocolProfile = protocol.ID("/whisper/profile/1.0.0")
+
+	// ProtocolAccountDeleted tells friends a user deleted their account
+	ProtocolAccountDeleted = protocol.ID("/whisper/account/deleted/1.0.0")
+
+	// ProtocolRosterRequest asks a peer to send the requester's friend list back
+	ProtocolRosterRequest = protocol.ID("/whisper/roster/request/1.0.0")
+
+	// ProtocolRoster carries a friend list, as an answer or a copy for safekeeping
+	ProtocolRoster = protocol.ID("/whisper/roster/1.0.0")
 )
 
 // FriendRequestMessage represents a friend request
@@ -36,11 +52,23 @@ type FriendResponseMessage struct {
 	Message  string `json:"message,omitempty"`
 }
 
+// ProfileMessage announces a user's current profile to a friend
+type ProfileMessage struct {
+	Username      string `json:"username"`
+	FullName      string `json:"full_name"`
+	StatusMessage string `json:"status_message,omitempty"`
+}
+
 // Protocol handles friend request protocol
 type Protocol struct {
-	requestHandler func(request *FriendRequestMessage, fromPeer peer.ID)
-	acceptHandler  func(response *FriendResponseMessage, fromPeer peer.ID)
-	rejectHandler  func(response *FriendResponseMessage, fromPeer peer.ID)
+	requestHandler   func(request *FriendRequestMessage, fromPeer peer.ID)
+	acceptHandler    func(response *FriendResponseMessage, fromPeer peer.ID)
+	rejectHandler    func(response *FriendResponseMessage, fromPeer peer.ID)
+	profileHandler   func(message *ProfileMessage, fromPeer peer.ID)
+	deletedHandler   func(notice *AccountDeletedNotice, fromPeer peer.ID)
+	rosterReqHandler func(request *RosterRequest, fromPeer peer.ID)
+	rosterHandler    func(message *RosterMessage, fromPeer peer.ID)
+	invalidHandler   func(fromPeer peer.ID)
 }
 
 // NewProtocol creates a new friend protocol handler
@@ -63,25 +91,38 @@ func (p *Protocol) SetRejectHandler(handler func(*FriendResponseMessage, peer.ID
 	p.rejectHandler = handler
 }
 
+// SetProfileHandler sets the handler for profiles friends announce
+func (p *Protocol) SetProfileHandler(handler func(*ProfileMessage, peer.ID)) {
+	p.profileHandler = handler
+}
+
+// SetAccountDeletedHandler sets the handler for account deletion notices
+func (p *Protocol) SetAccountDeletedHandler(handler func(*AccountDeletedNotice, peer.ID)) {
+	p.deletedHandler = handler
+}
+
+// SetRosterRequestHandler sets the handler for friend list requests
+func (p *Protocol) SetRosterRequestHandler(handler func(*RosterRequest, peer.ID)) {
+	p.rosterReqHandler = handler
+}
+
+// SetRosterHandler sets the handler for friend lists peers send
+func (p *Protocol) SetRosterHandler(handler func(*RosterMessage, peer.ID)) {
+	p.rosterHandler = handler
+}
+
+// SetInvalidHandler sets the handler told about peers that send malformed messages
+func (p *Protocol) SetInvalidHandler(handler func(peer.ID)) {
+	p.invalidHandler = handler
+}
+
 // HandleFriendRequest handles incoming friend requests
 func (p *Protocol) HandleFriendRequest(s network.Stream) {
 	defer s.Close()
 
-	reader := bufio.NewReader(s)
-	data, err := reader.ReadBytes('\n')
-	if err != nil && err != io.EOF {
-		fmt.Printf("Error reading friend request: %v\n", err)
-		return
-	}
-
-	var request FriendRequestMessage
-	if err := json.Unmarshal(data, &request); err != nil {
-		fmt.Printf("Error unmarshaling friend request: %v\n", err)
-		return
-	}
-
-	if p.requestHandler != nil {
-		p.requestHandler(&request, s.Conn().RemotePeer())
+	request, ok := p2p.ReadRequest(p2p.NewWireStream(s), "Error reading friend request: %v\n", readFriendRequest, p.invalidHandler)
+	if ok && p.requestHandler != nil {
+		p.requestHandler(request, s.Conn().RemotePeer())
 	}
 }
 
@@ -89,43 +130,59 @@ func (p *Protocol) HandleFriendRequest(s network.Stream) {
 func (p *Protocol) HandleFriendAccept(s network.Stream) {
 	defer s.Close()
 
-	reader := bufio.NewReader(s)
-	data, err := reader.ReadBytes('\n')
-	if err != nil && err != io.EOF {
-		fmt.Printf("Error reading friend accept: %v\n", err)
-		return
+	response, ok := p2p.ReadRequest(p2p.NewWireStream(s), "Error reading friend accept: %v\n", readFriendResponse, p.invalidHandler)
+	if ok && p.acceptHandler != nil {
+		p.acceptHandler(response, s.Conn().RemotePeer())
 	}
+}
+
+// HandleFriendReject handles friend request rejections
+func (p *Protocol) HandleFriendReject(s network.Stream) {
+	defer s.Close()
 
-	var response FriendResponseMessage
-	if err := json.Unmarshal(data, &response); err != nil {
-		fmt.Printf("Error unmarshaling friend accept: %v\n", err)
-		return
+	response, ok := p2p.ReadRequest(p2p.NewWireStream(s), "Error reading friend reject: %v\n", readFriendResponse, p.invalidHandler)
+	if ok && p.rejectHandler != nil {
+		p.rejectHandler(response, s.Conn().RemotePeer())
 	}
+}
 
-	if p.acceptHandler != nil {
-		p.acceptHandler(&response, s.Conn().RemotePeer())
+// HandleProfile handles a profile announced by a friend
+func (p *Protocol) HandleProfile(s network.Stream) {
+	defer s.Close()
+
+	message, ok := p2p.ReadRequest(p2p.NewWireStream(s), "Error reading profile: %v\n", p2p.Decoded(DecodeProfile), p.invalidHandler)
+	if ok && p.profileHandler != nil {
+		p.profileHandler(message, s.Conn().RemotePeer())
 	}
 }
 
-// HandleFriendReject handles friend request rejections
-func (p *Protocol) HandleFriendReject(s network.Stream) {
+// HandleAccountDeleted handles a friend's account deletion notice
+func (p *Protocol) HandleAccountDeleted(s network.Stream) {
 	defer s.Close()
 
-	reader := bufio.NewReader(s)
-	data, err := reader.ReadBytes('\n')
-	if err != nil && err != io.EOF {
-		fmt.Printf("Error reading friend reject: %v\n", err)
-		return
+	notice, ok := p2p.ReadRequest(p2p.NewWireStream(s), "Error reading account deletion notice: %v\n", p2p.Decoded(DecodeAccountDeletedNotice), p.invalidHandler)
+	if ok && p.deletedHandler != nil {
+		p.deletedHandler(notice, s.Conn().RemotePeer())
 	}
+}
 
-	var response FriendResponseMessage
-	if err := json.Unmarshal(data, &response); err != nil {
-		fmt.Printf("Error unmarshaling friend reject: %v\n", err)
-		return
+// HandleRosterRequest handles a peer's request for a friend list
+func (p *Protocol) HandleRosterRequest(s network.Stream) {
+	defer s.Close()
+
+	request, ok := p2p.ReadRequest(p2p.NewWireStream(s), "Error reading friend list request: %v\n", p2p.Decoded(DecodeRosterRequest), p.invalidHandler)
+	if ok && p.rosterReqHandler != nil {
+		p.rosterReqHandler(request, s.Conn().RemotePeer())
 	}
+}
 
-	if p.rejectHandler != nil {
-		p.rejectHandler(&response, s.Conn().RemotePeer())
+// HandleRoster handles a friend list sent by a peer
+func (p *Protocol) HandleRoster(s network.Stream) {
+	defer s.Close()
+
+	message, ok := p2p.ReadRequest(p2p.NewWireStream(s), "Error reading friend list: %v\n", p2p.Decoded(DecodeRoster), p.invalidHandler)
+	if ok && p.rosterHandler != nil {
+		p.rosterHandler(message, s.Conn().RemotePeer())
 	}
 }
 
@@ -133,17 +190,9 @@ func (p *Protocol) HandleFriendReject(s network.Stream) {
 func SendFriendRequest(ctx context.Context, s network.Stream, request *FriendRequestMessage) error {
 	defer s.Close()
 
-	data, err := json.Marshal(request)
-	if err != nil {
-		return fmt.Errorf("failed to marshal request: %w", err)
-	}
-
-	data = append(data, '\n')
-	_, err = s.Write(data)
-	if err != nil {
+	if err := p2p.NewWireStream(s).WriteMessage(request); err != nil {
 		return fmt.Errorf("failed to write request: %w", err)
 	}
-
 	return nil
 }
 
@@ -151,16 +200,68 @@ func SendFriendRequest(ctx context.Context, s network.Stream, request *FriendReq
 func SendFriendResponse(ctx context.Context, s network.Stream, response *FriendResponseMessage) error {
 	defer s.Close()
 
-	data, err := json.Marshal(response)
+	if err := p2p.NewWireStream(s).WriteMessage(response); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	return nil
+}
+
+// SendProfile announces a profile to a friend
+func SendProfile(ctx context.Context, s network.Stream, message *ProfileMessage) error {
+	defer s.Close()
+
+	data, err := json.Marshal(message)
 	if err != nil {
-		return fmt.Errorf("failed to marshal response: %w", err)
+		return fmt.Errorf("failed to marshal profile: %w", err)
 	}
+	data = append(data, '\n')
+	if _, err := s.Write(data); err != nil {
+		return fmt.Errorf("failed to write profile: %w", err)
+	}
+	return nil
+}
+
+// SendAccountDeletedNotice tells a friend the sender's account is gone
+func SendAccountDeletedNotice(ctx context.Context, s network.Stream, notice *AccountDeletedNotice) error {
+	defer s.Close()
 
+	data, err := json.Marshal(notice)
+	if err != nil {
+		return fmt.Errorf("failed to marshal account deletion notice: %w", err)
+	}
 	data = append(data, '\n')
-	_, err = s.Write(data)
+	if _, err := s.Write(data); err != nil {
+		return fmt.Errorf("failed to write account deletion notice: %w", err)
+	}
+	return nil
+}
+
+// SendRosterRequest asks a peer for the sender's friend list
+func SendRosterRequest(ctx context.Context, s network.Stream, request *RosterRequest) error {
+	defer s.Close()
+
+	data, err := json.Marshal(request)
 	if err != nil {
-		return fmt.Errorf("failed to write response: %w", err)
+		return fmt.Errorf("failed to marshal friend list request: %w", err)
 	}
+	data = append(data, '\n')
+	if _, err := s.Write(data); err != nil {
+		return fmt.Errorf("failed to write friend list request: %w", err)
+	}
+	return nil
+}
+
+// SendRoster sends a friend list to a peer
+func SendRoster(ctx context.Context, s network.Stream, message *RosterMessage) error {
+	defer s.Close()
 
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal friend list: %w", err)
+	}
+	data = append(data, '\n')
+	if _, err := s.Write(data); err != nil {
+		return fmt.Errorf("failed to write friend list: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,419 @@
+package friends
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// MaxRosterEntries is the most friends a friend list sent over the wire may hold
+	MaxRosterEntries = 250
+
+	// rosterRequestTTL is how long a friend list request waits for an answer,
+	// on both sides
+	rosterRequestTTL = time.Hour
+
+	// maxRosterRequests caps the requests waiting for the user to answer
+	maxRosterRequests = 20
+)
+
+var (
+	ErrRosterTooLarge      = fmt.Errorf("friend list is too long to send (at most %d friends)", MaxRosterEntries)
+	ErrRosterRequestFound  = errors.New("no friend list request from that user or peer - see 'roster'")
+	ErrRosterRequestUnsure = errors.New("several peers asked for that friend list - answer by peer ID")
+)
+
+// RosterRequest asks a peer to send the requester's friend list back: the
+// list their other device has, or the copy they left with a friend. It is
+// sent from the device that lost the list, usually under a new peer ID.
+type RosterRequest struct {
+	Username string `json:"username"` // Whose friend list is wanted
+	FullName string `json:"full_name"`
+	Note     string `json:"note,omitempty"`
+}
+
+// RosterMessage carries a friend list, in answer to a RosterRequest or as a
+// copy left with a friend for safekeeping
+type RosterMessage struct {
+	Username string                 `json:"username"` // Whose friend list it is
+	Entries  []*storage.RosterEntry `json:"entries,omitempty"`
+	Copy     bool                   `json:"copy,omitempty"`     // Left for safekeeping, not an answer
+	Declined string                 `json:"declined,omitempty"` // Why a request got no list
+}
+
+// PendingRoster is a friend list request waiting for the user to send or
+// deny it
+type PendingRoster struct {
+	Request    *RosterRequest
+	From       peer.ID
+	FriendID   int64 // Friend whose copy would be sent, or 0 for the user's own list
+	Entries    int   // How many friends the list holds
+	ReceivedAt time.Time
+}
+
+// ShareRoster leaves a copy of the current user's friend list with a friend,
+// who can send it back if the list is lost. Sharing again replaces the copy.
+func (m *Manager) ShareRoster(ctx context.Context, currentUser *storage.User, username string) (int, error) {
+	if m.currentUserID == 0 {
+		return 0, ErrNotAuthenticated
+	}
+	friendUser, err := m.storage.GetUserByUsername(ctx, username)
+	if errors.Is(err, storage.ErrNotFound) {
+		return 0, fmt.Errorf("user '%s' not found", username)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get user: %w", err)
+	}
+	friendship, err := m.storage.GetFriendRequest(ctx, currentUser.ID, friendUser.ID)
+	if err != nil || friendship == nil || friendship.Status != "accepted" {
+		return 0, ErrNotFriends
+	}
+	peerID, err := peer.Decode(friendUser.PeerID)
+	if err != nil {
+		return 0, fmt.Errorf("invalid peer ID: %w", err)
+	}
+
+	entries, err := m.rosterOf(ctx, currentUser.ID)
+	if err != nil {
+		return 0, err
+	}
+	message := &RosterMessage{Username: currentUser.Username, Entries: entries, Copy: true}
+	if err := m.sendRoster(ctx, peerID, message); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// RequestRoster asks a peer for the current user's friend list. Their user
+// decides whether to send it; if they do, a friend request goes to everyone
+// on it.
+func (m *Manager) RequestRoster(ctx context.Context, currentUser *storage.User, target peer.ID, note string) error {
+	if m.currentUserID == 0 {
+		return ErrNotAuthenticated
+	}
+	if target.String() == currentUser.PeerID {
+		return ErrCannotAddSelf
+	}
+
+	stream, err := m.host.NewStream(ctx, target, ProtocolRosterRequest)
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+	m.rosterMu.Lock()
+	m.rosterAsked[target] = time.Now()
+	m.rosterMu.Unlock()
+
+	return SendRosterRequest(ctx, stream, &RosterRequest{
+		Username: currentUser.Username,
+		FullName: currentUser.FullName,
+		Note:     note,
+	})
+}
+
+// RosterRequests returns the friend list requests waiting for an answer,
+// oldest first
+func (m *Manager) RosterRequests() []*PendingRoster {
+	m.rosterMu.Lock()
+	defer m.rosterMu.Unlock()
+	m.expireRosterRequestsLocked(time.Now())
+
+	pending := make([]*PendingRoster, 0, len(m.rosterRequests))
+	for _, request := range m.rosterRequests {
+		pending = append(pending, request)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ReceivedAt.Before(pending[j].ReceivedAt) })
+	return pending
+}
+
+// AnswerRosterRequest sends the friend list a peer asked for, or tells them
+// the user declined. who is the username the request was for or the
+// requester's peer ID.
+func (m *Manager) AnswerRosterRequest(ctx context.Context, currentUser *storage.User, who string, send bool) (*PendingRoster, error) {
+	if m.currentUserID == 0 {
+		return nil, ErrNotAuthenticated
+	}
+	m.rosterMu.Lock()
+	m.expireRosterRequestsLocked(time.Now())
+	var found *PendingRoster
+	for pid, request := range m.rosterRequests {
+		if pid.String() != who && !strings.EqualFold(request.Request.Username, who) {
+			continue
+		}
+		if found != nil {
+			m.rosterMu.Unlock()
+			return nil, ErrRosterRequestUnsure
+		}
+		found = request
+	}
+	if found != nil {
+		delete(m.rosterRequests, found.From)
+	}
+	m.rosterMu.Unlock()
+	if found == nil {
+		return nil, ErrRosterRequestFound
+	}
+
+	message := &RosterMessage{Username: found.Request.Username, Declined: "declined"}
+	if send {
+		entries, err := m.rosterFor(ctx, currentUser, found.FriendID)
+		if err != nil {
+			return nil, err
+		}
+		message = &RosterMessage{Username: found.Request.Username, Entries: entries}
+	}
+	if err := m.sendRoster(ctx, found.From, message); err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// GetRosterCopies returns the friend lists friends left with an account
+func (m *Manager) GetRosterCopies(ctx context.Context, userID int64) ([]*storage.RosterCopy, error) {
+	return m.storage.GetRosterCopies(ctx, userID)
+}
+
+// rosterOf returns an account's friends as a friend list
+func (m *Manager) rosterOf(ctx context.Context, userID int64) ([]*storage.RosterEntry, error) {
+	friends, err := m.storage.GetFriends(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get friends: %w", err)
+	}
+	if len(friends) > MaxRosterEntries {
+		return nil, ErrRosterTooLarge
+	}
+	entries := make([]*storage.RosterEntry, 0, len(friends))
+	for _, friend := range friends {
+		entries = append(entries, &storage.RosterEntry{Username: friend.Username, FullName: friend.FullName, PeerID: friend.PeerID})
+	}
+	return entries, nil
+}
+
+// rosterFor returns the list a request is answered with: the current user's
+// own, or the copy the friend friendID left with them
+func (m *Manager) rosterFor(ctx context.Context, currentUser *storage.User, friendID int64) ([]*storage.RosterEntry, error) {
+	if friendID == 0 {
+		return m.rosterOf(ctx, currentUser.ID)
+	}
+	copies, err := m.storage.GetRosterCopies(ctx, currentUser.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get friend list copies: %w", err)
+	}
+	for _, roster := range copies {
+		if roster.FriendID == friendID {
+			return roster.Entries, nil
+		}
+	}
+	return nil, fmt.Errorf("the copy of that friend list is gone")
+}
+
+// sendRoster sends a friend list to a peer
+func (m *Manager) sendRoster(ctx context.Context, peerID peer.ID, message *RosterMessage) error {
+	stream, err := m.host.NewStream(ctx, peerID, ProtocolRoster)
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+	return SendRoster(ctx, stream, message)
+}
+
+// expireRosterRequestsLocked forgets requests older than rosterRequestTTL;
+// rosterMu must be held
+func (m *Manager) expireRosterRequestsLocked(now time.Time) {
+	for pid, request := range m.rosterRequests {
+		if now.Sub(request.ReceivedAt) > rosterRequestTTL {
+			delete(m.rosterRequests, pid)
+		}
+	}
+	for pid, asked := range m.rosterAsked {
+		if now.Sub(asked) > rosterRequestTTL {
+			delete(m.rosterAsked, pid)
+		}
+	}
+}
+
+// handleRosterRequest holds a request for a friend list this node has - the
+// user's own, or a copy a friend left - until the user answers it. Requests
+// for lists it doesn't have are declined straight away.
+func (m *Manager) handleRosterRequest(request *RosterRequest, fromPeer peer.ID) {
+	ctx := context.Background()
+	if m.currentUserID == 0 {
+		return
+	}
+	if m.requestPolicy != nil && !m.requestPolicy(ctx, fromPeer) {
+		return
+	}
+	currentUser, err := m.storage.GetUserByID(ctx, m.currentUserID)
+	if err != nil {
+		return
+	}
+
+	pending := &PendingRoster{Request: request, From: fromPeer, ReceivedAt: time.Now()}
+	if strings.EqualFold(request.Username, currentUser.Username) {
+		friends, err := m.storage.GetFriends(ctx, currentUser.ID)
+		if err != nil {
+			return
+		}
+		pending.Entries = len(friends)
+	} else {
+		copies, err := m.storage.GetRosterCopies(ctx, currentUser.ID)
+		if err != nil {
+			return
+		}
+		for _, roster := range copies {
+			if strings.EqualFold(roster.Username, request.Username) {
+				pending.FriendID = roster.FriendID
+				pending.Entries = len(roster.Entries)
+			}
+		}
+		if pending.FriendID == 0 {
+			declined := &RosterMessage{Username: request.Username, Declined: "no friend list for " + request.Username + " here"}
+			if err := m.sendRoster(ctx, fromPeer, declined); err != nil {
+				i18n.Printf("Warning: Failed to answer friend list request: %v\n", err)
+			}
+			return
+		}
+	}
+
+	m.rosterMu.Lock()
+	m.expireRosterRequestsLocked(pending.ReceivedAt)
+	if _, ok := m.rosterRequests[fromPeer]; !ok && len(m.rosterRequests) >= maxRosterRequests {
+		m.rosterMu.Unlock()
+		return
+	}
+	m.rosterRequests[fromPeer] = pending
+	m.rosterMu.Unlock()
+
+	if pending.FriendID != 0 {
+		i18n.Printf("\n📇 Peer %s, calling itself %s (%s), asks for the friend list %s left with you (%d friends)\n", fromPeer, request.Username, request.FullName, request.Username, pending.Entries)
+	} else {
+		i18n.Printf("\n📇 Peer %s, calling itself %s (%s), asks for your friend list (%d friends)\n", fromPeer, request.Username, request.FullName, pending.Entries)
+	}
+	if request.Note != "" {
+		i18n.Printf("   Message: %s\n", request.Note)
+	}
+	i18n.Println("   Only send it once you've made sure it's really them, e.g. by phone")
+	i18n.Printf("   Use 'roster send %s' or 'roster deny %s'\n", fromPeer, fromPeer)
+	i18n.Print("> ")
+}
+
+// handleRoster takes a friend list: a copy a friend left for safekeeping, or
+// the answer to a request we sent, whose friends are then sent friend
+// requests. Lists nobody asked for are dropped.
+func (m *Manager) handleRoster(message *RosterMessage, fromPeer peer.ID) {
+	ctx := context.Background()
+	if m.currentUserID == 0 {
+		return
+	}
+	currentUser, err := m.storage.GetUserByID(ctx, m.currentUserID)
+	if err != nil {
+		return
+	}
+
+	if message.Copy {
+		contact, err := m.storage.GetUserByPeerID(ctx, fromPeer.String())
+		if err != nil || !contact.IsRemote() {
+			return
+		}
+		friendship, err := m.storage.GetFriendRequest(ctx, currentUser.ID, contact.ID)
+		if err != nil || friendship == nil || friendship.Status != "accepted" {
+			return
+		}
+		roster := &storage.RosterCopy{UserID: currentUser.ID, FriendID: contact.ID, Entries: message.Entries}
+		if err := m.storage.SaveRosterCopy(ctx, roster); err != nil {
+			i18n.Printf("Warning: Failed to save %s's friend list: %v\n", contact.Username, err)
+			return
+		}
+		i18n.Printf("\n📇 %s left a copy of their friend list with you (%d friends), to ask for if they lose it\n> ", contact.Username, len(message.Entries))
+		return
+	}
+
+	m.rosterMu.Lock()
+	m.expireRosterRequestsLocked(time.Now())
+	_, asked := m.rosterAsked[fromPeer]
+	delete(m.rosterAsked, fromPeer)
+	m.rosterMu.Unlock()
+	if !asked || !strings.EqualFold(message.Username, currentUser.Username) {
+		return
+	}
+	if message.Declined != "" {
+		i18n.Printf("\n📇 Peer %s didn't send your friend list: %s\n> ", fromPeer, message.Declined)
+		return
+	}
+
+	i18n.Printf("\n📇 Peer %s sent your friend list (%d friends); sending each a friend request\n", fromPeer, len(message.Entries))
+	sent := 0
+	for _, entry := range message.Entries {
+		pid, err := peer.Decode(entry.PeerID)
+		if err != nil || entry.PeerID == currentUser.PeerID {
+			continue
+		}
+		err = m.SendFriendRequestTo(ctx, currentUser, pid, entry.Username)
+		switch {
+		case err == nil:
+			sent++
+		case errors.Is(err, ErrAlreadyFriends), errors.Is(err, ErrPendingRequest):
+		default:
+			i18n.Printf("   %s: %v\n", entry.Username, err)
+		}
+	}
+	i18n.Printf("✓ Sent %d friend requests; they show in 'sent-requests' until accepted\n> ", sent)
+}
+
+// DecodeRosterRequest parses and validates a friend list request read from the wire
+func DecodeRosterRequest(data []byte) (*RosterRequest, error) {
+	var request RosterRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal friend list request: %w", err)
+	}
+	if err := p2p.CheckTextField("username", request.Username, p2p.MaxUsernameLength, true); err != nil {
+		return nil, err
+	}
+	if err := p2p.CheckTextField("full_name", request.FullName, p2p.MaxFullNameLength, false); err != nil {
+		return nil, err
+	}
+	if err := p2p.CheckTextField("note", request.Note, p2p.MaxNoteLength, false); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// DecodeRoster parses and validates a friend list read from the wire
+func DecodeRoster(data []byte) (*RosterMessage, error) {
+	var message RosterMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal friend list: %w", err)
+	}
+	if err := p2p.CheckTextField("username", message.Username, p2p.MaxUsernameLength, true); err != nil {
+		return nil, err
+	}
+	if err := p2p.CheckTextField("declined", message.Declined, p2p.MaxNoteLength, false); err != nil {
+		return nil, err
+	}
+	if len(message.Entries) > MaxRosterEntries {
+		return nil, ErrRosterTooLarge
+	}
+	for _, entry := range message.Entries {
+		if entry == nil {
+			return nil, fmt.Errorf("empty friend list entry")
+		}
+		if err := p2p.CheckTextField("username", entry.Username, p2p.MaxUsernameLength, true); err != nil {
+			return nil, err
+		}
+		if err := p2p.CheckTextField("full_name", entry.FullName, p2p.MaxFullNameLength, false); err != nil {
+			return nil, err
+		}
+		if err := p2p.CheckPeerIDField("peer_id", entry.PeerID); err != nil {
+			return nil, err
+		}
+	}
+	return &message, nil
+}
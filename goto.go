@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/search"
+	"github.com/austinwklein/whisper/storage"
+)
+
+// gotoHistoryLimit is how many recent messages goto shows on opening a conversation
+const gotoHistoryLimit = 10
+
+// conversation is the chat opened with goto. While it is open, plain lines
+// are sent to it and commands start with /.
+type conversation struct {
+	userID int64 // The account that opened it
+	target *search.Target
+}
+
+// switcherIndex indexes the user's friends, by username and full name, and
+// conferences, by name and ID
+func (a *App) switcherIndex(ctx context.Context, user *storage.User) (*search.Index, error) {
+	index := search.NewIndex()
+
+	friends, err := a.friendManager.GetFriends(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get friends: %w", err)
+	}
+	for _, friend := range friends {
+		target := &search.Target{Kind: search.TargetFriend, ID: friend.ID, Name: friend.Username, Label: friend.FullName}
+		index.Add(target, friend.Username, friend.FullName)
+	}
+
+	conferences, err := a.conferenceManager.GetConferences(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conferences: %w", err)
+	}
+	for _, conf := range conferences {
+		target := &search.Target{Kind: search.TargetConference, ID: conf.ID, Name: conf.Name}
+		index.Add(target, conf.Name, strconv.FormatInt(conf.ID, 10))
+	}
+	return index, nil
+}
+
+// handleGotoCommand handles `goto <query>`: it opens a conversation with the
+// friend or conference best matching query, and returns the command line
+// that shows its latest messages, or "" if nothing was opened
+func (a *App) handleGotoCommand(ctx context.Context, parts []string) string {
+	if !a.auth.IsAuthenticated() {
+		i18n.Println("You must be logged in to open a conversation")
+		return ""
+	}
+	if len(parts) < 2 {
+		i18n.Println("Usage: goto <friend or conference>")
+		i18n.Println("Example: goto ali")
+		return ""
+	}
+	query := strings.Join(parts[1:], " ")
+
+	user, _ := a.auth.CurrentUser()
+	index, err := a.switcherIndex(ctx, user)
+	if err != nil {
+		i18n.Printf("Failed to open conversation: %v\n", err)
+		return ""
+	}
+	matches := index.Match(query, 5)
+	if len(matches) == 0 {
+		i18n.Printf("No friend or conference matches %q\n", query)
+		return ""
+	}
+	if len(matches) > 1 && matches[0].Score == matches[1].Score {
+		i18n.Printf("%q matches more than one conversation:\n", query)
+		for _, match := range matches {
+			if match.Score == matches[0].Score {
+				i18n.Printf("  %s\n", describeTarget(match.Target))
+			}
+		}
+		i18n.Println("Type more of the name to pick one")
+		return ""
+	}
+
+	target := matches[0].Target
+	a.conversation = &conversation{userID: user.ID, target: target}
+	i18n.Printf("💬 Now chatting in %s - type to send, start commands with / (e.g. /help), /back to leave\n", describeTarget(target))
+	if target.Kind == search.TargetConference {
+		return fmt.Sprintf("conf-history %d %d", target.ID, gotoHistoryLimit)
+	}
+	return fmt.Sprintf("history %s %d", target.Name, gotoHistoryLimit)
+}
+
+// conversationLine turns a line typed while a conversation is open into the
+// command it stands for: /<command> runs the command, and anything else is
+// sent as a message. Lines pass through unchanged when no conversation is
+// open, and only commands are accepted while locked.
+func (a *App) conversationLine(line string) string {
+	c := a.conversation
+	if c == nil {
+		return line
+	}
+	if user, err := a.auth.CurrentUser(); err != nil || user.ID != c.userID {
+		a.conversation = nil // Logged out or switched accounts
+		return line
+	}
+
+	if command, ok := strings.CutPrefix(line, "/"); ok {
+		return strings.TrimSpace(command)
+	}
+	if line == "" || a.auth.IsLocked() {
+		return line
+	}
+	if c.target.Kind == search.TargetConference {
+		return fmt.Sprintf("conf-msg %d %s", c.target.ID, line)
+	}
+	return fmt.Sprintf("msg %s %s", c.target.Name, line)
+}
+
+// leaveConversation closes the conversation opened with goto
+func (a *App) leaveConversation() {
+	if a.conversation == nil {
+		i18n.Println("No conversation is open")
+		return
+	}
+	i18n.Printf("Left %s\n", describeTarget(a.conversation.target))
+	a.conversation = nil
+}
+
+// describeTarget names a switcher target for the user
+func describeTarget(target *search.Target) string {
+	if target.Kind == search.TargetConference {
+		return i18n.Sprintf("conference '%s' (#%d)", target.Name, target.ID)
+	}
+	if target.Label != "" {
+		return fmt.Sprintf("%s (%s)", target.Name, target.Label)
+	}
+	return target.Name
+}
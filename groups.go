@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/messages"
+	"github.com/austinwklein/whisper/storage"
+)
+
+// parseGroupID reads a group ID argument, printing usage if it isn't one
+func parseGroupID(arg, usage string) (int64, bool) {
+	var groupID int64
+	if _, err := fmt.Sscanf(arg, "%d", &groupID); err != nil {
+		i18n.Println(usage)
+		return 0, false
+	}
+	return groupID, true
+}
+
+// runGroupCreate handles `group-create <name> <user> <user> [...]`
+func (a *App) runGroupCreate(ctx context.Context, currentUser *storage.User, args []string) {
+	if len(args) < messages.MinGroupMembers {
+		i18n.Println("Usage: group-create <name> <username> <username> [...]")
+		i18n.Printf("A group has %d to %d people including you\n", messages.MinGroupMembers, messages.MaxGroupMembers)
+		return
+	}
+	group, err := a.messageManager.CreateGroup(ctx, currentUser, args[0], args[1:])
+	if err != nil {
+		i18n.Printf("Failed to create group: %v\n", err)
+		return
+	}
+	i18n.Printf("✓ Created group %s (ID: %d) - 'group-msg %d <message>' to write to it\n", group.Name, group.ID, group.ID)
+}
+
+// runGroups lists the user's groups and who is in them
+func (a *App) runGroups(ctx context.Context, currentUser *storage.User) {
+	groups, err := a.messageManager.GetGroups(ctx, currentUser.ID)
+	if err != nil {
+		i18n.Printf("Failed to get groups: %v\n", err)
+		return
+	}
+	if len(groups) == 0 {
+		i18n.Println("You are not in any groups")
+		i18n.Println("Use 'group-create <name> <username> <username>' to start one")
+		return
+	}
+
+	i18n.Printf("Your groups (%d):\n", len(groups))
+	for _, group := range groups {
+		names := make([]string, len(group.Members))
+		for i, member := range group.Members {
+			names[i] = a.messageManager.MemberName(ctx, member.PeerID, member.Username)
+		}
+		if !group.LeftAt.IsZero() {
+			i18n.Printf("  %d. %s (left %s)\n", group.ID, group.Name, group.LeftAt.Local().Format("Jan 2"))
+			continue
+		}
+		i18n.Printf("  %d. %s - you, %s\n", group.ID, group.Name, strings.Join(names, ", "))
+	}
+}
+
+// runGroupMsg handles `group-msg <group-id> <message>`
+func (a *App) runGroupMsg(ctx context.Context, currentUser *storage.User, args []string) {
+	const usage = "Usage: group-msg <group-id> <message>"
+	if len(args) < 2 {
+		i18n.Println(usage)
+		return
+	}
+	groupID, ok := parseGroupID(args[0], usage)
+	if !ok {
+		return
+	}
+	if err := a.messageManager.SendGroupMessage(ctx, currentUser, groupID, strings.Join(args[1:], " ")); err != nil {
+		i18n.Printf("Failed to send message: %v\n", err)
+	}
+}
+
+// runGroupHistory handles `group-history <group-id> [limit]`
+func (a *App) runGroupHistory(ctx context.Context, currentUser *storage.User, args []string) {
+	const usage = "Usage: group-history <group-id> [limit]"
+	if len(args) < 1 {
+		i18n.Println(usage)
+		return
+	}
+	groupID, ok := parseGroupID(args[0], usage)
+	if !ok {
+		return
+	}
+	limit := 20
+	if len(args) >= 2 {
+		fmt.Sscanf(args[1], "%d", &limit)
+	}
+
+	group, history, err := a.messageManager.GetGroupHistory(ctx, currentUser, groupID, limit)
+	if err != nil {
+		i18n.Printf("Failed to get messages: %v\n", err)
+		return
+	}
+	if len(history) == 0 {
+		i18n.Printf("No messages in group '%s'\n", group.Name)
+		return
+	}
+
+	i18n.Printf("\n=== Group: %s (%d messages) ===\n", group.Name, len(history))
+	for _, msg := range history {
+		timestamp := msg.CreatedAt.Local().Format("15:04:05")
+		if msg.IsSystem() {
+			i18n.Printf("[%s] *** %s ***\n", timestamp, msg.Content)
+			continue
+		}
+		from := msg.FromUsername
+		if !msg.Outgoing {
+			from = a.messageManager.MemberName(ctx, msg.FromPeerID, msg.FromUsername)
+		}
+		i18n.Printf("[%s] #%d %s: %s\n", timestamp, msg.ID, from, msg.Content)
+	}
+	i18n.Println()
+}
+
+// runGroupStatus shows which members a group message reached, and why the
+// tries at reaching the others failed
+func (a *App) runGroupStatus(ctx context.Context, currentUser *storage.User, args []string) {
+	const usage = "Usage: group-status <message-id>"
+	if len(args) < 1 {
+		i18n.Println(usage)
+		return
+	}
+	var messageID int64
+	if _, err := fmt.Sscanf(args[0], "%d", &messageID); err != nil {
+		i18n.Println(usage)
+		return
+	}
+
+	status, err := a.messageManager.GetGroupDeliveryStatus(ctx, currentUser, messageID)
+	if errors.Is(err, storage.ErrMessageNotFound) || errors.Is(err, messages.ErrNotSent) {
+		i18n.Printf("%v\n", err)
+		return
+	}
+	if err != nil {
+		i18n.Printf("Failed to get delivery status: %v\n", err)
+		return
+	}
+
+	i18n.Printf("\n=== Message #%d to %s ===\n", status.Message.ID, status.Group.Name)
+	i18n.Printf("Sent: %s\n", status.Message.CreatedAt.Local().Format("Jan 2 15:04"))
+	for _, delivery := range status.Deliveries {
+		name := a.messageManager.MemberName(ctx, delivery.PeerID, delivery.Username)
+		switch {
+		case delivery.Delivered:
+			i18n.Printf("  ✓ %-16s delivered %s\n", name, delivery.DeliveredAt.Local().Format("Jan 2 15:04"))
+		case delivery.Attempts > 0:
+			i18n.Printf("  ○ %-16s not yet (%d failed tries): %s\n", name, delivery.Attempts, messages.DeliveryHint(delivery.Reason, name))
+		default:
+			i18n.Printf("  ○ %-16s not yet\n", name)
+		}
+	}
+	i18n.Println()
+}
+
+// runGroupLeave handles `group-leave <group-id>`
+func (a *App) runGroupLeave(ctx context.Context, currentUser *storage.User, args []string) {
+	const usage = "Usage: group-leave <group-id>"
+	if len(args) < 1 {
+		i18n.Println(usage)
+		return
+	}
+	groupID, ok := parseGroupID(args[0], usage)
+	if !ok {
+		return
+	}
+	group, err := a.messageManager.LeaveGroup(ctx, currentUser, groupID)
+	if err != nil {
+		i18n.Printf("Failed to leave group: %v\n", err)
+		return
+	}
+	i18n.Printf("✓ Left group %s\n", group.Name)
+}
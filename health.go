@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/austinwklein/whisper/config"
+	"github.com/austinwklein/whisper/control"
+	"github.com/austinwklein/whisper/i18n"
+)
+
+const (
+	// healthTimeout bounds the database check
+	healthTimeout = 5 * time.Second
+
+	// minFreeDisk is the free space under DataDir below which the node is
+	// degraded; the database and backups can't grow much further
+	minFreeDisk = 100 << 20
+)
+
+// Health checks that the database answers, the P2P host is listening, the DHT
+// has peers and DataDir's disk has room, and counts what is queued
+func (a *App) Health(ctx context.Context) *control.Health {
+	health := &control.Health{Queues: make(map[string]int), CheckedAt: time.Now()}
+	check := func(name string, ok bool, detail string) {
+		health.Checks = append(health.Checks, control.HealthCheck{Name: name, OK: ok, Detail: detail})
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, healthTimeout)
+	err := a.storage.Ping(pingCtx)
+	cancel()
+	if err != nil {
+		check("database", false, err.Error())
+	} else {
+		check("database", true, "reachable")
+	}
+
+	addrs := a.p2p.Addrs()
+	peers := len(a.p2p.GetConnectedPeers())
+	check("p2p", len(addrs) > 0, fmt.Sprintf("%d listen addresses, %d peers connected", len(addrs), peers))
+
+	dht := a.p2p.DHTStats()
+	check("dht", dht.RoutingTableSize > 0, fmt.Sprintf("%d peers in routing table (%s mode)", dht.RoutingTableSize, dht.Mode))
+
+	dataDir := absPath(a.config.DataDir)
+	if free, err := freeDiskSpace(dataDir); err != nil {
+		check("disk", false, err.Error())
+	} else {
+		check("disk", free >= minFreeDisk, fmt.Sprintf("%s free in %s", formatSize(int64(free)), dataDir))
+	}
+
+	health.Queues["conference_writes"] = a.conferenceManager.PendingWrites()
+	if user, err := a.auth.CurrentUser(); err == nil {
+		if undelivered, err := a.storage.GetUndeliveredMessages(ctx, user.ID); err == nil {
+			health.Queues["undelivered_messages"] = len(undelivered)
+		}
+		if requests, err := a.storage.GetPendingFriendRequests(ctx, user.ID); err == nil {
+			health.Queues["pending_friend_requests"] = len(requests)
+		}
+	}
+
+	health.Healthy = true
+	for _, c := range health.Checks {
+		health.Healthy = health.Healthy && c.OK
+	}
+	return health
+}
+
+// printHealth shows a health report
+func printHealth(health *control.Health) {
+	if health.Healthy {
+		i18n.Println("✓ Healthy")
+	} else {
+		i18n.Println("✗ Degraded")
+	}
+	for _, c := range health.Checks {
+		mark := "✓"
+		if !c.OK {
+			mark = "✗"
+		}
+		i18n.Printf("  %s %-9s %s\n", mark, c.Name, c.Detail)
+	}
+
+	queues := make([]string, 0, len(health.Queues))
+	for name := range health.Queues {
+		queues = append(queues, name)
+	}
+	sort.Strings(queues)
+	for _, name := range queues {
+		i18n.Printf("  • %-24s %d\n", name, health.Queues[name])
+	}
+}
+
+// runHealthCommand handles `whisper health`: it asks the running daemon for
+// its health and fails when the daemon is degraded or unreachable, so scripts
+// and service monitors can act on the exit code
+func runHealthCommand(cfg *config.Config, args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: whisper health")
+	}
+	client, err := control.Dial(controlSocketPath(cfg))
+	if err != nil {
+		return err
+	}
+	health, err := client.Health(context.Background())
+	if err != nil {
+		return err
+	}
+	printHealth(health)
+	if !health.Healthy {
+		os.Exit(1)
+	}
+	return nil
+}
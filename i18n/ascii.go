@@ -0,0 +1,98 @@
+package i18n
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// asciiReplacer swaps the symbols whisper prints for plain text. Longer
+// sequences come first so an emoji's variation selector goes with it.
+var asciiReplacer = strings.NewReplacer(
+	"\u26a0\ufe0f", "[!]",
+	"⚠", "[!]",
+	"✓", "[ok]",
+	"✗", "[x]",
+	"📨", "[msg]",
+	"📬", "[mail]",
+	"📢", "[conf]",
+	"🔒", "[locked]",
+	"🔓", "[unlocked]",
+	"🩺", "[diag]",
+	"🚫", "[blocked]",
+	"🤝", "[friend]",
+	"👤", "[user]",
+	"📴", "[offline]",
+	"🟢", "*",
+	"⏱", "[wait]",
+	"🐢", "[slow]",
+	"👀", "[observer]",
+	"📇", "[roster]",
+	"🆕", "[new]",
+	"👥", "[group]",
+	"●", "*",
+	"○", "o",
+	"◐", "~",
+	"↳", "->",
+	"↪", "->",
+	"→", "->",
+	"←", "<-",
+	"…", "...",
+	"—", "-",
+	"–", "-",
+	"│", "|",
+	"─", "-",
+	"█", "#",
+	"╭", "+",
+	"╮", "+",
+	"╰", "+",
+	"╯", "+",
+	"“", "\"",
+	"”", "\"",
+	"‘", "'",
+	"’", "'",
+	"«", "\"",
+	"»", "\"",
+	"¿", "",
+	"¡", "",
+	"\u00a0", " ",
+	"\ufe0f", "", // Emoji variation selector
+)
+
+// ToASCII rewrites s using only ASCII: known symbols become text markers,
+// accented letters lose their accents, and anything else becomes "?"
+func ToASCII(s string) string {
+	if isASCII(s) {
+		return s
+	}
+	s = asciiReplacer.Replace(s)
+	if isASCII(s) {
+		return s
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range norm.NFD.String(s) {
+		switch {
+		case r < utf8.RuneSelf:
+			b.WriteRune(r)
+		case unicode.Is(unicode.Mn, r):
+			// Combining accent left over from decomposing a letter
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// isASCII reports whether s is already plain ASCII
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
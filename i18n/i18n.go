@@ -0,0 +1,292 @@
+// Package i18n translates whisper's user-facing text and, for terminals that
+// can't show Unicode, rewrites it as plain ASCII.
+//
+// Catalogs are keyed by the English text itself, so code keeps reading like
+// it prints English and a string with no translation is printed as written.
+// Each catalog in locales/ maps English format strings to the locale's, with
+// the same verbs in the same order.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultLocale is the language the source strings are written in
+const DefaultLocale = "en"
+
+// ErrUnknownLocale is returned when there is no catalog for a locale
+var ErrUnknownLocale = errors.New("unknown locale")
+
+//go:embed locales/*.json
+var localeFS embed.FS
+
+var (
+	mu      sync.RWMutex
+	locale  = DefaultLocale
+	catalog map[string]string // nil for English
+	ascii   bool
+
+	catalogs     map[string]map[string]string
+	catalogsOnce sync.Once
+)
+
+// loadCatalogs reads the embedded catalogs, keyed by locale
+func loadCatalogs() map[string]map[string]string {
+	catalogsOnce.Do(func() {
+		catalogs = make(map[string]map[string]string)
+		entries, err := localeFS.ReadDir("locales")
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			data, err := localeFS.ReadFile(path.Join("locales", entry.Name()))
+			if err != nil {
+				continue
+			}
+			var messages map[string]string
+			if err := json.Unmarshal(data, &messages); err != nil {
+				// A broken catalog is a build mistake; fall back to English
+				// rather than refusing to start
+				fmt.Fprintf(os.Stderr, "Warning: Failed to parse catalog %s: %v\n", entry.Name(), err)
+				continue
+			}
+			catalogs[strings.TrimSuffix(entry.Name(), ".json")] = messages
+		}
+	})
+	return catalogs
+}
+
+// normalizeLocale turns POSIX and BCP 47 forms (es_ES.UTF-8, es-MX, pt_BR@euro)
+// into lowercase language[_region]
+func normalizeLocale(tag string) string {
+	tag = strings.TrimSpace(tag)
+	if i := strings.IndexAny(tag, ".@"); i >= 0 {
+		tag = tag[:i]
+	}
+	return strings.ToLower(strings.ReplaceAll(tag, "-", "_"))
+}
+
+// Locales returns the locales with a catalog, English included
+func Locales() []string {
+	list := []string{DefaultLocale}
+	for name := range loadCatalogs() {
+		if name != DefaultLocale {
+			list = append(list, name)
+		}
+	}
+	sort.Strings(list[1:])
+	return list
+}
+
+// SetLocale switches the language text is translated to. A regional tag with
+// no catalog of its own (es_MX) uses its language's (es). "C" and "POSIX"
+// mean English.
+func SetLocale(tag string) error {
+	name, messages, err := resolveLocale(tag)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	locale = name
+	catalog = messages
+	return nil
+}
+
+// CheckLocale reports whether SetLocale would accept tag, without switching
+func CheckLocale(tag string) error {
+	_, _, err := resolveLocale(tag)
+	return err
+}
+
+// resolveLocale finds the catalog for tag, falling back from a region to its language
+func resolveLocale(tag string) (string, map[string]string, error) {
+	name := normalizeLocale(tag)
+	if name == "" || name == "c" || name == "posix" {
+		name = DefaultLocale
+	}
+
+	all := loadCatalogs()
+	messages, ok := all[name]
+	if !ok {
+		lang := name
+		if i := strings.Index(lang, "_"); i >= 0 {
+			lang = lang[:i]
+		}
+		if lang == DefaultLocale {
+			name, messages, ok = DefaultLocale, nil, true
+		} else if messages, ok = all[lang]; ok {
+			name = lang
+		}
+	}
+	if !ok {
+		return "", nil, fmt.Errorf("%w: %s", ErrUnknownLocale, tag)
+	}
+	return name, messages, nil
+}
+
+// Locale returns the current locale
+func Locale() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return locale
+}
+
+// envLocale returns the locale set in the environment, by POSIX precedence
+func envLocale() string {
+	for _, key := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if value := os.Getenv(key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// DetectLocale returns the locale from the environment, or English if it
+// names one without a catalog
+func DetectLocale() string {
+	tag := envLocale()
+	if tag == "" {
+		return DefaultLocale
+	}
+	if _, ok := loadCatalogs()[normalizeLocale(tag)]; ok {
+		return normalizeLocale(tag)
+	}
+	lang := normalizeLocale(tag)
+	if i := strings.Index(lang, "_"); i >= 0 {
+		lang = lang[:i]
+	}
+	if _, ok := loadCatalogs()[lang]; ok {
+		return lang
+	}
+	return DefaultLocale
+}
+
+// SetASCII turns ASCII mode on or off. In ASCII mode emoji and box drawing
+// become plain text markers and accents are dropped.
+func SetASCII(on bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	ascii = on
+}
+
+// ASCII reports whether ASCII mode is on
+func ASCII() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return ascii
+}
+
+// DetectASCII guesses whether the terminal can't show Unicode: the locale is C
+// or names a charset other than UTF-8, TERM is "dumb", or on Windows outside
+// Windows Terminal, whose console host shows emoji as boxes. With no locale
+// set at all it assumes Unicode works, as whisper always has.
+func DetectASCII() bool {
+	if os.Getenv("TERM") == "dumb" {
+		return true
+	}
+	if runtime.GOOS == "windows" {
+		return os.Getenv("WT_SESSION") == ""
+	}
+	tag := envLocale()
+	charset := ""
+	if i := strings.Index(tag, "."); i >= 0 {
+		charset = strings.ToLower(tag[i+1:])
+		if j := strings.Index(charset, "@"); j >= 0 {
+			charset = charset[:j]
+		}
+	}
+	switch charset {
+	case "utf-8", "utf8":
+		return false
+	case "":
+		// A bare language tag (en_US) leaves the charset to the system,
+		// which is UTF-8 everywhere whisper runs; C and POSIX are ASCII
+		name := normalizeLocale(tag)
+		return name == "c" || name == "posix"
+	default:
+		return true
+	}
+}
+
+// lookup translates s, or returns it unchanged if the catalog has no entry.
+// Text is matched without its leading and trailing whitespace, so "\nDone\n"
+// and "Done" share an entry.
+func lookup(s string) string {
+	mu.RLock()
+	messages := catalog
+	mu.RUnlock()
+	if messages == nil || s == "" {
+		return s
+	}
+	if t, ok := messages[s]; ok {
+		return t
+	}
+	core := strings.TrimSpace(s)
+	if core == "" || core == s {
+		return s
+	}
+	t, ok := messages[core]
+	if !ok {
+		return s
+	}
+	start := strings.Index(s, core)
+	return s[:start] + t + s[start+len(core):]
+}
+
+// render applies ASCII mode to text that is about to be shown
+func render(s string) string {
+	if !ASCII() {
+		return s
+	}
+	return ToASCII(s)
+}
+
+// T translates s for display
+func T(s string) string {
+	return render(lookup(s))
+}
+
+// Sprintf translates format and formats it for display
+func Sprintf(format string, a ...interface{}) string {
+	return render(fmt.Sprintf(lookup(format), a...))
+}
+
+// Printf translates format and prints it to standard output
+func Printf(format string, a ...interface{}) {
+	fmt.Print(Sprintf(format, a...))
+}
+
+// Println translates each string operand and prints them to standard output.
+// Other operands are formatted as fmt.Println would.
+func Println(a ...interface{}) {
+	fmt.Print(render(fmt.Sprintln(translateArgs(a)...)))
+}
+
+// Print translates each string operand and prints them as fmt.Print would
+func Print(a ...interface{}) {
+	fmt.Print(render(fmt.Sprint(translateArgs(a)...)))
+}
+
+// translateArgs translates the string operands in a
+func translateArgs(a []interface{}) []interface{} {
+	out := make([]interface{}, len(a))
+	for i, arg := range a {
+		if s, ok := arg.(string); ok {
+			out[i] = lookup(s)
+		} else {
+			out[i] = arg
+		}
+	}
+	return out
+}
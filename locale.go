@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/austinwklein/whisper/config"
+	"github.com/austinwklein/whisper/i18n"
+)
+
+// applyDisplaySettings sets the language and ASCII mode from the configuration,
+// falling back to what the environment suggests
+func applyDisplaySettings(cfg *config.Config) {
+	applyLocale(cfg.Locale)
+	applyASCIIMode(cfg.ASCIIMode)
+}
+
+// applyLocale switches to locale, or to the environment's if it is empty
+func applyLocale(locale string) {
+	if locale == "" {
+		locale = i18n.DetectLocale()
+	}
+	if err := i18n.SetLocale(locale); err != nil {
+		i18n.Printf("Warning: %v, using %s (available: %s)\n", err, i18n.DefaultLocale, strings.Join(i18n.Locales(), ", "))
+	}
+}
+
+// applyASCIIMode turns ASCII mode on or off, or detects it for auto
+func applyASCIIMode(mode string) {
+	switch mode {
+	case "on":
+		i18n.SetASCII(true)
+	case "off":
+		i18n.SetASCII(false)
+	case "auto", "":
+		i18n.SetASCII(i18n.DetectASCII())
+	default:
+		i18n.SetASCII(i18n.DetectASCII())
+		i18n.Printf("Warning: Invalid ASCII mode %q, detecting the terminal instead (want on, off or auto)\n", mode)
+	}
+}
+
+// handleLangCommand shows or changes the language and ASCII mode; changes
+// are saved as settings and kept across restarts
+func (a *App) handleLangCommand(ctx context.Context, parts []string) {
+	if len(parts) < 2 {
+		i18n.Printf("Language: %s (available: %s)\n", i18n.Locale(), strings.Join(i18n.Locales(), ", "))
+		if i18n.ASCII() {
+			i18n.Println("ASCII mode: on")
+		} else {
+			i18n.Println("ASCII mode: off")
+		}
+		i18n.Println("Usage: lang <locale>")
+		i18n.Println("       lang ascii <on|off>")
+		return
+	}
+
+	if parts[1] == "ascii" {
+		if len(parts) < 3 || (parts[2] != "on" && parts[2] != "off") {
+			i18n.Println("Usage: lang ascii <on|off>")
+			return
+		}
+		if err := a.settings.Set(ctx, settingASCIIMode, parts[2]); err != nil {
+			i18n.Printf("Failed to set ASCII mode: %v\n", err)
+			return
+		}
+		i18n.Printf("✓ ASCII mode %s\n", parts[2])
+		return
+	}
+
+	if err := a.settings.Set(ctx, settingLocale, parts[1]); err != nil {
+		i18n.Printf("Failed to set language: %v (available: %s)\n", err, strings.Join(i18n.Locales(), ", "))
+		return
+	}
+	i18n.Printf("✓ Language set to %s\n", i18n.Locale())
+}
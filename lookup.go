@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+
+	"github.com/austinwklein/whisper/auth"
+	"github.com/austinwklein/whisper/directory"
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+)
+
+// lookupUsername finds the peer behind a username, trying the trusted
+// directories in order, then the DHT, then users already in the local
+// database. Addresses a directory returns are kept for dialing the peer.
+func (a *App) lookupUsername(ctx context.Context, username string) (peer.ID, error) {
+	if a.directoryClient.Enabled() {
+		i18n.Printf("Looking up %s in directories...\n", username)
+		info, err := a.lookupDirectories(ctx, username)
+		if err == nil {
+			a.p2p.Host().Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.TempAddrTTL)
+			return info.ID, nil
+		}
+		// A bare ErrNotFound means every directory answered without a record
+		if err != directory.ErrNotFound {
+			i18n.Printf("Warning: Directory lookup failed: %v\n", err)
+		}
+	}
+
+	i18n.Printf("Looking up %s in DHT...\n", username)
+	if id, err := a.p2p.FindUserByUsername(ctx, username); err == nil {
+		return id, nil
+	}
+
+	user, err := a.auth.ResolveUsername(ctx, username)
+	if err != nil {
+		return "", err
+	}
+	id, err := peer.Decode(user.PeerID)
+	if err != nil {
+		return "", auth.ErrUserNotFound
+	}
+	return id, nil
+}
+
+// lookupDirectories returns the peer and addresses the trusted directories
+// have for a username
+func (a *App) lookupDirectories(ctx context.Context, username string) (peer.AddrInfo, error) {
+	record, err := a.directoryClient.Lookup(ctx, username)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	return record.AddrInfo()
+}
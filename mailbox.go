@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/mailbox"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// mailboxPollInterval is how often the mailbox is checked for letters the
+	// server couldn't announce, and mailboxRetryInterval how soon a failed
+	// registration is retried
+	mailboxPollInterval  = 10 * time.Minute
+	mailboxRetryInterval = 5 * time.Minute
+
+	// mailboxLookupTTL is how long a friend's mailbox record, or the lack of
+	// one, is remembered, and mailboxLookupTimeout bounds looking it up
+	mailboxLookupTTL     = 10 * time.Minute
+	mailboxLookupTimeout = 5 * time.Second
+)
+
+// errNoMailbox is returned for friends who take no messages through a mailbox
+var errNoMailbox = errors.New("no mailbox")
+
+// mailboxLookup is a friend's mailbox record as last looked up
+type mailboxLookup struct {
+	record *p2p.MailboxRecord
+	err    error
+	at     time.Time
+}
+
+// keepMailbox registers this node with the configured mailbox server,
+// publishes it on the DHT and takes the letters waiting there: right away,
+// whenever the server says new ones arrived, and every mailboxPollInterval.
+// When the config file changes the server, the old one is emptied and left.
+// With no server configured it waits for one.
+func (a *App) keepMailbox(ctx context.Context) {
+	previous := ""
+	for {
+		a.mailboxMu.Lock()
+		server, changed := a.config.Mailbox, a.mailboxChanged
+		a.mailboxMu.Unlock()
+
+		if previous != "" && previous != server {
+			a.leaveMailbox(ctx, previous, server == "")
+		}
+		previous = server
+		if server == "" {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			}
+			continue
+		}
+
+		if err := a.mailboxClient.Register(ctx, server); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			i18n.Printf("\nWarning: Failed to register with mailbox server: %v\n> ", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(mailboxRetryInterval):
+			case <-changed:
+			}
+			continue
+		}
+		a.publishMailbox(ctx, server)
+		published := time.Now()
+		a.fetchMailbox(ctx, server)
+
+		serverID, _ := serverPeer(server)
+		poll := time.NewTicker(mailboxPollInterval)
+	serve:
+		for {
+			select {
+			case <-ctx.Done():
+				poll.Stop()
+				return
+			case <-changed:
+				break serve
+			case from := <-a.mailboxNotified:
+				if from == serverID {
+					a.fetchMailbox(ctx, server)
+				}
+			case <-poll.C:
+				if time.Since(published) > p2p.MailboxRefreshInterval {
+					a.publishMailbox(ctx, server)
+					published = time.Now()
+				}
+				a.fetchMailbox(ctx, server)
+			}
+		}
+		poll.Stop()
+	}
+}
+
+// publishMailbox names server as this node's mailbox on the DHT
+func (a *App) publishMailbox(ctx context.Context, server string) {
+	keys := a.mailboxClient.Keys()
+	if err := a.p2p.PublishMailbox(ctx, server, keys.Public[:]); err != nil && ctx.Err() == nil {
+		i18n.Printf("\nWarning: Failed to publish mailbox: %v\n> ", err)
+	}
+}
+
+// leaveMailbox takes the last letters from a server this node no longer
+// uses and unregisters from it. withdraw also tells the DHT the node has no
+// mailbox any more.
+func (a *App) leaveMailbox(ctx context.Context, server string, withdraw bool) {
+	a.fetchMailbox(ctx, server)
+	if err := a.mailboxClient.Unregister(ctx, server); err != nil && ctx.Err() == nil {
+		i18n.Printf("\nWarning: Failed to leave mailbox server: %v\n> ", err)
+	}
+	if withdraw {
+		a.publishMailbox(ctx, "")
+	}
+}
+
+// fetchMailbox takes the letters waiting at server and receives the
+// messages in them
+func (a *App) fetchMailbox(ctx context.Context, server string) {
+	count, err := a.mailboxClient.Fetch(ctx, server, func(letter *mailbox.Letter) {
+		from, err := peer.Decode(letter.From)
+		if err != nil {
+			return
+		}
+		if err := a.messageManager.ReceiveDeposited(letter.Payload, from); err != nil {
+			i18n.Printf("\nWarning: Dropped a message from your mailbox: %v\n", err)
+		}
+	})
+	if err != nil && ctx.Err() == nil {
+		i18n.Printf("\nWarning: Failed to check your mailbox: %v\n> ", err)
+	}
+	if count > 0 {
+		i18n.Printf("\n📬 Took %d message(s) from your mailbox\n> ", count)
+	}
+}
+
+// setMailbox changes the mailbox server this node takes messages at
+func (a *App) setMailbox(server string) error {
+	if server != "" {
+		if _, err := serverPeer(server); err != nil {
+			return err
+		}
+	}
+	a.mailboxMu.Lock()
+	defer a.mailboxMu.Unlock()
+	a.config.Mailbox = server
+	close(a.mailboxChanged)
+	a.mailboxChanged = make(chan struct{})
+	return nil
+}
+
+// onMailboxNotify passes a server's notice of new letters on to keepMailbox,
+// dropping it if one is already waiting
+func (a *App) onMailboxNotify(from peer.ID) {
+	select {
+	case a.mailboxNotified <- from:
+	default:
+	}
+}
+
+// leaveInMailbox is the message manager's deposit handler: it leaves a
+// message for an unreachable friend at the mailbox server their DHT record
+// names
+func (a *App) leaveInMailbox(ctx context.Context, contact *storage.User, payload []byte) error {
+	pid, err := peer.Decode(contact.PeerID)
+	if err != nil {
+		return err
+	}
+	record, err := a.friendMailbox(ctx, pid)
+	if err != nil {
+		return err
+	}
+	return a.mailboxClient.Deposit(ctx, record, payload)
+}
+
+// friendMailbox returns the mailbox record a friend published, looking it up
+// on the DHT at most once every mailboxLookupTTL
+func (a *App) friendMailbox(ctx context.Context, pid peer.ID) (*p2p.MailboxRecord, error) {
+	a.mailboxMu.Lock()
+	cached, ok := a.mailboxLookups[pid.String()]
+	a.mailboxMu.Unlock()
+	if ok && time.Since(cached.at) < mailboxLookupTTL {
+		return cached.record, cached.err
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, mailboxLookupTimeout)
+	defer cancel()
+	record, err := a.p2p.LookupMailbox(lookupCtx, pid)
+	if err == nil && record.Mailbox == "" {
+		record, err = nil, errNoMailbox
+	}
+
+	a.mailboxMu.Lock()
+	a.mailboxLookups[pid.String()] = &mailboxLookup{record: record, err: err, at: time.Now()}
+	a.mailboxMu.Unlock()
+	return record, err
+}
+
+// serverPeer returns the peer ID of a mailbox server multiaddr
+func serverPeer(server string) (peer.ID, error) {
+	infos, err := p2p.ParsePeerAddrs([]string{server})
+	if err != nil {
+		return "", err
+	}
+	return infos[0].ID, nil
+}
@@ -0,0 +1,177 @@
+package mailbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Client registers this node with its mailbox server and fetches its
+// letters, and deposits letters in friends' mailboxes
+type Client struct {
+	host     host.Host
+	protocol *Protocol
+	identity crypto.PrivKey
+	keys     *KeyPair
+}
+
+// NewClient creates a mailbox client on h and starts accepting notices of
+// new letters; set a handler with SetNotifyHandler to act on them
+func NewClient(h host.Host) (*Client, error) {
+	privKey := h.Peerstore().PrivKey(h.ID())
+	if privKey == nil {
+		return nil, p2p.ErrNoPrivateKey
+	}
+	keys, err := DeriveKeyPair(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{host: h, protocol: NewProtocol(), identity: privKey, keys: keys}
+	p2p.HandleStreams(h, c.protocol.HandleNotify, ProtocolNotify)
+	return c, nil
+}
+
+// Keys returns this node's mailbox key pair
+func (c *Client) Keys() *KeyPair {
+	return c.keys
+}
+
+// SetNotifyHandler sets the handler told that a server has new letters
+func (c *Client) SetNotifyHandler(handler func(peer.ID)) {
+	c.protocol.SetNotifyHandler(handler)
+}
+
+// Register asks the server at serverAddr, a multiaddr with /p2p/, to keep
+// mail for this node
+func (c *Client) Register(ctx context.Context, serverAddr string) error {
+	return c.register(ctx, serverAddr, false)
+}
+
+// Unregister asks the server at serverAddr to stop keeping mail for this
+// node and drop what it holds
+func (c *Client) Unregister(ctx context.Context, serverAddr string) error {
+	return c.register(ctx, serverAddr, true)
+}
+
+// register sends a register request
+func (c *Client) register(ctx context.Context, serverAddr string, unregister bool) error {
+	response, err := c.request(ctx, serverAddr, ProtocolRegister, &RegisterRequest{Unregister: unregister})
+	if err != nil {
+		return err
+	}
+	if !response.OK {
+		return fmt.Errorf("mailbox server refused registration: %w", errorFor(response.Error))
+	}
+	return nil
+}
+
+// Deposit seals payload as a letter to the peer whose mailbox record this
+// is and leaves it at their server
+func (c *Client) Deposit(ctx context.Context, record *p2p.MailboxRecord, payload []byte) error {
+	if record.Mailbox == "" {
+		return errors.New("peer has no mailbox")
+	}
+	to, err := peer.Decode(record.PeerID)
+	if err != nil {
+		return fmt.Errorf("invalid peer ID: %w", err)
+	}
+	sealed, err := Seal(c.identity, to, record.Key, payload, time.Now())
+	if err != nil {
+		return err
+	}
+
+	response, err := c.request(ctx, record.Mailbox, ProtocolDeposit, &DepositRequest{To: to.String(), Sealed: sealed})
+	if err != nil {
+		return err
+	}
+	if !response.OK {
+		return errorFor(response.Error)
+	}
+	return nil
+}
+
+// Fetch takes every letter waiting at the server at serverAddr, passing
+// each to handle, and returns how many there were. Letters that can't be
+// opened are dropped. A letter is only deleted from the server once handle
+// has returned for it.
+func (c *Client) Fetch(ctx context.Context, serverAddr string, handle func(*Letter)) (int, error) {
+	info, err := parseServer(serverAddr)
+	if err != nil {
+		return 0, err
+	}
+
+	fetched := 0
+	ack := []string{}
+	for {
+		envelopes, more, err := c.fetchBatch(ctx, info, ack)
+		if err != nil {
+			return fetched, err
+		}
+		ack = ack[:0]
+		for _, envelope := range envelopes {
+			if letter, err := Open(c.keys, c.host.ID(), envelope.Sealed); err == nil {
+				handle(letter)
+				fetched++
+			}
+			ack = append(ack, envelope.ID)
+		}
+		if len(ack) == 0 {
+			return fetched, nil
+		}
+		if !more {
+			// One last round trip deletes the final batch
+			_, _, err := c.fetchBatch(ctx, info, ack)
+			return fetched, err
+		}
+	}
+}
+
+// fetchBatch acknowledges letters and fetches the next batch
+func (c *Client) fetchBatch(ctx context.Context, info peer.AddrInfo, ack []string) ([]*Envelope, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	if err := c.host.Connect(ctx, info); err != nil {
+		return nil, false, fmt.Errorf("failed to connect to mailbox server: %w", err)
+	}
+	stream, err := c.host.NewStream(ctx, info.ID, ProtocolFetch)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open stream to mailbox server: %w", err)
+	}
+	return SendFetchRequest(ctx, stream, &FetchRequest{Ack: ack})
+}
+
+// request sends one register or deposit request to a server
+func (c *Client) request(ctx context.Context, serverAddr string, proto protocol.ID, request interface{}) (*Response, error) {
+	info, err := parseServer(serverAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	if err := c.host.Connect(ctx, info); err != nil {
+		return nil, fmt.Errorf("failed to connect to mailbox server: %w", err)
+	}
+	stream, err := c.host.NewStream(ctx, info.ID, proto)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream to mailbox server: %w", err)
+	}
+	return SendRequest(ctx, stream, request)
+}
+
+// parseServer parses a mailbox server multiaddr, which must include /p2p/
+func parseServer(serverAddr string) (peer.AddrInfo, error) {
+	infos, err := p2p.ParsePeerAddrs([]string{serverAddr})
+	if err != nil {
+		return peer.AddrInfo{}, fmt.Errorf("invalid mailbox server %q: %w", serverAddr, err)
+	}
+	return infos[0], nil
+}
@@ -0,0 +1,149 @@
+// Package mailbox lets friends leave messages for a node while it is
+// offline. A node picks a mailbox server anyone can run, registers with it
+// and names it in a signed DHT record. A friend who can't reach the node
+// looks the record up and deposits the message at the server as a letter:
+// signed by the sender and sealed to the recipient's mailbox key, so the
+// server only ever holds ciphertext. The recipient fetches its letters when
+// it logs in, and again whenever the server tells it new ones arrived.
+package mailbox
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	// MaxSealedSize bounds a sealed letter, leaving room in a wire message
+	// for the base64 it travels as
+	MaxSealedSize = 44 * 1024
+
+	// requestTimeout bounds one exchange with a mailbox server
+	requestTimeout = 15 * time.Second
+)
+
+var (
+	ErrNotRegistered = errors.New("recipient has no mailbox at this server")
+	ErrMailboxFull   = errors.New("recipient's mailbox is full")
+	ErrServerFull    = errors.New("mailbox server is full")
+	ErrTooLarge      = fmt.Errorf("letter larger than %d bytes", MaxSealedSize)
+	ErrUndecryptable = errors.New("letter could not be decrypted")
+	ErrInvalidLetter = errors.New("invalid letter")
+)
+
+// Letter is what a sender leaves in a mailbox: a payload for To, signed by
+// From. It is sealed before it reaches the server.
+type Letter struct {
+	From      string `json:"from"` // Sender's peer ID
+	To        string `json:"to"`   // Recipient's peer ID
+	Payload   []byte `json:"payload"`
+	SentAt    int64  `json:"sent_at"` // Unix timestamp
+	Signature []byte `json:"signature"`
+}
+
+// signedBytes returns the bytes covered by the signature
+func (l *Letter) signedBytes() []byte {
+	sum := sha256.Sum256(l.Payload)
+	return []byte(fmt.Sprintf("whisper-mailbox-letter:%s:%s:%d:%x", l.From, l.To, l.SentAt, sum))
+}
+
+// Verify checks the letter's signature against the key embedded in its
+// sender's peer ID
+func (l *Letter) Verify() error {
+	id, err := peer.Decode(l.From)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidLetter, err)
+	}
+	pubKey, err := id.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidLetter, err)
+	}
+	ok, err := pubKey.Verify(l.signedBytes(), l.Signature)
+	if err != nil || !ok {
+		return fmt.Errorf("%w: bad signature", ErrInvalidLetter)
+	}
+	return nil
+}
+
+// KeyPair is a node's mailbox encryption key
+type KeyPair struct {
+	Public  [32]byte
+	Private [32]byte
+}
+
+// DeriveKeyPair derives the node's mailbox key from its identity key, so it
+// needs no storage of its own and survives reinstalls from a backup
+func DeriveKeyPair(identity crypto.PrivKey) (*KeyPair, error) {
+	raw, err := identity.Raw()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity key: %w", err)
+	}
+	pair := &KeyPair{Private: sha256.Sum256(append([]byte("whisper-mailbox-key:"), raw...))}
+	public, err := curve25519.X25519(pair.Private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive mailbox key: %w", err)
+	}
+	copy(pair.Public[:], public)
+	return pair, nil
+}
+
+// Seal signs payload as a letter from the identity key to recipient and
+// encrypts it to the recipient's mailbox key
+func Seal(identity crypto.PrivKey, recipient peer.ID, recipientKey []byte, payload []byte, now time.Time) ([]byte, error) {
+	if len(recipientKey) != curve25519.PointSize {
+		return nil, fmt.Errorf("%w: bad mailbox key", ErrInvalidLetter)
+	}
+	from, err := peer.IDFromPrivateKey(identity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive peer ID: %w", err)
+	}
+
+	letter := &Letter{From: from.String(), To: recipient.String(), Payload: payload, SentAt: now.Unix()}
+	letter.Signature, err = identity.Sign(letter.signedBytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign letter: %w", err)
+	}
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return nil, err
+	}
+
+	var key [32]byte
+	copy(key[:], recipientKey)
+	sealed, err := box.SealAnonymous(nil, data, &key, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) > MaxSealedSize {
+		return nil, ErrTooLarge
+	}
+	return sealed, nil
+}
+
+// Open decrypts a letter sealed to the key pair and checks that it was
+// signed by its sender and meant for self
+func Open(pair *KeyPair, self peer.ID, sealed []byte) (*Letter, error) {
+	data, ok := box.OpenAnonymous(nil, sealed, &pair.Public, &pair.Private)
+	if !ok {
+		return nil, ErrUndecryptable
+	}
+	var letter Letter
+	if err := json.Unmarshal(data, &letter); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUndecryptable, err)
+	}
+	if letter.To != self.String() {
+		return nil, fmt.Errorf("%w: addressed to someone else", ErrInvalidLetter)
+	}
+	if err := letter.Verify(); err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
@@ -0,0 +1,267 @@
+package mailbox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// Protocol IDs. Register, deposit and fetch are served by mailbox
+	// servers; notify is sent by a server to the nodes it keeps mail for.
+	ProtocolRegister = protocol.ID("/whisper/mailbox/register/1.0.0")
+	ProtocolDeposit  = protocol.ID("/whisper/mailbox/deposit/1.0.0")
+	ProtocolFetch    = protocol.ID("/whisper/mailbox/fetch/1.0.0")
+	ProtocolNotify   = protocol.ID("/whisper/mailbox/notify/1.0.0")
+)
+
+// RegisterRequest asks a server to keep mail for the requesting peer, or to
+// stop and drop what it holds
+type RegisterRequest struct {
+	Unregister bool `json:"unregister,omitempty"`
+}
+
+// DepositRequest leaves a sealed letter in a peer's mailbox
+type DepositRequest struct {
+	To     string `json:"to"` // Recipient's peer ID
+	Sealed []byte `json:"sealed"`
+}
+
+// FetchRequest asks for the letters in the requesting peer's mailbox, after
+// deleting the ones it already took
+type FetchRequest struct {
+	Ack []string `json:"ack,omitempty"` // IDs of letters taken in the previous fetch
+}
+
+// Envelope is a sealed letter as a mailbox holds it
+type Envelope struct {
+	ID          string    `json:"id"`
+	Sealed      []byte    `json:"sealed"`
+	DepositedAt time.Time `json:"deposited_at"`
+}
+
+// FetchItem is one line of a fetch response: an envelope, or the final line
+// saying whether more letters are waiting
+type FetchItem struct {
+	Envelope *Envelope `json:"envelope,omitempty"`
+	Done     bool      `json:"done,omitempty"`
+	More     bool      `json:"more,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Response reports whether a register or deposit request succeeded
+type Response struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Protocol handles the mailbox protocols
+type Protocol struct {
+	registerHandler func(request *RegisterRequest, fromPeer peer.ID) *Response
+	depositHandler  func(request *DepositRequest, fromPeer peer.ID) *Response
+	fetchHandler    func(request *FetchRequest, fromPeer peer.ID) ([]*Envelope, bool, error)
+	notifyHandler   func(fromPeer peer.ID)
+}
+
+// NewProtocol creates a new mailbox protocol handler
+func NewProtocol() *Protocol {
+	return &Protocol{}
+}
+
+// SetRegisterHandler sets the handler that answers register requests
+func (p *Protocol) SetRegisterHandler(handler func(*RegisterRequest, peer.ID) *Response) {
+	p.registerHandler = handler
+}
+
+// SetDepositHandler sets the handler that answers deposit requests
+func (p *Protocol) SetDepositHandler(handler func(*DepositRequest, peer.ID) *Response) {
+	p.depositHandler = handler
+}
+
+// SetFetchHandler sets the handler that answers fetch requests with the
+// envelopes to send and whether more are waiting
+func (p *Protocol) SetFetchHandler(handler func(*FetchRequest, peer.ID) ([]*Envelope, bool, error)) {
+	p.fetchHandler = handler
+}
+
+// SetNotifyHandler sets the handler told that a server has new letters
+func (p *Protocol) SetNotifyHandler(handler func(peer.ID)) {
+	p.notifyHandler = handler
+}
+
+// HandleRegister answers an incoming register request
+func (p *Protocol) HandleRegister(s network.Stream) {
+	defer s.Close()
+
+	var request RegisterRequest
+	if err := readRequest(s, &request); err != nil {
+		fmt.Printf("Error reading mailbox register request: %v\n", err)
+		return
+	}
+
+	response := &Response{Error: "registration not supported"}
+	if p.registerHandler != nil {
+		response = p.registerHandler(&request, s.Conn().RemotePeer())
+	}
+	writeResponse(s, response)
+}
+
+// HandleDeposit answers an incoming deposit request
+func (p *Protocol) HandleDeposit(s network.Stream) {
+	defer s.Close()
+
+	var request DepositRequest
+	if err := readRequest(s, &request); err != nil {
+		fmt.Printf("Error reading mailbox deposit: %v\n", err)
+		return
+	}
+
+	response := &Response{Error: "deposits not supported"}
+	switch {
+	case len(request.Sealed) == 0:
+		response = &Response{Error: "letter missing"}
+	case len(request.Sealed) > MaxSealedSize:
+		response = &Response{Error: ErrTooLarge.Error()}
+	case p2p.CheckPeerIDField("to", request.To) != nil:
+		response = &Response{Error: "invalid recipient"}
+	case p.depositHandler != nil:
+		response = p.depositHandler(&request, s.Conn().RemotePeer())
+	}
+	writeResponse(s, response)
+}
+
+// HandleFetch answers an incoming fetch request, one envelope per line
+func (p *Protocol) HandleFetch(s network.Stream) {
+	defer s.Close()
+
+	var request FetchRequest
+	if err := readRequest(s, &request); err != nil {
+		fmt.Printf("Error reading mailbox fetch: %v\n", err)
+		return
+	}
+	if p.fetchHandler == nil {
+		writeResponse(s, &FetchItem{Done: true, Error: "fetching not supported"})
+		return
+	}
+
+	envelopes, more, err := p.fetchHandler(&request, s.Conn().RemotePeer())
+	if err != nil {
+		writeResponse(s, &FetchItem{Done: true, Error: err.Error()})
+		return
+	}
+	for _, envelope := range envelopes {
+		writeResponse(s, &FetchItem{Envelope: envelope})
+	}
+	writeResponse(s, &FetchItem{Done: true, More: more})
+}
+
+// HandleNotify receives a server's notice that new letters arrived
+func (p *Protocol) HandleNotify(s network.Stream) {
+	defer s.Close()
+	if p.notifyHandler != nil {
+		p.notifyHandler(s.Conn().RemotePeer())
+	}
+}
+
+// readRequest reads and decodes one JSON request line
+func readRequest(s network.Stream, request interface{}) error {
+	data, err := p2p.ReadWireMessage(bufio.NewReader(s))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, request)
+}
+
+// writeResponse writes one JSON response line
+func writeResponse(s network.Stream, response interface{}) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		fmt.Printf("Error marshaling mailbox response: %v\n", err)
+		return
+	}
+
+	data = append(data, '\n')
+	if _, err := s.Write(data); err != nil {
+		fmt.Printf("Error writing mailbox response: %v\n", err)
+	}
+}
+
+// writeRequest writes one JSON request line and closes the write side
+func writeRequest(s network.Stream, request interface{}) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	data = append(data, '\n')
+	if _, err := s.Write(data); err != nil {
+		return fmt.Errorf("failed to write request: %w", err)
+	}
+	return s.CloseWrite()
+}
+
+// SendRequest sends a register or deposit request and reads the response
+func SendRequest(ctx context.Context, s network.Stream, request interface{}) (*Response, error) {
+	defer s.Close()
+
+	if err := writeRequest(s, request); err != nil {
+		return nil, err
+	}
+	data, err := p2p.ReadWireMessage(bufio.NewReader(s))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	var response Response
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return &response, nil
+}
+
+// SendFetchRequest sends a fetch request and reads the envelopes it returns,
+// reporting whether more are waiting
+func SendFetchRequest(ctx context.Context, s network.Stream, request *FetchRequest) ([]*Envelope, bool, error) {
+	defer s.Close()
+
+	if err := writeRequest(s, request); err != nil {
+		return nil, false, err
+	}
+	reader := bufio.NewReader(s)
+	envelopes := []*Envelope{}
+	for {
+		data, err := p2p.ReadWireMessage(reader)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read response: %w", err)
+		}
+		var item FetchItem
+		if err := json.Unmarshal(data, &item); err != nil {
+			return nil, false, fmt.Errorf("failed to unmarshal response: %w", err)
+		}
+		switch {
+		case item.Error != "":
+			return nil, false, errorFor(item.Error)
+		case item.Done:
+			return envelopes, item.More, nil
+		case item.Envelope != nil:
+			envelopes = append(envelopes, item.Envelope)
+		}
+	}
+}
+
+// errorFor turns an error a server reported back into the matching error
+// value, so callers can tell them apart
+func errorFor(message string) error {
+	for _, known := range []error{ErrNotRegistered, ErrMailboxFull, ErrServerFull, ErrTooLarge} {
+		if message == known.Error() {
+			return known
+		}
+	}
+	return fmt.Errorf("mailbox server: %s", message)
+}
@@ -0,0 +1,300 @@
+package mailbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// maxMailboxes caps the nodes a server keeps mail for
+	maxMailboxes = 10000
+
+	// maxLetters caps the letters waiting in one mailbox
+	maxLetters = 500
+
+	// letterLifetime is how long a letter waits to be fetched before the
+	// server drops it
+	letterLifetime = 30 * 24 * time.Hour
+
+	// fetchBatch is how many letters one fetch returns
+	fetchBatch = 50
+)
+
+// inbox is one node's mailbox: the letters waiting for it
+type inbox struct {
+	Registered time.Time   `json:"registered"`
+	Envelopes  []*Envelope `json:"envelopes"`
+}
+
+// Server keeps letters for the nodes registered with it until they fetch
+// them. Each mailbox is kept in a JSON file of its own under dir, so mail
+// survives restarts.
+type Server struct {
+	host     host.Host
+	protocol *Protocol
+	dir      string
+
+	mu    sync.Mutex
+	boxes map[peer.ID]*inbox
+}
+
+// NewServer creates a mailbox server serving the register, deposit and fetch
+// protocols on h, keeping mailboxes under dir
+func NewServer(h host.Host, dir string) (*Server, error) {
+	s := &Server{
+		host:     h,
+		protocol: NewProtocol(),
+		dir:      dir,
+		boxes:    make(map[peer.ID]*inbox),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	s.protocol.SetRegisterHandler(s.handleRegister)
+	s.protocol.SetDepositHandler(s.handleDeposit)
+	s.protocol.SetFetchHandler(s.handleFetch)
+	p2p.HandleStreams(h, s.protocol.HandleRegister, ProtocolRegister)
+	p2p.HandleStreams(h, s.protocol.HandleDeposit, ProtocolDeposit)
+	p2p.HandleStreams(h, s.protocol.HandleFetch, ProtocolFetch)
+	return s, nil
+}
+
+// Mailboxes returns how many nodes the server keeps mail for
+func (s *Server) Mailboxes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.boxes)
+}
+
+// Register opens a mailbox for a peer; registering again keeps its letters
+func (s *Server) Register(pid peer.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.boxes[pid]
+	if !ok {
+		if len(s.boxes) >= maxMailboxes {
+			return ErrServerFull
+		}
+		b = &inbox{Envelopes: []*Envelope{}}
+		s.boxes[pid] = b
+	}
+	b.Registered = time.Now()
+	return s.save(pid)
+}
+
+// Unregister closes a peer's mailbox, dropping the letters in it
+func (s *Server) Unregister(pid peer.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.boxes, pid)
+	err := os.Remove(s.boxPath(pid))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove mailbox: %w", err)
+	}
+	return nil
+}
+
+// Deposit leaves a sealed letter in a registered peer's mailbox and tells
+// the peer, if it is connected
+func (s *Server) Deposit(to peer.ID, sealed []byte) error {
+	if len(sealed) > MaxSealedSize {
+		return ErrTooLarge
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	b, ok := s.boxes[to]
+	if !ok {
+		s.mu.Unlock()
+		return ErrNotRegistered
+	}
+	now := time.Now()
+	b.expire(now)
+	if len(b.Envelopes) >= maxLetters {
+		s.mu.Unlock()
+		return ErrMailboxFull
+	}
+	b.Envelopes = append(b.Envelopes, &Envelope{ID: hex.EncodeToString(buf), Sealed: sealed, DepositedAt: now})
+	err := s.save(to)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if s.host.Network().Connectedness(to) == network.Connected {
+		go s.notify(to)
+	}
+	return nil
+}
+
+// Fetch deletes the letters a peer acknowledged and returns the next batch
+// of its mailbox, oldest first, reporting whether more are waiting
+func (s *Server) Fetch(pid peer.ID, ack []string) ([]*Envelope, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.boxes[pid]
+	if !ok {
+		return nil, false, ErrNotRegistered
+	}
+
+	acked := make(map[string]bool, len(ack))
+	for _, id := range ack {
+		acked[id] = true
+	}
+	kept := b.Envelopes[:0]
+	for _, envelope := range b.Envelopes {
+		if !acked[envelope.ID] {
+			kept = append(kept, envelope)
+		}
+	}
+	changed := len(kept) != len(b.Envelopes)
+	b.Envelopes = kept
+	if b.expire(time.Now()) {
+		changed = true
+	}
+	if changed {
+		if err := s.save(pid); err != nil {
+			return nil, false, err
+		}
+	}
+
+	batch := b.Envelopes
+	if len(batch) > fetchBatch {
+		batch = batch[:fetchBatch]
+	}
+	return append([]*Envelope(nil), batch...), len(b.Envelopes) > len(batch), nil
+}
+
+// expire drops letters older than letterLifetime, reporting whether any were
+func (b *inbox) expire(now time.Time) bool {
+	kept := b.Envelopes[:0]
+	for _, envelope := range b.Envelopes {
+		if now.Sub(envelope.DepositedAt) < letterLifetime {
+			kept = append(kept, envelope)
+		}
+	}
+	expired := len(kept) != len(b.Envelopes)
+	b.Envelopes = kept
+	return expired
+}
+
+// notify tells a connected peer that new letters are waiting
+func (s *Server) notify(pid peer.ID) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	stream, err := s.host.NewStream(ctx, pid, ProtocolNotify)
+	if err != nil {
+		return
+	}
+	stream.Close()
+}
+
+// handleRegister answers a register request made over libp2p
+func (s *Server) handleRegister(request *RegisterRequest, fromPeer peer.ID) *Response {
+	var err error
+	if request.Unregister {
+		err = s.Unregister(fromPeer)
+	} else {
+		err = s.Register(fromPeer)
+	}
+	if err != nil {
+		return &Response{Error: err.Error()}
+	}
+	return &Response{OK: true}
+}
+
+// handleDeposit answers a deposit made over libp2p
+func (s *Server) handleDeposit(request *DepositRequest, fromPeer peer.ID) *Response {
+	to, err := peer.Decode(request.To)
+	if err != nil {
+		return &Response{Error: "invalid recipient"}
+	}
+	if err := s.Deposit(to, request.Sealed); err != nil {
+		return &Response{Error: err.Error()}
+	}
+	return &Response{OK: true}
+}
+
+// handleFetch answers a fetch made over libp2p; a peer can only fetch its
+// own mailbox
+func (s *Server) handleFetch(request *FetchRequest, fromPeer peer.ID) ([]*Envelope, bool, error) {
+	return s.Fetch(fromPeer, request.Ack)
+}
+
+// boxPath returns the file a peer's mailbox is kept in
+func (s *Server) boxPath(pid peer.ID) string {
+	return filepath.Join(s.dir, pid.String()+".json")
+}
+
+// load reads the saved mailboxes, if any
+func (s *Server) load() error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create mailbox directory: %w", err)
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read mailboxes: %w", err)
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		pid, err := peer.Decode(name)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read mailbox: %w", err)
+		}
+		var b inbox
+		if err := json.Unmarshal(data, &b); err != nil {
+			return fmt.Errorf("failed to parse mailbox %s: %w", entry.Name(), err)
+		}
+		s.boxes[pid] = &b
+	}
+	return nil
+}
+
+// save writes a peer's mailbox atomically; caller holds mu
+func (s *Server) save(pid peer.ID) error {
+	b, ok := s.boxes[pid]
+	if !ok {
+		return errors.New("no such mailbox")
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	path := s.boxPath(pid)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to save mailbox: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to save mailbox: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package mailbox
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// TestServerRecoversFromHandlerPanic checks a panic answering one request
+// resets that stream and leaves the server serving the next
+func TestServerRecoversFromHandlerPanic(t *testing.T) {
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatalf("failed to start hosts: %v", err)
+	}
+	t.Cleanup(func() { mn.Close() })
+	client, host := mn.Hosts()[0], mn.Hosts()[1]
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	server, err := NewServer(host, t.TempDir())
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	server.protocol.SetRegisterHandler(func(*RegisterRequest, peer.ID) *Response { panic("injected failure") })
+	before := len(p2p.DefaultStreamGuard.RecentPanics())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	register := func() (*Response, error) {
+		s, err := client.NewStream(ctx, host.ID(), ProtocolRegister)
+		if err != nil {
+			t.Fatalf("NewStream: %v", err)
+		}
+		return SendRequest(ctx, s, &RegisterRequest{})
+	}
+
+	if _, err := register(); err == nil {
+		t.Error("got an answer from a handler that panicked; want the stream reset")
+	}
+	recent := p2p.DefaultStreamGuard.RecentPanics()
+	if len(recent) <= before || recent[len(recent)-1].Handler != string(ProtocolRegister) || recent[len(recent)-1].Peer != client.ID() {
+		t.Errorf("panic was not recorded: %+v", recent)
+	}
+
+	server.protocol.SetRegisterHandler(server.handleRegister)
+	if response, err := register(); err != nil || response.Error != "" {
+		t.Fatalf("register after the panic: %+v, %v", response, err)
+	}
+	if server.Mailboxes() != 1 {
+		t.Errorf("server keeps %d mailboxes, want 1", server.Mailboxes())
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/austinwklein/whisper/config"
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/mailbox"
+	"github.com/austinwklein/whisper/p2p"
+)
+
+// defaultMailboxServerPort keeps a mailbox server clear of a whisper node and
+// a push relay on the same machine
+const defaultMailboxServerPort = 9991
+
+// runMailboxServerCommand handles `whisper mailbox-server`, which runs a
+// mailbox server: nodes register with it, and their friends leave sealed
+// messages there for them to fetch when they come online
+func runMailboxServerCommand(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("mailbox-server", flag.ContinueOnError)
+	port := fs.Int("port", defaultMailboxServerPort, "port to listen on")
+	dataDir := fs.String("data", filepath.Join(cfg.DataDir, "mailbox-server"), "directory for the server's identity and mailboxes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("usage: whisper mailbox-server [--port <n>] [--data <dir>]")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dir := absPath(*dataDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create mailbox server data directory: %w", err)
+	}
+	privKey, err := p2p.LoadOrCreateIdentity(ctx, keyFile(filepath.Join(dir, "identity.key")))
+	if err != nil {
+		return err
+	}
+
+	host, err := p2p.NewP2PHost(ctx, *port, privKey, p2p.Options{DHTMode: cfg.DHTMode})
+	if err != nil {
+		return fmt.Errorf("failed to start P2P host: %w", err)
+	}
+	defer host.Close()
+
+	server, err := mailbox.NewServer(host.Host(), filepath.Join(dir, "mailboxes"))
+	if err != nil {
+		return err
+	}
+
+	i18n.Printf("✓ Mailbox server running, keeping mail for %d node(s)\n", server.Mailboxes())
+	i18n.Println("Set WHISPER_MAILBOX to one of these addresses:")
+	for _, addr := range host.ShareableAddrs() {
+		i18n.Printf("  %s\n", addr)
+	}
+
+	<-ctx.Done()
+	i18n.Println("Shutting down...")
+	return nil
+}
@@ -3,20 +3,36 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
-	"syscall"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/austinwklein/whisper/auth"
 	"github.com/austinwklein/whisper/conference"
 	"github.com/austinwklein/whisper/config"
+	"github.com/austinwklein/whisper/diagnostics"
+	"github.com/austinwklein/whisper/directory"
 	"github.com/austinwklein/whisper/friends"
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/mailbox"
 	"github.com/austinwklein/whisper/messages"
 	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/push"
+	"github.com/austinwklein/whisper/rendezvous"
+	"github.com/austinwklein/whisper/reputation"
+	"github.com/austinwklein/whisper/search"
+	"github.com/austinwklein/whisper/settings"
 	"github.com/austinwklein/whisper/storage"
+	"github.com/austinwklein/whisper/update"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
 )
@@ -29,8 +45,58 @@ type App struct {
 	friendManager     *friends.Manager
 	messageManager    *messages.Manager
 	conferenceManager *conference.Manager
+	searchManager     *search.Manager
+	rendezvousManager *rendezvous.Manager
+	directoryClient   *directory.Client
+	pushClient        *push.Client
+	mailboxClient     *mailbox.Client
+	updates           *update.Checker
+	reputation        *reputation.Tracker
+	settings          *settings.Service
+
+	pushMu       sync.Mutex
+	pushEndpoint *push.Endpoint       // This device's endpoint at the push relay, once registered
+	pushChanged  chan struct{}        // Closed and replaced when the push relay or device changes
+	pushWoken    map[string]time.Time // When each friend was last woken, by peer ID
+
+	mailboxMu       sync.Mutex
+	mailboxChanged  chan struct{}             // Closed and replaced when the mailbox server changes
+	mailboxNotified chan peer.ID              // Servers that said new letters arrived; see keepMailbox
+	mailboxLookups  map[string]*mailboxLookup // Friends' mailbox records, by peer ID
+
+	sessionCtx    context.Context    // Background work for the logged-in account runs under it
+	sessionCancel context.CancelFunc // Stops background work for the logged-in account
+	namesCancel   context.CancelFunc // Stops publishing the account's usernames; see publishNames
+
+	activityMu   sync.Mutex
+	lastActivity time.Time // When the last command was entered, for auto-lock
+
+	autoDialMu sync.Mutex
+	dialMode   string // When offline friends are dialed automatically; see autodial.go
+
+	compatMu     sync.Mutex
+	compatWarned map[string]string // Version each friend was last warned about, by peer ID; see compat.go
+
+	conversation *conversation  // Opened with goto; only the command loop uses it
+	input        *bufio.Scanner // Standard input; only the command loop and its password prompts read it
+
+	identityOwner int64         // Account whose own key the host runs with, or 0 for the node identity
+	restartAs     *accountLogin // Account to log in to once the node restarts with its identity
+
+	quit     context.CancelFunc // Shuts the node down gracefully, as a stop signal would
+	draining atomic.Bool        // A drain is under way; see drain.go
 }
 
+// accountLogin is an account the node logs in to as soon as it starts
+type accountLogin struct {
+	username string
+	password string
+}
+
+// stdin is read by every command loop in turn, so input already buffered
+// isn't lost when the node restarts as another account
+var stdin = bufio.NewScanner(os.Stdin)
+
 func main() {
 	// Load configuration
 	cfg, err := config.LoadConfig()
@@ -38,18 +104,168 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	// Initialize storage
-	store, err := storage.NewSQLiteStorage(cfg.DBPath)
+	// Show text in the configured language, and as plain ASCII where the
+	// terminal can't show emoji
+	applyDisplaySettings(cfg)
+
+	// Non-interactive subcommands run and exit without starting the node
+	if len(os.Args) > 1 && os.Args[1] == "account" {
+		if err := runAccountCommand(cfg, os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "conformance" {
+		if err := runConformanceCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		if err := runCtlCommand(cfg, os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "health" {
+		if err := runHealthCommand(cfg, os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "evidence-verify" {
+		if err := runEvidenceVerifyCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "push-relay" {
+		if err := runPushRelayCommand(cfg, os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "mailbox-server" {
+		if err := runMailboxServerCommand(cfg, os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	// The daemon runs the node headless, or installs it as a system service
+	if len(os.Args) > 1 && os.Args[1] == "daemon" {
+		if err := runDaemonCommand(cfg, os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--guest":
+			cfg.Guest = true
+		case "--account":
+			name := ""
+			if i+1 < len(args) {
+				i++
+				name = args[i]
+			}
+			if err := cfg.SetAccount(name); err != nil {
+				fmt.Fprintf(os.Stderr, "--account: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	runForeground(cfg, nil)
+}
+
+// runNode starts the node and runs it until parent is cancelled or the user
+// quits. Without daemon options it reads commands from standard input; with
+// them it runs headless, logged in to the daemon's account if it has one.
+// The node starts with the identity of the account it logs in to first: the
+// daemon's, or login's if given. If the user switches to an account with
+// another identity, runNode returns that account to start the node again as.
+func runNode(parent context.Context, cfg *config.Config, daemon *daemonOptions, login *accountLogin) *accountLogin {
+	var err error
+	// Initialize storage; guests get a throwaway in-memory database (and with it identity)
+	var store *storage.SQLiteStorage
+	if cfg.Guest {
+		store, err = storage.NewMemoryStorage()
+	} else {
+		store, err = storage.NewSQLiteStorage(cfg.DBPath)
+	}
 	if err != nil {
 		log.Fatalf("Failed to initialize storage: %v", err)
 	}
 	defer store.Close()
+	store.SetSlowQueryThreshold(time.Duration(cfg.SlowQueryMs) * time.Millisecond)
 
-	// Initialize P2P host (no private key = generate new one)
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(parent)
 	defer cancel()
 
-	p2pHost, err := p2p.NewP2PHost(ctx, cfg.Port, nil)
+	// Settings changed at runtime override the configuration they default to
+	settingsService := loadSettings(ctx, store, cfg)
+
+	// Load the identity so the PeerID is stable across restarts
+	firstAccount := ""
+	switch {
+	case login != nil:
+		firstAccount = login.username
+	case daemon != nil:
+		firstAccount = daemon.username
+	}
+	identity, owner, err := startIdentity(ctx, cfg, store, firstAccount)
+	if err != nil {
+		log.Fatalf("Failed to load identity: %v", err)
+	}
+	privKey, err := p2p.LoadOrCreateIdentity(ctx, identity)
+	if err != nil {
+		log.Fatalf("Failed to load identity: %v", err)
+	}
+
+	// Take automatic backups in the background, encrypted if given a passphrase
+	backupPassphrase := ""
+	if cfg.BackupPassphraseFile != "" {
+		if backupPassphrase, err = readPasswordFile(cfg.BackupPassphraseFile); err != nil {
+			log.Fatalf("Failed to read the backup passphrase: %v", err)
+		}
+	}
+	go store.RunScheduledBackups(ctx, time.Duration(cfg.BackupIntervalHours)*time.Hour, cfg.BackupRetain, backupPassphrase)
+
+	// Keep each category of stored data within its quota
+	quotas, err := quotasFromConfig(cfg)
+	if err != nil {
+		log.Fatalf("Invalid quota: %v", err)
+	}
+	store.SetQuotas(quotas)
+	if len(quotas) > 0 {
+		go store.RunQuotaEnforcement(ctx, quotaCheckInterval)
+	}
+
+	// Relays help with NAT traversal and resolve username@relay addresses
+	relays, err := p2p.ParsePeerAddrs(cfg.Relays)
+	if err != nil {
+		log.Fatalf("Invalid WHISPER_RELAYS: %v", err)
+	}
+
+	// Initialize P2P host
+	p2pHost, err := p2p.NewP2PHost(ctx, cfg.Port, privKey, p2p.Options{
+		DHTMode:                   cfg.DHTMode,
+		MaxMemoryMB:               cfg.MaxMemoryMB,
+		MaxStreamsPerPeerProtocol: cfg.MaxStreamsPerPeerProtocol,
+		ScoreStore:                store,
+		StaticRelays:              relays,
+		RelayService:              cfg.RelayService,
+	})
 	if err != nil {
 		log.Fatalf("Failed to initialize P2P host: %v", err)
 	}
@@ -63,9 +279,76 @@ func main() {
 
 	// Initialize message manager
 	messageManager := messages.NewManager(store, p2pHost.Host())
+	messageManager.SetDefaultTTL(time.Duration(cfg.MessageTTLHours) * time.Hour)
 
 	// Initialize conference manager
 	conferenceManager := conference.NewManager(store, p2pHost.Host(), p2pHost.PubSub())
+	conferenceManager.SetPersistencePolicy(cfg.ConferenceArchivers)
+	conferenceManager.SetDefaultMaxParticipants(cfg.ConferenceMaxParticipants)
+	if err := conferenceManager.SetCompaction(cfg.ConferenceCompactPolicy, cfg.ConferenceCompactDays); err != nil {
+		log.Fatalf("Invalid WHISPER_CONF_COMPACT_POLICY: %v", err)
+	}
+
+	// Score peers by how they behave: misbehaving peers lose GossipSub score,
+	// and the worst are disconnected and refused until they recover
+	reputationTracker := reputation.NewTracker(ctx, store)
+	reputationTracker.SetBlockHandler(func(pid peer.ID) {
+		i18n.Printf("\n🚫 Blocked peer %s for misbehaving - 'debug peer %s'\n> ", pid, pid)
+		p2pHost.DisconnectPeer(pid)
+	})
+	p2pHost.SetReputationHandler(reputationTracker.GossipPenalty)
+	p2pHost.SetConnectionFilter(reputationTracker.Allowed)
+	friendManager.SetOffenseHandler(reputationTracker.Report)
+	messageManager.SetOffenseHandler(reputationTracker.Report)
+	conferenceManager.SetOffenseHandler(reputationTracker.Report)
+	p2p.DefaultStreamGuard.SetAuthorizer(reputationTracker.Allowed)
+	p2p.DefaultStreamGuard.SetOffenseHandler(func(pid peer.ID) { reputationTracker.Report(pid, storage.PeerOffenseRateLimited) })
+
+	// Initialize search manager
+	searchManager := search.NewManager(store, p2pHost.Host(), p2pHost)
+
+	// Initialize rendezvous manager
+	rendezvousManager := rendezvous.NewManager(p2pHost.Host(), relays, cfg.RelayService)
+
+	// Look usernames up in trusted directories, and optionally serve one
+	directoryClient, err := directory.NewClient(p2pHost.Host(), cfg.Directories)
+	if err != nil {
+		log.Fatalf("Invalid WHISPER_DIRECTORIES: %v", err)
+	}
+	if cfg.DirectoryService {
+		directoryServer := directory.NewServer(p2pHost.Host())
+		if cfg.DirectoryHTTPAddr != "" {
+			if err := directoryServer.ListenHTTP(ctx, cfg.DirectoryHTTPAddr); err != nil {
+				log.Fatalf("Failed to start directory server: %v", err)
+			}
+		}
+	}
+
+	// Wake friends through their push relays, and let them wake us through ours
+	pushClient, err := push.NewClient(p2pHost.Host())
+	if err != nil {
+		log.Fatalf("Failed to initialize push client: %v", err)
+	}
+	if cfg.PushRelay != "" && (cfg.PushProvider == "" || cfg.PushTarget == "") {
+		log.Fatalf("WHISPER_PUSH_RELAY needs WHISPER_PUSH_PROVIDER and WHISPER_PUSH_TARGET")
+	}
+
+	// Take messages at a mailbox server while offline, and leave them at friends'
+	mailboxClient, err := mailbox.NewClient(p2pHost.Host())
+	if err != nil {
+		log.Fatalf("Failed to initialize mailbox client: %v", err)
+	}
+	if cfg.Mailbox != "" {
+		if _, err := serverPeer(cfg.Mailbox); err != nil {
+			log.Fatalf("Invalid WHISPER_MAILBOX: %v", err)
+		}
+	}
+
+	// Look for newer releases only where the user opted in
+	updates := update.NewChecker(p2p.Version)
+	if err := updates.Configure(cfg.UpdateCheck, cfg.UpdateFeed, cfg.UpdateKey); err != nil {
+		log.Fatalf("Invalid WHISPER_UPDATE_* settings: %v", err)
+	}
 
 	// Create app
 	app := &App{
@@ -76,6 +359,22 @@ func main() {
 		friendManager:     friendManager,
 		messageManager:    messageManager,
 		conferenceManager: conferenceManager,
+		searchManager:     searchManager,
+		rendezvousManager: rendezvousManager,
+		directoryClient:   directoryClient,
+		pushClient:        pushClient,
+		mailboxClient:     mailboxClient,
+		updates:           updates,
+		reputation:        reputationTracker,
+		settings:          settingsService,
+		pushWoken:         make(map[string]time.Time),
+		pushChanged:       make(chan struct{}),
+		mailboxChanged:    make(chan struct{}),
+		mailboxNotified:   make(chan peer.ID, 1),
+		mailboxLookups:    make(map[string]*mailboxLookup),
+		compatWarned:      make(map[string]string),
+		identityOwner:     owner,
+		quit:              cancel,
 	}
 
 	// Start app services
@@ -83,242 +382,704 @@ func main() {
 		log.Fatalf("Failed to start app: %v", err)
 	}
 
-	fmt.Println("\n=== Whisper P2P Chat ===")
-	fmt.Printf("Peer ID: %s\n", p2pHost.PeerID())
-	fmt.Println("\nYour multiaddresses:")
-	for _, addr := range p2pHost.GetFullAddrs() {
-		fmt.Printf("  %s\n", addr)
-	}
-	fmt.Println("\n=== Getting Started ===")
-	fmt.Println("1. Register or login:")
-	fmt.Println("   register <username> <password> <full-name>")
-	fmt.Println("   login <username> <password>")
-	fmt.Println()
-	fmt.Println("2. Share your multiaddress (above) with a friend")
-	fmt.Println()
-	fmt.Println("3. Connect to your friend's multiaddress:")
-	fmt.Println("   connect <their-multiaddr>")
-	fmt.Println("   (This automatically sends a friend request!)")
-	fmt.Println()
-	fmt.Println("4. Accept their friend request:")
-	fmt.Println("   accept <their-username>")
-	fmt.Println()
-	fmt.Println("Type 'help' for all available commands")
-	fmt.Println()
+	// Apply edits to the config file without a restart
+	configWatcher := config.NewWatcher(cfg)
+	configWatcher.SetReloadHandler(app.onConfigReloaded)
+	go configWatcher.Run(ctx, configPollInterval)
+
+	if daemon != nil {
+		app.startDaemon(ctx, daemon)
+		<-ctx.Done()
+		i18n.Println("Shutting down...")
+		conferenceManager.UnsubscribeAll()
+		return nil
+	}
+
+	if login != nil {
+		// Back from a restart as another account; pick up where the switch left off
+		i18n.Printf("Peer ID: %s\n", p2pHost.PeerID())
+		app.loginAfterRestart(ctx, login)
+		go app.commandLoop(ctx)
+		<-ctx.Done()
+		conferenceManager.UnsubscribeAll()
+		return app.restartAs
+	}
+
+	i18n.Println("\n=== Whisper P2P Chat ===")
+	if cfg.Guest {
+		i18n.Println("👤 Guest mode: identity, accounts and messages are kept in memory and lost on exit")
+	}
+	i18n.Printf("Peer ID: %s\n", p2pHost.PeerID())
+	printConnectString(p2pHost)
+	i18n.Println("\n=== Getting Started ===")
+	i18n.Println("1. Register or login:")
+	i18n.Println("   register <username>")
+	i18n.Println("   login <username>")
+	i18n.Println()
+	i18n.Println("2. Share your connect line (above, or run 'addr') with a friend")
+	i18n.Println()
+	i18n.Println("3. Connect to your friend's multiaddress:")
+	i18n.Println("   connect <their-multiaddr>")
+	i18n.Println("   (This automatically sends a friend request!)")
+	i18n.Println()
+	i18n.Println("4. Accept their friend request:")
+	i18n.Println("   accept <their-username>")
+	i18n.Println()
+	i18n.Println("Type 'help' for all available commands")
+	i18n.Println()
+
+	// Let returning users pick one of the accounts on this node
+	app.showAccounts(ctx)
+	i18n.Println()
 
 	// Start command loop in a goroutine
 	go app.commandLoop(ctx)
 
-	// Wait for shutdown signal
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	// Wait for a shutdown signal or quit
+	<-ctx.Done()
 
-	fmt.Println("\nShutting down...")
-	cancel()
+	if app.restartAs == nil {
+		i18n.Println("\nShutting down...")
+	}
+	conferenceManager.UnsubscribeAll()
+	return app.restartAs
 }
 
 func (a *App) Start(ctx context.Context) error {
-	// Future: Initialize additional services
+	// Remember identified peers so they show up by name later
+	a.p2p.SetIdentifyHandler(func(info *p2p.PeerInfo) {
+		a.rememberPeer(ctx, info)
+		go a.sharePushEndpoint(ctx, info.ID)
+		go a.sendProfile(ctx, info.ID)
+		go a.friendManager.DeliverDeletionNotice(ctx, info.ID)
+		go a.checkPeerClock(ctx, info.ID)
+		go a.checkPeerCompatibility(ctx, info)
+		go a.noticePeerRelease(ctx, info)
+	})
+
+	// Keep the addresses dials worked on, to try them first next time
+	a.p2p.SetDialSuccessHandler(func(pid peer.ID, addr multiaddr.Multiaddr) {
+		if err := a.storage.RecordDialSuccess(ctx, pid.String(), addr.String(), time.Now()); err != nil {
+			i18n.Printf("Warning: Failed to save dial address: %v\n", err)
+		}
+	})
+
+	// Report friends whose connection died or came back, and redial dropped ones
+	a.p2p.SetPresenceHandler(func(event p2p.PresenceEvent) {
+		a.onPresenceChange(ctx, event)
+	})
+
+	// Report answers to friend requests we sent, friends' new names and
+	// statuses, and friends who deleted their accounts
+	a.friendManager.SetSentRequestHandler(a.onSentRequestAnswered)
+	a.friendManager.SetContactUpdatedHandler(a.onContactUpdated)
+	a.friendManager.SetContactDeletedHandler(a.onContactDeleted)
+
+	// Dial offline friends as the auto-dial policy allows
+	if err := a.setAutoDialMode(a.config.AutoDialMode); err != nil {
+		i18n.Printf("Warning: Invalid auto-dial mode, using %s: %v\n", autoDialNormal, err)
+		a.setAutoDialMode(autoDialNormal)
+	}
+	a.messageManager.SetDialHandler(a.dialBeforeSend)
+
+	// Apply settings changed at runtime right away
+	a.settings.SetChangeHandler(a.onSettingChanged)
+
+	// Keep friends' push endpoints, and wake friends messages can't reach
+	a.pushClient.SetEndpointHandler(func(message *push.EndpointMessage, from peer.ID) {
+		a.onPushEndpoint(ctx, message, from)
+	})
+	a.messageManager.SetUndeliveredHandler(a.wakeFriend)
+
+	// Leave messages friends can't be reached for in their mailboxes, and
+	// check ours when its server says new ones arrived
+	a.messageManager.SetDepositHandler(a.leaveInMailbox)
+	a.mailboxClient.SetNotifyHandler(a.onMailboxNotify)
+
+	// Withhold read receipts as the privacy settings say,
+	// and tell peers so they don't wait for them
+	a.messageManager.SetReceiptPolicy(a.receiptsAllowed)
+	a.messageManager.SetFailedHandler(a.onMessageFailed)
+	a.friendManager.SetRequestPolicy(a.friendRequestAllowed)
+	a.p2p.SetCapabilityHandler(a.privacyCapabilities)
+	a.conferenceManager.SetPresenceCheck(a.conferencePresenceShown)
+
+	// Keep message content off the screen while the app is locked
+	a.messageManager.SetLockCheck(a.auth.IsLocked)
+	a.conferenceManager.SetLockCheck(a.auth.IsLocked)
+
+	// Supervise the P2P stack and restart it if it gets stuck
+	a.p2p.SetHealthHandler(func(event p2p.HealthEvent) {
+		i18n.Printf("\n🩺 P2P health [%s]: %s\n> ", event.Kind, event.Detail)
+	})
+	go a.p2p.StartWatchdog(ctx, p2p.WatchdogConfig{
+		NoPeersTimeout:  time.Duration(a.config.WatchdogNoPeersMinutes) * time.Minute,
+		MaxDialFailures: a.config.WatchdogMaxDialFailures,
+	})
+
+	// Keep the node running through a handler panic, but say so
+	p2p.DefaultStreamGuard.SetPanicHandler(func(event p2p.HandlerPanic) {
+		i18n.Printf("\n🩺 Recovered from a panic in the %s handler: %s - 'debug panics'\n> ", event.Handler, event.Value)
+	})
+
+	// Tell the user about newer releases; nothing is installed
+	a.updates.SetHandler(a.onUpdateAvailable)
+	go a.updates.Run(ctx)
+
+	// Debugging endpoints for long-running nodes
+	if a.config.DiagnosticsAddr != "" {
+		server, err := diagnostics.NewServer(a.config.DiagnosticsAddr, a.p2p)
+		if err != nil {
+			return err
+		}
+		if err := server.Start(ctx); err != nil {
+			return err
+		}
+		i18n.Printf("🩺 Diagnostics at http://%s/debug/pprof/\n", a.config.DiagnosticsAddr)
+	}
+
+	// Lock the session after a period of inactivity
+	a.touchActivity()
+	if a.config.AutoLockMinutes > 0 {
+		go a.autoLock(ctx, time.Duration(a.config.AutoLockMinutes)*time.Minute)
+	}
+	return nil
+}
+
+// LockApp locks the session until UnlockApp is called with the password or PIN
+func (a *App) LockApp() error {
+	return a.auth.Lock()
+}
+
+// UnlockApp resumes a locked session
+func (a *App) UnlockApp(secret string) error {
+	if err := a.auth.Unlock(secret); err != nil {
+		return err
+	}
+	a.touchActivity()
 	return nil
 }
 
+// touchActivity records user activity, postponing the auto-lock
+func (a *App) touchActivity() {
+	a.activityMu.Lock()
+	defer a.activityMu.Unlock()
+	a.lastActivity = time.Now()
+}
+
+// autoLock locks a logged-in session once it has been idle for the given duration
+func (a *App) autoLock(ctx context.Context, idle time.Duration) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.activityMu.Lock()
+			idleFor := time.Since(a.lastActivity)
+			a.activityMu.Unlock()
+
+			if idleFor < idle || !a.auth.IsAuthenticated() || a.auth.IsLocked() {
+				continue
+			}
+			if err := a.LockApp(); err == nil {
+				i18n.Printf("\n🔒 Locked after %s of inactivity - type 'unlock' to continue\n> ", idle)
+			}
+		}
+	}
+}
+
+// resolveUsername maps a typed username to the stored one, ignoring case.
+// Prints the reason and returns false if it is unknown or ambiguous.
+func (a *App) resolveUsername(ctx context.Context, name string) (string, bool) {
+	user, err := a.auth.ResolveUsername(ctx, name)
+	if err != nil {
+		if errors.Is(err, auth.ErrAmbiguousUser) {
+			i18n.Printf("%v - please type the exact username\n", err)
+		} else {
+			i18n.Printf("User not found: %v\n", err)
+		}
+		return "", false
+	}
+	return user.Username, true
+}
+
+// parseRequestID reads a friend request reference of the form #<id>
+func parseRequestID(arg string) (int64, bool) {
+	if !strings.HasPrefix(arg, "#") {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(arg[1:], 10, 64)
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// rememberPeer records an identified peer in known_peers
+func (a *App) rememberPeer(ctx context.Context, info *p2p.PeerInfo) {
+	addrs := make([]string, 0, len(info.Addrs))
+	for _, addr := range info.Addrs {
+		addrs = append(addrs, addr.String())
+	}
+	addrsJSON, _ := json.Marshal(addrs)
+
+	known := &storage.KnownPeer{
+		PeerID:   info.ID.String(),
+		Username: info.Username,
+		Addrs:    string(addrsJSON),
+		Version:  info.Version,
+		Platform: info.Platform,
+		LastSeen: time.Now(),
+	}
+	if err := a.storage.SaveKnownPeer(ctx, known); err != nil {
+		i18n.Printf("Warning: Failed to save known peer: %v\n", err)
+	}
+}
+
+// startSession activates a logged-in account: it points every manager at the
+// user, announces them to peers and the DHT, and restores the previous session
+func (a *App) startSession(ctx context.Context, user *storage.User) {
+	// Update user's peer ID to current one (in case it changed after restart)
+	currentPeerID := a.p2p.PeerID().String()
+	if user.PeerID != currentPeerID {
+		user.PeerID = currentPeerID
+		if err := a.storage.UpdateUser(ctx, user); err != nil {
+			i18n.Printf("Warning: Failed to update peer ID: %v\n", err)
+		}
+	}
+
+	// Background work for this account stops when the session ends
+	sessionCtx, cancel := context.WithCancel(ctx)
+	a.sessionCtx = sessionCtx
+	a.sessionCancel = cancel
+
+	// Set current user for friend manager, message manager, and conference manager
+	a.friendManager.SetCurrentUser(user.ID)
+	a.messageManager.SetCurrentUser(user.ID)
+	a.conferenceManager.SetCurrentUser(user.ID)
+	// Last-seen records on the DHT are public, so only publish them for
+	// users who show their online status to everyone
+	a.p2p.SetPresencePublished(a.onlineVisibility(ctx, user.ID) == visibleEveryone)
+	// Tell connected peers who we are
+	if a.config.ShareIdentity {
+		a.p2p.SetLocalProfile(user.Username, user.FullName)
+	} else {
+		// Still re-announce, since privacy settings are per account
+		a.p2p.RefreshProfile()
+	}
+	// Publish user to DHT, relays and directories
+	a.publishNames(sessionCtx, user)
+	// Pick up where the previous session left off
+	go a.bootstrapSession(sessionCtx, user)
+	// Keep friends' last-seen times fresh for the friend list
+	go a.trackFriendPresence(sessionCtx, user)
+	// Catch friend connections that died without closing
+	go a.keepFriendsAlive(sessionCtx, user)
+	// Give up on queued messages that missed their delivery deadline
+	go a.expireQueuedMessages(sessionCtx, user)
+	// Let friends wake this device when they can't reach it
+	go a.keepPushRegistered(sessionCtx)
+	// Take the messages friends left while we were offline, and keep taking them
+	go a.keepMailbox(sessionCtx)
+	// Replace conference history older than WHISPER_CONF_COMPACT_DAYS with summaries
+	go a.compactConferences(sessionCtx, user)
+}
+
+// stopSession detaches the current account from the managers and the network
+// without logging it out, so another account can take over the same host
+func (a *App) stopSession() {
+	if a.sessionCancel != nil {
+		a.sessionCancel()
+		a.sessionCancel = nil
+	}
+	a.friendManager.SetCurrentUser(0)
+	a.messageManager.SetCurrentUser(0)
+	a.conferenceManager.SetCurrentUser(0)
+	a.conferenceManager.UnsubscribeAll()
+	a.p2p.SetLocalProfile("", "")
+	a.setPushEndpoint(nil)
+}
+
+// loginAfterRestart logs in to the account the node was restarted as
+func (a *App) loginAfterRestart(ctx context.Context, login *accountLogin) {
+	user, err := a.auth.Login(ctx, login.username, login.password)
+	if err != nil {
+		i18n.Printf("Login failed: %v\n", err)
+		a.showAccounts(ctx)
+		return
+	}
+	i18n.Printf("✓ Welcome back, %s!\n", user.FullName)
+	a.startSession(ctx, user)
+	a.showAway(ctx, user)
+}
+
+// showAccounts lists the accounts registered on this node
+func (a *App) showAccounts(ctx context.Context) {
+	accounts, err := a.auth.LocalAccounts(ctx)
+	if err != nil {
+		i18n.Printf("Failed to list accounts: %v\n", err)
+		return
+	}
+	if len(accounts) == 0 {
+		i18n.Println("No accounts on this node yet - use 'register' to create one")
+		return
+	}
+
+	current, _ := a.auth.CurrentUser()
+	i18n.Printf("Accounts on this node (%d):\n", len(accounts))
+	for i, account := range accounts {
+		marker := " "
+		if current != nil && current.ID == account.ID {
+			marker = "*"
+		}
+		i18n.Printf(" %s%d. %s (%s)\n", marker, i+1, account.Username, account.FullName)
+	}
+	i18n.Println("Use 'login <username>' (or 'switch' while logged in) to pick one")
+}
+
+// bootstrapSession restores a logged-in user's session after a restart: it
+// resubscribes to active conferences, reconnects to friends using known_peers,
+// and then retries delivery of messages that were never acknowledged
+func (a *App) bootstrapSession(ctx context.Context, user *storage.User) {
+	count, err := a.conferenceManager.ResubscribeConferences(ctx, user)
+	if err != nil {
+		i18n.Printf("Warning: Failed to resubscribe to conferences: %v\n", err)
+	} else if count > 0 {
+		i18n.Printf("\n✓ Resubscribed to %d conference(s)\n> ", count)
+	}
+
+	if reconnected := a.reconnectFriends(ctx, user); reconnected > 0 {
+		i18n.Printf("\n✓ Reconnected to %d friend(s)\n> ", reconnected)
+	}
+
+	if err := a.messageManager.RetryUndeliveredMessages(ctx, user.ID); err != nil {
+		i18n.Printf("Warning: Failed to retry undelivered messages: %v\n", err)
+	}
+}
+
+// reconnectFriends dials every offline friend the auto-dial policy allows in
+// parallel and returns how many are connected afterwards
+func (a *App) reconnectFriends(ctx context.Context, user *storage.User) int {
+	friendList, err := a.friendManager.GetFriends(ctx, user.ID)
+	if err != nil {
+		i18n.Printf("Warning: Failed to load friends: %v\n", err)
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reconnected := 0
+	for _, friend := range friendList {
+		peerID, err := peer.Decode(friend.PeerID)
+		if err != nil || a.p2p.IsConnected(peerID) || !a.autoDialAllowed(friend, dialOnLogin) {
+			continue
+		}
+		wg.Add(1)
+		go func(friend *storage.Friend) {
+			defer wg.Done()
+			if err := a.dialFriend(ctx, friend); err != nil {
+				return // Offline friends are retried by normal delivery later
+			}
+			mu.Lock()
+			reconnected++
+			mu.Unlock()
+		}(friend)
+	}
+	wg.Wait()
+	return reconnected
+}
+
 func (a *App) commandLoop(ctx context.Context) {
-	scanner := bufio.NewScanner(os.Stdin)
-	fmt.Print("> ")
+	scanner := stdin
+	a.input = scanner
+	i18n.Print("> ")
 
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+		line := a.conversationLine(strings.TrimSpace(scanner.Text()))
 		if line == "" {
-			fmt.Print("> ")
+			i18n.Print("> ")
 			continue
 		}
 
 		parts := strings.Fields(line)
 		cmd := parts[0]
 
+		// Only unlocking and quitting are allowed while locked
+		if a.auth.IsLocked() && cmd != "unlock" && cmd != "quit" && cmd != "exit" {
+			i18n.Println("🔒 App is locked - type 'unlock' to continue")
+			i18n.Print("> ")
+			continue
+		}
+		a.touchActivity()
+
+		// goto opens a conversation, then shows its latest messages
+		if cmd == "goto" {
+			if line = a.handleGotoCommand(ctx, parts); line == "" {
+				i18n.Print("> ")
+				continue
+			}
+			parts = strings.Fields(line)
+			cmd = parts[0]
+		}
+
 		switch cmd {
 		case "register":
-			if len(parts) < 4 {
-				fmt.Println("Usage: register <username> <password> <full-name>")
-				fmt.Println("Example: register alice mypassword123 \"Alice Smith\"")
+			if len(parts) >= 2 {
+				if err := checkAccountDir(a.config, parts[1]); err != nil {
+					i18n.Printf("Registration failed: %v\n", err)
+					break
+				}
+			}
+			username, password, fullName, ok := a.registerArgs(parts)
+			if !ok {
 				break
 			}
-			username := parts[1]
-			password := parts[2]
-			fullName := strings.Join(parts[3:], " ")
-			fullName = strings.Trim(fullName, "\"")
 
-			peerID := a.p2p.PeerID().String()
-			err := a.auth.Register(ctx, username, password, fullName, peerID)
+			_, err := provisionAccount(ctx, a.config, a.storage, username, password, fullName)
 			if err != nil {
-				fmt.Printf("Registration failed: %v\n", err)
+				i18n.Printf("Registration failed: %v\n", err)
 			} else {
-				fmt.Printf("✓ Registration successful! You can now login with: login %s <password>\n", username)
+				i18n.Printf("✓ Registration successful! You can now login with: login %s\n", username)
 			}
 
-		case "login":
-			if len(parts) < 3 {
-				fmt.Println("Usage: login <username> <password>")
+		case "login", "switch":
+			// switch is login while another account is active; the P2P host
+			// keeps running unless the account has another identity
+			if len(parts) < 2 {
+				i18n.Printf("Usage: %s <username> [--password-file <file>]\n", cmd)
 				break
 			}
 			username := parts[1]
-			password := parts[2]
+			password, err := a.passwordArg(parts[2:], i18n.T("Password: "))
+			if errors.Is(err, errPasswordArgs) {
+				i18n.Printf("Usage: %s <username> [--password-file <file>]\n", cmd)
+				break
+			}
+			if err != nil {
+				i18n.Printf("Login failed: %v\n", err)
+				break
+			}
 
+			previous, _ := a.auth.CurrentUser()
 			user, err := a.auth.Login(ctx, username, password)
 			if err != nil {
-				fmt.Printf("Login failed: %v\n", err)
-			} else {
-				// Update user's peer ID to current one (in case it changed after restart)
-				currentPeerID := a.p2p.PeerID().String()
-				if user.PeerID != currentPeerID {
-					user.PeerID = currentPeerID
-					if err := a.storage.UpdateUser(ctx, user); err != nil {
-						fmt.Printf("Warning: Failed to update peer ID: %v\n", err)
-					}
-				}
-
-				fmt.Printf("✓ Welcome back, %s!\n", user.FullName)
-				// Set current user for friend manager, message manager, and conference manager
-				a.friendManager.SetCurrentUser(user.ID)
-				a.messageManager.SetCurrentUser(user.ID)
-				a.conferenceManager.SetCurrentUser(user.ID)
-				// Publish user to DHT
-				go func() {
-					if err := a.p2p.PublishUser(ctx, username); err != nil {
-						fmt.Printf("Warning: Failed to publish to DHT: %v\n", err)
-					}
-					// Keep refreshing presence
-					a.p2p.RefreshUserPresence(ctx, username)
-				}()
-				// Try to deliver any undelivered messages
-				go func() {
-					if err := a.messageManager.RetryUndeliveredMessages(ctx, user.ID); err != nil {
-						fmt.Printf("Warning: Failed to retry undelivered messages: %v\n", err)
-					}
-				}()
+				i18n.Printf("Login failed: %v\n", err)
+				break
+			}
+			owner, err := identityOwner(ctx, a.storage, user)
+			if err != nil {
+				a.auth.Logout()
+				i18n.Printf("Login failed: %v\n", err)
+				break
+			}
+			if previous != nil {
+				a.stopSession()
+				i18n.Printf("✓ Switched from %s\n", previous.Username)
+			}
+			if owner != a.identityOwner {
+				// Only the node as a whole changes identity
+				i18n.Printf("Restarting the node as %s...\n", user.Username)
+				a.restartAs = &accountLogin{username: username, password: password}
+				a.quit()
+				return
 			}
+			i18n.Printf("✓ Welcome back, %s!\n", user.FullName)
+			a.startSession(ctx, user)
+			a.showAway(ctx, user)
+
+		case "accounts":
+			a.showAccounts(ctx)
 
 		case "logout":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You are not logged in")
+				i18n.Println("You are not logged in")
 				break
 			}
 			user, _ := a.auth.CurrentUser()
+			a.stopSession()
 			a.auth.Logout()
-			a.friendManager.SetCurrentUser(0)
-			a.messageManager.SetCurrentUser(0)
-			a.conferenceManager.SetCurrentUser(0)
-			fmt.Printf("✓ Logged out %s\n", user.Username)
+			i18n.Printf("✓ Logged out %s\n", user.Username)
+
+		case "lock":
+			if err := a.LockApp(); err != nil {
+				i18n.Printf("Failed to lock: %v\n", err)
+				break
+			}
+			i18n.Println("🔒 Locked - type 'unlock' to continue")
+
+		case "unlock":
+			secret, err := a.passwordArg(parts[1:], i18n.T("Password or PIN: "))
+			if errors.Is(err, errPasswordArgs) {
+				i18n.Println("Usage: unlock [--password-file <file>]")
+				break
+			}
+			if err != nil {
+				i18n.Printf("Unlock failed: %v\n", err)
+				break
+			}
+			if err := a.UnlockApp(secret); err != nil {
+				i18n.Printf("Unlock failed: %v\n", err)
+				break
+			}
+			i18n.Println("🔓 Unlocked")
+
+		case "lock-pin":
+			pin, ok := a.lockPINArgs(parts)
+			if !ok {
+				break
+			}
+			if err := a.auth.SetLockPIN(pin); err != nil {
+				i18n.Printf("Failed to set PIN: %v\n", err)
+				break
+			}
+			if pin == "" {
+				i18n.Println("✓ Lock PIN removed")
+			} else {
+				i18n.Println("✓ Lock PIN set for this session")
+			}
 
-		case "whoami":
+		case "whoami", "me":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("Not authenticated. Please login first.")
+				i18n.Println("Not authenticated. Please login first.")
 				break
 			}
 			user, _ := a.auth.CurrentUser()
-			fmt.Printf("Username: %s\n", user.Username)
-			fmt.Printf("Full Name: %s\n", user.FullName)
-			fmt.Printf("Peer ID: %s\n", user.PeerID)
-			fmt.Printf("Account Created: %s\n", user.CreatedAt.Format("2006-01-02 15:04:05"))
+			if len(parts) > 1 && parts[1] == "--card" {
+				a.printIdentityCard(user)
+				break
+			}
+			i18n.Printf("Username: %s\n", user.Username)
+			i18n.Printf("Full Name: %s\n", user.FullName)
+			if user.StatusMessage != "" {
+				i18n.Printf("Status: %s\n", user.StatusMessage)
+			}
+			i18n.Printf("Peer ID: %s\n", user.PeerID)
+			i18n.Printf("Account Created: %s\n", user.CreatedAt.Format("2006-01-02 15:04:05"))
 
 		case "passwd":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to change password")
+				i18n.Println("You must be logged in to change password")
 				break
 			}
-			if len(parts) < 3 {
-				fmt.Println("Usage: passwd <old-password> <new-password>")
+			oldPassword, newPassword, ok := a.passwdArgs(parts)
+			if !ok {
 				break
 			}
-			oldPassword := parts[1]
-			newPassword := parts[2]
 
 			err := a.auth.ChangePassword(ctx, oldPassword, newPassword)
 			if err != nil {
-				fmt.Printf("Failed to change password: %v\n", err)
+				i18n.Printf("Failed to change password: %v\n", err)
 			} else {
-				fmt.Println("✓ Password changed successfully")
+				i18n.Println("✓ Password changed successfully")
 			}
 
 		case "search":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to search for users")
+				i18n.Println("You must be logged in to search for users")
 				break
 			}
 			if len(parts) < 2 {
-				fmt.Println("Usage: search <name>")
+				i18n.Println("Usage: search <name>")
 				break
 			}
 			searchName := strings.Join(parts[1:], " ")
 			searchName = strings.Trim(searchName, "\"")
 
-			users, err := a.auth.SearchUsers(ctx, searchName)
+			i18n.Println("Searching local database and network...")
+			results, err := a.searchManager.SearchUsers(ctx, searchName)
 			if err != nil {
-				fmt.Printf("Search failed: %v\n", err)
+				i18n.Printf("Search failed: %v\n", err)
 				break
 			}
 
-			if len(users) == 0 {
-				fmt.Println("No users found")
+			if len(results) == 0 {
+				i18n.Println("No users found")
 			} else {
-				fmt.Printf("Found %d user(s):\n", len(users))
-				for i, user := range users {
-					fmt.Printf("  %d. %s (%s) - Peer ID: %s\n", i+1, user.FullName, user.Username, user.PeerID)
+				i18n.Printf("Found %d user(s):\n", len(results))
+				for i, result := range results {
+					status := i18n.T("offline")
+					if result.Online {
+						status = i18n.T("online")
+					} else if !result.LastSeen.IsZero() {
+						status = i18n.Sprintf("offline, %s", formatLastSeen(result.LastSeen))
+					}
+					i18n.Printf("  %d. %s (%s) [%s, %s] - Peer ID: %s\n", i+1, result.FullName, result.Username, status, result.Source, result.PeerID)
 				}
 			}
 
 		case "add":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to add friends")
+				i18n.Println("You must be logged in to add friends")
 				break
 			}
 			if len(parts) < 2 {
-				fmt.Println("Usage: add <username>")
-				fmt.Println("Alternative: add-peer <peer-id> to add a connected peer")
+				i18n.Println("Usage: add <username|username@relay>")
+				i18n.Println("Alternative: add-peer <peer-id> to add a connected peer")
 				break
 			}
 			targetUsername := parts[1]
 
 			currentUser, _ := a.auth.CurrentUser()
 
-			// First, look up the user in DHT
-			fmt.Printf("Looking up %s in DHT...\n", targetUsername)
-			targetPeerID, err := a.p2p.FindUserByUsername(ctx, targetUsername)
-			if err != nil {
-				// Try local database as fallback
-				targetUser, dbErr := a.storage.GetUserByUsername(ctx, targetUsername)
-				if dbErr != nil || targetUser == nil {
-					fmt.Printf("User not found: %v\n", err)
-					fmt.Println("Tip: User must be online and registered, or use 'add-peer <peer-id>' for connected peers")
+			// username@relay: resolve through the relay and dial through it if needed
+			if _, _, ok := rendezvous.ParseAddress(targetUsername); ok {
+				i18n.Printf("Resolving %s...\n", targetUsername)
+				info, err := a.rendezvousManager.Resolve(ctx, targetUsername)
+				if err != nil {
+					i18n.Printf("Failed to resolve %s: %v\n", targetUsername, err)
 					break
 				}
-				targetPeerID, _ = peer.Decode(targetUser.PeerID)
+
+				// A relayed connection is limited; a friend request fits within it
+				relayCtx := network.WithAllowLimitedConn(ctx, "friend request")
+				if err := a.p2p.Host().Connect(relayCtx, info); err != nil {
+					i18n.Printf("Warning: Could not connect: %v\n", err)
+					i18n.Println("Attempting to send request anyway...")
+				}
+				if err := a.friendManager.SendFriendRequest(relayCtx, currentUser, info.ID); err != nil {
+					i18n.Printf("Failed to send friend request: %v\n", err)
+				}
+				break
+			}
+
+			// Look the user up in the directories, then the DHT, then the local database
+			targetPeerID, err := a.lookupUsername(ctx, targetUsername)
+			if errors.Is(err, auth.ErrAmbiguousUser) {
+				i18n.Printf("%v\n", err)
+				break
+			}
+			if err != nil {
+				i18n.Printf("User not found: %v\n", err)
+				i18n.Println("Tip: User must be online and registered, or use 'add-peer <peer-id>' for connected peers")
+				break
 			}
 
 			// Connect to the peer if not already connected
-			fmt.Printf("Connecting to %s...\n", targetUsername)
+			i18n.Printf("Connecting to %s...\n", targetUsername)
 			err = a.p2p.ConnectToPeer(ctx, fmt.Sprintf("/p2p/%s", targetPeerID.String()))
 			if err != nil {
-				fmt.Printf("Warning: Could not connect directly: %v\n", err)
-				fmt.Println("Attempting to send request anyway...")
+				i18n.Printf("Warning: Could not connect directly: %v\n", err)
+				i18n.Println("Attempting to send request anyway...")
 			}
 
 			// Send friend request
 			err = a.friendManager.SendFriendRequest(ctx, currentUser, targetPeerID)
 			if err != nil {
-				fmt.Printf("Failed to send friend request: %v\n", err)
+				i18n.Printf("Failed to send friend request: %v\n", err)
 			}
 
 		case "add-peer":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to add friends")
+				i18n.Println("You must be logged in to add friends")
 				break
 			}
 			if len(parts) < 2 {
-				fmt.Println("Usage: add-peer <peer-id>")
-				fmt.Println("Example: add-peer 12D3KooW...")
-				fmt.Println("Use 'peers' to see connected peer IDs")
+				i18n.Println("Usage: add-peer <peer-id>")
+				i18n.Println("Example: add-peer 12D3KooW...")
+				i18n.Println("Use 'peers' to see connected peer IDs")
 				break
 			}
 			peerIDStr := parts[1]
@@ -328,134 +1089,281 @@ func (a *App) commandLoop(ctx context.Context) {
 			// Decode peer ID
 			targetPeerID, err := peer.Decode(peerIDStr)
 			if err != nil {
-				fmt.Printf("Invalid peer ID: %v\n", err)
+				i18n.Printf("Invalid peer ID: %v\n", err)
 				break
 			}
 
 			// Send friend request
 			err = a.friendManager.SendFriendRequest(ctx, currentUser, targetPeerID)
 			if err != nil {
-				fmt.Printf("Failed to send friend request: %v\n", err)
+				i18n.Printf("Failed to send friend request: %v\n", err)
 			}
 
 		case "accept":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to accept friend requests")
+				i18n.Println("You must be logged in to accept friend requests")
 				break
 			}
 			if len(parts) < 2 {
-				fmt.Println("Usage: accept <username>")
+				i18n.Println("Usage: accept <username> | accept #<request-id> | accept --all")
 				break
 			}
-			fromUsername := parts[1]
 			currentUser, _ := a.auth.CurrentUser()
+			if parts[1] == "--all" {
+				a.acceptAllRequests(ctx, currentUser)
+				break
+			}
 
-			err := a.friendManager.AcceptFriendRequest(ctx, currentUser, fromUsername)
+			var err error
+			if requestID, ok := parseRequestID(parts[1]); ok {
+				err = a.friendManager.AcceptFriendRequestByID(ctx, currentUser, requestID)
+			} else {
+				fromUsername, ok := a.resolveUsername(ctx, parts[1])
+				if !ok {
+					break
+				}
+				err = a.friendManager.AcceptFriendRequest(ctx, currentUser, fromUsername)
+			}
 			if err != nil {
-				fmt.Printf("Failed to accept friend request: %v\n", err)
+				i18n.Printf("Failed to accept friend request: %v\n", err)
 			}
 
 		case "reject":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to reject friend requests")
+				i18n.Println("You must be logged in to reject friend requests")
 				break
 			}
 			if len(parts) < 2 {
-				fmt.Println("Usage: reject <username>")
+				i18n.Println("Usage: reject <username> | reject #<request-id> | reject --all")
 				break
 			}
-			fromUsername := parts[1]
 			currentUser, _ := a.auth.CurrentUser()
+			if parts[1] == "--all" {
+				a.rejectAllRequests(ctx, currentUser)
+				break
+			}
 
-			err := a.friendManager.RejectFriendRequest(ctx, currentUser, fromUsername)
+			var err error
+			if requestID, ok := parseRequestID(parts[1]); ok {
+				err = a.friendManager.RejectFriendRequestByID(ctx, currentUser, requestID)
+			} else {
+				err = a.friendManager.RejectFriendRequest(ctx, currentUser, parts[1])
+			}
 			if err != nil {
-				fmt.Printf("Failed to reject friend request: %v\n", err)
+				i18n.Printf("Failed to reject friend request: %v\n", err)
 			}
 
+		case "trust":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to trust a friend's identity")
+				break
+			}
+			if len(parts) < 2 {
+				i18n.Println("Usage: trust <username>")
+				i18n.Println("Use after verifying a friend's new peer ID out-of-band")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+
+			err := a.friendManager.TrustFriend(ctx, currentUser, parts[1])
+			if err != nil {
+				i18n.Printf("Failed to trust identity: %v\n", err)
+				break
+			}
+			if friend, err := a.storage.GetUserByUsername(ctx, parts[1]); err == nil {
+				if released := a.messageManager.ReleaseQuarantined(ctx, friend); released > 0 {
+					i18n.Printf("✓ Added %d held message(s) from %s to your conversation\n", released, friend.Username)
+				}
+			}
+
+		case "rename":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to rename contacts")
+				break
+			}
+			if len(parts) < 3 {
+				i18n.Println("Usage: rename <username> <new-name>")
+				i18n.Println("Changes how a contact is shown here; they keep their own username")
+				break
+			}
+			username, ok := a.resolveUsername(ctx, parts[1])
+			if !ok {
+				break
+			}
+			if err := a.friendManager.RenameContact(ctx, username, parts[2]); err != nil {
+				i18n.Printf("Failed to rename contact: %v\n", err)
+				break
+			}
+			i18n.Printf("✓ %s is now shown as %s\n", username, parts[2])
+
+		case "name-conflicts":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to view name conflicts")
+				break
+			}
+			users, err := a.friendManager.GetNameCollisions(ctx)
+			if err != nil {
+				i18n.Printf("Failed to get name conflicts: %v\n", err)
+				break
+			}
+			if len(users) == 0 {
+				i18n.Println("No users share a username")
+				break
+			}
+			i18n.Println("Users registered under the same username:")
+			group := ""
+			for _, user := range users {
+				if user.RemoteName() != group {
+					group = user.RemoteName()
+					i18n.Printf("  %s:\n", group)
+				}
+				where := "this device"
+				if user.IsRemote() {
+					where = user.PeerID
+				}
+				i18n.Printf("    %-20s %s (%s)\n", user.Username, user.FullName, where)
+			}
+			i18n.Println("Use 'rename <username> <new-name>' to tell them apart")
+
 		case "friends":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to view friends")
+				i18n.Println("You must be logged in to view friends")
 				break
 			}
 			currentUser, _ := a.auth.CurrentUser()
 
-			friends, err := a.friendManager.GetFriends(ctx, currentUser.ID)
+			filter := storage.FriendFilter{}
+			verbose := false
+			for _, peer := range a.p2p.GetConnectedPeers() {
+				// Friends who hide their online status never show as online
+				if !a.p2p.PresenceHidden(peer.ID) {
+					filter.OnlinePeerIDs = append(filter.OnlinePeerIDs, peer.ID.String())
+				}
+			}
+			for _, opt := range parts[1:] {
+				switch opt {
+				case "--online":
+					filter.OnlineOnly = true
+				case "--unread":
+					filter.UnreadOnly = true
+				case "--recent":
+					filter.SortBy = storage.FriendSortLastMessage
+				case "--status":
+					filter.SortBy = storage.FriendSortOnline
+				case "--verbose", "-v":
+					verbose = true
+				}
+			}
+
+			friends, err := a.friendManager.GetFriendsFiltered(ctx, currentUser.ID, filter)
 			if err != nil {
-				fmt.Printf("Failed to get friends: %v\n", err)
+				i18n.Printf("Failed to get friends: %v\n", err)
 				break
 			}
 
 			if len(friends) == 0 {
-				fmt.Println("You don't have any friends yet")
-				fmt.Println("Use 'add <username>' to send friend requests")
+				if filter.OnlineOnly || filter.UnreadOnly {
+					i18n.Println("No friends match")
+					break
+				}
+				i18n.Println("You don't have any friends yet")
+				i18n.Println("Use 'add <username>' to send friend requests")
 			} else {
-				fmt.Printf("Your friends (%d):\n", len(friends))
+				i18n.Printf("Your friends (%d):\n", len(friends))
 				for i, friend := range friends {
-					// Check if friend is online
-					status := "offline"
-					connectedPeers := a.p2p.GetConnectedPeers()
-					for _, peer := range connectedPeers {
-						if peer.ID.String() == friend.PeerID {
-							status = "online"
-							break
-						}
-					}
 					statusIcon := "○"
-					if status == "online" {
+					if friend.Online {
 						statusIcon = "●"
 					}
-					fmt.Printf("  %d. %s %s (%s)\n", i+1, statusIcon, friend.FullName, friend.Username)
+					unread := ""
+					if friend.UnreadCount > 0 {
+						unread = i18n.Sprintf(" [%d unread]", friend.UnreadCount)
+					}
+					lastSeen := ""
+					if pid, err := peer.Decode(friend.PeerID); err == nil && a.p2p.PresenceHidden(pid) {
+						statusIcon = "◌"
+					} else if friend.Online && a.p2p.PeerAway(pid) {
+						statusIcon = "◐"
+						lastSeen = i18n.Sprintf(" - away")
+					} else if !friend.Online && !friend.LastSeen.IsZero() {
+						lastSeen = " - " + formatLastSeen(friend.LastSeen)
+					}
+					i18n.Printf("  %d. %s %s (%s)%s%s\n", i+1, statusIcon, friend.FullName, friend.Username, unread, lastSeen)
+					if friend.StatusMessage != "" {
+						i18n.Printf("       💬 %s\n", friend.StatusMessage)
+					}
+					if verbose {
+						i18n.Printf("       Whisper %s\n", peerVersion(friend.Version, friend.Platform))
+						if pid, err := peer.Decode(friend.PeerID); err == nil && len(a.p2p.MissingProtocols(pid)) > 0 {
+							i18n.Printf("       ⚠️  Incompatible - see 'debug peer %s'\n", friend.Username)
+						}
+					}
 				}
 			}
 
 		case "requests":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to view friend requests")
+				i18n.Println("You must be logged in to view friend requests")
 				break
 			}
 			currentUser, _ := a.auth.CurrentUser()
 
 			requests, err := a.friendManager.GetPendingRequests(ctx, currentUser.ID)
 			if err != nil {
-				fmt.Printf("Failed to get friend requests: %v\n", err)
+				i18n.Printf("Failed to get friend requests: %v\n", err)
 				break
 			}
 
 			if len(requests) == 0 {
-				fmt.Println("No pending friend requests")
+				i18n.Println("No pending friend requests")
 			} else {
-				fmt.Printf("Pending friend requests (%d):\n", len(requests))
-				for i, req := range requests {
-					fmt.Printf("  %d. %s (%s)\n", i+1, req.FullName, req.Username)
+				i18n.Printf("Pending friend requests (%d):\n", len(requests))
+				for _, req := range requests {
+					i18n.Printf("  #%d  %s (%s)  %s\n", req.ID, req.FullName, req.Username, req.CreatedAt.Local().Format("Jan 2 15:04"))
 				}
-				fmt.Println("\nUse 'accept <username>' or 'reject <username>'")
+				i18n.Println("\nUse 'accept #<id>' or 'reject #<id>' (or the username)")
 			}
 
+		case "roster":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to recover friend lists")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.handleRosterCommand(ctx, currentUser, parts)
+
+		case "sent-requests":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to view sent friend requests")
+				break
+			}
+			a.printSentRequests(ctx)
+
 		case "connect":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to connect to peers")
+				i18n.Println("You must be logged in to connect to peers")
 				break
 			}
 			if len(parts) < 2 {
-				fmt.Println("Usage: connect <multiaddr>")
-				fmt.Println("Example: connect /ip4/127.0.0.1/tcp/9999/p2p/12D3KooW...")
-				fmt.Println()
-				fmt.Println("This will connect to the peer AND automatically send a friend request")
+				i18n.Println("Usage: connect <multiaddr>")
+				i18n.Println("Example: connect /ip4/127.0.0.1/tcp/9999/p2p/12D3KooW...")
+				i18n.Println()
+				i18n.Println("This will connect to the peer AND automatically send a friend request")
 				break
 			}
 			addr := parts[1]
 
 			// Connect to the peer
 			if err := a.p2p.ConnectToPeer(ctx, addr); err != nil {
-				fmt.Printf("Failed to connect: %v\n", err)
+				i18n.Printf("Failed to connect: %v\n", err)
 				break
 			}
-			fmt.Println("✓ Successfully connected!")
+			i18n.Println("✓ Successfully connected!")
 
 			// Extract peer ID from multiaddr and auto-send friend request
 			maddr, err := multiaddr.NewMultiaddr(addr)
 			if err != nil {
-				fmt.Printf("Note: Could not parse multiaddr to send friend request: %v\n", err)
+				i18n.Printf("Note: Could not parse multiaddr to send friend request: %v\n", err)
 				break
 			}
 
@@ -470,64 +1378,236 @@ func (a *App) commandLoop(ctx context.Context) {
 			})
 
 			if targetPeerID == "" {
-				fmt.Println("Note: No peer ID found in multiaddr, skipping auto friend request")
+				i18n.Println("Note: No peer ID found in multiaddr, skipping auto friend request")
 				break
 			}
 
 			// Auto-send friend request
 			currentUser, err := a.auth.CurrentUser()
 			if err != nil {
-				fmt.Println("Note: Please login first to send friend request")
+				i18n.Println("Note: Please login first to send friend request")
 				break
 			}
-			fmt.Printf("Automatically sending friend request to %s...\n", targetPeerID.String()[:16]+"...")
+			i18n.Printf("Automatically sending friend request to %s...\n", targetPeerID.String()[:16]+"...")
 			err = a.friendManager.SendFriendRequest(ctx, currentUser, targetPeerID)
 			if err != nil {
-				fmt.Printf("Note: Friend request not sent: %v\n", err)
-				fmt.Println("(You may already be friends or have a pending request)")
+				i18n.Printf("Note: Friend request not sent: %v\n", err)
+				i18n.Println("(You may already be friends or have a pending request)")
 			}
 
 		case "peers":
 			peers := a.p2p.GetConnectedPeers()
 			if len(peers) == 0 {
-				fmt.Println("No connected peers")
+				i18n.Println("No connected peers")
 			} else {
-				fmt.Printf("Connected peers (%d):\n", len(peers))
+				i18n.Printf("Connected peers (%d):\n", len(peers))
 				for i, peer := range peers {
-					fmt.Printf("  %d. %s\n", i+1, peer.ID.String())
 					if peer.Username != "" {
-						fmt.Printf("     Username: %s\n", peer.Username)
+						i18n.Printf("  %d. %s (%s)\n", i+1, peer.Username, peer.FullName)
+						i18n.Printf("     Peer ID: %s\n", peer.ID.String())
+					} else {
+						i18n.Printf("  %d. %s\n", i+1, peer.ID.String())
 					}
 				}
 			}
 
 		case "msg":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to send messages")
+				i18n.Println("You must be logged in to send messages")
+				break
+			}
+			args, ttl := parts[1:], time.Duration(0)
+			if len(args) > 1 && args[0] == "--ttl" {
+				var err error
+				if ttl, err = parseTTL(args[1]); err != nil {
+					i18n.Printf("Invalid --ttl: %v\n", err)
+					break
+				}
+				args = args[2:]
+			}
+			if len(args) < 2 {
+				i18n.Println("Usage: msg [--ttl <duration>] <username> <message>")
+				i18n.Println("Example: msg alice Hello, how are you?")
+				i18n.Println("Example: msg --ttl 2h alice Running late, start without me")
+				break
+			}
+			toUsername, ok := a.resolveUsername(ctx, args[0])
+			if !ok {
+				break
+			}
+			message := strings.Join(args[1:], " ")
+
+			currentUser, _ := a.auth.CurrentUser()
+			var err error
+			if ttl > 0 {
+				err = a.messageManager.SendMessageWithTTL(ctx, currentUser, toUsername, message, ttl)
+			} else {
+				err = a.messageManager.SendMessage(ctx, currentUser, toUsername, message)
+			}
+			if err != nil {
+				i18n.Printf("Failed to send message: %v\n", err)
+			}
+
+		case "forward", "fwd":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to forward messages")
 				break
 			}
 			if len(parts) < 3 {
-				fmt.Println("Usage: msg <username> <message>")
-				fmt.Println("Example: msg alice Hello, how are you?")
+				i18n.Println("Usage: forward <message-id> <username>")
+				i18n.Println("Message IDs are shown in 'history' as #<id>")
+				break
+			}
+			var messageID int64
+			fmt.Sscanf(parts[1], "%d", &messageID)
+			toUsername, ok := a.resolveUsername(ctx, parts[2])
+			if !ok {
+				break
+			}
+
+			currentUser, _ := a.auth.CurrentUser()
+			if err := a.messageManager.ForwardMessage(ctx, currentUser, messageID, toUsername); err != nil {
+				i18n.Printf("Failed to forward message: %v\n", err)
+			}
+
+		case "reply":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to reply to messages")
+				break
+			}
+			if len(parts) < 3 {
+				i18n.Println("Usage: reply <message-id> <message>")
+				i18n.Println("Message IDs are shown in 'history' as #<id>")
+				break
+			}
+			var messageID int64
+			fmt.Sscanf(parts[1], "%d", &messageID)
+			message := strings.Join(parts[2:], " ")
+
+			currentUser, _ := a.auth.CurrentUser()
+			if err := a.messageManager.Reply(ctx, currentUser, messageID, "", message); err != nil {
+				i18n.Printf("Failed to send reply: %v\n", err)
+			}
+
+		case "quote":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to quote messages")
+				break
+			}
+			if len(parts) < 4 {
+				i18n.Println("Usage: quote <message-id> <username> <message>")
+				i18n.Println("Replies to a message in another conversation, quoting it")
+				break
+			}
+			var messageID int64
+			fmt.Sscanf(parts[1], "%d", &messageID)
+			toUsername, ok := a.resolveUsername(ctx, parts[2])
+			if !ok {
+				break
+			}
+			message := strings.Join(parts[3:], " ")
+
+			currentUser, _ := a.auth.CurrentUser()
+			if err := a.messageManager.Reply(ctx, currentUser, messageID, toUsername, message); err != nil {
+				i18n.Printf("Failed to send reply: %v\n", err)
+			}
+
+		case "back":
+			a.leaveConversation()
+
+		case "chats":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to view conversations")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+
+			onlinePeerIDs := []string{}
+			for _, peer := range a.p2p.GetConnectedPeers() {
+				onlinePeerIDs = append(onlinePeerIDs, peer.ID.String())
+			}
+
+			conversations, err := a.messageManager.GetConversations(ctx, currentUser.ID, onlinePeerIDs)
+			if err != nil {
+				i18n.Printf("Failed to get conversations: %v\n", err)
+				break
+			}
+
+			if len(conversations) == 0 {
+				i18n.Println("No conversations yet")
+				i18n.Println("Use 'msg <username> <message>' to start one")
+			} else {
+				i18n.Printf("Conversations (%d):\n", len(conversations))
+				for _, conv := range conversations {
+					statusIcon := "○"
+					if conv.Online {
+						statusIcon = "●"
+					}
+					unread := ""
+					if conv.UnreadCount > 0 {
+						unread = i18n.Sprintf(" (%d new)", conv.UnreadCount)
+					}
+					prefix := ""
+					if conv.LastMessage.FromUserID == currentUser.ID && !conv.LastMessage.IsSystem() {
+						prefix = i18n.T("You: ")
+					}
+					i18n.Printf("  %s %s%s - %s\n", statusIcon, conv.FullName, unread, conv.LastMessage.CreatedAt.Local().Format("Jan 2 15:04"))
+					i18n.Printf("      %s%s\n", prefix, conv.Snippet)
+				}
+			}
+
+		case "msg-status":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to check on messages")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.runMsgStatus(ctx, currentUser, parts[1:])
+
+		case "delete-msg":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to delete messages")
+				break
+			}
+			if len(parts) < 2 {
+				i18n.Println("Usage: delete-msg <message-id>")
+				i18n.Println("Hides the message from your history only (the other person keeps it)")
+				break
+			}
+			var messageID int64
+			fmt.Sscanf(parts[1], "%d", &messageID)
+			currentUser, _ := a.auth.CurrentUser()
+
+			if err := a.messageManager.DeleteMessageForMe(ctx, currentUser.ID, messageID); err != nil {
+				i18n.Printf("Failed to delete message: %v\n", err)
+				break
+			}
+			i18n.Printf("✓ Message #%d deleted for you\n", messageID)
+
+		case "delete-chat":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to delete messages")
 				break
 			}
-			toUsername := parts[1]
-			message := strings.Join(parts[2:], " ")
-
 			currentUser, _ := a.auth.CurrentUser()
-			err := a.messageManager.SendMessage(ctx, currentUser, toUsername, message)
-			if err != nil {
-				fmt.Printf("Failed to send message: %v\n", err)
+			a.handleDeleteChatCommand(ctx, currentUser, parts)
+
+		case "mark-read":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to mark messages read")
+				break
 			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.handleMarkReadCommand(ctx, currentUser, parts)
 
 		case "history":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to view message history")
+				i18n.Println("You must be logged in to view message history")
 				break
 			}
 			if len(parts) < 2 {
-				fmt.Println("Usage: history <username> [limit]")
-				fmt.Println("Example: history alice 20")
+				i18n.Println("Usage: history <username> [limit]")
+				i18n.Println("Example: history alice 20")
 				break
 			}
 			otherUsername := parts[1]
@@ -538,26 +1618,34 @@ func (a *App) commandLoop(ctx context.Context) {
 
 			currentUser, _ := a.auth.CurrentUser()
 			otherUser, err := a.storage.GetUserByUsername(ctx, otherUsername)
-			if err != nil || otherUser == nil {
-				fmt.Printf("User not found: %s\n", otherUsername)
+			if err != nil {
+				i18n.Printf("User not found: %s\n", otherUsername)
 				break
 			}
 
 			messages, err := a.messageManager.GetConversation(ctx, currentUser.ID, otherUser.ID, limit)
 			if err != nil {
-				fmt.Printf("Failed to get messages: %v\n", err)
+				i18n.Printf("Failed to get messages: %v\n", err)
 				break
 			}
 
 			if len(messages) == 0 {
-				fmt.Printf("No message history with %s\n", otherUsername)
+				i18n.Printf("No message history with %s\n", otherUsername)
 			} else {
-				fmt.Printf("\n=== Conversation with %s (%d messages) ===\n", otherUser.FullName, len(messages))
+				i18n.Printf("\n=== Conversation with %s (%d messages) ===\n", otherUser.FullName, len(messages))
+				if pid, err := peer.Decode(otherUser.PeerID); err == nil && p2p.PeerSupports(a.p2p.Host(), pid, p2p.CapabilityReceiptsOff) {
+					i18n.Printf("(%s has read receipts off; ✓ means delivered)\n", otherUser.FullName)
+				}
 				// Messages are in DESC order, so reverse them for display
 				for i := len(messages) - 1; i >= 0; i-- {
 					msg := messages[i]
 					timestamp := msg.CreatedAt.Format("15:04:05")
 
+					if msg.IsSystem() {
+						i18n.Printf("[%s] *** %s ***\n", timestamp, msg.Content)
+						continue
+					}
+
 					var sender string
 					if msg.FromUserID == currentUser.ID {
 						sender = "You"
@@ -571,22 +1659,37 @@ func (a *App) commandLoop(ctx context.Context) {
 							status = " ✓✓"
 						} else if msg.Delivered {
 							status = " ✓"
+						} else if msg.Failed {
+							status = " ✗ " + i18n.T("not delivered")
 						}
+					} else if msg.ReceivedAt.Sub(msg.CreatedAt) > p2p.ClockSkewTolerance {
+						// Queued while we were away; say when it actually arrived
+						status = " (" + i18n.Sprintf("received %s", msg.ReceivedAt.Format("Jan 2 15:04")) + ")"
 					}
 
-					fmt.Printf("[%s] %s: %s%s\n", timestamp, sender, msg.Content, status)
+					if msg.Forwarded != nil {
+						i18n.Printf("[%s] #%d %s: ↪ forwarded from %s (%s)\n", timestamp, msg.ID, sender, msg.Forwarded.Author(), msg.Forwarded.SentAt.Local().Format("Jan 2 15:04"))
+						i18n.Printf("           %s%s\n", msg.Content, status)
+						continue
+					}
+					if msg.Quote != nil {
+						i18n.Printf("[%s] #%d %s: ↳ replying to %s (%s): \"%s\"\n", timestamp, msg.ID, sender, msg.Quote.Author(), msg.Quote.SentAt.Local().Format("Jan 2 15:04"), msg.Quote.Excerpt)
+						i18n.Printf("           %s%s\n", msg.Content, status)
+						continue
+					}
+					i18n.Printf("[%s] #%d %s: %s%s\n", timestamp, msg.ID, sender, msg.Content, status)
 				}
-				fmt.Println()
+				i18n.Println()
 			}
 
 			// Mark messages as read
 			if err := a.messageManager.MarkAsRead(ctx, currentUser, otherUsername); err != nil {
-				fmt.Printf("Warning: Failed to mark messages as read: %v\n", err)
+				i18n.Printf("Warning: Failed to mark messages as read: %v\n", err)
 			}
 
 		case "unread":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to view unread messages")
+				i18n.Println("You must be logged in to view unread messages")
 				break
 			}
 
@@ -595,7 +1698,7 @@ func (a *App) commandLoop(ctx context.Context) {
 			// Get all friends
 			friends, err := a.friendManager.GetFriends(ctx, currentUser.ID)
 			if err != nil {
-				fmt.Printf("Failed to get friends: %v\n", err)
+				i18n.Printf("Failed to get friends: %v\n", err)
 				break
 			}
 
@@ -616,27 +1719,75 @@ func (a *App) commandLoop(ctx context.Context) {
 
 				if unreadCount > 0 {
 					if !hasUnread {
-						fmt.Println("\n=== Unread Messages ===")
+						i18n.Println("\n=== Unread Messages ===")
 						hasUnread = true
 					}
-					fmt.Printf("%s (%s): %d unread message(s)\n", friend.FullName, friend.Username, unreadCount)
+					i18n.Printf("%s (%s): %d unread message(s)\n", friend.FullName, friend.Username, unreadCount)
 				}
 			}
 
 			if !hasUnread {
-				fmt.Println("No unread messages")
+				i18n.Println("No unread messages")
 			} else {
-				fmt.Println("\nUse 'history <username>' to read messages")
+				i18n.Println("\nUse 'history <username>' to read messages")
+			}
+
+		case "group-create":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to create a group")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.runGroupCreate(ctx, currentUser, parts[1:])
+
+		case "groups":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to view groups")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.runGroups(ctx, currentUser)
+
+		case "group-msg":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to send group messages")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.runGroupMsg(ctx, currentUser, parts[1:])
+
+		case "group-history":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to view group history")
+				break
 			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.runGroupHistory(ctx, currentUser, parts[1:])
+
+		case "group-status":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to check on messages")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.runGroupStatus(ctx, currentUser, parts[1:])
+
+		case "group-leave":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to leave a group")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.runGroupLeave(ctx, currentUser, parts[1:])
 
 		case "create-conf":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to create conferences")
+				i18n.Println("You must be logged in to create conferences")
 				break
 			}
 			if len(parts) < 2 {
-				fmt.Println("Usage: create-conf <name>")
-				fmt.Println("Example: create-conf \"Study Group\"")
+				i18n.Println("Usage: create-conf <name>")
+				i18n.Println("Example: create-conf \"Study Group\"")
 				break
 			}
 			confName := strings.Join(parts[1:], " ")
@@ -645,17 +1796,17 @@ func (a *App) commandLoop(ctx context.Context) {
 			currentUser, _ := a.auth.CurrentUser()
 			_, err := a.conferenceManager.CreateConference(ctx, currentUser, confName)
 			if err != nil {
-				fmt.Printf("Failed to create conference: %v\n", err)
+				i18n.Printf("Failed to create conference: %v\n", err)
 			}
 
 		case "invite-conf":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to invite to conferences")
+				i18n.Println("You must be logged in to invite to conferences")
 				break
 			}
 			if len(parts) < 3 {
-				fmt.Println("Usage: invite-conf <conference-id> <username>")
-				fmt.Println("Example: invite-conf 1 alice")
+				i18n.Println("Usage: invite-conf <conference-id> <username>")
+				i18n.Println("Example: invite-conf 1 alice")
 				break
 			}
 			var confID int64
@@ -665,17 +1816,17 @@ func (a *App) commandLoop(ctx context.Context) {
 			currentUser, _ := a.auth.CurrentUser()
 			err := a.conferenceManager.InviteToConference(ctx, currentUser, confID, username)
 			if err != nil {
-				fmt.Printf("Failed to invite: %v\n", err)
+				i18n.Printf("Failed to invite: %v\n", err)
 			}
 
 		case "join-conf":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to join conferences")
+				i18n.Println("You must be logged in to join conferences")
 				break
 			}
 			if len(parts) < 2 {
-				fmt.Println("Usage: join-conf <conference-id>")
-				fmt.Println("Example: join-conf 1")
+				i18n.Println("Usage: join-conf <conference-id>")
+				i18n.Println("Example: join-conf 1")
 				break
 			}
 			var confID int64
@@ -684,17 +1835,17 @@ func (a *App) commandLoop(ctx context.Context) {
 			currentUser, _ := a.auth.CurrentUser()
 			err := a.conferenceManager.JoinConference(ctx, currentUser, confID)
 			if err != nil {
-				fmt.Printf("Failed to join conference: %v\n", err)
+				i18n.Printf("Failed to join conference: %v\n", err)
 			}
 
 		case "conf-msg":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to send conference messages")
+				i18n.Println("You must be logged in to send conference messages")
 				break
 			}
 			if len(parts) < 3 {
-				fmt.Println("Usage: conf-msg <conference-id> <message>")
-				fmt.Println("Example: conf-msg 1 Hello everyone!")
+				i18n.Println("Usage: conf-msg <conference-id> <message>")
+				i18n.Println("Example: conf-msg 1 Hello everyone!")
 				break
 			}
 			var confID int64
@@ -703,42 +1854,97 @@ func (a *App) commandLoop(ctx context.Context) {
 
 			currentUser, _ := a.auth.CurrentUser()
 			err := a.conferenceManager.SendMessage(ctx, currentUser, confID, message)
-			if err != nil {
-				fmt.Printf("Failed to send message: %v\n", err)
+			if errors.Is(err, conference.ErrRateLimited) {
+				i18n.Printf("⏱️  %v\n", err)
+			} else if err != nil {
+				i18n.Printf("Failed to send message: %v\n", err)
 			} else {
-				fmt.Printf("✓ Message sent to conference\n")
+				i18n.Printf("✓ Message sent to conference\n")
 			}
 
 		case "conf-list":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to view conferences")
+				i18n.Println("You must be logged in to view conferences")
 				break
 			}
 			currentUser, _ := a.auth.CurrentUser()
 			conferences, err := a.conferenceManager.GetConferences(ctx, currentUser.ID)
 			if err != nil {
-				fmt.Printf("Failed to get conferences: %v\n", err)
+				i18n.Printf("Failed to get conferences: %v\n", err)
 				break
 			}
 
 			if len(conferences) == 0 {
-				fmt.Println("You are not in any conferences")
-				fmt.Println("Use 'create-conf <name>' to create one")
+				i18n.Println("You are not in any conferences")
+				i18n.Println("Use 'create-conf <name>' to create one")
 			} else {
-				fmt.Printf("Your conferences (%d):\n", len(conferences))
+				i18n.Printf("Your conferences (%d):\n", len(conferences))
 				for i, conf := range conferences {
-					fmt.Printf("  %d. %s (ID: %d)\n", i+1, conf.Name, conf.ID)
+					if conf.MaxParticipants > 0 {
+						i18n.Printf("  %d. %s (ID: %d, max %d)\n", i+1, conf.Name, conf.ID, conf.MaxParticipants)
+						continue
+					}
+					i18n.Printf("  %d. %s (ID: %d)\n", i+1, conf.Name, conf.ID)
 				}
 			}
 
+		case "conf-limit":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to change conference limits")
+				break
+			}
+			if len(parts) < 3 {
+				i18n.Println("Usage: conf-limit <conf-id> <max-participants>")
+				i18n.Println("Use 0 for no limit. Only the conference owner can change it.")
+				break
+			}
+			var confID int64
+			var max int
+			fmt.Sscanf(parts[1], "%d", &confID)
+			if _, err := fmt.Sscanf(parts[2], "%d", &max); err != nil {
+				i18n.Println("Usage: conf-limit <conf-id> <max-participants>")
+				break
+			}
+
+			currentUser, _ := a.auth.CurrentUser()
+			if err := a.conferenceManager.SetMaxParticipants(ctx, currentUser, confID, max); err != nil {
+				i18n.Printf("Failed to set limit: %v\n", err)
+				break
+			}
+			if max == 0 {
+				i18n.Println("✓ Conference has no participant limit")
+			} else {
+				i18n.Printf("✓ Conference limited to %d participants\n", max)
+			}
+
+		case "conf-delete-msg":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to delete messages")
+				break
+			}
+			if len(parts) < 3 {
+				i18n.Println("Usage: conf-delete-msg <conf-id> <message-id>")
+				i18n.Println("Hides the message from your history only (other members keep it)")
+				break
+			}
+			var confID, messageID int64
+			fmt.Sscanf(parts[1], "%d", &confID)
+			fmt.Sscanf(parts[2], "%d", &messageID)
+
+			if err := a.conferenceManager.DeleteMessageForMe(ctx, confID, messageID); err != nil {
+				i18n.Printf("Failed to delete message: %v\n", err)
+				break
+			}
+			i18n.Printf("✓ Message #%d deleted for you\n", messageID)
+
 		case "conf-history":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to view conference history")
+				i18n.Println("You must be logged in to view conference history")
 				break
 			}
 			if len(parts) < 2 {
-				fmt.Println("Usage: conf-history <conference-id> [limit]")
-				fmt.Println("Example: conf-history 1 20")
+				i18n.Println("Usage: conf-history <conference-id> [limit]")
+				i18n.Println("Example: conf-history 1 20")
 				break
 			}
 			var confID int64
@@ -750,46 +1956,97 @@ func (a *App) commandLoop(ctx context.Context) {
 
 			// Get conference
 			conf, err := a.storage.GetConference(ctx, confID)
-			if err != nil || conf == nil {
-				fmt.Printf("Conference not found\n")
+			if err != nil {
+				i18n.Printf("Conference not found\n")
 				break
 			}
 
 			messages, err := a.conferenceManager.GetConferenceMessages(ctx, confID, limit)
 			if err != nil {
-				fmt.Printf("Failed to get messages: %v\n", err)
+				i18n.Printf("Failed to get messages: %v\n", err)
 				break
 			}
 
 			if len(messages) == 0 {
-				fmt.Printf("No messages in conference '%s'\n", conf.Name)
+				i18n.Printf("No messages in conference '%s'\n", conf.Name)
 			} else {
-				fmt.Printf("\n=== Conference: %s (%d messages) ===\n", conf.Name, len(messages))
-				// Messages are in DESC order, so reverse them
-				for i := len(messages) - 1; i >= 0; i-- {
-					msg := messages[i]
-					timestamp := msg.CreatedAt.Format("15:04:05")
+				i18n.Printf("\n=== Conference: %s (%d messages) ===\n", conf.Name, len(messages))
+				a.printConferenceMessages(ctx, messages)
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			if err := a.conferenceManager.MarkRead(ctx, currentUser.ID, confID); err != nil {
+				i18n.Printf("Warning: Failed to mark conference as read: %v\n", err)
+			}
 
-					// Try to get username from peer ID
-					fromUsername := msg.FromPeerID[:8] + "..." // Fallback
-					fromUser, err := a.storage.GetUserByPeerID(ctx, msg.FromPeerID)
-					if err == nil && fromUser != nil {
-						fromUsername = fromUser.FullName
-					}
+		case "conf-export":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to export a conference")
+				break
+			}
+			a.exportConference(ctx, parts[1:])
 
-					fmt.Printf("[%s] %s: %s\n", timestamp, fromUsername, msg.Content)
-				}
-				fmt.Println()
+		case "conf-ratelimit":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to change conference limits")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.runConfRateLimit(ctx, currentUser, parts[1:])
+
+		case "conf-compact":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to compact conference history")
+				break
+			}
+			a.runConfCompact(ctx, parts[1:])
+
+		case "conf-summaries":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to view conference history")
+				break
 			}
+			a.runConfSummaries(ctx, parts[1:])
 
-		case "conf-members":
+		case "conf-slowmode":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to view conference members")
+				i18n.Println("You must be logged in to change conference limits")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.runConfSlowMode(ctx, currentUser, parts[1:])
+
+		case "conf-demote":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to change conference roles")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.runConfDemote(ctx, currentUser, parts[1:])
+
+		case "conf-promote":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to change conference roles")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.runConfPromote(ctx, currentUser, parts[1:])
+
+		case "conf-channel":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to use conference channels")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.runConfChannel(ctx, currentUser, parts[1:])
+
+		case "conf-members", "conf-participants":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to view conference members")
 				break
 			}
 			if len(parts) < 2 {
-				fmt.Println("Usage: conf-members <conference-id>")
-				fmt.Println("Example: conf-members 1")
+				i18n.Println("Usage: conf-members <conference-id>")
+				i18n.Println("Example: conf-members 1")
 				break
 			}
 			var confID int64
@@ -797,31 +2054,63 @@ func (a *App) commandLoop(ctx context.Context) {
 
 			participants, err := a.conferenceManager.GetConferenceParticipants(ctx, confID)
 			if err != nil {
-				fmt.Printf("Failed to get participants: %v\n", err)
+				i18n.Printf("Failed to get participants: %v\n", err)
 				break
 			}
+			observers, err := a.conferenceManager.GetObservers(ctx, confID)
+			if err != nil {
+				i18n.Printf("Failed to get observers: %v\n", err)
+				break
+			}
+
+			// We're in the room ourselves
+			currentUser, _ := a.auth.CurrentUser()
+			online := map[string]bool{currentUser.PeerID: true}
+			for _, p := range a.conferenceManager.GetOnlineParticipants(confID) {
+				online[p.PeerID.String()] = true
+			}
 
 			if len(participants) == 0 {
-				fmt.Println("No participants in conference")
+				i18n.Println("No participants in conference")
 			} else {
-				fmt.Printf("Conference participants (%d):\n", len(participants))
+				onlineCount := 0
+				for _, p := range participants {
+					if p.Active && online[p.PeerID] {
+						onlineCount++
+					}
+				}
+				i18n.Printf("Conference participants (%d, %d online):\n", len(participants), onlineCount)
 				for i, p := range participants {
 					status := "active"
 					if !p.Active {
 						status = "left"
+					} else if observers.Has(p.PeerID) {
+						status = "observer"
 					}
-					fmt.Printf("  %d. %s (%s) - %s\n", i+1, p.Username, status, p.JoinedAt.Format("Jan 2"))
+					statusIcon := "○"
+					if p.Active && online[p.PeerID] {
+						statusIcon = "●"
+					}
+					i18n.Printf("  %d. %s %s (%s) - %s\n", i+1, statusIcon, p.Username, status, p.JoinedAt.Format("Jan 2"))
 				}
 			}
 
+		case "conf-add":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to send friend requests")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.handleConfAddCommand(ctx, currentUser, parts)
+
 		case "leave-conf":
 			if !a.auth.IsAuthenticated() {
-				fmt.Println("You must be logged in to leave conferences")
+				i18n.Println("You must be logged in to leave conferences")
 				break
 			}
 			if len(parts) < 2 {
-				fmt.Println("Usage: leave-conf <conference-id>")
-				fmt.Println("Example: leave-conf 1")
+				i18n.Println("Usage: leave-conf <conference-id>")
+				i18n.Println("Example: leave-conf 1")
 				break
 			}
 			var confID int64
@@ -830,22 +2119,338 @@ func (a *App) commandLoop(ctx context.Context) {
 			currentUser, _ := a.auth.CurrentUser()
 			err := a.conferenceManager.LeaveConference(ctx, currentUser, confID)
 			if err != nil {
-				fmt.Printf("Failed to leave conference: %v\n", err)
+				i18n.Printf("Failed to leave conference: %v\n", err)
+			}
+
+		case "addr":
+			printConnectString(a.p2p)
+
+		case "dht":
+			stats := a.p2p.DHTStats()
+			i18n.Printf("DHT mode: %s (setting: %s)\n", stats.Mode, stats.Setting)
+			i18n.Printf("Routing table: %d peer(s)\n", stats.RoutingTableSize)
+			if stats.AvgPeerLatency > 0 {
+				i18n.Printf("Average peer latency: %s\n", stats.AvgPeerLatency.Round(time.Millisecond))
+			}
+			if len(stats.Buckets) > 0 {
+				i18n.Println("Buckets (common prefix length: peers):")
+				for cpl, count := range stats.Buckets {
+					if count > 0 {
+						i18n.Printf("  %3d: %d\n", cpl, count)
+					}
+				}
+			}
+			if len(stats.RecentQueries) == 0 {
+				i18n.Println("No recent DHT queries")
+			} else {
+				i18n.Println("Recent queries:")
+				for _, q := range stats.RecentQueries {
+					result := "ok"
+					if q.Err != "" {
+						result = q.Err
+					}
+					i18n.Printf("  %s %-10s %8s  %s\n", q.Time.Format("15:04:05"), q.Op, q.Duration.Round(time.Millisecond), result)
+				}
+			}
+
+		case "db-stats":
+			stats, err := a.storage.Stats(ctx)
+			if err != nil {
+				i18n.Printf("Failed to get database stats: %v\n", err)
+				break
+			}
+			i18n.Println("Rows:")
+			for _, table := range stats.Tables {
+				i18n.Printf("  %-24s %d\n", table.Name, table.Rows)
+			}
+			if len(stats.Ops) == 0 {
+				i18n.Println("No database operations yet")
+			} else {
+				i18n.Println("Operations (slowest total first):")
+				i18n.Printf("  %-32s %8s %10s %10s %6s\n", "op", "calls", "avg", "max", "slow")
+				for _, op := range stats.Ops {
+					i18n.Printf("  %-32s %8d %10s %10s %6d\n", op.Op, op.Count, op.Avg().Round(time.Microsecond), op.Max.Round(time.Microsecond), op.Slow)
+				}
+			}
+			if stats.SlowThreshold == 0 {
+				i18n.Println("Slow query log: off")
+			} else if len(stats.SlowQueries) == 0 {
+				i18n.Printf("No queries over %s\n", stats.SlowThreshold)
+			} else {
+				i18n.Printf("Recent queries over %s:\n", stats.SlowThreshold)
+				for _, q := range stats.SlowQueries {
+					i18n.Printf("  %s %-32s %s\n", q.Time.Format("15:04:05"), q.Op, q.Duration.Round(time.Millisecond))
+				}
+			}
+
+		case "resources":
+			stats := a.p2p.ResourceStats()
+			i18n.Printf("Memory: %.1f / %.1f MB\n", float64(stats.System.Memory)/(1<<20), float64(stats.MemoryLimit)/(1<<20))
+			i18n.Printf("Streams: %d inbound, %d outbound\n", stats.System.NumStreamsInbound, stats.System.NumStreamsOutbound)
+			i18n.Printf("Connections: %d inbound, %d outbound\n", stats.System.NumConnsInbound, stats.System.NumConnsOutbound)
+			if len(stats.BusiestPeers) > 0 {
+				i18n.Println("Busiest peers:")
+				for _, p := range stats.BusiestPeers {
+					i18n.Printf("  %s: %d in / %d out streams, %.1f KB\n", p.ID.String(), p.Stat.NumStreamsInbound, p.Stat.NumStreamsOutbound, float64(p.Stat.Memory)/1024)
+				}
+			}
+			if protocols := p2p.DefaultStreamGuard.Stats(); len(protocols) > 0 {
+				i18n.Println("Protocols:")
+				for _, p := range protocols {
+					average := time.Duration(0)
+					if p.Streams > 0 {
+						average = p.Total / time.Duration(p.Streams)
+					}
+					i18n.Printf("  %s: %d streams, %d refused, %d failed, %s average, %s slowest\n", p.Protocol, p.Streams, p.Refused, p.Panics,
+						average.Round(time.Millisecond), p.Slowest.Round(time.Millisecond))
+				}
+			}
+
+		case "scores":
+			scores := a.p2p.PeerScores()
+			if len(scores) == 0 {
+				i18n.Println("No peer scores yet (sampled every minute)")
+				break
+			}
+			ids := make([]peer.ID, 0, len(scores))
+			for id := range scores {
+				ids = append(ids, id)
+			}
+			sort.Slice(ids, func(i, j int) bool { return scores[ids[i]] < scores[ids[j]] })
+			names := make(map[peer.ID]string)
+			for _, info := range a.p2p.GetConnectedPeers() {
+				names[info.ID] = info.Username
+			}
+			i18n.Println("GossipSub peer scores (lowest first):")
+			for _, id := range ids {
+				if names[id] != "" {
+					i18n.Printf("  %8.2f  %s (%s)\n", scores[id], names[id], id.String())
+				} else {
+					i18n.Printf("  %8.2f  %s\n", scores[id], id.String())
+				}
+			}
+
+		case "debug":
+			a.handleDebugCommand(ctx, parts)
+
+		case "update":
+			a.runUpdate(ctx, parts[1:])
+
+		case "dht-mode":
+			if len(parts) < 2 {
+				i18n.Printf("DHT mode setting: %s\n", a.p2p.DHTMode())
+				i18n.Println("Usage: dht-mode <auto|client|server>")
+				break
+			}
+			if err := a.settings.Set(ctx, settingDHTMode, parts[1]); err != nil {
+				i18n.Printf("Failed to switch DHT mode: %v\n", err)
+				break
+			}
+			i18n.Printf("✓ DHT mode set to %s\n", parts[1])
+
+		case "lang":
+			a.handleLangCommand(ctx, parts)
+
+		case "settings":
+			a.handleSettingsCommand(ctx, parts)
+
+		case "autodial":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to change auto-dial settings")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			if len(parts) < 3 {
+				a.showAutoDial(ctx, currentUser)
+				break
+			}
+
+			switch parts[1] {
+			case "mode":
+				if err := a.settings.Set(ctx, settingAutoDialMode, parts[2]); err != nil {
+					i18n.Printf("Failed to set auto-dial mode: %v\n", err)
+					break
+				}
+				i18n.Printf("✓ Auto-dial mode set to %s\n", parts[2])
+			case "on", "off":
+				username, ok := a.resolveUsername(ctx, parts[2])
+				if !ok {
+					break
+				}
+				enabled := parts[1] == "on"
+				if err := a.friendManager.SetAutoDial(ctx, currentUser, username, enabled); err != nil {
+					i18n.Printf("Failed to change auto-dial for %s: %v\n", username, err)
+					break
+				}
+				if enabled {
+					i18n.Printf("✓ %s will be dialed automatically\n", username)
+				} else {
+					i18n.Printf("✓ %s will no longer be dialed automatically\n", username)
+				}
+			default:
+				a.showAutoDial(ctx, currentUser)
+			}
+
+		case "health":
+			printHealth(a.Health(ctx))
+
+		case "quota":
+			a.handleQuotaCommand(ctx, parts)
+
+		case "profile":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to change your profile")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.handleProfileCommand(ctx, currentUser, parts)
+
+		case "delete-account":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to delete your account")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.handleDeleteAccountCommand(ctx, currentUser, parts)
+
+		case "evidence-export":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to export an archive")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.handleEvidenceExportCommand(ctx, currentUser, parts)
+
+		case "activity":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to see activity")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.handleActivityCommand(ctx, currentUser, parts)
+
+		case "stats":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to see stats")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.handleStatsCommand(ctx, currentUser, parts)
+
+		case "evidence-verify":
+			if len(parts) != 2 {
+				i18n.Println("Usage: evidence-verify <archive>")
+				break
+			}
+			if err := verifyEvidence(parts[1]); err != nil {
+				i18n.Printf("✗ Verification failed: %v\n", err)
+			}
+
+		case "privacy":
+			if !a.auth.IsAuthenticated() {
+				i18n.Println("You must be logged in to change privacy settings")
+				break
+			}
+			currentUser, _ := a.auth.CurrentUser()
+			a.handlePrivacyCommand(ctx, currentUser, parts)
+
+		case "backup":
+			// backup [path] [--encrypt [--password-file <file>]]
+			destPath := ""
+			encrypt := false
+			passphraseFile := ""
+			usage := false
+			for i := 1; i < len(parts); i++ {
+				switch {
+				case parts[i] == "--encrypt":
+					encrypt = true
+				case parts[i] == "--password-file" && i+1 < len(parts):
+					passphraseFile = parts[i+1]
+					i++
+				case destPath == "" && !strings.HasPrefix(parts[i], "--"):
+					destPath = parts[i]
+				default:
+					usage = true
+				}
+			}
+			if usage || (passphraseFile != "" && !encrypt) {
+				i18n.Println("Usage: backup [path] [--encrypt [--password-file <file>]]")
+				i18n.Println("With --encrypt you are asked for a passphrase, which isn't shown")
+				break
+			}
+			if destPath == "" {
+				destPath = a.storage.DefaultBackupPath()
+			}
+
+			passphrase := ""
+			if encrypt {
+				var err error
+				if passphraseFile != "" {
+					passphrase, err = a.passwordArg([]string{"--password-file", passphraseFile}, "")
+				} else {
+					passphrase, err = a.readNewPassword(i18n.T("Backup passphrase: "))
+				}
+				if err == nil && passphrase == "" {
+					err = errors.New("the passphrase is empty")
+				}
+				if err != nil {
+					i18n.Printf("Backup failed: %v\n", err)
+					break
+				}
+			}
+
+			i18n.Println("Backing up database...")
+			if err := a.storage.Backup(ctx, destPath, passphrase); err != nil {
+				i18n.Printf("Backup failed: %v\n", err)
+				break
+			}
+			if passphrase != "" {
+				i18n.Printf("✓ Encrypted backup written to %s\n", destPath)
+				i18n.Println("  Restore with: decrypt-backup <file> <output.db>")
+			} else {
+				i18n.Printf("✓ Backup written to %s\n", destPath)
+			}
+
+		case "decrypt-backup":
+			// decrypt-backup <file> <out.db> [--password-file <file>]
+			if len(parts) != 3 && (len(parts) != 5 || parts[3] != "--password-file") {
+				i18n.Println("Usage: decrypt-backup <file> <output.db> [--password-file <file>]")
+				i18n.Println("Without --password-file you are asked for the passphrase, which isn't shown")
+				break
+			}
+			passphrase, err := a.passwordArg(parts[3:], i18n.T("Backup passphrase: "))
+			if err != nil {
+				i18n.Printf("Failed to decrypt backup: %v\n", err)
+				break
+			}
+			if err := storage.DecryptBackup(parts[1], parts[2], passphrase); err != nil {
+				i18n.Printf("Failed to decrypt backup: %v\n", err)
+				break
 			}
+			i18n.Printf("✓ Decrypted backup written to %s\n", parts[2])
 
 		case "help":
 			a.showHelp()
 
 		case "quit", "exit":
-			fmt.Println("Exiting...")
-			syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+			i18n.Println("Exiting...")
+			a.quit()
+			return
+
+		case "drain":
+			if err := a.drain(ctx); err != nil {
+				i18n.Printf("Failed to drain: %v\n", err)
+				break
+			}
+			i18n.Println("Exiting...")
+			a.quit()
 			return
 
 		default:
-			fmt.Printf("Unknown command: %s (type 'help' for available commands)\n", cmd)
+			i18n.Printf("Unknown command: %s (type 'help' for available commands)\n", cmd)
 		}
 
-		fmt.Print("> ")
+		i18n.Print("> ")
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -854,45 +2459,126 @@ func (a *App) commandLoop(ctx context.Context) {
 }
 
 func (a *App) showHelp() {
-	fmt.Println("\n=== Authentication Commands ===")
-	fmt.Println("  register <username> <password> <full-name> - Create new account")
-	fmt.Println("  login <username> <password>                - Login to your account")
-	fmt.Println("  logout                                      - Logout from current account")
-	fmt.Println("  whoami                                      - Show current user info")
-	fmt.Println("  passwd <old-pass> <new-pass>               - Change your password")
-	fmt.Println("  search <name>                               - Search for users by name")
-	fmt.Println()
-	fmt.Println("=== Getting Started ===")
-	fmt.Println("  connect <multiaddr>                         - Connect to peer & send friend request")
-	fmt.Println("  accept <username>                           - Accept friend request")
-	fmt.Println()
-	fmt.Println("=== Friend Commands ===")
-	fmt.Println("  add <username>                              - Send friend request by username")
-	fmt.Println("  add-peer <peer-id>                          - Send friend request by peer ID")
-	fmt.Println("  reject <username>                           - Reject friend request")
-	fmt.Println("  friends                                     - List your friends")
-	fmt.Println("  requests                                    - View pending friend requests")
-	fmt.Println()
-	fmt.Println("=== Messaging Commands ===")
-	fmt.Println("  msg <username> <message>                    - Send a direct message")
-	fmt.Println("  history <username> [limit]                  - View message history")
-	fmt.Println("  unread                                      - Show unread messages")
-	fmt.Println()
-	fmt.Println("=== Conference Commands ===")
-	fmt.Println("  create-conf <name>                          - Create a new conference")
-	fmt.Println("  invite-conf <conf-id> <username>            - Invite friend to conference")
-	fmt.Println("  join-conf <conference-id>                   - Join a conference")
-	fmt.Println("  conf-msg <conf-id> <message>                - Send conference message")
-	fmt.Println("  conf-list                                   - List your conferences")
-	fmt.Println("  conf-history <conf-id> [limit]              - View conference history")
-	fmt.Println("  conf-members <conf-id>                      - List conference members")
-	fmt.Println("  leave-conf <conf-id>                        - Leave a conference")
-	fmt.Println()
-	fmt.Println("=== Advanced Commands ===")
-	fmt.Println("  peers                                       - List connected peers")
-	fmt.Println()
-	fmt.Println("=== General Commands ===")
-	fmt.Println("  help                                        - Show this help")
-	fmt.Println("  quit                                        - Exit the application")
-	fmt.Println()
+	i18n.Println("\n=== Authentication Commands ===")
+	i18n.Println("  register <username>                         - Create new account (asks for your name and password)")
+	i18n.Println("  login <username> [--password-file <file>]   - Login to your account (asks for the password)")
+	i18n.Println("  logout                                      - Logout from current account")
+	i18n.Println("  accounts                                    - List the accounts on this node")
+	i18n.Println("  switch <username>                           - Switch to another account on this node")
+	i18n.Println("  lock                                        - Lock the app until the password or PIN is entered")
+	i18n.Println("  unlock                                      - Unlock the app (asks for the password or PIN)")
+	i18n.Println("  lock-pin [--remove]                         - Set (asks for it) or remove a PIN that unlocks this session")
+	i18n.Println("  whoami                                      - Show current user info")
+	i18n.Println("  me --card                                   - Show an identity card (with QR) to share with friends")
+	i18n.Println("  passwd                                      - Change your password (asks for the old and new ones)")
+	i18n.Println("  profile                                     - Show your full name and status")
+	i18n.Println("  profile username <new-name>                 - Rename your account; the old name works for 14 days")
+	i18n.Println("  profile name <full name>                    - Change the full name friends see")
+	i18n.Println("  profile status [text]                       - Set a status for friends (empty clears it)")
+	i18n.Println("  delete-account                              - Delete your account, telling friends it is gone")
+	i18n.Println("  search <name>                               - Search for users locally and on the network")
+	i18n.Println()
+	i18n.Println("=== Getting Started ===")
+	i18n.Println("  connect <multiaddr>                         - Connect to peer & send friend request")
+	i18n.Println("  accept <username>                           - Accept friend request")
+	i18n.Println("  accept #<request-id>                        - Accept friend request by ID (see 'requests')")
+	i18n.Println("  accept --all                                - Accept every pending friend request")
+	i18n.Println()
+	i18n.Println("=== Friend Commands ===")
+	i18n.Println("  add <username>                              - Send friend request by username")
+	i18n.Println("  add <username@relay>                        - Send friend request through a relay (see WHISPER_RELAYS)")
+	i18n.Println("  add-peer <peer-id>                          - Send friend request by peer ID")
+	i18n.Println("  reject <username>                           - Reject friend request")
+	i18n.Println("  reject #<request-id>                        - Reject friend request by ID (see 'requests')")
+	i18n.Println("  reject --all                                - Reject every pending friend request")
+	i18n.Println("  trust <username>                            - Trust a friend's changed identity")
+	i18n.Println("  rename <username> <new-name>                - Change the name a contact is shown by")
+	i18n.Println("  name-conflicts                              - List users who share a username")
+	i18n.Println("  friends [--online] [--unread] [--recent] [--verbose] - List your friends (--status sorts online first, --verbose shows versions)")
+	i18n.Println("  requests                                    - View pending friend requests")
+	i18n.Println("  sent-requests                               - View friend requests you sent and their status")
+	i18n.Println("  roster share <username>                     - Leave a copy of your friend list with a friend")
+	i18n.Println("  roster request <peer-id> [msg]              - Ask your other device or a friend for your friend list")
+	i18n.Println("  roster [send|deny <peer-id>]                - List or answer friend list requests")
+	i18n.Println()
+	i18n.Println("=== Messaging Commands ===")
+	i18n.Println("  msg <username> <message>                    - Send a direct message")
+	i18n.Println("  msg --ttl <duration> <user> <message>       - Give up if not delivered in time, e.g. 2h or 3d")
+	i18n.Println("  forward <message-id> <username>             - Forward a message to another friend")
+	i18n.Println("  reply <message-id> <message>                - Reply to a message, quoting it")
+	i18n.Println("  quote <message-id> <username> <message>     - Reply to a message in another conversation")
+	i18n.Println("  chats                                       - List conversations with latest message")
+	i18n.Println("  goto <friend or conference>                 - Chat there; plain lines are sent, /cmd runs cmd")
+	i18n.Println("  back                                        - Leave the conversation opened with goto")
+	i18n.Println("  msg-status <message-id>                     - Show whether a message was delivered, and why not")
+	i18n.Println("  delete-msg <message-id>                     - Delete a message for you only")
+	i18n.Println("  delete-chat <username>                      - Delete a whole conversation for you only")
+	i18n.Println("  history <username> [limit]                  - View message history")
+	i18n.Println("  unread                                      - Show unread messages")
+	i18n.Println("  mark-read <username|conf-id>                - Mark a conversation or conference read")
+	i18n.Println("  activity [before-id]                        - Friend requests, invites and messages you missed")
+	i18n.Println()
+	i18n.Println("=== Group Message Commands ===")
+	i18n.Println("  group-create <name> <user> <user> [...]     - Start a group with 2 to 7 friends")
+	i18n.Println("  groups                                      - List your groups and their members")
+	i18n.Println("  group-msg <group-id> <message>              - Send a message to everyone in a group")
+	i18n.Println("  group-history <group-id> [limit]            - View group history")
+	i18n.Println("  group-status <message-id>                   - Show which members a group message reached")
+	i18n.Println("  group-leave <group-id>                      - Leave a group")
+	i18n.Println()
+	i18n.Println("=== Conference Commands ===")
+	i18n.Println("  create-conf <name>                          - Create a new conference")
+	i18n.Println("  invite-conf <conf-id> <username>            - Invite friend to conference")
+	i18n.Println("  join-conf <conference-id>                   - Join a conference")
+	i18n.Println("  conf-msg <conf-id> <message>                - Send conference message")
+	i18n.Println("  conf-list                                   - List your conferences")
+	i18n.Println("  conf-limit <conf-id> <max>                  - Limit conference size (owner only, 0 = none)")
+	i18n.Println("  conf-ratelimit <conf-id> [n/window|off]     - Limit how fast members post (owner only)")
+	i18n.Println("  conf-slowmode <conf-id> <gap> [for]|off     - One message per gap per member (owner only)")
+	i18n.Println("  conf-demote <conf-id> <username>            - Make a member a read-only observer (owner only)")
+	i18n.Println("  conf-promote <conf-id> <username>           - Let an observer post again (owner only)")
+	i18n.Println("  conf-history <conf-id> [limit]              - View conference history")
+	i18n.Println("  conf-export <conf-id> [json|md] [path]      - Save a conference transcript to a file")
+	i18n.Println("  conf-compact <conf-id> [days]               - Replace history older than days with summaries")
+	i18n.Println("  conf-summaries <conf-id>                    - Show the summaries of compacted history")
+	i18n.Println("  conf-delete-msg <conf-id> <message-id>      - Delete a conference message for you only")
+	i18n.Println("  conf-members <conf-id>                      - List conference members and who is online")
+	i18n.Println("  conf-add <conf-id> <username>               - Send a friend request to a conference member")
+	i18n.Println("  conf-channel create|list <conf-id> [name]   - Create or list channels in a conference")
+	i18n.Println("  conf-channel msg <conf-id> <name> <message> - Send a message to a channel")
+	i18n.Println("  conf-channel history <conf-id> <name> [n]   - View a channel's history")
+	i18n.Println("  leave-conf <conf-id>                        - Leave a conference")
+	i18n.Println()
+	i18n.Println("=== Advanced Commands ===")
+	i18n.Println("  addr                                        - Show your connect line and addresses, best first")
+	i18n.Println("  peers                                       - List connected peers")
+	i18n.Println("  dht                                         - Show DHT routing table and query stats")
+	i18n.Println("  db-stats                                    - Show database row counts and query latencies")
+	i18n.Println("  dht-mode <auto|client|server>               - Switch DHT mode")
+	i18n.Println("  autodial [mode <mode>]                      - Show or set auto-dial mode: normal, bandwidth, battery, off")
+	i18n.Println("  autodial <on|off> <username>                - Allow or stop dialing one friend automatically")
+	i18n.Println("  privacy                                     - Show read receipt, online status and conference request settings")
+	i18n.Println("  privacy <setting> <on|off> [user]           - Turn receipts or conf-requests on or off")
+	i18n.Println("  privacy <setting> default [user]            - Go back to the default for all or one friend")
+	i18n.Println("  privacy online <everyone|friends|nobody>    - Choose who sees when you are online")
+	i18n.Println("  resources                                   - Show stream, connection, memory and protocol usage")
+	i18n.Println("  scores                                      - Show GossipSub peer scores")
+	i18n.Println("  debug peer <peer-id|username>               - Show a peer's connection, version, scores and reputation")
+	i18n.Println("  debug panics                                - Show handler panics the node recovered from")
+	i18n.Println("  backup [path] [--encrypt]                   - Snapshot the database while running")
+	i18n.Println("  decrypt-backup <file> <out.db>              - Decrypt an encrypted backup")
+	i18n.Println("  evidence-export friend|conf <name|id>        - Save a signed, tamper-evident archive (asks for the password)")
+	i18n.Println("  evidence-verify <archive>                   - Check an archive hasn't been altered")
+	i18n.Println("  stats <username|conf-id> [days]             - Message counts, busiest hours and top posters")
+	i18n.Println("  quota [enforce]                             - Show storage used against quotas, or prune now")
+	i18n.Println("  health                                      - Check database, P2P, DHT, disk space and queues")
+	i18n.Println("  update [check]                              - Show your version and newer releases, or check the feed now")
+	i18n.Println()
+	i18n.Println("=== General Commands ===")
+	i18n.Println("  help                                        - Show this help")
+	i18n.Println("  lang [<locale>|ascii <on|off>]              - Show or change the language and ASCII mode")
+	i18n.Println("  settings [set <key> <value>|reset <key>]    - Show, change or reset saved settings")
+	i18n.Println("  quit                                        - Exit the application")
+	i18n.Println("  drain                                       - Finish deliveries, tell peers you're away, then exit")
+	i18n.Println()
 }
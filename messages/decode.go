@@ -0,0 +1,248 @@
+package messages
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+)
+
+// DecodeDirectMessage parses and validates a direct message read from the wire
+func DecodeDirectMessage(data []byte) (*DirectMessage, error) {
+	var message DirectMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal direct message: %w", err)
+	}
+	if err := checkDirectMessage(&message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// checkDirectMessage validates a direct message in either wire encoding,
+// restoring compressed content first
+func checkDirectMessage(message *DirectMessage) error {
+	switch message.Encoding {
+	case "":
+		if len(message.Compressed) > 0 {
+			return fmt.Errorf("compressed content without an encoding")
+		}
+	case p2p.EncodingZstd:
+		if message.Content != "" {
+			return fmt.Errorf("both content and compressed content")
+		}
+		content, err := p2p.Decompress(message.Compressed)
+		if err != nil {
+			return fmt.Errorf("invalid compressed content: %w", err)
+		}
+		message.Content = string(content)
+		message.Encoding = ""
+		message.Compressed = nil
+	default:
+		return fmt.Errorf("unknown content encoding %q", message.Encoding)
+	}
+	if err := p2p.CheckTextField("from_username", message.FromUsername, p2p.MaxUsernameLength, true); err != nil {
+		return err
+	}
+	if err := p2p.CheckTextField("from_full_name", message.FromFullName, p2p.MaxFullNameLength, false); err != nil {
+		return err
+	}
+	if err := p2p.CheckPeerIDField("from_peer_id", message.FromPeerID); err != nil {
+		return err
+	}
+	if err := p2p.CheckTextField("to_username", message.ToUsername, p2p.MaxUsernameLength, false); err != nil {
+		return err
+	}
+	if err := p2p.CheckTextField("content", message.Content, p2p.MaxContentLength, false); err != nil {
+		return err
+	}
+	if message.Kind == storage.MessageKindSystem && message.Group == nil {
+		// Notices in a conversation are only ever recorded locally; one from
+		// a peer would pass for ours. Groups announce joins and leaves.
+		return fmt.Errorf("system messages can't be sent by peers")
+	}
+	if message.Kind != "" && message.Kind != storage.MessageKindUser && message.Kind != storage.MessageKindSystem {
+		return fmt.Errorf("unknown message kind %q", message.Kind)
+	}
+	if message.MessageID < 0 || message.Lamport < 0 || message.Seq < 0 || message.Timestamp < 0 {
+		return fmt.Errorf("negative message id, clock or timestamp")
+	}
+	if header := message.ForwardedFrom; header != nil {
+		if err := p2p.CheckTextField("forwarded_from.username", header.Username, p2p.MaxUsernameLength, true); err != nil {
+			return err
+		}
+		if err := p2p.CheckTextField("forwarded_from.full_name", header.FullName, p2p.MaxFullNameLength, false); err != nil {
+			return err
+		}
+		if header.PeerID != "" {
+			if err := p2p.CheckPeerIDField("forwarded_from.peer_id", header.PeerID); err != nil {
+				return err
+			}
+		}
+		if header.Timestamp < 0 {
+			return fmt.Errorf("negative forwarded_from.timestamp")
+		}
+	}
+	if quote := message.Quote; quote != nil {
+		if err := p2p.CheckTextField("quote.username", quote.Username, p2p.MaxUsernameLength, true); err != nil {
+			return err
+		}
+		if err := p2p.CheckTextField("quote.full_name", quote.FullName, p2p.MaxFullNameLength, false); err != nil {
+			return err
+		}
+		if quote.PeerID != "" {
+			if err := p2p.CheckPeerIDField("quote.peer_id", quote.PeerID); err != nil {
+				return err
+			}
+		}
+		if err := p2p.CheckTextField("quote.excerpt", quote.Excerpt, p2p.MaxNoteLength, false); err != nil {
+			return err
+		}
+		if utf8.RuneCountInString(quote.Excerpt) > QuoteExcerptLength+1 { // +1 for the ellipsis
+			return fmt.Errorf("quote.excerpt longer than %d characters", QuoteExcerptLength)
+		}
+		if quote.Timestamp < 0 {
+			return fmt.Errorf("negative quote.timestamp")
+		}
+	}
+	if message.Group != nil {
+		return checkGroupHeader(message.Group)
+	}
+	return nil
+}
+
+// checkGroupHeader validates the group a direct message was sent to
+func checkGroupHeader(group *GroupHeader) error {
+	if err := p2p.CheckTextField("group.id", group.ID, maxGroupIDLength, true); err != nil {
+		return err
+	}
+	if err := p2p.CheckTextField("group.name", group.Name, MaxGroupNameLength, true); err != nil {
+		return err
+	}
+	if group.MessageID <= 0 {
+		return fmt.Errorf("invalid group.message_id %d", group.MessageID)
+	}
+	if len(group.Members) == 0 || len(group.Members) > MaxGroupMembers {
+		return fmt.Errorf("group has %d members, want 1 to %d", len(group.Members), MaxGroupMembers)
+	}
+	seen := make(map[string]bool, len(group.Members))
+	for _, member := range group.Members {
+		if member == nil {
+			return fmt.Errorf("empty group member")
+		}
+		if err := p2p.CheckPeerIDField("group.members.peer_id", member.PeerID); err != nil {
+			return err
+		}
+		if err := p2p.CheckTextField("group.members.username", member.Username, p2p.MaxUsernameLength, true); err != nil {
+			return err
+		}
+		if seen[member.PeerID] {
+			return fmt.Errorf("group member %s listed twice", member.PeerID)
+		}
+		seen[member.PeerID] = true
+	}
+	return nil
+}
+
+// DecodeMessageAck parses and validates a delivery acknowledgment read from the wire
+func DecodeMessageAck(data []byte) (*MessageAck, error) {
+	var ack MessageAck
+	if err := json.Unmarshal(data, &ack); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message ack: %w", err)
+	}
+	if err := checkMessageAck(&ack); err != nil {
+		return nil, err
+	}
+	return &ack, nil
+}
+
+// checkMessageAck validates a delivery acknowledgment in either wire encoding
+func checkMessageAck(ack *MessageAck) error {
+	if err := checkReceipt(ack.MessageID, ack.FromPeer, ack.ToPeer, ack.Timestamp); err != nil {
+		return err
+	}
+	return p2p.CheckTextField("group_id", ack.GroupID, maxGroupIDLength, false)
+}
+
+// DecodeMessageRead parses and validates a read receipt read from the wire
+func DecodeMessageRead(data []byte) (*MessageRead, error) {
+	var read MessageRead
+	if err := json.Unmarshal(data, &read); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message read: %w", err)
+	}
+	if err := checkReceipt(read.MessageID, read.FromPeer, read.ToPeer, read.Timestamp); err != nil {
+		return nil, err
+	}
+	return &read, nil
+}
+
+// DecodeMessageReadBatch parses and validates a read batch read from the wire.
+// Batches listing more than MaxReadBatchSeqs messages are truncated, not rejected.
+func DecodeMessageReadBatch(data []byte) (*MessageReadBatch, error) {
+	var batch MessageReadBatch
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message read batch: %w", err)
+	}
+	if err := checkMessageReadBatch(&batch); err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// checkMessageReadBatch validates a read batch in either wire encoding
+func checkMessageReadBatch(batch *MessageReadBatch) error {
+	if err := checkReceipt(0, batch.FromPeer, batch.ToPeer, batch.Timestamp); err != nil {
+		return err
+	}
+	if len(batch.Seqs) > MaxReadBatchSeqs {
+		batch.Seqs = batch.Seqs[:MaxReadBatchSeqs]
+	}
+	for _, seq := range batch.Seqs {
+		if seq <= 0 {
+			return fmt.Errorf("invalid sequence number %d", seq)
+		}
+	}
+	return nil
+}
+
+// DecodeBackfillRequest parses and validates a backfill request read from the wire.
+// Requests for more than MaxBackfillSeqs messages are truncated, not rejected.
+func DecodeBackfillRequest(data []byte) (*BackfillRequest, error) {
+	var request BackfillRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal backfill request: %w", err)
+	}
+	if err := checkBackfillRequest(&request); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// checkBackfillRequest validates a backfill request in either wire encoding
+func checkBackfillRequest(request *BackfillRequest) error {
+	if err := p2p.CheckPeerIDField("from_peer", request.FromPeer); err != nil {
+		return err
+	}
+	if len(request.Seqs) > MaxBackfillSeqs {
+		request.Seqs = request.Seqs[:MaxBackfillSeqs]
+	}
+	for _, seq := range request.Seqs {
+		if seq <= 0 {
+			return fmt.Errorf("invalid sequence number %d", seq)
+		}
+	}
+	return nil
+}
+
+// checkReceipt validates the fields shared by acks and read receipts
+func checkReceipt(messageID int64, fromPeer, toPeer string, timestamp int64) error {
+	if messageID < 0 || timestamp < 0 {
+		return fmt.Errorf("negative message id or timestamp")
+	}
+	if err := p2p.CheckPeerIDField("from_peer", fromPeer); err != nil {
+		return err
+	}
+	return p2p.CheckPeerIDField("to_peer", toPeer)
+}
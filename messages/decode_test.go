@@ -0,0 +1,138 @@
+package messages_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/austinwklein/whisper/conformance"
+	"github.com/austinwklein/whisper/messages"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/pb"
+)
+
+// seedVectors adds the wire bytes of every published conformance vector of
+// messageType in the given encoding to a fuzz target's seed corpus
+func seedVectors(f *testing.F, messageType, encoding string) {
+	f.Helper()
+	set, err := conformance.Vectors()
+	if err != nil {
+		f.Fatalf("failed to load vectors: %v", err)
+	}
+	for _, v := range set.Vectors {
+		if v.Message != messageType {
+			continue
+		}
+		switch {
+		case encoding == conformance.EncodingJSON && (v.Encoding == "" || v.Encoding == conformance.EncodingJSON):
+			f.Add([]byte(v.Wire))
+		case encoding == conformance.EncodingProtobuf && v.Encoding == conformance.EncodingProtobuf:
+			wire, err := hex.DecodeString(v.Wire)
+			if err != nil {
+				f.Fatalf("%s: bad hex: %v", v.Name, err)
+			}
+			f.Add(wire)
+		}
+	}
+}
+
+// fuzzDecode checks that decode never panics on arbitrary bytes, and that a
+// message it accepts is accepted again after being encoded
+func fuzzDecode[T any](f *testing.F, decode func(data []byte) (T, error)) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message, err := decode(data)
+		if err != nil {
+			return
+		}
+		again, err := json.Marshal(message)
+		if err != nil {
+			t.Fatalf("failed to encode accepted message: %v", err)
+		}
+		if _, err := decode(again); err != nil {
+			t.Fatalf("accepted %q but rejected its re-encoding %s: %v", data, again, err)
+		}
+	})
+}
+
+func FuzzDecodeDirectMessage(f *testing.F) {
+	seedVectors(f, "DirectMessage", conformance.EncodingJSON)
+	f.Add([]byte(`{"from_username":"a","from_peer_id":"x","content":"` + string(bytes.Repeat([]byte("a"), 100)) + `"}`))
+	fuzzDecode(f, messages.DecodeDirectMessage)
+}
+
+func FuzzDecodeMessageAck(f *testing.F) {
+	seedVectors(f, "MessageAck", conformance.EncodingJSON)
+	fuzzDecode(f, messages.DecodeMessageAck)
+}
+
+func FuzzDecodeMessageRead(f *testing.F) {
+	seedVectors(f, "MessageRead", conformance.EncodingJSON)
+	fuzzDecode(f, messages.DecodeMessageRead)
+}
+
+func FuzzDecodeMessageReadBatch(f *testing.F) {
+	seedVectors(f, "MessageReadBatch", conformance.EncodingJSON)
+	fuzzDecode(f, messages.DecodeMessageReadBatch)
+}
+
+func FuzzDecodeBackfillRequest(f *testing.F) {
+	seedVectors(f, "BackfillRequest", conformance.EncodingJSON)
+	fuzzDecode(f, messages.DecodeBackfillRequest)
+}
+
+// FuzzDecodeDirectMessageProto reads a direct message off a 2.0.0 stream the
+// way the handler does, through the bounded length-prefixed reader
+func FuzzDecodeDirectMessageProto(f *testing.F) {
+	seedVectors(f, "DirectMessage", conformance.EncodingProtobuf)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var wire pb.DirectMessage
+		if err := p2p.ReadProtoMessage(bufio.NewReader(bytes.NewReader(data)), &wire); err != nil {
+			return
+		}
+		messages.DecodeDirectMessageProto(&wire)
+	})
+}
+
+func TestDecodeDirectMessageKinds(t *testing.T) {
+	const alice = "12D3KooWK99VoVxNE7XzyBwXEzW7xhK7Gpv85r9F3V3fyKSUKPH5"
+	group := &messages.GroupHeader{
+		ID:        "trip",
+		Name:      "trip",
+		Members:   []*messages.GroupMemberInfo{{PeerID: alice, Username: "alice"}},
+		MessageID: 1,
+	}
+
+	tests := []struct {
+		name  string
+		kind  string
+		group *messages.GroupHeader
+		valid bool
+	}{
+		{"default", "", nil, true},
+		{"user", "user", nil, true},
+		{"system", "system", nil, false},
+		{"group user", "user", group, true},
+		{"group notice", "system", group, true},
+		{"unknown", "admin", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(&messages.DirectMessage{
+				FromUsername: "alice",
+				FromPeerID:   alice,
+				Content:      "You are now friends with alice",
+				Kind:         tt.kind,
+				Group:        tt.group,
+				Timestamp:    1760000000,
+			})
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			if _, err := messages.DecodeDirectMessage(data); (err == nil) != tt.valid {
+				t.Errorf("DecodeDirectMessage error = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	msmux "github.com/multiformats/go-multistream"
+)
+
+// ErrNotSent is returned when asked for the delivery status of a message the
+// user received rather than sent
+var ErrNotSent = errors.New("only messages you sent have a delivery status")
+
+// Where a sent message stands
+const (
+	DeliveryPending   = "pending"   // Not delivered yet; still being retried
+	DeliveryDelivered = "delivered" // Reached the friend's node or mailbox
+	DeliveryRead      = "read"      // The friend read it
+	DeliveryFailed    = "failed"    // Missed its delivery deadline and was given up on
+)
+
+// DeliveryStatus is where one of the user's sent messages stands, and why
+// the tries at delivering it so far have failed
+type DeliveryStatus struct {
+	Message  *storage.Message
+	To       *storage.User
+	State    string                     // Delivery*
+	Attempts []*storage.DeliveryAttempt // Failed tries, oldest first; cleared once delivered
+}
+
+// LastFailure returns the most recent failed try, or nil if there was none
+func (s *DeliveryStatus) LastFailure() *storage.DeliveryAttempt {
+	if len(s.Attempts) == 0 {
+		return nil
+	}
+	return s.Attempts[len(s.Attempts)-1]
+}
+
+// GetDeliveryStatus returns where a message the user sent stands
+func (m *Manager) GetDeliveryStatus(ctx context.Context, currentUser *storage.User, messageID int64) (*DeliveryStatus, error) {
+	msg, err := m.storage.GetMessage(ctx, currentUser.ID, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load message: %w", err)
+	}
+	if msg == nil {
+		return nil, storage.ErrMessageNotFound
+	}
+	if msg.FromUserID != currentUser.ID {
+		return nil, ErrNotSent
+	}
+	toUser, err := m.storage.GetUserByID(ctx, msg.ToUserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up recipient: %w", err)
+	}
+	attempts, err := m.storage.GetDeliveryAttempts(ctx, msg.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get delivery attempts: %w", err)
+	}
+
+	status := &DeliveryStatus{Message: msg, To: toUser, State: DeliveryPending, Attempts: attempts}
+	switch {
+	case msg.Read:
+		status.State = DeliveryRead
+	case msg.Delivered:
+		status.State = DeliveryDelivered
+	case msg.Failed:
+		status.State = DeliveryFailed
+	}
+	return status, nil
+}
+
+// DeliveryHint explains a delivery failure reason to the user, for a message
+// to username, with what they can do about it
+func DeliveryHint(reason, username string) string {
+	switch reason {
+	case storage.DeliveryUnreachable:
+		return i18n.Sprintf("%s is offline or can't be reached", username)
+	case storage.DeliveryUnsupported:
+		return i18n.Sprintf("%s is on an old version of Whisper that can't receive it - ask them to update", username)
+	case storage.DeliveryReset:
+		return i18n.Sprintf("the connection to %s dropped while sending", username)
+	case storage.DeliveryTimeout:
+		return i18n.Sprintf("%s didn't answer in time", username)
+	}
+	return i18n.T("it couldn't be sent")
+}
+
+// deliveryReason classifies an error from opening a stream or sending a
+// message as one of the storage.Delivery* reasons
+func deliveryReason(err error) string {
+	var notSupported msmux.ErrNotSupported[protocol.ID]
+	var netErr net.Error
+	switch {
+	case errors.As(err, &notSupported):
+		return storage.DeliveryUnsupported
+	case errors.Is(err, network.ErrReset):
+		return storage.DeliveryReset
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return storage.DeliveryTimeout
+	case errors.Is(err, network.ErrNoConn), errors.Is(err, network.ErrNoRemoteAddrs),
+		errors.Is(err, swarm.ErrDialBackoff), errors.Is(err, swarm.ErrNoAddresses):
+		return storage.DeliveryUnreachable
+	}
+	var dialErr *swarm.DialError
+	if errors.As(err, &dialErr) {
+		return storage.DeliveryUnreachable
+	}
+	return storage.DeliveryError
+}
+
+// recordFailure stores why a try at delivering a message failed and returns
+// the reason; err may be nil when there was nothing to try
+func (m *Manager) recordFailure(ctx context.Context, msg *storage.Message, reason string, err error) string {
+	attempt := &storage.DeliveryAttempt{MessageID: msg.ID, Reason: reason}
+	if err != nil {
+		attempt.Detail = err.Error()
+	}
+	if err := m.storage.RecordDeliveryAttempt(ctx, attempt); err != nil {
+		i18n.Printf("Warning: Failed to record delivery attempt: %v\n", err)
+	}
+	return reason
+}
@@ -0,0 +1,70 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/austinwklein/whisper/storage"
+)
+
+// ErrForwardSystem is returned when asked to forward a local system message
+var ErrForwardSystem = errors.New("system messages can't be forwarded")
+
+// ForwardMessage re-sends one of the user's messages to another friend, attributed
+// to whoever wrote it. Forwarding a forward keeps the original author.
+func (m *Manager) ForwardMessage(ctx context.Context, currentUser *storage.User, messageID int64, toUsername string) error {
+	msg, err := m.storage.GetMessage(ctx, currentUser.ID, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to load message: %w", err)
+	}
+	if msg == nil {
+		return storage.ErrMessageNotFound
+	}
+	if msg.IsSystem() {
+		return ErrForwardSystem
+	}
+
+	forwarded := msg.Forwarded
+	if forwarded == nil {
+		author, err := m.storage.GetUserByID(ctx, msg.FromUserID)
+		if err != nil {
+			return fmt.Errorf("failed to look up the message's author")
+		}
+		forwarded = &storage.ForwardInfo{
+			Username: author.RemoteName(),
+			FullName: author.FullName,
+			PeerID:   author.PeerID,
+			SentAt:   msg.CreatedAt,
+		}
+	}
+
+	return m.send(ctx, currentUser, toUsername, msg.Content, forwarded, nil, m.ttl())
+}
+
+// forwardHeader converts stored forward attribution to its wire form
+func forwardHeader(info *storage.ForwardInfo) *ForwardHeader {
+	if info == nil {
+		return nil
+	}
+	return &ForwardHeader{
+		Username:  info.Username,
+		FullName:  info.FullName,
+		PeerID:    info.PeerID,
+		Timestamp: info.SentAt.Unix(),
+	}
+}
+
+// forwardInfo converts a received forward header to its stored form
+func forwardInfo(header *ForwardHeader) *storage.ForwardInfo {
+	if header == nil {
+		return nil
+	}
+	return &storage.ForwardInfo{
+		Username: header.Username,
+		FullName: header.FullName,
+		PeerID:   header.PeerID,
+		SentAt:   time.Unix(header.Timestamp, 0),
+	}
+}
@@ -0,0 +1,532 @@
+package messages
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Group limits. A group's messages go to every member separately, so groups
+// are kept small; conferences suit anything larger.
+const (
+	MinGroupMembers    = 3  // Including the user
+	MaxGroupMembers    = 8  // Including the user
+	MaxGroupNameLength = 64 // Bytes
+
+	// maxGroupIDLength bounds the shared group ID on the wire
+	maxGroupIDLength = 64
+)
+
+// ErrGroupNotFound is returned for a group the user isn't in
+var ErrGroupNotFound = errors.New("group not found - see 'groups'")
+
+// ErrGroupLeft is returned when writing to or leaving a group the user left
+var ErrGroupLeft = errors.New("you left this group")
+
+// GroupDeliveryStatus is how far one of the user's group messages got with
+// each member
+type GroupDeliveryStatus struct {
+	Message    *storage.GroupMessage
+	Group      *storage.Group
+	Deliveries []*storage.GroupDelivery
+}
+
+// CreateGroup starts a group with the named friends and tells each of them.
+// A group has MinGroupMembers to MaxGroupMembers people, the user included.
+func (m *Manager) CreateGroup(ctx context.Context, currentUser *storage.User, name string, usernames []string) (*storage.Group, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > MaxGroupNameLength {
+		return nil, fmt.Errorf("group name must be 1 to %d characters", MaxGroupNameLength)
+	}
+
+	group := &storage.Group{UserID: currentUser.ID, Name: name}
+	seen := map[string]bool{currentUser.PeerID: true}
+	for _, username := range usernames {
+		contact, err := m.storage.GetUserByUsername(ctx, username)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, fmt.Errorf("user '%s' not found", username)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up user: %w", err)
+		}
+		if !contact.IsRemote() {
+			return nil, fmt.Errorf("%s is an account on this node", username)
+		}
+		if err := m.checkCanMessage(ctx, currentUser, contact); err != nil {
+			return nil, fmt.Errorf("%s: %w", username, err)
+		}
+		if seen[contact.PeerID] {
+			continue
+		}
+		seen[contact.PeerID] = true
+		group.Members = append(group.Members, &storage.GroupMember{PeerID: contact.PeerID, Username: contact.RemoteName()})
+	}
+	if n := len(group.Members) + 1; n < MinGroupMembers || n > MaxGroupMembers {
+		return nil, fmt.Errorf("a group needs %d to %d people including you, not %d", MinGroupMembers, MaxGroupMembers, n)
+	}
+
+	uid := make([]byte, 16)
+	if _, err := rand.Read(uid); err != nil {
+		return nil, fmt.Errorf("failed to generate group ID: %w", err)
+	}
+	group.UID = hex.EncodeToString(uid)
+	if err := m.storage.CreateGroup(ctx, group); err != nil {
+		return nil, fmt.Errorf("failed to create group: %w", err)
+	}
+
+	// The first message is what tells the others about the group
+	if _, err := m.sendGroup(ctx, currentUser, group, fmt.Sprintf("%s created the group", currentUser.FullName), storage.MessageKindSystem, false); err != nil {
+		return group, err
+	}
+	return group, nil
+}
+
+// SendGroupMessage sends a message to everyone else in one of the user's groups
+func (m *Manager) SendGroupMessage(ctx context.Context, currentUser *storage.User, groupID int64, content string) error {
+	// Members would drop an oversized message on arrival
+	if len(content) > p2p.MaxContentLength {
+		return p2p.ErrContentTooLong
+	}
+	group, err := m.GetGroup(ctx, currentUser, groupID)
+	if err != nil {
+		return err
+	}
+	if !group.LeftAt.IsZero() {
+		return ErrGroupLeft
+	}
+	if len(group.Members) == 0 {
+		return fmt.Errorf("everyone else has left %s", group.Name)
+	}
+	_, err = m.sendGroup(ctx, currentUser, group, content, storage.MessageKindUser, false)
+	return err
+}
+
+// LeaveGroup tells the other members the user is leaving a group and stops
+// taking its messages. The group's history is kept.
+func (m *Manager) LeaveGroup(ctx context.Context, currentUser *storage.User, groupID int64) (*storage.Group, error) {
+	group, err := m.GetGroup(ctx, currentUser, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if !group.LeftAt.IsZero() {
+		return nil, ErrGroupLeft
+	}
+	if len(group.Members) > 0 {
+		if _, err := m.sendGroup(ctx, currentUser, group, fmt.Sprintf("%s left the group", currentUser.FullName), storage.MessageKindSystem, true); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.storage.LeaveGroup(ctx, group.ID); err != nil {
+		return nil, fmt.Errorf("failed to leave group: %w", err)
+	}
+	return group, nil
+}
+
+// GetGroup returns one of the user's groups, or ErrGroupNotFound
+func (m *Manager) GetGroup(ctx context.Context, currentUser *storage.User, groupID int64) (*storage.Group, error) {
+	group, err := m.storage.GetGroup(ctx, currentUser.ID, groupID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrGroupNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load group: %w", err)
+	}
+	return group, nil
+}
+
+// GetGroups returns the user's groups, most recently active first
+func (m *Manager) GetGroups(ctx context.Context, currentUserID int64) ([]*storage.Group, error) {
+	return m.storage.GetGroups(ctx, currentUserID)
+}
+
+// GetGroupHistory returns the latest messages in one of the user's groups
+func (m *Manager) GetGroupHistory(ctx context.Context, currentUser *storage.User, groupID int64, limit int) (*storage.Group, []*storage.GroupMessage, error) {
+	group, err := m.GetGroup(ctx, currentUser, groupID)
+	if err != nil {
+		return nil, nil, err
+	}
+	messages, err := m.storage.GetGroupMessages(ctx, group.ID, limit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get group messages: %w", err)
+	}
+	return group, messages, nil
+}
+
+// GetGroupDeliveryStatus returns how far a group message the user sent got
+// with each member
+func (m *Manager) GetGroupDeliveryStatus(ctx context.Context, currentUser *storage.User, messageID int64) (*GroupDeliveryStatus, error) {
+	msg, err := m.storage.GetGroupMessage(ctx, currentUser.ID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if !msg.Outgoing {
+		return nil, ErrNotSent
+	}
+	group, err := m.GetGroup(ctx, currentUser, msg.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	deliveries, err := m.storage.GetGroupDeliveries(ctx, msg.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get group deliveries: %w", err)
+	}
+	return &GroupDeliveryStatus{Message: msg, Group: group, Deliveries: deliveries}, nil
+}
+
+// MemberName returns what the user calls a group member: their contact
+// handle if they are a contact, otherwise the name they go by
+func (m *Manager) MemberName(ctx context.Context, peerID, username string) string {
+	if contact, err := m.storage.GetUserByPeerID(ctx, peerID); err == nil && contact.IsRemote() {
+		return contact.Username
+	}
+	return username
+}
+
+// sendGroup stores a group message and sends a copy to every member at once,
+// reporting who it didn't reach. leaving marks the message announcing the user
+// left.
+func (m *Manager) sendGroup(ctx context.Context, currentUser *storage.User, group *storage.Group, content, kind string, leaving bool) (*storage.GroupMessage, error) {
+	msg := &storage.GroupMessage{
+		GroupID:      group.ID,
+		FromPeerID:   currentUser.PeerID,
+		FromUsername: currentUser.Username,
+		Outgoing:     true,
+		Content:      content,
+		Kind:         kind,
+		Leaving:      leaving,
+		CreatedAt:    time.Now(),
+	}
+	if err := m.storage.SaveGroupMessage(ctx, msg, group.Members); err != nil {
+		return nil, fmt.Errorf("failed to save message: %w", err)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failures := make(map[string]string)
+	for _, member := range group.Members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reason := m.deliverToMember(ctx, currentUser, group, msg, member); reason != "" {
+				mu.Lock()
+				failures[member.PeerID] = reason
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(failures) == 0 {
+		i18n.Printf("✓ Message sent to %s (%d members)\n", group.Name, len(group.Members))
+		return msg, nil
+	}
+	i18n.Printf("✓ Message #%d sent to %d of %d members of %s, will retry the rest - 'group-status %d'\n", msg.ID, len(group.Members)-len(failures), len(group.Members), group.Name, msg.ID)
+	for _, member := range group.Members {
+		if reason, ok := failures[member.PeerID]; ok {
+			i18n.Printf("   %s\n", DeliveryHint(reason, m.MemberName(ctx, member.PeerID, member.Username)))
+		}
+	}
+	return msg, nil
+}
+
+// deliverToMember sends one member their copy of a group message over a
+// direct message stream. It returns why that failed, or "" once delivered.
+func (m *Manager) deliverToMember(ctx context.Context, currentUser *storage.User, group *storage.Group, msg *storage.GroupMessage, member *storage.GroupMember) string {
+	pid, err := peer.Decode(member.PeerID)
+	if err != nil {
+		return m.recordGroupFailure(ctx, msg, member, storage.DeliveryError)
+	}
+
+	// Members who are friends can be dialed the way a direct message would be
+	if m.host.Network().Connectedness(pid) != network.Connected && m.dialHandler != nil {
+		if contact, err := m.storage.GetUserByPeerID(ctx, member.PeerID); err == nil && contact.IsRemote() {
+			m.dialHandler(ctx, contact)
+		}
+	}
+	if m.host.Network().Connectedness(pid) != network.Connected {
+		return m.recordGroupFailure(ctx, msg, member, storage.DeliveryUnreachable)
+	}
+	// An older node would take the copy for a direct message
+	if !p2p.PeerSupports(m.host, pid, p2p.CapabilityGroups) {
+		return m.recordGroupFailure(ctx, msg, member, storage.DeliveryUnsupported)
+	}
+
+	stream, err := m.host.NewStream(ctx, pid, ProtocolDirectMessageV2, ProtocolDirectMessage)
+	if err == nil {
+		err = SendDirectMessage(ctx, stream, m.groupCopy(currentUser, group, msg, member, pid))
+	}
+	if err != nil {
+		return m.recordGroupFailure(ctx, msg, member, deliveryReason(err))
+	}
+	if _, err := m.storage.MarkGroupDelivered(ctx, currentUser.ID, msg.ID, member.PeerID); err != nil {
+		i18n.Printf("Warning: Failed to mark message as delivered: %v\n", err)
+	}
+	return ""
+}
+
+// recordGroupFailure stores why a try at delivering a group message to a
+// member failed and returns the reason
+func (m *Manager) recordGroupFailure(ctx context.Context, msg *storage.GroupMessage, member *storage.GroupMember, reason string) string {
+	if err := m.storage.RecordGroupDeliveryFailure(ctx, msg.ID, member.PeerID, reason); err != nil {
+		i18n.Printf("Warning: Failed to record delivery attempt: %v\n", err)
+	}
+	return reason
+}
+
+// groupCopy builds the direct message carrying a group message to one member
+func (m *Manager) groupCopy(currentUser *storage.User, group *storage.Group, msg *storage.GroupMessage, to *storage.GroupMember, pid peer.ID) *DirectMessage {
+	header := &GroupHeader{
+		ID:        group.UID,
+		Name:      group.Name,
+		Members:   []*GroupMemberInfo{{PeerID: currentUser.PeerID, Username: currentUser.Username}},
+		MessageID: msg.ID,
+		Left:      msg.Leaving,
+	}
+	for _, member := range group.Members {
+		header.Members = append(header.Members, &GroupMemberInfo{PeerID: member.PeerID, Username: member.Username})
+	}
+
+	message := &DirectMessage{
+		FromUsername: currentUser.Username,
+		FromFullName: currentUser.FullName,
+		FromPeerID:   currentUser.PeerID,
+		ToUsername:   to.Username,
+		Content:      msg.Content,
+		Kind:         msg.Kind,
+		Timestamp:    msg.CreatedAt.Unix(),
+		Group:        header,
+	}
+	if p2p.PeerSupports(m.host, pid, p2p.CapabilityZstd) {
+		message.compress()
+	}
+	return message
+}
+
+// receiveGroupMessage stores and acknowledges one member's copy of a group
+// message. A friend can add the user to a new group; anyone else's messages
+// are only taken for groups they are already in.
+func (m *Manager) receiveGroupMessage(ctx context.Context, message *DirectMessage, fromPeer peer.ID, mode receiveMode) {
+	header := message.Group
+	toUser, err := m.localRecipient(ctx, message.ToUsername)
+	if err != nil || toUser.IsRemote() {
+		return
+	}
+
+	// Both the sender and this node must be in the group the sender describes
+	var sender *GroupMemberInfo
+	included := false
+	for _, member := range header.Members {
+		switch member.PeerID {
+		case fromPeer.String():
+			sender = member
+		case m.host.ID().String():
+			included = true
+		}
+	}
+	if sender == nil || !included {
+		return
+	}
+
+	group, err := m.storage.GetGroupByUID(ctx, toUser.ID, header.ID)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		if header.Left {
+			m.sendGroupAck(ctx, header, fromPeer, toUser, mode)
+			return
+		}
+		joined := m.joinGroup(ctx, toUser, header, fromPeer)
+		if joined == nil {
+			return
+		}
+		group = joined
+	case err != nil:
+		i18n.Printf("Warning: Failed to look up group: %v\n", err)
+		return
+	case !group.LeftAt.IsZero():
+		// Still ack, so the sender stops retrying
+		m.sendGroupAck(ctx, header, fromPeer, toUser, mode)
+		return
+	case groupMember(group, fromPeer.String()) == nil:
+		return
+	}
+
+	// Drop duplicates (retries can resend a message) but still ack
+	exists, err := m.storage.HasGroupMessage(ctx, group.ID, fromPeer.String(), header.MessageID)
+	if err != nil {
+		i18n.Printf("Warning: Failed to check for duplicate message: %v\n", err)
+	} else if exists {
+		m.sendGroupAck(ctx, header, fromPeer, toUser, mode)
+		return
+	}
+
+	// Save message, with the sender's timestamp turned into local time
+	receivedAt := time.Now()
+	name := m.MemberName(ctx, fromPeer.String(), sender.Username)
+	msg := &storage.GroupMessage{
+		GroupID:      group.ID,
+		FromPeerID:   fromPeer.String(),
+		FromUsername: name,
+		RemoteID:     header.MessageID,
+		Content:      message.Content,
+		Kind:         storage.NormalizeKind(message.Kind),
+		Leaving:      header.Left,
+		CreatedAt:    p2p.NormalizeTimestamp(m.host, fromPeer, message.Timestamp, receivedAt),
+		ReceivedAt:   receivedAt,
+	}
+	if err := m.storage.SaveGroupMessage(ctx, msg, nil); err != nil {
+		i18n.Printf("Error saving message: %v\n", err)
+		return
+	}
+
+	if header.Left {
+		members := []*storage.GroupMember{}
+		for _, member := range group.Members {
+			if member.PeerID != fromPeer.String() {
+				members = append(members, member)
+			}
+		}
+		if err := m.storage.SetGroupMembers(ctx, group.ID, members); err != nil {
+			i18n.Printf("Warning: Failed to update group members: %v\n", err)
+		}
+	}
+
+	m.sendGroupAck(ctx, header, fromPeer, toUser, mode)
+
+	if m.isLocked() {
+		i18n.Printf("\n🔒 New message - unlock to read it\n> ")
+		return
+	}
+	if msg.IsSystem() {
+		i18n.Printf("\n*** [%s] %s ***\n> ", group.Name, message.Content)
+		return
+	}
+	i18n.Printf("\n👥 [%s] %s: %s\n> ", group.Name, name, message.Content)
+}
+
+// joinGroup stores a group the user was just added to, if the friend who
+// added them is trusted. It returns nil if the group was refused.
+func (m *Manager) joinGroup(ctx context.Context, toUser *storage.User, header *GroupHeader, fromPeer peer.ID) *storage.Group {
+	contact, err := m.storage.GetUserByPeerID(ctx, fromPeer.String())
+	if err != nil || !contact.IsRemote() || m.checkCanMessage(ctx, toUser, contact) != nil {
+		return nil
+	}
+
+	group := &storage.Group{UserID: toUser.ID, UID: header.ID, Name: header.Name}
+	for _, member := range header.Members {
+		if member.PeerID != m.host.ID().String() {
+			group.Members = append(group.Members, &storage.GroupMember{PeerID: member.PeerID, Username: member.Username})
+		}
+	}
+	if err := m.storage.CreateGroup(ctx, group); err != nil {
+		i18n.Printf("Warning: Failed to save group: %v\n", err)
+		return nil
+	}
+	i18n.Printf("\n👥 %s added you to the group %s (%d people) - 'group-msg %d <message>' to write to it\n> ", contact.Username, group.Name, len(group.Members)+1, group.ID)
+	return group
+}
+
+// groupMember returns the member of a group with a peer ID, or nil
+func groupMember(group *storage.Group, peerID string) *storage.GroupMember {
+	for _, member := range group.Members {
+		if member.PeerID == peerID {
+			return member
+		}
+	}
+	return nil
+}
+
+// sendGroupAck acknowledges a member's group message, unless it came from
+// the mailbox
+func (m *Manager) sendGroupAck(ctx context.Context, header *GroupHeader, fromPeer peer.ID, toUser *storage.User, mode receiveMode) {
+	if mode == receiveDeposited {
+		return
+	}
+	stream, err := m.host.NewStream(ctx, fromPeer, ProtocolMessageAckV2, ProtocolMessageAck)
+	if err != nil {
+		i18n.Printf("Warning: Failed to send message ack: %v\n", err)
+		return
+	}
+
+	ack := &MessageAck{
+		MessageID: header.MessageID,
+		FromPeer:  toUser.PeerID,
+		ToPeer:    fromPeer.String(),
+		Timestamp: time.Now().Unix(),
+		GroupID:   header.ID,
+	}
+	if err := SendMessageAck(ctx, stream, ack); err != nil {
+		i18n.Printf("Warning: Failed to send ack: %v\n", err)
+	}
+}
+
+// handleGroupAck marks a group message delivered to the member who
+// acknowledged it
+func (m *Manager) handleGroupAck(ctx context.Context, ack *MessageAck, fromPeer peer.ID) {
+	if m.currentUserID == 0 || ack.MessageID <= 0 {
+		return
+	}
+	if _, err := m.storage.MarkGroupDelivered(ctx, m.currentUserID, ack.MessageID, fromPeer.String()); err != nil {
+		i18n.Printf("Warning: Failed to mark message as delivered: %v\n", err)
+	}
+}
+
+// retryGroupDeliveries sends undelivered group messages to the members now
+// online who haven't had them
+func (m *Manager) retryGroupDeliveries(ctx context.Context, currentUserID int64) error {
+	pending, err := m.storage.GetPendingGroupDeliveries(ctx, currentUserID)
+	if err != nil {
+		return fmt.Errorf("failed to get undelivered group messages: %w", err)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	currentUser, err := m.storage.GetUserByID(ctx, currentUserID)
+	if err != nil {
+		return fmt.Errorf("failed to look up user: %w", err)
+	}
+
+	groups := make(map[int64]*storage.Group)
+	messages := make(map[int64]*storage.GroupMessage)
+	for _, delivery := range pending {
+		pid, err := peer.Decode(delivery.PeerID)
+		if err != nil || m.host.Network().Connectedness(pid) != network.Connected {
+			continue
+		}
+
+		group, ok := groups[delivery.GroupID]
+		if !ok {
+			if group, err = m.storage.GetGroup(ctx, currentUserID, delivery.GroupID); err != nil {
+				continue
+			}
+			groups[delivery.GroupID] = group
+		}
+		// Members who have since left aren't sent anything more
+		member := groupMember(group, delivery.PeerID)
+		if member == nil {
+			continue
+		}
+		msg, ok := messages[delivery.MessageID]
+		if !ok {
+			if msg, err = m.storage.GetGroupMessage(ctx, currentUserID, delivery.MessageID); err != nil {
+				continue
+			}
+			messages[delivery.MessageID] = msg
+		}
+
+		if m.deliverToMember(ctx, currentUser, group, msg, member) == "" {
+			i18n.Printf("✓ Delivered group message to %s in %s\n", m.MemberName(ctx, member.PeerID, member.Username), group.Name)
+		}
+	}
+	return nil
+}
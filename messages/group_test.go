@@ -0,0 +1,270 @@
+package messages_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/austinwklein/whisper/messages"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/austinwklein/whisper/testkit"
+)
+
+// groupSeed fixes the simulated network the group tests run on
+const groupSeed = 1239
+
+// newGroupNetwork starts alice, bob and carol as friends of each other, with
+// alice's group "trip" holding all three
+func newGroupNetwork(t *testing.T) (*testkit.Network, *testkit.Node, *testkit.Node, *testkit.Node, *storage.Group) {
+	t.Helper()
+	net := testkit.NewSimNetwork(t, 3, groupSeed)
+	alice, bob, carol := net.Nodes[0], net.Nodes[1], net.Nodes[2]
+	net.ConnectAll()
+	net.MakeFriends(alice, bob)
+	net.MakeFriends(alice, carol)
+	net.MakeFriends(bob, carol)
+
+	// Groups only go to peers that said they take them
+	for _, a := range net.Nodes {
+		for _, b := range net.Nodes {
+			if a != b {
+				net.Eventually(func() bool {
+					return p2p.PeerSupports(a.Host.Host(), b.Host.PeerID(), p2p.CapabilityGroups)
+				}, "%s learns %s's capabilities", a.Name, b.Name)
+			}
+		}
+	}
+
+	group, err := alice.Messages.CreateGroup(net.Context(), alice.User, "trip", []string{bob.Name, carol.Name})
+	if err != nil {
+		t.Fatalf("create group: %v", err)
+	}
+	for _, member := range []*testkit.Node{bob, carol} {
+		net.Eventually(func() bool { return memberGroup(member, group) != nil }, "%s is added to the group", member.Name)
+	}
+	return net, alice, bob, carol, group
+}
+
+// memberGroup returns a node's copy of a group, or nil if it has none
+func memberGroup(n *testkit.Node, group *storage.Group) *storage.Group {
+	groups, err := n.Messages.GetGroups(context.Background(), n.User.ID)
+	if err != nil {
+		return nil
+	}
+	for _, g := range groups {
+		if g.UID == group.UID {
+			return g
+		}
+	}
+	return nil
+}
+
+// hasGroupMessage reports whether a node has stored a group message with the given content
+func hasGroupMessage(n *testkit.Node, group *storage.Group, content string) bool {
+	g := memberGroup(n, group)
+	if g == nil {
+		return false
+	}
+	_, history, err := n.Messages.GetGroupHistory(context.Background(), n.User, g.ID, 100)
+	if err != nil {
+		return false
+	}
+	for _, msg := range history {
+		if msg.Content == content {
+			return true
+		}
+	}
+	return false
+}
+
+// lastSent returns the latest group message a node sent to a group
+func lastSent(t *testing.T, n *testkit.Node, group *storage.Group) *storage.GroupMessage {
+	t.Helper()
+	_, history, err := n.Messages.GetGroupHistory(context.Background(), n.User, group.ID, 100)
+	if err != nil {
+		t.Fatalf("group history: %v", err)
+	}
+	var last *storage.GroupMessage
+	for _, msg := range history {
+		if msg.Outgoing && (last == nil || msg.ID > last.ID) {
+			last = msg
+		}
+	}
+	if last == nil {
+		t.Fatalf("%s has sent nothing to %s", n.Name, group.Name)
+	}
+	return last
+}
+
+// deliveries returns whether each member has a group message, by peer ID
+func deliveries(t *testing.T, n *testkit.Node, msg *storage.GroupMessage) map[string]bool {
+	t.Helper()
+	status, err := n.Messages.GetGroupDeliveryStatus(context.Background(), n.User, msg.ID)
+	if err != nil {
+		t.Fatalf("delivery status: %v", err)
+	}
+	delivered := make(map[string]bool)
+	for _, d := range status.Deliveries {
+		delivered[d.PeerID] = d.Delivered
+	}
+	return delivered
+}
+
+func TestGroupMessageFansOutToEveryMember(t *testing.T) {
+	net, alice, bob, carol, group := newGroupNetwork(t)
+
+	if err := alice.Messages.SendGroupMessage(net.Context(), alice.User, group.ID, "train at nine"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	for _, member := range []*testkit.Node{bob, carol} {
+		net.Eventually(func() bool { return hasGroupMessage(member, group, "train at nine") }, "%s receives the message", member.Name)
+	}
+	msg := lastSent(t, alice, group)
+	if got := len(deliveries(t, alice, msg)); got != 2 {
+		t.Fatalf("%d deliveries recorded, want one per member", got)
+	}
+	for _, member := range []*testkit.Node{bob, carol} {
+		net.Eventually(func() bool { return deliveries(t, alice, msg)[member.Host.PeerID().String()] }, "%s's copy marked delivered", member.Name)
+	}
+
+	// Members reply to everyone, not only the creator
+	bobsGroup := memberGroup(bob, group)
+	if err := bob.Messages.SendGroupMessage(net.Context(), bob.User, bobsGroup.ID, "see you there"); err != nil {
+		t.Fatalf("bob send: %v", err)
+	}
+	for _, member := range []*testkit.Node{alice, carol} {
+		net.Eventually(func() bool { return hasGroupMessage(member, group, "see you there") }, "%s receives bob's reply", member.Name)
+	}
+}
+
+func TestGroupMessageRetriesMembersItMissed(t *testing.T) {
+	net, alice, bob, carol, group := newGroupNetwork(t)
+	ctx := net.Context()
+
+	net.Disconnect(alice, carol)
+	if err := alice.Messages.SendGroupMessage(ctx, alice.User, group.ID, "platform 4"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	net.Eventually(func() bool { return hasGroupMessage(bob, group, "platform 4") }, "bob receives the message")
+
+	msg := lastSent(t, alice, group)
+	status, err := alice.Messages.GetGroupDeliveryStatus(ctx, alice.User, msg.ID)
+	if err != nil {
+		t.Fatalf("delivery status: %v", err)
+	}
+	var missed *storage.GroupDelivery
+	for _, d := range status.Deliveries {
+		if d.PeerID == carol.Host.PeerID().String() {
+			missed = d
+		}
+	}
+	if missed == nil {
+		t.Fatal("no delivery recorded for carol")
+	}
+	if missed.Delivered || missed.Attempts != 1 || missed.Reason != storage.DeliveryUnreachable {
+		t.Fatalf("carol's delivery = delivered %v, %d attempts, reason %q; want one unreachable attempt", missed.Delivered, missed.Attempts, missed.Reason)
+	}
+	if hasGroupMessage(carol, group, "platform 4") {
+		t.Fatal("carol received a message while disconnected")
+	}
+
+	net.Reconnect(alice, carol)
+	net.Eventually(func() bool {
+		return p2p.PeerSupports(alice.Host.Host(), carol.Host.PeerID(), p2p.CapabilityGroups)
+	}, "alice learns carol's capabilities again")
+	if err := alice.Messages.RetryUndeliveredMessages(ctx, alice.User.ID); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	net.Eventually(func() bool { return hasGroupMessage(carol, group, "platform 4") }, "carol receives the retried message")
+	net.Eventually(func() bool { return deliveries(t, alice, msg)[carol.Host.PeerID().String()] }, "carol's copy marked delivered")
+
+	// Bob already had it, so the retry didn't send it twice
+	_, history, err := bob.Messages.GetGroupHistory(ctx, bob.User, memberGroup(bob, group).ID, 100)
+	if err != nil {
+		t.Fatalf("bob's history: %v", err)
+	}
+	copies := 0
+	for _, m := range history {
+		if m.Content == "platform 4" {
+			copies++
+		}
+	}
+	if copies != 1 {
+		t.Errorf("bob stored %d copies, want 1", copies)
+	}
+}
+
+func TestGroupMemberLeaving(t *testing.T) {
+	net, alice, bob, carol, group := newGroupNetwork(t)
+	ctx := net.Context()
+
+	carolsGroup := memberGroup(carol, group)
+	if _, err := carol.Messages.LeaveGroup(ctx, carol.User, carolsGroup.ID); err != nil {
+		t.Fatalf("leave: %v", err)
+	}
+	for _, member := range []*testkit.Node{alice, bob} {
+		net.Eventually(func() bool {
+			g := memberGroup(member, group)
+			return g != nil && len(g.Members) == 1
+		}, "%s drops carol from the group", member.Name)
+	}
+
+	// Later messages only go to who is left
+	if err := alice.Messages.SendGroupMessage(ctx, alice.User, group.ID, "just us now"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	net.Eventually(func() bool { return hasGroupMessage(bob, group, "just us now") }, "bob receives the message")
+	delivered := deliveries(t, alice, lastSent(t, alice, group))
+	if _, ok := delivered[carol.Host.PeerID().String()]; ok || len(delivered) != 1 {
+		t.Errorf("deliveries %v, want bob's only", delivered)
+	}
+	if hasGroupMessage(carol, group, "just us now") {
+		t.Error("carol received a message after leaving")
+	}
+
+	if err := carol.Messages.SendGroupMessage(ctx, carol.User, carolsGroup.ID, "wait for me"); !errors.Is(err, messages.ErrGroupLeft) {
+		t.Errorf("sending after leaving = %v, want ErrGroupLeft", err)
+	}
+	if _, err := carol.Messages.LeaveGroup(ctx, carol.User, carolsGroup.ID); !errors.Is(err, messages.ErrGroupLeft) {
+		t.Errorf("leaving twice = %v, want ErrGroupLeft", err)
+	}
+}
+
+func TestCreateGroupChecksMembers(t *testing.T) {
+	net := testkit.NewSimNetwork(t, 3, groupSeed)
+	alice, bob, carol := net.Nodes[0], net.Nodes[1], net.Nodes[2]
+	net.ConnectAll()
+	net.MakeFriends(alice, bob)
+	ctx := net.Context()
+
+	// Carol is a known contact but not a friend
+	contact := &storage.User{Username: carol.Name, PasswordHash: storage.RemoteUserPasswordHash, PeerID: carol.Host.PeerID().String()}
+	if err := alice.Storage.CreateUser(ctx, contact); err != nil {
+		t.Fatalf("failed to add carol: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		usernames []string
+	}{
+		{"too few people", []string{bob.Name}},
+		{"duplicates count once", []string{bob.Name, bob.Name}},
+		{"unknown user", []string{bob.Name, "nobody"}},
+		{"not a friend", []string{bob.Name, carol.Name}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := alice.Messages.CreateGroup(ctx, alice.User, "trip", tt.usernames); err == nil {
+				t.Fatal("CreateGroup succeeded")
+			}
+		})
+	}
+	groups, err := alice.Messages.GetGroups(ctx, alice.User.ID)
+	if err != nil {
+		t.Fatalf("groups: %v", err)
+	}
+	if len(groups) != 0 {
+		t.Errorf("%d groups created, want none", len(groups))
+	}
+}
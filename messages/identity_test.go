@@ -0,0 +1,36 @@
+package messages_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/austinwklein/whisper/messages"
+	"github.com/austinwklein/whisper/testkit"
+)
+
+func TestSendRefusedWhileIdentityPending(t *testing.T) {
+	net := testkit.NewSimNetwork(t, 2, 1130)
+	alice, bob := net.Nodes[0], net.Nodes[1]
+	net.ConnectAll()
+	net.MakeFriends(alice, bob)
+	ctx := net.Context()
+
+	// Another peer claims to be bob; alice hasn't trusted it yet
+	contact, err := alice.Storage.GetUserByUsername(ctx, bob.Name)
+	if err != nil {
+		t.Fatalf("get bob: %v", err)
+	}
+	if _, err := alice.Storage.SetIdentityCandidate(ctx, contact.ID, "12D3KooWImpostor"); err != nil {
+		t.Fatalf("set candidate: %v", err)
+	}
+	if err := alice.Messages.SendMessage(ctx, alice.User, bob.Name, "still you?"); !errors.Is(err, messages.ErrIdentityChanged) {
+		t.Fatalf("send with pending identity: got %v, want ErrIdentityChanged", err)
+	}
+
+	if err := alice.Storage.ClearIdentityCandidate(ctx, contact.ID); err != nil {
+		t.Fatalf("clear candidate: %v", err)
+	}
+	if err := alice.Messages.SendMessage(ctx, alice.User, bob.Name, "still you?"); err != nil {
+		t.Fatalf("send after clearing: %v", err)
+	}
+}
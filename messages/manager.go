@@ -2,20 +2,45 @@ package messages
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sync/atomic"
 	"time"
 
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
 	"github.com/austinwklein/whisper/storage"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
+// ErrIdentityChanged is returned when a friend's peer ID no longer matches the one we trusted
+var ErrIdentityChanged = errors.New("friend's identity changed - verify it and use 'trust <username>' before sending")
+
+// ErrContactDeleted is returned when sending to a friend who deleted their account
+var ErrContactDeleted = errors.New("this contact deleted their account")
+
+// missedMessageDelay is how late a message can arrive before it counts as
+// missed: one that waited in the sender's queue while we were offline
+const missedMessageDelay = time.Minute
+
 // Manager handles message operations
 type Manager struct {
 	storage       storage.Storage
 	host          host.Host
 	protocol      *Protocol
 	currentUserID int64
+	dialHandler   func(ctx context.Context, contact *storage.User) bool
+	undelivered   func(ctx context.Context, contact *storage.User)
+	deposit       func(ctx context.Context, contact *storage.User, payload []byte) error
+	receiptPolicy func(ctx context.Context, contact *storage.User) bool
+	failed        func(ctx context.Context, msg *storage.Message, contact *storage.User)
+	locked        func() bool  // Reports whether the app is locked, hiding message content
+	defaultTTL    atomic.Int64 // Delivery deadline for messages sent without one, in nanoseconds (0 = none)
+	offense       func(pid peer.ID, offense string)
+	order         *sequencer // Holds messages that arrived ahead of earlier ones
 }
 
 // NewManager creates a new message manager
@@ -24,17 +49,27 @@ func NewManager(store storage.Storage, h host.Host) *Manager {
 		storage:  store,
 		host:     h,
 		protocol: NewProtocol(),
+		order:    newSequencer(),
 	}
 
 	// Set protocol handlers
 	m.protocol.SetMessageHandler(m.handleIncomingMessage)
 	m.protocol.SetAckHandler(m.handleMessageAck)
 	m.protocol.SetReadHandler(m.handleMessageRead)
+	m.protocol.SetReadBatchHandler(m.handleMessageReadBatch)
+	m.protocol.SetInvalidHandler(func(pid peer.ID) { m.reportOffense(pid, storage.PeerOffenseInvalidMessage) })
+	m.protocol.SetBackfillHandler(m.handleBackfillRequest)
 
 	// Register stream handlers
-	h.SetStreamHandler(ProtocolDirectMessage, m.protocol.HandleDirectMessage)
-	h.SetStreamHandler(ProtocolMessageAck, m.protocol.HandleMessageAck)
-	h.SetStreamHandler(ProtocolMessageRead, m.protocol.HandleMessageRead)
+	p2p.HandleStreams(h, m.protocol.HandleDirectMessage, ProtocolDirectMessageV2, ProtocolDirectMessage)
+	p2p.HandleStreams(h, m.protocol.HandleMessageAck, ProtocolMessageAckV2, ProtocolMessageAck)
+	p2p.HandleStreams(h, m.protocol.HandleMessageRead, ProtocolMessageReadV2, ProtocolMessageRead)
+	p2p.HandleStreams(h, m.protocol.HandleMessageReadBatch, ProtocolReadBatchV2, ProtocolReadBatch)
+	p2p.HandleStreams(h, m.protocol.HandleBackfill, ProtocolBackfillV2, ProtocolBackfill)
+
+	// Without these a friend can't receive our messages or confirm them
+	p2p.RequireProtocol(ProtocolDirectMessageV2, ProtocolDirectMessage)
+	p2p.RequireProtocol(ProtocolMessageAckV2, ProtocolMessageAck)
 
 	return m
 }
@@ -44,38 +79,138 @@ func (m *Manager) SetCurrentUser(userID int64) {
 	m.currentUserID = userID
 }
 
+// SetDialHandler sets a callback that may try to connect an offline friend
+// before a message to them is stored for later; it reports whether it did
+func (m *Manager) SetDialHandler(handler func(ctx context.Context, contact *storage.User) bool) {
+	m.dialHandler = handler
+}
+
+// SetUndeliveredHandler sets a callback run when a message is stored because
+// its recipient couldn't be reached
+func (m *Manager) SetUndeliveredHandler(handler func(ctx context.Context, contact *storage.User)) {
+	m.undelivered = handler
+}
+
+// SetDepositHandler sets a callback that leaves a message for a friend who
+// can't be reached in their mailbox, given the message's wire form; a message
+// it takes counts as delivered
+func (m *Manager) SetDepositHandler(handler func(ctx context.Context, contact *storage.User, payload []byte) error) {
+	m.deposit = handler
+}
+
+// SetReceiptPolicy sets a callback reporting whether read receipts may be
+// sent to a contact; without one they always are
+func (m *Manager) SetReceiptPolicy(handler func(ctx context.Context, contact *storage.User) bool) {
+	m.receiptPolicy = handler
+}
+
+// SetFailedHandler sets a callback run for each message given up on because
+// it missed its delivery deadline
+func (m *Manager) SetFailedHandler(handler func(ctx context.Context, msg *storage.Message, contact *storage.User)) {
+	m.failed = handler
+}
+
+// SetLockCheck sets a callback reporting whether the app is locked; while it
+// is, notifications of new messages leave out who sent them and what they say
+func (m *Manager) SetLockCheck(locked func() bool) {
+	m.locked = locked
+}
+
+// isLocked reports whether the lock check says the app is locked
+func (m *Manager) isLocked() bool {
+	return m.locked != nil && m.locked()
+}
+
+// SetOffenseHandler sets the handler told when a peer misbehaves toward us,
+// with the storage.PeerOffense* it committed: so far only a malformed message
+func (m *Manager) SetOffenseHandler(handler func(pid peer.ID, offense string)) {
+	m.offense = handler
+}
+
+// reportOffense tells the offense handler about a peer
+func (m *Manager) reportOffense(pid peer.ID, offense string) {
+	if m.offense != nil {
+		m.offense(pid, offense)
+	}
+}
+
+// SetDefaultTTL sets how long messages sent without a deadline of their own
+// may wait to be delivered; 0 lets them wait forever. It can change while
+// messages are being sent.
+func (m *Manager) SetDefaultTTL(ttl time.Duration) {
+	m.defaultTTL.Store(int64(ttl))
+}
+
+// ttl returns the delivery deadline for messages sent without one
+func (m *Manager) ttl() time.Duration {
+	return time.Duration(m.defaultTTL.Load())
+}
+
+// notifyUndelivered runs the undelivered handler, if any
+func (m *Manager) notifyUndelivered(ctx context.Context, contact *storage.User) {
+	if m.undelivered != nil {
+		m.undelivered(ctx, contact)
+	}
+}
+
 // SendMessage sends a direct message to a friend
 func (m *Manager) SendMessage(ctx context.Context, currentUser *storage.User, toUsername string, content string) error {
+	return m.send(ctx, currentUser, toUsername, content, nil, nil, m.ttl())
+}
+
+// SendMessageWithTTL sends a direct message that is given up on if it can't
+// be delivered within ttl
+func (m *Manager) SendMessageWithTTL(ctx context.Context, currentUser *storage.User, toUsername string, content string, ttl time.Duration) error {
+	return m.send(ctx, currentUser, toUsername, content, nil, nil, ttl)
+}
+
+// send stores a direct message and delivers it if the friend is online.
+// forwarded attributes the content to its original author and quote carries
+// the message being replied to; either may be nil. A message still
+// undelivered after ttl is marked failed and no longer retried (0 = no deadline).
+func (m *Manager) send(ctx context.Context, currentUser *storage.User, toUsername, content string, forwarded *storage.ForwardInfo, quote *storage.QuoteInfo, ttl time.Duration) error {
+	// Friends would drop an oversized message on arrival
+	if len(content) > p2p.MaxContentLength {
+		return p2p.ErrContentTooLong
+	}
+
 	// Look up recipient user
 	toUser, err := m.storage.GetUserByUsername(ctx, toUsername)
+	if errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("user '%s' not found - you must be friends first (use 'add %s' to send friend request)", toUsername, toUsername)
+	}
 	if err != nil {
-		return fmt.Errorf("user not found: %w", err)
+		return fmt.Errorf("failed to look up user: %w", err)
 	}
-	if toUser == nil {
-		return fmt.Errorf("user '%s' not found - you must be friends first (use 'add %s' to send friend request)", toUsername, toUsername)
+
+	if err := m.checkCanMessage(ctx, currentUser, toUser); err != nil {
+		return err
 	}
 
-	// Check if they are friends
-	friendship, err := m.storage.GetFriendRequest(ctx, currentUser.ID, toUser.ID)
-	if err != nil || friendship == nil || friendship.Status != "accepted" {
-		// Check reverse direction
-		friendship, err = m.storage.GetFriendRequest(ctx, toUser.ID, currentUser.ID)
-		if err != nil || friendship == nil || friendship.Status != "accepted" {
-			return fmt.Errorf("you must be friends with %s to send messages", toUsername)
-		}
+	// Number the message so the recipient can detect gaps
+	seq, err := m.storage.NextMessageSeq(ctx, currentUser.ID, toUser.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get sequence number: %w", err)
 	}
 
 	// Create message
 	msg := &storage.Message{
+		Seq:        seq,
 		FromUserID: currentUser.ID,
 		ToUserID:   toUser.ID,
 		FromPeerID: currentUser.PeerID,
 		ToPeerID:   toUser.PeerID,
 		Content:    content,
+		Kind:       storage.MessageKindUser,
+		Forwarded:  forwarded,
+		Quote:      quote,
 		Delivered:  false,
 		Read:       false,
 		CreatedAt:  time.Now(),
 	}
+	if ttl > 0 {
+		msg.ExpiresAt = msg.CreatedAt.Add(ttl)
+	}
 
 	// Save message to database
 	if err := m.storage.SaveMessage(ctx, msg); err != nil {
@@ -88,113 +223,515 @@ func (m *Manager) SendMessage(ctx context.Context, currentUser *storage.User, to
 		return fmt.Errorf("invalid peer ID: %w", err)
 	}
 
-	// Check if peer is connected
+	// Check if peer is connected, giving the dial handler a chance to connect them
+	if m.host.Network().Connectedness(toPeerID) != 1 && m.dialHandler != nil {
+		m.dialHandler(ctx, toUser)
+	}
 	if m.host.Network().Connectedness(toPeerID) != 1 { // 1 = Connected
-		fmt.Printf("✓ Message saved (user offline, will deliver when online)\n")
+		if m.depositMessage(ctx, msg, currentUser, toUser) {
+			i18n.Printf("✓ Message left in %s's mailbox (user offline)\n", toUsername)
+		} else {
+			m.recordFailure(ctx, msg, storage.DeliveryUnreachable, nil)
+			i18n.Printf("✓ Message saved (user offline, will deliver when online)\n")
+		}
+		m.notifyUndelivered(ctx, toUser)
 		return nil
 	}
 
 	// Open stream and send message
-	stream, err := m.host.NewStream(ctx, toPeerID, ProtocolDirectMessage)
+	stream, err := m.host.NewStream(ctx, toPeerID, ProtocolDirectMessageV2, ProtocolDirectMessage)
+	if err == nil {
+		err = SendDirectMessage(ctx, stream, m.outgoingMessage(msg, currentUser, toUser))
+	}
 	if err != nil {
-		fmt.Printf("✓ Message saved (delivery failed, will retry: %v)\n", err)
+		reason := m.recordFailure(ctx, msg, deliveryReason(err), err)
+		i18n.Printf("✓ Message #%d saved, will retry: %s - 'msg-status %d'\n", msg.ID, DeliveryHint(reason, toUsername), msg.ID)
+		m.notifyUndelivered(ctx, toUser)
 		return nil
 	}
 
-	directMsg := &DirectMessage{
-		MessageID:    msg.ID,
-		FromUsername: currentUser.Username,
-		FromFullName: currentUser.FullName,
-		FromPeerID:   currentUser.PeerID,
-		ToUsername:   toUser.Username,
-		Content:      content,
-		Timestamp:    msg.CreatedAt.Unix(),
+	// Mark as delivered
+	if err := m.storage.MarkMessageDelivered(ctx, msg.ID); err != nil {
+		i18n.Printf("Warning: Failed to mark message as delivered: %v\n", err)
 	}
 
-	if err := SendDirectMessage(ctx, stream, directMsg); err != nil {
-		fmt.Printf("✓ Message saved (delivery failed, will retry: %v)\n", err)
-		return nil
+	i18n.Printf("✓ Message sent to %s\n", toUsername)
+	return nil
+}
+
+// checkCanMessage returns why currentUser can't send toUser messages, or nil
+// if they are friends and toUser's identity is the one that was trusted
+func (m *Manager) checkCanMessage(ctx context.Context, currentUser, toUser *storage.User) error {
+	// Check if they are friends
+	friendship, err := m.storage.GetFriendRequest(ctx, currentUser.ID, toUser.ID)
+	if err != nil || friendship == nil || friendship.Status != "accepted" {
+		// Check reverse direction
+		friendship, err = m.storage.GetFriendRequest(ctx, toUser.ID, currentUser.ID)
+		if err != nil || friendship == nil || friendship.Status != "accepted" {
+			if friendship != nil && friendship.Status == "deleted" {
+				return ErrContactDeleted
+			}
+			return fmt.Errorf("you must be friends with %s to send messages", toUser.Username)
+		}
 	}
 
-	// Mark as delivered
+	// Refuse to send until a changed identity has been re-verified
+	if friendship.PeerID != toUser.PeerID {
+		return ErrIdentityChanged
+	}
+	candidate, err := m.storage.GetIdentityCandidate(ctx, toUser.ID)
+	if err != nil {
+		return fmt.Errorf("failed to check identity: %w", err)
+	}
+	if candidate != nil {
+		return ErrIdentityChanged
+	}
+	return nil
+}
+
+// depositMessage leaves a message for an offline friend in their mailbox
+// through the deposit handler, marking it delivered if that worked
+func (m *Manager) depositMessage(ctx context.Context, msg *storage.Message, fromUser, toUser *storage.User) bool {
+	if m.deposit == nil {
+		return false
+	}
+	payload, err := json.Marshal(newDirectMessage(msg, fromUser, toUser))
+	if err != nil {
+		return false
+	}
+	if err := m.deposit(ctx, toUser, payload); err != nil {
+		return false
+	}
 	if err := m.storage.MarkMessageDelivered(ctx, msg.ID); err != nil {
-		fmt.Printf("Warning: Failed to mark message as delivered: %v\n", err)
+		i18n.Printf("Warning: Failed to mark message as delivered: %v\n", err)
 	}
+	return true
+}
 
-	fmt.Printf("✓ Message sent to %s\n", toUsername)
-	return nil
+// newDirectMessage builds the wire form of a stored message
+func newDirectMessage(msg *storage.Message, fromUser, toUser *storage.User) *DirectMessage {
+	return &DirectMessage{
+		MessageID:     msg.ID,
+		FromUsername:  fromUser.Username,
+		FromFullName:  fromUser.FullName,
+		FromPeerID:    fromUser.PeerID,
+		ToUsername:    toUser.RemoteName(),
+		Content:       msg.Content,
+		Kind:          msg.Kind,
+		Lamport:       msg.Lamport,
+		Seq:           msg.Seq,
+		Timestamp:     msg.CreatedAt.Unix(),
+		ForwardedFrom: forwardHeader(msg.Forwarded),
+		Quote:         quoteSnapshot(msg.Quote),
+	}
+}
+
+// outgoingMessage builds the wire form of a stored message for toUser,
+// compressing long content if their node advertised zstd support
+func (m *Manager) outgoingMessage(msg *storage.Message, fromUser, toUser *storage.User) *DirectMessage {
+	message := newDirectMessage(msg, fromUser, toUser)
+	if toPeerID, err := peer.Decode(toUser.PeerID); err == nil && p2p.PeerSupports(m.host, toPeerID, p2p.CapabilityZstd) {
+		message.compress()
+	}
+	return message
+}
+
+// How a direct message reached us
+type receiveMode int
+
+const (
+	receiveDirect    receiveMode = iota // Sent straight to us
+	receiveBackfill                     // Fetched from the sender after a gap
+	receiveDeposited                    // Taken from our mailbox while the sender may be offline
+	receiveReleased                     // Held from a changed identity until the user trusted it
+)
+
+// acked reports whether messages received this way are acknowledged; the
+// sender already counts the others as delivered
+func (mode receiveMode) acked() bool {
+	return mode == receiveDirect || mode == receiveBackfill
 }
 
 // handleIncomingMessage handles incoming direct messages
 func (m *Manager) handleIncomingMessage(message *DirectMessage, fromPeer peer.ID) {
+	m.receiveMessage(message, fromPeer, receiveDirect)
+}
+
+// ReceiveDeposited takes in a direct message fromPeer left in our mailbox,
+// given its wire form. The sender already counts it as delivered, so it is
+// not acknowledged.
+func (m *Manager) ReceiveDeposited(payload []byte, fromPeer peer.ID) error {
+	message, err := DecodeDirectMessage(payload)
+	if err != nil {
+		return err
+	}
+	if message.FromPeerID != fromPeer.String() {
+		return fmt.Errorf("message claims to be from %s but was sent by %s", message.FromPeerID, fromPeer)
+	}
+	m.receiveMessage(message, fromPeer, receiveDeposited)
+	return nil
+}
+
+// receiveMessage stores and acknowledges a direct message, in the order
+// the sender wrote it. Missing earlier sequence numbers of messages sent
+// straight to us are requested from the sender.
+func (m *Manager) receiveMessage(message *DirectMessage, fromPeer peer.ID, mode receiveMode) {
 	ctx := context.Background()
 
-	// Look up sender
-	fromUser, err := m.storage.GetUserByUsername(ctx, message.FromUsername)
-	if err != nil || fromUser == nil {
-		fmt.Printf("Error: Message from unknown user %s\n", message.FromUsername)
+	if message.Group != nil {
+		m.receiveGroupMessage(ctx, message, fromPeer, mode)
+		return
+	}
+
+	// Look up sender by the peer they connected as; a known username from a new
+	// peer is treated as an identity change below
+	fromUser, err := m.storage.GetUserByPeerID(ctx, fromPeer.String())
+	if errors.Is(err, storage.ErrNotFound) {
+		fromUser, err = m.storage.GetUserByUsername(ctx, message.FromUsername)
+	}
+	if err != nil || !fromUser.IsRemote() {
+		i18n.Printf("Error: Message from unknown user %s\n", message.FromUsername)
 		return
 	}
 
 	// Look up recipient (should be current user)
-	toUser, err := m.storage.GetUserByUsername(ctx, message.ToUsername)
-	if err != nil || toUser == nil {
-		fmt.Printf("\n📨 Incoming message for %s, but you're not logged in as that user\n", message.ToUsername)
-		fmt.Printf("   From: %s\n", message.FromUsername)
-		fmt.Printf("   Please login to receive messages\n")
-		fmt.Print("> ")
+	toUser, err := m.localRecipient(ctx, message.ToUsername)
+	if err != nil {
+		i18n.Printf("\n📨 Incoming message for %s, but you're not logged in as that user\n", message.ToUsername)
+		i18n.Printf("   From: %s\n", message.FromUsername)
+		i18n.Printf("   Please login to receive messages\n")
+		i18n.Print("> ")
 		return
 	}
 
-	// Save message
+	// A changed identity (reinstall, new device, or someone else) is held
+	// apart until the user verifies it
+	if fromUser.PeerID != fromPeer.String() {
+		m.quarantineMessage(ctx, message, fromPeer, fromUser, toUser, mode)
+		return
+	}
+
+	// Drop duplicates (retries and backfills can resend a message) but still ack
+	if message.Seq > 0 {
+		exists, err := m.storage.HasMessageSeq(ctx, fromUser.ID, toUser.ID, message.Seq)
+		if err != nil {
+			i18n.Printf("Warning: Failed to check for duplicate message: %v\n", err)
+		} else if exists {
+			if mode.acked() {
+				m.sendAck(ctx, message, fromPeer, fromUser, toUser)
+			}
+			return
+		}
+	}
+
+	// Save message, with the sender's timestamp turned into local time
+	receivedAt := time.Now()
 	msg := &storage.Message{
+		Seq:        message.Seq,
 		FromUserID: fromUser.ID,
 		ToUserID:   toUser.ID,
 		FromPeerID: fromUser.PeerID,
 		ToPeerID:   toUser.PeerID,
 		Content:    message.Content,
+		Kind:       storage.MessageKindUser, // Only we record notices in a conversation
+		Forwarded:  forwardInfo(message.ForwardedFrom),
+		Quote:      quoteInfo(message.Quote),
+		Lamport:    message.Lamport, // Zero for older peers; storage assigns the next value
 		Delivered:  true,
 		Read:       false,
-		CreatedAt:  time.Unix(message.Timestamp, 0),
+		CreatedAt:  p2p.NormalizeTimestamp(m.host, fromPeer, message.Timestamp, receivedAt),
+		ReceivedAt: receivedAt,
 	}
 
-	if err := m.storage.SaveMessage(ctx, msg); err != nil {
-		fmt.Printf("Error saving message: %v\n", err)
-		return
+	m.sequence(ctx, &incomingMessage{
+		message:  message,
+		msg:      msg,
+		fromPeer: fromPeer,
+		fromUser: fromUser,
+		toUser:   toUser,
+		mode:     mode,
+	})
+}
+
+// storeIncoming saves a received message, reporting whether it should be
+// announced. A message another stream stored while this one was held
+// back is only acked.
+func (m *Manager) storeIncoming(ctx context.Context, in *incomingMessage) bool {
+	if in.msg.Seq > 0 {
+		if exists, err := m.storage.HasMessageSeq(ctx, in.fromUser.ID, in.toUser.ID, in.msg.Seq); err == nil && exists {
+			in.duplicate = true
+			return true
+		}
+	}
+
+	if err := m.storage.SaveMessage(ctx, in.msg); err != nil {
+		i18n.Printf("Error saving message: %v\n", err)
+		return false
 	}
 
 	// Mark as delivered immediately
-	if err := m.storage.MarkMessageDelivered(ctx, msg.ID); err != nil {
-		fmt.Printf("Warning: Failed to mark message as delivered: %v\n", err)
+	if err := m.storage.MarkMessageDelivered(ctx, in.msg.ID); err != nil {
+		i18n.Printf("Warning: Failed to mark message as delivered: %v\n", err)
 	}
+	return true
+}
+
+// announceIncoming acknowledges a stored message and tells the user about it
+func (m *Manager) announceIncoming(ctx context.Context, in *incomingMessage) {
+	message, msg, fromUser, toUser := in.message, in.msg, in.fromUser, in.toUser
 
 	// Send acknowledgment
-	stream, err := m.host.NewStream(ctx, fromPeer, ProtocolMessageAck)
+	if in.mode.acked() {
+		m.sendAck(ctx, message, in.fromPeer, fromUser, toUser)
+	}
+	if in.duplicate {
+		return
+	}
+
+	// Keep messages the recipient wasn't there for in their activity feed
+	if !msg.IsSystem() && (toUser.ID != m.currentUserID || msg.ReceivedAt.Sub(msg.CreatedAt) > missedMessageDelay) {
+		m.recordMissedMessage(ctx, toUser, fromUser, msg)
+	}
+
+	// Display notification
+	if m.isLocked() {
+		i18n.Printf("\n🔒 New message - unlock to read it\n> ")
+		return
+	}
+	if msg.IsSystem() {
+		i18n.Printf("\n*** %s: %s ***\n> ", fromUser.Username, message.Content)
+		return
+	}
+	if msg.Forwarded != nil {
+		i18n.Printf("\n📨 New message from %s (%s), forwarded from %s: %s\n> ", message.FromFullName, fromUser.Username, msg.Forwarded.Author(), message.Content)
+		return
+	}
+	if msg.Quote != nil {
+		i18n.Printf("\n📨 New message from %s (%s)\n   ↳ replying to %s: \"%s\"\n   %s\n> ", message.FromFullName, fromUser.Username, msg.Quote.Author(), msg.Quote.Excerpt, message.Content)
+		return
+	}
+	i18n.Printf("\n📨 New message from %s (%s): %s\n> ", message.FromFullName, fromUser.Username, message.Content)
+}
+
+// localRecipient looks up the account on this node a message is addressed to
+func (m *Manager) localRecipient(ctx context.Context, username string) (*storage.User, error) {
+	toUser, err := m.storage.GetUserByUsername(ctx, username)
+	if errors.Is(err, storage.ErrNotFound) {
+		// Friends who haven't heard of a rename yet still use the old name
+		if toUser, err = m.storage.GetUserByAlias(ctx, username); err == nil && toUser.IsRemote() {
+			err = storage.ErrNotFound
+		}
+	}
+	return toUser, err
+}
+
+// sendAck acknowledges a received direct message to its sender
+func (m *Manager) sendAck(ctx context.Context, message *DirectMessage, fromPeer peer.ID, fromUser, toUser *storage.User) {
+	stream, err := m.host.NewStream(ctx, fromPeer, ProtocolMessageAckV2, ProtocolMessageAck)
 	if err != nil {
-		fmt.Printf("Warning: Failed to send message ack: %v\n", err)
-	} else {
-		ack := &MessageAck{
-			MessageID: message.MessageID,
-			FromPeer:  toUser.PeerID,
-			ToPeer:    fromUser.PeerID,
-			Timestamp: time.Now().Unix(),
+		i18n.Printf("Warning: Failed to send message ack: %v\n", err)
+		return
+	}
+
+	ack := &MessageAck{
+		MessageID: message.MessageID,
+		FromPeer:  toUser.PeerID,
+		ToPeer:    fromUser.PeerID,
+		Timestamp: time.Now().Unix(),
+	}
+	if err := SendMessageAck(ctx, stream, ack); err != nil {
+		i18n.Printf("Warning: Failed to send ack: %v\n", err)
+	}
+}
+
+// requestBackfill fetches missing messages from their sender and stores them
+func (m *Manager) requestBackfill(fromPeer peer.ID, fromUser *storage.User, missing []int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if len(missing) > MaxBackfillSeqs {
+		missing = missing[:MaxBackfillSeqs]
+	}
+
+	stream, err := m.host.NewStream(ctx, fromPeer, ProtocolBackfillV2, ProtocolBackfill)
+	if err != nil {
+		i18n.Printf("Warning: Could not request %d missing message(s) from %s: %v\n", len(missing), fromUser.Username, err)
+		return
+	}
+
+	request := &BackfillRequest{
+		FromPeer: m.host.ID().String(),
+		Seqs:     missing,
+	}
+
+	resent, err := RequestBackfill(ctx, stream, request)
+	if err != nil {
+		i18n.Printf("Warning: Backfill from %s failed: %v\n", fromUser.Username, err)
+	}
+
+	for _, message := range resent {
+		// Resent messages must come from the conversation we asked about
+		if message.FromUsername != fromUser.Username {
+			continue
 		}
-		if err := SendMessageAck(ctx, stream, ack); err != nil {
-			fmt.Printf("Warning: Failed to send ack: %v\n", err)
+		m.receiveMessage(message, fromPeer, receiveBackfill)
+	}
+}
+
+// handleBackfillRequest returns our messages to the requesting friend with the requested sequence numbers
+func (m *Manager) handleBackfillRequest(request *BackfillRequest, fromPeer peer.ID) []*DirectMessage {
+	ctx := context.Background()
+
+	if m.currentUserID == 0 {
+		return nil
+	}
+
+	currentUser, err := m.storage.GetUserByID(ctx, m.currentUserID)
+	if err != nil {
+		return nil
+	}
+
+	// Only answer the peer the messages were addressed to
+	requester, err := m.storage.GetUserByPeerID(ctx, fromPeer.String())
+	if err != nil {
+		return nil
+	}
+	if !m.isIdentityTrusted(ctx, currentUser.ID, requester) {
+		return nil
+	}
+
+	stored, err := m.storage.GetMessagesBySeq(ctx, currentUser.ID, requester.ID, request.Seqs)
+	if err != nil {
+		i18n.Printf("Warning: Failed to load messages for backfill: %v\n", err)
+		return nil
+	}
+
+	resent := make([]*DirectMessage, 0, len(stored))
+	for _, msg := range stored {
+		// Messages past their deadline must not turn up late this way either
+		if msg.Failed || (!msg.ExpiresAt.IsZero() && time.Now().After(msg.ExpiresAt)) {
+			continue
 		}
+		resent = append(resent, m.outgoingMessage(msg, currentUser, requester))
 	}
+	return resent
+}
 
-	// Display notification
-	fmt.Printf("\n📨 New message from %s (%s): %s\n> ", message.FromFullName, message.FromUsername, message.Content)
+// recordMissedMessage adds a message that arrived while its recipient was
+// away to their activity feed
+func (m *Manager) recordMissedMessage(ctx context.Context, toUser, fromUser *storage.User, msg *storage.Message) {
+	err := m.storage.RecordActivity(ctx, &storage.Activity{
+		UserID:    toUser.ID,
+		Kind:      storage.ActivityMissedMessages,
+		PeerID:    fromUser.PeerID,
+		Name:      fromUser.Username,
+		Detail:    msg.Preview,
+		CreatedAt: msg.ReceivedAt,
+	})
+	if err != nil {
+		i18n.Printf("Warning: Failed to record activity: %v\n", err)
+	}
+}
+
+// quarantineMessage holds a message from a peer claiming to be contact
+// without being the peer trusted for them. Nothing about the contact changes:
+// sends still go to the trusted peer, and the held messages only join the
+// conversation once the user runs 'trust'.
+func (m *Manager) quarantineMessage(ctx context.Context, message *DirectMessage, fromPeer peer.ID, contact, toUser *storage.User, mode receiveMode) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	isNew, err := m.storage.SetIdentityCandidate(ctx, contact.ID, fromPeer.String())
+	if err != nil {
+		i18n.Printf("Warning: Failed to record identity change for %s: %v\n", contact.Username, err)
+		return
+	}
+	if err := m.storage.QuarantineMessage(ctx, &storage.QuarantinedMessage{
+		ContactID: contact.ID,
+		PeerID:    fromPeer.String(),
+		Payload:   payload,
+	}); err != nil {
+		i18n.Printf("Warning: Failed to hold message from %s: %v\n", contact.Username, err)
+		return
+	}
+
+	// The message is kept, so the sender can stop retrying
+	if mode.acked() {
+		m.sendAck(ctx, message, fromPeer, contact, toUser)
+	}
+
+	if !isNew {
+		i18n.Printf("\n⚠️  Held another message from the unverified identity claiming to be %s\n> ", contact.Username)
+		return
+	}
+
+	notice := &storage.Message{
+		FromUserID: contact.ID,
+		ToUserID:   toUser.ID,
+		FromPeerID: contact.PeerID,
+		ToPeerID:   toUser.PeerID,
+		Content:    fmt.Sprintf("A new identity (peer ID %s) claims to be %s. Its messages are held until you verify it and use 'trust %s'.", fromPeer, contact.Username, contact.Username),
+		Kind:       storage.MessageKindSystem,
+		Delivered:  true,
+		CreatedAt:  time.Now(),
+	}
+	if err := m.storage.SaveMessage(ctx, notice); err != nil {
+		i18n.Printf("Warning: Failed to save system message: %v\n", err)
+	}
+
+	i18n.Printf("\n⚠️  A new identity claims to be %s (peer ID %s)\n", contact.Username, fromPeer)
+	i18n.Printf("   Its messages are held, and yours still go to the %s you trusted, until you verify it and run 'trust %s'\n> ", contact.Username, contact.Username)
+}
+
+// ReleaseQuarantined adds the messages held from a contact's newly trusted
+// identity to the conversation, returning how many there were
+func (m *Manager) ReleaseQuarantined(ctx context.Context, contact *storage.User) int {
+	fromPeer, err := peer.Decode(contact.PeerID)
+	if err != nil {
+		return 0
+	}
+	held, err := m.storage.TakeQuarantinedMessages(ctx, contact.ID, contact.PeerID)
+	if err != nil {
+		i18n.Printf("Warning: Failed to load held messages from %s: %v\n", contact.Username, err)
+		return 0
+	}
+	released := 0
+	for _, h := range held {
+		message, err := DecodeDirectMessage(h.Payload)
+		if err != nil {
+			continue
+		}
+		m.receiveMessage(message, fromPeer, receiveReleased)
+		released++
+	}
+	return released
+}
+
+// isIdentityTrusted reports whether the contact's current peer ID matches the one
+// recorded on the friendship
+func (m *Manager) isIdentityTrusted(ctx context.Context, userID int64, contact *storage.User) bool {
+	friendship, err := m.storage.GetFriendRequest(ctx, userID, contact.ID)
+	if err != nil || friendship == nil {
+		friendship, err = m.storage.GetFriendRequest(ctx, contact.ID, userID)
+		if err != nil || friendship == nil {
+			return false
+		}
+	}
+	return friendship.PeerID == contact.PeerID
 }
 
 // handleMessageAck handles message delivery acknowledgments
 func (m *Manager) handleMessageAck(ack *MessageAck, fromPeer peer.ID) {
 	ctx := context.Background()
 
+	if ack.GroupID != "" {
+		m.handleGroupAck(ctx, ack, fromPeer)
+		return
+	}
 	if ack.MessageID > 0 {
 		if err := m.storage.MarkMessageDelivered(ctx, ack.MessageID); err != nil {
-			fmt.Printf("Warning: Failed to mark message as delivered: %v\n", err)
+			i18n.Printf("Warning: Failed to mark message as delivered: %v\n", err)
 		}
 	}
 }
@@ -205,16 +742,55 @@ func (m *Manager) handleMessageRead(read *MessageRead, fromPeer peer.ID) {
 
 	if read.MessageID > 0 {
 		if err := m.storage.MarkMessageRead(ctx, read.MessageID); err != nil {
-			fmt.Printf("Warning: Failed to mark message as read: %v\n", err)
+			i18n.Printf("Warning: Failed to mark message as read: %v\n", err)
 		}
 	}
 }
 
+// handleMessageReadBatch marks the messages we sent the friend who read them
+// as read
+func (m *Manager) handleMessageReadBatch(batch *MessageReadBatch, fromPeer peer.ID) {
+	ctx := context.Background()
+
+	if m.currentUserID == 0 {
+		return
+	}
+
+	// Only the peer the messages were addressed to can have read them
+	reader, err := m.storage.GetUserByPeerID(ctx, fromPeer.String())
+	if err != nil {
+		return
+	}
+	if !m.isIdentityTrusted(ctx, m.currentUserID, reader) {
+		return
+	}
+
+	if _, err := m.storage.MarkMessagesReadBySeq(ctx, m.currentUserID, reader.ID, batch.Seqs); err != nil {
+		i18n.Printf("Warning: Failed to mark messages as read: %v\n", err)
+	}
+}
+
 // GetConversation retrieves message history with another user
 func (m *Manager) GetConversation(ctx context.Context, currentUserID, otherUserID int64, limit int) ([]*storage.Message, error) {
 	return m.storage.GetMessages(ctx, currentUserID, otherUserID, limit)
 }
 
+// GetConversationStats summarizes the messages exchanged with another user
+// since the given time (zero for all time)
+func (m *Manager) GetConversationStats(ctx context.Context, currentUserID, otherUserID int64, since time.Time) (*storage.ConversationStats, error) {
+	return m.storage.GetConversationStats(ctx, currentUserID, otherUserID, since)
+}
+
+// DeleteMessageForMe hides a message from local history without notifying the peer
+func (m *Manager) DeleteMessageForMe(ctx context.Context, currentUserID, messageID int64) error {
+	return m.storage.HideMessage(ctx, currentUserID, messageID)
+}
+
+// GetConversations lists direct conversations with their latest message, newest first
+func (m *Manager) GetConversations(ctx context.Context, currentUserID int64, onlinePeerIDs []string) ([]*storage.ConversationSummary, error) {
+	return m.storage.GetConversations(ctx, currentUserID, onlinePeerIDs)
+}
+
 // GetUndeliveredMessages retrieves messages that haven't been delivered yet
 func (m *Manager) GetUndeliveredMessages(ctx context.Context, userID int64) ([]*storage.Message, error) {
 	return m.storage.GetUndeliveredMessages(ctx, userID)
@@ -224,51 +800,110 @@ func (m *Manager) GetUndeliveredMessages(ctx context.Context, userID int64) ([]*
 func (m *Manager) MarkAsRead(ctx context.Context, currentUser *storage.User, fromUsername string) error {
 	// Look up the other user
 	fromUser, err := m.storage.GetUserByUsername(ctx, fromUsername)
+	if errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("user '%s' not found", fromUsername)
+	}
 	if err != nil {
-		return fmt.Errorf("user not found: %w", err)
+		return fmt.Errorf("failed to look up user: %w", err)
 	}
 
-	// Get all unread messages from that user
-	messages, err := m.storage.GetMessages(ctx, currentUser.ID, fromUser.ID, 100)
+	// Mark every unread message read at once; system messages are local only
+	// and don't come back, as there is no receipt to send for them
+	read, err := m.storage.MarkConversationRead(ctx, currentUser.ID, fromUser.ID)
 	if err != nil {
-		return fmt.Errorf("failed to get messages: %w", err)
+		return fmt.Errorf("failed to mark messages as read: %w", err)
 	}
 
-	// Mark each unread message as read
-	for _, msg := range messages {
-		if msg.FromUserID == fromUser.ID && !msg.Read {
-			if err := m.storage.MarkMessageRead(ctx, msg.ID); err != nil {
-				fmt.Printf("Warning: Failed to mark message %d as read: %v\n", msg.ID, err)
-			}
+	// Messages are marked read either way; only the receipt is withheld
+	if len(read) > 0 && (m.receiptPolicy == nil || m.receiptPolicy(ctx, fromUser)) {
+		m.sendReadReceipts(ctx, currentUser, fromUser, read)
+	}
+	return nil
+}
 
-			// Send read receipt if peer is online
-			toPeerID, err := peer.Decode(fromUser.PeerID)
-			if err != nil {
-				continue
-			}
+// sendReadReceipts tells a contact, if they're connected, which of their
+// messages were read. Peers that speak read batches get one stream listing
+// every message by its sequence number; older peers, and messages sent before
+// sequence numbers, get a receipt each.
+func (m *Manager) sendReadReceipts(ctx context.Context, currentUser, contact *storage.User, read []*storage.Message) {
+	toPeerID, err := peer.Decode(contact.PeerID)
+	if err != nil || m.host.Network().Connectedness(toPeerID) != network.Connected {
+		return
+	}
 
-			if m.host.Network().Connectedness(toPeerID) == 1 { // Connected
-				stream, err := m.host.NewStream(ctx, toPeerID, ProtocolMessageRead)
-				if err != nil {
-					continue
-				}
-
-				readReceipt := &MessageRead{
-					MessageID: msg.ID,
-					FromPeer:  currentUser.PeerID,
-					ToPeer:    fromUser.PeerID,
-					Timestamp: time.Now().Unix(),
-				}
-				SendMessageRead(ctx, stream, readReceipt)
+	single := read
+	if stream, err := m.host.NewStream(ctx, toPeerID, ProtocolReadBatchV2, ProtocolReadBatch); err == nil {
+		batch := &MessageReadBatch{
+			FromPeer:  currentUser.PeerID,
+			ToPeer:    contact.PeerID,
+			Timestamp: time.Now().Unix(),
+		}
+		single = nil
+		for _, msg := range read {
+			if msg.Seq > 0 {
+				batch.Seqs = append(batch.Seqs, msg.Seq)
+			} else {
+				single = append(single, msg)
 			}
 		}
+		if err := SendMessageReadBatch(ctx, stream, batch); err != nil {
+			i18n.Printf("Warning: Failed to send read receipts: %v\n", err)
+		}
+	}
+
+	for _, msg := range single {
+		stream, err := m.host.NewStream(ctx, toPeerID, ProtocolMessageReadV2, ProtocolMessageRead)
+		if err != nil {
+			return
+		}
+		readReceipt := &MessageRead{
+			MessageID: msg.ID,
+			FromPeer:  currentUser.PeerID,
+			ToPeer:    contact.PeerID,
+			Timestamp: time.Now().Unix(),
+		}
+		SendMessageRead(ctx, stream, readReceipt)
 	}
+}
 
+// DeleteConversation hides a whole conversation with a contact from local
+// history without notifying them, and returns how many messages it hid
+func (m *Manager) DeleteConversation(ctx context.Context, currentUserID, contactID int64) (int64, error) {
+	return m.storage.HideConversation(ctx, currentUserID, contactID)
+}
+
+// ExpireUndeliveredMessages gives up on the user's queued messages whose
+// delivery deadline has passed, marking them failed and running the failed
+// handler for each
+func (m *Manager) ExpireUndeliveredMessages(ctx context.Context, currentUserID int64) error {
+	expired, err := m.storage.FailExpiredMessages(ctx, currentUserID)
+	if err != nil {
+		return fmt.Errorf("failed to expire undelivered messages: %w", err)
+	}
+	if m.failed == nil {
+		return nil
+	}
+	for _, msg := range expired {
+		toUser, err := m.storage.GetUserByID(ctx, msg.ToUserID)
+		if err != nil {
+			continue
+		}
+		m.failed(ctx, msg, toUser)
+	}
 	return nil
 }
 
-// RetryUndeliveredMessages attempts to deliver queued messages to online peers
+// RetryUndeliveredMessages attempts to deliver queued messages to online
+// peers, after giving up on any past their delivery deadline
 func (m *Manager) RetryUndeliveredMessages(ctx context.Context, currentUserID int64) error {
+	if err := m.ExpireUndeliveredMessages(ctx, currentUserID); err != nil {
+		return err
+	}
+
+	if err := m.retryGroupDeliveries(ctx, currentUserID); err != nil {
+		return err
+	}
+
 	messages, err := m.storage.GetUndeliveredMessages(ctx, currentUserID)
 	if err != nil {
 		return fmt.Errorf("failed to get undelivered messages: %w", err)
@@ -278,7 +913,7 @@ func (m *Manager) RetryUndeliveredMessages(ctx context.Context, currentUserID in
 		return nil
 	}
 
-	fmt.Printf("Found %d undelivered message(s), attempting delivery...\n", len(messages))
+	i18n.Printf("Found %d undelivered message(s), attempting delivery...\n", len(messages))
 
 	for _, msg := range messages {
 		// Look up sender and recipient
@@ -298,34 +933,33 @@ func (m *Manager) RetryUndeliveredMessages(ctx context.Context, currentUserID in
 			continue
 		}
 
-		if m.host.Network().Connectedness(toPeerID) != 1 {
-			continue // Still offline
+		// Skip recipients whose changed identity hasn't been re-verified
+		if !m.isIdentityTrusted(ctx, fromUser.ID, toUser) {
+			continue
 		}
 
-		stream, err := m.host.NewStream(ctx, toPeerID, ProtocolDirectMessage)
-		if err != nil {
+		if m.host.Network().Connectedness(toPeerID) != 1 {
+			// Still offline; leave it in their mailbox if they have one
+			if m.depositMessage(ctx, msg, fromUser, toUser) {
+				i18n.Printf("✓ Left message in %s's mailbox\n", toUser.Username)
+			}
 			continue
 		}
 
-		directMsg := &DirectMessage{
-			MessageID:    msg.ID,
-			FromUsername: fromUser.Username,
-			FromFullName: fromUser.FullName,
-			FromPeerID:   fromUser.PeerID,
-			ToUsername:   toUser.Username,
-			Content:      msg.Content,
-			Timestamp:    msg.CreatedAt.Unix(),
+		stream, err := m.host.NewStream(ctx, toPeerID, ProtocolDirectMessageV2, ProtocolDirectMessage)
+		if err == nil {
+			err = SendDirectMessage(ctx, stream, m.outgoingMessage(msg, fromUser, toUser))
 		}
-
-		if err := SendDirectMessage(ctx, stream, directMsg); err != nil {
+		if err != nil {
+			m.recordFailure(ctx, msg, deliveryReason(err), err)
 			continue
 		}
 
 		// Mark as delivered
 		if err := m.storage.MarkMessageDelivered(ctx, msg.ID); err != nil {
-			fmt.Printf("Warning: Failed to mark message as delivered: %v\n", err)
+			i18n.Printf("Warning: Failed to mark message as delivered: %v\n", err)
 		} else {
-			fmt.Printf("✓ Delivered message to %s\n", toUser.Username)
+			i18n.Printf("✓ Delivered message to %s\n", toUser.Username)
 		}
 	}
 
@@ -0,0 +1,212 @@
+package messages
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// reorderWait is how long a message that arrived ahead of an earlier one
+// is held back before it is stored anyway; the earlier one is usually
+// on a racing stream or comes in by backfill well within this. Tests
+// shorten it.
+var reorderWait = 5 * time.Second
+
+// maxHeldMessages bounds how many early messages one conversation holds
+// back; past it they are stored as they come
+const maxHeldMessages = 100
+
+// conversationKey identifies one direction of a direct conversation
+type conversationKey struct {
+	from, to int64
+}
+
+// incomingMessage is a received direct message waiting to be stored
+type incomingMessage struct {
+	message   *DirectMessage
+	msg       *storage.Message
+	fromPeer  peer.ID
+	fromUser  *storage.User
+	toUser    *storage.User
+	mode      receiveMode
+	duplicate bool // Stored by another stream while it waited; only acked
+}
+
+// heldConversation holds messages that arrived before an earlier one
+type heldConversation struct {
+	messages  map[int64]*incomingMessage // By sequence number
+	requested map[int64]bool             // Missing sequence numbers already asked for
+	timer     *time.Timer
+}
+
+// sequencer keeps direct messages stored in the order they were sent, so
+// history and notifications don't jump around when streams race
+type sequencer struct {
+	mu   sync.Mutex
+	held map[conversationKey]*heldConversation
+}
+
+func newSequencer() *sequencer {
+	return &sequencer{held: make(map[conversationKey]*heldConversation)}
+}
+
+// sequence stores an incoming message once every message sent before it is
+// stored, holding it back for up to reorderWait otherwise. Gaps are asked
+// for from the sender. Messages from older peers without sequence numbers,
+// backfilled ones and ones released from quarantine are stored straight away.
+func (m *Manager) sequence(ctx context.Context, in *incomingMessage) {
+	key := conversationKey{from: in.fromUser.ID, to: in.toUser.ID}
+
+	m.order.mu.Lock()
+	held := m.order.held[key]
+	if held != nil && held.messages[in.msg.Seq] != nil {
+		m.order.mu.Unlock()
+		return // Already waiting for its turn
+	}
+
+	if in.msg.Seq > 0 && (in.mode == receiveDirect || in.mode == receiveDeposited) && (held == nil || len(held.messages) < maxHeldMessages) {
+		expected, err := m.storage.NextMessageSeq(ctx, key.from, key.to)
+		if err != nil {
+			i18n.Printf("Warning: Failed to check message order: %v\n", err)
+		} else if in.msg.Seq > expected {
+			if held == nil {
+				held = &heldConversation{
+					messages:  make(map[int64]*incomingMessage),
+					requested: make(map[int64]bool),
+				}
+				held.timer = time.AfterFunc(reorderWait, func() { m.releaseHeld(key, held) })
+				m.order.held[key] = held
+			}
+			held.messages[in.msg.Seq] = in
+
+			// Ask for the gap once, leaving what another stream already brought
+			var missing []int64
+			if in.mode == receiveDirect {
+				for seq := expected; seq < in.msg.Seq && len(missing) < MaxBackfillSeqs; seq++ {
+					if held.messages[seq] == nil && !held.requested[seq] {
+						held.requested[seq] = true
+						missing = append(missing, seq)
+					}
+				}
+			}
+			m.order.mu.Unlock()
+
+			if len(missing) > 0 {
+				go p2p.Protect("backfill", in.fromPeer, func() { m.requestBackfill(in.fromPeer, in.fromUser, missing) })
+			}
+			return
+		}
+	}
+
+	ready := m.storeInOrder(ctx, key, in)
+	m.order.mu.Unlock()
+
+	// Ask the sender for anything we missed before this message
+	if in.mode == receiveDirect && in.msg.Seq > 1 {
+		missing, err := m.storage.GetMissingMessageSeqs(ctx, key.from, key.to, in.msg.Seq)
+		if err != nil {
+			i18n.Printf("Warning: Failed to check for missing messages: %v\n", err)
+		} else if len(missing) > 0 {
+			go p2p.Protect("backfill", in.fromPeer, func() { m.requestBackfill(in.fromPeer, in.fromUser, missing) })
+		}
+	}
+
+	for _, next := range ready {
+		m.announceIncoming(ctx, next)
+	}
+}
+
+// storeInOrder stores a message and then any held ones it was the last gap
+// before, returning them in the order they were stored. The caller holds
+// m.order.mu.
+func (m *Manager) storeInOrder(ctx context.Context, key conversationKey, in *incomingMessage) []*incomingMessage {
+	var ready []*incomingMessage
+	if m.storeIncoming(ctx, in) {
+		ready = append(ready, in)
+	}
+
+	held := m.order.held[key]
+	if held == nil {
+		return ready
+	}
+	expected, err := m.storage.NextMessageSeq(ctx, key.from, key.to)
+	for err == nil {
+		next := held.messages[expected]
+		if next == nil {
+			break
+		}
+		delete(held.messages, expected)
+		if m.storeIncoming(ctx, next) {
+			ready = append(ready, next)
+		}
+		expected, err = m.storage.NextMessageSeq(ctx, key.from, key.to)
+	}
+	if len(held.messages) == 0 {
+		held.timer.Stop()
+		delete(m.order.held, key)
+	}
+	return ready
+}
+
+// releaseHeld stores everything a conversation held back once reorderWait
+// passes without the gap being filled. Messages that turn up for the gap
+// later are stored then, out of order.
+func (m *Manager) releaseHeld(key conversationKey, held *heldConversation) {
+	ctx := context.Background()
+
+	m.order.mu.Lock()
+	if m.order.held[key] != held {
+		m.order.mu.Unlock()
+		return // Released by the message it was waiting for
+	}
+	delete(m.order.held, key)
+	ready := m.storeHeld(ctx, held)
+	m.order.mu.Unlock()
+
+	for _, next := range ready {
+		m.announceIncoming(ctx, next)
+	}
+}
+
+// ReleaseHeld stores every message held back waiting for an earlier one,
+// so none are lost when the node stops
+func (m *Manager) ReleaseHeld() {
+	ctx := context.Background()
+
+	m.order.mu.Lock()
+	var ready []*incomingMessage
+	for key, held := range m.order.held {
+		held.timer.Stop()
+		delete(m.order.held, key)
+		ready = append(ready, m.storeHeld(ctx, held)...)
+	}
+	m.order.mu.Unlock()
+
+	for _, next := range ready {
+		m.announceIncoming(ctx, next)
+	}
+}
+
+// storeHeld stores a conversation's held messages in sequence order. The
+// caller holds m.order.mu.
+func (m *Manager) storeHeld(ctx context.Context, held *heldConversation) []*incomingMessage {
+	seqs := make([]int64, 0, len(held.messages))
+	for seq := range held.messages {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	var ready []*incomingMessage
+	for _, seq := range seqs {
+		if next := held.messages[seq]; m.storeIncoming(ctx, next) {
+			ready = append(ready, next)
+		}
+	}
+	return ready
+}
@@ -0,0 +1,248 @@
+package messages
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// sequencerTest is a receiving manager with a sender peer that records the
+// acks and backfill requests it gets
+type sequencerTest struct {
+	t          *testing.T
+	m          *Manager
+	store      *storage.SQLiteStorage
+	sender     host.Host
+	bob, alice *storage.User
+
+	mu        sync.Mutex
+	acked     []int64
+	requested []int64
+}
+
+func newSequencerTest(t *testing.T) *sequencerTest {
+	t.Helper()
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatalf("failed to start hosts: %v", err)
+	}
+	t.Cleanup(func() { mn.Close() })
+	receiver, sender := mn.Hosts()[0], mn.Hosts()[1]
+
+	store, err := storage.NewMemoryStorage()
+	if err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	ctx := context.Background()
+	bob := &storage.User{Username: "bob", PasswordHash: "hash", PeerID: receiver.ID().String()}
+	if err := store.CreateUser(ctx, bob); err != nil {
+		t.Fatalf("failed to create bob: %v", err)
+	}
+	alice := &storage.User{Username: "alice", PasswordHash: storage.RemoteUserPasswordHash, PeerID: sender.ID().String()}
+	if err := store.CreateUser(ctx, alice); err != nil {
+		t.Fatalf("failed to create alice: %v", err)
+	}
+
+	st := &sequencerTest{t: t, store: store, sender: sender, bob: bob, alice: alice}
+	st.m = NewManager(store, receiver)
+	st.m.SetCurrentUser(bob.ID)
+	t.Cleanup(st.m.ReleaseHeld)
+
+	// The sender side only records what it is asked for
+	protocol := NewProtocol()
+	protocol.SetAckHandler(func(ack *MessageAck, _ peer.ID) {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		st.acked = append(st.acked, ack.MessageID)
+	})
+	protocol.SetBackfillHandler(func(request *BackfillRequest, _ peer.ID) []*DirectMessage {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		st.requested = append(st.requested, request.Seqs...)
+		return nil
+	})
+	p2p.HandleStreams(sender, protocol.HandleMessageAck, ProtocolMessageAckV2, ProtocolMessageAck)
+	p2p.HandleStreams(sender, protocol.HandleBackfill, ProtocolBackfillV2, ProtocolBackfill)
+	return st
+}
+
+// receive hands the manager alice's message with the given sequence number
+func (st *sequencerTest) receive(seq int64, mode receiveMode) {
+	st.m.receiveMessage(&DirectMessage{
+		MessageID:    seq,
+		FromUsername: st.alice.Username,
+		FromPeerID:   st.alice.PeerID,
+		ToUsername:   st.bob.Username,
+		Content:      fmt.Sprintf("m%d", seq),
+		Seq:          seq,
+		Timestamp:    time.Now().Unix(),
+	}, st.sender.ID(), mode)
+}
+
+// stored returns the sequence numbers stored, in the order they were stored
+func (st *sequencerTest) stored() []int64 {
+	msgs, err := st.store.GetMessages(context.Background(), st.bob.ID, st.alice.ID, 1000)
+	if err != nil {
+		st.t.Fatalf("failed to get messages: %v", err)
+	}
+	seqs := make([]int64, 0, len(msgs))
+	for i := len(msgs) - 1; i >= 0; i-- {
+		seqs = append(seqs, msgs[i].Seq)
+	}
+	return seqs
+}
+
+// sorted returns a sorted copy of the recorded sequence numbers
+func (st *sequencerTest) sorted(recorded *[]int64) []int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	seqs := append([]int64(nil), (*recorded)...)
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// eventually fails the test unless got matches want within a few seconds
+func (st *sequencerTest) eventually(what string, got func() []int64, want []int64) {
+	st.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		seqs := got()
+		if fmt.Sprint(seqs) == fmt.Sprint(want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			st.t.Fatalf("%s = %v, want %v", what, seqs, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// seqRange returns from..to inclusive
+func seqRange(from, to int64) []int64 {
+	var seqs []int64
+	for seq := from; seq <= to; seq++ {
+		seqs = append(seqs, seq)
+	}
+	return seqs
+}
+
+func TestSequencer(t *testing.T) {
+	type step struct {
+		seqs  []int64
+		mode  receiveMode
+		pause time.Duration // Before delivering
+	}
+
+	tests := []struct {
+		name      string
+		wait      time.Duration // reorderWait
+		steps     []step
+		stored    []int64
+		acked     []int64
+		requested []int64
+	}{
+		{
+			name:   "in order",
+			wait:   time.Minute,
+			steps:  []step{{seqs: []int64{1, 2, 3}, mode: receiveDirect}},
+			stored: []int64{1, 2, 3},
+			acked:  []int64{1, 2, 3},
+		},
+		{
+			name: "early message held until the gap is backfilled",
+			wait: time.Minute,
+			steps: []step{
+				{seqs: []int64{3, 2}, mode: receiveDirect},
+				{seqs: []int64{1}, mode: receiveBackfill},
+			},
+			stored:    []int64{1, 2, 3},
+			acked:     []int64{1, 2, 3},
+			requested: []int64{1, 2},
+		},
+		{
+			name: "held messages flushed after reorderWait",
+			wait: 50 * time.Millisecond,
+			steps: []step{
+				{seqs: []int64{3}, mode: receiveDirect},
+				{seqs: []int64{1}, mode: receiveBackfill, pause: 300 * time.Millisecond},
+			},
+			stored:    []int64{3, 1},
+			acked:     []int64{1, 3},
+			requested: []int64{1, 2},
+		},
+		{
+			name: "duplicate acked and dropped",
+			wait: time.Minute,
+			steps: []step{
+				{seqs: []int64{1, 1}, mode: receiveDirect},
+				{seqs: []int64{1}, mode: receiveBackfill},
+			},
+			stored: []int64{1},
+			acked:  []int64{1, 1, 1},
+		},
+		{
+			name: "duplicate of a held message ignored",
+			wait: time.Minute,
+			steps: []step{
+				{seqs: []int64{2, 2}, mode: receiveDirect},
+				{seqs: []int64{1}, mode: receiveBackfill},
+			},
+			stored:    []int64{1, 2},
+			acked:     []int64{1, 2},
+			requested: []int64{1},
+		},
+		{
+			name: "deposited messages held but not acked or backfilled",
+			wait: time.Minute,
+			steps: []step{
+				{seqs: []int64{2}, mode: receiveDeposited},
+				{seqs: []int64{1}, mode: receiveDeposited},
+			},
+			stored: []int64{1, 2},
+		},
+		{
+			name: "overflow stored as it comes",
+			wait: time.Minute,
+			steps: []step{
+				{seqs: seqRange(2, maxHeldMessages+1), mode: receiveDirect},
+				{seqs: []int64{maxHeldMessages + 2}, mode: receiveDirect},
+			},
+			stored: []int64{maxHeldMessages + 2},
+			acked:  []int64{maxHeldMessages + 2},
+			// The gap once when holding starts, then everything before the
+			// message stored out of order, held ones included
+			requested: append([]int64{1}, seqRange(1, MaxBackfillSeqs)...),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := reorderWait
+			reorderWait = tt.wait
+			t.Cleanup(func() { reorderWait = saved })
+
+			st := newSequencerTest(t)
+			for _, step := range tt.steps {
+				time.Sleep(step.pause)
+				for _, seq := range step.seqs {
+					st.receive(seq, step.mode)
+				}
+			}
+
+			st.eventually("stored", st.stored, tt.stored)
+			st.eventually("acked", func() []int64 { return st.sorted(&st.acked) }, tt.acked)
+			st.eventually("requested", func() []int64 { return st.sorted(&st.requested) }, tt.requested)
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package messages
+
+import (
+	"fmt"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// Proto returns the message's protobuf form
+func (m *DirectMessage) Proto() proto.Message {
+	wire := &pb.DirectMessage{
+		MessageId:    m.MessageID,
+		FromUsername: m.FromUsername,
+		FromFullName: m.FromFullName,
+		FromPeerId:   m.FromPeerID,
+		ToUsername:   m.ToUsername,
+		Content:      m.Content,
+		Kind:         m.Kind,
+		Lamport:      m.Lamport,
+		Seq:          m.Seq,
+		Timestamp:    m.Timestamp,
+		Encoding:     m.Encoding,
+		Compressed:   m.Compressed,
+	}
+	if h := m.ForwardedFrom; h != nil {
+		wire.ForwardedFrom = &pb.ForwardHeader{Username: h.Username, FullName: h.FullName, PeerId: h.PeerID, Timestamp: h.Timestamp}
+	}
+	if q := m.Quote; q != nil {
+		wire.Quote = &pb.QuoteSnapshot{Username: q.Username, FullName: q.FullName, PeerId: q.PeerID, Timestamp: q.Timestamp, Excerpt: q.Excerpt}
+	}
+	if g := m.Group; g != nil {
+		wire.GroupId = g.ID
+		wire.GroupName = g.Name
+		wire.GroupMessageId = g.MessageID
+		wire.GroupLeft = g.Left
+		for _, member := range g.Members {
+			wire.GroupMembers = append(wire.GroupMembers, member.PeerID)
+			wire.GroupUsernames = append(wire.GroupUsernames, member.Username)
+		}
+	}
+	return wire
+}
+
+// Proto returns the ack's protobuf form
+func (a *MessageAck) Proto() proto.Message {
+	return &pb.MessageAck{MessageId: a.MessageID, FromPeer: a.FromPeer, ToPeer: a.ToPeer, Timestamp: a.Timestamp, GroupId: a.GroupID}
+}
+
+// Proto returns the read receipt's protobuf form
+func (r *MessageRead) Proto() proto.Message {
+	return &pb.MessageRead{MessageId: r.MessageID, FromPeer: r.FromPeer, ToPeer: r.ToPeer, Timestamp: r.Timestamp}
+}
+
+// Proto returns the read batch's protobuf form
+func (b *MessageReadBatch) Proto() proto.Message {
+	return &pb.MessageReadBatch{Seqs: b.Seqs, FromPeer: b.FromPeer, ToPeer: b.ToPeer, Timestamp: b.Timestamp}
+}
+
+// Proto returns the request's protobuf form
+func (r *BackfillRequest) Proto() proto.Message {
+	return &pb.BackfillRequest{FromPeer: r.FromPeer, Seqs: r.Seqs}
+}
+
+// DecodeDirectMessageProto validates a direct message read from a protobuf stream
+func DecodeDirectMessageProto(wire *pb.DirectMessage) (*DirectMessage, error) {
+	message := &DirectMessage{
+		MessageID:    wire.MessageId,
+		FromUsername: wire.FromUsername,
+		FromFullName: wire.FromFullName,
+		FromPeerID:   wire.FromPeerId,
+		ToUsername:   wire.ToUsername,
+		Content:      wire.Content,
+		Kind:         wire.Kind,
+		Lamport:      wire.Lamport,
+		Seq:          wire.Seq,
+		Timestamp:    wire.Timestamp,
+		Encoding:     wire.Encoding,
+		Compressed:   wire.Compressed,
+	}
+	if h := wire.ForwardedFrom; h != nil {
+		message.ForwardedFrom = &ForwardHeader{Username: h.Username, FullName: h.FullName, PeerID: h.PeerId, Timestamp: h.Timestamp}
+	}
+	if q := wire.Quote; q != nil {
+		message.Quote = &QuoteSnapshot{Username: q.Username, FullName: q.FullName, PeerID: q.PeerId, Timestamp: q.Timestamp, Excerpt: q.Excerpt}
+	}
+	if wire.GroupId != "" {
+		if len(wire.GroupMembers) != len(wire.GroupUsernames) {
+			return nil, fmt.Errorf("group has %d members but %d usernames", len(wire.GroupMembers), len(wire.GroupUsernames))
+		}
+		message.Group = &GroupHeader{ID: wire.GroupId, Name: wire.GroupName, MessageID: wire.GroupMessageId, Left: wire.GroupLeft}
+		for i, peerID := range wire.GroupMembers {
+			message.Group.Members = append(message.Group.Members, &GroupMemberInfo{PeerID: peerID, Username: wire.GroupUsernames[i]})
+		}
+	}
+	if err := checkDirectMessage(message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// DecodeMessageAckProto validates a delivery acknowledgment read from a protobuf stream
+func DecodeMessageAckProto(wire *pb.MessageAck) (*MessageAck, error) {
+	ack := &MessageAck{MessageID: wire.MessageId, FromPeer: wire.FromPeer, ToPeer: wire.ToPeer, Timestamp: wire.Timestamp, GroupID: wire.GroupId}
+	if err := checkMessageAck(ack); err != nil {
+		return nil, err
+	}
+	return ack, nil
+}
+
+// DecodeMessageReadProto validates a read receipt read from a protobuf stream
+func DecodeMessageReadProto(wire *pb.MessageRead) (*MessageRead, error) {
+	if err := checkReceipt(wire.MessageId, wire.FromPeer, wire.ToPeer, wire.Timestamp); err != nil {
+		return nil, err
+	}
+	return &MessageRead{MessageID: wire.MessageId, FromPeer: wire.FromPeer, ToPeer: wire.ToPeer, Timestamp: wire.Timestamp}, nil
+}
+
+// DecodeMessageReadBatchProto validates a read batch read from a protobuf
+// stream. Batches listing more than MaxReadBatchSeqs messages are truncated.
+func DecodeMessageReadBatchProto(wire *pb.MessageReadBatch) (*MessageReadBatch, error) {
+	batch := &MessageReadBatch{Seqs: wire.Seqs, FromPeer: wire.FromPeer, ToPeer: wire.ToPeer, Timestamp: wire.Timestamp}
+	if err := checkMessageReadBatch(batch); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// DecodeBackfillRequestProto validates a backfill request read from a protobuf
+// stream. Requests for more than MaxBackfillSeqs messages are truncated.
+func DecodeBackfillRequestProto(wire *pb.BackfillRequest) (*BackfillRequest, error) {
+	request := &BackfillRequest{FromPeer: wire.FromPeer, Seqs: wire.Seqs}
+	if err := checkBackfillRequest(request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// readDirectMessage reads and validates the next direct message on a stream
+func readDirectMessage(ws *p2p.WireStream) (*DirectMessage, error) {
+	var wire pb.DirectMessage
+	data, err := ws.ReadMessage(&wire)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Protobuf() {
+		return DecodeDirectMessageProto(&wire)
+	}
+	return DecodeDirectMessage(data)
+}
+
+// readMessageAck reads and validates a delivery acknowledgment from a stream
+func readMessageAck(ws *p2p.WireStream) (*MessageAck, error) {
+	var wire pb.MessageAck
+	data, err := ws.ReadMessage(&wire)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Protobuf() {
+		return DecodeMessageAckProto(&wire)
+	}
+	return DecodeMessageAck(data)
+}
+
+// readMessageRead reads and validates a read receipt from a stream
+func readMessageRead(ws *p2p.WireStream) (*MessageRead, error) {
+	var wire pb.MessageRead
+	data, err := ws.ReadMessage(&wire)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Protobuf() {
+		return DecodeMessageReadProto(&wire)
+	}
+	return DecodeMessageRead(data)
+}
+
+// readMessageReadBatch reads and validates the next read batch on a stream
+func readMessageReadBatch(ws *p2p.WireStream) (*MessageReadBatch, error) {
+	var wire pb.MessageReadBatch
+	data, err := ws.ReadMessage(&wire)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Protobuf() {
+		return DecodeMessageReadBatchProto(&wire)
+	}
+	return DecodeMessageReadBatch(data)
+}
+
+// readBackfillRequest reads and validates a backfill request from a stream
+func readBackfillRequest(ws *p2p.WireStream) (*BackfillRequest, error) {
+	var wire pb.BackfillRequest
+	data, err := ws.ReadMessage(&wire)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Protobuf() {
+		return DecodeBackfillRequestProto(&wire)
+	}
+	return DecodeBackfillRequest(data)
+}
@@ -1,12 +1,12 @@
 package messages
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
@@ -17,6 +17,22 @@ const (
 	ProtocolDirectMessage = protocol.ID("/whisper/message/direct/1.0.0")
 	ProtocolMessageAck    = protocol.ID("/whisper/message/ack/1.0.0")
 	ProtocolMessageRead   = protocol.ID("/whisper/message/read/1.0.0")
+	ProtocolBackfill      = protocol.ID("/whisper/message/backfill/1.0.0")
+	ProtocolReadBatch     = protocol.ID("/whisper/message/read-batch/1.0.0")
+
+	// Protobuf versions of the protocols above, preferred when both sides speak them
+	ProtocolDirectMessageV2 = protocol.ID("/whisper/message/direct/2.0.0")
+	ProtocolMessageAckV2    = protocol.ID("/whisper/message/ack/2.0.0")
+	ProtocolMessageReadV2   = protocol.ID("/whisper/message/read/2.0.0")
+	ProtocolBackfillV2      = protocol.ID("/whisper/message/backfill/2.0.0")
+	ProtocolReadBatchV2     = protocol.ID("/whisper/message/read-batch/2.0.0")
+
+	// MaxBackfillSeqs caps how many missing messages one backfill request may ask for
+	MaxBackfillSeqs = 100
+
+	// MaxReadBatchSeqs caps how many messages one read batch may list; longer
+	// runs of receipts are split across several batches on the same stream
+	MaxReadBatchSeqs = 1000
 )
 
 // DirectMessage represents a direct message between users
@@ -27,7 +43,69 @@ type DirectMessage struct {
 	FromPeerID   string `json:"from_peer_id"`
 	ToUsername   string `json:"to_username"`
 	Content      string `json:"content"`
-	Timestamp    int64  `json:"timestamp"` // Unix timestamp
+	Kind         string `json:"kind,omitempty"`    // user (default), or system on a group notice
+	Lamport      int64  `json:"lamport,omitempty"` // Sender's logical clock for the conversation
+	Seq          int64  `json:"seq,omitempty"`     // Sender's sequence number for the conversation
+	Timestamp    int64  `json:"timestamp"`         // Unix timestamp
+
+	ForwardedFrom *ForwardHeader `json:"forwarded_from,omitempty"` // Original author of a forwarded message
+	Quote         *QuoteSnapshot `json:"quote,omitempty"`          // Message being replied to
+	Group         *GroupHeader   `json:"group,omitempty"`          // Group the message was sent to, if any
+
+	// Long content may travel compressed to peers that advertise support; Content
+	// is then empty until DecodeDirectMessage restores it
+	Encoding   string `json:"encoding,omitempty"`   // Compression of Compressed, e.g. zstd
+	Compressed []byte `json:"compressed,omitempty"` // Content, compressed
+}
+
+// compress moves long content into Compressed when that makes the message smaller
+func (m *DirectMessage) compress() {
+	if len(m.Content) < p2p.CompressionThreshold {
+		return
+	}
+	compressed := p2p.Compress([]byte(m.Content))
+	// JSON carries bytes as base64, a third larger
+	if len(compressed)*4/3 >= len(m.Content) {
+		return
+	}
+	m.Encoding = p2p.EncodingZstd
+	m.Compressed = compressed
+	m.Content = ""
+}
+
+// ForwardHeader attributes a forwarded message to its original author
+type ForwardHeader struct {
+	Username  string `json:"username"`
+	FullName  string `json:"full_name,omitempty"`
+	PeerID    string `json:"peer_id,omitempty"`
+	Timestamp int64  `json:"timestamp"` // When the original was written (Unix)
+}
+
+// QuoteSnapshot carries enough of a replied-to message to show it in context,
+// whether or not the recipient has the original
+type QuoteSnapshot struct {
+	Username  string `json:"username"`
+	FullName  string `json:"full_name,omitempty"`
+	PeerID    string `json:"peer_id,omitempty"`
+	Timestamp int64  `json:"timestamp"` // When the quoted message was written (Unix)
+	Excerpt   string `json:"excerpt"`   // First QuoteExcerptLength characters
+}
+
+// GroupHeader marks a direct message as one copy of a group message. Only
+// peers that advertise p2p.CapabilityGroups are sent one; older nodes would
+// take it for a direct message.
+type GroupHeader struct {
+	ID        string             `json:"id"` // Random ID shared by every member's copy of the group
+	Name      string             `json:"name"`
+	Members   []*GroupMemberInfo `json:"members"`        // Everyone in the group, the sender included
+	MessageID int64              `json:"message_id"`     // Sender's ID for the group message, echoed in acks
+	Left      bool               `json:"left,omitempty"` // The sender left the group
+}
+
+// GroupMemberInfo names one member of a group
+type GroupMemberInfo struct {
+	PeerID   string `json:"peer_id"`
+	Username string `json:"username"` // What the member calls themselves
 }
 
 // MessageAck represents acknowledgment that a message was received
@@ -36,6 +114,7 @@ type MessageAck struct {
 	FromPeer  string `json:"from_peer"`
 	ToPeer    string `json:"to_peer"`
 	Timestamp int64  `json:"timestamp"`
+	GroupID   string `json:"group_id,omitempty"` // Set for a group message; MessageID is then the group header's
 }
 
 // MessageRead represents notification that a message was read
@@ -46,11 +125,29 @@ type MessageRead struct {
 	Timestamp int64  `json:"timestamp"`
 }
 
+// MessageReadBatch tells a sender which of their messages were read, by the
+// sender's sequence numbers for the conversation
+type MessageReadBatch struct {
+	Seqs      []int64 `json:"seqs"`
+	FromPeer  string  `json:"from_peer"`
+	ToPeer    string  `json:"to_peer"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+// BackfillRequest asks a sender to resend messages we never received
+type BackfillRequest struct {
+	FromPeer string  `json:"from_peer"`
+	Seqs     []int64 `json:"seqs"` // Sender's sequence numbers that are missing
+}
+
 // Protocol handles direct messaging protocol
 type Protocol struct {
-	messageHandler func(message *DirectMessage, fromPeer peer.ID)
-	ackHandler     func(ack *MessageAck, fromPeer peer.ID)
-	readHandler    func(read *MessageRead, fromPeer peer.ID)
+	messageHandler   func(message *DirectMessage, fromPeer peer.ID)
+	ackHandler       func(ack *MessageAck, fromPeer peer.ID)
+	readHandler      func(read *MessageRead, fromPeer peer.ID)
+	readBatchHandler func(batch *MessageReadBatch, fromPeer peer.ID)
+	backfillHandler  func(request *BackfillRequest, fromPeer peer.ID) []*DirectMessage
+	invalidHandler   func(fromPeer peer.ID)
 }
 
 // NewProtocol creates a new message protocol handler
@@ -73,25 +170,28 @@ func (p *Protocol) SetReadHandler(handler func(*MessageRead, peer.ID)) {
 	p.readHandler = handler
 }
 
+// SetReadBatchHandler sets the handler for batched read receipts
+func (p *Protocol) SetReadBatchHandler(handler func(*MessageReadBatch, peer.ID)) {
+	p.readBatchHandler = handler
+}
+
+// SetBackfillHandler sets the handler that answers backfill requests
+func (p *Protocol) SetBackfillHandler(handler func(*BackfillRequest, peer.ID) []*DirectMessage) {
+	p.backfillHandler = handler
+}
+
+// SetInvalidHandler sets the handler told about peers that send malformed messages
+func (p *Protocol) SetInvalidHandler(handler func(peer.ID)) {
+	p.invalidHandler = handler
+}
+
 // HandleDirectMessage handles incoming direct messages
 func (p *Protocol) HandleDirectMessage(s network.Stream) {
 	defer s.Close()
 
-	reader := bufio.NewReader(s)
-	data, err := reader.ReadBytes('\n')
-	if err != nil && err != io.EOF {
-		fmt.Printf("Error reading direct message: %v\n", err)
-		return
-	}
-
-	var message DirectMessage
-	if err := json.Unmarshal(data, &message); err != nil {
-		fmt.Printf("Error unmarshaling direct message: %v\n", err)
-		return
-	}
-
-	if p.messageHandler != nil {
-		p.messageHandler(&message, s.Conn().RemotePeer())
+	message, ok := p2p.ReadRequest(p2p.NewWireStream(s), "Error reading direct message: %v\n", readDirectMessage, p.invalidHandler)
+	if ok && p.messageHandler != nil {
+		p.messageHandler(message, s.Conn().RemotePeer())
 	}
 }
 
@@ -99,61 +199,89 @@ func (p *Protocol) HandleDirectMessage(s network.Stream) {
 func (p *Protocol) HandleMessageAck(s network.Stream) {
 	defer s.Close()
 
-	reader := bufio.NewReader(s)
-	data, err := reader.ReadBytes('\n')
-	if err != nil && err != io.EOF {
-		fmt.Printf("Error reading message ack: %v\n", err)
-		return
+	ack, ok := p2p.ReadRequest(p2p.NewWireStream(s), "Error reading message ack: %v\n", readMessageAck, p.invalidHandler)
+	if ok && p.ackHandler != nil {
+		p.ackHandler(ack, s.Conn().RemotePeer())
 	}
+}
 
-	var ack MessageAck
-	if err := json.Unmarshal(data, &ack); err != nil {
-		fmt.Printf("Error unmarshaling message ack: %v\n", err)
-		return
+// HandleMessageRead handles message read receipts
+func (p *Protocol) HandleMessageRead(s network.Stream) {
+	defer s.Close()
+
+	read, ok := p2p.ReadRequest(p2p.NewWireStream(s), "Error reading message read: %v\n", readMessageRead, p.invalidHandler)
+	if ok && p.readHandler != nil {
+		p.readHandler(read, s.Conn().RemotePeer())
 	}
+}
 
-	if p.ackHandler != nil {
-		p.ackHandler(&ack, s.Conn().RemotePeer())
+// HandleMessageReadBatch handles batched read receipts, one batch after
+// another until the end of the stream
+func (p *Protocol) HandleMessageReadBatch(s network.Stream) {
+	defer s.Close()
+
+	ws := p2p.NewWireStream(s)
+	for {
+		batch, ok := p2p.ReadRequest(ws, "Error reading message read batch: %v\n", readMessageReadBatch, p.invalidHandler)
+		if !ok {
+			return
+		}
+
+		if p.readBatchHandler != nil {
+			p.readBatchHandler(batch, s.Conn().RemotePeer())
+		}
 	}
 }
 
-// HandleMessageRead handles message read receipts
-func (p *Protocol) HandleMessageRead(s network.Stream) {
+// HandleBackfill answers a backfill request with the resent messages, one after another
+func (p *Protocol) HandleBackfill(s network.Stream) {
 	defer s.Close()
 
-	reader := bufio.NewReader(s)
-	data, err := reader.ReadBytes('\n')
-	if err != nil && err != io.EOF {
-		fmt.Printf("Error reading message read: %v\n", err)
+	ws := p2p.NewWireStream(s)
+	request, ok := p2p.ReadRequest(ws, "Error reading backfill request: %v\n", readBackfillRequest, p.invalidHandler)
+	if !ok || p.backfillHandler == nil {
 		return
 	}
 
-	var read MessageRead
-	if err := json.Unmarshal(data, &read); err != nil {
-		fmt.Printf("Error unmarshaling message read: %v\n", err)
-		return
+	for _, message := range p.backfillHandler(request, s.Conn().RemotePeer()) {
+		if err := ws.WriteMessage(message); err != nil {
+			i18n.Printf("Error writing backfill message: %v\n", err)
+			return
+		}
 	}
+}
+
+// RequestBackfill sends a backfill request and reads the resent messages
+func RequestBackfill(ctx context.Context, s network.Stream, request *BackfillRequest) ([]*DirectMessage, error) {
+	defer s.Close()
 
-	if p.readHandler != nil {
-		p.readHandler(&read, s.Conn().RemotePeer())
+	ws := p2p.NewWireStream(s)
+	if err := ws.WriteMessage(request); err != nil {
+		return nil, fmt.Errorf("failed to write backfill request: %w", err)
+	}
+	s.CloseWrite()
+
+	messages := []*DirectMessage{}
+	for len(messages) < MaxBackfillSeqs {
+		message, err := readDirectMessage(ws)
+		if err == io.EOF {
+			return messages, nil
+		}
+		if err != nil {
+			return messages, fmt.Errorf("failed to read backfill message: %w", err)
+		}
+		messages = append(messages, message)
 	}
+	return messages, nil
 }
 
 // SendDirectMessage sends a direct message to a peer
 func SendDirectMessage(ctx context.Context, s network.Stream, message *DirectMessage) error {
 	defer s.Close()
 
-	data, err := json.Marshal(message)
-	if err != nil {
-		return fmt.Errorf("failed to marshal message: %w", err)
-	}
-
-	data = append(data, '\n')
-	_, err = s.Write(data)
-	if err != nil {
+	if err := p2p.NewWireStream(s).WriteMessage(message); err != nil {
 		return fmt.Errorf("failed to write message: %w", err)
 	}
-
 	return nil
 }
 
@@ -161,17 +289,9 @@ func SendDirectMessage(ctx context.Context, s network.Stream, message *DirectMes
 func SendMessageAck(ctx context.Context, s network.Stream, ack *MessageAck) error {
 	defer s.Close()
 
-	data, err := json.Marshal(ack)
-	if err != nil {
-		return fmt.Errorf("failed to marshal ack: %w", err)
-	}
-
-	data = append(data, '\n')
-	_, err = s.Write(data)
-	if err != nil {
+	if err := p2p.NewWireStream(s).WriteMessage(ack); err != nil {
 		return fmt.Errorf("failed to write ack: %w", err)
 	}
-
 	return nil
 }
 
@@ -179,16 +299,27 @@ func SendMessageAck(ctx context.Context, s network.Stream, ack *MessageAck) erro
 func SendMessageRead(ctx context.Context, s network.Stream, read *MessageRead) error {
 	defer s.Close()
 
-	data, err := json.Marshal(read)
-	if err != nil {
-		return fmt.Errorf("failed to marshal read: %w", err)
-	}
-
-	data = append(data, '\n')
-	_, err = s.Write(data)
-	if err != nil {
+	if err := p2p.NewWireStream(s).WriteMessage(read); err != nil {
 		return fmt.Errorf("failed to write read: %w", err)
 	}
+	return nil
+}
 
+// SendMessageReadBatch sends read receipts for the given sequence numbers to a
+// peer, split into batches of at most MaxReadBatchSeqs
+func SendMessageReadBatch(ctx context.Context, s network.Stream, batch *MessageReadBatch) error {
+	defer s.Close()
+
+	ws := p2p.NewWireStream(s)
+	seqs := batch.Seqs
+	for len(seqs) > 0 {
+		n := min(len(seqs), MaxReadBatchSeqs)
+		part := *batch
+		part.Seqs = seqs[:n]
+		if err := ws.WriteMessage(&part); err != nil {
+			return fmt.Errorf("failed to write read batch: %w", err)
+		}
+		seqs = seqs[n:]
+	}
 	return nil
 }
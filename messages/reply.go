@@ -0,0 +1,104 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/austinwklein/whisper/storage"
+)
+
+// QuoteExcerptLength is how many characters of the replied-to message a reply carries
+const QuoteExcerptLength = 200
+
+// ErrReplySystem is returned when asked to reply to a local system message
+var ErrReplySystem = errors.New("system messages can't be replied to")
+
+// Reply sends content quoting one of the user's messages. With toUsername empty
+// it goes to the other side of that message's conversation; otherwise it can go
+// to any friend, who sees the quote even though they never had the original.
+func (m *Manager) Reply(ctx context.Context, currentUser *storage.User, messageID int64, toUsername, content string) error {
+	msg, err := m.storage.GetMessage(ctx, currentUser.ID, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to load message: %w", err)
+	}
+	if msg == nil {
+		return storage.ErrMessageNotFound
+	}
+	if msg.IsSystem() {
+		return ErrReplySystem
+	}
+
+	if toUsername == "" {
+		otherID := msg.FromUserID
+		if otherID == currentUser.ID {
+			otherID = msg.ToUserID
+		}
+		other, err := m.storage.GetUserByID(ctx, otherID)
+		if err != nil {
+			return fmt.Errorf("failed to look up the conversation's other side")
+		}
+		toUsername = other.Username
+	}
+
+	quote := &storage.QuoteInfo{Excerpt: quoteExcerpt(msg.Content)}
+	if msg.Forwarded != nil {
+		// Quote whoever wrote it, not whoever passed it on
+		quote.Username = msg.Forwarded.Username
+		quote.FullName = msg.Forwarded.FullName
+		quote.PeerID = msg.Forwarded.PeerID
+		quote.SentAt = msg.Forwarded.SentAt
+	} else {
+		author, err := m.storage.GetUserByID(ctx, msg.FromUserID)
+		if err != nil {
+			return fmt.Errorf("failed to look up the message's author")
+		}
+		quote.Username = author.RemoteName()
+		quote.FullName = author.FullName
+		quote.PeerID = author.PeerID
+		quote.SentAt = msg.CreatedAt
+	}
+
+	return m.send(ctx, currentUser, toUsername, content, nil, quote, m.ttl())
+}
+
+// quoteExcerpt returns the start of content on one line, at most
+// QuoteExcerptLength characters plus an ellipsis
+func quoteExcerpt(content string) string {
+	excerpt := strings.Join(strings.Fields(content), " ")
+	runes := []rune(excerpt)
+	if len(runes) > QuoteExcerptLength {
+		return string(runes[:QuoteExcerptLength]) + "…"
+	}
+	return excerpt
+}
+
+// quoteSnapshot converts a stored quote to its wire form
+func quoteSnapshot(info *storage.QuoteInfo) *QuoteSnapshot {
+	if info == nil {
+		return nil
+	}
+	return &QuoteSnapshot{
+		Username:  info.Username,
+		FullName:  info.FullName,
+		PeerID:    info.PeerID,
+		Timestamp: info.SentAt.Unix(),
+		Excerpt:   info.Excerpt,
+	}
+}
+
+// quoteInfo converts a received quote snapshot to its stored form
+func quoteInfo(snapshot *QuoteSnapshot) *storage.QuoteInfo {
+	if snapshot == nil {
+		return nil
+	}
+	return &storage.QuoteInfo{
+		Username: snapshot.Username,
+		FullName: snapshot.FullName,
+		PeerID:   snapshot.PeerID,
+		SentAt:   time.Unix(snapshot.Timestamp, 0),
+		Excerpt:  snapshot.Excerpt,
+	}
+}
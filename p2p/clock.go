@@ -0,0 +1,103 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// ProtocolTime answers with the node's current time, so peers can tell
+	// how far their clocks disagree
+	ProtocolTime = "/whisper/time/1.0.0"
+
+	// ClockSkewTolerance is how far a peer's clock may drift from ours before
+	// its timestamps are corrected and the user is warned
+	ClockSkewTolerance = 2 * time.Minute
+
+	// timeTimeout bounds one clock measurement
+	timeTimeout = 10 * time.Second
+
+	clockSkewStoreKey = "whisper/clock-skew"
+)
+
+// MeasureClockSkew asks a connected peer for its time and returns how far
+// ahead of ours its clock runs (negative when behind). The round trip is
+// split evenly, as NTP does. The result is kept for ClockSkew.
+func (p *P2PHost) MeasureClockSkew(ctx context.Context, pid peer.ID) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeTimeout)
+	defer cancel()
+
+	started := time.Now()
+	s, err := p.host.NewStream(network.WithNoDial(ctx, "clock"), pid, ProtocolTime)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open time stream: %w", err)
+	}
+	defer s.Close()
+	s.SetDeadline(started.Add(timeTimeout))
+	s.CloseWrite()
+
+	reply, err := ReadWireMessage(bufio.NewReader(s))
+	if err != nil {
+		s.Reset()
+		return 0, fmt.Errorf("no time reply: %w", err)
+	}
+	finished := time.Now()
+	remote, err := strconv.ParseInt(strings.TrimSpace(string(reply)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time reply: %w", err)
+	}
+
+	midpoint := started.Add(finished.Sub(started) / 2)
+	skew := time.Unix(0, remote).Sub(midpoint)
+	if err := p.host.Peerstore().Put(pid, clockSkewStoreKey, skew); err != nil {
+		return 0, fmt.Errorf("failed to record clock skew: %w", err)
+	}
+	return skew, nil
+}
+
+// handleTime tells the peer our current time, in Unix nanoseconds
+func (p *P2PHost) handleTime(s network.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(timeTimeout))
+	s.Write([]byte(strconv.FormatInt(time.Now().UnixNano(), 10) + "\n"))
+}
+
+// ClockSkew returns how far ahead of ours a peer's clock was last measured
+// to run, and whether it has been measured at all
+func ClockSkew(h host.Host, pid peer.ID) (time.Duration, bool) {
+	value, err := h.Peerstore().Get(pid, clockSkewStoreKey)
+	if err != nil {
+		return 0, false
+	}
+	skew, ok := value.(time.Duration)
+	return skew, ok
+}
+
+// NormalizeTimestamp turns a Unix timestamp a peer stamped with its own clock
+// into local time for storage and display ordering:
+//   - a missing timestamp means the message was just received
+//   - a peer whose clock is measured to be off by more than ClockSkewTolerance
+//     has the difference taken back out
+//   - nothing can have been sent after it arrived, so later times are clamped
+//     to the receive time
+func NormalizeTimestamp(h host.Host, from peer.ID, sent int64, received time.Time) time.Time {
+	if sent <= 0 {
+		return received
+	}
+	t := time.Unix(sent, 0)
+	if skew, ok := ClockSkew(h, from); ok && (skew > ClockSkewTolerance || skew < -ClockSkewTolerance) {
+		t = t.Add(-skew)
+	}
+	if t.After(received) {
+		return received
+	}
+	return t
+}
@@ -0,0 +1,115 @@
+package p2p
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtobufVersion is the protocol version that carries protobuf messages (see
+// package pb). Each message is prefixed with its length as a varint. Version
+// 1.0.0 of the same protocol carries newline-delimited JSON.
+const ProtobufVersion = "2.0.0"
+
+// WireMessage is a wire message with a protobuf form
+type WireMessage interface {
+	Proto() proto.Message
+}
+
+// IsProtobufProtocol reports whether a protocol ID is a protobuf version
+func IsProtobufProtocol(id protocol.ID) bool {
+	return strings.HasSuffix(string(id), "/"+ProtobufVersion)
+}
+
+// WireStream reads and writes a stream's messages in the encoding of the
+// protocol version it negotiated
+type WireStream struct {
+	network.Stream
+	reader   *bufio.Reader
+	protobuf bool
+	received bool // The last ReadMessage got a whole message off the stream
+}
+
+// NewWireStream wraps a stream whose protocol has been negotiated
+func NewWireStream(s network.Stream) *WireStream {
+	return &WireStream{
+		Stream:   s,
+		reader:   bufio.NewReader(s),
+		protobuf: IsProtobufProtocol(s.Protocol()),
+	}
+}
+
+// Protobuf reports whether the stream carries protobuf rather than JSON
+func (w *WireStream) Protobuf() bool {
+	return w.protobuf
+}
+
+// ReadMessage reads the next message. On a protobuf stream it is unmarshaled
+// into pbMessage and nil is returned; on a JSON stream the line is returned for
+// the caller to decode. It returns io.EOF when the stream ended cleanly.
+func (w *WireStream) ReadMessage(pbMessage proto.Message) ([]byte, error) {
+	var data []byte
+	var err error
+	if w.protobuf {
+		err = ReadProtoMessage(w.reader, pbMessage)
+	} else {
+		data, err = ReadWireMessage(w.reader)
+	}
+	w.received = err == nil
+	return data, err
+}
+
+// Malformed reports whether err, from reading and decoding a message off the
+// stream, is the peer's doing: the message was too large, or arrived whole but
+// failed to unmarshal or validate. Failures of the stream itself are not.
+func (w *WireStream) Malformed(err error) bool {
+	return err != nil && (w.received || errors.Is(err, ErrMessageTooLarge) || errors.Is(err, proto.Error))
+}
+
+// WriteMessage writes a message in the stream's encoding
+func (w *WireStream) WriteMessage(message WireMessage) error {
+	if w.protobuf {
+		return WriteProtoMessage(w.Stream, message.Proto())
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	_, err = w.Stream.Write(append(data, '\n'))
+	return err
+}
+
+// ReadProtoMessage reads one length-prefixed protobuf message of at most
+// MaxWireMessageSize bytes into m. It returns io.EOF only when the stream ended
+// before the length prefix.
+func ReadProtoMessage(r *bufio.Reader, m proto.Message) error {
+	err := protodelim.UnmarshalOptions{MaxSize: MaxWireMessageSize}.UnmarshalFrom(r, m)
+	var tooLarge *protodelim.SizeTooLargeError
+	switch {
+	case err == nil, err == io.EOF:
+		return err
+	case errors.As(err, &tooLarge):
+		return ErrMessageTooLarge
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("truncated protobuf message: %w", err)
+	default:
+		return fmt.Errorf("failed to unmarshal %s: %w", m.ProtoReflect().Descriptor().Name(), err)
+	}
+}
+
+// WriteProtoMessage writes m prefixed with its length
+func WriteProtoMessage(w io.Writer, m proto.Message) error {
+	if proto.Size(m) > MaxWireMessageSize {
+		return ErrMessageTooLarge
+	}
+	_, err := protodelim.MarshalTo(w, m)
+	return err
+}
@@ -0,0 +1,110 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Capabilities a node advertises in the identify exchange. A peer only uses an
+// optional wire feature once the other side has listed it.
+const (
+	CapabilityZstd   = "zstd"   // Accepts zstd-compressed message content
+	CapabilityGroups = "groups" // Understands group messages carried on direct messages
+
+	// CapabilityReceiptsOff tells a peer not to wait for read receipts that
+	// will never come. Older nodes never list it, which is right: they always
+	// send them.
+	CapabilityReceiptsOff = "receipts-off"
+
+	// CapabilityConfRequestsOff tells conference members not to send friend
+	// requests; the node drops them
+	CapabilityConfRequestsOff = "conf-requests-off"
+
+	// CapabilityPresenceHidden asks a peer not to show this node as online or
+	// record when it was last seen
+	CapabilityPresenceHidden = "presence-hidden"
+
+	// CapabilityAway tells peers the node is draining before it stops, so
+	// they show it as away rather than online
+	CapabilityAway = "away"
+
+	// CapabilityConfProtobuf says the node reads protobuf published on
+	// conference topics as well as JSON
+	CapabilityConfProtobuf = "conf-protobuf"
+)
+
+// localCapabilities is what this build advertises
+var localCapabilities = []string{CapabilityZstd, CapabilityGroups, CapabilityConfProtobuf}
+
+// Capability list limits for decoding identify payloads
+const (
+	maxCapabilities      = 32
+	maxCapabilityLength  = 32
+	capabilitiesStoreKey = "whisper/capabilities"
+)
+
+// CompressionThreshold is the smallest payload worth compressing; below it the
+// encoding overhead outweighs the saving
+const CompressionThreshold = 1024
+
+// EncodingZstd marks wire content compressed with zstd
+const EncodingZstd = "zstd"
+
+// ErrDecompressedTooLarge is returned when compressed content inflates past its limit
+var ErrDecompressedTooLarge = errors.New("decompressed content too large")
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(MaxContentLength))
+)
+
+// Compress zstd-compresses a payload
+func Compress(data []byte) []byte {
+	return zstdEncoder.EncodeAll(data, nil)
+}
+
+// Decompress inflates a zstd payload, refusing anything that would decode to
+// more than MaxContentLength bytes
+func Decompress(data []byte) ([]byte, error) {
+	out, err := zstdDecoder.DecodeAll(data, nil)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || len(out) > MaxContentLength {
+		return nil, ErrDecompressedTooLarge
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+	return out, nil
+}
+
+// PeerSupports reports whether a peer advertised a capability in its last
+// identify exchange
+func PeerSupports(h host.Host, p peer.ID, capability string) bool {
+	value, err := h.Peerstore().Get(p, capabilitiesStoreKey)
+	if err != nil {
+		return false
+	}
+	capabilities, _ := value.([]string)
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCapabilities validates the capability list of a decoded identify payload
+func checkCapabilities(capabilities []string) error {
+	if len(capabilities) > maxCapabilities {
+		return fmt.Errorf("more than %d capabilities", maxCapabilities)
+	}
+	for _, c := range capabilities {
+		if err := CheckTextField("capability", c, maxCapabilityLength, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
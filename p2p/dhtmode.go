@@ -0,0 +1,115 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// DHT modes
+const (
+	DHTModeAuto   = "auto"   // Serve the DHT only when publicly reachable (default)
+	DHTModeClient = "client" // Query only; right for most nodes behind NAT
+	DHTModeServer = "server" // Always answer DHT queries
+)
+
+// DHTProtocolPrefix namespaces whisper's DHT apart from the public IPFS one, which
+// only accepts /pk and /ipns records; protocols become /whisper/kad/1.0.0
+const DHTProtocolPrefix = "/whisper"
+
+// protocolDHT is the DHT protocol served in server mode
+const protocolDHT = protocol.ID(DHTProtocolPrefix + "/kad/1.0.0")
+
+// ErrInvalidDHTMode is returned for an unknown DHT mode name
+var ErrInvalidDHTMode = errors.New("DHT mode must be auto, client or server")
+
+// parseDHTMode maps a mode name to the DHT option; empty means auto
+func parseDHTMode(mode string) (dht.ModeOpt, error) {
+	switch mode {
+	case "", DHTModeAuto:
+		// AutoNAT reachability events switch between client and server
+		return dht.ModeAuto, nil
+	case DHTModeClient:
+		return dht.ModeClient, nil
+	case DHTModeServer:
+		return dht.ModeServer, nil
+	default:
+		return 0, ErrInvalidDHTMode
+	}
+}
+
+// CheckDHTMode reports whether mode is a valid DHT mode name
+func CheckDHTMode(mode string) error {
+	_, err := parseDHTMode(mode)
+	return err
+}
+
+// newDHT creates and bootstraps a DHT in the given mode
+func (p *P2PHost) newDHT(mode string) (*dht.IpfsDHT, error) {
+	opt, err := parseDHTMode(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	kdht, err := dht.New(p.ctx, p.host,
+		dht.Mode(opt),
+		dht.ProtocolPrefix(DHTProtocolPrefix),
+		dht.NamespacedValidator(PresenceNamespace, presenceValidator{}),
+		dht.NamespacedValidator(MailboxNamespace, mailboxValidator{}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DHT: %w", err)
+	}
+
+	if err := kdht.Bootstrap(p.ctx); err != nil {
+		kdht.Close()
+		return nil, fmt.Errorf("failed to bootstrap DHT: %w", err)
+	}
+	return kdht, nil
+}
+
+// DHTMode returns the configured DHT mode (see DHTStats for what the node is doing now)
+func (p *P2PHost) DHTMode() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.dhtMode
+}
+
+// SetDHTMode switches the DHT mode at runtime by replacing the DHT instance.
+// The routing table is rebuilt from currently connected peers.
+func (p *P2PHost) SetDHTMode(mode string) error {
+	if mode == "" {
+		mode = DHTModeAuto
+	}
+	if _, err := parseDHTMode(mode); err != nil {
+		return err
+	}
+	if mode == p.DHTMode() {
+		return nil
+	}
+
+	kdht, err := p.newDHT(mode)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	old := p.dht
+	p.dht = kdht
+	p.dhtMode = mode
+	p.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// routing returns the current DHT instance
+func (p *P2PHost) routing() *dht.IpfsDHT {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.dht
+}
@@ -0,0 +1,103 @@
+package p2p
+
+import (
+	"sync"
+	"time"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// maxRecentDHTQueries is how many DHT query timings are kept for diagnostics
+const maxRecentDHTQueries = 20
+
+// DHTQueryStat records the outcome of a single DHT operation
+type DHTQueryStat struct {
+	Op       string        `json:"op"` // e.g. advertise, find_peers
+	Duration time.Duration `json:"duration"`
+	Err      string        `json:"err,omitempty"`
+	Time     time.Time     `json:"time"`
+}
+
+// DHTStats summarizes the state of the DHT for diagnosing discovery problems
+type DHTStats struct {
+	Mode             string         `json:"mode"`    // server or client (what the node is doing now)
+	Setting          string         `json:"setting"` // Configured mode: auto, client or server
+	RoutingTableSize int            `json:"routing_table_size"`
+	Buckets          []int          `json:"buckets"` // Peers per bucket, indexed by common prefix length
+	AvgPeerLatency   time.Duration  `json:"avg_peer_latency"`
+	RecentQueries    []DHTQueryStat `json:"recent_queries"`
+}
+
+// dhtQueryLog is a bounded log of recent DHT query timings
+type dhtQueryLog struct {
+	mu      sync.Mutex
+	queries []DHTQueryStat
+}
+
+// record appends a query timing, dropping the oldest beyond the limit
+func (l *dhtQueryLog) record(op string, started time.Time, err error) {
+	stat := DHTQueryStat{Op: op, Duration: time.Since(started), Time: started}
+	if err != nil {
+		stat.Err = err.Error()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queries = append(l.queries, stat)
+	if len(l.queries) > maxRecentDHTQueries {
+		l.queries = l.queries[len(l.queries)-maxRecentDHTQueries:]
+	}
+}
+
+// snapshot returns a copy of the recorded queries, newest first
+func (l *dhtQueryLog) snapshot() []DHTQueryStat {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]DHTQueryStat, len(l.queries))
+	for i, q := range l.queries {
+		out[len(l.queries)-1-i] = q
+	}
+	return out
+}
+
+// DHTStats returns routing table occupancy, recent query latencies and the current DHT mode
+func (p *P2PHost) DHTStats() *DHTStats {
+	stats := &DHTStats{
+		Mode:          p.currentDHTMode(),
+		Setting:       p.DHTMode(),
+		RecentQueries: p.dhtQueries.snapshot(),
+	}
+
+	rt := p.routing().RoutingTable()
+	self := kb.ConvertPeerID(p.host.ID())
+	var totalLatency time.Duration
+	measured := 0
+	for _, info := range rt.GetPeerInfos() {
+		cpl := kb.CommonPrefixLen(self, kb.ConvertPeerID(info.Id))
+		for len(stats.Buckets) <= cpl {
+			stats.Buckets = append(stats.Buckets, 0)
+		}
+		stats.Buckets[cpl]++
+		stats.RoutingTableSize++
+
+		if latency := p.host.Peerstore().LatencyEWMA(info.Id); latency > 0 {
+			totalLatency += latency
+			measured++
+		}
+	}
+	if measured > 0 {
+		stats.AvgPeerLatency = totalLatency / time.Duration(measured)
+	}
+	return stats
+}
+
+// currentDHTMode reports whether the DHT is currently answering queries (server)
+// or only issuing them (client). In auto mode this follows reachability.
+func (p *P2PHost) currentDHTMode() string {
+	for _, proto := range p.host.Mux().Protocols() {
+		if proto == protocolDHT {
+			return "server"
+		}
+	}
+	return "client"
+}
@@ -0,0 +1,30 @@
+package p2p
+
+import (
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// SetDialSuccessHandler sets a callback for each address ConnectToPeer and
+// ConnectToKnownPeer reached a peer on, so working addresses can be kept and
+// tried first next time
+func (p *P2PHost) SetDialSuccessHandler(handler func(pid peer.ID, addr multiaddr.Multiaddr)) {
+	p.dialSuccessHandler = handler
+}
+
+// dialSucceeded reports the addresses of our direct connections to a peer we
+// just dialed. Inbound connections say nothing about where the peer can be
+// dialed, and relayed ones depend on the relay.
+func (p *P2PHost) dialSucceeded(pid peer.ID) {
+	if p.dialSuccessHandler == nil {
+		return
+	}
+	for _, conn := range p.host.Network().ConnsToPeer(pid) {
+		stat := conn.Stat()
+		if stat.Direction != network.DirOutbound || stat.Limited {
+			continue
+		}
+		p.dialSuccessHandler(pid, conn.RemoteMultiaddr())
+	}
+}
@@ -5,19 +5,65 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/discovery"
 	"github.com/libp2p/go-libp2p/core/peer"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
 )
 
+// WhisperNamespace is the DHT rendezvous namespace whisper nodes advertise under
+const WhisperNamespace = "whisper/users/1.0.0"
+
 // PublishUser publishes a user's information to the DHT
 // For Phase 3, we use a simplified approach: user discovery via database + peer connections
 // In a production system with many users, you'd want to implement proper DHT records with signing
 func (p *P2PHost) PublishUser(ctx context.Context, username string) error {
-	// Store in local peer metadata for now
-	// When peers connect, they can exchange user information
+	// Advertise this node under the whisper namespace so others can find it for user search.
+	// User details themselves are exchanged over the user search protocol.
+	if p.routing().RoutingTable().Size() == 0 {
+		// No DHT peers yet (e.g. LAN only) - mDNS and direct connects still work
+		fmt.Printf("Registered user '%s' for local peer discovery\n", username)
+		return nil
+	}
+
+	rd := drouting.NewRoutingDiscovery(p.routing())
+	started := time.Now()
+	_, err := rd.Advertise(ctx, WhisperNamespace)
+	p.dhtQueries.record("advertise", started, err)
+	if err != nil {
+		return fmt.Errorf("failed to advertise on DHT: %w", err)
+	}
+
+	// Signed last-seen, so friends can tell how long ago we were online
+	if p.presencePublished() {
+		if err := p.PublishPresence(ctx); err != nil {
+			return err
+		}
+	}
 	fmt.Printf("Registered user '%s' for peer discovery\n", username)
 	return nil
 }
 
+// FindWhisperPeers returns up to limit whisper nodes advertising on the DHT
+func (p *P2PHost) FindWhisperPeers(ctx context.Context, limit int) ([]peer.AddrInfo, error) {
+	rd := drouting.NewRoutingDiscovery(p.routing())
+	started := time.Now()
+	peerChan, err := rd.FindPeers(ctx, WhisperNamespace, discovery.Limit(limit))
+	if err != nil {
+		p.dhtQueries.record("find_peers", started, err)
+		return nil, fmt.Errorf("failed to query DHT: %w", err)
+	}
+	defer func() { p.dhtQueries.record("find_peers", started, ctx.Err()) }()
+
+	found := []peer.AddrInfo{}
+	for info := range peerChan {
+		if info.ID == p.host.ID() || len(info.Addrs) == 0 {
+			continue
+		}
+		found = append(found, info)
+	}
+	return found, nil
+}
+
 // FindUserByUsername looks up a user's peer ID
 // For Phase 3, this uses the local database (requires user to be in DB)
 // In a full DHT implementation, this would query the distributed hash table
@@ -29,7 +75,7 @@ func (p *P2PHost) FindUserByUsername(ctx context.Context, username string) (peer
 
 // RefreshUserPresence periodically republishes user presence to DHT
 func (p *P2PHost) RefreshUserPresence(ctx context.Context, username string) {
-	ticker := time.NewTicker(10 * time.Minute)
+	ticker := time.NewTicker(PresenceRefreshInterval)
 	defer ticker.Stop()
 
 	for {
@@ -0,0 +1,77 @@
+package p2p
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// whisperProtocolPrefix starts the ID of every protocol the app speaks, as
+// opposed to libp2p's own (identify, GossipSub, the DHT, relays)
+const whisperProtocolPrefix = "/whisper/"
+
+// SetAway advertises CapabilityAway to every connected peer and waits until
+// each has heard it, or ctx ends. It can't be undone: a node goes away to stop.
+func (p *P2PHost) SetAway(ctx context.Context) {
+	p.mu.Lock()
+	p.away = true
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, pid := range p.host.Network().Peers() {
+		wg.Add(1)
+		go func(pid peer.ID) {
+			defer wg.Done()
+			p.identifyPeer(pid)
+		}(pid)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// isAway reports whether SetAway was called
+func (p *P2PHost) isAway() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.away
+}
+
+// PeerAway reports whether a peer said it is draining, going by its last identify
+func (p *P2PHost) PeerAway(id peer.ID) bool {
+	return PeerSupports(p.host, id, CapabilityAway)
+}
+
+// StopInbound refuses new whisper streams by removing their protocol handlers.
+// Peers opening one are told the protocol isn't supported, so they keep what
+// they meant to send queued for when the node is back. Streams already open
+// are unaffected, and libp2p's own protocols keep running.
+func (p *P2PHost) StopInbound() {
+	for _, id := range p.host.Mux().Protocols() {
+		if strings.HasPrefix(string(id), whisperProtocolPrefix) {
+			p.host.RemoveStreamHandler(id)
+		}
+	}
+}
+
+// OpenStreams returns how many whisper streams are open, in either direction
+func (p *P2PHost) OpenStreams() int {
+	open := 0
+	for _, conn := range p.host.Network().Conns() {
+		for _, s := range conn.GetStreams() {
+			if strings.HasPrefix(string(s.Protocol()), whisperProtocolPrefix) {
+				open++
+			}
+		}
+	}
+	return open
+}
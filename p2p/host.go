@@ -36,6 +36,50 @@ type P2PHost struct {
 	discovery mdns.Service
 	mu        sync.RWMutex
 	peers     map[peer.ID]*PeerInfo
+
+	profile           IdentifyPayload        // Identity shared with peers
+	identifyHandler   func(info *PeerInfo)   // Called when a peer's identity is learned
+	capabilityHandler func(peer.ID) []string // Extra capabilities advertised to one peer
+
+	dialFailures       int                                         // Consecutive failed dials, reset on connect
+	healthHandler      func(event HealthEvent)                     // Receives watchdog diagnostics
+	dialSuccessHandler func(pid peer.ID, addr multiaddr.Multiaddr) // Receives addresses dials worked on
+
+	presenceHandler func(event PresenceEvent) // Receives keepalive presence changes
+	hidePresence    bool                      // Don't publish last-seen records to the DHT
+	away            bool                      // Draining before shutdown; see drain.go
+
+	dhtQueries dhtQueryLog // Recent DHT query timings for diagnostics
+	dhtMode    string      // Configured DHT mode
+
+	memoryLimit int64 // Resource manager memory cap in bytes
+
+	scores     map[peer.ID]float64 // Latest GossipSub score snapshot
+	remembered map[peer.ID]float64 // Penalties carried over from earlier runs
+	scoreStore PeerScoreStore
+
+	reputationHandler func(peer.ID) float64 // Penalty for how a peer behaved toward the app
+	connectionFilter  func(peer.ID) bool    // Reports peers whose connections are refused
+
+	simulated bool // Running on an injected host; no real network discovery
+}
+
+// Options tunes the P2P host; the zero value uses the defaults
+type Options struct {
+	DHTMode string // auto (default), client or server
+
+	MaxMemoryMB               int // Resource manager memory cap (0 = DefaultMaxMemoryMB)
+	MaxStreamsPerPeerProtocol int // Inbound streams per peer per protocol (0 = DefaultMaxStreamsPerPeerProtocol)
+
+	ScoreStore PeerScoreStore // Persists GossipSub peer scores across restarts (optional)
+
+	StaticRelays []peer.AddrInfo // Relays to reserve slots on when behind NAT (empty = discover via DHT)
+	RelayService bool            // Relay traffic for other peers
+
+	// Host replaces the libp2p host NewP2PHost would build, letting tests inject
+	// a simulated swarm (e.g. a mocknet peer). Port, privKey and the resource
+	// limits are ignored, and mDNS is not started, when it is set.
+	Host host.Host
 }
 
 // PeerInfo stores information about a connected peer
@@ -43,7 +87,12 @@ type PeerInfo struct {
 	ID        peer.ID
 	Addrs     []multiaddr.Multiaddr
 	Connected bool
-	Username  string // Will be populated after user identification
+	Username  string // Populated by the identify exchange (empty if not shared)
+	FullName  string
+
+	Capabilities []string // Optional wire features the peer advertised
+	Version      string   // Whisper release the peer runs; empty for older releases
+	Platform     string   // The peer's operating system and architecture
 }
 
 // isPortAvailable checks if a TCP port is available for libp2p
@@ -72,89 +121,148 @@ func isPortAvailable(port int) bool {
 }
 
 // NewP2PHost creates a new P2P host instance
-func NewP2PHost(ctx context.Context, port int, privKey crypto.PrivKey) (*P2PHost, error) {
-	// Generate a new identity if not provided
-	if privKey == nil {
+func NewP2PHost(ctx context.Context, port int, privKey crypto.PrivKey, opts Options) (*P2PHost, error) {
+	var h host.Host
+	var memoryLimit int64
+	if opts.Host != nil {
+		h = opts.Host
+	} else {
 		var err error
-		privKey, _, err = crypto.GenerateKeyPair(crypto.Ed25519, -1)
+		h, memoryLimit, err = newLibp2pHost(port, privKey, opts)
 		if err != nil {
-			return nil, fmt.Errorf("failed to generate key pair: %w", err)
+			return nil, err
 		}
 	}
 
-	// Check if requested port is available
-	if !isPortAvailable(port) {
-		fmt.Printf("Port %d is already in use, selecting an available port automatically...\n", port)
-		port = 0 // Let OS select an available port
+	p2pHost := &P2PHost{
+		host:        h,
+		ctx:         ctx,
+		peers:       make(map[peer.ID]*PeerInfo),
+		memoryLimit: memoryLimit,
+		scores:      make(map[peer.ID]float64),
+		remembered:  make(map[peer.ID]float64),
+		scoreStore:  opts.ScoreStore,
+		simulated:   opts.Host != nil,
 	}
 
-	// Create listen address
-	// If port is 0, libp2p will automatically select an available port
-	listenAddr := fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", port)
-
-	// Create libp2p host with NAT traversal capabilities
-	h, err := libp2p.New(
-		libp2p.Identity(privKey),
-		libp2p.ListenAddrStrings(listenAddr),
-		libp2p.DefaultTransports,
-		libp2p.DefaultMuxers,
-		libp2p.DefaultSecurity,
-		libp2p.NATPortMap(),                                       // UPnP/NAT-PMP port mapping
-		libp2p.EnableNATService(),                                 // Help other peers determine their NAT status
-		libp2p.EnableAutoRelayWithStaticRelays([]peer.AddrInfo{}), // Enable auto relay (empty = use DHT discovered relays)
-		libp2p.EnableHolePunching(),                               // Enable hole punching for better NAT traversal
-		libp2p.EnableRelay(),                                      // Can use other peers as relays
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create libp2p host: %w", err)
+	if opts.ScoreStore != nil {
+		p2pHost.loadPeerScores(opts.ScoreStore)
 	}
 
-	// Create DHT for peer discovery
-	kdht, err := dht.New(ctx, h, dht.Mode(dht.ModeServer))
+	// Create GossipSub for pub/sub messaging (conferences), scoring peers so
+	// spammers and senders of invalid messages are pushed out of the mesh
+	ps, err := pubsub.NewGossipSub(ctx, h,
+		pubsub.WithPeerScore(p2pHost.peerScoreParams(), peerScoreThresholds()),
+		pubsub.WithPeerScoreInspect(p2pHost.inspectPeerScores, scoreInspectInterval),
+	)
 	if err != nil {
 		h.Close()
-		return nil, fmt.Errorf("failed to create DHT: %w", err)
+		return nil, fmt.Errorf("failed to create GossipSub: %w", err)
 	}
+	p2pHost.pubsub = ps
 
-	// Bootstrap the DHT
-	if err = kdht.Bootstrap(ctx); err != nil {
-		h.Close()
-		return nil, fmt.Errorf("failed to bootstrap DHT: %w", err)
+	// Create DHT for peer discovery
+	if opts.DHTMode == "" {
+		opts.DHTMode = DHTModeAuto
 	}
-
-	// Create GossipSub for pub/sub messaging (conferences)
-	ps, err := pubsub.NewGossipSub(ctx, h)
+	kdht, err := p2pHost.newDHT(opts.DHTMode)
 	if err != nil {
 		h.Close()
-		return nil, fmt.Errorf("failed to create GossipSub: %w", err)
-	}
-
-	p2pHost := &P2PHost{
-		host:   h,
-		dht:    kdht,
-		pubsub: ps,
-		ctx:    ctx,
-		peers:  make(map[peer.ID]*PeerInfo),
+		return nil, err
 	}
+	p2pHost.dht = kdht
+	p2pHost.dhtMode = opts.DHTMode
 
 	// Set up connection notifications
 	h.Network().Notify(&network.NotifyBundle{
 		ConnectedF: func(n network.Network, conn network.Conn) {
+			if !p2pHost.allowConnection(conn.RemotePeer()) {
+				go conn.Close()
+				return
+			}
 			p2pHost.handleNewConnection(conn.RemotePeer())
+			// The dialing side starts the identify exchange; the other side answers
+			if conn.Stat().Direction == network.DirOutbound {
+				go p2pHost.identifyPeer(conn.RemotePeer())
+			}
 		},
 		DisconnectedF: func(n network.Network, conn network.Conn) {
 			p2pHost.handleDisconnection(conn.RemotePeer())
 		},
 	})
 
+	// Answer identify exchanges from peers that dial us
+	HandleStreams(h, p2pHost.handleIdentify, ProtocolIdentifyV2, ProtocolIdentify)
+	HandleStreams(h, p2pHost.handleKeepalive, ProtocolKeepalive)
+	HandleStreams(h, p2pHost.handleTime, ProtocolTime)
+
 	// Setup mDNS discovery for local network peers
-	disc := &discoveryNotifee{h: p2pHost}
-	ser := mdns.NewMdnsService(h, "whisper-mdns", disc)
-	p2pHost.discovery = ser
+	if err := p2pHost.startMDNS(); err != nil {
+		fmt.Printf("Warning: Failed to start mDNS discovery: %v\n", err)
+	}
 
 	return p2pHost, nil
 }
 
+// newLibp2pHost creates the real libp2p host, returning it with its memory limit
+func newLibp2pHost(port int, privKey crypto.PrivKey, opts Options) (host.Host, int64, error) {
+	// Generate a new identity if not provided
+	if privKey == nil {
+		var err error
+		privKey, _, err = crypto.GenerateKeyPair(crypto.Ed25519, -1)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to generate key pair: %w", err)
+		}
+	}
+
+	// Check if requested port is available
+	if !isPortAvailable(port) {
+		fmt.Printf("Port %d is already in use, selecting an available port automatically...\n", port)
+		port = 0 // Let OS select an available port
+	}
+
+	// Create listen address
+	// If port is 0, libp2p will automatically select an available port
+	listenAddr := fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", port)
+
+	// Limit what any single peer (or all of them together) can consume
+	rm, memoryLimit, err := newResourceManager(opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	staticRelays := opts.StaticRelays
+	if staticRelays == nil {
+		staticRelays = []peer.AddrInfo{}
+	}
+
+	// Create libp2p host with NAT traversal capabilities
+	libp2pOpts := []libp2p.Option{
+		libp2p.ResourceManager(rm),
+		libp2p.Identity(privKey),
+		libp2p.ListenAddrStrings(listenAddr),
+		libp2p.DefaultTransports,
+		libp2p.DefaultMuxers,
+		libp2p.DefaultSecurity,
+		libp2p.NATPortMap(),                                  // UPnP/NAT-PMP port mapping
+		libp2p.EnableNATService(),                            // Help other peers determine their NAT status
+		libp2p.EnableAutoRelayWithStaticRelays(staticRelays), // Enable auto relay (empty = use DHT discovered relays)
+		libp2p.EnableHolePunching(),                          // Enable hole punching for better NAT traversal
+		libp2p.EnableRelay(),                                 // Can use other peers as relays
+		libp2p.UserAgent(userAgentPrefix + Version),          // Seen by libp2p identify, e.g. in relay logs
+	}
+	if opts.RelayService {
+		libp2pOpts = append(libp2pOpts, libp2p.EnableRelayService())
+	}
+
+	h, err := libp2p.New(libp2pOpts...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create libp2p host: %w", err)
+	}
+
+	return h, memoryLimit, nil
+}
+
 // PeerID returns the local peer ID
 func (p *P2PHost) PeerID() peer.ID {
 	return p.host.ID()
@@ -175,10 +283,10 @@ func (p *P2PHost) Addrs() []multiaddr.Multiaddr {
 	return p.host.Addrs()
 }
 
-// GetFullAddrs returns the full multiaddresses including peer ID
+// GetFullAddrs returns the full multiaddresses including peer ID, best first
 func (p *P2PHost) GetFullAddrs() []string {
 	addrs := make([]string, 0)
-	for _, addr := range p.host.Addrs() {
+	for _, addr := range RankAddrs(p.host.Addrs()) {
 		// Combine address with peer ID
 		fullAddr := fmt.Sprintf("%s/p2p/%s", addr.String(), p.host.ID().String())
 		addrs = append(addrs, fullAddr)
@@ -202,12 +310,70 @@ func (p *P2PHost) ConnectToPeer(ctx context.Context, addrStr string) error {
 
 	// Connect to the peer
 	if err := p.host.Connect(ctx, *addrInfo); err != nil {
+		p.recordDialFailure()
 		return fmt.Errorf("failed to connect to peer: %w", err)
 	}
+	p.dialSucceeded(addrInfo.ID)
 
 	return nil
 }
 
+// ParsePeerAddrs parses full multiaddrs (with /p2p/) into address infos, merging
+// several addresses of the same peer
+func ParsePeerAddrs(addrs []string) ([]peer.AddrInfo, error) {
+	maddrs := make([]multiaddr.Multiaddr, 0, len(addrs))
+	for _, addrStr := range addrs {
+		maddr, err := multiaddr.NewMultiaddr(addrStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid multiaddress %q: %w", addrStr, err)
+		}
+		maddrs = append(maddrs, maddr)
+	}
+
+	infos, err := peer.AddrInfosFromP2pAddrs(maddrs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peer info: %w", err)
+	}
+	return infos, nil
+}
+
+// ConnectToKnownPeer reconnects to a peer using previously seen addresses,
+// falling back to a DHT lookup when none of them are usable
+func (p *P2PHost) ConnectToKnownPeer(ctx context.Context, peerID peer.ID, addrs []string) error {
+	if p.IsConnected(peerID) {
+		return nil
+	}
+
+	addrInfo := peer.AddrInfo{ID: peerID}
+	for _, addrStr := range addrs {
+		maddr, err := multiaddr.NewMultiaddr(addrStr)
+		if err != nil {
+			continue
+		}
+		addrInfo.Addrs = append(addrInfo.Addrs, maddr)
+	}
+
+	if len(addrInfo.Addrs) == 0 {
+		found, err := p.routing().FindPeer(ctx, peerID)
+		if err != nil {
+			return fmt.Errorf("failed to find peer: %w", err)
+		}
+		addrInfo = found
+	}
+
+	if err := p.host.Connect(ctx, addrInfo); err != nil {
+		p.recordDialFailure()
+		return fmt.Errorf("failed to connect to peer: %w", err)
+	}
+	p.dialSucceeded(peerID)
+	return nil
+}
+
+// IsConnected reports whether there is an open connection to the peer
+func (p *P2PHost) IsConnected(peerID peer.ID) bool {
+	return p.host.Network().Connectedness(peerID) == network.Connected
+}
+
 // GetConnectedPeers returns a list of currently connected peers
 func (p *P2PHost) GetConnectedPeers() []*PeerInfo {
 	p.mu.RLock()
@@ -222,9 +388,9 @@ func (p *P2PHost) GetConnectedPeers() []*PeerInfo {
 	return peers
 }
 
-// SetStreamHandler sets a handler for a specific protocol
+// SetStreamHandler sets a handler for a specific protocol behind DefaultStreamGuard
 func (p *P2PHost) SetStreamHandler(protocolID protocol.ID, handler network.StreamHandler) {
-	p.host.SetStreamHandler(protocolID, handler)
+	HandleStreams(p.host, handler, protocolID)
 }
 
 // NewStream opens a new stream to a peer for a specific protocol
@@ -250,6 +416,7 @@ func (p *P2PHost) handleNewConnection(peerID peer.ID) {
 
 	// Get peer addresses
 	peerInfo.Addrs = p.host.Peerstore().Addrs(peerID)
+	p.dialFailures = 0
 
 	fmt.Printf("Peer connected: %s\n", peerID.String())
 }
@@ -267,11 +434,14 @@ func (p *P2PHost) handleDisconnection(peerID peer.ID) {
 
 // Close shuts down the P2P host
 func (p *P2PHost) Close() error {
-	if p.discovery != nil {
-		p.discovery.Close()
+	p.mu.RLock()
+	disc := p.discovery
+	p.mu.RUnlock()
+	if disc != nil {
+		disc.Close()
 	}
-	if p.dht != nil {
-		p.dht.Close()
+	if kdht := p.routing(); kdht != nil {
+		kdht.Close()
 	}
 	return p.host.Close()
 }
@@ -285,6 +455,7 @@ type discoveryNotifee struct {
 func (n *discoveryNotifee) HandlePeerFound(peerInfo peer.AddrInfo) {
 	// Try to connect to the discovered peer
 	if err := n.h.host.Connect(n.h.ctx, peerInfo); err != nil {
+		n.h.recordDialFailure()
 		fmt.Printf("Failed to connect to discovered peer %s: %v\n", peerInfo.ID, err)
 	} else {
 		fmt.Printf("Connected to peer via mDNS: %s\n", peerInfo.ID)
@@ -0,0 +1,238 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/austinwklein/whisper/pb"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// ProtocolIdentify exchanges whisper usernames right after connecting
+	ProtocolIdentify = "/whisper/identify/1.0.0"
+
+	// ProtocolIdentifyV2 is the protobuf version of ProtocolIdentify
+	ProtocolIdentifyV2 = "/whisper/identify/2.0.0"
+
+	// identifyTimeout bounds a single identify exchange
+	identifyTimeout = 10 * time.Second
+)
+
+// IdentifyPayload carries the whisper identity a peer chooses to share.
+// Both name fields are empty when the peer has no logged-in user or has opted
+// out; capabilities, version and platform are always advertised.
+type IdentifyPayload struct {
+	Username     string   `json:"username,omitempty"`
+	FullName     string   `json:"full_name,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"` // Optional wire features understood, e.g. zstd
+	Version      string   `json:"version,omitempty"`      // Whisper release, e.g. v1.4.0; empty from older releases
+	Platform     string   `json:"platform,omitempty"`     // Operating system and architecture, e.g. linux/amd64
+}
+
+// SetLocalProfile sets the identity shared with peers and re-announces it to
+// everyone currently connected. Pass empty strings to stop sharing (e.g. on logout).
+func (p *P2PHost) SetLocalProfile(username, fullName string) {
+	p.mu.Lock()
+	p.profile = IdentifyPayload{Username: username, FullName: fullName}
+	p.mu.Unlock()
+
+	p.RefreshProfile()
+}
+
+// RefreshProfile re-announces the local identity and capabilities to everyone
+// currently connected, e.g. after a setting they depend on changed
+func (p *P2PHost) RefreshProfile() {
+	for _, pid := range p.host.Network().Peers() {
+		go p.identifyPeer(pid)
+	}
+}
+
+// SetCapabilityHandler sets a callback returning capabilities advertised to
+// one peer on top of the build's own, such as per-friend privacy settings
+func (p *P2PHost) SetCapabilityHandler(handler func(peer.ID) []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.capabilityHandler = handler
+}
+
+// SetIdentifyHandler sets a callback invoked whenever a peer's identity is learned
+func (p *P2PHost) SetIdentifyHandler(handler func(info *PeerInfo)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.identifyHandler = handler
+}
+
+// localProfile returns the identity currently shared with a peer
+func (p *P2PHost) localProfile(peerID peer.ID) IdentifyPayload {
+	p.mu.RLock()
+	profile := p.profile
+	handler := p.capabilityHandler
+	p.mu.RUnlock()
+
+	profile.Version = Version
+	profile.Platform = Platform
+	profile.Capabilities = localCapabilities
+	if handler != nil {
+		profile.Capabilities = append(append([]string{}, localCapabilities...), handler(peerID)...)
+	}
+	if p.isAway() {
+		profile.Capabilities = append(append([]string{}, profile.Capabilities...), CapabilityAway)
+	}
+	return profile
+}
+
+// handleIdentify answers an identify exchange started by a remote peer
+func (p *P2PHost) handleIdentify(s network.Stream) {
+	defer s.Close()
+
+	ws := NewWireStream(s)
+	remote, err := readIdentify(ws)
+	if err != nil {
+		fmt.Printf("Error reading identify payload: %v\n", err)
+		return
+	}
+
+	if err := writeIdentify(ws, p.localProfile(s.Conn().RemotePeer())); err != nil {
+		fmt.Printf("Error writing identify payload: %v\n", err)
+		return
+	}
+
+	p.recordIdentity(s.Conn().RemotePeer(), remote)
+}
+
+// identifyPeer sends our identity to a peer and records theirs
+func (p *P2PHost) identifyPeer(peerID peer.ID) {
+	ctx, cancel := context.WithTimeout(p.ctx, identifyTimeout)
+	defer cancel()
+
+	s, err := p.host.NewStream(ctx, peerID, ProtocolIdentifyV2, ProtocolIdentify)
+	if err != nil {
+		// Not a whisper node (or it went away) - nothing to learn
+		return
+	}
+	defer s.Close()
+
+	ws := NewWireStream(s)
+	if err := writeIdentify(ws, p.localProfile(peerID)); err != nil {
+		return
+	}
+	s.CloseWrite()
+
+	remote, err := readIdentify(ws)
+	if err != nil {
+		return
+	}
+
+	p.recordIdentity(peerID, remote)
+}
+
+// recordIdentity stores a peer's shared identity and notifies the identify handler
+func (p *P2PHost) recordIdentity(peerID peer.ID, payload *IdentifyPayload) {
+	p.mu.Lock()
+	peerInfo, exists := p.peers[peerID]
+	if !exists {
+		peerInfo = &PeerInfo{ID: peerID, Connected: true}
+		p.peers[peerID] = peerInfo
+	}
+	changed := peerInfo.Username != payload.Username
+	peerInfo.Username = payload.Username
+	peerInfo.FullName = payload.FullName
+	peerInfo.Addrs = p.host.Peerstore().Addrs(peerID)
+	peerInfo.Capabilities = payload.Capabilities
+	peerInfo.Version = payload.Version
+	peerInfo.Platform = payload.Platform
+	snapshot := *peerInfo
+	handler := p.identifyHandler
+	p.mu.Unlock()
+
+	// Kept in the peerstore so protocol managers can check them with PeerSupports
+	if err := p.host.Peerstore().Put(peerID, capabilitiesStoreKey, payload.Capabilities); err != nil {
+		fmt.Printf("Warning: Failed to record capabilities of %s: %v\n", peerID.String(), err)
+	}
+
+	if changed && payload.Username != "" {
+		fmt.Printf("Peer %s identified as %s\n", peerID.String(), payload.Username)
+	}
+
+	if handler != nil {
+		handler(&snapshot)
+	}
+}
+
+// writeIdentify writes an identify payload in the stream's encoding
+func writeIdentify(ws *WireStream, payload IdentifyPayload) error {
+	if err := ws.WriteMessage(&payload); err != nil {
+		return fmt.Errorf("failed to write identify payload: %w", err)
+	}
+	return nil
+}
+
+// readIdentify reads and validates an identify payload in the stream's encoding
+func readIdentify(ws *WireStream) (*IdentifyPayload, error) {
+	var wire pb.IdentifyPayload
+	data, err := ws.ReadMessage(&wire)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identify payload: %w", err)
+	}
+	if ws.Protobuf() {
+		return DecodeIdentifyPayloadProto(&wire)
+	}
+	return DecodeIdentifyPayload(data)
+}
+
+// DecodeIdentifyPayload parses and validates an identify payload read from the wire
+func DecodeIdentifyPayload(data []byte) (*IdentifyPayload, error) {
+	var payload IdentifyPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal identify payload: %w", err)
+	}
+	if err := checkIdentifyPayload(&payload); err != nil {
+		return nil, err
+	}
+	return &payload, nil
+}
+
+// DecodeIdentifyPayloadProto validates an identify payload read from a protobuf stream
+func DecodeIdentifyPayloadProto(wire *pb.IdentifyPayload) (*IdentifyPayload, error) {
+	payload := &IdentifyPayload{
+		Username:     wire.Username,
+		FullName:     wire.FullName,
+		Capabilities: wire.Capabilities,
+		Version:      wire.Version,
+		Platform:     wire.Platform,
+	}
+	if err := checkIdentifyPayload(payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// checkIdentifyPayload validates an identify payload in either wire encoding
+func checkIdentifyPayload(payload *IdentifyPayload) error {
+	if err := checkCapabilities(payload.Capabilities); err != nil {
+		return fmt.Errorf("invalid identify payload: %w", err)
+	}
+	if err := CheckTextField("version", payload.Version, maxVersionLength, false); err != nil {
+		return fmt.Errorf("invalid identify payload: %w", err)
+	}
+	if err := CheckTextField("platform", payload.Platform, maxVersionLength, false); err != nil {
+		return fmt.Errorf("invalid identify payload: %w", err)
+	}
+	return nil
+}
+
+// Proto returns the payload's protobuf form
+func (p *IdentifyPayload) Proto() proto.Message {
+	return &pb.IdentifyPayload{
+		Username:     p.Username,
+		FullName:     p.FullName,
+		Capabilities: p.Capabilities,
+		Version:      p.Version,
+		Platform:     p.Platform,
+	}
+}
@@ -0,0 +1,263 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/austinwklein/whisper/pb"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestIdentifyPayloadEncodings(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload IdentifyPayload
+	}{
+		{"current release", IdentifyPayload{
+			Username:     "alice",
+			FullName:     "Alice Liddell",
+			Capabilities: []string{CapabilityZstd, CapabilityGroups},
+			Version:      "v1.4.0",
+			Platform:     "linux/amd64",
+		}},
+		{"profile not shared", IdentifyPayload{Capabilities: []string{CapabilityZstd}, Version: "dev", Platform: "darwin/arm64"}},
+		{"older release without version", IdentifyPayload{Username: "bob", FullName: "Bob"}},
+		{"capabilities we don't know", IdentifyPayload{Username: "carol", Capabilities: []string{"teleport"}, Version: "v9.0.0", Platform: "plan9/386"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+"/json", func(t *testing.T) {
+			data, err := json.Marshal(&tt.payload)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			if tt.payload.Version == "" && strings.Contains(string(data), "version") {
+				t.Errorf("empty version sent as %s; older peers expect it left out", data)
+			}
+			got, err := DecodeIdentifyPayload(data)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.payload) {
+				t.Errorf("decoded %+v, want %+v", *got, tt.payload)
+			}
+		})
+		t.Run(tt.name+"/protobuf", func(t *testing.T) {
+			data, err := proto.Marshal(tt.payload.Proto())
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			var wire pb.IdentifyPayload
+			if err := proto.Unmarshal(data, &wire); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			got, err := DecodeIdentifyPayloadProto(&wire)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.payload) {
+				t.Errorf("decoded %+v, want %+v", *got, tt.payload)
+			}
+		})
+	}
+}
+
+// TestIdentifyPayloadFromNewerPeer checks fields added by later releases are
+// skipped rather than refused
+func TestIdentifyPayloadFromNewerPeer(t *testing.T) {
+	want := IdentifyPayload{Username: "dave", Version: "v3.0.0", Platform: "linux/riscv64"}
+
+	got, err := DecodeIdentifyPayload([]byte(`{"username":"dave","version":"v3.0.0","platform":"linux/riscv64","hologram":{"enabled":true}}`))
+	if err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("json decoded %+v, want %+v", *got, want)
+	}
+
+	data, err := proto.Marshal(want.Proto())
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	data = protowire.AppendTag(data, 99, protowire.BytesType)
+	data = protowire.AppendString(data, "from the future")
+	var wire pb.IdentifyPayload
+	if err := proto.Unmarshal(data, &wire); err != nil {
+		t.Fatalf("protobuf unmarshal: %v", err)
+	}
+	got, err = DecodeIdentifyPayloadProto(&wire)
+	if err != nil {
+		t.Fatalf("protobuf: %v", err)
+	}
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("protobuf decoded %+v, want %+v", *got, want)
+	}
+}
+
+func TestIdentifyPayloadRejectsInvalid(t *testing.T) {
+	tooMany := make([]string, maxCapabilities+1)
+	for i := range tooMany {
+		tooMany[i] = CapabilityZstd
+	}
+
+	tests := []struct {
+		name      string
+		payload   IdentifyPayload
+		protoOnly bool // JSON decoding already replaces invalid UTF-8
+	}{
+		{"long version", IdentifyPayload{Version: strings.Repeat("9", maxVersionLength+1)}, false},
+		{"long platform", IdentifyPayload{Platform: strings.Repeat("x", maxVersionLength+1)}, false},
+		{"version not UTF-8", IdentifyPayload{Version: "v1.\xff"}, true},
+		{"too many capabilities", IdentifyPayload{Capabilities: tooMany}, false},
+		{"empty capability", IdentifyPayload{Capabilities: []string{""}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeIdentifyPayloadProto(tt.payload.Proto().(*pb.IdentifyPayload)); err == nil {
+				t.Error("protobuf payload accepted")
+			}
+			if tt.protoOnly {
+				return
+			}
+			data, err := json.Marshal(&tt.payload)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			if _, err := DecodeIdentifyPayload(data); err == nil {
+				t.Error("json payload accepted")
+			}
+		})
+	}
+}
+
+// newIdentifyHost wraps a simulated host in a P2PHost, sending what it learns
+// about peers to the returned channel
+func newIdentifyHost(t *testing.T, h host.Host) (*P2PHost, chan *PeerInfo) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	p, err := NewP2PHost(ctx, 0, nil, Options{Host: h, DHTMode: DHTModeClient})
+	if err != nil {
+		t.Fatalf("failed to start host: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	learned := make(chan *PeerInfo, 4)
+	p.SetIdentifyHandler(func(info *PeerInfo) { learned <- info })
+	return p, learned
+}
+
+// waitIdentified returns the next peer identity a host learns
+func waitIdentified(t *testing.T, learned chan *PeerInfo) *PeerInfo {
+	t.Helper()
+	select {
+	case info := <-learned:
+		return info
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the identify exchange")
+		return nil
+	}
+}
+
+func TestIdentifyExchangeBetweenReleases(t *testing.T) {
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+	newPeer := func() host.Host {
+		h, err := mn.GenPeer()
+		if err != nil {
+			t.Fatalf("failed to add peer: %v", err)
+		}
+		return h
+	}
+
+	t.Run("current release", func(t *testing.T) {
+		a, _ := newIdentifyHost(t, newPeer())
+		b, learned := newIdentifyHost(t, newPeer())
+		a.SetLocalProfile("alice", "Alice")
+		if err := mn.LinkAll(); err != nil {
+			t.Fatalf("failed to link peers: %v", err)
+		}
+		if _, err := mn.ConnectPeers(a.PeerID(), b.PeerID()); err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+
+		info := waitIdentified(t, learned)
+		if info.ID != a.PeerID() || info.Username != "alice" || info.Version != Version || info.Platform != Platform {
+			t.Errorf("b learned %s as %q on %q/%q, want alice on %q/%q", info.ID, info.Username, info.Version, info.Platform, Version, Platform)
+		}
+		if !PeerSupports(b.Host(), a.PeerID(), CapabilityZstd) {
+			t.Error("b did not record a's capabilities")
+		}
+	})
+
+	t.Run("older release", func(t *testing.T) {
+		a, learned := newIdentifyHost(t, newPeer())
+
+		// A release before versions were exchanged speaks JSON identify only
+		old := newPeer()
+		sent := make(chan IdentifyPayload, 1)
+		old.SetStreamHandler(ProtocolIdentify, func(s network.Stream) {
+			defer s.Close()
+			line, err := bufio.NewReader(s).ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			var payload IdentifyPayload
+			if json.Unmarshal(line, &payload) == nil {
+				sent <- payload
+			}
+			s.Write([]byte(`{"username":"olivia","full_name":"Olivia"}` + "\n"))
+		})
+		if err := mn.LinkAll(); err != nil {
+			t.Fatalf("failed to link peers: %v", err)
+		}
+		if _, err := mn.ConnectPeers(a.PeerID(), old.ID()); err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+
+		info := waitIdentified(t, learned)
+		if info.Username != "olivia" || info.Version != "" || info.Platform != "" {
+			t.Errorf("learned %q on %q/%q, want olivia with no version", info.Username, info.Version, info.Platform)
+		}
+		if PeerSupports(a.Host(), old.ID(), CapabilityZstd) {
+			t.Error("older peer assumed to support zstd")
+		}
+		select {
+		case payload := <-sent:
+			if payload.Version != Version || payload.Platform != Platform {
+				t.Errorf("older peer was sent %q/%q, want %q/%q", payload.Version, payload.Platform, Version, Platform)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("older peer was never sent an identify payload")
+		}
+	})
+
+	t.Run("not a whisper node", func(t *testing.T) {
+		a, learned := newIdentifyHost(t, newPeer())
+		stranger := newPeer()
+		if err := mn.LinkAll(); err != nil {
+			t.Fatalf("failed to link peers: %v", err)
+		}
+		if _, err := mn.ConnectPeers(a.PeerID(), stranger.ID()); err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+
+		select {
+		case info := <-learned:
+			t.Errorf("learned an identity %+v from a peer without identify", info)
+		case <-time.After(500 * time.Millisecond):
+		}
+		if !a.IsConnected(stranger.ID()) {
+			t.Error("connection to a peer without identify was dropped")
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package p2p
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HostSnapshot is a point-in-time view of the libp2p host for debugging
+type HostSnapshot struct {
+	PeerID      peer.ID          `json:"peer_id"`
+	Addrs       []string         `json:"addrs"`
+	Protocols   []string         `json:"protocols"` // Protocols this node handles
+	DHT         *DHTStats        `json:"dht"`
+	Resources   *ResourceStats   `json:"resources"`
+	Connections []ConnectionInfo `json:"connections"`
+	EventTypes  []string         `json:"event_types"` // Event types with an emitter or subscriber on the bus
+}
+
+// ConnectionInfo describes one open connection and the streams on it
+type ConnectionInfo struct {
+	Peer      peer.ID       `json:"peer"`
+	Username  string        `json:"username,omitempty"`
+	Direction string        `json:"direction"`
+	Addr      string        `json:"addr"`
+	Limited   bool          `json:"limited"` // Relayed with data and time limits
+	Age       time.Duration `json:"age"`
+	Streams   []string      `json:"streams"` // Protocol of each open stream
+}
+
+// EventQueueStat is the backlog of one event bus subscriber
+type EventQueueStat struct {
+	Subscriber string `json:"subscriber"`
+	Queued     int    `json:"queued"`
+	Full       bool   `json:"full"`
+}
+
+// Snapshot gathers the host's addresses, protocols, connections and streams
+func (p *P2PHost) Snapshot() *HostSnapshot {
+	snap := &HostSnapshot{
+		PeerID:    p.host.ID(),
+		Addrs:     p.GetFullAddrs(),
+		DHT:       p.DHTStats(),
+		Resources: p.ResourceStats(),
+	}
+	for _, proto := range p.host.Mux().Protocols() {
+		snap.Protocols = append(snap.Protocols, string(proto))
+	}
+	sort.Strings(snap.Protocols)
+	for _, typ := range p.host.EventBus().GetAllEventTypes() {
+		snap.EventTypes = append(snap.EventTypes, strings.TrimPrefix(typ.String(), "event."))
+	}
+	sort.Strings(snap.EventTypes)
+
+	names := make(map[peer.ID]string)
+	for _, info := range p.GetConnectedPeers() {
+		names[info.ID] = info.Username
+	}
+
+	for _, conn := range p.host.Network().Conns() {
+		stat := conn.Stat()
+		info := ConnectionInfo{
+			Peer:      conn.RemotePeer(),
+			Username:  names[conn.RemotePeer()],
+			Direction: stat.Direction.String(),
+			Addr:      conn.RemoteMultiaddr().String(),
+			Limited:   stat.Limited,
+			Age:       time.Since(stat.Opened).Round(time.Second),
+			Streams:   []string{},
+		}
+		for _, s := range conn.GetStreams() {
+			proto := string(s.Protocol())
+			if proto == "" {
+				proto = "(negotiating)"
+			}
+			info.Streams = append(info.Streams, proto)
+		}
+		snap.Connections = append(snap.Connections, info)
+	}
+	sort.Slice(snap.Connections, func(i, j int) bool {
+		return len(snap.Connections[i].Streams) > len(snap.Connections[j].Streams)
+	})
+	return snap
+}
+
+// EventBusBacklog reports how many events each event bus subscriber has yet
+// to consume, largest first. libp2p only records this while metrics are
+// enabled, so the result is empty if they were turned off.
+func EventBusBacklog() ([]EventQueueStat, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]*EventQueueStat)
+	for _, family := range families {
+		switch family.GetName() {
+		case "libp2p_eventbus_subscriber_queue_length", "libp2p_eventbus_subscriber_queue_full":
+		default:
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			name := ""
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "subscriber_name" {
+					name = label.GetValue()
+				}
+			}
+			stat, ok := stats[name]
+			if !ok {
+				stat = &EventQueueStat{Subscriber: name}
+				stats[name] = stat
+			}
+			value := m.GetGauge().GetValue()
+			if family.GetName() == "libp2p_eventbus_subscriber_queue_length" {
+				stat.Queued = int(value)
+			} else {
+				stat.Full = value > 0
+			}
+		}
+	}
+
+	backlog := make([]EventQueueStat, 0, len(stats))
+	for _, stat := range stats {
+		backlog = append(backlog, *stat)
+	}
+	sort.Slice(backlog, func(i, j int) bool {
+		if backlog[i].Queued != backlog[j].Queued {
+			return backlog[i].Queued > backlog[j].Queued
+		}
+		return backlog[i].Subscriber < backlog[j].Subscriber
+	})
+	return backlog, nil
+}
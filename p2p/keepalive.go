@@ -0,0 +1,248 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	msmux "github.com/multiformats/go-multistream"
+)
+
+const (
+	// ProtocolKeepalive echoes a nonce so both ends know the connection still carries traffic
+	ProtocolKeepalive = "/whisper/keepalive/1.0.0"
+
+	// DefaultKeepaliveInterval is how often watched peers are pinged
+	DefaultKeepaliveInterval = 30 * time.Second
+
+	// DefaultKeepaliveTimeout is how long a ping may take before it counts as missed
+	DefaultKeepaliveTimeout = 10 * time.Second
+
+	// DefaultKeepaliveMaxMissed is how many pings in a row may go unanswered
+	// before the connection is considered dead
+	DefaultKeepaliveMaxMissed = 2
+
+	// keepaliveNonceSize is the number of random bytes in a ping
+	keepaliveNonceSize = 8
+)
+
+// Presence event kinds
+const (
+	PresenceOnline  = "online"  // A watched peer that was offline answers again
+	PresenceOffline = "offline" // A watched peer disconnected or stopped answering keepalives
+)
+
+// PresenceEvent reports a watched peer going offline or coming back
+type PresenceEvent struct {
+	Time   time.Time     `json:"time"`
+	Peer   peer.ID       `json:"peer"`
+	Kind   string        `json:"kind"`
+	RTT    time.Duration `json:"rtt,omitempty"` // Round trip of the answering ping (online only)
+	Detail string        `json:"detail,omitempty"`
+}
+
+// KeepaliveConfig controls how watched peers are pinged; zero fields use the defaults
+type KeepaliveConfig struct {
+	Interval  time.Duration
+	Timeout   time.Duration
+	MaxMissed int
+}
+
+// keepalivePeer tracks one watched peer between rounds
+type keepalivePeer struct {
+	missed   int  // Consecutive unanswered pings
+	offline  bool // Not reachable as of the last round
+	reported bool // An offline event was sent, so coming back is reported too
+}
+
+// SetPresenceHandler sets a callback for watched peers going offline or coming back
+func (p *P2PHost) SetPresenceHandler(handler func(event PresenceEvent)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.presenceHandler = handler
+}
+
+// StartKeepalive pings the peers returned by watched every interval until ctx
+// is cancelled. NATs drop idle mappings without closing the connection, so a
+// peer can look connected long after it became unreachable; a peer that misses
+// cfg.MaxMissed pings in a row has its connections closed and is reported
+// offline, so it stops showing as online and callers can redial it.
+func (p *P2PHost) StartKeepalive(ctx context.Context, cfg KeepaliveConfig, watched func() []peer.ID) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultKeepaliveInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultKeepaliveTimeout
+	}
+	if cfg.MaxMissed <= 0 {
+		cfg.MaxMissed = DefaultKeepaliveMaxMissed
+	}
+
+	state := make(map[peer.ID]*keepalivePeer)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		p.keepaliveRound(ctx, cfg, watched(), state)
+	}
+}
+
+// keepaliveRound pings every watched peer once and reports state changes
+func (p *P2PHost) keepaliveRound(ctx context.Context, cfg KeepaliveConfig, peers []peer.ID, state map[peer.ID]*keepalivePeer) {
+	type result struct {
+		peer peer.ID
+		rtt  time.Duration
+		err  error
+	}
+
+	current := make(map[peer.ID]bool, len(peers))
+	results := make(chan result, len(peers))
+	var wg sync.WaitGroup
+	for _, pid := range peers {
+		current[pid] = true
+		st, ok := state[pid]
+		if !ok {
+			// Peers already offline when first watched are not news
+			st = &keepalivePeer{offline: !p.IsConnected(pid)}
+			state[pid] = st
+		}
+
+		if !p.IsConnected(pid) {
+			// Already gone; there is nothing to ping
+			if !st.offline {
+				st.offline = true
+				st.reported = true
+				st.missed = 0
+				p.emitPresence(PresenceEvent{Peer: pid, Kind: PresenceOffline, Detail: "disconnected"})
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func(pid peer.ID) {
+			defer wg.Done()
+			rtt, err := p.Ping(ctx, pid, cfg.Timeout)
+			results <- result{pid, rtt, err}
+		}(pid)
+	}
+	wg.Wait()
+	close(results)
+
+	// Forget peers that are no longer watched (e.g. unfriended)
+	for pid := range state {
+		if !current[pid] {
+			delete(state, pid)
+		}
+	}
+
+	for r := range results {
+		st := state[r.peer]
+		if r.err == nil {
+			st.missed = 0
+			if st.offline && st.reported {
+				p.emitPresence(PresenceEvent{Peer: r.peer, Kind: PresenceOnline, RTT: r.rtt})
+			}
+			st.offline = false
+			st.reported = false
+			continue
+		}
+
+		st.missed++
+		if st.missed < cfg.MaxMissed || st.offline || ctx.Err() != nil {
+			continue
+		}
+
+		// The connection is dead but nothing told libp2p; drop it so the peer
+		// no longer shows as connected and a fresh dial can replace it
+		if err := p.host.Network().ClosePeer(r.peer); err != nil {
+			fmt.Printf("Warning: Failed to close dead connection to %s: %v\n", r.peer.String(), err)
+		}
+		st.offline = true
+		st.reported = true
+		st.missed = 0
+		p.emitPresence(PresenceEvent{
+			Peer:   r.peer,
+			Kind:   PresenceOffline,
+			Detail: fmt.Sprintf("%d keepalives unanswered: %v", cfg.MaxMissed, r.err),
+		})
+	}
+}
+
+// Ping sends one keepalive to a connected peer and returns the round-trip time
+func (p *P2PHost) Ping(ctx context.Context, pid peer.ID, timeout time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	started := time.Now()
+	s, err := p.host.NewStream(network.WithNoDial(ctx, "keepalive"), pid, ProtocolKeepalive)
+	var notSupported msmux.ErrNotSupported[protocol.ID]
+	if errors.As(err, &notSupported) {
+		// An older node turned the protocol down, which still proves the
+		// connection carries traffic
+		return time.Since(started), nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open keepalive stream: %w", err)
+	}
+	defer s.Close()
+	s.SetDeadline(started.Add(timeout))
+
+	nonce := make([]byte, keepaliveNonceSize)
+	rand.Read(nonce)
+	ping := []byte(hex.EncodeToString(nonce) + "\n")
+	if _, err := s.Write(ping); err != nil {
+		s.Reset()
+		return 0, fmt.Errorf("failed to write keepalive: %w", err)
+	}
+	s.CloseWrite()
+
+	pong, err := ReadWireMessage(bufio.NewReader(s))
+	if err != nil {
+		s.Reset()
+		return 0, fmt.Errorf("no keepalive reply: %w", err)
+	}
+	if !bytes.Equal(pong, ping) {
+		return 0, fmt.Errorf("keepalive reply does not match")
+	}
+	return time.Since(started), nil
+}
+
+// handleKeepalive echoes a keepalive nonce back to the sender
+func (p *P2PHost) handleKeepalive(s network.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(DefaultKeepaliveTimeout))
+
+	ping, err := ReadWireMessage(bufio.NewReader(s))
+	if err != nil || len(ping) != keepaliveNonceSize*2+1 {
+		s.Reset()
+		return
+	}
+	s.Write(ping)
+}
+
+// emitPresence sends a presence event to the presence handler, if any
+func (p *P2PHost) emitPresence(event PresenceEvent) {
+	event.Time = time.Now()
+
+	p.mu.RLock()
+	handler := p.presenceHandler
+	p.mu.RUnlock()
+
+	if handler != nil {
+		handler(event)
+	}
+}
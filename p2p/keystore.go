@@ -0,0 +1,156 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrIdentitySealed is returned when the stored identity key is encrypted and
+// no passphrase was given to open it
+var ErrIdentitySealed = errors.New("the node identity is encrypted; a passphrase is needed to open it")
+
+// sealedIdentityMagic starts an identity key sealed with a passphrase; a
+// marshalled libp2p key never does
+var sealedIdentityMagic = []byte("WHISPERID1")
+
+// IdentityStore persists the node's private key so its PeerID survives restarts
+type IdentityStore interface {
+	GetIdentityKey(ctx context.Context) ([]byte, error)
+	SaveIdentityKey(ctx context.Context, key []byte) error
+}
+
+// LoadOrCreateIdentity returns the node's private key from the store, generating
+// and saving a new Ed25519 key the first time. No host is needed, so the PeerID
+// is known before networking starts and accounts can be bound to it directly.
+func LoadOrCreateIdentity(ctx context.Context, store IdentityStore) (crypto.PrivKey, error) {
+	data, err := store.GetIdentityKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load identity: %w", err)
+	}
+	// The host keeps its own copy of the key; don't leave another lying around
+	defer func() { clear(data) }()
+
+	if bytes.HasPrefix(data, sealedIdentityMagic) {
+		return nil, ErrIdentitySealed
+	}
+	if data != nil {
+		privKey, err := crypto.UnmarshalPrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode identity: %w", err)
+		}
+		return privKey, nil
+	}
+
+	privKey, data, err := NewIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if err := store.SaveIdentityKey(ctx, data); err != nil {
+		return nil, fmt.Errorf("failed to save identity: %w", err)
+	}
+	return privKey, nil
+}
+
+// NewIdentity generates a new Ed25519 identity key, returned along with its
+// encoding for an IdentityStore
+func NewIdentity() (crypto.PrivKey, []byte, error) {
+	privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key pair: %w", err)
+	}
+	data, err := crypto.MarshalPrivateKey(privKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode identity: %w", err)
+	}
+	return privKey, data, nil
+}
+
+// SealIdentity wraps store so the identity key is kept encrypted with a
+// passphrase, and a copy of the database alone doesn't give the node's
+// identity away. A key stored in the clear is sealed the first time it is read.
+func SealIdentity(store IdentityStore, passphrase string) IdentityStore {
+	return &sealedIdentityStore{store: store, passphrase: passphrase}
+}
+
+// sealedIdentityStore encrypts the identity key on its way into store and
+// decrypts it on the way out
+type sealedIdentityStore struct {
+	store      IdentityStore
+	passphrase string
+}
+
+func (s *sealedIdentityStore) GetIdentityKey(ctx context.Context) ([]byte, error) {
+	data, err := s.store.GetIdentityKey(ctx)
+	if err != nil || data == nil {
+		return data, err
+	}
+	if !bytes.HasPrefix(data, sealedIdentityMagic) {
+		// Saved before a passphrase was set
+		if err := s.SaveIdentityKey(ctx, data); err != nil {
+			return nil, fmt.Errorf("failed to encrypt identity: %w", err)
+		}
+		return data, nil
+	}
+
+	sealed := data[len(sealedIdentityMagic):]
+	if len(sealed) < identitySaltSize {
+		return nil, errors.New("sealed identity is truncated")
+	}
+	gcm, err := identityCipher(s.passphrase, sealed[:identitySaltSize])
+	if err != nil {
+		return nil, err
+	}
+	sealed = sealed[identitySaltSize:]
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed identity is truncated")
+	}
+	key, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], sealedIdentityMagic)
+	if err != nil {
+		return nil, errors.New("wrong identity passphrase, or the identity is corrupted")
+	}
+	return key, nil
+}
+
+func (s *sealedIdentityStore) SaveIdentityKey(ctx context.Context, key []byte) error {
+	salt := make([]byte, identitySaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	gcm, err := identityCipher(s.passphrase, salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	sealed := append(append(append([]byte{}, sealedIdentityMagic...), salt...), nonce...)
+	sealed = gcm.Seal(sealed, nonce, key, sealedIdentityMagic)
+	return s.store.SaveIdentityKey(ctx, sealed)
+}
+
+// identitySaltSize is the length of the random salt a sealed identity starts with
+const identitySaltSize = 16
+
+// identityCipher derives the AES-GCM cipher for a passphrase and salt
+func identityCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,90 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// memoryIdentity is an IdentityStore holding the key in memory
+type memoryIdentity struct {
+	key []byte
+}
+
+func (m *memoryIdentity) GetIdentityKey(ctx context.Context) ([]byte, error) {
+	if m.key == nil {
+		return nil, nil
+	}
+	return append([]byte(nil), m.key...), nil
+}
+
+func (m *memoryIdentity) SaveIdentityKey(ctx context.Context, key []byte) error {
+	m.key = append([]byte(nil), key...)
+	return nil
+}
+
+func TestSealedIdentity(t *testing.T) {
+	ctx := context.Background()
+	raw := &memoryIdentity{}
+
+	created, err := LoadOrCreateIdentity(ctx, SealIdentity(raw, "correct horse"))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	plain, err := crypto.MarshalPrivateKey(created)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if !bytes.HasPrefix(raw.key, sealedIdentityMagic) || bytes.Contains(raw.key, plain) {
+		t.Fatal("identity key stored in the clear")
+	}
+
+	loaded, err := LoadOrCreateIdentity(ctx, SealIdentity(raw, "correct horse"))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !loaded.Equals(created) {
+		t.Error("loaded a different key than was created")
+	}
+
+	if _, err := LoadOrCreateIdentity(ctx, SealIdentity(raw, "battery staple")); err == nil {
+		t.Error("opened with the wrong passphrase")
+	}
+	if _, err := LoadOrCreateIdentity(ctx, raw); !errors.Is(err, ErrIdentitySealed) {
+		t.Errorf("load without a passphrase = %v, want ErrIdentitySealed", err)
+	}
+
+	raw.key[len(raw.key)-1] ^= 1
+	if _, err := LoadOrCreateIdentity(ctx, SealIdentity(raw, "correct horse")); err == nil {
+		t.Error("opened a tampered identity")
+	}
+}
+
+// TestSealIdentityStoredInTheClear checks a key saved before a passphrase was
+// set keeps the same PeerID and is sealed once read
+func TestSealIdentityStoredInTheClear(t *testing.T) {
+	ctx := context.Background()
+	raw := &memoryIdentity{}
+
+	created, err := LoadOrCreateIdentity(ctx, raw)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if bytes.HasPrefix(raw.key, sealedIdentityMagic) {
+		t.Fatal("identity sealed without a passphrase")
+	}
+
+	loaded, err := LoadOrCreateIdentity(ctx, SealIdentity(raw, "correct horse"))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !loaded.Equals(created) {
+		t.Error("sealing changed the identity")
+	}
+	if !bytes.HasPrefix(raw.key, sealedIdentityMagic) {
+		t.Error("identity left in the clear after a passphrase was set")
+	}
+}
@@ -0,0 +1,178 @@
+package p2p
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// MailboxNamespace is the DHT record namespace naming the mailbox server
+	// each node takes messages at while it is offline
+	MailboxNamespace = "whisper-mailbox"
+
+	// MailboxRefreshInterval is how often a node republishes its mailbox
+	// record; DHT nodes drop records after 36 hours
+	MailboxRefreshInterval = 12 * time.Hour
+
+	// maxMailboxRecordSize bounds a mailbox record accepted from the DHT
+	maxMailboxRecordSize = 2048
+)
+
+// ErrInvalidMailbox is returned for mailbox records that are malformed or
+// not signed by the peer they name
+var ErrInvalidMailbox = errors.New("invalid mailbox record")
+
+// MailboxRecord is a node's signed statement of where to leave messages for
+// it while it is offline, and the key to seal them to. An empty Mailbox means
+// the node takes no messages that way.
+type MailboxRecord struct {
+	PeerID    string `json:"peer_id"`
+	Mailbox   string `json:"mailbox,omitempty"` // Mailbox server multiaddr with /p2p/
+	Key       []byte `json:"key,omitempty"`     // X25519 public key
+	Published int64  `json:"published"`         // Unix timestamp
+	Signature []byte `json:"signature"`
+}
+
+// mailboxKey returns the DHT key a peer's mailbox record is stored under
+func mailboxKey(id peer.ID) string {
+	return "/" + MailboxNamespace + "/" + id.String()
+}
+
+// signedBytes returns the bytes covered by the signature
+func (r *MailboxRecord) signedBytes() []byte {
+	sum := sha256.Sum256(r.Key)
+	return []byte(fmt.Sprintf("whisper-mailbox:%s:%s:%x:%d", r.PeerID, r.Mailbox, sum, r.Published))
+}
+
+// NewMailboxRecord signs a mailbox record for the key's peer ID
+func NewMailboxRecord(privKey crypto.PrivKey, mailbox string, key []byte, now time.Time) (*MailboxRecord, error) {
+	id, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive peer ID: %w", err)
+	}
+
+	record := &MailboxRecord{PeerID: id.String(), Mailbox: mailbox, Key: key, Published: now.Unix()}
+	record.Signature, err = privKey.Sign(record.signedBytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign mailbox record: %w", err)
+	}
+	return record, nil
+}
+
+// Verify checks the record's signature against the key embedded in its peer ID
+func (r *MailboxRecord) Verify() error {
+	id, err := peer.Decode(r.PeerID)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMailbox, err)
+	}
+	pubKey, err := id.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMailbox, err)
+	}
+	ok, err := pubKey.Verify(r.signedBytes(), r.Signature)
+	if err != nil || !ok {
+		return fmt.Errorf("%w: bad signature", ErrInvalidMailbox)
+	}
+	return nil
+}
+
+// decodeMailboxRecord parses a mailbox record stored under key and verifies it
+func decodeMailboxRecord(key string, value []byte) (*MailboxRecord, error) {
+	if len(value) > maxMailboxRecordSize {
+		return nil, fmt.Errorf("%w: too large", ErrInvalidMailbox)
+	}
+
+	var record MailboxRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMailbox, err)
+	}
+	if key != "/"+MailboxNamespace+"/"+record.PeerID {
+		return nil, fmt.Errorf("%w: key does not match peer ID", ErrInvalidMailbox)
+	}
+	if record.Mailbox != "" {
+		if _, err := ParsePeerAddrs([]string{record.Mailbox}); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidMailbox, err)
+		}
+		if len(record.Key) != 32 {
+			return nil, fmt.Errorf("%w: bad key", ErrInvalidMailbox)
+		}
+	}
+	if time.Unix(record.Published, 0).After(time.Now().Add(maxPresenceSkew)) {
+		return nil, fmt.Errorf("%w: published in the future", ErrInvalidMailbox)
+	}
+	if err := record.Verify(); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// mailboxValidator lets DHT nodes reject forged mailbox records and keep the newest
+type mailboxValidator struct{}
+
+// Validate implements record.Validator
+func (mailboxValidator) Validate(key string, value []byte) error {
+	_, err := decodeMailboxRecord(key, value)
+	return err
+}
+
+// Select implements record.Validator, preferring the latest record
+func (mailboxValidator) Select(key string, values [][]byte) (int, error) {
+	best, bestPublished := -1, int64(0)
+	for i, value := range values {
+		record, err := decodeMailboxRecord(key, value)
+		if err != nil {
+			continue
+		}
+		if best == -1 || record.Published > bestPublished {
+			best, bestPublished = i, record.Published
+		}
+	}
+	if best == -1 {
+		return 0, ErrInvalidMailbox
+	}
+	return best, nil
+}
+
+// PublishMailbox stores a freshly signed mailbox record for this node on the
+// DHT; an empty mailbox withdraws a previously published one
+func (p *P2PHost) PublishMailbox(ctx context.Context, mailbox string, key []byte) error {
+	privKey := p.host.Peerstore().PrivKey(p.host.ID())
+	if privKey == nil {
+		return ErrNoPrivateKey
+	}
+
+	record, err := NewMailboxRecord(privKey, mailbox, key, time.Now())
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal mailbox record: %w", err)
+	}
+
+	started := time.Now()
+	err = p.routing().PutValue(ctx, mailboxKey(p.host.ID()), data)
+	p.dhtQueries.record("put_mailbox", started, err)
+	if err != nil {
+		return fmt.Errorf("failed to publish mailbox: %w", err)
+	}
+	return nil
+}
+
+// LookupMailbox returns the mailbox record a peer published to the DHT
+func (p *P2PHost) LookupMailbox(ctx context.Context, id peer.ID) (*MailboxRecord, error) {
+	started := time.Now()
+	data, err := p.routing().GetValue(ctx, mailboxKey(id))
+	p.dhtQueries.record("get_mailbox", started, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up mailbox: %w", err)
+	}
+	return decodeMailboxRecord(mailboxKey(id), data)
+}
@@ -0,0 +1,264 @@
+package p2p
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// streamRateLimit is how many streams one peer may open on one protocol
+	// per streamRateWindow before further streams are reset. It is well above
+	// what a friend flushing a long outbox needs.
+	streamRateLimit  = 200
+	streamRateWindow = 10 * time.Second
+
+	// maxThrottled is how many peer/protocol windows the limiter tracks
+	// before sweeping out the expired ones
+	maxThrottled = 4096
+)
+
+// Middleware wraps a stream handler with behavior shared across protocols
+type Middleware func(next network.StreamHandler) network.StreamHandler
+
+// Chain wraps handler in middleware; the first one given runs outermost
+func Chain(handler network.StreamHandler, middleware ...Middleware) network.StreamHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// ProtocolStat counts the inbound streams of one protocol
+type ProtocolStat struct {
+	Protocol protocol.ID   `json:"protocol"`
+	Streams  int64         `json:"streams"`   // Handled to the end
+	Refused  int64         `json:"refused"`   // Reset by Authorize or Throttle
+	Panics   int64         `json:"panics"`    // Handler panicked and the stream was reset
+	Total    time.Duration `json:"total"`     // Time spent in the handler, all streams together
+	Slowest  time.Duration `json:"slowest"`   // Longest single stream
+	LastPeer peer.ID       `json:"last_peer"` // Who opened the latest stream
+}
+
+// StreamGuard is the standard middleware chain for whisper's protocols:
+// panic recovery, metrics, an authorization check and per-peer rate limiting,
+// with the state they share
+type StreamGuard struct {
+	mu        sync.Mutex
+	stats     map[protocol.ID]*ProtocolStat
+	windows   map[throttleKey]*throttleWindow
+	authorize func(peer.ID) bool
+	offense   func(peer.ID)
+	onPanic   func(HandlerPanic)
+	panics    []HandlerPanic // Most recent last
+}
+
+// throttleKey is one peer's use of one protocol
+type throttleKey struct {
+	peer     peer.ID
+	protocol protocol.ID
+}
+
+// throttleWindow counts the streams opened since start
+type throttleWindow struct {
+	start   time.Time
+	streams int
+}
+
+// DefaultStreamGuard guards the handlers registered with HandleStreams
+var DefaultStreamGuard = NewStreamGuard()
+
+// NewStreamGuard creates a guard that lets every peer in and has seen no streams
+func NewStreamGuard() *StreamGuard {
+	return &StreamGuard{
+		stats:   make(map[protocol.ID]*ProtocolStat),
+		windows: make(map[throttleKey]*throttleWindow),
+	}
+}
+
+// HandleStreams registers handler for each protocol ID on h behind DefaultStreamGuard
+func HandleStreams(h host.Host, handler network.StreamHandler, ids ...protocol.ID) {
+	DefaultStreamGuard.Handle(h, handler, ids...)
+}
+
+// Handle registers handler for each protocol ID on h behind the guard's chain
+func (g *StreamGuard) Handle(h host.Host, handler network.StreamHandler, ids ...protocol.ID) {
+	wrapped := g.Wrap(handler)
+	for _, id := range ids {
+		h.SetStreamHandler(id, wrapped)
+	}
+}
+
+// Wrap puts handler behind the guard's chain
+func (g *StreamGuard) Wrap(handler network.StreamHandler) network.StreamHandler {
+	return Chain(handler, g.Recover(), g.Measure(), g.Authorize(), g.Throttle())
+}
+
+// SetAuthorizer sets the check a peer must pass for its streams to be
+// handled; nil lets everyone in
+func (g *StreamGuard) SetAuthorizer(allowed func(peer.ID) bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.authorize = allowed
+}
+
+// SetOffenseHandler sets the handler told about peers that open streams
+// faster than the rate limit allows
+func (g *StreamGuard) SetOffenseHandler(handler func(peer.ID)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.offense = handler
+}
+
+// Measure counts each stream that is handled and how long it took
+func (g *StreamGuard) Measure() Middleware {
+	return func(next network.StreamHandler) network.StreamHandler {
+		return func(s network.Stream) {
+			started := time.Now()
+			next(s)
+			took := time.Since(started)
+			g.record(s.Protocol(), func(stat *ProtocolStat) {
+				stat.Streams++
+				stat.Total += took
+				stat.Slowest = max(stat.Slowest, took)
+				stat.LastPeer = s.Conn().RemotePeer()
+			})
+		}
+	}
+}
+
+// Authorize resets streams from peers the authorizer turns away
+func (g *StreamGuard) Authorize() Middleware {
+	return func(next network.StreamHandler) network.StreamHandler {
+		return func(s network.Stream) {
+			g.mu.Lock()
+			allowed := g.authorize
+			g.mu.Unlock()
+			if allowed != nil && !allowed(s.Conn().RemotePeer()) {
+				g.refuse(s)
+				return
+			}
+			next(s)
+		}
+	}
+}
+
+// Throttle resets streams a peer opens on a protocol beyond streamRateLimit
+// per streamRateWindow, and reports the peer the first time in each window
+func (g *StreamGuard) Throttle() Middleware {
+	return func(next network.StreamHandler) network.StreamHandler {
+		return func(s network.Stream) {
+			pid := s.Conn().RemotePeer()
+			allowed, report := g.allow(throttleKey{peer: pid, protocol: s.Protocol()}, time.Now())
+			if !allowed {
+				g.refuse(s)
+				if report {
+					g.mu.Lock()
+					offense := g.offense
+					g.mu.Unlock()
+					if offense != nil {
+						offense(pid)
+					}
+				}
+				return
+			}
+			next(s)
+		}
+	}
+}
+
+// allow counts a stream against its peer and protocol's window, reporting
+// whether it is within the limit and whether it is the first one over it
+func (g *StreamGuard) allow(key throttleKey, now time.Time) (bool, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	window, ok := g.windows[key]
+	if !ok || now.Sub(window.start) >= streamRateWindow {
+		if !ok && len(g.windows) >= maxThrottled {
+			for k, w := range g.windows {
+				if now.Sub(w.start) >= streamRateWindow {
+					delete(g.windows, k)
+				}
+			}
+		}
+		window = &throttleWindow{start: now}
+		g.windows[key] = window
+	}
+	window.streams++
+	return window.streams <= streamRateLimit, window.streams == streamRateLimit+1
+}
+
+// refuse resets a stream the chain won't hand to its handler
+func (g *StreamGuard) refuse(s network.Stream) {
+	g.record(s.Protocol(), func(stat *ProtocolStat) { stat.Refused++ })
+	s.Reset()
+}
+
+// record updates a protocol's stats
+func (g *StreamGuard) record(id protocol.ID, update func(stat *ProtocolStat)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	stat, ok := g.stats[id]
+	if !ok {
+		stat = &ProtocolStat{Protocol: id}
+		g.stats[id] = stat
+	}
+	update(stat)
+}
+
+// Stats returns a copy of each protocol's stats, busiest first
+func (g *StreamGuard) Stats() []ProtocolStat {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	stats := make([]ProtocolStat, 0, len(g.stats))
+	for _, stat := range g.stats {
+		stats = append(stats, *stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Streams != stats[j].Streams {
+			return stats[i].Streams > stats[j].Streams
+		}
+		return stats[i].Protocol < stats[j].Protocol
+	})
+	return stats
+}
+
+// ReadRequest reads the next message on a stream using read. A failure is
+// printed with errFormat, which takes the error, and reported to invalid when
+// the peer sent something malformed; a stream that simply ended is not. It
+// reports whether a message was read.
+func ReadRequest[T any](ws *WireStream, errFormat string, read func(*WireStream) (T, error), invalid func(peer.ID)) (T, bool) {
+	message, err := read(ws)
+	if err == io.EOF {
+		return message, false
+	}
+	if err != nil {
+		i18n.Printf(errFormat, err)
+		if invalid != nil && ws.Malformed(err) {
+			invalid(ws.Conn().RemotePeer())
+		}
+		return message, false
+	}
+	return message, true
+}
+
+// Decoded turns a decoder of JSON wire messages into a read function for
+// ReadRequest, for protocols that have no protobuf version
+func Decoded[T any](decode func(data []byte) (T, error)) func(*WireStream) (T, error) {
+	return func(ws *WireStream) (T, error) {
+		data, err := ws.ReadMessage(nil)
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+		return decode(data)
+	}
+}
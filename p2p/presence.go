@@ -0,0 +1,194 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// PresenceNamespace is the DHT record namespace holding signed last-seen times
+	PresenceNamespace = "whisper-presence"
+
+	// PresenceRefreshInterval is how often an online node republishes its presence
+	PresenceRefreshInterval = 10 * time.Minute
+
+	// maxPresenceSkew is how far in the future a last-seen time may claim to be
+	maxPresenceSkew = 10 * time.Minute
+
+	// maxPresenceRecordSize bounds a presence record accepted from the DHT
+	maxPresenceRecordSize = 1024
+)
+
+// Presence errors
+var (
+	ErrInvalidPresence = errors.New("invalid presence record")
+	ErrNoPrivateKey    = errors.New("host private key not available")
+)
+
+// PresenceRecord is a node's signed claim that it was online at LastSeen. Only
+// the key behind PeerID can produce one, so others cannot fake or refresh it.
+type PresenceRecord struct {
+	PeerID    string `json:"peer_id"`
+	LastSeen  int64  `json:"last_seen"` // Unix timestamp
+	Signature []byte `json:"signature"`
+}
+
+// presenceKey returns the DHT key a peer's presence record is stored under
+func presenceKey(id peer.ID) string {
+	return "/" + PresenceNamespace + "/" + id.String()
+}
+
+// signedBytes returns the bytes covered by the signature
+func (r *PresenceRecord) signedBytes() []byte {
+	return []byte(fmt.Sprintf("whisper-presence:%s:%d", r.PeerID, r.LastSeen))
+}
+
+// NewPresenceRecord signs a presence record for the key's peer ID
+func NewPresenceRecord(privKey crypto.PrivKey, seen time.Time) (*PresenceRecord, error) {
+	id, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive peer ID: %w", err)
+	}
+
+	record := &PresenceRecord{PeerID: id.String(), LastSeen: seen.Unix()}
+	record.Signature, err = privKey.Sign(record.signedBytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign presence: %w", err)
+	}
+	return record, nil
+}
+
+// Verify checks the record's signature against the key embedded in its peer ID
+func (r *PresenceRecord) Verify() error {
+	id, err := peer.Decode(r.PeerID)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPresence, err)
+	}
+	pubKey, err := id.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPresence, err)
+	}
+	ok, err := pubKey.Verify(r.signedBytes(), r.Signature)
+	if err != nil || !ok {
+		return fmt.Errorf("%w: bad signature", ErrInvalidPresence)
+	}
+	return nil
+}
+
+// decodePresenceRecord parses a presence record stored under key and verifies it
+func decodePresenceRecord(key string, value []byte) (*PresenceRecord, error) {
+	if len(value) > maxPresenceRecordSize {
+		return nil, fmt.Errorf("%w: too large", ErrInvalidPresence)
+	}
+
+	var record PresenceRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPresence, err)
+	}
+	if key != "/"+PresenceNamespace+"/"+record.PeerID {
+		return nil, fmt.Errorf("%w: key does not match peer ID", ErrInvalidPresence)
+	}
+	if time.Unix(record.LastSeen, 0).After(time.Now().Add(maxPresenceSkew)) {
+		return nil, fmt.Errorf("%w: last seen in the future", ErrInvalidPresence)
+	}
+	if err := record.Verify(); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// presenceValidator lets DHT nodes reject forged presence records and keep the newest
+type presenceValidator struct{}
+
+// Validate implements record.Validator
+func (presenceValidator) Validate(key string, value []byte) error {
+	_, err := decodePresenceRecord(key, value)
+	return err
+}
+
+// Select implements record.Validator, preferring the latest last-seen time
+func (presenceValidator) Select(key string, values [][]byte) (int, error) {
+	best, bestSeen := -1, int64(0)
+	for i, value := range values {
+		record, err := decodePresenceRecord(key, value)
+		if err != nil {
+			continue
+		}
+		if best == -1 || record.LastSeen > bestSeen {
+			best, bestSeen = i, record.LastSeen
+		}
+	}
+	if best == -1 {
+		return 0, ErrInvalidPresence
+	}
+	return best, nil
+}
+
+// SetPresencePublished controls whether PublishUser also publishes a signed
+// last-seen record. Anyone can read those from the DHT, so they are only
+// published for users who show their online status to everyone.
+func (p *P2PHost) SetPresencePublished(publish bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hidePresence = !publish
+}
+
+// presencePublished reports whether last-seen records are published
+func (p *P2PHost) presencePublished() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return !p.hidePresence
+}
+
+// PresenceHidden reports whether a peer asked not to have its online status
+// shown, going by its last identify
+func (p *P2PHost) PresenceHidden(id peer.ID) bool {
+	return PeerSupports(p.host, id, CapabilityPresenceHidden)
+}
+
+// PublishPresence stores a freshly signed last-seen record for this node on the DHT
+func (p *P2PHost) PublishPresence(ctx context.Context) error {
+	privKey := p.host.Peerstore().PrivKey(p.host.ID())
+	if privKey == nil {
+		return ErrNoPrivateKey
+	}
+
+	record, err := NewPresenceRecord(privKey, time.Now())
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal presence: %w", err)
+	}
+
+	started := time.Now()
+	err = p.routing().PutValue(ctx, presenceKey(p.host.ID()), data)
+	p.dhtQueries.record("put_presence", started, err)
+	if err != nil {
+		return fmt.Errorf("failed to publish presence: %w", err)
+	}
+	return nil
+}
+
+// LookupLastSeen returns when a peer last published its presence to the DHT
+func (p *P2PHost) LookupLastSeen(ctx context.Context, id peer.ID) (time.Time, error) {
+	started := time.Now()
+	data, err := p.routing().GetValue(ctx, presenceKey(id))
+	p.dhtQueries.record("get_presence", started, err)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to look up presence: %w", err)
+	}
+
+	record, err := decodePresenceRecord(presenceKey(id), data)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(record.LastSeen, 0), nil
+}
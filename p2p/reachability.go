@@ -0,0 +1,140 @@
+package p2p
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Reachability summarizes how other peers can reach this node
+type Reachability struct {
+	PeerID      string
+	Addrs       []string // Full multiaddrs worth sharing, best first
+	Public      bool     // At least one address is publicly routable
+	Relayed     bool     // At least one address goes through a circuit relay
+	Fingerprint string   // Digest of the node's public key, for out-of-band checks
+}
+
+// Reachability gathers the node's identity and shareable addresses
+func (p *P2PHost) Reachability() *Reachability {
+	info := &Reachability{
+		PeerID: p.host.ID().String(),
+		Addrs:  p.ShareableAddrs(),
+	}
+
+	for _, addr := range p.host.Addrs() {
+		if isRelayAddr(addr) {
+			info.Relayed = true
+		} else if manet.IsPublicAddr(addr) {
+			info.Public = true
+		}
+	}
+
+	if pub := p.host.Peerstore().PubKey(p.host.ID()); pub != nil {
+		if fp, err := KeyFingerprint(pub); err == nil {
+			info.Fingerprint = fp
+		}
+	}
+	return info
+}
+
+// Address classes, best first
+const (
+	addrClassPublic = iota
+	addrClassRelay
+	addrClassLAN
+	addrClassLoopback
+)
+
+// addrClass buckets an address by how widely it can be dialed
+func addrClass(addr multiaddr.Multiaddr) int {
+	switch {
+	case isRelayAddr(addr):
+		return addrClassRelay
+	case manet.IsIPLoopback(addr):
+		return addrClassLoopback
+	case manet.IsPublicAddr(addr):
+		return addrClassPublic
+	default:
+		return addrClassLAN
+	}
+}
+
+// addrTransportRank prefers QUIC, which traverses NATs better, then TCP
+func addrTransportRank(addr multiaddr.Multiaddr) int {
+	if _, err := addr.ValueForProtocol(multiaddr.P_QUIC_V1); err == nil {
+		return 0
+	}
+	if _, err := addr.ValueForProtocol(multiaddr.P_TCP); err == nil {
+		return 1
+	}
+	return 2
+}
+
+// RankAddrs orders addresses best first: public > relayed > LAN > loopback,
+// preferring QUIC over TCP within each class. The input is left untouched.
+func RankAddrs(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	ranked := make([]multiaddr.Multiaddr, len(addrs))
+	copy(ranked, addrs)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		ci, cj := addrClass(ranked[i]), addrClass(ranked[j])
+		if ci != cj {
+			return ci < cj
+		}
+		return addrTransportRank(ranked[i]) < addrTransportRank(ranked[j])
+	})
+	return ranked
+}
+
+// ShareableAddrs returns full multiaddrs (with /p2p/) a friend can dial, best
+// first. Loopback addresses are left out unless nothing else is known.
+func (p *P2PHost) ShareableAddrs() []string {
+	ranked := RankAddrs(p.host.Addrs())
+
+	addrs := make([]string, 0, len(ranked))
+	for _, addr := range ranked {
+		if addrClass(addr) == addrClassLoopback && len(addrs) > 0 {
+			break // Everything after this is loopback too
+		}
+		addrs = append(addrs, fmt.Sprintf("%s/p2p/%s", addr.String(), p.host.ID().String()))
+	}
+	return addrs
+}
+
+// BestAddr returns the single address most likely to work for a friend, ready to
+// paste after 'connect', or "" if the node has no listen addresses yet
+func (p *P2PHost) BestAddr() string {
+	addrs := p.ShareableAddrs()
+	if len(addrs) == 0 {
+		return ""
+	}
+	return addrs[0]
+}
+
+// KeyFingerprint returns a short, human-comparable digest of a public key,
+// formatted as groups of four hex digits
+func KeyFingerprint(pub crypto.PubKey) (string, error) {
+	data, err := crypto.MarshalPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal public key: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	digits := strings.ToUpper(fmt.Sprintf("%x", sum[:16]))
+	groups := make([]string, 0, len(digits)/4)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, " "), nil
+}
+
+// isRelayAddr reports whether the address routes through a circuit relay
+func isRelayAddr(addr multiaddr.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(multiaddr.P_CIRCUIT)
+	return err == nil
+}
@@ -0,0 +1,100 @@
+package p2p
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// maxRecentPanics is how many recovered panics a guard keeps for inspection
+const maxRecentPanics = 20
+
+// HandlerPanic describes a handler panic that was recovered
+type HandlerPanic struct {
+	Time    time.Time `json:"time"`
+	Handler string    `json:"handler"`        // Protocol ID, or the name given to Protect
+	Peer    peer.ID   `json:"peer,omitempty"` // Whose stream or message was being handled
+	Value   string    `json:"value"`          // What the handler panicked with
+	Stack   string    `json:"stack"`
+}
+
+// SetPanicHandler sets a callback for handler panics the guard recovers
+func (g *StreamGuard) SetPanicHandler(handler func(event HandlerPanic)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.onPanic = handler
+}
+
+// RecentPanics returns the last panics the guard recovered, oldest first
+func (g *StreamGuard) RecentPanics() []HandlerPanic {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]HandlerPanic(nil), g.panics...)
+}
+
+// Recover resets a stream whose handler panicked rather than letting the
+// panic take down the node
+func (g *StreamGuard) Recover() Middleware {
+	return func(next network.StreamHandler) network.StreamHandler {
+		return func(s network.Stream) {
+			defer func() {
+				if r := recover(); r != nil {
+					g.record(s.Protocol(), func(stat *ProtocolStat) { stat.Panics++ })
+					g.recovered(string(s.Protocol()), s.Conn().RemotePeer(), r)
+					s.Reset()
+				}
+			}()
+			next(s)
+		}
+	}
+}
+
+// Protect runs fn, recovering a panic in it the way Recover does for streams.
+// It is for work a stream handler doesn't cover, such as a pubsub message or
+// a goroutine started on a peer's behalf; name identifies it in the panic
+// event, and from is the peer involved, if any. It reports whether fn returned
+// normally.
+func (g *StreamGuard) Protect(name string, from peer.ID, fn func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			g.recovered(name, from, r)
+			ok = false
+		}
+	}()
+	fn()
+	return true
+}
+
+// Protect runs fn behind DefaultStreamGuard's panic recovery
+func Protect(name string, from peer.ID, fn func()) bool {
+	return DefaultStreamGuard.Protect(name, from, fn)
+}
+
+// recovered logs a recovered panic with the stack that raised it, keeps it
+// for RecentPanics and tells the panic handler
+func (g *StreamGuard) recovered(handler string, from peer.ID, r any) {
+	event := HandlerPanic{
+		Time:    time.Now(),
+		Handler: handler,
+		Peer:    from,
+		Value:   fmt.Sprint(r),
+		Stack:   string(debug.Stack()),
+	}
+	log.Printf("%s handler panicked: %s\n%s", handler, event.Value, event.Stack)
+
+	g.mu.Lock()
+	g.panics = append(g.panics, event)
+	if len(g.panics) > maxRecentPanics {
+		g.panics = g.panics[len(g.panics)-maxRecentPanics:]
+	}
+	onPanic := g.onPanic
+	g.mu.Unlock()
+
+	if onPanic != nil {
+		onPanic(event)
+	}
+}
@@ -0,0 +1,153 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+const (
+	panicProtocol protocol.ID = "/whisper/test/panic/1.0.0"
+	echoProtocol  protocol.ID = "/whisper/test/echo/1.0.0"
+)
+
+// captureLog sends the standard logger's output to a buffer for the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &logged
+}
+
+// echo writes back one line
+func echo(s network.Stream) {
+	defer s.Close()
+	line, err := bufio.NewReader(s).ReadString('\n')
+	if err != nil {
+		return
+	}
+	s.Write([]byte(line))
+}
+
+func TestRecoverResetsPanickingStream(t *testing.T) {
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatalf("failed to start hosts: %v", err)
+	}
+	t.Cleanup(func() { mn.Close() })
+	client, server := mn.Hosts()[0], mn.Hosts()[1]
+	logged := captureLog(t)
+
+	guard := NewStreamGuard()
+	events := make(chan HandlerPanic, 1)
+	guard.SetPanicHandler(func(event HandlerPanic) { events <- event })
+	guard.Handle(server, func(s network.Stream) { panic("injected failure") }, panicProtocol)
+	guard.Handle(server, echo, echoProtocol)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := client.NewStream(ctx, server.ID(), panicProtocol)
+	if err != nil {
+		t.Fatalf("NewStream: %v", err)
+	}
+	s.Write([]byte("hello\n"))
+	if _, err := bufio.NewReader(s).ReadString('\n'); err == nil {
+		t.Error("read an answer from a handler that panicked; want the stream reset")
+	}
+
+	select {
+	case event := <-events:
+		if event.Handler != string(panicProtocol) || event.Peer != client.ID() || event.Value != "injected failure" {
+			t.Errorf("panic event = %+v", event)
+		}
+		if !strings.Contains(event.Stack, "TestRecoverResetsPanickingStream") {
+			t.Errorf("panic stack doesn't show the handler:\n%s", event.Stack)
+		}
+	case <-ctx.Done():
+		t.Fatal("panic handler was never told")
+	}
+	if !strings.Contains(logged.String(), "injected failure") {
+		t.Errorf("panic was not logged; log: %q", logged.String())
+	}
+	if recent := guard.RecentPanics(); len(recent) != 1 {
+		t.Errorf("RecentPanics has %d events, want 1", len(recent))
+	}
+	for _, stat := range guard.Stats() {
+		if stat.Protocol == panicProtocol && stat.Panics != 1 {
+			t.Errorf("%s counted %d panics, want 1", panicProtocol, stat.Panics)
+		}
+	}
+
+	// The node keeps serving other streams
+	s, err = client.NewStream(ctx, server.ID(), echoProtocol)
+	if err != nil {
+		t.Fatalf("NewStream after panic: %v", err)
+	}
+	s.Write([]byte("still there?\n"))
+	if line, err := bufio.NewReader(s).ReadString('\n'); err != nil || line != "still there?\n" {
+		t.Errorf("echo after panic = %q, %v", line, err)
+	}
+}
+
+func TestProtectRecoversPanic(t *testing.T) {
+	from, _ := peer.Decode("12D3KooWK99VoVxNE7XzyBwXEzW7xhK7Gpv85r9F3V3fyKSUKPH5")
+	tests := []struct {
+		name  string // As the pubsub and backfill callers name their work
+		panic any
+	}{
+		{"conference message", "nil map write"},
+		{"conference membership", struct{ code int }{7}},
+		{"backfill", "index out of range"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logged := captureLog(t)
+			guard := NewStreamGuard()
+
+			// Backfills run on their own goroutine; a panic there must not escape it
+			done := make(chan bool)
+			go func() { done <- guard.Protect(tt.name, from, func() { panic(tt.panic) }) }()
+			if ok := <-done; ok {
+				t.Fatal("Protect reported success for a function that panicked")
+			}
+
+			recent := guard.RecentPanics()
+			if len(recent) != 1 || recent[0].Handler != tt.name || recent[0].Peer != from {
+				t.Fatalf("RecentPanics = %+v", recent)
+			}
+			if !strings.Contains(logged.String(), tt.name+" handler panicked") {
+				t.Errorf("panic was not logged; log: %q", logged.String())
+			}
+			if !guard.Protect(tt.name, from, func() {}) {
+				t.Error("Protect failed a function that returned normally")
+			}
+		})
+	}
+}
+
+func TestRecentPanicsKeepsTheLatest(t *testing.T) {
+	captureLog(t)
+	guard := NewStreamGuard()
+	for i := 0; i < maxRecentPanics+5; i++ {
+		guard.Protect("handler", "", func() { panic(i) })
+	}
+	recent := guard.RecentPanics()
+	if len(recent) != maxRecentPanics {
+		t.Fatalf("kept %d panics, want %d", len(recent), maxRecentPanics)
+	}
+	if recent[len(recent)-1].Value != "24" {
+		t.Errorf("latest panic = %s, want 24", recent[len(recent)-1].Value)
+	}
+}
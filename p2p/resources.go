@@ -0,0 +1,86 @@
+package p2p
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+)
+
+// Resource limit defaults
+const (
+	DefaultMaxMemoryMB               = 256 // Total memory libp2p may reserve
+	DefaultMaxStreamsPerPeerProtocol = 16  // Inbound streams one peer may hold open per protocol
+)
+
+// ResourceStats reports current resource manager utilization
+type ResourceStats struct {
+	System       network.ScopeStat `json:"system"`
+	MemoryLimit  int64             `json:"memory_limit"`
+	BusiestPeers []PeerResources   `json:"busiest_peers"`
+}
+
+// PeerResources is one peer's share of the resources in use
+type PeerResources struct {
+	ID   peer.ID           `json:"id"`
+	Stat network.ScopeStat `json:"stat"`
+}
+
+// newResourceManager builds a libp2p resource manager with whisper's limits
+func newResourceManager(opts Options) (network.ResourceManager, int64, error) {
+	maxMemoryMB := opts.MaxMemoryMB
+	if maxMemoryMB <= 0 {
+		maxMemoryMB = DefaultMaxMemoryMB
+	}
+	maxStreams := opts.MaxStreamsPerPeerProtocol
+	if maxStreams <= 0 {
+		maxStreams = DefaultMaxStreamsPerPeerProtocol
+	}
+
+	limits := rcmgr.DefaultLimits
+	libp2p.SetDefaultServiceLimits(&limits)
+
+	// A single peer may not hold more than maxStreams inbound streams on any one protocol
+	limits.ProtocolPeerBaseLimit.StreamsInbound = maxStreams
+	limits.ProtocolPeerLimitIncrease.StreamsInbound = 0
+
+	memoryLimit := int64(maxMemoryMB) << 20
+	concrete := rcmgr.PartialLimitConfig{
+		System: rcmgr.ResourceLimits{Memory: rcmgr.LimitVal64(memoryLimit)},
+	}.Build(limits.AutoScale())
+
+	rm, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(concrete))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create resource manager: %w", err)
+	}
+	return rm, memoryLimit, nil
+}
+
+// ResourceStats returns current stream, connection and memory usage
+func (p *P2PHost) ResourceStats() *ResourceStats {
+	rm := p.host.Network().ResourceManager()
+	stats := &ResourceStats{MemoryLimit: p.memoryLimit}
+
+	rm.ViewSystem(func(scope network.ResourceScope) error {
+		stats.System = scope.Stat()
+		return nil
+	})
+
+	for _, pid := range p.host.Network().Peers() {
+		rm.ViewPeer(pid, func(scope network.PeerScope) error {
+			stats.BusiestPeers = append(stats.BusiestPeers, PeerResources{ID: pid, Stat: scope.Stat()})
+			return nil
+		})
+	}
+	sort.Slice(stats.BusiestPeers, func(i, j int) bool {
+		a, b := stats.BusiestPeers[i].Stat, stats.BusiestPeers[j].Stat
+		return a.NumStreamsInbound+a.NumStreamsOutbound > b.NumStreamsInbound+b.NumStreamsOutbound
+	})
+	if len(stats.BusiestPeers) > 5 {
+		stats.BusiestPeers = stats.BusiestPeers[:5]
+	}
+	return stats
+}
@@ -0,0 +1,188 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// scoreInspectInterval is how often peer scores are sampled and persisted
+	scoreInspectInterval = time.Minute
+
+	// rememberedScoreDecay shrinks a penalty carried over from a previous run each interval,
+	// so a peer that behaves is forgiven within about half an hour
+	rememberedScoreDecay = 0.9
+)
+
+// PeerScoreStore persists GossipSub peer scores across restarts
+type PeerScoreStore interface {
+	GetPeerScores(ctx context.Context) (map[string]float64, error)
+	SavePeerScores(ctx context.Context, scores map[string]float64) error
+}
+
+// peerScoreThresholds gates gossip, publishing and graylisting by score
+func peerScoreThresholds() *pubsub.PeerScoreThresholds {
+	return &pubsub.PeerScoreThresholds{
+		GossipThreshold:             -10,
+		PublishThreshold:            -50,
+		GraylistThreshold:           -80,
+		AcceptPXThreshold:           10,
+		OpportunisticGraftThreshold: 5,
+	}
+}
+
+// peerScoreParams returns router-wide scoring; per-topic parameters are set when a topic is joined
+func (p *P2PHost) peerScoreParams() *pubsub.PeerScoreParams {
+	return &pubsub.PeerScoreParams{
+		Topics:        make(map[string]*pubsub.TopicScoreParams),
+		TopicScoreCap: 50,
+
+		// Penalties remembered from earlier sessions
+		AppSpecificScore:  p.rememberedScore,
+		AppSpecificWeight: 1,
+
+		// Several whisper nodes commonly share an IP (same LAN or machine), so don't penalize it
+		IPColocationFactorWeight: 0,
+
+		// Broken gossip promises and other protocol misbehaviour
+		BehaviourPenaltyWeight:    -10,
+		BehaviourPenaltyThreshold: 6,
+		BehaviourPenaltyDecay:     pubsub.ScoreParameterDecay(10 * time.Minute),
+
+		DecayInterval: pubsub.DefaultDecayInterval,
+		DecayToZero:   pubsub.DefaultDecayToZero,
+		RetainScore:   time.Hour,
+	}
+}
+
+// ConferenceTopicScoreParams are tuned for small, low-traffic conference topics:
+// peers earn a little for staying in the mesh and delivering messages first, and
+// lose heavily for forwarding messages that fail validation. Mesh delivery quotas
+// are disabled because quiet conferences would otherwise penalize honest peers.
+func ConferenceTopicScoreParams() *pubsub.TopicScoreParams {
+	return &pubsub.TopicScoreParams{
+		TopicWeight: 1,
+
+		TimeInMeshWeight:  0.01,
+		TimeInMeshQuantum: time.Second,
+		TimeInMeshCap:     3600,
+
+		FirstMessageDeliveriesWeight: 1,
+		FirstMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(time.Hour),
+		FirstMessageDeliveriesCap:    20,
+
+		InvalidMessageDeliveriesWeight: -100,
+		InvalidMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(time.Hour),
+	}
+}
+
+// PeerScores returns the most recently sampled GossipSub score for each peer
+func (p *P2PHost) PeerScores() map[peer.ID]float64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	scores := make(map[peer.ID]float64, len(p.scores))
+	for pid, score := range p.scores {
+		scores[pid] = score
+	}
+	return scores
+}
+
+// loadPeerScores restores penalties persisted by a previous run
+func (p *P2PHost) loadPeerScores(store PeerScoreStore) {
+	saved, err := store.GetPeerScores(p.ctx)
+	if err != nil {
+		fmt.Printf("Warning: Failed to load peer scores: %v\n", err)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, score := range saved {
+		pid, err := peer.Decode(id)
+		if err != nil || score >= 0 {
+			continue
+		}
+		p.remembered[pid] = score
+	}
+}
+
+// rememberedScore is the app-specific score: a penalty carried over from
+// earlier runs, plus any the reputation handler gives the peer
+func (p *P2PHost) rememberedScore(pid peer.ID) float64 {
+	p.mu.RLock()
+	score, reputation := p.remembered[pid], p.reputationHandler
+	p.mu.RUnlock()
+
+	if reputation != nil {
+		score += reputation(pid)
+	}
+	return score
+}
+
+// SetReputationHandler sets the source of a penalty (zero or less) for how a
+// peer has behaved toward the app. It is added to the peer's GossipSub score,
+// so poorly behaved peers are gossiped to less and eventually graylisted.
+func (p *P2PHost) SetReputationHandler(handler func(peer.ID) float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reputationHandler = handler
+}
+
+// SetConnectionFilter sets the check new connections must pass; connections
+// from peers it rejects are closed straight away
+func (p *P2PHost) SetConnectionFilter(allow func(peer.ID) bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.connectionFilter = allow
+}
+
+// allowConnection runs the connection filter on a newly connected peer
+func (p *P2PHost) allowConnection(pid peer.ID) bool {
+	p.mu.RLock()
+	allow := p.connectionFilter
+	p.mu.RUnlock()
+	return allow == nil || allow(pid)
+}
+
+// DisconnectPeer closes every connection to a peer
+func (p *P2PHost) DisconnectPeer(pid peer.ID) error {
+	return p.host.Network().ClosePeer(pid)
+}
+
+// inspectPeerScores records a score snapshot, decays remembered penalties and persists them
+func (p *P2PHost) inspectPeerScores(snapshot map[peer.ID]float64) {
+	p.mu.Lock()
+	p.scores = snapshot
+	for pid, score := range p.remembered {
+		score *= rememberedScoreDecay
+		if score > -0.01 {
+			delete(p.remembered, pid)
+		} else {
+			p.remembered[pid] = score
+		}
+	}
+	store := p.scoreStore
+	p.mu.Unlock()
+
+	if store == nil {
+		return
+	}
+
+	// Only penalties are worth carrying over; zero clears a stored score
+	toSave := make(map[string]float64, len(snapshot))
+	for pid, score := range snapshot {
+		if score < 0 {
+			toSave[pid.String()] = score
+		} else {
+			toSave[pid.String()] = 0
+		}
+	}
+	if err := store.SavePeerScores(p.ctx, toSave); err != nil {
+		fmt.Printf("Warning: Failed to save peer scores: %v\n", err)
+	}
+}
@@ -0,0 +1,85 @@
+package p2p
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// maxVersionLength bounds the version and platform a peer may share
+	maxVersionLength = 64
+
+	// userAgentPrefix starts the libp2p user agent whisper nodes announce
+	userAgentPrefix = "whisper/"
+)
+
+// Version is the Whisper release this build reports to peers. Release builds
+// set it with -ldflags "-X github.com/austinwklein/whisper/p2p.Version=v1.2.3";
+// otherwise it comes from the module version, or "dev" for a local build.
+var Version string
+
+// Platform is the operating system and architecture this build runs on
+var Platform = runtime.GOOS + "/" + runtime.GOARCH
+
+func init() {
+	if Version != "" {
+		return
+	}
+	Version = "dev"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		Version = info.Main.Version
+	}
+}
+
+// requiredProtocols lists, for each protocol whisper can't work without,
+// the IDs that speak it; a peer needs one of each
+var (
+	requiredMu        sync.Mutex
+	requiredProtocols [][]protocol.ID
+)
+
+// RequireProtocol marks a protocol as one a peer must speak, in any of the
+// given versions, for the two nodes to be compatible. Marking it again, e.g.
+// from a second manager in the same process, changes nothing.
+func RequireProtocol(ids ...protocol.ID) {
+	requiredMu.Lock()
+	defer requiredMu.Unlock()
+	for _, required := range requiredProtocols {
+		if required[0] == ids[0] {
+			return
+		}
+	}
+	requiredProtocols = append(requiredProtocols, ids)
+}
+
+// MissingProtocols returns the required protocols a peer speaks no version
+// of, by their newest ID. It is empty when the peer is compatible or its
+// protocols aren't known yet.
+func (p *P2PHost) MissingProtocols(peerID peer.ID) []protocol.ID {
+	supported, err := p.host.Peerstore().GetProtocols(peerID)
+	if err != nil || len(supported) == 0 {
+		return nil
+	}
+	speaks := make(map[protocol.ID]bool, len(supported))
+	for _, id := range supported {
+		speaks[id] = true
+	}
+
+	requiredMu.Lock()
+	defer requiredMu.Unlock()
+	missing := []protocol.ID{}
+	for _, ids := range requiredProtocols {
+		found := false
+		for _, id := range ids {
+			found = found || speaks[id]
+		}
+		if !found {
+			missing = append(missing, ids[0])
+		}
+	}
+	return missing
+}
@@ -0,0 +1,233 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+)
+
+const (
+	// watchdogInterval is how often the watchdog checks host health
+	watchdogInterval = 30 * time.Second
+
+	// minRestartCooldown is the shortest wait after a soft restart before another
+	minRestartCooldown = 5 * time.Minute
+
+	// maxRestartBackoff caps the delay between consecutive soft restarts
+	maxRestartBackoff = time.Hour
+
+	// maxRedialPeers caps how many previously seen peers are redialed after a restart
+	maxRedialPeers = 20
+)
+
+// Health event kinds
+const (
+	HealthNoPeers       = "no_peers"       // No connections for longer than the configured timeout
+	HealthDialFailures  = "dial_failures"  // Too many consecutive failed dials
+	HealthRestart       = "restart"        // A soft restart was performed
+	HealthRestartFailed = "restart_failed" // A soft restart step failed
+	HealthRecovered     = "recovered"      // Peers are connected again after a problem
+)
+
+// WatchdogConfig controls when the watchdog considers the host wedged
+type WatchdogConfig struct {
+	NoPeersTimeout  time.Duration // Restart after this long without any connection (0 = never)
+	MaxDialFailures int           // Restart after this many consecutive failed dials (0 = never)
+}
+
+// HealthEvent is a diagnostic event emitted by the watchdog
+type HealthEvent struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Detail string    `json:"detail"`
+}
+
+// SetHealthHandler sets a callback for watchdog diagnostic events
+func (p *P2PHost) SetHealthHandler(handler func(event HealthEvent)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.healthHandler = handler
+}
+
+// StartWatchdog supervises the host until ctx is cancelled, soft-restarting the
+// P2P stack when it stops making connections
+func (p *P2PHost) StartWatchdog(ctx context.Context, cfg WatchdogConfig) {
+	if cfg.NoPeersTimeout <= 0 && cfg.MaxDialFailures <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+
+	w := newWatchdog(cfg, time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		kind, detail := w.check(time.Now(), len(p.host.Network().Peers()), p.consecutiveDialFailures())
+		if kind == "" {
+			continue
+		}
+		p.emitHealth(kind, detail)
+		if kind != HealthRecovered {
+			p.SoftRestart(ctx)
+		}
+	}
+}
+
+// watchdog decides when the host is wedged enough to restart
+type watchdog struct {
+	cfg          WatchdogConfig
+	lastPeerSeen time.Time
+	lastRestart  time.Time
+	cooldown     time.Duration // Wait after lastRestart before the next one (0 = none yet)
+	unhealthy    bool
+}
+
+// newWatchdog starts a watchdog that last saw a peer at now
+func newWatchdog(cfg WatchdogConfig, now time.Time) *watchdog {
+	return &watchdog{cfg: cfg, lastPeerSeen: now}
+}
+
+// check looks at the host's state on one tick and returns the health event to
+// emit, or "" for none. Any kind but HealthRecovered calls for a restart.
+func (w *watchdog) check(now time.Time, peers, failures int) (string, string) {
+	if peers > 0 {
+		w.lastPeerSeen = now
+		w.cooldown = 0
+		if w.unhealthy {
+			w.unhealthy = false
+			return HealthRecovered, fmt.Sprintf("%d peer(s) connected", peers)
+		}
+		return "", ""
+	}
+
+	// Give the last restart time to work, so a network that stays down
+	// doesn't restart the host every interval
+	if w.cooldown > 0 && now.Sub(w.lastRestart) < w.cooldown {
+		return "", ""
+	}
+
+	var kind, detail string
+	switch {
+	case w.cfg.MaxDialFailures > 0 && failures >= w.cfg.MaxDialFailures:
+		kind, detail = HealthDialFailures, fmt.Sprintf("%d consecutive dial failures", failures)
+	case w.cfg.NoPeersTimeout > 0 && now.Sub(w.lastPeerSeen) >= w.cfg.NoPeersTimeout:
+		kind, detail = HealthNoPeers, fmt.Sprintf("no peers for %s", now.Sub(w.lastPeerSeen).Round(time.Second))
+	default:
+		return "", ""
+	}
+
+	// Back off exponentially until a peer connects again
+	if w.cooldown == 0 {
+		w.cooldown = max(w.cfg.NoPeersTimeout, minRestartCooldown)
+	} else {
+		w.cooldown = min(w.cooldown*2, maxRestartBackoff)
+	}
+	w.unhealthy = true
+	w.lastRestart = now
+	return kind, detail
+}
+
+// SoftRestart resets networking state without replacing the host, so protocol
+// handlers registered by the managers stay in place: it drops stale
+// connections, re-bootstraps the DHT, restarts mDNS and redials known peers.
+func (p *P2PHost) SoftRestart(ctx context.Context) {
+	for _, pid := range p.host.Network().Peers() {
+		p.host.Network().ClosePeer(pid)
+	}
+	p.resetDialFailures()
+
+	if err := p.routing().Bootstrap(ctx); err != nil {
+		p.emitHealth(HealthRestartFailed, fmt.Sprintf("DHT bootstrap: %v", err))
+	}
+
+	if err := p.restartMDNS(); err != nil {
+		p.emitHealth(HealthRestartFailed, fmt.Sprintf("mDNS: %v", err))
+	}
+
+	redialed := 0
+	for _, pid := range p.host.Peerstore().PeersWithAddrs() {
+		if pid == p.host.ID() || redialed >= maxRedialPeers {
+			continue
+		}
+		redialed++
+		go func(pid peer.ID) {
+			dialCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+			defer cancel()
+			// Failures here aren't counted: they would only trigger the
+			// next restart, and the peers may simply be gone
+			p.host.Connect(dialCtx, p.host.Peerstore().PeerInfo(pid))
+		}(pid)
+	}
+
+	p.emitHealth(HealthRestart, fmt.Sprintf("soft restart complete, redialing %d known peer(s)", redialed))
+}
+
+// restartMDNS replaces the mDNS service with a freshly started one
+func (p *P2PHost) restartMDNS() error {
+	p.mu.Lock()
+	old := p.discovery
+	p.discovery = nil
+	p.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return p.startMDNS()
+}
+
+// startMDNS starts local network discovery
+func (p *P2PHost) startMDNS() error {
+	if p.simulated {
+		return nil // Simulated swarms are wired up by the test
+	}
+
+	ser := mdns.NewMdnsService(p.host, "whisper-mdns", &discoveryNotifee{h: p})
+	if err := ser.Start(); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.discovery = ser
+	p.mu.Unlock()
+	return nil
+}
+
+// recordDialFailure counts a failed outbound connection attempt
+func (p *P2PHost) recordDialFailure() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialFailures++
+}
+
+// resetDialFailures clears the consecutive dial failure count
+func (p *P2PHost) resetDialFailures() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialFailures = 0
+}
+
+// consecutiveDialFailures returns the number of failed dials since the last success
+func (p *P2PHost) consecutiveDialFailures() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.dialFailures
+}
+
+// emitHealth sends a diagnostic event to the health handler, if any
+func (p *P2PHost) emitHealth(kind, detail string) {
+	p.mu.RLock()
+	handler := p.healthHandler
+	p.mu.RUnlock()
+
+	if handler != nil {
+		handler(HealthEvent{Time: time.Now(), Kind: kind, Detail: detail})
+	}
+}
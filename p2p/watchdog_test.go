@@ -0,0 +1,61 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+)
+
+// TestWatchdogBacksOffWhileNetworkStaysDown checks a network that never comes
+// back restarts the host on a growing interval, not on every tick
+func TestWatchdogBacksOffWhileNetworkStaysDown(t *testing.T) {
+	cfg := WatchdogConfig{NoPeersTimeout: 10 * time.Minute, MaxDialFailures: 5}
+	start := time.Now()
+	w := newWatchdog(cfg, start)
+
+	var restarts []time.Time
+	for now := start; now.Before(start.Add(24 * time.Hour)); now = now.Add(watchdogInterval) {
+		// Every dial keeps failing
+		if kind, _ := w.check(now, 0, cfg.MaxDialFailures); kind != "" {
+			restarts = append(restarts, now)
+		}
+	}
+
+	if len(restarts) == 0 {
+		t.Fatal("never restarted")
+	}
+	if limit := int(24*time.Hour/maxRestartBackoff) + 5; len(restarts) > limit {
+		t.Fatalf("restarted %d times in a day, want at most %d", len(restarts), limit)
+	}
+	for i := 1; i < len(restarts); i++ {
+		if gap := restarts[i].Sub(restarts[i-1]); gap < minRestartCooldown {
+			t.Errorf("restart %d came only %s after the last", i, gap)
+		}
+	}
+	for i := 2; i < len(restarts); i++ {
+		gap, prev := restarts[i].Sub(restarts[i-1]), restarts[i-1].Sub(restarts[i-2])
+		if gap < prev && gap < maxRestartBackoff {
+			t.Errorf("restart %d came %s after the last, sooner than the %s before", i, gap, prev)
+		}
+	}
+}
+
+func TestWatchdogRecovers(t *testing.T) {
+	cfg := WatchdogConfig{NoPeersTimeout: 10 * time.Minute}
+	start := time.Now()
+	w := newWatchdog(cfg, start)
+
+	now := start.Add(cfg.NoPeersTimeout)
+	if kind, _ := w.check(now, 0, 0); kind != HealthNoPeers {
+		t.Fatalf("check after timeout = %q, want %q", kind, HealthNoPeers)
+	}
+	now = now.Add(watchdogInterval)
+	if kind, _ := w.check(now, 2, 0); kind != HealthRecovered {
+		t.Fatalf("check with peers = %q, want %q", kind, HealthRecovered)
+	}
+
+	// A fresh outage starts the backoff over
+	now = now.Add(cfg.NoPeersTimeout)
+	if kind, _ := w.check(now, 0, 0); kind != HealthNoPeers {
+		t.Fatalf("check after second outage = %q, want %q", kind, HealthNoPeers)
+	}
+}
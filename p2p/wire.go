@@ -0,0 +1,84 @@
+package p2p
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// MaxWireMessageSize caps one newline-delimited JSON message read from a stream.
+// Without it a peer could send an endless line and grow our read buffer unbounded.
+const MaxWireMessageSize = 64 * 1024
+
+// Field limits shared by every wire message
+const (
+	MaxUsernameLength = 64
+	MaxFullNameLength = 128
+	MaxStatusLength   = 140       // Profile status messages
+	MaxNoteLength     = 1024      // Free-text notes on requests and invites
+	MaxContentLength  = 32 * 1024 // Direct and conference message bodies
+)
+
+// Wire decoding errors
+var (
+	ErrMessageTooLarge = errors.New("wire message too large")
+	ErrContentTooLong  = fmt.Errorf("message content longer than %d bytes", MaxContentLength)
+)
+
+// ReadWireMessage reads one newline-delimited message of at most MaxWireMessageSize
+// bytes. It returns io.EOF only when the stream ended before any data arrived; a
+// final message without a trailing newline is returned as-is.
+func ReadWireMessage(r *bufio.Reader) ([]byte, error) {
+	var data []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(data)+len(chunk) > MaxWireMessageSize {
+			return nil, ErrMessageTooLarge
+		}
+		data = append(data, chunk...)
+
+		switch {
+		case err == nil:
+			return data, nil
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case err == io.EOF:
+			if len(data) == 0 {
+				return nil, io.EOF
+			}
+			return data, nil
+		default:
+			return nil, err
+		}
+	}
+}
+
+// CheckTextField validates a string field of a decoded wire message: it must be
+// valid UTF-8, at most maxLen bytes, and non-empty when required
+func CheckTextField(name, value string, maxLen int, required bool) error {
+	if required && value == "" {
+		return fmt.Errorf("missing %s", name)
+	}
+	if len(value) > maxLen {
+		return fmt.Errorf("%s longer than %d bytes", name, maxLen)
+	}
+	if !utf8.ValidString(value) {
+		return fmt.Errorf("%s is not valid UTF-8", name)
+	}
+	return nil
+}
+
+// CheckPeerIDField validates that a wire message field holds a well-formed peer ID
+func CheckPeerIDField(name, value string) error {
+	if value == "" {
+		return fmt.Errorf("missing %s", name)
+	}
+	if _, err := peer.Decode(value); err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return nil
+}
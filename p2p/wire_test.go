@@ -0,0 +1,73 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// FuzzReadWireMessage checks that a stream read never returns more than
+// MaxWireMessageSize bytes at once and never invents or reorders data
+func FuzzReadWireMessage(f *testing.F) {
+	f.Add([]byte("{\"a\":1}\n{\"b\":2}\n"))
+	f.Add([]byte("no trailing newline"))
+	f.Add([]byte(strings.Repeat("x", MaxWireMessageSize) + "\n"))
+	f.Add([]byte(strings.Repeat("x", MaxWireMessageSize+1)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bufio.NewReader(bytes.NewReader(data))
+		var read []byte
+		for {
+			message, err := ReadWireMessage(r)
+			if err != nil {
+				break
+			}
+			if len(message) > MaxWireMessageSize {
+				t.Fatalf("read %d bytes, over the %d byte cap", len(message), MaxWireMessageSize)
+			}
+			read = append(read, message...)
+		}
+		if !bytes.HasPrefix(data, read) {
+			t.Fatalf("read data that isn't a prefix of the stream")
+		}
+	})
+}
+
+func TestReadWireMessageCapsLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+		err   error
+	}{
+		{"lines", "one\ntwo\n", []string{"one\n", "two\n"}, nil},
+		{"last line without newline", "one\ntwo", []string{"one\n", "two"}, nil},
+		{"at the cap", strings.Repeat("x", MaxWireMessageSize-1) + "\n", []string{strings.Repeat("x", MaxWireMessageSize-1) + "\n"}, nil},
+		{"over the cap", strings.Repeat("x", MaxWireMessageSize+1) + "\n", nil, ErrMessageTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+			var got []string
+			var err error
+			for {
+				var message []byte
+				if message, err = ReadWireMessage(r); err != nil {
+					break
+				}
+				got = append(got, string(message))
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("read %d messages, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("message %d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+			if tt.err != nil && err != tt.err {
+				t.Errorf("error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/austinwklein/whisper/i18n"
+	"golang.org/x/term"
+)
+
+var (
+	errNoInput          = errors.New("input ended before a password was entered")
+	errPasswordMismatch = errors.New("passwords don't match")
+	errPasswordStdin    = errors.New("--password-file - would read the commands as the password; leave the password out to be asked for it")
+	errPasswordArgs     = errors.New("expected a password, --password-file <file>, or nothing to be asked for it")
+	errNoPIN            = errors.New("no PIN entered; use 'lock-pin --remove' to remove it")
+)
+
+// readPassword asks for a password without showing it as it is typed. When
+// standard input isn't a terminal, as when a script pipes commands in, the
+// next line of input is the password.
+func (a *App) readPassword(prompt string) (string, error) {
+	i18n.Print(prompt)
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		password, err := term.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			return "", fmt.Errorf("failed to read password: %w", err)
+		}
+		return string(password), nil
+	}
+	return a.readInputLine()
+}
+
+// readLine asks for a line of ordinary, visible input
+func (a *App) readLine(prompt string) (string, error) {
+	i18n.Print(prompt)
+	line, err := a.readInputLine()
+	return strings.TrimSpace(line), err
+}
+
+// readInputLine reads the next line the command loop would have read
+func (a *App) readInputLine() (string, error) {
+	if a.input == nil || !a.input.Scan() {
+		return "", errNoInput
+	}
+	return strings.TrimRight(a.input.Text(), "\r"), nil
+}
+
+// readNewPassword asks for a new password, twice on a terminal so a typo
+// can't lock the user out
+func (a *App) readNewPassword(prompt string) (string, error) {
+	password, err := a.readPassword(prompt)
+	if err != nil {
+		return "", err
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return password, nil
+	}
+	confirm, err := a.readPassword(i18n.T("Confirm password: "))
+	if err != nil {
+		return "", err
+	}
+	if confirm != password {
+		return "", errPasswordMismatch
+	}
+	return password, nil
+}
+
+// passwordArg returns the password a command was given: read from the file
+// after --password-file, typed inline, or, with neither, asked for without
+// showing it
+func (a *App) passwordArg(args []string, prompt string) (string, error) {
+	switch {
+	case len(args) == 2 && args[0] == "--password-file":
+		if args[1] == "-" {
+			return "", errPasswordStdin
+		}
+		return readPasswordFile(args[1])
+	case len(args) == 1 && args[0] != "--password-file":
+		return args[0], nil
+	case len(args) == 0:
+		return a.readPassword(prompt)
+	}
+	return "", errPasswordArgs
+}
+
+// registerArgs returns the account `register` creates: from
+// `register <username>`, asking for the full name and password, or from
+// `register <username> --password-file <file> <full-name>`. The old
+// `register <username> <password> <full-name>` still works.
+func (a *App) registerArgs(parts []string) (username, password, fullName string, ok bool) {
+	var err error
+	switch {
+	case len(parts) == 2:
+		if fullName, err = a.readLine(i18n.T("Full name: ")); err == nil {
+			password, err = a.readNewPassword(i18n.T("Password: "))
+		}
+	case len(parts) >= 5 && parts[2] == "--password-file":
+		password, err = a.passwordArg(parts[2:4], "")
+		fullName = strings.Join(parts[4:], " ")
+	case len(parts) >= 4 && parts[2] != "--password-file":
+		password = parts[2]
+		fullName = strings.Join(parts[3:], " ")
+	default:
+		i18n.Println("Usage: register <username> [--password-file <file> <full-name>]")
+		i18n.Println("Without --password-file you are asked for your full name and a password, which isn't shown")
+		return "", "", "", false
+	}
+	if err != nil {
+		i18n.Printf("Registration failed: %v\n", err)
+		return "", "", "", false
+	}
+	return parts[1], password, strings.Trim(fullName, "\""), true
+}
+
+// passwdArgs returns the current and new passwords for `passwd`, asking for
+// them without showing them. The old `passwd <old-password> <new-password>`
+// still works.
+func (a *App) passwdArgs(parts []string) (oldPassword, newPassword string, ok bool) {
+	switch len(parts) {
+	case 1:
+		var err error
+		if oldPassword, err = a.readPassword(i18n.T("Current password: ")); err == nil {
+			newPassword, err = a.readNewPassword(i18n.T("New password: "))
+		}
+		if err != nil {
+			i18n.Printf("Failed to change password: %v\n", err)
+			return "", "", false
+		}
+		return oldPassword, newPassword, true
+	case 3:
+		return parts[1], parts[2], true
+	}
+	i18n.Println("Usage: passwd")
+	i18n.Println("You are asked for your current and new passwords, which aren't shown")
+	return "", "", false
+}
+
+// lockPINArgs returns the PIN `lock-pin` sets, asking for it without showing
+// it or reading it from the file after --password-file. `lock-pin --remove`
+// returns an empty PIN, which removes it.
+func (a *App) lockPINArgs(parts []string) (pin string, ok bool) {
+	var err error
+	switch {
+	case len(parts) == 2 && parts[1] == "--remove":
+		return "", true
+	case len(parts) == 1:
+		pin, err = a.readNewPassword(i18n.T("PIN: "))
+	case len(parts) == 3 && parts[1] == "--password-file":
+		pin, err = a.passwordArg(parts[1:], "")
+	default:
+		i18n.Println("Usage: lock-pin [--password-file <file> | --remove]")
+		i18n.Println("Without --password-file you are asked for the PIN, which isn't shown")
+		return "", false
+	}
+	if err == nil && pin == "" {
+		err = errNoPIN
+	}
+	if err != nil {
+		i18n.Printf("Failed to set PIN: %v\n", err)
+		return "", false
+	}
+	return pin, true
+}
@@ -0,0 +1,9 @@
+// Package pb holds the protobuf schema for whisper's wire messages and the Go
+// types generated from it. Version 2.0.0 of each stream protocol carries these
+// messages; version 1.0.0 carries the JSON forms in the protocol packages and
+// is kept for older peers. Conference topics carry these messages once every
+// member reads them, and JSON until then. The .proto files are the reference
+// for clients written in other languages.
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative conference.proto friends.proto messages.proto presence.proto sync.proto
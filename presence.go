@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// presenceLookupTimeout bounds one friend's DHT presence lookup
+const presenceLookupTimeout = 10 * time.Second
+
+// trackFriendPresence keeps friends' last-seen times current: connected friends
+// are seen now, and offline ones are looked up on the DHT. It runs until the
+// session ends.
+func (a *App) trackFriendPresence(ctx context.Context, user *storage.User) {
+	ticker := time.NewTicker(p2p.PresenceRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		a.refreshFriendPresence(ctx, user)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshFriendPresence updates the stored last-seen time of every friend once
+func (a *App) refreshFriendPresence(ctx context.Context, user *storage.User) {
+	friends, err := a.friendManager.GetFriends(ctx, user.ID)
+	if err != nil {
+		i18n.Printf("Warning: Failed to load friends for presence: %v\n", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, friend := range friends {
+		pid, err := peer.Decode(friend.PeerID)
+		if err != nil || a.p2p.PresenceHidden(pid) {
+			continue
+		}
+
+		if a.p2p.IsConnected(pid) {
+			if err := a.storage.TouchKnownPeer(ctx, friend.PeerID, time.Now()); err != nil {
+				i18n.Printf("Warning: Failed to record last seen: %v\n", err)
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func(pid peer.ID) {
+			defer wg.Done()
+			lookupCtx, cancel := context.WithTimeout(ctx, presenceLookupTimeout)
+			defer cancel()
+			seen, err := a.p2p.LookupLastSeen(lookupCtx, pid)
+			if err != nil {
+				return // Not published yet, or the DHT is unreachable
+			}
+			if err := a.storage.TouchKnownPeer(ctx, pid.String(), seen); err != nil {
+				i18n.Printf("Warning: Failed to record last seen: %v\n", err)
+			}
+		}(pid)
+	}
+	wg.Wait()
+}
+
+// formatLastSeen renders a last-seen time as "last online 2h ago"
+func formatLastSeen(seen time.Time) string {
+	ago := time.Since(seen)
+	switch {
+	case ago < time.Minute:
+		return i18n.T("last online just now")
+	case ago < time.Hour:
+		return i18n.Sprintf("last online %dm ago", int(ago.Minutes()))
+	case ago < 24*time.Hour:
+		return i18n.Sprintf("last online %dh ago", int(ago.Hours()))
+	default:
+		return i18n.Sprintf("last online %dd ago", int(ago.Hours()/24))
+	}
+}
+
+// redialDelays are the waits before each attempt to reconnect a friend whose
+// connection was found dead
+var redialDelays = []time.Duration{0, 30 * time.Second, 2 * time.Minute, 10 * time.Minute}
+
+// keepFriendsAlive pings connected friends until the session ends, so a
+// connection that silently died stops showing the friend as online
+func (a *App) keepFriendsAlive(ctx context.Context, user *storage.User) {
+	if a.config.KeepaliveSeconds <= 0 {
+		return
+	}
+
+	cfg := p2p.KeepaliveConfig{
+		Interval: time.Duration(a.config.KeepaliveSeconds) * time.Second,
+		Timeout:  time.Duration(a.config.KeepaliveTimeoutSeconds) * time.Second,
+	}
+	a.p2p.StartKeepalive(ctx, cfg, func() []peer.ID {
+		friends, err := a.friendManager.GetFriends(ctx, user.ID)
+		if err != nil {
+			return nil
+		}
+		peers := make([]peer.ID, 0, len(friends))
+		for _, friend := range friends {
+			if pid, err := peer.Decode(friend.PeerID); err == nil {
+				peers = append(peers, pid)
+			}
+		}
+		return peers
+	})
+}
+
+// onPresenceChange tells the user when a friend drops off or comes back, and
+// starts redialing friends whose connection died
+func (a *App) onPresenceChange(ctx context.Context, event p2p.PresenceEvent) {
+	name := event.Peer.String()[:16] + "..."
+	if contact, err := a.storage.GetUserByPeerID(ctx, event.Peer.String()); err == nil {
+		name = contact.Username
+	}
+
+	// Friends hiding their online status are still redialed, just not reported
+	hidden := a.p2p.PresenceHidden(event.Peer)
+
+	switch event.Kind {
+	case p2p.PresenceOffline:
+		if !hidden {
+			i18n.Printf("\n📴 %s went offline (%s)\n> ", name, event.Detail)
+		}
+		go a.redialFriend(ctx, event.Peer)
+	case p2p.PresenceOnline:
+		if hidden {
+			return
+		}
+		if err := a.storage.TouchKnownPeer(ctx, event.Peer.String(), event.Time); err != nil {
+			i18n.Printf("Warning: Failed to record last seen: %v\n", err)
+		}
+		i18n.Printf("\n🟢 %s is back online (%s round trip)\n> ", name, event.RTT.Round(time.Millisecond))
+	}
+}
+
+// redialFriend tries to reconnect a friend whose connection died, backing off
+// between attempts, until it succeeds, the user logs out or the auto-dial
+// policy no longer allows it
+func (a *App) redialFriend(ctx context.Context, pid peer.ID) {
+	for _, delay := range redialDelays {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if !a.auth.IsAuthenticated() || a.p2p.IsConnected(pid) {
+			return
+		}
+
+		friend := a.friendByPeer(ctx, pid)
+		if friend == nil || !a.autoDialAllowed(friend, dialOnRedial) {
+			return
+		}
+		if err := a.dialFriend(ctx, friend); err == nil {
+			return // The keepalive reports it back online on its next round
+		}
+	}
+}
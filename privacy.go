@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Privacy settings, stored per account in the settings table with optional
+// per-friend overrides. All are on unless turned off.
+const (
+	settingReadReceipts = "read_receipts"
+	settingConfRequests = "conference_requests"
+)
+
+// settingOnlineStatus says who may see when the user is online or was last
+// seen. It is account-wide, without per-friend overrides.
+const settingOnlineStatus = "online_status"
+
+// Online status visibility values
+const (
+	visibleEveryone = "everyone"
+	visibleFriends  = "friends"
+	visibleNobody   = "nobody"
+)
+
+// privacySetting describes one privacy setting for the privacy command
+type privacySetting struct {
+	arg        string // Name used on the command line
+	name       string // Name in the settings table
+	label      string
+	capability string // Advertised to peers the setting is off for
+}
+
+var privacySettings = []privacySetting{
+	{"receipts", settingReadReceipts, "Read receipts", p2p.CapabilityReceiptsOff},
+	{"conf-requests", settingConfRequests, "Friend requests from conference members", p2p.CapabilityConfRequestsOff},
+}
+
+// settingEnabled reports whether an on/off setting is on for a friend: their
+// own override if set, else the account default, else on. friendID 0 asks
+// for the account default.
+func (a *App) settingEnabled(ctx context.Context, userID, friendID int64, name string) bool {
+	if friendID != 0 {
+		if setting, err := a.storage.GetSetting(ctx, userID, friendID, name); err == nil && setting != nil {
+			return setting.Value != "off"
+		}
+	}
+	if setting, err := a.storage.GetSetting(ctx, userID, 0, name); err == nil && setting != nil {
+		return setting.Value != "off"
+	}
+	return true
+}
+
+// receiptsAllowed is the message manager's receipt policy
+func (a *App) receiptsAllowed(ctx context.Context, contact *storage.User) bool {
+	user, err := a.auth.CurrentUser()
+	if err != nil || user == nil {
+		return true
+	}
+	return a.settingEnabled(ctx, user.ID, contact.ID, settingReadReceipts)
+}
+
+// friendRequestAllowed is the friend manager's request policy: with
+// conference requests off, it turns away requests from people the user only
+// knows from a conference they're both in
+func (a *App) friendRequestAllowed(ctx context.Context, from peer.ID) bool {
+	user, err := a.auth.CurrentUser()
+	if err != nil || user == nil {
+		return true
+	}
+	friendID := int64(0)
+	if contact, err := a.storage.GetUserByPeerID(ctx, from.String()); err == nil {
+		friendID = contact.ID
+		// Requests crossing one we sent them are always welcome
+		if sent, err := a.storage.GetFriendRequest(ctx, user.ID, contact.ID); err == nil && sent != nil {
+			return true
+		}
+	}
+	if a.settingEnabled(ctx, user.ID, friendID, settingConfRequests) {
+		return true
+	}
+	return a.sharedConference(ctx, user.ID, from) == nil
+}
+
+// sharedConference returns a conference the user and a peer both take part
+// in, or nil if there is none
+func (a *App) sharedConference(ctx context.Context, userID int64, pid peer.ID) *storage.Conference {
+	conferences, err := a.conferenceManager.GetConferences(ctx, userID)
+	if err != nil {
+		return nil
+	}
+	for _, conf := range conferences {
+		participants, err := a.conferenceManager.GetConferenceParticipants(ctx, conf.ID)
+		if err != nil {
+			continue
+		}
+		for _, p := range participants {
+			if p.Active && p.PeerID == pid.String() {
+				return conf
+			}
+		}
+	}
+	return nil
+}
+
+// privacyCapabilities is the P2P host's capability handler: it tells each peer
+// which signals the logged-in user won't send them
+func (a *App) privacyCapabilities(pid peer.ID) []string {
+	user, err := a.auth.CurrentUser()
+	if err != nil || user == nil {
+		return nil
+	}
+	ctx := context.Background()
+	friendID := int64(0)
+	if contact, err := a.storage.GetUserByPeerID(ctx, pid.String()); err == nil {
+		friendID = contact.ID
+	}
+
+	var capabilities []string
+	for _, s := range privacySettings {
+		if !a.settingEnabled(ctx, user.ID, friendID, s.name) {
+			capabilities = append(capabilities, s.capability)
+		}
+	}
+	switch a.onlineVisibility(ctx, user.ID) {
+	case visibleNobody:
+		capabilities = append(capabilities, p2p.CapabilityPresenceHidden)
+	case visibleFriends:
+		if a.friendByPeer(ctx, pid) == nil {
+			capabilities = append(capabilities, p2p.CapabilityPresenceHidden)
+		}
+	}
+	return capabilities
+}
+
+// onlineVisibility returns who may see the user's online status
+func (a *App) onlineVisibility(ctx context.Context, userID int64) string {
+	if setting, err := a.storage.GetSetting(ctx, userID, 0, settingOnlineStatus); err == nil && setting != nil {
+		return setting.Value
+	}
+	return visibleEveryone
+}
+
+// conferencePresenceShown is the conference manager's presence check.
+// Beacons reach every member, friend or not, so they only go out while
+// everyone may see the user online.
+func (a *App) conferencePresenceShown() bool {
+	user, err := a.auth.CurrentUser()
+	if err != nil || user == nil {
+		return true
+	}
+	return a.onlineVisibility(context.Background(), user.ID) == visibleEveryone
+}
+
+// setOnlineVisibility handles `privacy online <everyone|friends|nobody|default>`
+func (a *App) setOnlineVisibility(ctx context.Context, user *storage.User, parts []string) {
+	if len(parts) != 3 {
+		i18n.Println("Usage: privacy online <everyone|friends|nobody|default>")
+		return
+	}
+
+	var err error
+	switch value := parts[2]; value {
+	case visibleEveryone, visibleFriends, visibleNobody:
+		err = a.storage.SaveSetting(ctx, &storage.Setting{UserID: user.ID, Name: settingOnlineStatus, Value: value})
+	case "default":
+		err = a.storage.DeleteSetting(ctx, user.ID, 0, settingOnlineStatus)
+	default:
+		i18n.Println("Usage: privacy online <everyone|friends|nobody|default>")
+		return
+	}
+	if err != nil {
+		i18n.Printf("Failed to save setting: %v\n", err)
+		return
+	}
+
+	// Last-seen records on the DHT are public; tell connected peers the rest
+	a.p2p.SetPresencePublished(a.onlineVisibility(ctx, user.ID) == visibleEveryone)
+	a.p2p.RefreshProfile()
+	i18n.Printf("✓ Your online status is visible to %s\n", i18n.T(a.onlineVisibility(ctx, user.ID)))
+}
+
+// handlePrivacyCommand handles `privacy [receipts|conf-requests <on|off|default> [username]]`
+func (a *App) handlePrivacyCommand(ctx context.Context, user *storage.User, parts []string) {
+	if len(parts) == 1 {
+		a.showPrivacy(ctx, user)
+		return
+	}
+	if parts[1] == "online" {
+		a.setOnlineVisibility(ctx, user, parts)
+		return
+	}
+	if len(parts) < 3 || len(parts) > 4 {
+		i18n.Println("Usage: privacy [receipts|conf-requests <on|off|default> [username]]")
+		return
+	}
+
+	var setting *privacySetting
+	for i := range privacySettings {
+		if privacySettings[i].arg == parts[1] {
+			setting = &privacySettings[i]
+		}
+	}
+	value := parts[2]
+	if setting == nil || (value != "on" && value != "off" && value != "default") {
+		i18n.Println("Usage: privacy [receipts|conf-requests <on|off|default> [username]]")
+		return
+	}
+
+	friendID, who := int64(0), i18n.T("everyone")
+	if len(parts) == 4 {
+		username, ok := a.resolveUsername(ctx, parts[3])
+		if !ok {
+			return
+		}
+		contact, err := a.storage.GetUserByUsername(ctx, username)
+		if err != nil {
+			i18n.Printf("User not found: %v\n", err)
+			return
+		}
+		friendID, who = contact.ID, username
+	}
+
+	var err error
+	if value == "default" {
+		err = a.storage.DeleteSetting(ctx, user.ID, friendID, setting.name)
+	} else {
+		err = a.storage.SaveSetting(ctx, &storage.Setting{UserID: user.ID, FriendID: friendID, Name: setting.name, Value: value})
+	}
+	if err != nil {
+		i18n.Printf("Failed to save setting: %v\n", err)
+		return
+	}
+
+	// Let connected peers know what to expect from now on
+	a.p2p.RefreshProfile()
+
+	state := i18n.T("on")
+	if !a.settingEnabled(ctx, user.ID, friendID, setting.name) {
+		state = i18n.T("off")
+	}
+	i18n.Printf("✓ %s are %s for %s\n", i18n.T(setting.label), state, who)
+}
+
+// showPrivacy prints the account's privacy settings and per-friend overrides
+func (a *App) showPrivacy(ctx context.Context, user *storage.User) {
+	i18n.Println("\n=== Privacy ===")
+	for _, s := range privacySettings {
+		state := i18n.T("on")
+		if !a.settingEnabled(ctx, user.ID, 0, s.name) {
+			state = i18n.T("off")
+		}
+		i18n.Printf("%s: %s\n", i18n.T(s.label), state)
+	}
+	i18n.Printf("Online status visible to: %s\n", i18n.T(a.onlineVisibility(ctx, user.ID)))
+
+	settings, err := a.storage.GetSettings(ctx, user.ID)
+	if err != nil {
+		i18n.Printf("Failed to get settings: %v\n", err)
+		return
+	}
+	header := false
+	for _, setting := range settings {
+		if setting.FriendID == 0 {
+			continue
+		}
+		label := ""
+		for _, s := range privacySettings {
+			if s.name == setting.Name {
+				label = i18n.T(s.label)
+			}
+		}
+		contact, err := a.storage.GetUserByID(ctx, setting.FriendID)
+		if label == "" || err != nil {
+			continue
+		}
+		if !header {
+			i18n.Println("\nFor specific friends:")
+			header = true
+		}
+		i18n.Printf("  %s: %s %s\n", contact.Username, label, i18n.T(setting.Value))
+	}
+}
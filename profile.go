@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/austinwklein/whisper/friends"
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// handleProfileCommand handles `profile [username <name>|name <full name>|status [text]]`
+func (a *App) handleProfileCommand(ctx context.Context, user *storage.User, parts []string) {
+	if len(parts) == 1 {
+		i18n.Printf("Username: %s\n", user.Username)
+		i18n.Printf("Full Name: %s\n", user.FullName)
+		if user.StatusMessage != "" {
+			i18n.Printf("Status: %s\n", user.StatusMessage)
+		} else {
+			i18n.Println("Status: (none)")
+		}
+		return
+	}
+	if parts[1] == "username" && len(parts) == 3 {
+		a.changeUsername(ctx, user, parts[2])
+		return
+	}
+
+	fullName, status := user.FullName, user.StatusMessage
+	text := strings.Join(parts[2:], " ")
+	switch {
+	case parts[1] == "name" && len(parts) > 2:
+		fullName = text
+	case parts[1] == "status":
+		status = text
+	default:
+		i18n.Println("Usage: profile [username <name>|name <full name>|status [text]]")
+		return
+	}
+
+	if err := a.friendManager.UpdateProfile(ctx, user, fullName, status); err != nil {
+		i18n.Printf("Failed to update profile: %v\n", err)
+		return
+	}
+
+	// Peers that aren't friends see the name through identify
+	if a.config.ShareIdentity {
+		a.p2p.SetLocalProfile(user.Username, user.FullName)
+	}
+	if parts[1] == "name" {
+		i18n.Printf("✓ Full name set to %s\n", user.FullName)
+	} else if user.StatusMessage == "" {
+		i18n.Println("✓ Status cleared")
+	} else {
+		i18n.Printf("✓ Status set to: %s\n", user.StatusMessage)
+	}
+}
+
+// changeUsername renames the logged-in account, tells friends, and publishes
+// the new name alongside the old one until the old one's grace period ends
+func (a *App) changeUsername(ctx context.Context, user *storage.User, username string) {
+	oldUsername := user.Username
+	if err := a.auth.ChangeUsername(ctx, username); err != nil {
+		i18n.Printf("Failed to change username: %v\n", err)
+		return
+	}
+	if user.Username == oldUsername {
+		return
+	}
+
+	a.friendManager.BroadcastProfile(ctx, user)
+	if a.config.ShareIdentity {
+		a.p2p.SetLocalProfile(user.Username, user.FullName)
+	}
+	a.publishNames(a.sessionCtx, user)
+
+	i18n.Printf("✓ Username changed from %s to %s\n", oldUsername, user.Username)
+	i18n.Printf("   %s keeps working for friends and lookups for %d days\n", oldUsername, int(storage.UsernameAliasLifetime.Hours()/24))
+}
+
+// sendProfile gives a friend who just connected the logged-in user's profile,
+// in case it changed while they were away
+func (a *App) sendProfile(ctx context.Context, pid peer.ID) {
+	user, err := a.auth.CurrentUser()
+	if err != nil || user == nil || a.friendByPeer(ctx, pid) == nil {
+		return
+	}
+	a.friendManager.SendProfile(ctx, user, pid)
+}
+
+// onContactUpdated reports a friend's new name or status
+func (a *App) onContactUpdated(update *friends.ContactUpdated) {
+	contact := update.Contact
+	if update.UsernameChanged() {
+		if contact.Username == contact.RemoteName() {
+			i18n.Printf("\n🏷  %s changed their username to %s\n> ", update.OldHandle, contact.Username)
+		} else {
+			i18n.Printf("\n🏷  %s changed their username to %s (shown here as %s)\n> ", update.OldHandle, contact.RemoteName(), contact.Username)
+		}
+	}
+	if update.NameChanged() {
+		i18n.Printf("\n👤 %s (%s) now goes by %s\n> ", update.OldFullName, contact.Username, contact.FullName)
+	}
+	if update.StatusChanged() {
+		if contact.StatusMessage == "" {
+			i18n.Printf("\n💬 %s cleared their status\n> ", contact.FullName)
+		} else {
+			i18n.Printf("\n💬 %s: %s\n> ", contact.FullName, contact.StatusMessage)
+		}
+	}
+}
+
+// publishNames makes the account findable by its username, and by usernames
+// it gave up until their aliases expire. Calling it again, after a rename,
+// replaces what the previous call published.
+func (a *App) publishNames(ctx context.Context, user *storage.User) {
+	if a.namesCancel != nil {
+		a.namesCancel()
+	}
+	ctx, a.namesCancel = context.WithCancel(ctx)
+
+	go func() {
+		if err := a.p2p.PublishUser(ctx, user.Username); err != nil {
+			i18n.Printf("Warning: Failed to publish to DHT: %v\n", err)
+		}
+		// Keep refreshing presence
+		a.p2p.RefreshUserPresence(ctx, user.Username)
+	}()
+	go a.keepNamePublished(ctx, user.Username)
+
+	aliases, err := a.storage.GetUsernameAliases(ctx, user.ID)
+	if err != nil {
+		i18n.Printf("Warning: Failed to get former usernames: %v\n", err)
+	}
+	for _, alias := range aliases {
+		go func() {
+			ctx, cancel := context.WithDeadline(ctx, alias.ExpiresAt)
+			defer cancel()
+			a.keepNamePublished(ctx, alias.Username)
+		}()
+	}
+}
+
+// keepNamePublished keeps name registered with the relays and published in
+// the directories until ctx is done
+func (a *App) keepNamePublished(ctx context.Context, name string) {
+	var wg sync.WaitGroup
+	// Let friends on other networks find us as username@relay, and others
+	// look us up in the trusted directories. Both wait if none are configured
+	// yet, as the config file can add some later.
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		a.rendezvousManager.KeepRegistered(ctx, name)
+	}()
+	go func() {
+		defer wg.Done()
+		a.directoryClient.KeepPublished(ctx, name, a.p2p.ShareableAddrs)
+	}()
+	wg.Wait()
+}
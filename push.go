@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/push"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// pushRegisterInterval is how often the device registration is refreshed,
+	// and pushRetryInterval how soon a failed one is retried
+	pushRegisterInterval = 6 * time.Hour
+	pushRetryInterval    = 5 * time.Minute
+
+	// pushWakeInterval is how often one friend is woken while messages to
+	// them pile up
+	pushWakeInterval = 5 * time.Minute
+)
+
+// keepPushRegistered registers this device with the configured push relay and
+// shares the endpoint with friends, refreshing it until ctx is done and
+// registering again when the config file changes the relay or device. With
+// no relay configured it waits for one.
+func (a *App) keepPushRegistered(ctx context.Context) {
+	for {
+		a.pushMu.Lock()
+		relay, provider, target := a.config.PushRelay, a.config.PushProvider, a.config.PushTarget
+		changed := a.pushChanged
+		a.pushMu.Unlock()
+
+		wait := pushRegisterInterval
+		if relay == "" {
+			a.setPushEndpoint(nil)
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			}
+			continue
+		}
+
+		endpoint, err := a.pushClient.Register(ctx, relay, provider, target)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			i18n.Printf("\nWarning: Failed to register with push relay: %v\n> ", err)
+			wait = pushRetryInterval
+		} else if a.setPushEndpoint(endpoint) {
+			for _, pid := range a.p2p.Host().Network().Peers() {
+				a.sharePushEndpoint(ctx, pid)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		case <-changed:
+		}
+	}
+}
+
+// setPushDevice changes the push relay and device this node registers with
+func (a *App) setPushDevice(relay, provider, target string) error {
+	if relay != "" && (provider == "" || target == "") {
+		return errors.New("WHISPER_PUSH_RELAY needs WHISPER_PUSH_PROVIDER and WHISPER_PUSH_TARGET")
+	}
+	a.pushMu.Lock()
+	defer a.pushMu.Unlock()
+	a.config.PushRelay, a.config.PushProvider, a.config.PushTarget = relay, provider, target
+	close(a.pushChanged)
+	a.pushChanged = make(chan struct{})
+	return nil
+}
+
+// setPushEndpoint records this device's endpoint, reporting whether it changed
+func (a *App) setPushEndpoint(endpoint *push.Endpoint) bool {
+	a.pushMu.Lock()
+	defer a.pushMu.Unlock()
+	changed := a.pushEndpoint == nil || endpoint == nil || a.pushEndpoint.Relay != endpoint.Relay || a.pushEndpoint.Token != endpoint.Token
+	a.pushEndpoint = endpoint
+	return changed
+}
+
+// sharePushEndpoint gives a connected friend this device's endpoint, if it
+// has one. Peers running older versions don't speak the protocol; that's fine.
+func (a *App) sharePushEndpoint(ctx context.Context, pid peer.ID) {
+	a.pushMu.Lock()
+	endpoint := a.pushEndpoint
+	a.pushMu.Unlock()
+	if endpoint == nil || a.friendByPeer(ctx, pid) == nil {
+		return
+	}
+	a.pushClient.ShareEndpoint(ctx, pid, endpoint)
+}
+
+// onPushEndpoint keeps an endpoint a friend shared, so they can be woken later
+func (a *App) onPushEndpoint(ctx context.Context, message *push.EndpointMessage, from peer.ID) {
+	if a.friendByPeer(ctx, from) == nil {
+		return
+	}
+
+	var err error
+	if message.Endpoint == nil {
+		err = a.storage.DeletePushEndpoint(ctx, from.String())
+	} else {
+		err = a.storage.SavePushEndpoint(ctx, &storage.PushEndpoint{
+			PeerID: from.String(),
+			Relay:  message.Endpoint.Relay,
+			Token:  message.Endpoint.Token,
+			Key:    message.Endpoint.Key,
+		})
+	}
+	if err != nil {
+		i18n.Printf("Warning: Failed to save push endpoint: %v\n", err)
+	}
+}
+
+// wakeFriend is the message manager's undelivered handler: it asks an
+// unreachable friend's push relay to wake their device, at most once every
+// pushWakeInterval. The deposit runs in the background so sending isn't held up.
+func (a *App) wakeFriend(ctx context.Context, contact *storage.User) {
+	saved, err := a.storage.GetPushEndpoint(ctx, contact.PeerID)
+	if err != nil || saved == nil {
+		return
+	}
+	user, err := a.auth.CurrentUser()
+	if err != nil || user == nil {
+		return
+	}
+
+	a.pushMu.Lock()
+	if time.Since(a.pushWoken[contact.PeerID]) < pushWakeInterval {
+		a.pushMu.Unlock()
+		return
+	}
+	a.pushWoken[contact.PeerID] = time.Now()
+	a.pushMu.Unlock()
+
+	endpoint := &push.Endpoint{Relay: saved.Relay, Token: saved.Token, Key: saved.Key}
+	notification := &push.Notification{
+		Kind:         push.KindMessage,
+		FromPeerID:   a.p2p.PeerID().String(),
+		FromUsername: user.Username,
+		SentAt:       time.Now().Unix(),
+	}
+	go func() {
+		err := a.pushClient.Deposit(context.WithoutCancel(ctx), endpoint, notification)
+		switch {
+		case err == nil:
+			i18n.Printf("\n📣 Sent %s a wake-up notification\n> ", contact.Username)
+		case errors.Is(err, push.ErrNotRegistered):
+			// Their relay forgot them; wait until they share a new endpoint
+			a.storage.DeletePushEndpoint(context.WithoutCancel(ctx), contact.PeerID)
+		case errors.Is(err, push.ErrRateLimited):
+			// Someone else woke them moments ago
+		default:
+			i18n.Printf("\nWarning: Failed to wake %s: %v\n> ", contact.Username, err)
+		}
+	}()
+}
@@ -0,0 +1,138 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Client registers this node's device with a relay, shares the resulting
+// endpoint with friends, and wakes friends by depositing at theirs
+type Client struct {
+	host     host.Host
+	protocol *Protocol
+	keys     *KeyPair
+}
+
+// NewClient creates a push client on h and starts accepting endpoints from
+// friends; set a handler with SetEndpointHandler to keep them
+func NewClient(h host.Host) (*Client, error) {
+	privKey := h.Peerstore().PrivKey(h.ID())
+	if privKey == nil {
+		return nil, p2p.ErrNoPrivateKey
+	}
+	keys, err := DeriveKeyPair(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{host: h, protocol: NewProtocol(), keys: keys}
+	p2p.HandleStreams(h, c.protocol.HandleEndpoint, ProtocolEndpoint)
+	return c, nil
+}
+
+// Keys returns this node's push key pair
+func (c *Client) Keys() *KeyPair {
+	return c.keys
+}
+
+// SetEndpointHandler sets the handler for endpoints shared by friends
+func (c *Client) SetEndpointHandler(handler func(*EndpointMessage, peer.ID)) {
+	c.protocol.SetEndpointHandler(handler)
+}
+
+// Register registers this node's device with the relay at relayAddr, a
+// multiaddr with /p2p/, and returns the endpoint to share with friends
+func (c *Client) Register(ctx context.Context, relayAddr, provider, target string) (*Endpoint, error) {
+	info, err := parseRelay(relayAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	if err := c.host.Connect(ctx, info); err != nil {
+		return nil, fmt.Errorf("failed to connect to push relay: %w", err)
+	}
+	stream, err := c.host.NewStream(ctx, info.ID, ProtocolRegister)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream to push relay: %w", err)
+	}
+
+	response, err := SendRegisterRequest(ctx, stream, &RegisterRequest{Provider: provider, Target: target})
+	if err != nil {
+		return nil, err
+	}
+	if !response.OK {
+		return nil, fmt.Errorf("push relay refused registration: %s", response.Error)
+	}
+
+	endpoint := &Endpoint{Relay: relayAddr, Token: response.Token, Key: c.keys.Public[:]}
+	if err := endpoint.Validate(); err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+// Deposit seals a notification to a friend's endpoint and leaves it at
+// their relay
+func (c *Client) Deposit(ctx context.Context, endpoint *Endpoint, notification *Notification) error {
+	sealed, err := Seal(endpoint, notification)
+	if err != nil {
+		return err
+	}
+	info, err := parseRelay(endpoint.Relay)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	if err := c.host.Connect(ctx, info); err != nil {
+		return fmt.Errorf("failed to connect to push relay: %w", err)
+	}
+	stream, err := c.host.NewStream(ctx, info.ID, ProtocolDeposit)
+	if err != nil {
+		return fmt.Errorf("failed to open stream to push relay: %w", err)
+	}
+
+	response, err := SendDepositRequest(ctx, stream, &DepositRequest{Token: endpoint.Token, Sealed: sealed})
+	if err != nil {
+		return err
+	}
+	if !response.OK {
+		// Let callers tell a forgotten token from a temporary failure
+		for _, known := range []error{ErrNotRegistered, ErrRateLimited} {
+			if response.Error == known.Error() {
+				return known
+			}
+		}
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+// ShareEndpoint sends this node's endpoint to a connected friend; nil
+// withdraws a previously shared one
+func (c *Client) ShareEndpoint(ctx context.Context, friend peer.ID, endpoint *Endpoint) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	stream, err := c.host.NewStream(ctx, friend, ProtocolEndpoint)
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+	return SendEndpointMessage(ctx, stream, &EndpointMessage{Endpoint: endpoint})
+}
+
+// parseRelay parses a relay multiaddr, which must include /p2p/
+func parseRelay(relayAddr string) (peer.AddrInfo, error) {
+	infos, err := p2p.ParsePeerAddrs([]string{relayAddr})
+	if err != nil {
+		return peer.AddrInfo{}, fmt.Errorf("invalid push relay %q: %w", relayAddr, err)
+	}
+	return infos[0], nil
+}
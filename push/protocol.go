@@ -0,0 +1,213 @@
+package push
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// Protocol IDs. Register and deposit are served by relays; endpoint is
+	// spoken between friends.
+	ProtocolRegister = protocol.ID("/whisper/push/register/1.0.0")
+	ProtocolDeposit  = protocol.ID("/whisper/push/deposit/1.0.0")
+	ProtocolEndpoint = protocol.ID("/whisper/push/endpoint/1.0.0")
+)
+
+// RegisterRequest asks a relay to forward notifications to a device
+type RegisterRequest struct {
+	Provider string `json:"provider"` // unifiedpush, apns or fcm
+	Target   string `json:"target"`   // UnifiedPush endpoint URL, or APNs/FCM device token
+}
+
+// RegisterResponse carries the token friends deposit notifications under
+type RegisterResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+// DepositRequest leaves a sealed notification for the device behind a token
+type DepositRequest struct {
+	Token  string `json:"token"`
+	Sealed []byte `json:"sealed"`
+}
+
+// DepositResponse reports whether the relay forwarded the notification
+type DepositResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// EndpointMessage shares a node's push endpoint with a friend; a nil
+// endpoint withdraws it
+type EndpointMessage struct {
+	Endpoint *Endpoint `json:"endpoint"`
+}
+
+// Protocol handles the push protocols
+type Protocol struct {
+	registerHandler func(request *RegisterRequest, fromPeer peer.ID) *RegisterResponse
+	depositHandler  func(request *DepositRequest, fromPeer peer.ID) *DepositResponse
+	endpointHandler func(message *EndpointMessage, fromPeer peer.ID)
+}
+
+// NewProtocol creates a new push protocol handler
+func NewProtocol() *Protocol {
+	return &Protocol{}
+}
+
+// SetRegisterHandler sets the handler that answers register requests
+func (p *Protocol) SetRegisterHandler(handler func(*RegisterRequest, peer.ID) *RegisterResponse) {
+	p.registerHandler = handler
+}
+
+// SetDepositHandler sets the handler that answers deposit requests
+func (p *Protocol) SetDepositHandler(handler func(*DepositRequest, peer.ID) *DepositResponse) {
+	p.depositHandler = handler
+}
+
+// SetEndpointHandler sets the handler for endpoints shared by friends
+func (p *Protocol) SetEndpointHandler(handler func(*EndpointMessage, peer.ID)) {
+	p.endpointHandler = handler
+}
+
+// HandleRegister answers an incoming register request
+func (p *Protocol) HandleRegister(s network.Stream) {
+	defer s.Close()
+
+	var request RegisterRequest
+	if err := readRequest(s, &request); err != nil {
+		fmt.Printf("Error reading push register request: %v\n", err)
+		return
+	}
+
+	response := &RegisterResponse{Error: "registration not supported"}
+	if p.registerHandler != nil {
+		response = p.registerHandler(&request, s.Conn().RemotePeer())
+	}
+	writeResponse(s, response)
+}
+
+// HandleDeposit answers an incoming deposit request
+func (p *Protocol) HandleDeposit(s network.Stream) {
+	defer s.Close()
+
+	var request DepositRequest
+	if err := readRequest(s, &request); err != nil {
+		fmt.Printf("Error reading push deposit request: %v\n", err)
+		return
+	}
+
+	response := &DepositResponse{Error: "deposits not supported"}
+	if len(request.Sealed) == 0 || len(request.Sealed) > maxSealedSize {
+		response = &DepositResponse{Error: "notification missing or too large"}
+	} else if p.depositHandler != nil {
+		response = p.depositHandler(&request, s.Conn().RemotePeer())
+	}
+	writeResponse(s, response)
+}
+
+// HandleEndpoint receives a friend's push endpoint
+func (p *Protocol) HandleEndpoint(s network.Stream) {
+	defer s.Close()
+
+	var message EndpointMessage
+	if err := readRequest(s, &message); err != nil {
+		fmt.Printf("Error reading push endpoint: %v\n", err)
+		return
+	}
+	if message.Endpoint != nil && message.Endpoint.Validate() != nil {
+		return
+	}
+	if p.endpointHandler != nil {
+		p.endpointHandler(&message, s.Conn().RemotePeer())
+	}
+}
+
+// readRequest reads and decodes one JSON request line
+func readRequest(s network.Stream, request interface{}) error {
+	data, err := p2p.ReadWireMessage(bufio.NewReader(s))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, request)
+}
+
+// writeResponse writes one JSON response line
+func writeResponse(s network.Stream, response interface{}) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		fmt.Printf("Error marshaling push response: %v\n", err)
+		return
+	}
+
+	data = append(data, '\n')
+	if _, err := s.Write(data); err != nil {
+		fmt.Printf("Error writing push response: %v\n", err)
+	}
+}
+
+// SendRegisterRequest sends a register request and reads the response
+func SendRegisterRequest(ctx context.Context, s network.Stream, request *RegisterRequest) (*RegisterResponse, error) {
+	var response RegisterResponse
+	if err := roundTrip(s, request, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// SendDepositRequest sends a deposit request and reads the response
+func SendDepositRequest(ctx context.Context, s network.Stream, request *DepositRequest) (*DepositResponse, error) {
+	var response DepositResponse
+	if err := roundTrip(s, request, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// SendEndpointMessage shares an endpoint with a friend; there is no response
+func SendEndpointMessage(ctx context.Context, s network.Stream, message *EndpointMessage) error {
+	defer s.Close()
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal endpoint: %w", err)
+	}
+	data = append(data, '\n')
+	if _, err := s.Write(data); err != nil {
+		return fmt.Errorf("failed to write endpoint: %w", err)
+	}
+	return nil
+}
+
+// roundTrip writes a request line and reads one response line
+func roundTrip(s network.Stream, request, response interface{}) error {
+	defer s.Close()
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	data = append(data, '\n')
+	if _, err := s.Write(data); err != nil {
+		return fmt.Errorf("failed to write request: %w", err)
+	}
+	s.CloseWrite()
+
+	data, err = p2p.ReadWireMessage(bufio.NewReader(s))
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if err := json.Unmarshal(data, response); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return nil
+}
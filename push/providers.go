@@ -0,0 +1,424 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// tokenLifetime is how long a provider auth token is reused; APNs rejects
+	// tokens older than an hour and FCM access tokens last an hour
+	tokenLifetime = 50 * time.Minute
+
+	apnsHost        = "https://api.push.apple.com"
+	apnsSandboxHost = "https://api.sandbox.push.apple.com"
+	fcmScope        = "https://www.googleapis.com/auth/firebase.messaging"
+	fcmSendURL      = "https://fcm.googleapis.com/v1/projects/%s/messages:send"
+)
+
+// ErrTargetGone is returned by a provider when the device has unregistered;
+// the relay drops the registration
+var ErrTargetGone = errors.New("push target is no longer registered with its provider")
+
+// Provider forwards a sealed notification to one device
+type Provider interface {
+	// ValidateTarget checks a target given at registration
+	ValidateTarget(target string) error
+	Send(ctx context.Context, target string, sealed []byte) error
+}
+
+// UnifiedPush posts notifications to the device's UnifiedPush endpoint, a
+// URL on the distributor the user chose
+type UnifiedPush struct {
+	client *http.Client
+}
+
+// NewUnifiedPush creates a UnifiedPush provider. Endpoints come from
+// untrusted registrations, so it only connects to public addresses.
+func NewUnifiedPush() *UnifiedPush {
+	dialer := &net.Dialer{Timeout: requestTimeout, Control: rejectPrivateAddrs}
+	transport := &http.Transport{
+		Proxy:               nil,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: requestTimeout,
+	}
+	return &UnifiedPush{client: &http.Client{Transport: transport, Timeout: requestTimeout}}
+}
+
+// ValidateTarget requires an https endpoint URL
+func (u *UnifiedPush) ValidateTarget(target string) error {
+	endpoint, err := url.Parse(target)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" || len(target) > 1024 {
+		return fmt.Errorf("%w: UnifiedPush target must be an https URL", ErrInvalidEndpoint)
+	}
+	return nil
+}
+
+// Send posts the sealed notification as the message body
+func (u *UnifiedPush) Send(ctx context.Context, target string, sealed []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(sealed))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", "86400")
+	req.Header.Set("Urgency", "high")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return providerError("UnifiedPush", resp)
+}
+
+// rejectPrivateAddrs refuses connections to loopback, private and other
+// non-public addresses
+func rejectPrivateAddrs(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return fmt.Errorf("refusing to connect to non-public address %s", host)
+	}
+	return nil
+}
+
+// APNs sends notifications through Apple's push service using token-based
+// authentication with a .p8 signing key
+type APNs struct {
+	key    *ecdsa.PrivateKey
+	keyID  string
+	teamID string
+	topic  string
+	host   string
+	client *http.Client
+	auth   cachedToken
+}
+
+// NewAPNs loads the .p8 key at keyPath. The topic is the app's bundle ID;
+// sandbox selects Apple's development environment.
+func NewAPNs(keyPath, keyID, teamID, topic string, sandbox bool) (*APNs, error) {
+	if keyID == "" || teamID == "" || topic == "" {
+		return nil, errors.New("APNs needs a key ID, team ID and topic")
+	}
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read APNs key: %w", err)
+	}
+	parsed, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse APNs key: %w", err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("APNs key is not an ECDSA key")
+	}
+
+	host := apnsHost
+	if sandbox {
+		host = apnsSandboxHost
+	}
+	// The default transport negotiates HTTP/2, which APNs requires
+	return &APNs{
+		key:    key,
+		keyID:  keyID,
+		teamID: teamID,
+		topic:  topic,
+		host:   host,
+		client: &http.Client{Timeout: requestTimeout},
+	}, nil
+}
+
+// ValidateTarget requires a hex device token
+func (a *APNs) ValidateTarget(target string) error {
+	if len(target) == 0 || len(target) > 200 || strings.Trim(strings.ToLower(target), "0123456789abcdef") != "" {
+		return fmt.Errorf("%w: APNs target must be a hex device token", ErrInvalidEndpoint)
+	}
+	return nil
+}
+
+// Send delivers the sealed notification as a mutable alert, so the app's
+// notification service extension can open it and show the sender
+func (a *APNs) Send(ctx context.Context, target string, sealed []byte) error {
+	token, err := a.auth.get(func() (string, time.Duration, error) {
+		jwt, err := signJWT("ES256", a.keyID, map[string]interface{}{
+			"iss": a.teamID,
+			"iat": time.Now().Unix(),
+		}, a.signES256)
+		return jwt, tokenLifetime, err
+	})
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert":           map[string]string{"title": "Whisper", "body": "New message"},
+			"mutable-content": 1,
+		},
+		"whisper": base64.StdEncoding.EncodeToString(sealed),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.host+"/3/device/"+target, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("apns-topic", a.topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest {
+		// APNs reports unknown tokens as 400 BadDeviceToken
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if strings.Contains(string(body), "BadDeviceToken") {
+			return ErrTargetGone
+		}
+		return fmt.Errorf("APNs returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return providerError("APNs", resp)
+}
+
+// signES256 signs a JWT with the APNs key, as the raw r||s pair JWS expects
+func (a *APNs) signES256(data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signature, nil
+}
+
+// FCM sends notifications through Firebase Cloud Messaging's HTTP v1 API,
+// authenticating as a service account
+type FCM struct {
+	account serviceAccount
+	key     *rsa.PrivateKey
+	client  *http.Client
+	auth    cachedToken
+}
+
+// serviceAccount is the part of a Google service account key file FCM needs
+type serviceAccount struct {
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// NewFCM loads the service account key file at credentialsPath
+func NewFCM(credentialsPath string) (*FCM, error) {
+	data, err := os.ReadFile(credentialsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read FCM credentials: %w", err)
+	}
+	var account serviceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("failed to parse FCM credentials: %w", err)
+	}
+	if account.ProjectID == "" || account.ClientEmail == "" || account.TokenURI == "" {
+		return nil, errors.New("FCM credentials need project_id, client_email and token_uri")
+	}
+	parsed, err := parsePrivateKey([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse FCM private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("FCM private key is not an RSA key")
+	}
+	return &FCM{account: account, key: key, client: &http.Client{Timeout: requestTimeout}}, nil
+}
+
+// ValidateTarget requires a plausible registration token
+func (f *FCM) ValidateTarget(target string) error {
+	if len(target) == 0 || len(target) > 4096 || strings.ContainsAny(target, " /\n") {
+		return fmt.Errorf("%w: FCM target must be a registration token", ErrInvalidEndpoint)
+	}
+	return nil
+}
+
+// Send delivers the sealed notification as a high priority data message
+func (f *FCM) Send(ctx context.Context, target string, sealed []byte) error {
+	token, err := f.auth.get(func() (string, time.Duration, error) {
+		return f.accessToken(ctx)
+	})
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"token":   target,
+			"data":    map[string]string{"whisper": base64.StdEncoding.EncodeToString(sealed)},
+			"android": map[string]string{"priority": "high"},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf(fcmSendURL, f.account.ProjectID), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return providerError("FCM", resp)
+}
+
+// accessToken exchanges a signed assertion for an OAuth access token
+func (f *FCM) accessToken(ctx context.Context) (string, time.Duration, error) {
+	now := time.Now()
+	assertion, err := signJWT("RS256", f.account.PrivateKeyID, map[string]interface{}{
+		"iss":   f.account.ClientEmail,
+		"scope": fcmScope,
+		"aud":   f.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}, func(data []byte) ([]byte, error) {
+		digest := sha256.Sum256(data)
+		return rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, digest[:])
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to get FCM access token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", 0, fmt.Errorf("failed to get FCM access token: %w", providerError("Google OAuth", resp))
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", 0, fmt.Errorf("failed to decode FCM access token: %w", err)
+	}
+	lifetime := time.Duration(result.ExpiresIn)*time.Second - 5*time.Minute
+	if lifetime > tokenLifetime {
+		lifetime = tokenLifetime
+	}
+	return result.AccessToken, lifetime, nil
+}
+
+// cachedToken reuses a provider auth token until it is due for renewal
+type cachedToken struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// get returns the cached token, minting a new one with refresh if needed
+func (c *cachedToken) get(refresh func() (string, time.Duration, error)) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+	token, lifetime, err := refresh()
+	if err != nil {
+		return "", err
+	}
+	c.token, c.expires = token, time.Now().Add(lifetime)
+	return token, nil
+}
+
+// signJWT builds a compact JWS over claims with the given algorithm and signer
+func signJWT(alg, keyID string, claims map[string]interface{}, sign func([]byte) ([]byte, error)) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": keyID})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	signature, err := sign([]byte(signingInput))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %w", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parsePrivateKey decodes a PEM-encoded PKCS#8 private key
+func parsePrivateKey(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+// providerError turns a failed provider response into an error; 404 and 410
+// mean the device is gone
+func providerError(provider string, resp *http.Response) error {
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusNotFound, resp.StatusCode == http.StatusGone:
+		return ErrTargetGone
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if message := strings.TrimSpace(string(body)); message != "" {
+		return fmt.Errorf("%s returned %s: %s", provider, resp.Status, message)
+	}
+	return fmt.Errorf("%s returned %s", provider, resp.Status)
+}
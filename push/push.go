@@ -0,0 +1,130 @@
+// Package push wakes up friends whose devices are asleep. A node that wants
+// wake-ups registers its device (a UnifiedPush endpoint, or an APNs or FCM
+// device token) with a push relay of its choice and shares the resulting
+// endpoint with its friends. When a message to it can't be delivered, a
+// friend deposits a small notification at the relay, sealed to the
+// recipient's push key so the relay and the push services only ever see
+// ciphertext; the relay forwards it through the matching provider.
+package push
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Providers a relay can forward through
+const (
+	ProviderUnifiedPush = "unifiedpush"
+	ProviderAPNs        = "apns"
+	ProviderFCM         = "fcm"
+)
+
+// Notification kinds
+const (
+	KindMessage = "message" // A direct message is waiting
+)
+
+const (
+	// maxSealedSize bounds a sealed notification; providers cap payloads at 4KB
+	maxSealedSize = 2048
+
+	// requestTimeout bounds one exchange with a relay or friend
+	requestTimeout = 10 * time.Second
+)
+
+var (
+	ErrUnknownProvider = errors.New("push provider must be unifiedpush, apns or fcm")
+	ErrProviderOff     = errors.New("push provider is not enabled at this relay")
+	ErrNotRegistered   = errors.New("push token is not registered at this relay")
+	ErrRateLimited     = errors.New("too many notifications for this token, try again later")
+	ErrInvalidEndpoint = errors.New("invalid push endpoint")
+	ErrUndecryptable   = errors.New("notification could not be decrypted")
+	ErrRelayFull       = errors.New("push relay is full")
+)
+
+// Endpoint is where and how to wake a node: the relay to deposit at, the
+// opaque token the relay knows the device by, and the key to seal to
+type Endpoint struct {
+	Relay string `json:"relay"` // Relay multiaddr with /p2p/
+	Token string `json:"token"`
+	Key   []byte `json:"key"` // X25519 public key
+}
+
+// Validate checks an endpoint received from a friend
+func (e *Endpoint) Validate() error {
+	if e.Relay == "" || e.Token == "" || len(e.Token) > 128 {
+		return ErrInvalidEndpoint
+	}
+	if len(e.Key) != curve25519.PointSize {
+		return fmt.Errorf("%w: bad key", ErrInvalidEndpoint)
+	}
+	return nil
+}
+
+// Notification is what a woken device learns; deliberately little, since the
+// message itself is fetched from the sender once the node is back online
+type Notification struct {
+	Kind         string `json:"kind"`
+	FromPeerID   string `json:"from_peer_id"`
+	FromUsername string `json:"from_username"`
+	SentAt       int64  `json:"sent_at"` // Unix timestamp
+}
+
+// KeyPair is a node's push encryption key
+type KeyPair struct {
+	Public  [32]byte
+	Private [32]byte
+}
+
+// DeriveKeyPair derives the node's push key from its identity key, so it
+// needs no storage of its own and survives reinstalls from a backup
+func DeriveKeyPair(identity crypto.PrivKey) (*KeyPair, error) {
+	raw, err := identity.Raw()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity key: %w", err)
+	}
+	pair := &KeyPair{Private: sha256.Sum256(append([]byte("whisper-push-key:"), raw...))}
+	public, err := curve25519.X25519(pair.Private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive push key: %w", err)
+	}
+	copy(pair.Public[:], public)
+	return pair, nil
+}
+
+// Seal encrypts a notification to an endpoint's key; neither the relay nor
+// the push service can read it
+func Seal(endpoint *Endpoint, notification *Notification) ([]byte, error) {
+	if err := endpoint.Validate(); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], endpoint.Key)
+	return box.SealAnonymous(nil, data, &key, rand.Reader)
+}
+
+// Open decrypts a notification sealed to the key pair, as a device's
+// notification handler would
+func Open(pair *KeyPair, sealed []byte) (*Notification, error) {
+	data, ok := box.OpenAnonymous(nil, sealed, &pair.Public, &pair.Private)
+	if !ok {
+		return nil, ErrUndecryptable
+	}
+	var notification Notification
+	if err := json.Unmarshal(data, &notification); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUndecryptable, err)
+	}
+	return &notification, nil
+}
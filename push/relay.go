@@ -0,0 +1,215 @@
+package push
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// minDepositInterval is how often one device may be woken; a burst of
+	// messages only needs one wake-up
+	minDepositInterval = 30 * time.Second
+
+	// maxRegistrations caps the devices a relay serves
+	maxRegistrations = 100000
+)
+
+// registration is one device a relay forwards to
+type registration struct {
+	Peer     string    `json:"peer"` // Peer that registered the device
+	Provider string    `json:"provider"`
+	Target   string    `json:"target"`
+	Updated  time.Time `json:"updated"`
+	lastSent time.Time
+}
+
+// Relay accepts device registrations and forwards deposited notifications
+// through the configured providers. Registrations are kept in a JSON file so
+// tokens friends hold stay valid across restarts.
+type Relay struct {
+	protocol  *Protocol
+	providers map[string]Provider
+	path      string
+
+	mu            sync.Mutex
+	registrations map[string]*registration // token -> registration
+	tokens        map[string]string        // registering peer -> token
+}
+
+// NewRelay creates a relay serving the register and deposit protocols on h,
+// keeping registrations at path
+func NewRelay(h host.Host, path string, providers map[string]Provider) (*Relay, error) {
+	r := &Relay{
+		protocol:      NewProtocol(),
+		providers:     providers,
+		path:          path,
+		registrations: make(map[string]*registration),
+		tokens:        make(map[string]string),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	r.protocol.SetRegisterHandler(r.handleRegister)
+	r.protocol.SetDepositHandler(r.handleDeposit)
+	p2p.HandleStreams(h, r.protocol.HandleRegister, ProtocolRegister)
+	p2p.HandleStreams(h, r.protocol.HandleDeposit, ProtocolDeposit)
+	return r, nil
+}
+
+// Providers returns the names of the providers this relay forwards through
+func (r *Relay) Providers() []string {
+	names := []string{}
+	for _, name := range []string{ProviderUnifiedPush, ProviderAPNs, ProviderFCM} {
+		if _, ok := r.providers[name]; ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Register records where to forward notifications for a peer's device and
+// returns its token. A peer keeps the same token when it re-registers, so
+// endpoints its friends hold survive a change of device token.
+func (r *Relay) Register(peerID peer.ID, provider, target string) (string, error) {
+	if provider != ProviderUnifiedPush && provider != ProviderAPNs && provider != ProviderFCM {
+		return "", ErrUnknownProvider
+	}
+	p, ok := r.providers[provider]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrProviderOff, provider)
+	}
+	if err := p.ValidateTarget(target); err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	token, ok := r.tokens[peerID.String()]
+	if !ok {
+		if len(r.registrations) >= maxRegistrations {
+			return "", ErrRelayFull
+		}
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		token = hex.EncodeToString(buf)
+	}
+
+	r.registrations[token] = &registration{Peer: peerID.String(), Provider: provider, Target: target, Updated: time.Now()}
+	r.tokens[peerID.String()] = token
+	if err := r.save(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Deposit forwards a sealed notification to the device behind token
+func (r *Relay) Deposit(ctx context.Context, token string, sealed []byte) error {
+	r.mu.Lock()
+	reg, ok := r.registrations[token]
+	if !ok {
+		r.mu.Unlock()
+		return ErrNotRegistered
+	}
+	if time.Since(reg.lastSent) < minDepositInterval {
+		r.mu.Unlock()
+		return ErrRateLimited
+	}
+	reg.lastSent = time.Now()
+	provider, target := r.providers[reg.Provider], reg.Target
+	r.mu.Unlock()
+
+	if provider == nil {
+		return fmt.Errorf("%w: %s", ErrProviderOff, reg.Provider)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	err := provider.Send(ctx, target, sealed)
+	if errors.Is(err, ErrTargetGone) {
+		r.unregister(token)
+	}
+	return err
+}
+
+// unregister drops a registration whose device is gone
+func (r *Relay) unregister(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reg, ok := r.registrations[token]; ok {
+		delete(r.tokens, reg.Peer)
+		delete(r.registrations, token)
+		if err := r.save(); err != nil {
+			fmt.Printf("Warning: Failed to save push registrations: %v\n", err)
+		}
+	}
+}
+
+// handleRegister answers a register request made over libp2p
+func (r *Relay) handleRegister(request *RegisterRequest, fromPeer peer.ID) *RegisterResponse {
+	token, err := r.Register(fromPeer, request.Provider, request.Target)
+	if err != nil {
+		return &RegisterResponse{Error: err.Error()}
+	}
+	return &RegisterResponse{OK: true, Token: token}
+}
+
+// handleDeposit forwards a notification deposited over libp2p
+func (r *Relay) handleDeposit(request *DepositRequest, fromPeer peer.ID) *DepositResponse {
+	if err := r.Deposit(context.Background(), request.Token, request.Sealed); err != nil {
+		return &DepositResponse{Error: err.Error()}
+	}
+	return &DepositResponse{OK: true}
+}
+
+// load reads saved registrations, if any
+func (r *Relay) load() error {
+	data, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read push registrations: %w", err)
+	}
+	if err := json.Unmarshal(data, &r.registrations); err != nil {
+		return fmt.Errorf("failed to parse push registrations: %w", err)
+	}
+	for token, reg := range r.registrations {
+		r.tokens[reg.Peer] = token
+	}
+	return nil
+}
+
+// save writes the registrations atomically; caller holds mu
+func (r *Relay) save() error {
+	data, err := json.Marshal(r.registrations)
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(r.path), 0700); err != nil {
+		return fmt.Errorf("failed to create relay data directory: %w", err)
+	}
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to save push registrations: %w", err)
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return fmt.Errorf("failed to save push registrations: %w", err)
+	}
+	return nil
+}
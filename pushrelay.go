@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/austinwklein/whisper/config"
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/push"
+)
+
+// defaultPushRelayPort keeps a relay clear of a whisper node on the same machine
+const defaultPushRelayPort = 9990
+
+// runPushRelayCommand handles `whisper push-relay`, which runs a push relay:
+// friends deposit sealed wake-up notifications with it, and it forwards them
+// to the registered devices through UnifiedPush, APNs or FCM
+func runPushRelayCommand(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("push-relay", flag.ContinueOnError)
+	port := fs.Int("port", defaultPushRelayPort, "port to listen on")
+	dataDir := fs.String("data", filepath.Join(cfg.DataDir, "push-relay"), "directory for the relay's identity and registrations")
+	unifiedPush := fs.Bool("unifiedpush", true, "forward to UnifiedPush endpoints")
+	apnsKey := fs.String("apns-key", "", "APNs .p8 signing key; enables APNs")
+	apnsKeyID := fs.String("apns-key-id", "", "APNs signing key ID")
+	apnsTeam := fs.String("apns-team", "", "Apple developer team ID")
+	apnsTopic := fs.String("apns-topic", "", "app bundle ID notifications are sent to")
+	apnsSandbox := fs.Bool("apns-sandbox", false, "use the APNs development environment")
+	fcmCredentials := fs.String("fcm-credentials", "", "Firebase service account key file; enables FCM")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("usage: whisper push-relay [--port <n>] [--data <dir>] [--unifiedpush=false] [--apns-key <file> --apns-key-id <id> --apns-team <id> --apns-topic <bundle-id> [--apns-sandbox]] [--fcm-credentials <file>]")
+	}
+
+	providers := map[string]push.Provider{}
+	if *unifiedPush {
+		providers[push.ProviderUnifiedPush] = push.NewUnifiedPush()
+	}
+	if *apnsKey != "" {
+		apns, err := push.NewAPNs(*apnsKey, *apnsKeyID, *apnsTeam, *apnsTopic, *apnsSandbox)
+		if err != nil {
+			return err
+		}
+		providers[push.ProviderAPNs] = apns
+	}
+	if *fcmCredentials != "" {
+		fcm, err := push.NewFCM(*fcmCredentials)
+		if err != nil {
+			return err
+		}
+		providers[push.ProviderFCM] = fcm
+	}
+	if len(providers) == 0 {
+		return errors.New("no push providers enabled")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dir := absPath(*dataDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create relay data directory: %w", err)
+	}
+	privKey, err := p2p.LoadOrCreateIdentity(ctx, keyFile(filepath.Join(dir, "identity.key")))
+	if err != nil {
+		return err
+	}
+
+	host, err := p2p.NewP2PHost(ctx, *port, privKey, p2p.Options{DHTMode: cfg.DHTMode})
+	if err != nil {
+		return fmt.Errorf("failed to start P2P host: %w", err)
+	}
+	defer host.Close()
+
+	relay, err := push.NewRelay(host.Host(), filepath.Join(dir, "registrations.json"), providers)
+	if err != nil {
+		return err
+	}
+
+	i18n.Printf("✓ Push relay running, forwarding through: %s\n", strings.Join(relay.Providers(), ", "))
+	i18n.Println("Set WHISPER_PUSH_RELAY to one of these addresses:")
+	for _, addr := range host.ShareableAddrs() {
+		i18n.Printf("  %s\n", addr)
+	}
+
+	<-ctx.Done()
+	i18n.Println("Shutting down...")
+	return nil
+}
+
+// keyFile is an identity store backed by a single file, for commands that
+// run without a database
+type keyFile string
+
+func (f keyFile) GetIdentityKey(ctx context.Context) ([]byte, error) {
+	data, err := os.ReadFile(string(f))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (f keyFile) SaveIdentityKey(ctx context.Context, key []byte) error {
+	return os.WriteFile(string(f), key, 0600)
+}
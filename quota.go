@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/austinwklein/whisper/config"
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+)
+
+// quotaCheckInterval is how often storage quotas are enforced in the background
+const quotaCheckInterval = 10 * time.Minute
+
+// quotasFromConfig builds the storage quotas configured with WHISPER_QUOTA_*
+func quotasFromConfig(cfg *config.Config) ([]storage.Quota, error) {
+	historyPolicy, err := storage.ParseQuotaPolicy(cfg.QuotaHistoryPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("WHISPER_QUOTA_HISTORY_POLICY: %w", err)
+	}
+	backupsPolicy, err := storage.ParseQuotaPolicy(cfg.QuotaBackupsPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("WHISPER_QUOTA_BACKUPS_POLICY: %w", err)
+	}
+
+	quotas := []storage.Quota{}
+	add := func(category storage.QuotaCategory, mb int, policy storage.QuotaPolicy) {
+		if mb > 0 {
+			quotas = append(quotas, storage.Quota{Category: category, LimitBytes: int64(mb) << 20, Policy: policy})
+		}
+	}
+	add(storage.QuotaMessages, cfg.QuotaMessagesMB, historyPolicy)
+	add(storage.QuotaConferences, cfg.QuotaConferencesMB, historyPolicy)
+	add(storage.QuotaBackups, cfg.QuotaBackupsMB, backupsPolicy)
+	return quotas, nil
+}
+
+// handleQuotaCommand handles `quota [enforce]`: show each category's usage,
+// or prune over-quota categories now instead of waiting for the next check
+func (a *App) handleQuotaCommand(ctx context.Context, parts []string) {
+	if len(parts) > 1 {
+		if parts[1] != "enforce" {
+			i18n.Println("Usage: quota [enforce]")
+			return
+		}
+		pruned, err := a.storage.EnforceQuotas(ctx)
+		if err != nil {
+			i18n.Printf("Failed to enforce quotas: %v\n", err)
+			return
+		}
+		total := int64(0)
+		for _, category := range storage.QuotaCategories {
+			if pruned[category] > 0 {
+				i18n.Printf("✓ Pruned the oldest %d %s\n", pruned[category], quotaLabel(category))
+				total += pruned[category]
+			}
+		}
+		if total == 0 {
+			i18n.Println("✓ Nothing to prune")
+		}
+	}
+
+	usages, err := a.storage.GetQuotaUsage(ctx)
+	if err != nil {
+		i18n.Printf("Failed to get storage usage: %v\n", err)
+		return
+	}
+	i18n.Println("\n=== Storage Usage ===")
+	for _, usage := range usages {
+		limit := i18n.T("unlimited")
+		if usage.LimitBytes > 0 {
+			limit = i18n.Sprintf("%s of %s (%d%%), %s when full", formatSize(usage.UsedBytes), formatSize(usage.LimitBytes), usage.UsedBytes*100/usage.LimitBytes, i18n.T(string(usage.Policy)))
+		} else {
+			limit = formatSize(usage.UsedBytes) + ", " + limit
+		}
+		status := ""
+		if usage.Over() {
+			status = i18n.T(" - over quota")
+		}
+		i18n.Printf("  %-20s %7d  %s%s\n", quotaLabel(usage.Category), usage.Items, limit, status)
+	}
+	i18n.Println()
+}
+
+// quotaLabel names what a quota category counts
+func quotaLabel(category storage.QuotaCategory) string {
+	switch category {
+	case storage.QuotaMessages:
+		return i18n.T("direct messages")
+	case storage.QuotaConferences:
+		return i18n.T("conference messages")
+	case storage.QuotaBackups:
+		return i18n.T("backup files")
+	}
+	return string(category)
+}
+
+// formatSize renders a byte count in B, KB, MB or GB
+func formatSize(bytes int64) string {
+	switch {
+	case bytes >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(bytes)/(1<<30))
+	case bytes >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(bytes)/(1<<20))
+	case bytes >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(bytes)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", bytes)
+}
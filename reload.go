@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/austinwklein/whisper/config"
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+)
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 2 * time.Second
+
+// onConfigReloaded applies the variables that changed in the config file and
+// reports the changes that weren't applied
+func (a *App) onConfigReloaded(event *config.ConfigReloaded) {
+	cfg := event.Config
+	applied := []string{}
+	rejected := event.Rejected
+	pushChanged := false
+
+	for _, key := range event.Changed {
+		if strings.HasPrefix(key, "WHISPER_PUSH_") {
+			pushChanged = true
+			continue
+		}
+		if err := a.applyConfig(key, cfg); err != nil {
+			rejected = append(rejected, fmt.Errorf("%s: %w", key, err))
+			continue
+		}
+		applied = append(applied, key)
+	}
+	if pushChanged {
+		if err := a.setPushDevice(cfg.PushRelay, cfg.PushProvider, cfg.PushTarget); err != nil {
+			rejected = append(rejected, err)
+		} else {
+			applied = append(applied, "WHISPER_PUSH_*")
+		}
+	}
+
+	if len(applied) > 0 {
+		i18n.Printf("\n✓ Reloaded %s: %s\n> ", cfg.File, strings.Join(applied, ", "))
+	}
+	for _, err := range rejected {
+		i18n.Printf("\n⚠️  Config change not applied - %v\n> ", err)
+	}
+}
+
+// applyConfig applies one changed variable to the running node. Variables
+// behind runtime settings change the settings' defaults, so a value set with
+// 'settings set' still wins over them.
+func (a *App) applyConfig(key string, cfg *config.Config) error {
+	switch key {
+	case "WHISPER_AUTODIAL_MODE":
+		return a.settings.SetDefault(settingAutoDialMode, cfg.AutoDialMode)
+	case "WHISPER_DHT_MODE":
+		return a.settings.SetDefault(settingDHTMode, cfg.DHTMode)
+	case "WHISPER_LOCALE":
+		return a.settings.SetDefault(settingLocale, cfg.Locale)
+	case "WHISPER_ASCII":
+		return a.settings.SetDefault(settingASCIIMode, cfg.ASCIIMode)
+	case "WHISPER_SLOW_QUERY_MS":
+		a.storage.SetSlowQueryThreshold(time.Duration(cfg.SlowQueryMs) * time.Millisecond)
+	case "WHISPER_MESSAGE_TTL_HOURS":
+		a.messageManager.SetDefaultTTL(time.Duration(cfg.MessageTTLHours) * time.Hour)
+	case "WHISPER_CONF_MAX_PARTICIPANTS":
+		a.conferenceManager.SetDefaultMaxParticipants(cfg.ConferenceMaxParticipants)
+	case "WHISPER_CONF_COMPACT_DAYS", "WHISPER_CONF_COMPACT_POLICY":
+		return a.conferenceManager.SetCompaction(cfg.ConferenceCompactPolicy, cfg.ConferenceCompactDays)
+	case "WHISPER_RELAYS":
+		relays, err := p2p.ParsePeerAddrs(cfg.Relays)
+		if err != nil {
+			return err
+		}
+		a.rendezvousManager.SetRelays(relays)
+	case "WHISPER_DIRECTORIES":
+		return a.directoryClient.SetDirectories(cfg.Directories)
+	case "WHISPER_MAILBOX":
+		return a.setMailbox(cfg.Mailbox)
+	case "WHISPER_UPDATE_CHECK", "WHISPER_UPDATE_FEED", "WHISPER_UPDATE_KEY":
+		return a.updates.Configure(cfg.UpdateCheck, cfg.UpdateFeed, cfg.UpdateKey)
+	default:
+		return config.ErrNotReloadable
+	}
+	return nil
+}
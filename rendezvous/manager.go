@@ -0,0 +1,396 @@
+// Package rendezvous lets users on different networks find each other by a
+// username@relay address. Nodes register their username with the relays they
+// are configured with; anyone using the same relay can then look them up and
+// dial them through it.
+package rendezvous
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// RegistrationTTL is how long a relay keeps a username without a refresh
+	RegistrationTTL = 30 * time.Minute
+
+	// refreshInterval is how often a node re-registers with its relays
+	refreshInterval = 10 * time.Minute
+
+	// requestTimeout bounds one register or lookup exchange with a relay
+	requestTimeout = 10 * time.Second
+
+	// maxRegistrations caps the directory a relay keeps in memory
+	maxRegistrations = 10000
+)
+
+var (
+	ErrInvalidAddress = errors.New("address must look like username@relay")
+	ErrUnknownRelay   = errors.New("relay is not configured (see WHISPER_RELAYS) - use its full multiaddr after @")
+	ErrNotRegistered  = errors.New("username is not registered at that relay")
+	ErrNoRelays       = errors.New("no relays configured")
+)
+
+// registration is one username claim held by a relay
+type registration struct {
+	peerID  peer.ID
+	expires time.Time
+}
+
+// Manager registers the local user with relays, resolves username@relay
+// addresses, and, on relay nodes, serves the directory
+type Manager struct {
+	host     host.Host
+	protocol *Protocol
+
+	relaysMu      sync.RWMutex
+	relays        []peer.AddrInfo
+	relaysChanged chan struct{} // Closed and replaced when the relays change
+
+	mu       sync.Mutex
+	registry map[string]*registration // lowercased username -> claim (relay nodes only)
+}
+
+// NewManager creates a rendezvous manager using the given relays. When serve is
+// set the node also answers register and lookup requests from others.
+func NewManager(h host.Host, relays []peer.AddrInfo, serve bool) *Manager {
+	m := &Manager{
+		host:          h,
+		protocol:      NewProtocol(),
+		relays:        relays,
+		relaysChanged: make(chan struct{}),
+		registry:      make(map[string]*registration),
+	}
+
+	if serve {
+		m.protocol.SetRegisterHandler(m.handleRegister)
+		m.protocol.SetLookupHandler(m.handleLookup)
+		m.protocol.SetReleaseHandler(m.handleRelease)
+
+		p2p.HandleStreams(h, m.protocol.HandleRegister, ProtocolRegister)
+		p2p.HandleStreams(h, m.protocol.HandleLookup, ProtocolLookup)
+		p2p.HandleStreams(h, m.protocol.HandleRelease, ProtocolRelease)
+	}
+
+	return m
+}
+
+// SetRelays replaces the relays the node registers with and looks usernames
+// up at. Usernames kept registered are claimed at the new relays right away;
+// claims at relays no longer used expire.
+func (m *Manager) SetRelays(relays []peer.AddrInfo) {
+	m.relaysMu.Lock()
+	defer m.relaysMu.Unlock()
+	m.relays = relays
+	close(m.relaysChanged)
+	m.relaysChanged = make(chan struct{})
+}
+
+// Enabled reports whether any relays are configured
+func (m *Manager) Enabled() bool {
+	return len(m.relayList()) > 0
+}
+
+// relayList returns the configured relays
+func (m *Manager) relayList() []peer.AddrInfo {
+	m.relaysMu.RLock()
+	defer m.relaysMu.RUnlock()
+	return m.relays
+}
+
+// ParseAddress splits a username@relay address
+func ParseAddress(address string) (username, relay string, ok bool) {
+	username, relay, found := strings.Cut(address, "@")
+	if !found || username == "" || relay == "" {
+		return "", "", false
+	}
+	return username, relay, true
+}
+
+// Addresses returns the username@relay addresses others can use to reach username
+func (m *Manager) Addresses(username string) []string {
+	addresses := []string{}
+	for _, relay := range m.relayList() {
+		addresses = append(addresses, username+"@"+relayName(relay))
+	}
+	return addresses
+}
+
+// Register claims username at every configured relay. It succeeds if at least
+// one relay accepted the claim.
+func (m *Manager) Register(ctx context.Context, username string) error {
+	relays := m.relayList()
+	if len(relays) == 0 {
+		return ErrNoRelays
+	}
+
+	var errs []error
+	registered := 0
+	for _, relay := range relays {
+		if err := m.registerWith(ctx, relay, username); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", relayName(relay), err))
+			continue
+		}
+		registered++
+	}
+	if registered == 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// Release gives up username at every configured relay. Relays that can't be
+// reached, or don't support releasing, drop the claim when it expires.
+func (m *Manager) Release(ctx context.Context, username string) error {
+	relays := m.relayList()
+	if len(relays) == 0 {
+		return ErrNoRelays
+	}
+
+	var errs []error
+	for _, relay := range relays {
+		if err := m.releaseFrom(ctx, relay, username); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", relayName(relay), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// KeepRegistered registers username now and refreshes it until ctx is done,
+// registering again whenever the relays change. With no relays it waits for some.
+func (m *Manager) KeepRegistered(ctx context.Context, username string) {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		m.relaysMu.RLock()
+		changed := m.relaysChanged
+		m.relaysMu.RUnlock()
+
+		if err := m.Register(ctx, username); err != nil && !errors.Is(err, ErrNoRelays) && ctx.Err() == nil {
+			fmt.Printf("Warning: Failed to register with relays: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-changed:
+		}
+	}
+}
+
+// registerWith claims username at one relay
+func (m *Manager) registerWith(ctx context.Context, relay peer.AddrInfo, username string) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	if err := m.host.Connect(ctx, relay); err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	stream, err := m.host.NewStream(ctx, relay.ID, ProtocolRegister)
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+
+	response, err := SendRegisterRequest(ctx, stream, &RegisterRequest{Username: username})
+	if err != nil {
+		return err
+	}
+	if !response.OK {
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+// releaseFrom gives up username at one relay
+func (m *Manager) releaseFrom(ctx context.Context, relay peer.AddrInfo, username string) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	if err := m.host.Connect(ctx, relay); err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	stream, err := m.host.NewStream(ctx, relay.ID, ProtocolRelease)
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+
+	response, err := SendReleaseRequest(ctx, stream, &ReleaseRequest{Username: username})
+	if err != nil {
+		return err
+	}
+	if !response.OK {
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+// Resolve looks up a username@relay address and returns how to reach the user:
+// the addresses the relay knows for them plus a circuit through the relay
+func (m *Manager) Resolve(ctx context.Context, address string) (peer.AddrInfo, error) {
+	username, name, ok := ParseAddress(address)
+	if !ok {
+		return peer.AddrInfo{}, ErrInvalidAddress
+	}
+	relay, err := m.findRelay(name)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	if err := m.host.Connect(ctx, relay); err != nil {
+		return peer.AddrInfo{}, fmt.Errorf("failed to connect to relay: %w", err)
+	}
+	stream, err := m.host.NewStream(ctx, relay.ID, ProtocolLookup)
+	if err != nil {
+		return peer.AddrInfo{}, fmt.Errorf("failed to open stream: %w", err)
+	}
+
+	response, err := SendLookupRequest(ctx, stream, &LookupRequest{Username: username})
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	if !response.Found {
+		return peer.AddrInfo{}, ErrNotRegistered
+	}
+
+	pid, err := peer.Decode(response.PeerID)
+	if err != nil {
+		return peer.AddrInfo{}, fmt.Errorf("invalid peer ID from relay: %w", err)
+	}
+
+	info := peer.AddrInfo{ID: pid}
+	for _, addrStr := range response.Addrs {
+		if maddr, err := multiaddr.NewMultiaddr(addrStr); err == nil {
+			info.Addrs = append(info.Addrs, maddr)
+		}
+	}
+	for _, relayAddr := range relay.Addrs {
+		circuit, err := multiaddr.NewMultiaddr(fmt.Sprintf("%s/p2p/%s/p2p-circuit", relayAddr, relay.ID))
+		if err == nil {
+			info.Addrs = append(info.Addrs, circuit)
+		}
+	}
+	return info, nil
+}
+
+// findRelay matches the part after @ against the configured relays by host name,
+// IP or peer ID; a full multiaddr selects an unconfigured relay directly
+func (m *Manager) findRelay(name string) (peer.AddrInfo, error) {
+	if strings.HasPrefix(name, "/") {
+		infos, err := p2p.ParsePeerAddrs([]string{name})
+		if err != nil {
+			return peer.AddrInfo{}, err
+		}
+		return infos[0], nil
+	}
+
+	for _, relay := range m.relayList() {
+		if relay.ID.String() == name {
+			return relay, nil
+		}
+		for _, addr := range relay.Addrs {
+			if strings.EqualFold(addrHost(addr), name) {
+				return relay, nil
+			}
+		}
+	}
+	return peer.AddrInfo{}, ErrUnknownRelay
+}
+
+// relayName returns the friendliest name for a relay: its host name or IP,
+// falling back to its peer ID
+func relayName(relay peer.AddrInfo) string {
+	for _, addr := range p2p.RankAddrs(relay.Addrs) {
+		if host := addrHost(addr); host != "" {
+			return host
+		}
+	}
+	return relay.ID.String()
+}
+
+// addrHost returns the DNS name or IP an address dials
+func addrHost(addr multiaddr.Multiaddr) string {
+	for _, code := range []int{multiaddr.P_DNS, multiaddr.P_DNS4, multiaddr.P_DNS6, multiaddr.P_IP4, multiaddr.P_IP6} {
+		if value, err := addr.ValueForProtocol(code); err == nil {
+			return value
+		}
+	}
+	return ""
+}
+
+// handleRegister records a username claim for the requesting peer. A name stays
+// with its peer until the claim expires, so others can't take it over.
+func (m *Manager) handleRegister(request *RegisterRequest, fromPeer peer.ID) *RegisterResponse {
+	key := strings.ToLower(request.Username)
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.registry[key]
+	if ok && existing.peerID != fromPeer && now.Before(existing.expires) {
+		return &RegisterResponse{Error: "username is taken at this relay"}
+	}
+	if !ok && len(m.registry) >= maxRegistrations {
+		m.pruneExpired(now)
+		if len(m.registry) >= maxRegistrations {
+			return &RegisterResponse{Error: "relay directory is full"}
+		}
+	}
+
+	m.registry[key] = &registration{peerID: fromPeer, expires: now.Add(RegistrationTTL)}
+	return &RegisterResponse{OK: true, TTLSeconds: int64(RegistrationTTL.Seconds())}
+}
+
+// handleRelease drops a username claim held by the requesting peer
+func (m *Manager) handleRelease(request *ReleaseRequest, fromPeer peer.ID) *ReleaseResponse {
+	key := strings.ToLower(request.Username)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.registry[key]
+	if ok && existing.peerID != fromPeer && time.Now().Before(existing.expires) {
+		return &ReleaseResponse{Error: "username is held by another peer at this relay"}
+	}
+	delete(m.registry, key)
+	return &ReleaseResponse{OK: true}
+}
+
+// handleLookup returns the peer holding a username and the addresses we know for it
+func (m *Manager) handleLookup(request *LookupRequest, fromPeer peer.ID) *LookupResponse {
+	m.mu.Lock()
+	reg, ok := m.registry[strings.ToLower(request.Username)]
+	m.mu.Unlock()
+
+	if !ok || time.Now().After(reg.expires) {
+		return &LookupResponse{}
+	}
+
+	response := &LookupResponse{Found: true, PeerID: reg.peerID.String(), Addrs: []string{}}
+	for _, addr := range m.host.Peerstore().Addrs(reg.peerID) {
+		response.Addrs = append(response.Addrs, addr.String())
+	}
+	return response
+}
+
+// pruneExpired drops expired claims; caller holds mu
+func (m *Manager) pruneExpired(now time.Time) {
+	for key, reg := range m.registry {
+		if now.After(reg.expires) {
+			delete(m.registry, key)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package rendezvous
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// Protocol IDs
+	ProtocolRegister = protocol.ID("/whisper/rendezvous/register/1.0.0")
+	ProtocolLookup   = protocol.ID("/whisper/rendezvous/lookup/1.0.0")
+	ProtocolRelease  = protocol.ID("/whisper/rendezvous/release/1.0.0")
+)
+
+// RegisterRequest claims a username at a rendezvous node for the sending peer
+type RegisterRequest struct {
+	Username string `json:"username"`
+}
+
+// RegisterResponse reports whether the claim was accepted and for how long
+type RegisterResponse struct {
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	TTLSeconds int64  `json:"ttl_seconds,omitempty"`
+}
+
+// ReleaseRequest gives up the sending peer's claim on a username
+type ReleaseRequest struct {
+	Username string `json:"username"`
+}
+
+// ReleaseResponse reports whether the claim was dropped
+type ReleaseResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// LookupRequest asks a rendezvous node who registered a username
+type LookupRequest struct {
+	Username string `json:"username"`
+}
+
+// LookupResponse carries the registered peer, if any
+type LookupResponse struct {
+	Found  bool     `json:"found"`
+	PeerID string   `json:"peer_id,omitempty"`
+	Addrs  []string `json:"addrs,omitempty"` // Addresses the rendezvous node knows for the peer
+}
+
+// Protocol handles the rendezvous protocols
+type Protocol struct {
+	registerHandler func(request *RegisterRequest, fromPeer peer.ID) *RegisterResponse
+	lookupHandler   func(request *LookupRequest, fromPeer peer.ID) *LookupResponse
+	releaseHandler  func(request *ReleaseRequest, fromPeer peer.ID) *ReleaseResponse
+}
+
+// NewProtocol creates a new rendezvous protocol handler
+func NewProtocol() *Protocol {
+	return &Protocol{}
+}
+
+// SetRegisterHandler sets the handler that answers register requests
+func (p *Protocol) SetRegisterHandler(handler func(*RegisterRequest, peer.ID) *RegisterResponse) {
+	p.registerHandler = handler
+}
+
+// SetLookupHandler sets the handler that answers lookup requests
+func (p *Protocol) SetLookupHandler(handler func(*LookupRequest, peer.ID) *LookupResponse) {
+	p.lookupHandler = handler
+}
+
+// SetReleaseHandler sets the handler that answers release requests
+func (p *Protocol) SetReleaseHandler(handler func(*ReleaseRequest, peer.ID) *ReleaseResponse) {
+	p.releaseHandler = handler
+}
+
+// HandleRegister answers an incoming register request
+func (p *Protocol) HandleRegister(s network.Stream) {
+	defer s.Close()
+
+	data, err := p2p.ReadWireMessage(bufio.NewReader(s))
+	if err != nil {
+		fmt.Printf("Error reading register request: %v\n", err)
+		return
+	}
+
+	var request RegisterRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		fmt.Printf("Error unmarshaling register request: %v\n", err)
+		return
+	}
+
+	response := &RegisterResponse{Error: "registration not supported"}
+	if err := p2p.CheckTextField("username", request.Username, p2p.MaxUsernameLength, true); err != nil {
+		response = &RegisterResponse{Error: err.Error()}
+	} else if p.registerHandler != nil {
+		response = p.registerHandler(&request, s.Conn().RemotePeer())
+	}
+	writeResponse(s, response)
+}
+
+// HandleLookup answers an incoming lookup request
+func (p *Protocol) HandleLookup(s network.Stream) {
+	defer s.Close()
+
+	data, err := p2p.ReadWireMessage(bufio.NewReader(s))
+	if err != nil {
+		fmt.Printf("Error reading lookup request: %v\n", err)
+		return
+	}
+
+	var request LookupRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		fmt.Printf("Error unmarshaling lookup request: %v\n", err)
+		return
+	}
+
+	response := &LookupResponse{}
+	if p.lookupHandler != nil && p2p.CheckTextField("username", request.Username, p2p.MaxUsernameLength, true) == nil {
+		response = p.lookupHandler(&request, s.Conn().RemotePeer())
+	}
+	writeResponse(s, response)
+}
+
+// HandleRelease answers an incoming release request
+func (p *Protocol) HandleRelease(s network.Stream) {
+	defer s.Close()
+
+	data, err := p2p.ReadWireMessage(bufio.NewReader(s))
+	if err != nil {
+		fmt.Printf("Error reading release request: %v\n", err)
+		return
+	}
+
+	var request ReleaseRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		fmt.Printf("Error unmarshaling release request: %v\n", err)
+		return
+	}
+
+	response := &ReleaseResponse{Error: "release not supported"}
+	if err := p2p.CheckTextField("username", request.Username, p2p.MaxUsernameLength, true); err != nil {
+		response = &ReleaseResponse{Error: err.Error()}
+	} else if p.releaseHandler != nil {
+		response = p.releaseHandler(&request, s.Conn().RemotePeer())
+	}
+	writeResponse(s, response)
+}
+
+// writeResponse writes one JSON response line
+func writeResponse(s network.Stream, response interface{}) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		fmt.Printf("Error marshaling rendezvous response: %v\n", err)
+		return
+	}
+
+	data = append(data, '\n')
+	if _, err := s.Write(data); err != nil {
+		fmt.Printf("Error writing rendezvous response: %v\n", err)
+	}
+}
+
+// SendRegisterRequest sends a register request and reads the response
+func SendRegisterRequest(ctx context.Context, s network.Stream, request *RegisterRequest) (*RegisterResponse, error) {
+	var response RegisterResponse
+	if err := roundTrip(s, request, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// SendReleaseRequest sends a release request and reads the response
+func SendReleaseRequest(ctx context.Context, s network.Stream, request *ReleaseRequest) (*ReleaseResponse, error) {
+	var response ReleaseResponse
+	if err := roundTrip(s, request, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// SendLookupRequest sends a lookup request and reads the response
+func SendLookupRequest(ctx context.Context, s network.Stream, request *LookupRequest) (*LookupResponse, error) {
+	var response LookupResponse
+	if err := roundTrip(s, request, &response); err != nil {
+		return nil, err
+	}
+	if response.Found {
+		if err := p2p.CheckPeerIDField("peer_id", response.PeerID); err != nil {
+			return nil, err
+		}
+	}
+	return &response, nil
+}
+
+// roundTrip writes a request line and reads one response line
+func roundTrip(s network.Stream, request, response interface{}) error {
+	defer s.Close()
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	data = append(data, '\n')
+	if _, err := s.Write(data); err != nil {
+		return fmt.Errorf("failed to write request: %w", err)
+	}
+	s.CloseWrite()
+
+	data, err = p2p.ReadWireMessage(bufio.NewReader(s))
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if err := json.Unmarshal(data, response); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return nil
+}
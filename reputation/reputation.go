@@ -0,0 +1,168 @@
+// Package reputation scores peers by how they behave toward this node. Each
+// offense (an invalid message, a post over a conference's limits, a friend
+// request that was rejected) lowers a peer's score, which recovers slowly
+// while it behaves. Peers below DeprioritizeBelow lose GossipSub score, and
+// peers at BlockAt or lower are disconnected and refused.
+package reputation
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// DeprioritizeBelow is the score under which a peer's GossipSub score is
+	// lowered by its reputation
+	DeprioritizeBelow = -20.0
+
+	// BlockAt is the score at or below which a peer is disconnected and refused
+	BlockAt = -100.0
+
+	// minScore bounds how low a score can go, so any peer can earn its way
+	// back within a day
+	minScore = -200.0
+
+	// recoveryPerHour is how much of a lost score a peer regains each hour,
+	// in whole points
+	recoveryPerHour = 10.0
+)
+
+// penalties is what each offense costs
+var penalties = map[string]float64{
+	storage.PeerOffenseInvalidMessage:  10,
+	storage.PeerOffenseRateLimited:     2,
+	storage.PeerOffenseRejectedRequest: 25,
+}
+
+// Status names for a score
+const (
+	StatusGood          = "good"
+	StatusDeprioritized = "deprioritized"
+	StatusBlocked       = "blocked"
+)
+
+// Tracker records offenses and answers how a peer is to be treated
+type Tracker struct {
+	storage storage.Storage
+
+	mu           sync.Mutex
+	peers        map[peer.ID]*storage.PeerReputation // Peers with a score below zero
+	blockHandler func(pid peer.ID)                   // Called when a peer becomes blocked
+}
+
+// NewTracker creates a tracker, loading the reputations of peers that have
+// offended before
+func NewTracker(ctx context.Context, store storage.Storage) *Tracker {
+	t := &Tracker{
+		storage: store,
+		peers:   make(map[peer.ID]*storage.PeerReputation),
+	}
+
+	reputations, err := store.GetPeerReputations(ctx)
+	if err != nil {
+		fmt.Printf("Warning: Failed to load peer reputations: %v\n", err)
+		return t
+	}
+	for _, rep := range reputations {
+		if pid, err := peer.Decode(rep.PeerID); err == nil {
+			t.peers[pid] = rep
+		}
+	}
+	return t
+}
+
+// SetBlockHandler sets the handler called when an offense blocks a peer
+func (t *Tracker) SetBlockHandler(handler func(peer.ID)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.blockHandler = handler
+}
+
+// Report counts an offense against a peer
+func (t *Tracker) Report(pid peer.ID, offense string) {
+	penalty, ok := penalties[offense]
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	now := time.Now()
+	before := t.scoreLocked(pid, now)
+	after := max(before-penalty, minScore)
+	rep, err := t.storage.RecordPeerOffense(context.Background(), pid.String(), offense, after, now)
+	if err != nil {
+		t.mu.Unlock()
+		fmt.Printf("Warning: Failed to record peer offense: %v\n", err)
+		return
+	}
+	t.peers[pid] = rep
+	handler := t.blockHandler
+	t.mu.Unlock()
+
+	if before > BlockAt && after <= BlockAt && handler != nil {
+		handler(pid)
+	}
+}
+
+// Score returns a peer's current score, after recovery
+func (t *Tracker) Score(pid peer.ID) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.scoreLocked(pid, time.Now())
+}
+
+// scoreLocked returns a peer's score at now; t.mu must be held
+func (t *Tracker) scoreLocked(pid peer.ID, now time.Time) float64 {
+	rep, ok := t.peers[pid]
+	if !ok {
+		return 0
+	}
+	score := rep.Score + math.Floor(now.Sub(rep.UpdatedAt).Hours()*recoveryPerHour)
+	if score >= 0 {
+		delete(t.peers, pid)
+		return 0
+	}
+	return score
+}
+
+// GossipPenalty is the amount a peer's reputation takes off its GossipSub
+// score: nothing until it falls below DeprioritizeBelow
+func (t *Tracker) GossipPenalty(pid peer.ID) float64 {
+	if score := t.Score(pid); score < DeprioritizeBelow {
+		return score
+	}
+	return 0
+}
+
+// Allowed reports whether a peer may stay connected
+func (t *Tracker) Allowed(pid peer.ID) bool {
+	return t.Score(pid) > BlockAt
+}
+
+// Get returns a peer's reputation with its score brought up to date
+func (t *Tracker) Get(ctx context.Context, pid peer.ID) (*storage.PeerReputation, error) {
+	rep, err := t.storage.GetPeerReputation(ctx, pid.String())
+	if err != nil {
+		return nil, err
+	}
+	rep.Score = t.Score(pid)
+	return rep, nil
+}
+
+// Status names how a score has the peer treated
+func Status(score float64) string {
+	switch {
+	case score <= BlockAt:
+		return StatusBlocked
+	case score < DeprioritizeBelow:
+		return StatusDeprioritized
+	default:
+		return StatusGood
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// SentRequests returns the friend requests the logged-in user has sent, newest
+// first, with their current status
+func (a *App) SentRequests(ctx context.Context) ([]*storage.Friend, error) {
+	currentUser, err := a.auth.CurrentUser()
+	if err != nil {
+		return nil, err
+	}
+	return a.friendManager.GetSentRequests(ctx, currentUser.ID)
+}
+
+// printSentRequests lists sent friend requests with when they were sent and answered
+func (a *App) printSentRequests(ctx context.Context) {
+	requests, err := a.SentRequests(ctx)
+	if err != nil {
+		i18n.Printf("Failed to get sent requests: %v\n", err)
+		return
+	}
+	if len(requests) == 0 {
+		i18n.Println("You haven't sent any friend requests")
+		return
+	}
+
+	i18n.Printf("Sent friend requests (%d):\n", len(requests))
+	for _, req := range requests {
+		status := i18n.T(req.Status)
+		switch {
+		case req.Status == "accepted" && !req.AcceptedAt.IsZero():
+			status = i18n.Sprintf("accepted %s", req.AcceptedAt.Local().Format("Jan 2 15:04"))
+		case req.Status == "rejected" && !req.RejectedAt.IsZero():
+			status = i18n.Sprintf("rejected %s", req.RejectedAt.Local().Format("Jan 2 15:04"))
+		}
+		i18n.Printf("  #%d  %s (%s)  sent %s - %s\n", req.ID, req.FullName, req.Username, req.CreatedAt.Local().Format("Jan 2 15:04"), status)
+	}
+}
+
+// onSentRequestAnswered notifies the user when someone answers their friend request
+func (a *App) onSentRequestAnswered(request *storage.Friend) {
+	waited := time.Since(request.CreatedAt).Round(time.Second)
+	if request.Status == "accepted" {
+		i18n.Printf("\n✓ %s accepted your friend request (sent %s ago)\n", request.FullName, waited)
+		i18n.Printf("   You are now friends with %s (%s)\n> ", request.FullName, request.Username)
+		return
+	}
+	i18n.Printf("\n✗ %s declined your friend request (sent %s ago)\n> ", request.FullName, waited)
+}
+
+// handleConfAddCommand handles `conf-add <conf-id> <username>`, which sends a
+// friend request to a conference member using the peer ID from the roster
+func (a *App) handleConfAddCommand(ctx context.Context, user *storage.User, parts []string) {
+	if len(parts) != 3 {
+		i18n.Println("Usage: conf-add <conference-id> <username>")
+		i18n.Println("Example: conf-add 1 alice")
+		return
+	}
+	var confID int64
+	fmt.Sscanf(parts[1], "%d", &confID)
+	username := parts[2]
+
+	self, err := a.storage.GetConferenceParticipant(ctx, confID, user.ID)
+	if err != nil || self == nil || !self.Active {
+		i18n.Println("You are not in that conference")
+		return
+	}
+	participants, err := a.conferenceManager.GetConferenceParticipants(ctx, confID)
+	if err != nil {
+		i18n.Printf("Failed to get participants: %v\n", err)
+		return
+	}
+	var member *storage.ConferenceParticipant
+	for _, p := range participants {
+		if p.Active && p.Username == username && p.PeerID != user.PeerID {
+			member = p
+		}
+	}
+	if member == nil {
+		i18n.Printf("%s is not in conference %d\n", username, confID)
+		return
+	}
+	pid, err := peer.Decode(member.PeerID)
+	if err != nil {
+		i18n.Printf("Invalid peer ID for %s: %v\n", username, err)
+		return
+	}
+
+	if a.friendByPeer(ctx, pid) != nil {
+		i18n.Printf("You are already friends with %s\n", username)
+		return
+	}
+	if p2p.PeerSupports(a.p2p.Host(), pid, p2p.CapabilityConfRequestsOff) {
+		i18n.Printf("%s doesn't accept friend requests from conference members\n", username)
+		return
+	}
+
+	if err := a.friendManager.SendFriendRequestTo(ctx, user, pid, member.Username); err != nil {
+		i18n.Printf("Failed to send friend request: %v\n", err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const rosterUsage = `Usage:
+  roster                                  - List friend list requests and copies friends left with you
+  roster share <username>                 - Leave a copy of your friend list with a friend
+  roster request <peer-id|username> [msg] - Ask your other device or a friend for your friend list
+  roster send <peer-id|username>          - Send the friend list a peer asked for
+  roster deny <peer-id|username>          - Refuse a friend list request`
+
+// handleRosterCommand handles `roster [share|request|send|deny ...]`, which
+// recovers a lost friend list from another device or from a copy left with a
+// friend
+func (a *App) handleRosterCommand(ctx context.Context, user *storage.User, parts []string) {
+	if len(parts) == 1 {
+		a.printRoster(ctx, user)
+		return
+	}
+	if len(parts) < 3 {
+		i18n.Println(rosterUsage)
+		return
+	}
+
+	switch parts[1] {
+	case "share":
+		count, err := a.friendManager.ShareRoster(ctx, user, parts[2])
+		if err != nil {
+			i18n.Printf("Failed to share friend list: %v\n", err)
+			return
+		}
+		i18n.Printf("✓ Left a copy of your friend list (%d friends) with %s\n", count, parts[2])
+		i18n.Println("   If you lose it, ask for it back with 'roster request <their peer ID>'")
+
+	case "request":
+		target, err := a.rosterPeer(ctx, parts[2])
+		if err != nil {
+			i18n.Printf("Invalid peer ID: %v\n", err)
+			return
+		}
+		note := strings.Join(parts[3:], " ")
+		if err := a.friendManager.RequestRoster(ctx, user, target, note); err != nil {
+			i18n.Printf("Failed to ask for your friend list: %v\n", err)
+			return
+		}
+		i18n.Printf("✓ Asked %s for your friend list; you'll be told when they answer\n", parts[2])
+
+	case "send", "deny":
+		send := parts[1] == "send"
+		request, err := a.friendManager.AnswerRosterRequest(ctx, user, parts[2], send)
+		if err != nil {
+			i18n.Printf("Failed to answer friend list request: %v\n", err)
+			return
+		}
+		if send {
+			i18n.Printf("✓ Sent %s's friend list (%d friends) to peer %s\n", request.Request.Username, request.Entries, request.From)
+		} else {
+			i18n.Printf("✓ Refused peer %s's request for %s's friend list\n", request.From, request.Request.Username)
+		}
+
+	default:
+		i18n.Println(rosterUsage)
+	}
+}
+
+// printRoster lists the friend list requests waiting for an answer and the
+// copies friends left with the user
+func (a *App) printRoster(ctx context.Context, user *storage.User) {
+	requests := a.friendManager.RosterRequests()
+	if len(requests) > 0 {
+		i18n.Printf("Friend list requests (%d):\n", len(requests))
+		for _, request := range requests {
+			i18n.Printf("  %s calling itself %s (%s), %d friends, asked %s\n", request.From, request.Request.Username, request.Request.FullName, request.Entries, request.ReceivedAt.Local().Format("Jan 2 15:04"))
+		}
+		i18n.Println("Answer with 'roster send <peer-id>' or 'roster deny <peer-id>'")
+	}
+
+	copies, err := a.friendManager.GetRosterCopies(ctx, user.ID)
+	if err != nil {
+		i18n.Printf("Failed to get friend list copies: %v\n", err)
+		return
+	}
+	if len(copies) == 0 {
+		if len(requests) == 0 {
+			i18n.Println("No friend list requests, and no friend has left their friend list with you")
+		}
+		return
+	}
+	i18n.Printf("Friend lists left with you (%d):\n", len(copies))
+	for _, roster := range copies {
+		i18n.Printf("  %s: %d friends, received %s\n", roster.Username, len(roster.Entries), roster.ReceivedAt.Local().Format("Jan 2 15:04"))
+	}
+}
+
+// rosterPeer resolves who to ask for a friend list: a peer ID, or the
+// username of a contact this account knows
+func (a *App) rosterPeer(ctx context.Context, who string) (peer.ID, error) {
+	if pid, err := peer.Decode(who); err == nil {
+		return pid, nil
+	}
+	contact, err := a.storage.GetUserByUsername(ctx, who)
+	if errors.Is(err, storage.ErrNotFound) {
+		return "", errors.New("not a peer ID or a known username")
+	}
+	if err != nil {
+		return "", err
+	}
+	return peer.Decode(contact.PeerID)
+}
@@ -0,0 +1,274 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// queryTimeout bounds how long a single peer may take to answer
+	queryTimeout = 5 * time.Second
+
+	// maxDHTPeers caps how many DHT-discovered nodes are queried per search
+	maxDHTPeers = 20
+)
+
+// Result sources
+const (
+	SourceLocal   = "local"   // Local database
+	SourcePeer    = "peer"    // A connected peer
+	SourceNetwork = "network" // A node discovered through the DHT
+)
+
+// Result is a user found by a search
+type Result struct {
+	Username string    `json:"username"`
+	FullName string    `json:"full_name"`
+	PeerID   string    `json:"peer_id"`
+	Online   bool      `json:"online"`
+	Source   string    `json:"source"`
+	LastSeen time.Time `json:"last_seen,omitempty"` // For offline users, when they were last online (zero if unknown)
+}
+
+// PeerFinder discovers other whisper nodes and their presence, typically through the DHT
+type PeerFinder interface {
+	FindWhisperPeers(ctx context.Context, limit int) ([]peer.AddrInfo, error)
+	LookupLastSeen(ctx context.Context, id peer.ID) (time.Time, error)
+}
+
+// Manager handles user search across the local database and the network
+type Manager struct {
+	storage  storage.Storage
+	host     host.Host
+	finder   PeerFinder
+	protocol *Protocol
+}
+
+// NewManager creates a new search manager
+func NewManager(store storage.Storage, h host.Host, finder PeerFinder) *Manager {
+	m := &Manager{
+		storage:  store,
+		host:     h,
+		finder:   finder,
+		protocol: NewProtocol(),
+	}
+
+	// Set protocol handlers
+	m.protocol.SetSearchHandler(m.handleSearchRequest)
+
+	// Register stream handlers
+	p2p.HandleStreams(h, m.protocol.HandleUserSearch, ProtocolUserSearch)
+
+	return m
+}
+
+// SearchUsers searches the local database, connected peers and DHT-discovered
+// nodes, returning results de-duplicated by peer ID
+func (m *Manager) SearchUsers(ctx context.Context, query string) ([]*Result, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, fmt.Errorf("search query is required")
+	}
+
+	results := make(map[string]*Result)
+
+	// Local database first; network answers replace these as they are fresher
+	local, err := m.storage.SearchUsersByName(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search local users: %w", err)
+	}
+	for _, user := range local {
+		if user.PeerID == m.host.ID().String() {
+			continue
+		}
+		results[user.PeerID] = &Result{
+			Username: user.Username,
+			FullName: user.FullName,
+			PeerID:   user.PeerID,
+			Online:   m.isConnected(user.PeerID),
+			Source:   SourceLocal,
+		}
+	}
+
+	for _, result := range m.searchNetwork(ctx, query) {
+		results[result.PeerID] = result
+	}
+
+	merged := make([]*Result, 0, len(results))
+	for _, result := range results {
+		merged = append(merged, result)
+	}
+	m.fillLastSeen(ctx, merged)
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].Online != merged[j].Online {
+			return merged[i].Online
+		}
+		return merged[i].Username < merged[j].Username
+	})
+	return merged, nil
+}
+
+// searchNetwork queries connected peers and DHT-discovered nodes concurrently
+func (m *Manager) searchNetwork(ctx context.Context, query string) []*Result {
+	targets := make(map[peer.ID]string)
+	for _, pid := range m.host.Network().Peers() {
+		targets[pid] = SourcePeer
+	}
+
+	if m.finder != nil {
+		findCtx, cancel := context.WithTimeout(ctx, queryTimeout)
+		found, err := m.finder.FindWhisperPeers(findCtx, maxDHTPeers)
+		cancel()
+		if err == nil {
+			for _, info := range found {
+				if _, ok := targets[info.ID]; ok {
+					continue
+				}
+				m.host.Peerstore().AddAddrs(info.ID, info.Addrs, time.Hour)
+				targets[info.ID] = SourceNetwork
+			}
+		}
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results []*Result
+	)
+	for pid, source := range targets {
+		wg.Add(1)
+		go func(pid peer.ID, source string) {
+			defer wg.Done()
+			found, err := m.queryPeer(ctx, pid, query)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, record := range found {
+				// A peer may only vouch for accounts hosted on itself
+				if record.PeerID != pid.String() {
+					continue
+				}
+				results = append(results, &Result{
+					Username: record.Username,
+					FullName: record.FullName,
+					PeerID:   record.PeerID,
+					Online:   true,
+					Source:   source,
+				})
+			}
+		}(pid, source)
+	}
+	wg.Wait()
+	return results
+}
+
+// fillLastSeen sets LastSeen on offline results from what we last observed and
+// from presence records on the DHT, remembering anything newer for next time
+func (m *Manager) fillLastSeen(ctx context.Context, results []*Result) {
+	var wg sync.WaitGroup
+	for _, result := range results {
+		if result.Online {
+			continue
+		}
+
+		if known, err := m.storage.GetKnownPeer(ctx, result.PeerID); err == nil && known != nil {
+			result.LastSeen = known.LastSeen
+		}
+
+		pid, err := peer.Decode(result.PeerID)
+		if err != nil || m.finder == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(result *Result, pid peer.ID) {
+			defer wg.Done()
+			lookupCtx, cancel := context.WithTimeout(ctx, queryTimeout)
+			defer cancel()
+			seen, err := m.finder.LookupLastSeen(lookupCtx, pid)
+			if err != nil || !seen.After(result.LastSeen) {
+				return
+			}
+			result.LastSeen = seen
+			if err := m.storage.TouchKnownPeer(ctx, result.PeerID, seen); err != nil {
+				fmt.Printf("Warning: Failed to record last seen: %v\n", err)
+			}
+		}(result, pid)
+	}
+	wg.Wait()
+}
+
+// queryPeer sends a search request to a single peer
+func (m *Manager) queryPeer(ctx context.Context, pid peer.ID, query string) ([]*UserRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	stream, err := m.host.NewStream(ctx, pid, ProtocolUserSearch)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := SendSearchRequest(ctx, stream, &SearchRequest{
+		Query:    query,
+		FromPeer: m.host.ID().String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response.Users, nil
+}
+
+// handleSearchRequest answers with accounts registered on this node that match the query
+func (m *Manager) handleSearchRequest(request *SearchRequest, fromPeer peer.ID) *SearchResponse {
+	ctx := context.Background()
+	response := &SearchResponse{Users: []*UserRecord{}}
+
+	query := strings.TrimSpace(request.Query)
+	if query == "" {
+		return response
+	}
+
+	candidates, err := m.storage.SearchUsersByName(ctx, query)
+	if err != nil {
+		return response
+	}
+
+	seen := make(map[int64]bool)
+	self := m.host.ID().String()
+	for _, user := range candidates {
+		// Only share our own accounts, never cached contacts
+		if seen[user.ID] || user.IsRemote() || user.PeerID != self {
+			continue
+		}
+		seen[user.ID] = true
+		response.Users = append(response.Users, &UserRecord{
+			Username: user.Username,
+			FullName: user.FullName,
+			PeerID:   user.PeerID,
+		})
+		if len(response.Users) >= MaxResultsPerPeer {
+			break
+		}
+	}
+	return response
+}
+
+// isConnected reports whether we currently have a connection to the peer
+func (m *Manager) isConnected(peerIDStr string) bool {
+	pid, err := peer.Decode(peerIDStr)
+	if err != nil {
+		return false
+	}
+	return m.host.Network().Connectedness(pid) == network.Connected
+}
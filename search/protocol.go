@@ -0,0 +1,120 @@
+package search
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// Protocol IDs
+	ProtocolUserSearch = protocol.ID("/whisper/user/search/1.0.0")
+
+	// MaxResultsPerPeer caps how many users a single peer may return
+	MaxResultsPerPeer = 20
+)
+
+// SearchRequest asks a peer for local accounts matching a query
+type SearchRequest struct {
+	Query    string `json:"query"`
+	FromPeer string `json:"from_peer"`
+}
+
+// UserRecord describes a user account hosted by the responding peer
+type UserRecord struct {
+	Username string `json:"username"`
+	FullName string `json:"full_name"`
+	PeerID   string `json:"peer_id"`
+}
+
+// SearchResponse lists matching accounts hosted by the responding peer
+type SearchResponse struct {
+	Users []*UserRecord `json:"users"`
+}
+
+// Protocol handles the user search protocol
+type Protocol struct {
+	searchHandler func(request *SearchRequest, fromPeer peer.ID) *SearchResponse
+}
+
+// NewProtocol creates a new user search protocol handler
+func NewProtocol() *Protocol {
+	return &Protocol{}
+}
+
+// SetSearchHandler sets the handler that answers search requests
+func (p *Protocol) SetSearchHandler(handler func(*SearchRequest, peer.ID) *SearchResponse) {
+	p.searchHandler = handler
+}
+
+// HandleUserSearch answers an incoming search request
+func (p *Protocol) HandleUserSearch(s network.Stream) {
+	defer s.Close()
+
+	reader := bufio.NewReader(s)
+	data, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		fmt.Printf("Error reading search request: %v\n", err)
+		return
+	}
+
+	var request SearchRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		fmt.Printf("Error unmarshaling search request: %v\n", err)
+		return
+	}
+
+	response := &SearchResponse{Users: []*UserRecord{}}
+	if p.searchHandler != nil {
+		response = p.searchHandler(&request, s.Conn().RemotePeer())
+	}
+
+	data, err = json.Marshal(response)
+	if err != nil {
+		fmt.Printf("Error marshaling search response: %v\n", err)
+		return
+	}
+
+	data = append(data, '\n')
+	if _, err := s.Write(data); err != nil {
+		fmt.Printf("Error writing search response: %v\n", err)
+	}
+}
+
+// SendSearchRequest sends a search request and reads the response
+func SendSearchRequest(ctx context.Context, s network.Stream, request *SearchRequest) (*SearchResponse, error) {
+	defer s.Close()
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	data = append(data, '\n')
+	if _, err := s.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to write request: %w", err)
+	}
+	s.CloseWrite()
+
+	reader := bufio.NewReader(s)
+	data, err = reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var response SearchResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	if len(response.Users) > MaxResultsPerPeer {
+		response.Users = response.Users[:MaxResultsPerPeer]
+	}
+	return &response, nil
+}
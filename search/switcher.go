@@ -0,0 +1,118 @@
+package search
+
+import (
+	"sort"
+	"strings"
+)
+
+// Switcher target kinds
+const (
+	TargetFriend     = "friend"
+	TargetConference = "conference"
+)
+
+// Target is a conversation the quick switcher can jump to
+type Target struct {
+	Kind  string
+	ID    int64  // The friend's user ID, or the conference ID
+	Name  string // Username, or conference name
+	Label string // Full name for friends
+}
+
+// Match is a target found for a query, with how well it matched
+type Match struct {
+	Target *Target
+	Score  int
+}
+
+// Index ranks friends and conferences against partial or misspelled names,
+// for the quick switcher. Each target is matched by any of its keys.
+type Index struct {
+	entries []indexEntry
+}
+
+type indexEntry struct {
+	target *Target
+	keys   []string // Lowercased
+}
+
+// NewIndex creates an empty switcher index
+func NewIndex() *Index {
+	return &Index{}
+}
+
+// Add indexes a target under the given keys, such as a username and full name
+func (x *Index) Add(target *Target, keys ...string) {
+	entry := indexEntry{target: target}
+	for _, key := range keys {
+		if key = strings.ToLower(strings.TrimSpace(key)); key != "" {
+			entry.keys = append(entry.keys, key)
+		}
+	}
+	x.entries = append(x.entries, entry)
+}
+
+// Match returns up to limit targets matching query, best first
+func (x *Index) Match(query string, limit int) []*Match {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return nil
+	}
+
+	var matches []*Match
+	for _, entry := range x.entries {
+		best := -1
+		for _, key := range entry.keys {
+			if score := fuzzyScore(key, query); score > best {
+				best = score
+			}
+		}
+		if best >= 0 {
+			matches = append(matches, &Match{Target: entry.target, Score: best})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].Target.Name < matches[j].Target.Name
+	})
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
+}
+
+// fuzzyScore rates how well query matches key, or returns -1 if it doesn't.
+// Exact matches beat prefixes, which beat substrings, which beat the query's
+// letters merely appearing in order, where fewer letters skipped scores higher.
+func fuzzyScore(key, query string) int {
+	switch {
+	case key == query:
+		return 1000
+	case strings.HasPrefix(key, query):
+		return 800
+	case strings.Contains(key, query):
+		return 600
+	}
+
+	// Subsequence: every query rune appears in key in order
+	gaps, last := 0, -1
+	pos := 0
+	for _, r := range query {
+		i := strings.IndexRune(key[pos:], r)
+		if i < 0 {
+			return -1
+		}
+		if last >= 0 {
+			gaps += pos + i - last - 1
+		}
+		last = pos + i
+		pos = last + len(string(r))
+	}
+	if score := 400 - gaps; score > 0 {
+		return score
+	}
+	return 0
+}
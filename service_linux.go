@@ -0,0 +1,140 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/austinwklein/whisper/config"
+	"github.com/austinwklein/whisper/i18n"
+)
+
+// unitTemplate is the systemd user unit. systemd stops the daemon with
+// SIGTERM, which shuts it down gracefully; restart is a stop and a start.
+const unitTemplate = `[Unit]
+Description=Whisper P2P chat node
+Documentation=https://github.com/austinwklein/whisper
+
+[Service]
+Type=simple
+ExecStart=%s
+%sRestart=on-failure
+RestartSec=5
+KillSignal=SIGTERM
+TimeoutStopSec=30
+
+[Install]
+WantedBy=default.target
+`
+
+// unitPath is where the whisper user unit is installed
+func unitPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the config directory: %w", err)
+	}
+	return filepath.Join(dir, "systemd", "user", serviceName+".service"), nil
+}
+
+// systemctl runs systemctl against the user's service manager
+func systemctl(args ...string) error {
+	cmd := exec.Command("systemctl", append([]string{"--user"}, args...)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("systemctl %s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// systemdQuote quotes one ExecStart or Environment word. '%' starts a
+// specifier in unit files, so it is doubled.
+func systemdQuote(word string) string {
+	word = strings.ReplaceAll(word, "%", "%%")
+	if word != "" && !strings.ContainsAny(word, " \t\"'\\$;") {
+		return word
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `$$`).Replace(word) + `"`
+}
+
+// installService writes a systemd user unit running exe with args, then
+// enables and starts it
+func installService(exe string, args, env []string) error {
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return errServiceUnsupported
+	}
+	path, err := unitPath()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return errServiceInstalled
+	}
+
+	words := []string{systemdQuote(exe)}
+	for _, arg := range args {
+		words = append(words, systemdQuote(arg))
+	}
+	var environment strings.Builder
+	for _, kv := range env {
+		fmt.Fprintf(&environment, "Environment=%s\n", systemdQuote(kv))
+	}
+	unit := fmt.Sprintf(unitTemplate, strings.Join(words, " "), environment.String())
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	// The environment can hold settings the user would rather keep private
+	if err := os.WriteFile(path, []byte(unit), 0600); err != nil {
+		return fmt.Errorf("failed to write unit: %w", err)
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	if err := systemctl("enable", "--now", serviceName+".service"); err != nil {
+		return err
+	}
+
+	i18n.Printf("Unit written to %s\n", path)
+	i18n.Println("To keep it running while you are logged out: loginctl enable-linger")
+	return nil
+}
+
+// uninstallService stops and disables the unit and removes it
+func uninstallService() error {
+	path, err := unitPath()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return errServiceNotInstalled
+	}
+
+	if err := systemctl("disable", "--now", serviceName+".service"); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove unit: %w", err)
+	}
+	return systemctl("daemon-reload")
+}
+
+// controlService starts, stops or restarts the installed unit
+func controlService(action string) error {
+	path, err := unitPath()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return errServiceNotInstalled
+	}
+	return systemctl(action, serviceName+".service")
+}
+
+// runDaemon runs the node headless; under systemd it is an ordinary process
+func runDaemon(cfg *config.Config, daemon *daemonOptions) error {
+	runForeground(cfg, daemon)
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build !linux && !windows
+
+package main
+
+import "github.com/austinwklein/whisper/config"
+
+// installService is only implemented for systemd and Windows
+func installService(exe string, args, env []string) error {
+	return errServiceUnsupported
+}
+
+// uninstallService is only implemented for systemd and Windows
+func uninstallService() error {
+	return errServiceUnsupported
+}
+
+// controlService is only implemented for systemd and Windows
+func controlService(action string) error {
+	return errServiceUnsupported
+}
+
+// runDaemon runs the node headless in the foreground, for launchd or a
+// process supervisor to manage
+func runDaemon(cfg *config.Config, daemon *daemonOptions) error {
+	runForeground(cfg, daemon)
+	return nil
+}
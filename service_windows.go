@@ -0,0 +1,193 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/austinwklein/whisper/config"
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// stopWait bounds how long stop and restart wait for the service to shut down
+const stopWait = 30 * time.Second
+
+// windowsService runs the node under the service control manager
+type windowsService struct {
+	cfg    *config.Config
+	daemon *daemonOptions
+}
+
+// Execute runs the node and maps the service manager's stop and shutdown
+// requests to its graceful shutdown
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		runNode(ctx, s.cfg, s.daemon, nil)
+		close(done)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case <-done:
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
+
+// runDaemon runs the node as a Windows service when started by the service
+// control manager, and in the foreground otherwise
+func runDaemon(cfg *config.Config, daemon *daemonOptions) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return fmt.Errorf("failed to detect the service manager: %w", err)
+	}
+	if !isService {
+		runForeground(cfg, daemon)
+		return nil
+	}
+	return svc.Run(serviceName, &windowsService{cfg: cfg, daemon: daemon})
+}
+
+// installService registers exe with args as an automatically started service
+// and starts it
+func installService(exe string, args, env []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager (run as administrator): %w", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return errServiceInstalled
+	}
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Whisper",
+		Description: "Whisper P2P chat node",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("failed to create service: %w", err)
+	}
+	defer s.Close()
+
+	// Restart after a crash, as systemd's Restart=on-failure does
+	recovery := []mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 5 * time.Second}}
+	if err := s.SetRecoveryActions(recovery, uint32((24 * time.Hour).Seconds())); err != nil {
+		return fmt.Errorf("failed to set recovery actions: %w", err)
+	}
+
+	// The service manager passes a service's Environment value to it
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\`+serviceName, registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("failed to open service key: %w", err)
+	}
+	defer key.Close()
+	if err := key.SetStringsValue("Environment", env); err != nil {
+		return fmt.Errorf("failed to set service environment: %w", err)
+	}
+
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("failed to start service: %w", err)
+	}
+	return nil
+}
+
+// uninstallService stops the service and removes it
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager (run as administrator): %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return errServiceNotInstalled
+	}
+	defer s.Close()
+
+	if err := stopService(s); err != nil {
+		return err
+	}
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("failed to delete service: %w", err)
+	}
+	return nil
+}
+
+// controlService starts, stops or restarts the installed service
+func controlService(action string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager (run as administrator): %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return errServiceNotInstalled
+	}
+	defer s.Close()
+
+	if action == "stop" || action == "restart" {
+		if err := stopService(s); err != nil {
+			return err
+		}
+	}
+	if action == "start" || action == "restart" {
+		if err := s.Start(); err != nil {
+			return fmt.Errorf("failed to start service: %w", err)
+		}
+	}
+	return nil
+}
+
+// stopService asks a running service to stop and waits until it has
+func stopService(s *mgr.Service) error {
+	st, err := s.Query()
+	if err != nil {
+		return fmt.Errorf("failed to query service: %w", err)
+	}
+	if st.State == svc.Stopped {
+		return nil
+	}
+	if st.State != svc.StopPending {
+		if st, err = s.Control(svc.Stop); err != nil {
+			return fmt.Errorf("failed to stop service: %w", err)
+		}
+	}
+
+	deadline := time.Now().Add(stopWait)
+	for st.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service did not stop within %s", stopWait)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if st, err = s.Query(); err != nil {
+			return fmt.Errorf("failed to query service: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+
+	"github.com/austinwklein/whisper/config"
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/settings"
+)
+
+// Node-wide settings that can change at runtime, named after their config fields
+const (
+	settingAutoDialMode = "autodial_mode"
+	settingDHTMode      = "dht_mode"
+	settingLocale       = "locale"
+	settingASCIIMode    = "ascii_mode"
+)
+
+// loadSettings declares the runtime settings with the configuration as their
+// defaults, loads the saved values, and writes the result back into cfg so
+// the rest of startup uses it
+func loadSettings(ctx context.Context, store settings.Store, cfg *config.Config) *settings.Service {
+	service := settings.NewService(store)
+	service.Define(settingAutoDialMode, "When offline friends are dialed automatically", cfg.AutoDialMode, settings.OneOf(autoDialModes...))
+	service.Define(settingDHTMode, "DHT mode: auto, client or server", cfg.DHTMode, p2p.CheckDHTMode)
+	service.Define(settingLocale, "Language (empty to follow the environment)", cfg.Locale, func(locale string) error {
+		if locale == "" {
+			return nil
+		}
+		return i18n.CheckLocale(locale)
+	})
+	service.Define(settingASCIIMode, "Plain ASCII output: on, off or auto", cfg.ASCIIMode, settings.OneOf("on", "off", "auto"))
+
+	if err := service.Load(ctx); err != nil {
+		i18n.Printf("Warning: Ignoring saved settings: %v\n", err)
+	}
+
+	cfg.AutoDialMode = service.String(settingAutoDialMode)
+	cfg.DHTMode = service.String(settingDHTMode)
+	if service.IsSet(settingLocale) || service.IsSet(settingASCIIMode) {
+		cfg.Locale = service.String(settingLocale)
+		cfg.ASCIIMode = service.String(settingASCIIMode)
+		applyDisplaySettings(cfg)
+	}
+	return service
+}
+
+// onSettingChanged applies a runtime setting as soon as it changes
+func (a *App) onSettingChanged(change settings.Change) {
+	switch change.Key {
+	case settingAutoDialMode:
+		a.setAutoDialMode(change.New)
+	case settingDHTMode:
+		if err := a.p2p.SetDHTMode(change.New); err != nil {
+			i18n.Printf("Failed to switch DHT mode: %v\n", err)
+		}
+	case settingLocale:
+		applyLocale(change.New)
+	case settingASCIIMode:
+		applyASCIIMode(change.New)
+	}
+}
+
+// handleSettingsCommand handles `settings [set <key> <value> | reset <key>]`
+func (a *App) handleSettingsCommand(ctx context.Context, parts []string) {
+	switch {
+	case len(parts) == 1:
+		i18n.Println("\n=== Settings ===")
+		for _, value := range a.settings.All() {
+			source := i18n.T("default")
+			if value.Set {
+				source = i18n.Sprintf("default %s", quoteSetting(value.Default))
+			}
+			i18n.Printf("  %-14s %-10s (%s) - %s\n", value.Key, quoteSetting(value.Value), source, i18n.T(value.Description))
+		}
+		i18n.Println("\nUse 'settings set <key> <value>' to change one, 'settings reset <key>' to restore its default")
+
+	case len(parts) == 4 && parts[1] == "set":
+		if err := a.settings.Set(ctx, parts[2], parts[3]); err != nil {
+			i18n.Printf("Failed to change setting: %v\n", err)
+			return
+		}
+		i18n.Printf("✓ %s set to %s\n", parts[2], parts[3])
+
+	case len(parts) == 3 && parts[1] == "reset":
+		if err := a.settings.Reset(ctx, parts[2]); err != nil {
+			i18n.Printf("Failed to reset setting: %v\n", err)
+			return
+		}
+		i18n.Printf("✓ %s reset to %s\n", parts[2], quoteSetting(a.settings.String(parts[2])))
+
+	default:
+		i18n.Println("Usage: settings [set <key> <value> | reset <key>]")
+	}
+}
+
+// quoteSetting shows an empty value visibly
+func quoteSetting(value string) string {
+	if value == "" {
+		return `""`
+	}
+	return value
+}
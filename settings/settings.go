@@ -0,0 +1,277 @@
+// Package settings keeps preferences that can change while the node runs.
+// Each setting is declared with a default, usually taken from config.Config;
+// a value set at runtime is saved in the settings table and replaces the
+// default from then on, including after a restart. Node-wide settings are
+// stored under user 0; per-account ones live beside them in the same table.
+package settings
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/austinwklein/whisper/storage"
+)
+
+// nodeUserID is the settings table user_id node-wide settings are stored under
+const nodeUserID = 0
+
+var (
+	ErrUnknownSetting = errors.New("unknown setting")
+	ErrInvalidValue   = errors.New("invalid setting value")
+)
+
+// Store is the part of storage.Storage settings need
+type Store interface {
+	GetSettings(ctx context.Context, userID int64) ([]*storage.Setting, error)
+	SaveSetting(ctx context.Context, setting *storage.Setting) error
+	DeleteSetting(ctx context.Context, userID, friendID int64, name string) error
+}
+
+// definition is a declared setting
+type definition struct {
+	description string
+	fallback    string
+	validate    func(string) error
+}
+
+// Value is a setting as shown to the user
+type Value struct {
+	Key         string
+	Description string
+	Value       string
+	Default     string
+	Set         bool // Saved at runtime rather than the default
+}
+
+// Change describes a setting whose value changed
+type Change struct {
+	Key string
+	Old string
+	New string
+}
+
+// Service reads and writes node-wide settings
+type Service struct {
+	store Store
+
+	mu            sync.RWMutex
+	defs          map[string]*definition
+	order         []string          // Keys in declaration order
+	values        map[string]string // Saved values, by key
+	changeHandler func(Change)
+}
+
+// NewService creates a settings service over store; declare settings with
+// Define, then Load the saved values
+func NewService(store Store) *Service {
+	return &Service{
+		store:  store,
+		defs:   make(map[string]*definition),
+		values: make(map[string]string),
+	}
+}
+
+// Define declares a setting with its default. validate, if not nil, vets
+// values before they are saved or loaded.
+func (s *Service) Define(key, description, fallback string, validate func(string) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.defs[key]; !ok {
+		s.order = append(s.order, key)
+	}
+	s.defs[key] = &definition{description: description, fallback: fallback, validate: validate}
+}
+
+// SetChangeHandler sets a callback run after a setting's value changes
+func (s *Service) SetChangeHandler(handler func(Change)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.changeHandler = handler
+}
+
+// Load reads the saved values. Values for settings that are no longer
+// declared, or that no longer validate, are skipped and reported.
+func (s *Service) Load(ctx context.Context) error {
+	saved, err := s.store.GetSettings(ctx, nodeUserID)
+	if err != nil {
+		return fmt.Errorf("failed to load settings: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, setting := range saved {
+		if setting.FriendID != 0 {
+			continue
+		}
+		def, ok := s.defs[setting.Name]
+		if !ok {
+			continue
+		}
+		if def.validate != nil {
+			if err := def.validate(setting.Value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", setting.Name, err))
+				continue
+			}
+		}
+		s.values[setting.Name] = setting.Value
+	}
+	return errors.Join(errs...)
+}
+
+// String returns a setting's value, or its default if it was never set
+func (s *Service) String(key string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if value, ok := s.values[key]; ok {
+		return value
+	}
+	if def, ok := s.defs[key]; ok {
+		return def.fallback
+	}
+	return ""
+}
+
+// Bool returns a boolean setting; values that don't parse read as false
+func (s *Service) Bool(key string) bool {
+	v, _ := strconv.ParseBool(s.String(key))
+	return v
+}
+
+// Int returns an integer setting; values that don't parse read as 0
+func (s *Service) Int(key string) int {
+	v, _ := strconv.Atoi(s.String(key))
+	return v
+}
+
+// IsSet reports whether a setting has a saved value
+func (s *Service) IsSet(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.values[key]
+	return ok
+}
+
+// Set validates and saves a setting, then runs the change handler if the
+// value changed
+func (s *Service) Set(ctx context.Context, key, value string) error {
+	s.mu.RLock()
+	def, ok := s.defs[key]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownSetting, key)
+	}
+	if def.validate != nil {
+		if err := def.validate(value); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidValue, err)
+		}
+	}
+
+	if err := s.store.SaveSetting(ctx, &storage.Setting{UserID: nodeUserID, Name: key, Value: value}); err != nil {
+		return fmt.Errorf("failed to save setting: %w", err)
+	}
+
+	old := s.String(key)
+	s.mu.Lock()
+	s.values[key] = value
+	s.mu.Unlock()
+	s.changed(key, old)
+	return nil
+}
+
+// SetBool saves a boolean setting
+func (s *Service) SetBool(ctx context.Context, key string, value bool) error {
+	return s.Set(ctx, key, strconv.FormatBool(value))
+}
+
+// SetInt saves an integer setting
+func (s *Service) SetInt(ctx context.Context, key string, value int) error {
+	return s.Set(ctx, key, strconv.Itoa(value))
+}
+
+// Reset deletes a setting's saved value so its default applies again
+func (s *Service) Reset(ctx context.Context, key string) error {
+	s.mu.RLock()
+	_, ok := s.defs[key]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownSetting, key)
+	}
+
+	if err := s.store.DeleteSetting(ctx, nodeUserID, 0, key); err != nil {
+		return fmt.Errorf("failed to reset setting: %w", err)
+	}
+
+	old := s.String(key)
+	s.mu.Lock()
+	delete(s.values, key)
+	s.mu.Unlock()
+	s.changed(key, old)
+	return nil
+}
+
+// SetDefault changes a setting's default, as when the config file it comes
+// from is edited, and runs the change handler if the setting was never set
+// and so takes the new value
+func (s *Service) SetDefault(key, fallback string) error {
+	s.mu.RLock()
+	def, ok := s.defs[key]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownSetting, key)
+	}
+	if def.validate != nil {
+		if err := def.validate(fallback); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidValue, err)
+		}
+	}
+
+	old := s.String(key)
+	s.mu.Lock()
+	s.defs[key] = &definition{description: def.description, fallback: fallback, validate: def.validate}
+	s.mu.Unlock()
+	s.changed(key, old)
+	return nil
+}
+
+// All returns every declared setting in declaration order
+func (s *Service) All() []Value {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	values := make([]Value, 0, len(s.order))
+	for _, key := range s.order {
+		def := s.defs[key]
+		value, set := s.values[key]
+		if !set {
+			value = def.fallback
+		}
+		values = append(values, Value{Key: key, Description: def.description, Value: value, Default: def.fallback, Set: set})
+	}
+	return values
+}
+
+// changed runs the change handler if key's value differs from old
+func (s *Service) changed(key, old string) {
+	value := s.String(key)
+	s.mu.RLock()
+	handler := s.changeHandler
+	s.mu.RUnlock()
+	if handler != nil && value != old {
+		handler(Change{Key: key, Old: old, New: value})
+	}
+}
+
+// OneOf returns a validator accepting only the given values
+func OneOf(allowed ...string) func(string) error {
+	return func(value string) error {
+		for _, a := range allowed {
+			if value == a {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %v", value, allowed)
+	}
+}
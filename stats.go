@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/storage"
+)
+
+const (
+	// statsDays is how many active days the per-day chart shows
+	statsDays = 14
+
+	// statsBarWidth is the length of the busiest day's bar
+	statsBarWidth = 30
+)
+
+// handleStatsCommand handles `stats <username|conf-id> [days]`, summarizing a
+// conversation or conference over the last days, or all time without them
+func (a *App) handleStatsCommand(ctx context.Context, user *storage.User, parts []string) {
+	if len(parts) < 2 || len(parts) > 3 {
+		i18n.Println("Usage: stats <username|conf-id> [days]")
+		return
+	}
+	var since time.Time
+	if len(parts) == 3 {
+		days, err := strconv.Atoi(parts[2])
+		if err != nil || days <= 0 {
+			i18n.Println("Usage: stats <username|conf-id> [days]")
+			return
+		}
+		since = time.Now().AddDate(0, 0, -days)
+	}
+
+	var name string
+	var stats *storage.ConversationStats
+	var err error
+	conf, confErr := a.conferenceByArg(ctx, parts[1])
+	if confErr == nil {
+		name = conf.Name
+		stats, err = a.conferenceManager.GetStats(ctx, conf.ID, since)
+	} else {
+		contact, lookupErr := a.storage.GetUserByUsername(ctx, parts[1])
+		if errors.Is(lookupErr, storage.ErrNotFound) {
+			i18n.Printf("No friend or conference called %s\n", parts[1])
+			return
+		}
+		if lookupErr != nil {
+			i18n.Printf("Failed to get stats: %v\n", lookupErr)
+			return
+		}
+		name = contact.Username
+		stats, err = a.messageManager.GetConversationStats(ctx, user.ID, contact.ID, since)
+	}
+	if err != nil {
+		i18n.Printf("Failed to get stats: %v\n", err)
+		return
+	}
+
+	if since.IsZero() {
+		i18n.Printf("\n=== Stats: %s (all time) ===\n", name)
+	} else {
+		i18n.Printf("\n=== Stats: %s (last %s days) ===\n", name, parts[2])
+	}
+	printStats(stats, user)
+}
+
+// conferenceByArg returns the conference a numeric argument names
+func (a *App) conferenceByArg(ctx context.Context, arg string) (*storage.Conference, error) {
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return a.storage.GetConference(ctx, id)
+}
+
+// printStats renders conversation statistics
+func printStats(stats *storage.ConversationStats, user *storage.User) {
+	if stats.Messages == 0 {
+		i18n.Println("No messages")
+		return
+	}
+
+	i18n.Printf("Messages: %d, %s to %s\n", stats.Messages,
+		stats.First.Local().Format("2006-01-02"), stats.Last.Local().Format("2006-01-02"))
+	if stats.Responses > 0 {
+		i18n.Printf("Average response: %s (%d replies)\n", formatResponseTime(stats.AvgResponse), stats.Responses)
+	}
+
+	hours := stats.BusiestHours()
+	if len(hours) > 3 {
+		hours = hours[:3]
+	}
+	busiest := make([]string, 0, len(hours))
+	for _, hour := range hours {
+		busiest = append(busiest, fmt.Sprintf("%02d:00 (%d)", hour, stats.ByHour[hour]))
+	}
+	i18n.Printf("Busiest hours: %s\n", strings.Join(busiest, ", "))
+
+	i18n.Println("Top posters:")
+	for i, poster := range stats.Posters {
+		if i == 5 {
+			break
+		}
+		name := poster.Username
+		switch {
+		case poster.PeerID == user.PeerID:
+			name = i18n.T("You")
+		case name == "":
+			name = poster.PeerID[:min(16, len(poster.PeerID))] + "..."
+		}
+		i18n.Printf("  %-20s %5d (%d%%)\n", name, poster.Messages, poster.Messages*100/stats.Messages)
+	}
+
+	days := stats.PerDay
+	if len(days) > statsDays {
+		days = days[len(days)-statsDays:]
+	}
+	most := 0
+	for _, day := range days {
+		most = max(most, day.Messages)
+	}
+	i18n.Printf("Messages per day (last %d active days):\n", len(days))
+	for _, day := range days {
+		bar := strings.Repeat("█", max(1, day.Messages*statsBarWidth/most))
+		i18n.Printf("  %s %s %d\n", day.Day, bar, day.Messages)
+	}
+}
+
+// formatResponseTime renders a response time to the nearest second, or minute past an hour
+func formatResponseTime(d time.Duration) string {
+	if d >= time.Hour {
+		return d.Round(time.Minute).String()
+	}
+	return d.Round(time.Second).String()
+}
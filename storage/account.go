@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DeleteAccount removes an account on this node and everything kept for it:
+// its messages, friends, settings and former usernames, the conferences no
+// other account here takes part in, and contacts no other account knows.
+// The database is vacuumed afterwards so deleted rows don't linger in free pages.
+func (s *SQLiteStorage) DeleteAccount(ctx context.Context, userID int64) error {
+	defer s.observe("DeleteAccount", time.Now())
+	user, err := s.GetUserByID(ctx, userID)
+	if errors.Is(err, ErrNotFound) || (err == nil && user.IsRemote()) {
+		return ErrNotAccount
+	}
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Conferences only this account takes part in go entirely
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id FROM conferences
+		WHERE (creator_id = ? OR id IN (SELECT conference_id FROM conference_participants WHERE user_id = ?))
+		AND id NOT IN (
+			SELECT p.conference_id FROM conference_participants p
+			JOIN users u ON u.id = p.user_id
+			WHERE u.id != ? AND u.password_hash != ?
+		)
+	`, userID, userID, userID, RemoteUserPasswordHash)
+	if err != nil {
+		return err
+	}
+	var conferenceIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		conferenceIDs = append(conferenceIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range conferenceIDs {
+		for _, table := range []string{"conference_messages", "conference_membership", "conference_channels", "conference_rate_limits", "conference_observers", "conference_reads", "conference_summaries", "conference_participants"} {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE conference_id = ?`, id); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM conferences WHERE id = ?`, id); err != nil {
+			return err
+		}
+	}
+
+	deletes := []string{
+		`DELETE FROM message_bodies WHERE message_id IN (SELECT id FROM messages WHERE from_user_id = ?1 OR to_user_id = ?1)`,
+		`DELETE FROM delivery_attempts WHERE message_id IN (SELECT id FROM messages WHERE from_user_id = ?1 OR to_user_id = ?1)`,
+		`DELETE FROM messages WHERE from_user_id = ?1 OR to_user_id = ?1`,
+		`DELETE FROM message_seqs WHERE from_user_id = ?1 OR to_user_id = ?1`,
+		`DELETE FROM quarantined_messages WHERE contact_id = ?1`,
+		`DELETE FROM identity_candidates WHERE contact_id = ?1`,
+		`DELETE FROM group_deliveries WHERE message_id IN (SELECT m.id FROM group_messages m JOIN group_chats g ON g.id = m.group_id WHERE g.user_id = ?1)`,
+		`DELETE FROM group_messages WHERE group_id IN (SELECT id FROM group_chats WHERE user_id = ?1)`,
+		`DELETE FROM group_members WHERE group_id IN (SELECT id FROM group_chats WHERE user_id = ?1)`,
+		`DELETE FROM group_chats WHERE user_id = ?1`,
+		`DELETE FROM conference_participants WHERE user_id = ?1`,
+		`DELETE FROM friends WHERE user_id = ?1 OR friend_id = ?1`,
+		`DELETE FROM settings WHERE user_id = ?1`,
+		`DELETE FROM activity WHERE user_id = ?1`,
+		`DELETE FROM conference_reads WHERE user_id = ?1`,
+		`DELETE FROM roster_copies WHERE user_id = ?1 OR friend_id = ?1`,
+		`DELETE FROM account_keys WHERE user_id = ?1`,
+		`DELETE FROM users WHERE id = ?1`,
+	}
+	for _, query := range deletes {
+		if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+			return err
+		}
+	}
+
+	// Contacts nothing refers to any more, and what was kept about them
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM users WHERE password_hash = ?
+		AND id NOT IN (SELECT user_id FROM friends)
+		AND id NOT IN (SELECT friend_id FROM friends)
+		AND id NOT IN (SELECT from_user_id FROM messages)
+		AND id NOT IN (SELECT to_user_id FROM messages)
+		AND id NOT IN (SELECT user_id FROM conference_participants)
+		AND id NOT IN (SELECT from_user_id FROM conference_messages)
+	`, RemoteUserPasswordHash); err != nil {
+		return err
+	}
+	cleanups := []string{
+		`DELETE FROM settings WHERE friend_id != 0 AND friend_id NOT IN (SELECT id FROM users)`,
+		`DELETE FROM roster_copies WHERE friend_id NOT IN (SELECT id FROM users)`,
+		`DELETE FROM username_aliases WHERE user_id NOT IN (SELECT id FROM users)`,
+		`DELETE FROM push_endpoints WHERE peer_id NOT IN (SELECT peer_id FROM users)`,
+	}
+	for _, query := range cleanups {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if err := s.checkpoint(); err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, "VACUUM")
+	return err
+}
+
+// ExportAccount copies the database to destPath with a single local account
+// in it: every other account is deleted from the copy as DeleteAccount
+// would delete it. An account with an identity key of its own takes it along
+// as the copy's node identity. Otherwise, unless keepIdentity is set, the
+// copy has no node identity, so whoever opens it next creates a new one.
+// destPath must not exist yet.
+func (s *SQLiteStorage) ExportAccount(ctx context.Context, userID int64, destPath string, keepIdentity bool) error {
+	defer s.observe("ExportAccount", time.Now())
+	user, err := s.GetUserByID(ctx, userID)
+	if errors.Is(err, ErrNotFound) || (err == nil && user.IsRemote()) {
+		return ErrNotAccount
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(destPath); err == nil {
+		return fmt.Errorf("%s already exists", destPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(destPath), 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	if err := s.snapshot(ctx, destPath); err != nil {
+		removeDatabase(destPath)
+		return fmt.Errorf("failed to copy database: %w", err)
+	}
+	if err := trimExport(ctx, destPath, userID, keepIdentity); err != nil {
+		removeDatabase(destPath)
+		return err
+	}
+	return os.Chmod(destPath, 0600)
+}
+
+// trimExport deletes what isn't the exported account's from a copy
+func trimExport(ctx context.Context, path string, userID int64, keepIdentity bool) error {
+	dest, err := NewSQLiteStorage(path)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	accounts, err := dest.GetLocalUsers(ctx)
+	if err != nil {
+		return err
+	}
+	for _, account := range accounts {
+		if account.ID == userID {
+			continue
+		}
+		if err := dest.DeleteAccount(ctx, account.ID); err != nil {
+			return fmt.Errorf("failed to remove %s from the copy: %w", account.Username, err)
+		}
+	}
+
+	key, err := dest.GetAccountKey(ctx, userID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case key != nil:
+		if err := dest.SaveIdentityKey(ctx, key); err != nil {
+			return fmt.Errorf("failed to make the account's key the node identity: %w", err)
+		}
+		if _, err := dest.db.ExecContext(ctx, `DELETE FROM account_keys`); err != nil {
+			return err
+		}
+	case !keepIdentity:
+		if _, err := dest.db.ExecContext(ctx, `DELETE FROM node_identity`); err != nil {
+			return fmt.Errorf("failed to remove the node identity from the copy: %w", err)
+		}
+	}
+	return nil
+}
+
+// removeDatabase deletes a database file with its WAL files
+func removeDatabase(path string) {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(path + suffix)
+	}
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportAccountTakesItsOwnKey(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(t)
+	nodeKey, bobKey := []byte("node key"), []byte("bob's key")
+	if err := s.SaveIdentityKey(ctx, nodeKey); err != nil {
+		t.Fatalf("SaveIdentityKey: %v", err)
+	}
+	alice := &User{Username: "alice", PasswordHash: "hash", PeerID: "node"}
+	bob := &User{Username: "bob", PasswordHash: "hash", PeerID: "bob"}
+	for _, user := range []*User{alice, bob} {
+		if err := s.CreateUser(ctx, user); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+	}
+	if err := s.SaveAccountKey(ctx, bob.ID, bobKey); err != nil {
+		t.Fatalf("SaveAccountKey: %v", err)
+	}
+	if key, err := s.GetAccountKey(ctx, alice.ID); err != nil || key != nil {
+		t.Fatalf("GetAccountKey(alice) = %q, %v; want none", key, err)
+	}
+
+	tests := []struct {
+		name         string
+		user         *User
+		keepIdentity bool
+		want         []byte
+	}{
+		{"own key", bob, false, bobKey},
+		{"own key over the node's", bob, true, bobKey},
+		{"node identity kept", alice, true, nodeKey},
+		{"node identity left out", alice, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "export.db")
+			if err := s.ExportAccount(ctx, tt.user.ID, path, tt.keepIdentity); err != nil {
+				t.Fatalf("ExportAccount: %v", err)
+			}
+			dest, err := NewSQLiteStorage(path)
+			if err != nil {
+				t.Fatalf("failed to open the export: %v", err)
+			}
+			defer dest.Close()
+
+			if key, err := dest.GetIdentityKey(ctx); err != nil || !bytes.Equal(key, tt.want) {
+				t.Errorf("node identity = %q, %v; want %q", key, err, tt.want)
+			}
+			if key, err := dest.GetAccountKey(ctx, tt.user.ID); err != nil || key != nil {
+				t.Errorf("account key left in the export: %q, %v", key, err)
+			}
+		})
+	}
+}
+
+func TestDeleteAccountDropsItsKey(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(t)
+	bob := &User{Username: "bob", PasswordHash: "hash", PeerID: "bob"}
+	if err := s.CreateUser(ctx, bob); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if err := s.SaveAccountKey(ctx, bob.ID, []byte("bob's key")); err != nil {
+		t.Fatalf("SaveAccountKey: %v", err)
+	}
+	if err := s.DeleteAccount(ctx, bob.ID); err != nil {
+		t.Fatalf("DeleteAccount: %v", err)
+	}
+	if key, err := s.GetAccountKey(ctx, bob.ID); err != nil || key != nil {
+		t.Errorf("GetAccountKey after delete = %q, %v; want none", key, err)
+	}
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// GetActivityFeed returns up to limit of a user's activity entries older than
+// beforeID, newest first; beforeID 0 starts from the newest. Pass the last
+// returned ID to get the next page.
+func (s *SQLiteStorage) GetActivityFeed(ctx context.Context, userID, beforeID int64, limit int) ([]*Activity, error) {
+	defer s.observe("GetActivityFeed", time.Now())
+	if beforeID <= 0 {
+		beforeID = 1<<63 - 1
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, user_id, kind, peer_id, name, conference_id, detail, count, seen, created_at
+		FROM activity
+		WHERE user_id = ? AND id < ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, userID, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	feed := []*Activity{}
+	for rows.Next() {
+		activity := &Activity{}
+		if err := rows.Scan(&activity.ID, &activity.UserID, &activity.Kind, &activity.PeerID, &activity.Name,
+			&activity.ConferenceID, &activity.Detail, &activity.Count, &activity.Seen, &activity.CreatedAt); err != nil {
+			return nil, err
+		}
+		feed = append(feed, activity)
+	}
+	return feed, rows.Err()
+}
+
+// RecordActivity adds an entry to a user's activity feed. Missed messages
+// from a peer whose last entry hasn't been seen yet are counted into that
+// entry instead, which moves to the top of the feed. Only the newest
+// MaxActivity entries of a user are kept.
+func (s *SQLiteStorage) RecordActivity(ctx context.Context, activity *Activity) error {
+	defer s.observe("RecordActivity", time.Now())
+	if activity.Count == 0 {
+		activity.Count = 1
+	}
+	if activity.CreatedAt.IsZero() {
+		activity.CreatedAt = time.Now()
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if activity.Kind == ActivityMissedMessages {
+		var id int64
+		var count int
+		err := tx.QueryRowContext(ctx, `
+			SELECT id, count FROM activity
+			WHERE user_id = ? AND kind = ? AND peer_id = ? AND seen = 0
+			ORDER BY id DESC LIMIT 1
+		`, activity.UserID, activity.Kind, activity.PeerID).Scan(&id, &count)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil {
+			activity.Count += count
+			if _, err := tx.ExecContext(ctx, `DELETE FROM activity WHERE id = ?`, id); err != nil {
+				return err
+			}
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO activity (user_id, kind, peer_id, name, conference_id, detail, count, seen, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?)
+	`, activity.UserID, activity.Kind, activity.PeerID, activity.Name, activity.ConferenceID,
+		activity.Detail, activity.Count, activity.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if activity.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM activity
+		WHERE user_id = ?1 AND id NOT IN (
+			SELECT id FROM activity WHERE user_id = ?1
+			ORDER BY id DESC LIMIT ?2
+		)
+	`, activity.UserID, MaxActivity); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MarkActivitySeen marks a user's activity entries up to and including upToID as seen
+func (s *SQLiteStorage) MarkActivitySeen(ctx context.Context, userID, upToID int64) error {
+	defer s.observe("MarkActivitySeen", time.Now())
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE activity SET seen = 1 WHERE user_id = ? AND id <= ? AND seen = 0
+	`, userID, upToID)
+	return err
+}
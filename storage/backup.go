@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/scrypt"
+)
+
+// backupMagic prefixes encrypted backup files
+const backupMagic = "WHISPERBAK1\n"
+
+// backupPagesPerStep is how many pages are copied before yielding to writers
+const backupPagesPerStep = 256
+
+// DefaultBackupPath returns a timestamped path in the database's backup directory
+func (s *SQLiteStorage) DefaultBackupPath() string {
+	return filepath.Join(s.backupDir(), fmt.Sprintf("manual-%s.db", time.Now().Format("20060102-150405")))
+}
+
+// Backup snapshots the live database to destPath using SQLite's online backup
+// API, so the node keeps running while the copy is made. If passphrase is not
+// empty the snapshot is encrypted with a key derived from it. The plaintext
+// snapshot is only ever readable by the user and is removed if anything fails.
+func (s *SQLiteStorage) Backup(ctx context.Context, destPath, passphrase string) error {
+	return s.backup(ctx, destPath, passphrase, true)
+}
+
+// backup takes a backup as Backup does; without keepIdentity the node
+// identity key is scrubbed from the snapshot first
+func (s *SQLiteStorage) backup(ctx context.Context, destPath, passphrase string, keepIdentity bool) (err error) {
+	if s.IsEphemeral() {
+		return fmt.Errorf("backup: %w", ErrEphemeral)
+	}
+
+	if err := s.admitBackup(ctx, destPath); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(destPath), 0700); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	snapshotPath := destPath
+	if passphrase != "" {
+		snapshotPath = destPath + ".tmp"
+		defer removeDatabase(snapshotPath)
+	}
+	removeDatabase(snapshotPath)
+	written := false
+	defer func() {
+		if err != nil && !written {
+			removeDatabase(destPath)
+		}
+	}()
+
+	// Created private before SQLite writes to it, which gives its journal the same mode
+	if err := createPrivateFile(snapshotPath); err != nil {
+		return fmt.Errorf("failed to create backup file: %w", err)
+	}
+	if err := s.snapshot(ctx, snapshotPath); err != nil {
+		return err
+	}
+	if !keepIdentity {
+		if err := scrubIdentity(ctx, snapshotPath); err != nil {
+			return err
+		}
+	}
+
+	if passphrase != "" {
+		if err := encryptFile(snapshotPath, destPath, passphrase); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(destPath, 0600); err != nil {
+		return err
+	}
+	written = true
+	if err := s.trimBackups(ctx, destPath); err != nil {
+		return fmt.Errorf("failed to prune backups: %w", err)
+	}
+	return nil
+}
+
+// createPrivateFile creates an empty file only the user can read
+func createPrivateFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// scrubIdentity deletes the node identity key from a snapshot, vacuuming so
+// no copy of it is left in the file's free pages
+func scrubIdentity(ctx context.Context, path string) error {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %w", err)
+	}
+	defer db.Close()
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM node_identity`); err != nil {
+		return fmt.Errorf("failed to remove the node identity from the backup: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, "VACUUM"); err != nil {
+		return fmt.Errorf("failed to compact backup: %w", err)
+	}
+	return nil
+}
+
+// snapshot copies the database page by page into a new SQLite file
+func (s *SQLiteStorage) snapshot(ctx context.Context, destPath string) error {
+	destDB, err := sql.Open("sqlite3", destPath)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %w", err)
+	}
+	defer destDB.Close()
+
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %w", err)
+	}
+	defer destConn.Close()
+
+	srcConn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire database connection: %w", err)
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destRaw interface{}) error {
+		return srcConn.Raw(func(srcRaw interface{}) error {
+			dest, ok := destRaw.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("backup destination is not a SQLite connection")
+			}
+			src, ok := srcRaw.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("database is not a SQLite connection")
+			}
+
+			backup, err := dest.Backup("main", src, "main")
+			if err != nil {
+				return fmt.Errorf("failed to start backup: %w", err)
+			}
+
+			for {
+				done, err := backup.Step(backupPagesPerStep)
+				if err != nil {
+					backup.Finish()
+					return fmt.Errorf("backup failed: %w", err)
+				}
+				if done {
+					break
+				}
+				if ctx.Err() != nil {
+					backup.Finish()
+					return ctx.Err()
+				}
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// RunScheduledBackups takes a backup every interval, keeping the newest keep
+// copies in the backup directory. Backups are encrypted with passphrase if it
+// isn't empty; otherwise the node identity key is left out of them, so a
+// stray copy can't be used to impersonate the node. It returns when ctx is
+// cancelled.
+func (s *SQLiteStorage) RunScheduledBackups(ctx context.Context, interval time.Duration, keep int, passphrase string) {
+	if interval <= 0 || s.IsEphemeral() {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			dest := filepath.Join(s.backupDir(), fmt.Sprintf("auto-%s.db", time.Now().Format("20060102-150405")))
+			if err := s.backup(ctx, dest, passphrase, passphrase != ""); err != nil {
+				fmt.Printf("Warning: Scheduled backup failed: %v\n", err)
+				continue
+			}
+			if err := rotateBackups(s.backupDir(), "auto-", keep); err != nil {
+				fmt.Printf("Warning: Failed to rotate backups: %v\n", err)
+			}
+		}
+	}
+}
+
+// encryptFile encrypts src into dst with AES-256-GCM using a scrypt-derived key.
+// Layout: magic | salt (16) | nonce (12) | ciphertext.
+func encryptFile(src, dst, passphrase string) error {
+	plaintext, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %w", err)
+	}
+	gcm, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	out := append([]byte(backupMagic), salt...)
+	out = append(out, nonce...)
+	out = gcm.Seal(out, nonce, plaintext, []byte(backupMagic))
+
+	if err := os.WriteFile(dst, out, 0600); err != nil {
+		return fmt.Errorf("failed to write encrypted backup: %w", err)
+	}
+	return nil
+}
+
+// DecryptBackup decrypts an encrypted backup file into a plain SQLite database at dst
+func DecryptBackup(src, dst, passphrase string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+	if len(data) < len(backupMagic)+16 || string(data[:len(backupMagic)]) != backupMagic {
+		return errors.New("not an encrypted whisper backup")
+	}
+	data = data[len(backupMagic):]
+
+	gcm, err := backupCipher(passphrase, data[:16])
+	if err != nil {
+		return err
+	}
+	data = data[16:]
+	if len(data) < gcm.NonceSize() {
+		return errors.New("encrypted backup is truncated")
+	}
+
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(backupMagic))
+	if err != nil {
+		return errors.New("wrong passphrase or damaged backup")
+	}
+	if err := os.WriteFile(dst, plaintext, 0600); err != nil {
+		return fmt.Errorf("failed to write decrypted backup: %w", err)
+	}
+	return nil
+}
+
+// backupCipher derives the AES-GCM cipher for a passphrase and salt
+func backupCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newFileStorage opens a database in a temporary directory with a node
+// identity key saved, returning the key
+func newFileStorage(t *testing.T) (*SQLiteStorage, []byte) {
+	t.Helper()
+	s, err := NewSQLiteStorage(filepath.Join(t.TempDir(), "whisper.db"))
+	if err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	key := bytes.Repeat([]byte("identity-key-"), 4)
+	if err := s.SaveIdentityKey(context.Background(), key); err != nil {
+		t.Fatalf("failed to save identity: %v", err)
+	}
+	return s, key
+}
+
+// backupIdentity opens a plaintext backup and returns the identity key in it
+func backupIdentity(t *testing.T, path string) []byte {
+	t.Helper()
+	b, err := NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatalf("failed to open backup: %v", err)
+	}
+	defer b.Close()
+	key, err := b.GetIdentityKey(context.Background())
+	if err != nil {
+		t.Fatalf("failed to read identity from backup: %v", err)
+	}
+	return key
+}
+
+// checkPrivate fails the test unless only the user can read path
+func checkPrivate(t *testing.T, path string) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("backup missing: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("%s has mode %o, want 600", filepath.Base(path), mode)
+	}
+}
+
+func TestBackupKeepsIdentity(t *testing.T) {
+	s, key := newFileStorage(t)
+	dest := filepath.Join(t.TempDir(), "manual.db")
+
+	if err := s.Backup(context.Background(), dest, ""); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	checkPrivate(t, dest)
+	if got := backupIdentity(t, dest); !bytes.Equal(got, key) {
+		t.Errorf("backup identity = %q, want %q", got, key)
+	}
+}
+
+func TestPlaintextScheduledBackupLeavesOutIdentity(t *testing.T) {
+	s, key := newFileStorage(t)
+	dest := filepath.Join(t.TempDir(), "auto.db")
+
+	if err := s.backup(context.Background(), dest, "", false); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	checkPrivate(t, dest)
+	if got := backupIdentity(t, dest); got != nil {
+		t.Errorf("backup identity = %q, want none", got)
+	}
+	data, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("failed to read backup: %v", err)
+	}
+	if bytes.Contains(data, key) {
+		t.Error("identity key bytes are still in the backup file")
+	}
+}
+
+func TestEncryptedBackup(t *testing.T) {
+	s, key := newFileStorage(t)
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "manual.db")
+
+	if err := s.backup(context.Background(), dest, "correct horse", true); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	checkPrivate(t, dest)
+	if _, err := os.Stat(dest + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("plaintext snapshot left behind: %v", err)
+	}
+	data, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("failed to read backup: %v", err)
+	}
+	if bytes.Contains(data, key) {
+		t.Error("identity key readable in the encrypted backup")
+	}
+
+	if err := DecryptBackup(dest, filepath.Join(dir, "wrong.db"), "battery staple"); err == nil {
+		t.Error("decrypted with the wrong passphrase")
+	}
+	restored := filepath.Join(dir, "restored.db")
+	if err := DecryptBackup(dest, restored, "correct horse"); err != nil {
+		t.Fatalf("DecryptBackup: %v", err)
+	}
+	checkPrivate(t, restored)
+	if got := backupIdentity(t, restored); !bytes.Equal(got, key) {
+		t.Errorf("restored identity = %q, want %q", got, key)
+	}
+}
+
+func TestFailedBackupLeavesNothing(t *testing.T) {
+	for _, passphrase := range []string{"", "correct horse"} {
+		s, _ := newFileStorage(t)
+		dir := t.TempDir()
+		dest := filepath.Join(dir, "manual.db")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := s.Backup(ctx, dest, passphrase); err == nil {
+			t.Fatalf("backup with a cancelled context succeeded (passphrase %q)", passphrase)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("failed to list backup directory: %v", err)
+		}
+		for _, entry := range entries {
+			t.Errorf("failed backup left %s behind (passphrase %q)", entry.Name(), passphrase)
+		}
+	}
+}
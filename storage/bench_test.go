@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Benchmark database shape: enough conversations and long enough bodies for
+// the conversation list to feel the cost of reading message text
+const (
+	benchConversations = 20
+	benchMessages      = 200 // Per conversation
+	benchBodySize      = 2048
+)
+
+// newBenchStorage opens a file database holding benchConversations
+// conversations between the owner and a contact each, and returns the owner
+// and the contacts
+func newBenchStorage(b *testing.B) (*SQLiteStorage, *User, []*User) {
+	b.Helper()
+	ctx := context.Background()
+	s, err := NewSQLiteStorage(filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatalf("failed to open storage: %v", err)
+	}
+	b.Cleanup(func() { s.Close() })
+
+	owner := createTestUser(b, s, "owner")
+	body := strings.Repeat("x", benchBodySize)
+	contacts := make([]*User, benchConversations)
+	for i := range contacts {
+		contacts[i] = createTestUser(b, s, fmt.Sprintf("contact%d", i))
+		for n := int64(1); n <= benchMessages; n++ {
+			from, to := owner, contacts[i]
+			if n%2 == 0 {
+				from, to = to, from
+			}
+			msg := &Message{FromUserID: from.ID, ToUserID: to.ID, FromPeerID: from.PeerID, ToPeerID: to.PeerID, Content: body, Lamport: n, Delivered: true}
+			if err := s.SaveMessage(ctx, msg); err != nil {
+				b.Fatalf("SaveMessage: %v", err)
+			}
+		}
+	}
+	return s, owner, contacts
+}
+
+// BenchmarkGetConversations lists conversations, which reads only the
+// previews kept with the metadata, never the bodies
+func BenchmarkGetConversations(b *testing.B) {
+	ctx := context.Background()
+	s, owner, _ := newBenchStorage(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conversations, err := s.GetConversations(ctx, owner.ID, nil)
+		if err != nil || len(conversations) != benchConversations {
+			b.Fatalf("GetConversations = %d, %v", len(conversations), err)
+		}
+	}
+}
+
+// BenchmarkGetMessages reads the latest page of one conversation, walking
+// idx_messages_conversation and joining in the message bodies
+func BenchmarkGetMessages(b *testing.B) {
+	ctx := context.Background()
+	s, owner, contacts := newBenchStorage(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		messages, err := s.GetMessages(ctx, owner.ID, contacts[i%len(contacts)].ID, 50)
+		if err != nil || len(messages) != 50 {
+			b.Fatalf("GetMessages = %d, %v", len(messages), err)
+		}
+	}
+}
+
+// BenchmarkNextMessageLamport finds one conversation's next Lamport time
+// through idx_messages_conversation, without touching the others
+func BenchmarkNextMessageLamport(b *testing.B) {
+	ctx := context.Background()
+	s, owner, contacts := newBenchStorage(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		next, err := s.NextMessageLamport(ctx, owner.ID, contacts[i%len(contacts)].ID)
+		if err != nil || next != benchMessages+1 {
+			b.Fatalf("NextMessageLamport = %d, %v", next, err)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// MarkConversationRead marks every unread message a user received in a
+// direct conversation as read, and returns the ones that weren't system
+// messages, which are the ones to send read receipts for. Their bodies are
+// not loaded.
+func (s *SQLiteStorage) MarkConversationRead(ctx context.Context, userID, otherUserID int64) ([]*Message, error) {
+	defer s.observe("MarkConversationRead", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE messages SET read = 1, read_at = CURRENT_TIMESTAMP
+		WHERE conversation_id = ? AND to_user_id = ? AND read = 0
+		RETURNING `+messageColumns, conversationID(userID, otherUserID), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	read := []*Message{}
+	for rows.Next() {
+		msg, err := scanMessageRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Kind != MessageKindSystem {
+			read = append(read, msg)
+		}
+	}
+	return read, rows.Err()
+}
+
+// MarkMessagesReadBySeq marks the messages sent from one user to another with
+// the given sequence numbers as read, and returns how many it marked
+func (s *SQLiteStorage) MarkMessagesReadBySeq(ctx context.Context, fromUserID, toUserID int64, seqs []int64) (int64, error) {
+	defer s.observe("MarkMessagesReadBySeq", time.Now())
+	if len(seqs) == 0 {
+		return 0, nil
+	}
+
+	placeholders := make([]string, len(seqs))
+	args := []interface{}{fromUserID, toUserID}
+	for i, seq := range seqs {
+		placeholders[i] = "?"
+		args = append(args, seq)
+	}
+
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE messages SET read = 1, read_at = CURRENT_TIMESTAMP
+		WHERE from_user_id = ? AND to_user_id = ? AND read = 0
+			AND seq IN (`+strings.Join(placeholders, ", ")+`)
+	`, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// HideConversation hides every message of a direct conversation from a
+// user's history, as HideMessage does for one, and returns how many it hid
+func (s *SQLiteStorage) HideConversation(ctx context.Context, userID, otherUserID int64) (int64, error) {
+	defer s.observe("HideConversation", time.Now())
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE messages SET hidden = 1
+		WHERE conversation_id = ? AND hidden = 0
+	`, conversationID(userID, otherUserID))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// AcceptAllFriendRequests accepts every pending friend request sent to a
+// user, stores the friendship in the other direction too, and returns the
+// requests it accepted
+func (s *SQLiteStorage) AcceptAllFriendRequests(ctx context.Context, userID int64) ([]*Friend, error) {
+	defer s.observe("AcceptAllFriendRequests", time.Now())
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	accepted, err := updatePendingRequests(ctx, tx, `
+		UPDATE friends SET status = 'accepted', accepted_at = ?
+		WHERE friend_id = ? AND status = 'pending'
+		RETURNING `+friendColumns, now, userID)
+	if err != nil || len(accepted) == 0 {
+		return accepted, err
+	}
+
+	// Both directions hold the contact's details. Requests we had sent them
+	// ourselves are accepted rather than duplicated.
+	placeholders := make([]string, len(accepted))
+	args := []interface{}{now}
+	for i, request := range accepted {
+		placeholders[i] = "?"
+		args = append(args, request.ID)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO friends (user_id, friend_id, peer_id, username, full_name, status_message, status, accepted_at)
+		SELECT friend_id, user_id, peer_id, username, full_name, status_message, 'accepted', ?
+		FROM friends
+		WHERE id IN (`+strings.Join(placeholders, ", ")+`)
+		ON CONFLICT(user_id, friend_id) DO UPDATE SET status = 'accepted', accepted_at = excluded.accepted_at
+	`, args...); err != nil {
+		return nil, err
+	}
+	return accepted, tx.Commit()
+}
+
+// RejectAllFriendRequests rejects every pending friend request sent to a
+// user and returns the requests it rejected
+func (s *SQLiteStorage) RejectAllFriendRequests(ctx context.Context, userID int64) ([]*Friend, error) {
+	defer s.observe("RejectAllFriendRequests", time.Now())
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rejected, err := updatePendingRequests(ctx, tx, `
+		UPDATE friends SET status = 'rejected', rejected_at = CURRENT_TIMESTAMP
+		WHERE friend_id = ? AND status = 'pending'
+		RETURNING `+friendColumns, userID)
+	if err != nil {
+		return nil, err
+	}
+	return rejected, tx.Commit()
+}
+
+// updatePendingRequests runs an UPDATE ... RETURNING friendColumns and reads
+// the changed requests
+func updatePendingRequests(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) ([]*Friend, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []*Friend{}
+	for rows.Next() {
+		request, err := scanFriendRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+	return requests, rows.Err()
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// CatchUpSummary counts what is waiting for a user, for the summary shown
+// when they log in
+type CatchUpSummary struct {
+	UnreadMessages  int                 `json:"unread_messages"`
+	UnreadFrom      int                 `json:"unread_from"` // Friends the unread messages came from
+	PendingRequests int                 `json:"pending_requests"`
+	Conferences     []*ConferenceUnread `json:"conferences"` // Conferences with unread messages, most first
+	UnseenActivity  int                 `json:"unseen_activity"`
+}
+
+// ConferenceUnread is how many messages in a conference a user hasn't read
+type ConferenceUnread struct {
+	ConferenceID int64  `json:"conference_id"`
+	Name         string `json:"name"`
+	Unread       int    `json:"unread"`
+}
+
+// Empty reports whether nothing is waiting
+func (s *CatchUpSummary) Empty() bool {
+	return s.UnreadMessages == 0 && s.PendingRequests == 0 && len(s.Conferences) == 0 && s.UnseenActivity == 0
+}
+
+// GetCatchUpSummary counts a user's unread direct messages and who sent them,
+// friend requests waiting for an answer, unread messages in each of their
+// conferences and activity entries they haven't seen. Conference messages
+// count as unread until MarkConferenceRead moves past them; the user's own
+// messages and system messages never do.
+func (s *SQLiteStorage) GetCatchUpSummary(ctx context.Context, userID int64) (*CatchUpSummary, error) {
+	defer s.observe("GetCatchUpSummary", time.Now())
+	summary := &CatchUpSummary{Conferences: []*ConferenceUnread{}}
+
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COUNT(DISTINCT from_user_id)
+		FROM messages
+		WHERE to_user_id = ? AND read = 0 AND kind = 'user' AND hidden = 0
+	`, userID).Scan(&summary.UnreadMessages, &summary.UnreadFrom)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.QueryRowContext(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM friends WHERE friend_id = ?1 AND status = 'pending'),
+			(SELECT COUNT(*) FROM activity WHERE user_id = ?1 AND seen = 0)
+	`, userID).Scan(&summary.PendingRequests, &summary.UnseenActivity)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT c.id, c.name, COUNT(m.id) AS unread
+		FROM conferences c
+		JOIN conference_messages m ON m.conference_id = c.id
+		LEFT JOIN conference_reads r ON r.conference_id = c.id AND r.user_id = ?1
+		WHERE c.id IN (SELECT conference_id FROM conference_participants WHERE user_id = ?1 AND active = 1)
+			AND m.id > COALESCE(r.last_read_id, 0)
+			AND m.kind = 'user' AND m.hidden = 0
+			AND m.from_user_id != ?1
+			AND m.from_peer_id != (SELECT peer_id FROM users WHERE id = ?1)
+		GROUP BY c.id
+		ORDER BY unread DESC, c.name
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		conf := &ConferenceUnread{}
+		if err := rows.Scan(&conf.ConferenceID, &conf.Name, &conf.Unread); err != nil {
+			return nil, err
+		}
+		summary.Conferences = append(summary.Conferences, conf)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// MarkConferenceRead marks every message stored for a conference so far as
+// read by a user
+func (s *SQLiteStorage) MarkConferenceRead(ctx context.Context, userID, conferenceID int64) error {
+	defer s.observe("MarkConferenceRead", time.Now())
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO conference_reads (user_id, conference_id, last_read_id)
+		VALUES (?1, ?2, (SELECT COALESCE(MAX(id), 0) FROM conference_messages WHERE conference_id = ?2))
+		ON CONFLICT(user_id, conference_id) DO UPDATE SET last_read_id = excluded.last_read_id
+	`, userID, conferenceID)
+	return err
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// GetConferenceMessagesBefore returns a conference's visible messages in
+// every channel sent before a time, oldest first: the history compaction may
+// replace with summaries
+func (s *SQLiteStorage) GetConferenceMessagesBefore(ctx context.Context, conferenceID int64, before time.Time, limit int) ([]*ConferenceMessage, error) {
+	defer s.observe("GetConferenceMessagesBefore", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, conference_id, channel, from_user_id, from_peer_id, content, kind, lamport, created_at
+		FROM conference_messages
+		WHERE conference_id = ? AND hidden = 0 AND datetime(created_at) < datetime(?)
+		ORDER BY lamport ASC, created_at ASC
+		LIMIT ?
+	`, conferenceID, before.UTC().Format("2006-01-02 15:04:05"), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*ConferenceMessage{}
+	for rows.Next() {
+		msg := &ConferenceMessage{}
+		if err := rows.Scan(&msg.ID, &msg.ConferenceID, &msg.Channel, &msg.FromUserID, &msg.FromPeerID, &msg.Content, &msg.Kind, &msg.Lamport, &msg.CreatedAt); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// ReplaceConferenceMessages deletes the messages in the summary's channel
+// whose logical clock falls in its range, hidden ones included, and stores the
+// summary in their place, in one transaction. Messages is set to how many
+// were deleted.
+func (s *SQLiteStorage) ReplaceConferenceMessages(ctx context.Context, summary *ConferenceSummary) error {
+	defer s.observe("ReplaceConferenceMessages", time.Now())
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		DELETE FROM conference_messages
+		WHERE conference_id = ? AND channel = ? AND lamport BETWEEN ? AND ?
+	`, summary.ConferenceID, summary.Channel, summary.FromLamport, summary.ToLamport)
+	if err != nil {
+		return err
+	}
+	deleted, _ := result.RowsAffected()
+	summary.Messages = int(deleted)
+	if summary.CreatedAt.IsZero() {
+		summary.CreatedAt = time.Now()
+	}
+
+	result, err = tx.ExecContext(ctx, `
+		INSERT INTO conference_summaries (conference_id, channel, from_lamport, to_lamport, started_at, ended_at, messages, policy, content, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, summary.ConferenceID, summary.Channel, summary.FromLamport, summary.ToLamport, summary.StartedAt, summary.EndedAt, summary.Messages, summary.Policy, summary.Content, summary.CreatedAt)
+	if err != nil {
+		return err
+	}
+	summary.ID, _ = result.LastInsertId()
+	return tx.Commit()
+}
+
+// GetConferenceSummaries returns the summaries standing in for a conference's
+// compacted history, in every channel, oldest first
+func (s *SQLiteStorage) GetConferenceSummaries(ctx context.Context, conferenceID int64) ([]*ConferenceSummary, error) {
+	defer s.observe("GetConferenceSummaries", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, conference_id, channel, from_lamport, to_lamport, started_at, ended_at, messages, policy, content, created_at
+		FROM conference_summaries
+		WHERE conference_id = ?
+		ORDER BY from_lamport ASC, id ASC
+	`, conferenceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := []*ConferenceSummary{}
+	for rows.Next() {
+		summary := &ConferenceSummary{}
+		if err := rows.Scan(&summary.ID, &summary.ConferenceID, &summary.Channel, &summary.FromLamport, &summary.ToLamport, &summary.StartedAt, &summary.EndedAt, &summary.Messages, &summary.Policy, &summary.Content, &summary.CreatedAt); err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
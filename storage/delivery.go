@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// maxDeliveryAttempts is how many failed tries are kept per message; older
+// ones are dropped as new ones are recorded
+const maxDeliveryAttempts = 20
+
+// RecordDeliveryAttempt stores why a try at delivering a message failed
+func (s *SQLiteStorage) RecordDeliveryAttempt(ctx context.Context, attempt *DeliveryAttempt) error {
+	defer s.observe("RecordDeliveryAttempt", time.Now())
+	if attempt.AttemptedAt.IsZero() {
+		attempt.AttemptedAt = time.Now()
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO delivery_attempts (message_id, reason, detail, attempted_at)
+		VALUES (?, ?, ?, ?)
+	`, attempt.MessageID, attempt.Reason, attempt.Detail, attempt.AttemptedAt)
+	if err != nil {
+		return err
+	}
+	if attempt.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM delivery_attempts WHERE message_id = ? AND id NOT IN (
+			SELECT id FROM delivery_attempts WHERE message_id = ? ORDER BY id DESC LIMIT ?
+		)
+	`, attempt.MessageID, attempt.MessageID, maxDeliveryAttempts); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetDeliveryAttempts returns the failed tries at delivering a message that
+// are still kept, oldest first
+func (s *SQLiteStorage) GetDeliveryAttempts(ctx context.Context, messageID int64) ([]*DeliveryAttempt, error) {
+	defer s.observe("GetDeliveryAttempts", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, message_id, reason, detail, attempted_at
+		FROM delivery_attempts
+		WHERE message_id = ?
+		ORDER BY id
+	`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []*DeliveryAttempt{}
+	for rows.Next() {
+		attempt := &DeliveryAttempt{}
+		if err := rows.Scan(&attempt.ID, &attempt.MessageID, &attempt.Reason, &attempt.Detail, &attempt.AttemptedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, attempt)
+	}
+	return attempts, rows.Err()
+}
@@ -0,0 +1,393 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// CreateGroup stores a group and its members. Each member's copy of a group
+// shares its UID, so creating one the user already has fails.
+func (s *SQLiteStorage) CreateGroup(ctx context.Context, group *Group) error {
+	defer s.observe("CreateGroup", time.Now())
+	if group.CreatedAt.IsZero() {
+		group.CreatedAt = time.Now()
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO group_chats (user_id, uid, name, created_at)
+		VALUES (?, ?, ?, ?)
+	`, group.UserID, group.UID, group.Name, group.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if group.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+	if err := insertGroupMembers(ctx, tx, group.ID, group.Members); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertGroupMembers adds members to a group inside a transaction
+func insertGroupMembers(ctx context.Context, tx *sql.Tx, groupID int64, members []*GroupMember) error {
+	for _, member := range members {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT OR REPLACE INTO group_members (group_id, peer_id, username)
+			VALUES (?, ?, ?)
+		`, groupID, member.PeerID, member.Username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetGroup returns one of the user's groups with its members, or ErrNotFound
+func (s *SQLiteStorage) GetGroup(ctx context.Context, userID, groupID int64) (*Group, error) {
+	defer s.observe("GetGroup", time.Now())
+	return s.getGroup(ctx, `WHERE user_id = ? AND id = ?`, userID, groupID)
+}
+
+// GetGroupByUID returns the user's copy of the group with a shared UID, or
+// ErrNotFound
+func (s *SQLiteStorage) GetGroupByUID(ctx context.Context, userID int64, uid string) (*Group, error) {
+	defer s.observe("GetGroupByUID", time.Now())
+	return s.getGroup(ctx, `WHERE user_id = ? AND uid = ?`, userID, uid)
+}
+
+// getGroup loads the single group matching a WHERE clause
+func (s *SQLiteStorage) getGroup(ctx context.Context, where string, args ...interface{}) (*Group, error) {
+	group := &Group{}
+	var leftAt sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, user_id, uid, name, left_at, created_at
+		FROM group_chats `+where, args...).Scan(&group.ID, &group.UserID, &group.UID, &group.Name, &leftAt, &group.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if leftAt.Valid {
+		group.LeftAt = leftAt.Time
+	}
+	if group.Members, err = s.getGroupMembers(ctx, group.ID); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// getGroupMembers returns everyone else in a group, by username
+func (s *SQLiteStorage) getGroupMembers(ctx context.Context, groupID int64) ([]*GroupMember, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT peer_id, username FROM group_members
+		WHERE group_id = ?
+		ORDER BY username, peer_id
+	`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*GroupMember{}
+	for rows.Next() {
+		member := &GroupMember{}
+		if err := rows.Scan(&member.PeerID, &member.Username); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// GetGroups returns the user's groups with their members, including ones they
+// left, most recently active first
+func (s *SQLiteStorage) GetGroups(ctx context.Context, userID int64) ([]*Group, error) {
+	defer s.observe("GetGroups", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT g.id, g.user_id, g.uid, g.name, g.left_at, g.created_at
+		FROM group_chats g
+		WHERE g.user_id = ?
+		ORDER BY COALESCE((SELECT MAX(created_at) FROM group_messages WHERE group_id = g.id), g.created_at) DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []*Group{}
+	for rows.Next() {
+		group := &Group{}
+		var leftAt sql.NullTime
+		if err := rows.Scan(&group.ID, &group.UserID, &group.UID, &group.Name, &leftAt, &group.CreatedAt); err != nil {
+			return nil, err
+		}
+		if leftAt.Valid {
+			group.LeftAt = leftAt.Time
+		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, group := range groups {
+		if group.Members, err = s.getGroupMembers(ctx, group.ID); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+// SetGroupMembers replaces the members of a group
+func (s *SQLiteStorage) SetGroupMembers(ctx context.Context, groupID int64, members []*GroupMember) error {
+	defer s.observe("SetGroupMembers", time.Now())
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM group_members WHERE group_id = ?`, groupID); err != nil {
+		return err
+	}
+	if err := insertGroupMembers(ctx, tx, groupID, members); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LeaveGroup marks a group as left. Its history is kept, but undelivered
+// messages to it other than the leaving announcement are no longer retried.
+func (s *SQLiteStorage) LeaveGroup(ctx context.Context, groupID int64) error {
+	defer s.observe("LeaveGroup", time.Now())
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE group_chats SET left_at = ? WHERE id = ? AND left_at IS NULL
+	`, time.Now(), groupID)
+	return err
+}
+
+// SaveGroupMessage stores a group message. For one the user sends, recipients
+// are the members it goes to, each of whose delivery is then tracked.
+func (s *SQLiteStorage) SaveGroupMessage(ctx context.Context, message *GroupMessage, recipients []*GroupMember) error {
+	defer s.observe("SaveGroupMessage", time.Now())
+	if err := s.checkQuota(QuotaMessages); err != nil {
+		return err
+	}
+	if message.CreatedAt.IsZero() {
+		message.CreatedAt = time.Now()
+	}
+	if message.ReceivedAt.IsZero() {
+		message.ReceivedAt = message.CreatedAt
+	}
+	message.Kind = NormalizeKind(message.Kind)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO group_messages (group_id, from_peer_id, from_username, remote_id, outgoing, content, kind, leaving, created_at, received_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, message.GroupID, message.FromPeerID, message.FromUsername, message.RemoteID, message.Outgoing, message.Content, message.Kind, message.Leaving, message.CreatedAt, message.ReceivedAt)
+	if err != nil {
+		return err
+	}
+	if message.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+
+	for _, member := range recipients {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO group_deliveries (message_id, peer_id, username)
+			VALUES (?, ?, ?)
+		`, message.ID, member.PeerID, member.Username); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// HasGroupMessage reports whether a member's message, by the ID they gave it,
+// is already stored
+func (s *SQLiteStorage) HasGroupMessage(ctx context.Context, groupID int64, fromPeerID string, remoteID int64) (bool, error) {
+	defer s.observe("HasGroupMessage", time.Now())
+	var exists bool
+	err := s.db.QueryRowContext(ctx, `
+		SELECT EXISTS(
+			SELECT 1 FROM group_messages
+			WHERE group_id = ? AND from_peer_id = ? AND remote_id = ? AND outgoing = 0
+		)
+	`, groupID, fromPeerID, remoteID).Scan(&exists)
+	return exists, err
+}
+
+// groupMessageColumns are the columns scanGroupMessage reads
+const groupMessageColumns = `m.id, m.group_id, m.from_peer_id, m.from_username, m.remote_id, m.outgoing, m.content, m.kind, m.leaving, m.created_at, m.received_at`
+
+// scanGroupMessage scans groupMessageColumns from the current row
+func scanGroupMessage(scan func(dest ...interface{}) error) (*GroupMessage, error) {
+	msg := &GroupMessage{}
+	err := scan(&msg.ID, &msg.GroupID, &msg.FromPeerID, &msg.FromUsername, &msg.RemoteID, &msg.Outgoing, &msg.Content, &msg.Kind, &msg.Leaving, &msg.CreatedAt, &msg.ReceivedAt)
+	return msg, err
+}
+
+// GetGroupMessages returns the latest messages in a group, oldest first
+func (s *SQLiteStorage) GetGroupMessages(ctx context.Context, groupID int64, limit int) ([]*GroupMessage, error) {
+	defer s.observe("GetGroupMessages", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+groupMessageColumns+`
+		FROM group_messages m
+		WHERE m.group_id = ?
+		ORDER BY m.created_at DESC, m.id DESC
+		LIMIT ?
+	`, groupID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*GroupMessage{}
+	for rows.Next() {
+		msg, err := scanGroupMessage(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Oldest first, for display
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// GetGroupMessage returns a message in one of the user's groups, or
+// ErrMessageNotFound
+func (s *SQLiteStorage) GetGroupMessage(ctx context.Context, userID, messageID int64) (*GroupMessage, error) {
+	defer s.observe("GetGroupMessage", time.Now())
+	msg, err := scanGroupMessage(s.db.QueryRowContext(ctx, `
+		SELECT `+groupMessageColumns+`
+		FROM group_messages m
+		JOIN group_chats g ON g.id = m.group_id
+		WHERE m.id = ? AND g.user_id = ?
+	`, messageID, userID).Scan)
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// groupDeliveryColumns are the columns scanGroupDelivery reads
+const groupDeliveryColumns = `d.message_id, m.group_id, d.peer_id, d.username, d.delivered, d.delivered_at, d.attempts, d.reason, d.attempted_at`
+
+// scanGroupDelivery scans groupDeliveryColumns from the current row
+func scanGroupDelivery(rows *sql.Rows) (*GroupDelivery, error) {
+	delivery := &GroupDelivery{}
+	var deliveredAt, attemptedAt sql.NullTime
+	if err := rows.Scan(&delivery.MessageID, &delivery.GroupID, &delivery.PeerID, &delivery.Username, &delivery.Delivered, &deliveredAt, &delivery.Attempts, &delivery.Reason, &attemptedAt); err != nil {
+		return nil, err
+	}
+	if deliveredAt.Valid {
+		delivery.DeliveredAt = deliveredAt.Time
+	}
+	if attemptedAt.Valid {
+		delivery.AttemptedAt = attemptedAt.Time
+	}
+	return delivery, nil
+}
+
+// GetGroupDeliveries returns how far a group message the user sent got with
+// each member
+func (s *SQLiteStorage) GetGroupDeliveries(ctx context.Context, messageID int64) ([]*GroupDelivery, error) {
+	defer s.observe("GetGroupDeliveries", time.Now())
+	return s.queryGroupDeliveries(ctx, `
+		SELECT `+groupDeliveryColumns+`
+		FROM group_deliveries d
+		JOIN group_messages m ON m.id = d.message_id
+		WHERE d.message_id = ?
+		ORDER BY d.username, d.peer_id
+	`, messageID)
+}
+
+// GetPendingGroupDeliveries returns the undelivered copies of the user's group
+// messages, oldest first. Once the user leaves a group only the message
+// announcing it is still pending.
+func (s *SQLiteStorage) GetPendingGroupDeliveries(ctx context.Context, userID int64) ([]*GroupDelivery, error) {
+	defer s.observe("GetPendingGroupDeliveries", time.Now())
+	return s.queryGroupDeliveries(ctx, `
+		SELECT `+groupDeliveryColumns+`
+		FROM group_deliveries d
+		JOIN group_messages m ON m.id = d.message_id
+		JOIN group_chats g ON g.id = m.group_id
+		WHERE d.delivered = 0 AND g.user_id = ? AND (g.left_at IS NULL OR m.leaving = 1)
+		ORDER BY m.created_at, m.id
+	`, userID)
+}
+
+// queryGroupDeliveries runs a query selecting groupDeliveryColumns
+func (s *SQLiteStorage) queryGroupDeliveries(ctx context.Context, query string, args ...interface{}) ([]*GroupDelivery, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*GroupDelivery{}
+	for rows.Next() {
+		delivery, err := scanGroupDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// MarkGroupDelivered records that a member acknowledged a group message the
+// user sent. It reports false if the message wasn't one the member was
+// waiting for.
+func (s *SQLiteStorage) MarkGroupDelivered(ctx context.Context, userID, messageID int64, peerID string) (bool, error) {
+	defer s.observe("MarkGroupDelivered", time.Now())
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE group_deliveries SET delivered = 1, delivered_at = ?
+		WHERE message_id = ? AND peer_id = ? AND delivered = 0
+		AND message_id IN (
+			SELECT m.id FROM group_messages m JOIN group_chats g ON g.id = m.group_id
+			WHERE g.user_id = ? AND m.outgoing = 1
+		)
+	`, time.Now(), messageID, peerID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// RecordGroupDeliveryFailure stores why a try at delivering a group message to
+// one member failed
+func (s *SQLiteStorage) RecordGroupDeliveryFailure(ctx context.Context, messageID int64, peerID, reason string) error {
+	defer s.observe("RecordGroupDeliveryFailure", time.Now())
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE group_deliveries SET attempts = attempts + 1, reason = ?, attempted_at = ?
+		WHERE message_id = ? AND peer_id = ? AND delivered = 0
+	`, reason, time.Now(), messageID, peerID)
+	return err
+}
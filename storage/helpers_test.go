@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"context"
+	"testing"
+)
+
+// newTestStorage opens an in-memory database closed when the test ends
+func newTestStorage(t testing.TB) *SQLiteStorage {
+	t.Helper()
+	s, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// createTestUser adds a remote contact with the given username
+func createTestUser(t testing.TB, s *SQLiteStorage, username string) *User {
+	t.Helper()
+	user := &User{Username: username, PasswordHash: RemoteUserPasswordHash, PeerID: "peer-" + username}
+	if err := s.CreateUser(context.Background(), user); err != nil {
+		t.Fatalf("failed to create %s: %v", username, err)
+	}
+	return user
+}
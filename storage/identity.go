@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// maxQuarantinedMessages is how many messages are held per contact from an
+// unverified identity; older ones are dropped as new ones arrive
+const maxQuarantinedMessages = 200
+
+// SetIdentityCandidate records peerID as claiming to be the contact. It
+// reports whether that is news: a first claim, or a different peer than the
+// last one, whose held messages are then dropped.
+func (s *SQLiteStorage) SetIdentityCandidate(ctx context.Context, contactID int64, peerID string) (bool, error) {
+	defer s.observe("SetIdentityCandidate", time.Now())
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRowContext(ctx, `SELECT peer_id FROM identity_candidates WHERE contact_id = ?`, contactID).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if current == peerID {
+		return false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM quarantined_messages WHERE contact_id = ?`, contactID); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO identity_candidates (contact_id, peer_id, first_seen_at) VALUES (?, ?, ?)
+		ON CONFLICT(contact_id) DO UPDATE SET peer_id = excluded.peer_id, first_seen_at = excluded.first_seen_at
+	`, contactID, peerID, time.Now()); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// GetIdentityCandidate returns the peer claiming to be the contact, or nil if
+// there is none
+func (s *SQLiteStorage) GetIdentityCandidate(ctx context.Context, contactID int64) (*IdentityCandidate, error) {
+	defer s.observe("GetIdentityCandidate", time.Now())
+	candidate := &IdentityCandidate{}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT c.contact_id, c.peer_id, c.first_seen_at,
+			(SELECT COUNT(*) FROM quarantined_messages q WHERE q.contact_id = c.contact_id)
+		FROM identity_candidates c
+		WHERE c.contact_id = ?
+	`, contactID).Scan(&candidate.ContactID, &candidate.PeerID, &candidate.FirstSeenAt, &candidate.Held)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return candidate, nil
+}
+
+// ClearIdentityCandidate forgets the peer claiming to be the contact once it
+// is trusted. Messages held from it stay until taken.
+func (s *SQLiteStorage) ClearIdentityCandidate(ctx context.Context, contactID int64) error {
+	defer s.observe("ClearIdentityCandidate", time.Now())
+	_, err := s.db.ExecContext(ctx, `DELETE FROM identity_candidates WHERE contact_id = ?`, contactID)
+	return err
+}
+
+// QuarantineMessage holds a message from an identity candidate
+func (s *SQLiteStorage) QuarantineMessage(ctx context.Context, msg *QuarantinedMessage) error {
+	defer s.observe("QuarantineMessage", time.Now())
+	if msg.ReceivedAt.IsZero() {
+		msg.ReceivedAt = time.Now()
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO quarantined_messages (contact_id, peer_id, payload, received_at)
+		VALUES (?, ?, ?, ?)
+	`, msg.ContactID, msg.PeerID, msg.Payload, msg.ReceivedAt)
+	if err != nil {
+		return err
+	}
+	if msg.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM quarantined_messages WHERE contact_id = ? AND id NOT IN (
+			SELECT id FROM quarantined_messages WHERE contact_id = ? ORDER BY id DESC LIMIT ?
+		)
+	`, msg.ContactID, msg.ContactID, maxQuarantinedMessages); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// TakeQuarantinedMessages removes and returns, oldest first, the messages
+// held from peerID while it claimed to be the contact
+func (s *SQLiteStorage) TakeQuarantinedMessages(ctx context.Context, contactID int64, peerID string) ([]*QuarantinedMessage, error) {
+	defer s.observe("TakeQuarantinedMessages", time.Now())
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, contact_id, peer_id, payload, received_at
+		FROM quarantined_messages
+		WHERE contact_id = ? AND peer_id = ?
+		ORDER BY id
+	`, contactID, peerID)
+	if err != nil {
+		return nil, err
+	}
+	held := []*QuarantinedMessage{}
+	for rows.Next() {
+		msg := &QuarantinedMessage{}
+		if err := rows.Scan(&msg.ID, &msg.ContactID, &msg.PeerID, &msg.Payload, &msg.ReceivedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		held = append(held, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM quarantined_messages WHERE contact_id = ? AND peer_id = ?`, contactID, peerID); err != nil {
+		return nil, err
+	}
+	return held, tx.Commit()
+}
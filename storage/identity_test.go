@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"testing"
+)
+
+func TestIdentityCandidateQuarantine(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(t)
+	alice := createTestUser(t, s, "alice")
+
+	if candidate, err := s.GetIdentityCandidate(ctx, alice.ID); err != nil || candidate != nil {
+		t.Fatalf("GetIdentityCandidate = %v, %v; want none", candidate, err)
+	}
+
+	isNew, err := s.SetIdentityCandidate(ctx, alice.ID, "impostor")
+	if err != nil || !isNew {
+		t.Fatalf("SetIdentityCandidate = %v, %v; want a new candidate", isNew, err)
+	}
+	if isNew, _ := s.SetIdentityCandidate(ctx, alice.ID, "impostor"); isNew {
+		t.Error("the same peer again counted as a new candidate")
+	}
+	for _, payload := range []string{"one", "two"} {
+		if err := s.QuarantineMessage(ctx, &QuarantinedMessage{ContactID: alice.ID, PeerID: "impostor", Payload: []byte(payload)}); err != nil {
+			t.Fatalf("QuarantineMessage: %v", err)
+		}
+	}
+	if candidate, _ := s.GetIdentityCandidate(ctx, alice.ID); candidate == nil || candidate.PeerID != "impostor" || candidate.Held != 2 {
+		t.Fatalf("GetIdentityCandidate = %+v, want impostor holding 2", candidate)
+	}
+
+	// A different peer replaces the candidate and drops what the last one sent
+	if isNew, _ := s.SetIdentityCandidate(ctx, alice.ID, "reinstall"); !isNew {
+		t.Fatal("a different peer did not count as a new candidate")
+	}
+	if err := s.QuarantineMessage(ctx, &QuarantinedMessage{ContactID: alice.ID, PeerID: "reinstall", Payload: []byte("three")}); err != nil {
+		t.Fatalf("QuarantineMessage: %v", err)
+	}
+	if held, _ := s.TakeQuarantinedMessages(ctx, alice.ID, "impostor"); len(held) != 0 {
+		t.Errorf("kept %d messages from the replaced candidate", len(held))
+	}
+
+	if err := s.ClearIdentityCandidate(ctx, alice.ID); err != nil {
+		t.Fatalf("ClearIdentityCandidate: %v", err)
+	}
+	held, err := s.TakeQuarantinedMessages(ctx, alice.ID, "reinstall")
+	if err != nil || len(held) != 1 || string(held[0].Payload) != "three" {
+		t.Fatalf("TakeQuarantinedMessages = %v, %v; want the one message", held, err)
+	}
+	if held, _ := s.TakeQuarantinedMessages(ctx, alice.ID, "reinstall"); len(held) != 0 {
+		t.Errorf("messages were still held after being taken")
+	}
+}
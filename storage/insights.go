@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+)
+
+// maxResponseGap is the longest wait that still counts as a response; a
+// message after a longer silence starts a new exchange instead
+const maxResponseGap = 12 * time.Hour
+
+// ConversationStats summarizes the chat messages of a direct conversation or
+// a conference; system messages are left out
+type ConversationStats struct {
+	Messages    int           `json:"messages"`
+	First       time.Time     `json:"first,omitempty"`
+	Last        time.Time     `json:"last,omitempty"`
+	PerDay      []DayCount    `json:"per_day"`      // Oldest first; days without messages are left out
+	ByHour      [24]int       `json:"by_hour"`      // Messages per hour of the day, local time
+	Responses   int           `json:"responses"`    // Times the sender changed within maxResponseGap
+	AvgResponse time.Duration `json:"avg_response"` // Mean time those responses took; 0 without any
+	Posters     []PosterCount `json:"posters"`      // Most messages first
+}
+
+// DayCount is how many messages were sent on one local day
+type DayCount struct {
+	Day      string `json:"day"` // 2006-01-02
+	Messages int    `json:"messages"`
+}
+
+// PosterCount is how many messages one participant sent
+type PosterCount struct {
+	PeerID   string `json:"peer_id"`
+	Username string `json:"username,omitempty"` // Empty for senders never seen
+	Messages int    `json:"messages"`
+}
+
+// BusiestHours returns the hours of the day with messages, busiest first
+func (s *ConversationStats) BusiestHours() []int {
+	hours := []int{}
+	for hour, count := range s.ByHour {
+		if count > 0 {
+			hours = append(hours, hour)
+		}
+	}
+	sort.SliceStable(hours, func(i, j int) bool { return s.ByHour[hours[i]] > s.ByHour[hours[j]] })
+	return hours
+}
+
+// statsMessage is the part of a message the statistics need
+type statsMessage struct {
+	fromPeerID string
+	username   string
+	at         time.Time
+}
+
+// GetConversationStats summarizes a direct conversation's messages sent at or
+// after since (zero for all of them), hidden ones included
+func (s *SQLiteStorage) GetConversationStats(ctx context.Context, userID, otherUserID int64, since time.Time) (*ConversationStats, error) {
+	defer s.observe("GetConversationStats", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT m.from_peer_id, COALESCE(u.username, ''), m.created_at
+		FROM messages m
+		LEFT JOIN users u ON u.id = m.from_user_id
+		WHERE m.conversation_id = ? AND m.kind != ?
+	`, conversationID(userID, otherUserID), MessageKindSystem)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := scanStatsMessages(rows, since)
+	if err != nil {
+		return nil, err
+	}
+	return buildStats(messages), nil
+}
+
+// GetConferenceStats summarizes a conference's messages in every channel sent
+// at or after since (zero for all of them), naming senders as transcripts do
+func (s *SQLiteStorage) GetConferenceStats(ctx context.Context, conferenceID int64, since time.Time) (*ConversationStats, error) {
+	defer s.observe("GetConferenceStats", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT m.from_peer_id,
+			COALESCE(byid.username, bypeer.username, (
+				SELECT username FROM conference_membership
+				WHERE conference_id = m.conference_id AND peer_id = m.from_peer_id
+				ORDER BY id DESC LIMIT 1
+			), ''),
+			m.created_at
+		FROM conference_messages m
+		LEFT JOIN users byid ON m.from_user_id != 0 AND byid.id = m.from_user_id
+		LEFT JOIN users bypeer ON bypeer.peer_id = m.from_peer_id
+		WHERE m.conference_id = ? AND m.kind != ?
+	`, conferenceID, MessageKindSystem)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := scanStatsMessages(rows, since)
+	if err != nil {
+		return nil, err
+	}
+	return buildStats(messages), nil
+}
+
+// scanStatsMessages reads the sender, name and time of each row sent at or
+// after since, oldest first, and closes rows. Stored times can mix zones, so
+// they are put in order here rather than by the query.
+func scanStatsMessages(rows *sql.Rows, since time.Time) ([]*statsMessage, error) {
+	defer rows.Close()
+
+	messages := []*statsMessage{}
+	for rows.Next() {
+		msg := &statsMessage{}
+		if err := rows.Scan(&msg.fromPeerID, &msg.username, &msg.at); err != nil {
+			return nil, err
+		}
+		if !msg.at.Before(since) {
+			messages = append(messages, msg)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].at.Before(messages[j].at) })
+	return messages, nil
+}
+
+// buildStats computes the statistics of messages in time order
+func buildStats(messages []*statsMessage) *ConversationStats {
+	stats := &ConversationStats{PerDay: []DayCount{}, Posters: []PosterCount{}}
+	posters := make(map[string]int) // Peer ID -> index in stats.Posters
+	var responseTotal time.Duration
+	for i, msg := range messages {
+		local := msg.at.Local()
+		stats.Messages++
+		stats.ByHour[local.Hour()]++
+
+		day := local.Format("2006-01-02")
+		if n := len(stats.PerDay); n > 0 && stats.PerDay[n-1].Day == day {
+			stats.PerDay[n-1].Messages++
+		} else {
+			stats.PerDay = append(stats.PerDay, DayCount{Day: day, Messages: 1})
+		}
+
+		idx, ok := posters[msg.fromPeerID]
+		if !ok {
+			idx = len(stats.Posters)
+			posters[msg.fromPeerID] = idx
+			stats.Posters = append(stats.Posters, PosterCount{PeerID: msg.fromPeerID, Username: msg.username})
+		}
+		stats.Posters[idx].Messages++
+
+		if i > 0 && messages[i-1].fromPeerID != msg.fromPeerID {
+			if gap := msg.at.Sub(messages[i-1].at); gap <= maxResponseGap {
+				stats.Responses++
+				responseTotal += gap
+			}
+		}
+	}
+
+	if len(messages) > 0 {
+		stats.First = messages[0].at
+		stats.Last = messages[len(messages)-1].at
+	}
+	if stats.Responses > 0 {
+		stats.AvgResponse = responseTotal / time.Duration(stats.Responses)
+	}
+	sort.SliceStable(stats.Posters, func(i, j int) bool { return stats.Posters[i].Messages > stats.Posters[j].Messages })
+	return stats
+}
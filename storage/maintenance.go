@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// schemaVersion is stored in PRAGMA user_version once migrations have run.
+// Bump it whenever migrate() gains a column or index so existing databases
+// are backed up before being upgraded.
+const schemaVersion = 21
+
+// maxMigrationBackups is how many pre-migration backups are kept
+const maxMigrationBackups = 5
+
+// ErrDatabaseCorrupt is returned when the startup integrity check fails
+var ErrDatabaseCorrupt = errors.New("database failed integrity check")
+
+// checkIntegrity runs PRAGMA integrity_check and reports any problems found
+func (s *SQLiteStorage) checkIntegrity() error {
+	rows, err := s.db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return fmt.Errorf("failed to run integrity check: %w", err)
+	}
+	defer rows.Close()
+
+	problems := []string{}
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return fmt.Errorf("failed to read integrity check: %w", err)
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read integrity check: %w", err)
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	if len(problems) > 3 {
+		problems = append(problems[:3], fmt.Sprintf("... and %d more", len(problems)-3))
+	}
+	return fmt.Errorf("%w: %s\n"+
+		"To recover, stop whisper and either:\n"+
+		"  - restore a backup from %s over %s, or\n"+
+		"  - run: sqlite3 %s \".recover\" | sqlite3 recovered.db  and move recovered.db into place\n"+
+		"Keep a copy of the damaged file until you have confirmed your history is intact",
+		ErrDatabaseCorrupt, strings.Join(problems, "; "), s.backupDir(), s.path, s.path)
+}
+
+// schemaUserVersion returns the schema version recorded in the database
+func (s *SQLiteStorage) schemaUserVersion() (int, error) {
+	var version int
+	err := s.db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+// setSchemaUserVersion records that the database is at the current schema version
+func (s *SQLiteStorage) setSchemaUserVersion() error {
+	_, err := s.db.Exec(fmt.Sprintf("PRAGMA user_version = %d", schemaVersion))
+	return err
+}
+
+// backupBeforeMigration snapshots an existing database that is about to be
+// upgraded, keeping the most recent maxMigrationBackups copies
+func (s *SQLiteStorage) backupBeforeMigration(existed bool) error {
+	if !existed || s.IsEphemeral() {
+		return nil
+	}
+
+	version, err := s.schemaUserVersion()
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version >= schemaVersion {
+		return nil
+	}
+
+	dir := s.backupDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	name := fmt.Sprintf("premigrate-v%d-%s.db", version, time.Now().Format("20060102-150405"))
+	dest := filepath.Join(dir, name)
+	// VACUUM INTO writes a consistent copy even while the WAL holds uncheckpointed pages
+	if _, err := s.db.Exec("VACUUM INTO ?", dest); err != nil {
+		return fmt.Errorf("failed to back up database: %w", err)
+	}
+	os.Chmod(dest, 0600)
+
+	return rotateBackups(dir, "premigrate-", maxMigrationBackups)
+}
+
+// backupDir is where automatic backups of this database are written
+func (s *SQLiteStorage) backupDir() string {
+	return filepath.Join(filepath.Dir(s.path), "backups")
+}
+
+// rotateBackups deletes the oldest backups with the given prefix, keeping the newest keep files
+func rotateBackups(dir, prefix string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	backups := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), prefix) {
+			backups = append(backups, entry.Name())
+		}
+	}
+	if len(backups) <= keep {
+		return nil
+	}
+
+	// Order by the timestamp embedded in each name, oldest first
+	sort.Slice(backups, func(i, j int) bool {
+		return backupTimestamp(backups[i]) < backupTimestamp(backups[j])
+	})
+	for _, name := range backups[:len(backups)-keep] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("failed to remove old backup: %w", err)
+		}
+	}
+	return nil
+}
+
+// backupTimestamp extracts the trailing timestamp from a backup file name
+func backupTimestamp(name string) string {
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	if i := strings.LastIndex(name, "-"); i > 0 {
+		if j := strings.LastIndex(name[:i], "-"); j >= 0 {
+			return name[j+1:]
+		}
+	}
+	return name
+}
+
+// checkpoint folds the WAL back into the main database file and truncates it
+func (s *SQLiteStorage) checkpoint() error {
+	_, err := s.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	return err
+}
@@ -2,51 +2,272 @@ package storage
 
 import "time"
 
+// RemoteUserPasswordHash marks user records created for contacts registered on other peers
+const RemoteUserPasswordHash = "P2P_REMOTE_USER"
+
 // User represents a user in the system
 type User struct {
-	ID           int64     `json:"id"`
-	Username     string    `json:"username"`
-	PasswordHash string    `json:"-"` // Don't serialize password
-	FullName     string    `json:"full_name"`
-	PeerID       string    `json:"peer_id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID             int64     `json:"id"`
+	Username       string    `json:"username"`                  // Unique locally; for contacts, the handle we show them under
+	RemoteUsername string    `json:"remote_username,omitempty"` // Username a contact registered with, when Username differs
+	PasswordHash   string    `json:"-"`                         // Don't serialize password
+	FullName       string    `json:"full_name"`
+	StatusMessage  string    `json:"status_message,omitempty"` // Short line shown beside the name
+	PeerID         string    `json:"peer_id"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// IsRemote reports whether the user is a contact registered on another peer
+func (u *User) IsRemote() bool {
+	return u.PasswordHash == RemoteUserPasswordHash
+}
+
+// RemoteName returns the username the user goes by on their own node, which is
+// what goes on the wire
+func (u *User) RemoteName() string {
+	if u.RemoteUsername != "" {
+		return u.RemoteUsername
+	}
+	return u.Username
 }
 
 // Friend represents a friendship between two users
 type Friend struct {
-	ID         int64     `json:"id"`
-	UserID     int64     `json:"user_id"`
-	FriendID   int64     `json:"friend_id"`
-	PeerID     string    `json:"peer_id"`   // Friend's peer ID
-	Username   string    `json:"username"`  // Friend's username
-	FullName   string    `json:"full_name"` // Friend's full name
-	Status     string    `json:"status"`    // pending, accepted, blocked
-	CreatedAt  time.Time `json:"created_at"`
-	AcceptedAt time.Time `json:"accepted_at,omitempty"`
+	ID            int64     `json:"id"`
+	UserID        int64     `json:"user_id"`
+	FriendID      int64     `json:"friend_id"`
+	PeerID        string    `json:"peer_id"`                  // Friend's peer ID
+	Username      string    `json:"username"`                 // Friend's username
+	FullName      string    `json:"full_name"`                // Friend's full name
+	StatusMessage string    `json:"status_message,omitempty"` // Friend's status message
+	Status        string    `json:"status"`                   // pending, accepted, blocked, deleted
+	CreatedAt     time.Time `json:"created_at"`
+	AcceptedAt    time.Time `json:"accepted_at,omitempty"`
+	RejectedAt    time.Time `json:"rejected_at,omitempty"`
+	AutoDial      bool      `json:"auto_dial"` // Dial the friend automatically when they are offline
+}
+
+// Friend list sort orders
+const (
+	FriendSortName        = "name"         // Full name, A-Z
+	FriendSortLastMessage = "last_message" // Most recent conversation first
+	FriendSortOnline      = "online"       // Online friends first, then by name
+)
+
+// FriendFilter selects, orders and pages a user's friend list
+type FriendFilter struct {
+	SortBy     string // One of the FriendSort* constants (default name)
+	OnlineOnly bool
+	UnreadOnly bool
+	// OnlinePeerIDs lists currently connected peers; storage has no view of the network
+	OnlinePeerIDs []string
+	Limit         int // 0 = no limit
+	Offset        int
+}
+
+// FriendSummary is a friend plus the conversation details shown in a friend list
+type FriendSummary struct {
+	*Friend
+	Online        bool      `json:"online"`
+	UnreadCount   int       `json:"unread_count"`
+	LastMessageAt time.Time `json:"last_message_at,omitempty"`
+	LastSeen      time.Time `json:"last_seen,omitempty"` // Last time the friend was known to be online
+	Version       string    `json:"version,omitempty"`   // Whisper release the friend last identified with
+	Platform      string    `json:"platform,omitempty"`  // The friend's operating system and architecture
 }
 
+// ConversationSnippetLength is the maximum length of a conversation preview
+const ConversationSnippetLength = 60
+
+// ConversationSummary is one row of the conversation list: who it's with and the latest message
+type ConversationSummary struct {
+	UserID      int64    `json:"user_id"` // The other participant
+	Username    string   `json:"username"`
+	FullName    string   `json:"full_name"`
+	PeerID      string   `json:"peer_id"`
+	Online      bool     `json:"online"`
+	UnreadCount int      `json:"unread_count"`
+	LastMessage *Message `json:"last_message"`
+	Snippet     string   `json:"snippet"` // Single-line preview of LastMessage, whose Content is not loaded
+}
+
+// Message kinds
+const (
+	MessageKindUser   = "user"   // Written by a user
+	MessageKindSystem = "system" // Records an event (key change, friendship established, member joined)
+)
+
 // Message represents a direct message
 type Message struct {
+	ID          int64        `json:"id"`
+	FromUserID  int64        `json:"from_user_id"`
+	ToUserID    int64        `json:"to_user_id"`
+	FromPeerID  string       `json:"from_peer_id"`
+	ToPeerID    string       `json:"to_peer_id"`
+	Content     string       `json:"content"`             // Loaded from message_bodies; empty in conversation summaries
+	Preview     string       `json:"preview"`             // Single-line start of Content, kept with the metadata
+	Kind        string       `json:"kind"`                // user, system
+	Lamport     int64        `json:"lamport"`             // Per-conversation logical clock
+	Seq         int64        `json:"seq"`                 // Sender's per-conversation sequence number (0 = unnumbered)
+	Forwarded   *ForwardInfo `json:"forwarded,omitempty"` // Set when the message forwards someone else's
+	Quote       *QuoteInfo   `json:"quote,omitempty"`     // Set when the message replies to another
+	Delivered   bool         `json:"delivered"`
+	Read        bool         `json:"read"`
+	Failed      bool         `json:"failed"` // Given up on after missing its delivery deadline
+	CreatedAt   time.Time    `json:"created_at"`
+	DeliveredAt time.Time    `json:"delivered_at,omitempty"`
+	ReadAt      time.Time    `json:"read_at,omitempty"`
+	ExpiresAt   time.Time    `json:"expires_at,omitempty"` // Delivery deadline; zero means none
+	FailedAt    time.Time    `json:"failed_at,omitempty"`
+	ReceivedAt  time.Time    `json:"received_at,omitempty"` // Local arrival time of messages from friends
+}
+
+// Why a try at delivering a direct message failed
+const (
+	DeliveryUnreachable = "unreachable" // Not connected, and no mailbox took the message
+	DeliveryUnsupported = "unsupported" // The peer doesn't speak the direct message protocol
+	DeliveryReset       = "reset"       // The stream was reset before the message got through
+	DeliveryTimeout     = "timeout"     // The peer didn't answer in time
+	DeliveryError       = "error"       // Anything else
+)
+
+// DeliveryAttempt records one failed try at delivering a direct message
+type DeliveryAttempt struct {
 	ID          int64     `json:"id"`
-	FromUserID  int64     `json:"from_user_id"`
-	ToUserID    int64     `json:"to_user_id"`
-	FromPeerID  string    `json:"from_peer_id"`
-	ToPeerID    string    `json:"to_peer_id"`
-	Content     string    `json:"content"`
+	MessageID   int64     `json:"message_id"`
+	Reason      string    `json:"reason"` // Delivery*
+	Detail      string    `json:"detail"` // The error, as reported
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+// IdentityCandidate is a peer that claimed to be a contact without being the
+// peer their identity was trusted for. It replaces nothing until the user
+// runs 'trust'.
+type IdentityCandidate struct {
+	ContactID   int64     `json:"contact_id"`
+	PeerID      string    `json:"peer_id"`
+	FirstSeenAt time.Time `json:"first_seen_at"`
+	Held        int       `json:"held"` // Messages held back from it
+}
+
+// QuarantinedMessage is a direct message from an identity candidate, kept in
+// its wire form until the candidate is trusted or replaced
+type QuarantinedMessage struct {
+	ID         int64     `json:"id"`
+	ContactID  int64     `json:"contact_id"`
+	PeerID     string    `json:"peer_id"`
+	Payload    []byte    `json:"payload"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// Group is a small private group chat. Its messages go to each member as a
+// direct message rather than over GossipSub; members are fixed when it is
+// created and only ever leave.
+type Group struct {
+	ID        int64          `json:"id"`
+	UserID    int64          `json:"user_id"` // Local account in the group
+	UID       string         `json:"uid"`     // Random ID shared by every member's copy of the group
+	Name      string         `json:"name"`
+	Members   []*GroupMember `json:"members"`           // Everyone else in the group
+	LeftAt    time.Time      `json:"left_at,omitempty"` // When the user left it; zero while still in it
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// GroupMember is someone else in a group. Members need not be the user's
+// friends, so they are known by peer ID rather than as users.
+type GroupMember struct {
+	PeerID   string `json:"peer_id"`
+	Username string `json:"username"`
+}
+
+// GroupMessage is one message in a group, sent or received
+type GroupMessage struct {
+	ID           int64     `json:"id"`
+	GroupID      int64     `json:"group_id"`
+	FromPeerID   string    `json:"from_peer_id"`
+	FromUsername string    `json:"from_username"`
+	RemoteID     int64     `json:"remote_id"` // The sender's ID for it; 0 for the user's own
+	Outgoing     bool      `json:"outgoing"`  // Sent by the user
+	Content      string    `json:"content"`
+	Kind         string    `json:"kind"`    // user or system
+	Leaving      bool      `json:"leaving"` // Tells members the sender left
+	CreatedAt    time.Time `json:"created_at"`
+	ReceivedAt   time.Time `json:"received_at"`
+}
+
+// IsSystem reports whether the group message records an event rather than chat
+func (m *GroupMessage) IsSystem() bool {
+	return m.Kind == MessageKindSystem
+}
+
+// GroupDelivery is how far one of the user's group messages got with one member
+type GroupDelivery struct {
+	MessageID   int64     `json:"message_id"`
+	GroupID     int64     `json:"group_id"`
+	PeerID      string    `json:"peer_id"`
+	Username    string    `json:"username"`
 	Delivered   bool      `json:"delivered"`
-	Read        bool      `json:"read"`
-	CreatedAt   time.Time `json:"created_at"`
 	DeliveredAt time.Time `json:"delivered_at,omitempty"`
-	ReadAt      time.Time `json:"read_at,omitempty"`
+	Attempts    int       `json:"attempts"`               // Failed tries so far
+	Reason      string    `json:"reason,omitempty"`       // Why the last try failed (Delivery*)
+	AttemptedAt time.Time `json:"attempted_at,omitempty"` // When the last try failed
+}
+
+// ForwardInfo attributes a forwarded message to the person who first wrote it
+type ForwardInfo struct {
+	Username string    `json:"username"`
+	FullName string    `json:"full_name,omitempty"`
+	PeerID   string    `json:"peer_id,omitempty"`
+	SentAt   time.Time `json:"sent_at"` // When the original was written
+}
+
+// Author returns the original author's full name, or username if it wasn't shared
+func (f *ForwardInfo) Author() string {
+	if f.FullName != "" {
+		return f.FullName
+	}
+	return f.Username
+}
+
+// QuoteInfo is a snapshot of the message being replied to, kept with the reply so
+// it reads in context even where the original isn't stored
+type QuoteInfo struct {
+	Username string    `json:"username"`
+	FullName string    `json:"full_name,omitempty"`
+	PeerID   string    `json:"peer_id,omitempty"`
+	SentAt   time.Time `json:"sent_at"` // When the quoted message was written
+	Excerpt  string    `json:"excerpt"` // Start of the quoted message
+}
+
+// Author returns the quoted author's full name, or username if it wasn't shared
+func (q *QuoteInfo) Author() string {
+	if q.FullName != "" {
+		return q.FullName
+	}
+	return q.Username
+}
+
+// IsSystem reports whether the message is a locally generated system message
+func (m *Message) IsSystem() bool {
+	return m.Kind == MessageKindSystem
+}
+
+// NormalizeKind returns a known message kind, defaulting to a user message
+func NormalizeKind(kind string) string {
+	if kind == MessageKindSystem {
+		return MessageKindSystem
+	}
+	return MessageKindUser
 }
 
 // Conference represents a group chat
 type Conference struct {
-	ID        int64     `json:"id"`
-	Name      string    `json:"name"`
-	CreatorID int64     `json:"creator_id"`
-	CreatedAt time.Time `json:"created_at"`
+	ID              int64     `json:"id"`
+	Name            string    `json:"name"`
+	CreatorID       int64     `json:"creator_id"`
+	MaxParticipants int       `json:"max_participants"` // Enforced by the creator; 0 = unlimited
+	CreatedAt       time.Time `json:"created_at"`
 }
 
 // ConferenceParticipant represents a participant in a conference
@@ -65,9 +286,115 @@ type ConferenceParticipant struct {
 type ConferenceMessage struct {
 	ID           int64     `json:"id"`
 	ConferenceID int64     `json:"conference_id"`
+	Channel      string    `json:"channel,omitempty"` // Empty for the main channel
 	FromUserID   int64     `json:"from_user_id"`
 	FromPeerID   string    `json:"from_peer_id"`
 	Content      string    `json:"content"`
+	Kind         string    `json:"kind"`    // user, system
+	Lamport      int64     `json:"lamport"` // Per-conference logical clock, shared by all channels
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// TranscriptEntry is a conference message with its sender's known names, as
+// exported in a transcript. The names are empty for senders never seen.
+type TranscriptEntry struct {
+	*ConferenceMessage
+	Username string `json:"username,omitempty"`
+	FullName string `json:"full_name,omitempty"`
+	Hidden   bool   `json:"hidden,omitempty"` // Deleted for the user; only in complete records
+}
+
+// ConferenceSummary stands in for a compacted range of one channel's history:
+// the raw messages are gone, and Content, if the policy wrote one, sums them up
+type ConferenceSummary struct {
+	ID           int64     `json:"id"`
+	ConferenceID int64     `json:"conference_id"`
+	Channel      string    `json:"channel,omitempty"` // Empty for the main channel
+	FromLamport  int64     `json:"from_lamport"`
+	ToLamport    int64     `json:"to_lamport"`
+	StartedAt    time.Time `json:"started_at"` // When the first message replaced was sent
+	EndedAt      time.Time `json:"ended_at"`   // When the last one was
+	Messages     int       `json:"messages"`   // How many messages were replaced
+	Policy       string    `json:"policy"`     // Name of the compaction policy that wrote it
+	Content      string    `json:"content,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// IsSystem reports whether the conference message records an event rather than chat
+func (m *ConferenceMessage) IsSystem() bool {
+	return m.Kind == MessageKindSystem
+}
+
+// ConferenceChannel is a named channel inside a conference, with its own topic and history
+type ConferenceChannel struct {
+	ID           int64     `json:"id"`
+	ConferenceID int64     `json:"conference_id"`
+	Name         string    `json:"name"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// ConferenceRateLimit is how fast each member may post in a conference, as set
+// by its owner. Both limits apply at once; zero turns one off.
+type ConferenceRateLimit struct {
+	ConferenceID    int64     `json:"conference_id"`
+	Messages        int       `json:"messages"`          // Per member per window
+	WindowSeconds   int       `json:"window_seconds"`    // Length of the window Messages counts over
+	SlowModeSeconds int       `json:"slow_mode_seconds"` // Minimum gap between a member's messages in slow mode
+	SlowModeUntil   time.Time `json:"slow_mode_until"`   // When slow mode ends; zero keeps it on until turned off
+	Version         int64     `json:"version"`           // When the owner set it, in Unix nanoseconds; the newest wins
+}
+
+// SlowModeActive reports whether slow mode holds members to SlowModeSeconds between posts at now
+func (l *ConferenceRateLimit) SlowModeActive(now time.Time) bool {
+	return l.SlowModeSeconds > 0 && (l.SlowModeUntil.IsZero() || now.Before(l.SlowModeUntil))
+}
+
+// RosterEntry is one friend in a friend list sent to help its owner recover it
+type RosterEntry struct {
+	Username string `json:"username"`
+	FullName string `json:"full_name"`
+	PeerID   string `json:"peer_id"`
+}
+
+// RosterCopy is a copy of a friend's friend list that they left with one of
+// our accounts, to be sent back if they lose it
+type RosterCopy struct {
+	UserID     int64          `json:"user_id"`   // Account keeping the copy
+	FriendID   int64          `json:"friend_id"` // Friend whose list it is
+	Username   string         `json:"username"`  // The friend's username, for display
+	Entries    []*RosterEntry `json:"entries"`
+	ReceivedAt time.Time      `json:"received_at"`
+}
+
+// ConferenceObservers is who may read a conference but not post in it, as set
+// by its owner
+type ConferenceObservers struct {
+	ConferenceID int64    `json:"conference_id"`
+	PeerIDs      []string `json:"peer_ids"`
+	Version      int64    `json:"version"` // When the owner set it, in Unix nanoseconds; the newest wins
+}
+
+// Has reports whether a peer is an observer; a nil set has none
+func (o *ConferenceObservers) Has(peerID string) bool {
+	if o == nil {
+		return false
+	}
+	for _, id := range o.PeerIDs {
+		if id == peerID {
+			return true
+		}
+	}
+	return false
+}
+
+// ConferenceMembershipEntry is a tagged add in a conference's replicated membership set
+type ConferenceMembershipEntry struct {
+	ID           int64     `json:"id"`
+	ConferenceID int64     `json:"conference_id"`
+	PeerID       string    `json:"peer_id"`
+	Username     string    `json:"username"`
+	Tag          string    `json:"tag"`
+	Removed      bool      `json:"removed"`
 	CreatedAt    time.Time `json:"created_at"`
 }
 
@@ -76,7 +403,105 @@ type KnownPeer struct {
 	ID        int64     `json:"id"`
 	PeerID    string    `json:"peer_id"`
 	Username  string    `json:"username"`
-	Addrs     string    `json:"addrs"` // JSON array of multiaddresses
+	Addrs     string    `json:"addrs"`    // JSON array of multiaddresses
+	Version   string    `json:"version"`  // Whisper release it last identified with; empty if unknown
+	Platform  string    `json:"platform"` // Its operating system and architecture, e.g. linux/amd64
 	LastSeen  time.Time `json:"last_seen"`
 	CreatedAt time.Time `json:"created_at"`
 }
+
+// PeerReputation is how well a peer has behaved toward this node. The score
+// starts at 0 and goes down with each offense; it is kept with the peer in
+// known_peers.
+type PeerReputation struct {
+	PeerID           string    `json:"peer_id"`
+	Score            float64   `json:"score"`
+	InvalidMessages  int       `json:"invalid_messages"`
+	RateLimited      int       `json:"rate_limited"`      // Messages over a conference's posting limits
+	RejectedRequests int       `json:"rejected_requests"` // Friend requests we turned down
+	UpdatedAt        time.Time `json:"updated_at"`        // When the score last changed (zero if never)
+}
+
+// Peer offenses that cost reputation
+const (
+	PeerOffenseInvalidMessage  = "invalid_message"  // Sent a message that failed to decode or validate
+	PeerOffenseRateLimited     = "rate_limited"     // Posted over a conference's limits or opened streams too fast
+	PeerOffenseRejectedRequest = "rejected_request" // Sent a friend request that was rejected
+)
+
+// MaxDialAddrs is how many confirmed dial addresses are kept per peer
+const MaxDialAddrs = 8
+
+// DialAddr is an address a peer was successfully dialed on
+type DialAddr struct {
+	PeerID       string    `json:"peer_id"`
+	Addr         string    `json:"addr"` // Multiaddr without the /p2p part
+	Successes    int       `json:"successes"`
+	FirstSuccess time.Time `json:"first_success"`
+	LastSuccess  time.Time `json:"last_success"`
+}
+
+// Activity kinds
+const (
+	ActivityFriendRequest    = "friend_request"    // Someone asked to be friends
+	ActivityFriendAdded      = "friend_added"      // Someone accepted our friend request
+	ActivityMissedMessages   = "missed_messages"   // Messages that arrived while we were away
+	ActivityConferenceInvite = "conference_invite" // Someone invited us to a conference
+)
+
+// MaxActivity is how many activity entries are kept per user
+const MaxActivity = 500
+
+// Activity is a notable event in a user's activity feed
+type Activity struct {
+	ID           int64     `json:"id"`
+	UserID       int64     `json:"user_id"`
+	Kind         string    `json:"kind"`
+	PeerID       string    `json:"peer_id,omitempty"`       // Who it came from
+	Name         string    `json:"name,omitempty"`          // Their username
+	ConferenceID int64     `json:"conference_id,omitempty"` // For conference invites
+	Detail       string    `json:"detail,omitempty"`        // Conference name, or the latest missed message's preview
+	Count        int       `json:"count"`                   // Messages an entry of missed messages stands for; 1 otherwise
+	Seen         bool      `json:"seen"`
+	CreatedAt    time.Time `json:"created_at"` // When it last happened
+}
+
+// Setting is a per-account preference; FriendID 0 makes it the default for
+// every friend, and a friend's own row overrides that default
+type Setting struct {
+	UserID    int64     `json:"user_id"`
+	FriendID  int64     `json:"friend_id"`
+	Name      string    `json:"name"`
+	Value     string    `json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DeletionNotice is a signed account-deleted notice waiting to be delivered
+// to a friend who was offline when the account was deleted
+type DeletionNotice struct {
+	PeerID    string    `json:"peer_id"` // Friend to deliver to
+	Notice    string    `json:"notice"`  // The notice as sent on the wire
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UsernameAlias is a name a user went by before a rename. It keeps resolving
+// to them until it expires, so friends who haven't heard of the new name yet
+// can still reach them.
+type UsernameAlias struct {
+	Username  string    `json:"username"`
+	UserID    int64     `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// UsernameAliasLifetime is how long a former username keeps resolving
+const UsernameAliasLifetime = 14 * 24 * time.Hour
+
+// PushEndpoint is a friend's push relay registration, used to wake their
+// device when a message to them can't be delivered
+type PushEndpoint struct {
+	PeerID    string    `json:"peer_id"`
+	Relay     string    `json:"relay"`
+	Token     string    `json:"token"`
+	Key       []byte    `json:"key"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -0,0 +1,399 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QuotaCategory is a kind of stored data with a quota of its own
+type QuotaCategory string
+
+const (
+	QuotaMessages    QuotaCategory = "messages"    // Direct message history
+	QuotaConferences QuotaCategory = "conferences" // Conference history
+	QuotaBackups     QuotaCategory = "backups"     // Backup files in the backup directory
+)
+
+// QuotaCategories lists every category in the order usage is reported
+var QuotaCategories = []QuotaCategory{QuotaMessages, QuotaConferences, QuotaBackups}
+
+// QuotaPolicy is what happens to a category once it is over its quota
+type QuotaPolicy string
+
+const (
+	QuotaPrune  QuotaPolicy = "prune"  // Delete the oldest data until back under quota
+	QuotaReject QuotaPolicy = "reject" // Refuse new data until space is freed
+)
+
+// ErrQuotaExceeded is returned when new data is refused by a reject quota
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// ErrUnknownQuotaPolicy is returned for a policy other than prune or reject
+var ErrUnknownQuotaPolicy = errors.New("quota policy must be prune or reject")
+
+const (
+	// quotaPruneTarget is the share of a quota pruning frees down to, so the
+	// next few messages don't immediately trigger another prune
+	quotaPruneTarget = 0.9
+
+	// quotaPruneBatch is how many rows a prune reads per query
+	quotaPruneBatch = 500
+)
+
+// Quota limits one category
+type Quota struct {
+	Category   QuotaCategory `json:"category"`
+	LimitBytes int64         `json:"limit_bytes"` // 0 = unlimited
+	Policy     QuotaPolicy   `json:"policy"`
+}
+
+// QuotaUsage is how much of its quota a category uses. Database categories
+// are estimated from the size of their rows.
+type QuotaUsage struct {
+	Quota
+	UsedBytes int64 `json:"used_bytes"`
+	Items     int64 `json:"items"` // Messages, or backup files
+}
+
+// Over reports whether the category is at or over its quota
+func (u *QuotaUsage) Over() bool {
+	return u.LimitBytes > 0 && u.UsedBytes >= u.LimitBytes
+}
+
+// ParseQuotaPolicy parses a quota policy name
+func ParseQuotaPolicy(name string) (QuotaPolicy, error) {
+	switch QuotaPolicy(name) {
+	case QuotaPrune, QuotaReject:
+		return QuotaPolicy(name), nil
+	}
+	return "", ErrUnknownQuotaPolicy
+}
+
+// quotaState holds the configured quotas and which reject quotas are full
+type quotaState struct {
+	mu     sync.Mutex
+	quotas map[QuotaCategory]Quota
+	full   map[QuotaCategory]bool
+}
+
+// newQuotaState creates a state with every category unlimited
+func newQuotaState() *quotaState {
+	return &quotaState{
+		quotas: make(map[QuotaCategory]Quota),
+		full:   make(map[QuotaCategory]bool),
+	}
+}
+
+// SetQuotas replaces the configured quotas; categories left out are unlimited
+func (s *SQLiteStorage) SetQuotas(quotas []Quota) {
+	s.quotas.mu.Lock()
+	defer s.quotas.mu.Unlock()
+	s.quotas.quotas = make(map[QuotaCategory]Quota)
+	s.quotas.full = make(map[QuotaCategory]bool)
+	for _, quota := range quotas {
+		s.quotas.quotas[quota.Category] = quota
+	}
+}
+
+// quotaFor returns a category's quota, which is unlimited if none was set
+func (s *SQLiteStorage) quotaFor(category QuotaCategory) Quota {
+	s.quotas.mu.Lock()
+	defer s.quotas.mu.Unlock()
+	quota, ok := s.quotas.quotas[category]
+	if !ok {
+		return Quota{Category: category, Policy: QuotaPrune}
+	}
+	return quota
+}
+
+// checkQuota fails with ErrQuotaExceeded if a reject quota was found full
+// the last time usage was measured
+func (s *SQLiteStorage) checkQuota(category QuotaCategory) error {
+	s.quotas.mu.Lock()
+	defer s.quotas.mu.Unlock()
+	if s.quotas.full[category] {
+		return fmt.Errorf("%w: %s are full (see 'quota')", ErrQuotaExceeded, category)
+	}
+	return nil
+}
+
+// GetQuotaUsage measures every category against its quota
+func (s *SQLiteStorage) GetQuotaUsage(ctx context.Context) ([]*QuotaUsage, error) {
+	defer s.observe("GetQuotaUsage", time.Now())
+	usages := []*QuotaUsage{}
+	for _, category := range QuotaCategories {
+		usage, err := s.measureQuota(ctx, category)
+		if err != nil {
+			return nil, err
+		}
+		usages = append(usages, usage)
+	}
+	return usages, nil
+}
+
+// EnforceQuotas prunes the oldest data from prune categories that are over
+// quota and returns how many items each lost. Reject categories that are
+// full refuse new data until the next call finds them back under quota.
+func (s *SQLiteStorage) EnforceQuotas(ctx context.Context) (map[QuotaCategory]int64, error) {
+	defer s.observe("EnforceQuotas", time.Now())
+	pruned := make(map[QuotaCategory]int64)
+	for _, category := range QuotaCategories {
+		usage, err := s.measureQuota(ctx, category)
+		if err != nil {
+			return pruned, err
+		}
+		if !usage.Over() || usage.Policy != QuotaPrune {
+			continue
+		}
+
+		excess := usage.UsedBytes - int64(float64(usage.LimitBytes)*quotaPruneTarget)
+		var n int64
+		switch category {
+		case QuotaMessages:
+			n, err = s.pruneRows(ctx, excess, messageSizeQuery, pruneMessageSeqs, `DELETE FROM message_bodies WHERE message_id IN (SELECT id FROM messages WHERE id <= ? AND delivered = 1)`, `DELETE FROM messages WHERE id <= ? AND delivered = 1`)
+		case QuotaConferences:
+			n, err = s.pruneRows(ctx, excess, conferenceSizeQuery, `DELETE FROM conference_messages WHERE id <= ?`)
+		case QuotaBackups:
+			n, err = s.pruneBackups(excess, "")
+		}
+		pruned[category] = n
+		if err != nil {
+			return pruned, fmt.Errorf("failed to prune %s: %w", category, err)
+		}
+	}
+	return pruned, nil
+}
+
+// RunQuotaEnforcement enforces quotas now and then every interval, until ctx
+// is cancelled
+func (s *SQLiteStorage) RunQuotaEnforcement(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pruned, err := s.EnforceQuotas(ctx)
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("Warning: Failed to enforce storage quotas: %v\n", err)
+		}
+		for _, category := range QuotaCategories {
+			if pruned[category] > 0 {
+				fmt.Printf("Storage quota: pruned %d items from %s\n", pruned[category], category)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Row sizes are the text a row stores plus 64 bytes for its ids, flags,
+// timestamps and index entries. Only delivered direct messages are pruned, so
+// the outbox is never lost.
+const (
+	messageRowSize = `LENGTH(CAST(m.content AS BLOB)) + LENGTH(CAST(m.preview AS BLOB)) +
+		LENGTH(CAST(m.forwarded_from AS BLOB)) + LENGTH(CAST(m.quote AS BLOB)) +
+		LENGTH(m.from_peer_id) + LENGTH(m.to_peer_id) + COALESCE(LENGTH(CAST(b.content AS BLOB)), 0) + 64`
+	conferenceRowSize = `LENGTH(CAST(content AS BLOB)) + LENGTH(channel) + LENGTH(from_peer_id) + 64`
+
+	messageSizeQuery = `
+		SELECT m.id, ` + messageRowSize + `
+		FROM messages m LEFT JOIN message_bodies b ON b.message_id = m.id
+		WHERE m.id > ? AND m.delivered = 1
+		ORDER BY m.id ASC
+		LIMIT ?`
+	// pruneMessageSeqs raises the sequence state of each direction past the
+	// messages about to be pruned, so the sender doesn't restart its sequence
+	// and the receiver doesn't ask for them again
+	pruneMessageSeqs = `
+		INSERT INTO message_seqs (from_user_id, to_user_id, high_seq, low_water)
+		SELECT from_user_id, to_user_id, MAX(seq), MAX(seq)
+		FROM messages
+		WHERE id <= ? AND delivered = 1 AND seq > 0
+		GROUP BY from_user_id, to_user_id
+		ON CONFLICT(from_user_id, to_user_id) DO UPDATE SET
+			high_seq = MAX(high_seq, excluded.high_seq),
+			low_water = MAX(low_water, excluded.low_water)`
+	conferenceSizeQuery = `
+		SELECT id, ` + conferenceRowSize + `
+		FROM conference_messages
+		WHERE id > ?
+		ORDER BY id ASC
+		LIMIT ?`
+)
+
+// measureQuota measures one category and records whether a reject quota is full
+func (s *SQLiteStorage) measureQuota(ctx context.Context, category QuotaCategory) (*QuotaUsage, error) {
+	usage := &QuotaUsage{Quota: s.quotaFor(category)}
+	var err error
+	switch category {
+	case QuotaMessages:
+		err = s.db.QueryRowContext(ctx, `
+			SELECT COUNT(*), COALESCE(SUM(`+messageRowSize+`), 0)
+			FROM messages m LEFT JOIN message_bodies b ON b.message_id = m.id
+		`).Scan(&usage.Items, &usage.UsedBytes)
+	case QuotaConferences:
+		err = s.db.QueryRowContext(ctx, `
+			SELECT COUNT(*), COALESCE(SUM(`+conferenceRowSize+`), 0)
+			FROM conference_messages
+		`).Scan(&usage.Items, &usage.UsedBytes)
+	case QuotaBackups:
+		var backups []backupFile
+		backups, err = s.listBackups()
+		for _, backup := range backups {
+			usage.Items++
+			usage.UsedBytes += backup.size
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure %s: %w", category, err)
+	}
+
+	s.quotas.mu.Lock()
+	s.quotas.full[category] = usage.Policy == QuotaReject && usage.Over()
+	s.quotas.mu.Unlock()
+	return usage, nil
+}
+
+// pruneRows deletes the oldest rows, as listed with their sizes by sizeQuery,
+// until at least excess bytes are freed, and returns how many went. The
+// deletes are run with the id of the newest row to go.
+func (s *SQLiteStorage) pruneRows(ctx context.Context, excess int64, sizeQuery string, deletes ...string) (int64, error) {
+	var lastID, freed, count int64
+	for freed < excess {
+		rows, err := s.db.QueryContext(ctx, sizeQuery, lastID, quotaPruneBatch)
+		if err != nil {
+			return 0, err
+		}
+		read := 0
+		for rows.Next() && freed < excess {
+			var size int64
+			if err := rows.Scan(&lastID, &size); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			freed += size
+			count++
+			read++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		if read == 0 {
+			break
+		}
+	}
+	if count == 0 {
+		return 0, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, query := range deletes {
+		if _, err := tx.ExecContext(ctx, query, lastID); err != nil {
+			return 0, err
+		}
+	}
+	return count, tx.Commit()
+}
+
+// admitBackup refuses a backup into the backup directory while a reject
+// quota on backups is full
+func (s *SQLiteStorage) admitBackup(ctx context.Context, destPath string) error {
+	if filepath.Dir(destPath) != s.backupDir() {
+		return nil
+	}
+	if _, err := s.measureQuota(ctx, QuotaBackups); err != nil {
+		return err
+	}
+	return s.checkQuota(QuotaBackups)
+}
+
+// trimBackups applies a prune quota on backups once destPath has been
+// written, keeping destPath itself
+func (s *SQLiteStorage) trimBackups(ctx context.Context, destPath string) error {
+	if filepath.Dir(destPath) != s.backupDir() {
+		return nil
+	}
+	usage, err := s.measureQuota(ctx, QuotaBackups)
+	if err != nil || !usage.Over() || usage.Policy != QuotaPrune {
+		return err
+	}
+	_, err = s.pruneBackups(usage.UsedBytes-int64(float64(usage.LimitBytes)*quotaPruneTarget), destPath)
+	return err
+}
+
+// backupFile is one file in the backup directory
+type backupFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// listBackups returns the files in the backup directory, oldest first
+func (s *SQLiteStorage) listBackups() ([]backupFile, error) {
+	if s.IsEphemeral() {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(s.backupDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []backupFile{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backupFile{
+			path:    filepath.Join(s.backupDir(), entry.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].modTime.Before(backups[j].modTime) })
+	return backups, nil
+}
+
+// pruneBackups deletes the oldest backups, other than keep, until at least
+// excess bytes are freed, and returns how many went
+func (s *SQLiteStorage) pruneBackups(excess int64, keep string) (int64, error) {
+	backups, err := s.listBackups()
+	if err != nil {
+		return 0, err
+	}
+	var freed, count int64
+	for _, backup := range backups {
+		if freed >= excess {
+			break
+		}
+		if backup.path == keep {
+			continue
+		}
+		if err := os.Remove(backup.path); err != nil {
+			return count, err
+		}
+		freed += backup.size
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestPruneKeepsMessageSequence(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(t)
+	alice := createTestUser(t, s, "alice")
+	bob := createTestUser(t, s, "bob")
+
+	for seq := int64(1); seq <= 5; seq++ {
+		msg := &Message{FromUserID: alice.ID, ToUserID: bob.ID, FromPeerID: alice.PeerID, ToPeerID: bob.PeerID, Content: "hello", Seq: seq, Delivered: true}
+		if err := s.SaveMessage(ctx, msg); err != nil {
+			t.Fatalf("SaveMessage(%d): %v", seq, err)
+		}
+	}
+
+	// A one-byte quota prunes every delivered message
+	s.SetQuotas([]Quota{{Category: QuotaMessages, LimitBytes: 1, Policy: QuotaPrune}})
+	pruned, err := s.EnforceQuotas(ctx)
+	if err != nil {
+		t.Fatalf("EnforceQuotas: %v", err)
+	}
+	if pruned[QuotaMessages] != 5 {
+		t.Fatalf("pruned %d messages, want 5", pruned[QuotaMessages])
+	}
+
+	next, err := s.NextMessageSeq(ctx, alice.ID, bob.ID)
+	if err != nil || next != 6 {
+		t.Errorf("NextMessageSeq = %d, %v; want 6", next, err)
+	}
+	for _, seq := range []int64{1, 5} {
+		if has, err := s.HasMessageSeq(ctx, alice.ID, bob.ID, seq); err != nil || !has {
+			t.Errorf("HasMessageSeq(%d) = %v, %v; want true for a pruned message", seq, has, err)
+		}
+	}
+	if has, _ := s.HasMessageSeq(ctx, alice.ID, bob.ID, 6); has {
+		t.Error("HasMessageSeq(6) = true for a message never received")
+	}
+	missing, err := s.GetMissingMessageSeqs(ctx, alice.ID, bob.ID, 8)
+	if err != nil || !reflect.DeepEqual(missing, []int64{6, 7}) {
+		t.Errorf("GetMissingMessageSeqs = %v, %v; want [6 7]", missing, err)
+	}
+
+	// The other direction is untouched
+	if next, _ := s.NextMessageSeq(ctx, bob.ID, alice.ID); next != 1 {
+		t.Errorf("NextMessageSeq(bob, alice) = %d, want 1", next)
+	}
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// offenseColumns maps each peer offense to the known_peers column counting it
+var offenseColumns = map[string]string{
+	PeerOffenseInvalidMessage:  "invalid_messages",
+	PeerOffenseRateLimited:     "rate_limited",
+	PeerOffenseRejectedRequest: "rejected_requests",
+}
+
+// reputationColumns lists the known_peers columns in the order scanReputation reads them
+const reputationColumns = `peer_id, reputation, invalid_messages, rate_limited, rejected_requests, reputation_at`
+
+// GetPeerReputation returns a peer's stored reputation, which is a clean one
+// for peers that never offended
+func (s *SQLiteStorage) GetPeerReputation(ctx context.Context, peerID string) (*PeerReputation, error) {
+	defer s.observe("GetPeerReputation", time.Now())
+	rep, err := scanReputation(s.db.QueryRowContext(ctx, `
+		SELECT `+reputationColumns+` FROM known_peers WHERE peer_id = ?
+	`, peerID))
+	if err == sql.ErrNoRows {
+		return &PeerReputation{PeerID: peerID}, nil
+	}
+	return rep, err
+}
+
+// GetPeerReputations returns the stored reputation of every peer with a
+// score below zero, lowest first
+func (s *SQLiteStorage) GetPeerReputations(ctx context.Context) ([]*PeerReputation, error) {
+	defer s.observe("GetPeerReputations", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+reputationColumns+` FROM known_peers
+		WHERE reputation < 0
+		ORDER BY reputation ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reputations := []*PeerReputation{}
+	for rows.Next() {
+		rep, err := scanReputation(rows)
+		if err != nil {
+			return nil, err
+		}
+		reputations = append(reputations, rep)
+	}
+	return reputations, rows.Err()
+}
+
+// RecordPeerOffense counts an offense against a peer and sets its score,
+// adding the peer to known_peers if needed, and returns the new reputation
+func (s *SQLiteStorage) RecordPeerOffense(ctx context.Context, peerID, offense string, score float64, at time.Time) (*PeerReputation, error) {
+	defer s.observe("RecordPeerOffense", time.Now())
+	column, ok := offenseColumns[offense]
+	if !ok {
+		return nil, fmt.Errorf("unknown peer offense %q", offense)
+	}
+	return scanReputation(s.db.QueryRowContext(ctx, `
+		INSERT INTO known_peers (peer_id, username, addrs, reputation, `+column+`, reputation_at)
+		VALUES (?1, '', '[]', ?2, 1, ?3)
+		ON CONFLICT(peer_id) DO UPDATE SET
+			reputation = excluded.reputation, `+column+` = `+column+` + 1, reputation_at = excluded.reputation_at
+		RETURNING `+reputationColumns, peerID, score, at))
+}
+
+// scanReputation scans reputationColumns from a row
+func scanReputation(row rowScanner) (*PeerReputation, error) {
+	rep := &PeerReputation{}
+	var updatedAt sql.NullTime
+	if err := row.Scan(&rep.PeerID, &rep.Score, &rep.InvalidMessages, &rep.RateLimited, &rep.RejectedRequests, &updatedAt); err != nil {
+		return nil, err
+	}
+	rep.UpdatedAt = updatedAt.Time
+	return rep, nil
+}
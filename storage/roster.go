@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SaveRosterCopy stores the friend list a friend left with an account,
+// replacing the copy they left before
+func (s *SQLiteStorage) SaveRosterCopy(ctx context.Context, roster *RosterCopy) error {
+	defer s.observe("SaveRosterCopy", time.Now())
+	data, err := json.Marshal(roster.Entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode friend list: %w", err)
+	}
+	if roster.ReceivedAt.IsZero() {
+		roster.ReceivedAt = time.Now()
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO roster_copies (user_id, friend_id, entries, received_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id, friend_id) DO UPDATE SET
+			entries = excluded.entries,
+			received_at = excluded.received_at
+	`, roster.UserID, roster.FriendID, string(data), roster.ReceivedAt)
+	return err
+}
+
+// GetRosterCopies returns the friend lists friends left with an account,
+// ordered by the friends' usernames
+func (s *SQLiteStorage) GetRosterCopies(ctx context.Context, userID int64) ([]*RosterCopy, error) {
+	defer s.observe("GetRosterCopies", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT r.user_id, r.friend_id, u.username, r.entries, r.received_at
+		FROM roster_copies r
+		JOIN users u ON u.id = r.friend_id
+		WHERE r.user_id = ?
+		ORDER BY u.username COLLATE NOCASE
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	copies := []*RosterCopy{}
+	for rows.Next() {
+		roster := &RosterCopy{}
+		var entries string
+		if err := rows.Scan(&roster.UserID, &roster.FriendID, &roster.Username, &entries, &roster.ReceivedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(entries), &roster.Entries); err != nil {
+			return nil, fmt.Errorf("failed to decode friend list: %w", err)
+		}
+		copies = append(copies, roster)
+	}
+	return copies, rows.Err()
+}
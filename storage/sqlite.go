@@ -3,22 +3,48 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
+// MemoryPath opens a database that lives only in memory and is gone on Close
+const MemoryPath = ":memory:"
+
+// ErrEphemeral is returned for operations that would persist an in-memory database
+var ErrEphemeral = errors.New("not available for in-memory storage")
+
 // SQLiteStorage implements the Storage interface using SQLite
 type SQLiteStorage struct {
-	db *sql.DB
+	db     *sql.DB
+	path   string
+	stats  *queryStats // Per-operation timings; see Stats
+	quotas *quotaState // See SetQuotas
+}
+
+// NewMemoryStorage creates a storage instance that is never written to disk,
+// for guest sessions
+func NewMemoryStorage() (*SQLiteStorage, error) {
+	return NewSQLiteStorage(MemoryPath)
+}
+
+// IsEphemeral reports whether the database only lives in memory
+func (s *SQLiteStorage) IsEphemeral() bool {
+	return s.path == MemoryPath
 }
 
 // NewSQLiteStorage creates a new SQLite storage instance
 func NewSQLiteStorage(dbPath string) (*SQLiteStorage, error) {
+	if dbPath == MemoryPath {
+		return openSQLiteStorage(dbPath, false)
+	}
+
 	// Expand ~ to home directory
 	if strings.HasPrefix(dbPath, "~/") {
 		home, err := os.UserHomeDir()
@@ -34,18 +60,48 @@ func NewSQLiteStorage(dbPath string) (*SQLiteStorage, error) {
 		return nil, fmt.Errorf("failed to create directory: %w", err)
 	}
 
+	// Remember whether this is an existing database that may need upgrading
+	info, statErr := os.Stat(dbPath)
+	existed := statErr == nil && info.Size() > 0
+
+	return openSQLiteStorage(dbPath, existed)
+}
+
+// openSQLiteStorage opens the database and brings its schema up to date
+func openSQLiteStorage(dbPath string, existed bool) (*SQLiteStorage, error) {
 	// Open database
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
+	// Every connection to :memory: gets its own empty database, so keep exactly one
+	if dbPath == MemoryPath {
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		db.SetConnMaxLifetime(0)
+	}
+
 	// Enable WAL mode for better concurrency
 	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
 		return nil, fmt.Errorf("failed to enable WAL mode: %w", err)
 	}
 
-	storage := &SQLiteStorage{db: db}
+	storage := &SQLiteStorage{db: db, path: dbPath, stats: newQueryStats(), quotas: newQuotaState()}
+
+	// Refuse to run on a damaged database; the error explains how to recover
+	if existed {
+		if err := storage.checkIntegrity(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	// Keep a copy of the database before upgrading its schema
+	if err := storage.backupBeforeMigration(existed); err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	// Initialize schema
 	if err := storage.initSchema(); err != nil {
@@ -53,6 +109,16 @@ func NewSQLiteStorage(dbPath string) (*SQLiteStorage, error) {
 		return nil, fmt.Errorf("failed to initialize schema: %w", err)
 	}
 
+	// Apply column migrations for databases created by older versions
+	if err := storage.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate schema: %w", err)
+	}
+	if err := storage.setSchemaUserVersion(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to record schema version: %w", err)
+	}
+
 	return storage, nil
 }
 
@@ -70,6 +136,7 @@ func (s *SQLiteStorage) initSchema() error {
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_users_username ON users(username);
+	CREATE INDEX IF NOT EXISTS idx_users_username_nocase ON users(username COLLATE NOCASE);
 	CREATE INDEX IF NOT EXISTS idx_users_peer_id ON users(peer_id);
 
 	CREATE TABLE IF NOT EXISTS friends (
@@ -96,6 +163,10 @@ func (s *SQLiteStorage) initSchema() error {
 		from_peer_id TEXT NOT NULL,
 		to_peer_id TEXT NOT NULL,
 		content TEXT NOT NULL,
+		kind TEXT NOT NULL DEFAULT 'user',
+		lamport INTEGER NOT NULL DEFAULT 0,
+		seq INTEGER NOT NULL DEFAULT 0,
+		hidden BOOLEAN NOT NULL DEFAULT 0,
 		delivered BOOLEAN DEFAULT 0,
 		read BOOLEAN DEFAULT 0,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
@@ -108,6 +179,25 @@ func (s *SQLiteStorage) initSchema() error {
 	CREATE INDEX IF NOT EXISTS idx_messages_to_user ON messages(to_user_id);
 	CREATE INDEX IF NOT EXISTS idx_messages_delivered ON messages(delivered);
 
+	-- Bodies live apart from messages so listing conversations never reads them.
+	-- messages.content is only kept for databases created before the split.
+	CREATE TABLE IF NOT EXISTS message_bodies (
+		message_id INTEGER PRIMARY KEY,
+		content TEXT NOT NULL,
+		FOREIGN KEY(message_id) REFERENCES messages(id)
+	);
+
+	-- Sequence state of each direction of a conversation, kept apart from the
+	-- messages so pruning them never restarts or reopens the sequence.
+	-- Everything at or below low_water was received or pruned.
+	CREATE TABLE IF NOT EXISTS message_seqs (
+		from_user_id INTEGER NOT NULL,
+		to_user_id INTEGER NOT NULL,
+		high_seq INTEGER NOT NULL DEFAULT 0,
+		low_water INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (from_user_id, to_user_id)
+	);
+
 	CREATE TABLE IF NOT EXISTS conferences (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		name TEXT NOT NULL,
@@ -138,6 +228,9 @@ func (s *SQLiteStorage) initSchema() error {
 		from_user_id INTEGER NOT NULL,
 		from_peer_id TEXT NOT NULL,
 		content TEXT NOT NULL,
+		kind TEXT NOT NULL DEFAULT 'user',
+		lamport INTEGER NOT NULL DEFAULT 0,
+		hidden BOOLEAN NOT NULL DEFAULT 0,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY(conference_id) REFERENCES conferences(id),
 		FOREIGN KEY(from_user_id) REFERENCES users(id)
@@ -145,6 +238,45 @@ func (s *SQLiteStorage) initSchema() error {
 
 	CREATE INDEX IF NOT EXISTS idx_conference_messages_conf ON conference_messages(conference_id);
 
+	CREATE TABLE IF NOT EXISTS conference_membership (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		conference_id INTEGER NOT NULL,
+		peer_id TEXT NOT NULL,
+		username TEXT NOT NULL,
+		tag TEXT UNIQUE NOT NULL,
+		removed BOOLEAN DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(conference_id) REFERENCES conferences(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_conference_membership_conf ON conference_membership(conference_id);
+
+	CREATE TABLE IF NOT EXISTS conference_channels (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		conference_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(conference_id, name),
+		FOREIGN KEY(conference_id) REFERENCES conferences(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS conference_rate_limits (
+		conference_id INTEGER PRIMARY KEY,
+		messages INTEGER NOT NULL DEFAULT 0,
+		window_seconds INTEGER NOT NULL DEFAULT 0,
+		slow_mode_seconds INTEGER NOT NULL DEFAULT 0,
+		slow_mode_until DATETIME,
+		version INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(conference_id) REFERENCES conferences(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS conference_observers (
+		conference_id INTEGER PRIMARY KEY,
+		peer_ids TEXT NOT NULL DEFAULT '[]',
+		version INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(conference_id) REFERENCES conferences(id)
+	);
+
 	CREATE TABLE IF NOT EXISTS known_peers (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		peer_id TEXT UNIQUE NOT NULL,
@@ -155,18 +287,364 @@ func (s *SQLiteStorage) initSchema() error {
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_known_peers_peer_id ON known_peers(peer_id);
+
+	CREATE TABLE IF NOT EXISTS node_identity (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		private_key BLOB NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS account_keys (
+		user_id INTEGER PRIMARY KEY,
+		private_key BLOB NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS peer_scores (
+		peer_id TEXT PRIMARY KEY,
+		score REAL NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS settings (
+		user_id INTEGER NOT NULL,
+		friend_id INTEGER NOT NULL DEFAULT 0,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, friend_id, name),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS push_endpoints (
+		peer_id TEXT PRIMARY KEY,
+		relay TEXT NOT NULL,
+		token TEXT NOT NULL,
+		key BLOB NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS username_aliases (
+		username TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		expires_at DATETIME NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_username_aliases_user ON username_aliases(user_id);
+
+	CREATE TABLE IF NOT EXISTS deletion_notices (
+		peer_id TEXT PRIMARY KEY,
+		notice TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS known_peer_addrs (
+		peer_id TEXT NOT NULL,
+		addr TEXT NOT NULL,
+		successes INTEGER NOT NULL DEFAULT 0,
+		first_success DATETIME NOT NULL,
+		last_success DATETIME NOT NULL,
+		PRIMARY KEY (peer_id, addr)
+	);
+
+	CREATE TABLE IF NOT EXISTS activity (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		peer_id TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL DEFAULT '',
+		conference_id INTEGER NOT NULL DEFAULT 0,
+		detail TEXT NOT NULL DEFAULT '',
+		count INTEGER NOT NULL DEFAULT 1,
+		seen BOOLEAN NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_activity_user ON activity(user_id, id);
+
+	CREATE TABLE IF NOT EXISTS conference_reads (
+		user_id INTEGER NOT NULL,
+		conference_id INTEGER NOT NULL,
+		last_read_id INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, conference_id),
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		FOREIGN KEY (conference_id) REFERENCES conferences(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS roster_copies (
+		user_id INTEGER NOT NULL,
+		friend_id INTEGER NOT NULL,
+		entries TEXT NOT NULL DEFAULT '[]',
+		received_at DATETIME NOT NULL,
+		PRIMARY KEY (user_id, friend_id),
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		FOREIGN KEY (friend_id) REFERENCES users(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS conference_summaries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		conference_id INTEGER NOT NULL,
+		channel TEXT NOT NULL DEFAULT '',
+		from_lamport INTEGER NOT NULL,
+		to_lamport INTEGER NOT NULL,
+		started_at DATETIME NOT NULL,
+		ended_at DATETIME NOT NULL,
+		messages INTEGER NOT NULL,
+		policy TEXT NOT NULL,
+		content TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (conference_id) REFERENCES conferences(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_conference_summaries_conf ON conference_summaries(conference_id, started_at);
+
+	-- Why each try at delivering a direct message failed, until it is delivered
+	CREATE TABLE IF NOT EXISTS delivery_attempts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id INTEGER NOT NULL,
+		reason TEXT NOT NULL,
+		detail TEXT NOT NULL DEFAULT '',
+		attempted_at DATETIME NOT NULL,
+		FOREIGN KEY (message_id) REFERENCES messages(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_delivery_attempts_message ON delivery_attempts(message_id, id);
+
+	-- Peers that claimed to be a contact, and what they sent, until trusted
+	CREATE TABLE IF NOT EXISTS identity_candidates (
+		contact_id INTEGER PRIMARY KEY,
+		peer_id TEXT NOT NULL,
+		first_seen_at DATETIME NOT NULL,
+		FOREIGN KEY (contact_id) REFERENCES users(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS quarantined_messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		contact_id INTEGER NOT NULL,
+		peer_id TEXT NOT NULL,
+		payload BLOB NOT NULL,
+		received_at DATETIME NOT NULL,
+		FOREIGN KEY (contact_id) REFERENCES users(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_quarantined_messages_contact ON quarantined_messages(contact_id, id);
+
+	-- Small group chats whose messages go to each member as direct messages
+	CREATE TABLE IF NOT EXISTS group_chats (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		uid TEXT NOT NULL,
+		name TEXT NOT NULL,
+		left_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(user_id, uid),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS group_members (
+		group_id INTEGER NOT NULL,
+		peer_id TEXT NOT NULL,
+		username TEXT NOT NULL,
+		PRIMARY KEY (group_id, peer_id),
+		FOREIGN KEY (group_id) REFERENCES group_chats(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS group_messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		group_id INTEGER NOT NULL,
+		from_peer_id TEXT NOT NULL,
+		from_username TEXT NOT NULL,
+		remote_id INTEGER NOT NULL DEFAULT 0,
+		outgoing BOOLEAN NOT NULL DEFAULT 0,
+		content TEXT NOT NULL,
+		kind TEXT NOT NULL DEFAULT 'user',
+		leaving BOOLEAN NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		received_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (group_id) REFERENCES group_chats(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_group_messages_group ON group_messages(group_id, created_at);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_group_messages_remote ON group_messages(group_id, from_peer_id, remote_id) WHERE outgoing = 0;
+
+	-- How far each of the user's group messages got with each member
+	CREATE TABLE IF NOT EXISTS group_deliveries (
+		message_id INTEGER NOT NULL,
+		peer_id TEXT NOT NULL,
+		username TEXT NOT NULL,
+		delivered BOOLEAN NOT NULL DEFAULT 0,
+		delivered_at DATETIME,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		reason TEXT NOT NULL DEFAULT '',
+		attempted_at DATETIME,
+		PRIMARY KEY (message_id, peer_id),
+		FOREIGN KEY (message_id) REFERENCES group_messages(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_group_deliveries_pending ON group_deliveries(peer_id) WHERE delivered = 0;
 	`
 
 	_, err := s.db.Exec(schema)
 	return err
 }
 
+// migrate adds columns introduced after the initial schema
+func (s *SQLiteStorage) migrate() error {
+	migrations := []struct {
+		table      string
+		column     string
+		definition string
+	}{
+		{"messages", "kind", "TEXT NOT NULL DEFAULT 'user'"},
+		{"conference_messages", "kind", "TEXT NOT NULL DEFAULT 'user'"},
+		{"messages", "lamport", "INTEGER NOT NULL DEFAULT 0"},
+		{"conference_messages", "lamport", "INTEGER NOT NULL DEFAULT 0"},
+		{"messages", "seq", "INTEGER NOT NULL DEFAULT 0"},
+		{"messages", "hidden", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"conference_messages", "hidden", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"conferences", "max_participants", "INTEGER NOT NULL DEFAULT 0"},
+		{"conference_messages", "channel", "TEXT NOT NULL DEFAULT ''"},
+		{"messages", "forwarded_from", "TEXT NOT NULL DEFAULT ''"},
+		{"messages", "quote", "TEXT NOT NULL DEFAULT ''"},
+		{"messages", "preview", "TEXT NOT NULL DEFAULT ''"},
+		{"messages", "conversation_id", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "remote_username", "TEXT NOT NULL DEFAULT ''"},
+		{"friends", "rejected_at", "DATETIME"},
+		{"friends", "auto_dial", "BOOLEAN NOT NULL DEFAULT 1"},
+		{"users", "status_message", "TEXT NOT NULL DEFAULT ''"},
+		{"friends", "status_message", "TEXT NOT NULL DEFAULT ''"},
+		{"messages", "expires_at", "DATETIME"},
+		{"messages", "failed", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"messages", "failed_at", "DATETIME"},
+		{"messages", "received_at", "DATETIME"},
+		{"known_peers", "reputation", "REAL NOT NULL DEFAULT 0"},
+		{"known_peers", "invalid_messages", "INTEGER NOT NULL DEFAULT 0"},
+		{"known_peers", "rate_limited", "INTEGER NOT NULL DEFAULT 0"},
+		{"known_peers", "rejected_requests", "INTEGER NOT NULL DEFAULT 0"},
+		{"known_peers", "reputation_at", "DATETIME"},
+		{"known_peers", "version", "TEXT NOT NULL DEFAULT ''"},
+		{"known_peers", "platform", "TEXT NOT NULL DEFAULT ''"},
+	}
+
+	for _, m := range migrations {
+		if err := s.addColumnIfMissing(m.table, m.column, m.definition); err != nil {
+			return fmt.Errorf("failed to add %s.%s: %w", m.table, m.column, err)
+		}
+	}
+
+	// Indexes on migrated columns can only be created once the columns exist
+	indexes := []string{
+		`CREATE INDEX IF NOT EXISTS idx_messages_seq ON messages(from_user_id, to_user_id, seq)`,
+		`CREATE INDEX IF NOT EXISTS idx_conference_messages_lamport ON conference_messages(conference_id, lamport)`,
+		`CREATE INDEX IF NOT EXISTS idx_conference_messages_channel ON conference_messages(conference_id, channel, lamport)`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_conversation ON messages(conversation_id, hidden, lamport, created_at)`,
+	}
+
+	for _, index := range indexes {
+		if _, err := s.db.Exec(index); err != nil {
+			return fmt.Errorf("failed to create index: %w", err)
+		}
+	}
+
+	// Key rows written before conversation_id existed; must match conversationID
+	if _, err := s.db.Exec(`
+		UPDATE messages
+		SET conversation_id = MIN(from_user_id, to_user_id) || ':' || MAX(from_user_id, to_user_id)
+		WHERE conversation_id = ''
+	`); err != nil {
+		return fmt.Errorf("failed to set conversation IDs: %w", err)
+	}
+
+	if err := s.moveMessageBodies(); err != nil {
+		return fmt.Errorf("failed to move message bodies: %w", err)
+	}
+	return nil
+}
+
+// moveMessageBodies moves content still stored inline in messages into
+// message_bodies, leaving a preview behind
+func (s *SQLiteStorage) moveMessageBodies() error {
+	rows, err := s.db.Query(`SELECT id, content FROM messages WHERE content != ''`)
+	if err != nil {
+		return err
+	}
+	bodies := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var content string
+		if err := rows.Scan(&id, &content); err != nil {
+			rows.Close()
+			return err
+		}
+		bodies[id] = content
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(bodies) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for id, content := range bodies {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO message_bodies (message_id, content) VALUES (?, ?)`, id, content); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE messages SET content = '', preview = ? WHERE id = ?`, snippet(content, ConversationSnippetLength), id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// addColumnIfMissing adds a column to a table unless it already exists
+func (s *SQLiteStorage) addColumnIfMissing(table, column, definition string) error {
+	rows, err := s.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
 // User operations
 func (s *SQLiteStorage) CreateUser(ctx context.Context, user *User) error {
+	defer s.observe("CreateUser", time.Now())
 	result, err := s.db.ExecContext(ctx, `
-		INSERT INTO users (username, password_hash, full_name, peer_id)
-		VALUES (?, ?, ?, ?)
-	`, user.Username, user.PasswordHash, user.FullName, user.PeerID)
+		INSERT INTO users (username, remote_username, password_hash, full_name, peer_id)
+		VALUES (?, ?, ?, ?, ?)
+	`, user.Username, user.RemoteUsername, user.PasswordHash, user.FullName, user.PeerID)
 	if err != nil {
 		return err
 	}
@@ -175,413 +653,2108 @@ func (s *SQLiteStorage) CreateUser(ctx context.Context, user *User) error {
 }
 
 func (s *SQLiteStorage) GetUserByID(ctx context.Context, id int64) (*User, error) {
-	user := &User{}
-	err := s.db.QueryRowContext(ctx, `
-		SELECT id, username, password_hash, full_name, peer_id, created_at, updated_at
+	defer s.observe("GetUserByID", time.Now())
+	user, err := scanUser(s.db.QueryRowContext(ctx, `
+		SELECT `+userColumns+`
 		FROM users WHERE id = ?
-	`, id).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.FullName, &user.PeerID, &user.CreatedAt, &user.UpdatedAt)
+	`, id))
 	if err == sql.ErrNoRows {
-		return nil, nil
+		return nil, ErrNotFound
 	}
 	return user, err
 }
 
 func (s *SQLiteStorage) GetUserByUsername(ctx context.Context, username string) (*User, error) {
-	user := &User{}
-	err := s.db.QueryRowContext(ctx, `
-		SELECT id, username, password_hash, full_name, peer_id, created_at, updated_at
+	defer s.observe("GetUserByUsername", time.Now())
+	user, err := scanUser(s.db.QueryRowContext(ctx, `
+		SELECT `+userColumns+`
 		FROM users WHERE username = ?
-	`, username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.FullName, &user.PeerID, &user.CreatedAt, &user.UpdatedAt)
+	`, username))
 	if err == sql.ErrNoRows {
-		return nil, nil
+		return nil, ErrNotFound
 	}
 	return user, err
 }
 
 func (s *SQLiteStorage) GetUserByPeerID(ctx context.Context, peerID string) (*User, error) {
-	user := &User{}
-	err := s.db.QueryRowContext(ctx, `
-		SELECT id, username, password_hash, full_name, peer_id, created_at, updated_at
+	defer s.observe("GetUserByPeerID", time.Now())
+	user, err := scanUser(s.db.QueryRowContext(ctx, `
+		SELECT `+userColumns+`
 		FROM users WHERE peer_id = ?
-	`, peerID).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.FullName, &user.PeerID, &user.CreatedAt, &user.UpdatedAt)
+	`, peerID))
 	if err == sql.ErrNoRows {
-		return nil, nil
+		return nil, ErrNotFound
 	}
 	return user, err
 }
 
 func (s *SQLiteStorage) UpdateUser(ctx context.Context, user *User) error {
+	defer s.observe("UpdateUser", time.Now())
 	user.UpdatedAt = time.Now()
 	_, err := s.db.ExecContext(ctx, `
-		UPDATE users SET password_hash = ?, full_name = ?, peer_id = ?, updated_at = ?
+		UPDATE users SET password_hash = ?, full_name = ?, status_message = ?, peer_id = ?, updated_at = ?
 		WHERE id = ?
-	`, user.PasswordHash, user.FullName, user.PeerID, user.UpdatedAt, user.ID)
+	`, user.PasswordHash, user.FullName, user.StatusMessage, user.PeerID, user.UpdatedAt, user.ID)
 	return err
 }
 
-func (s *SQLiteStorage) SearchUsersByName(ctx context.Context, name string) ([]*User, error) {
-	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, username, password_hash, full_name, peer_id, created_at, updated_at
-		FROM users WHERE full_name LIKE ?
-	`, "%"+name+"%")
+// ContactHandle returns the local username for a new contact registered as
+// username: the name itself while it is free, otherwise the name with the end
+// of their peer ID appended (bob#1a2b)
+func (s *SQLiteStorage) ContactHandle(ctx context.Context, username, peerID string) (string, error) {
+	defer s.observe("ContactHandle", time.Now())
+	candidate := username
+	for n := 4; ; n += 2 {
+		var count int
+		if err := s.db.QueryRowContext(ctx, `
+			SELECT COUNT(*) FROM users WHERE username = ?
+		`, candidate).Scan(&count); err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return candidate, nil
+		}
+		if n > len(peerID) {
+			return "", ErrHandleTaken
+		}
+		candidate = username + "#" + peerID[len(peerID)-n:]
+	}
+}
+
+// RenameContact changes the local username of a contact from another peer.
+// The name they registered with is kept in remote_username for the wire.
+func (s *SQLiteStorage) RenameContact(ctx context.Context, userID int64, handle string) error {
+	defer s.observe("RenameContact", time.Now())
+	user, err := s.GetUserByID(ctx, userID)
+	if errors.Is(err, ErrNotFound) || (err == nil && !user.IsRemote()) {
+		return ErrNotContact
+	}
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
 
-	users := []*User{}
-	for rows.Next() {
-		user := &User{}
-		if err := rows.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.FullName, &user.PeerID, &user.CreatedAt, &user.UpdatedAt); err != nil {
-			return nil, err
-		}
-		users = append(users, user)
+	remote := user.RemoteName()
+	if remote == handle {
+		remote = ""
 	}
-	return users, rows.Err()
+	return s.renameUser(ctx, user, handle, remote, false)
 }
 
-// Friend operations
-func (s *SQLiteStorage) CreateFriendRequest(ctx context.Context, friend *Friend) error {
-	result, err := s.db.ExecContext(ctx, `
-		INSERT INTO friends (user_id, friend_id, peer_id, username, full_name, status)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, friend.UserID, friend.FriendID, friend.PeerID, friend.Username, friend.FullName, friend.Status)
+// RenameAccount changes the username of an account on this node. The old
+// name keeps resolving to the account for UsernameAliasLifetime.
+func (s *SQLiteStorage) RenameAccount(ctx context.Context, userID int64, username string) error {
+	defer s.observe("RenameAccount", time.Now())
+	user, err := s.GetUserByID(ctx, userID)
+	if errors.Is(err, ErrNotFound) || (err == nil && user.IsRemote()) {
+		return ErrNotAccount
+	}
 	if err != nil {
 		return err
 	}
-	friend.ID, _ = result.LastInsertId()
-	return nil
+	return s.renameUser(ctx, user, username, user.RemoteUsername, true)
 }
 
-func (s *SQLiteStorage) GetFriendRequest(ctx context.Context, userID, friendID int64) (*Friend, error) {
-	friend := &Friend{}
-	var acceptedAt sql.NullTime
-	err := s.db.QueryRowContext(ctx, `
-		SELECT id, user_id, friend_id, peer_id, username, full_name, status, created_at, accepted_at
-		FROM friends WHERE user_id = ? AND friend_id = ?
-	`, userID, friendID).Scan(&friend.ID, &friend.UserID, &friend.FriendID, &friend.PeerID, &friend.Username, &friend.FullName, &friend.Status, &friend.CreatedAt, &acceptedAt)
-	if err == sql.ErrNoRows {
-		return nil, nil
+// RecordContactRename records that a contact from another peer now goes by
+// remoteName, shown locally as handle. When the handle changes, the old one
+// keeps resolving to the contact for UsernameAliasLifetime.
+func (s *SQLiteStorage) RecordContactRename(ctx context.Context, userID int64, remoteName, handle string) error {
+	defer s.observe("RecordContactRename", time.Now())
+	user, err := s.GetUserByID(ctx, userID)
+	if errors.Is(err, ErrNotFound) || (err == nil && !user.IsRemote()) {
+		return ErrNotContact
 	}
-	if acceptedAt.Valid {
-		friend.AcceptedAt = acceptedAt.Time
+	if err != nil {
+		return err
 	}
-	return friend, err
+	if remoteName == handle {
+		remoteName = ""
+	}
+	return s.renameUser(ctx, user, handle, remoteName, true)
 }
 
-func (s *SQLiteStorage) UpdateFriendRequest(ctx context.Context, friend *Friend) error {
-	_, err := s.db.ExecContext(ctx, `
-		UPDATE friends SET status = ?, accepted_at = ?
+// renameUser sets a user's username and remote_username. If the username
+// changed and keepAlias is set, the old one is kept as an alias.
+func (s *SQLiteStorage) renameUser(ctx context.Context, user *User, username, remoteUsername string, keepAlias bool) error {
+	var count int
+	if err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM users WHERE username = ? AND id != ?
+	`, username, user.ID).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrHandleTaken
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE users SET username = ?, remote_username = ?, updated_at = ?
 		WHERE id = ?
-	`, friend.Status, friend.AcceptedAt, friend.ID)
-	return err
+	`, username, remoteUsername, time.Now(), user.ID); err != nil {
+		return err
+	}
+	// Friend rows carry a copy of the contact's name
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE friends SET username = ? WHERE peer_id = ?
+	`, username, user.PeerID); err != nil {
+		return err
+	}
+	if username != user.Username {
+		// A name in use again is no longer anyone's alias
+		if _, err := tx.ExecContext(ctx, `
+			DELETE FROM username_aliases WHERE username = ?
+		`, username); err != nil {
+			return err
+		}
+	}
+	if username != user.Username && keepAlias {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT OR REPLACE INTO username_aliases (username, user_id, expires_at)
+			VALUES (?, ?, ?)
+		`, user.Username, user.ID, time.Now().Add(UsernameAliasLifetime)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func (s *SQLiteStorage) GetFriends(ctx context.Context, userID int64) ([]*Friend, error) {
+// GetUserByAlias returns the user a former username still resolves to, or
+// ErrNotFound if it isn't an alias or the alias has expired
+func (s *SQLiteStorage) GetUserByAlias(ctx context.Context, username string) (*User, error) {
+	defer s.observe("GetUserByAlias", time.Now())
+	user, err := scanUser(s.db.QueryRowContext(ctx, `
+		SELECT `+qualifyColumns("u", userColumns)+`
+		FROM username_aliases a
+		JOIN users u ON u.id = a.user_id
+		WHERE a.username = ? COLLATE NOCASE AND a.expires_at > ?
+		ORDER BY a.expires_at DESC
+		LIMIT 1
+	`, username, time.Now()))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return user, err
+}
+
+// GetUsernameAliases returns a user's former usernames that haven't expired
+func (s *SQLiteStorage) GetUsernameAliases(ctx context.Context, userID int64) ([]*UsernameAlias, error) {
+	defer s.observe("GetUsernameAliases", time.Now())
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, user_id, friend_id, peer_id, username, full_name, status, created_at, accepted_at
-		FROM friends WHERE user_id = ? AND status = 'accepted'
-	`, userID)
+		SELECT username, user_id, expires_at FROM username_aliases
+		WHERE user_id = ? AND expires_at > ?
+		ORDER BY expires_at
+	`, userID, time.Now())
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	friends := []*Friend{}
+	aliases := []*UsernameAlias{}
 	for rows.Next() {
-		friend := &Friend{}
-		var acceptedAt sql.NullTime
-		if err := rows.Scan(&friend.ID, &friend.UserID, &friend.FriendID, &friend.PeerID, &friend.Username, &friend.FullName, &friend.Status, &friend.CreatedAt, &acceptedAt); err != nil {
+		alias := &UsernameAlias{}
+		if err := rows.Scan(&alias.Username, &alias.UserID, &alias.ExpiresAt); err != nil {
 			return nil, err
 		}
-		if acceptedAt.Valid {
-			friend.AcceptedAt = acceptedAt.Time
+		aliases = append(aliases, alias)
+	}
+	return aliases, rows.Err()
+}
+
+// UpdateContactProfile records the full name and status message a contact
+// from another peer announced, in their user row and the friend rows that
+// carry a copy
+func (s *SQLiteStorage) UpdateContactProfile(ctx context.Context, userID int64, fullName, statusMessage string) error {
+	defer s.observe("UpdateContactProfile", time.Now())
+	user, err := s.GetUserByID(ctx, userID)
+	if errors.Is(err, ErrNotFound) || (err == nil && !user.IsRemote()) {
+		return ErrNotContact
+	}
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE users SET full_name = ?, status_message = ?, updated_at = ?
+		WHERE id = ?
+	`, fullName, statusMessage, time.Now(), userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE friends SET full_name = ?, status_message = ? WHERE peer_id = ?
+	`, fullName, statusMessage, user.PeerID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetUsernameCollisions returns the users, local or remote, who registered
+// under the same username as someone else, grouped by that name
+func (s *SQLiteStorage) GetUsernameCollisions(ctx context.Context) ([]*User, error) {
+	defer s.observe("GetUsernameCollisions", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+userColumns+`
+		FROM users
+		WHERE COALESCE(NULLIF(remote_username, ''), username) IN (
+			SELECT COALESCE(NULLIF(remote_username, ''), username) AS name
+			FROM users
+			GROUP BY name
+			HAVING COUNT(*) > 1
+		)
+		ORDER BY COALESCE(NULLIF(remote_username, ''), username), id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUsers(rows)
+}
+
+// SearchUsersByName matches the full name or username, case-insensitively
+func (s *SQLiteStorage) SearchUsersByName(ctx context.Context, name string) ([]*User, error) {
+	defer s.observe("SearchUsersByName", time.Now())
+	pattern := "%" + escapeLike(name) + "%"
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+userColumns+`
+		FROM users WHERE full_name LIKE ? ESCAPE '\' OR username LIKE ? ESCAPE '\'
+		ORDER BY username COLLATE NOCASE
+	`, pattern, pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUsers(rows)
+}
+
+// GetUsersByUsernameFold returns every user whose username matches ignoring case
+func (s *SQLiteStorage) GetUsersByUsernameFold(ctx context.Context, username string) ([]*User, error) {
+	defer s.observe("GetUsersByUsernameFold", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+userColumns+`
+		FROM users WHERE username = ? COLLATE NOCASE
+		ORDER BY username
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUsers(rows)
+}
+
+// SearchUsersByUsernamePrefix returns users whose username starts with prefix, ignoring case
+func (s *SQLiteStorage) SearchUsersByUsernamePrefix(ctx context.Context, prefix string, limit int) ([]*User, error) {
+	defer s.observe("SearchUsersByUsernamePrefix", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+userColumns+`
+		FROM users WHERE username LIKE ? ESCAPE '\'
+		ORDER BY username COLLATE NOCASE
+		LIMIT ?
+	`, escapeLike(prefix)+"%", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUsers(rows)
+}
+
+// GetLocalUsers returns the accounts registered on this node, excluding remote contacts
+func (s *SQLiteStorage) GetLocalUsers(ctx context.Context) ([]*User, error) {
+	defer s.observe("GetLocalUsers", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+userColumns+`
+		FROM users WHERE password_hash != ?
+		ORDER BY username COLLATE NOCASE
+	`, RemoteUserPasswordHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUsers(rows)
+}
+
+// userColumns lists the users columns in the order scanUser reads them
+const userColumns = `id, username, remote_username, password_hash, full_name, status_message, peer_id, created_at, updated_at`
+
+// scanUser scans userColumns from a row
+func scanUser(row rowScanner) (*User, error) {
+	user := &User{}
+	if err := row.Scan(&user.ID, &user.Username, &user.RemoteUsername, &user.PasswordHash, &user.FullName, &user.StatusMessage, &user.PeerID, &user.CreatedAt, &user.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// scanUsers reads user rows selected with userColumns
+func scanUsers(rows *sql.Rows) ([]*User, error) {
+	users := []*User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// escapeLike escapes LIKE wildcards so user input matches literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// Friend operations
+func (s *SQLiteStorage) CreateFriendRequest(ctx context.Context, friend *Friend) error {
+	defer s.observe("CreateFriendRequest", time.Now())
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO friends (user_id, friend_id, peer_id, username, full_name, status_message, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, friend.UserID, friend.FriendID, friend.PeerID, friend.Username, friend.FullName, friend.StatusMessage, friend.Status)
+	if err != nil {
+		return err
+	}
+	friend.ID, _ = result.LastInsertId()
+	return nil
+}
+
+func (s *SQLiteStorage) GetFriendRequest(ctx context.Context, userID, friendID int64) (*Friend, error) {
+	defer s.observe("GetFriendRequest", time.Now())
+	friend, err := scanFriendRow(s.db.QueryRowContext(ctx, `
+		SELECT `+friendColumns+`
+		FROM friends WHERE user_id = ? AND friend_id = ?
+	`, userID, friendID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return friend, err
+}
+
+// GetFriendRequestByID returns a friends row by its ID, or nil if there is none
+func (s *SQLiteStorage) GetFriendRequestByID(ctx context.Context, id int64) (*Friend, error) {
+	defer s.observe("GetFriendRequestByID", time.Now())
+	friend, err := scanFriendRow(s.db.QueryRowContext(ctx, `
+		SELECT `+friendColumns+`
+		FROM friends WHERE id = ?
+	`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return friend, err
+}
+
+// SetFriendAutoDial turns automatic dialing of a friend on or off
+func (s *SQLiteStorage) SetFriendAutoDial(ctx context.Context, userID, friendID int64, enabled bool) error {
+	defer s.observe("SetFriendAutoDial", time.Now())
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE friends SET auto_dial = ? WHERE user_id = ? AND friend_id = ? AND status = 'accepted'
+	`, enabled, userID, friendID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFriends
+	}
+	return nil
+}
+
+// UpdateFriendRequest saves a request's status, peer ID and full name. The
+// rejection time is stamped the first time the status becomes rejected.
+func (s *SQLiteStorage) UpdateFriendRequest(ctx context.Context, friend *Friend) error {
+	defer s.observe("UpdateFriendRequest", time.Now())
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE friends SET status = ?, accepted_at = ?, peer_id = ?, full_name = ?,
+			rejected_at = CASE WHEN ? = 'rejected' THEN COALESCE(rejected_at, CURRENT_TIMESTAMP) END
+		WHERE id = ?
+	`, friend.Status, friend.AcceptedAt, friend.PeerID, friend.FullName, friend.Status, friend.ID)
+	return err
+}
+
+func (s *SQLiteStorage) GetFriends(ctx context.Context, userID int64) ([]*Friend, error) {
+	defer s.observe("GetFriends", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+friendColumns+`
+		FROM friends WHERE user_id = ? AND status = 'accepted'
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	friends := []*Friend{}
+	for rows.Next() {
+		friend, err := scanFriendRow(rows)
+		if err != nil {
+			return nil, err
 		}
 		friends = append(friends, friend)
 	}
-	return friends, rows.Err()
+	return friends, rows.Err()
+}
+
+// GetFriendsFiltered returns accepted friends with unread counts and last
+// message times, filtered, sorted and paginated in SQL
+func (s *SQLiteStorage) GetFriendsFiltered(ctx context.Context, userID int64, filter FriendFilter) ([]*FriendSummary, error) {
+	defer s.observe("GetFriendsFiltered", time.Now())
+	// Online status is supplied by the caller; match it with an IN list
+	onlineExpr := "0"
+	args := []interface{}{}
+	if len(filter.OnlinePeerIDs) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(filter.OnlinePeerIDs)), ",")
+		onlineExpr = "f.peer_id IN (" + placeholders + ")"
+		for _, id := range filter.OnlinePeerIDs {
+			args = append(args, id)
+		}
+	}
+
+	query := `
+		SELECT * FROM (
+			SELECT ` + qualifyColumns("f", friendColumns) + `,
+				` + onlineExpr + ` AS online,
+				(SELECT COUNT(*) FROM messages m
+					WHERE m.from_user_id = f.friend_id AND m.to_user_id = f.user_id
+					AND m.read = 0 AND m.kind = 'user' AND m.hidden = 0) AS unread_count,
+				(SELECT MAX(m.created_at) FROM messages m
+					WHERE ((m.from_user_id = f.user_id AND m.to_user_id = f.friend_id)
+					OR (m.from_user_id = f.friend_id AND m.to_user_id = f.user_id))
+					AND m.hidden = 0) AS last_message_at,
+				(SELECT kp.last_seen FROM known_peers kp WHERE kp.peer_id = f.peer_id) AS last_seen,
+				(SELECT kp.version FROM known_peers kp WHERE kp.peer_id = f.peer_id) AS version,
+				(SELECT kp.platform FROM known_peers kp WHERE kp.peer_id = f.peer_id) AS platform
+			FROM friends f
+			WHERE f.user_id = ? AND f.status = 'accepted'
+		)
+		WHERE 1 = 1`
+	args = append(args, userID)
+
+	if filter.OnlineOnly {
+		query += " AND online = 1"
+	}
+	if filter.UnreadOnly {
+		query += " AND unread_count > 0"
+	}
+
+	switch filter.SortBy {
+	case FriendSortLastMessage:
+		query += " ORDER BY last_message_at IS NULL, last_message_at DESC, full_name COLLATE NOCASE"
+	case FriendSortOnline:
+		query += " ORDER BY online DESC, full_name COLLATE NOCASE"
+	default:
+		query += " ORDER BY full_name COLLATE NOCASE"
+	}
+
+	if filter.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, filter.Limit, filter.Offset)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := []*FriendSummary{}
+	for rows.Next() {
+		summary := &FriendSummary{}
+		var lastSeen sql.NullTime
+		var lastMessageAt, version, platform sql.NullString
+		friend, err := scanFriendRow(rows, &summary.Online, &summary.UnreadCount, &lastMessageAt, &lastSeen, &version, &platform)
+		if err != nil {
+			return nil, err
+		}
+		summary.Friend = friend
+		if lastMessageAt.Valid {
+			summary.LastMessageAt = parseTimestamp(lastMessageAt.String)
+		}
+		if lastSeen.Valid {
+			summary.LastSeen = lastSeen.Time
+		}
+		summary.Version, summary.Platform = version.String, platform.String
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
+
+// parseTimestamp parses a timestamp returned by an SQL expression, which the
+// driver hands back as text rather than time.Time
+func parseTimestamp(value string) time.Time {
+	for _, format := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.ParseInLocation(format, value, time.UTC); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// GetOutgoingFriendRequests returns the requests userID has sent, newest first,
+// whatever their status. Accepting a request also stores a reciprocal accepted
+// row; a sent request is the one of a pair that was stored first.
+func (s *SQLiteStorage) GetOutgoingFriendRequests(ctx context.Context, userID int64) ([]*Friend, error) {
+	defer s.observe("GetOutgoingFriendRequests", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+qualifyColumns("f", friendColumns)+`
+		FROM friends f
+		WHERE f.user_id = ? AND NOT EXISTS (
+			SELECT 1 FROM friends r
+			WHERE r.user_id = f.friend_id AND r.friend_id = f.user_id AND r.id < f.id
+		)
+		ORDER BY f.created_at DESC, f.id DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []*Friend{}
+	for rows.Next() {
+		friend, err := scanFriendRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, friend)
+	}
+	return requests, rows.Err()
+}
+
+func (s *SQLiteStorage) GetPendingFriendRequests(ctx context.Context, userID int64) ([]*Friend, error) {
+	defer s.observe("GetPendingFriendRequests", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+friendColumns+`
+		FROM friends WHERE friend_id = ? AND status = 'pending'
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []*Friend{}
+	for rows.Next() {
+		friend, err := scanFriendRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, friend)
+	}
+	return requests, rows.Err()
+}
+
+// friendColumns lists the friends columns in the order scanFriendRow reads them
+const friendColumns = `id, user_id, friend_id, peer_id, username, full_name, status_message, status, created_at, accepted_at, rejected_at, auto_dial`
+
+// rowScanner is the Scan method shared by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanFriendRow scans friendColumns from a row, followed by any extra columns
+func scanFriendRow(row rowScanner, extra ...interface{}) (*Friend, error) {
+	friend := &Friend{}
+	var acceptedAt, rejectedAt sql.NullTime
+	dest := []interface{}{&friend.ID, &friend.UserID, &friend.FriendID, &friend.PeerID, &friend.Username, &friend.FullName, &friend.StatusMessage, &friend.Status, &friend.CreatedAt, &acceptedAt, &rejectedAt, &friend.AutoDial}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	if acceptedAt.Valid {
+		friend.AcceptedAt = acceptedAt.Time
+	}
+	if rejectedAt.Valid {
+		friend.RejectedAt = rejectedAt.Time
+	}
+	return friend, nil
+}
+
+// Message operations
+
+// messageColumns lists the messages columns in the order scanMessageRow reads them.
+// The body is not among them; see messageBodyJoin.
+const messageColumns = `id, from_user_id, to_user_id, from_peer_id, to_peer_id, preview, kind, lamport, seq, forwarded_from, quote, delivered, read, created_at, delivered_at, read_at, expires_at, failed, failed_at, received_at`
+
+// messageBodyJoin selects messageColumns followed by the body, from messages
+// joined with message_bodies. Queries using it add their own WHERE clause.
+const messageBodyJoin = `
+		SELECT ` + messageColumns + `, COALESCE(b.content, '')
+		FROM messages
+		LEFT JOIN message_bodies b ON b.message_id = messages.id`
+
+// scanMessages reads message rows selected with messageBodyJoin and closes rows
+func scanMessages(rows *sql.Rows) ([]*Message, error) {
+	defer rows.Close()
+
+	messages := []*Message{}
+	for rows.Next() {
+		var content string
+		msg, err := scanMessageRow(rows, &content)
+		if err != nil {
+			return nil, err
+		}
+		msg.Content = content
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// scanMessageRow scans messageColumns from the current row, followed by any extra columns
+func scanMessageRow(rows *sql.Rows, extra ...interface{}) (*Message, error) {
+	msg := &Message{}
+	var forwarded, quote string
+	var deliveredAt, readAt, expiresAt, failedAt, receivedAt sql.NullTime
+	dest := []interface{}{&msg.ID, &msg.FromUserID, &msg.ToUserID, &msg.FromPeerID, &msg.ToPeerID, &msg.Preview, &msg.Kind, &msg.Lamport, &msg.Seq, &forwarded, &quote, &msg.Delivered, &msg.Read, &msg.CreatedAt, &deliveredAt, &readAt, &expiresAt, &msg.Failed, &failedAt, &receivedAt}
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	if forwarded != "" {
+		msg.Forwarded = &ForwardInfo{}
+		if err := json.Unmarshal([]byte(forwarded), msg.Forwarded); err != nil {
+			return nil, fmt.Errorf("failed to decode forward info of message %d: %w", msg.ID, err)
+		}
+	}
+	if quote != "" {
+		msg.Quote = &QuoteInfo{}
+		if err := json.Unmarshal([]byte(quote), msg.Quote); err != nil {
+			return nil, fmt.Errorf("failed to decode quote of message %d: %w", msg.ID, err)
+		}
+	}
+	if deliveredAt.Valid {
+		msg.DeliveredAt = deliveredAt.Time
+	}
+	if readAt.Valid {
+		msg.ReadAt = readAt.Time
+	}
+	if expiresAt.Valid {
+		msg.ExpiresAt = expiresAt.Time
+	}
+	if failedAt.Valid {
+		msg.FailedAt = failedAt.Time
+	}
+	if receivedAt.Valid {
+		msg.ReceivedAt = receivedAt.Time
+	}
+	return msg, nil
+}
+
+// GetConversations returns one summary per direct conversation, newest first,
+// with the last message, unread count and the other user's online status
+func (s *SQLiteStorage) GetConversations(ctx context.Context, userID int64, onlinePeerIDs []string) ([]*ConversationSummary, error) {
+	defer s.observe("GetConversations", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		WITH ranked AS (
+			SELECT `+messageColumns+`,
+				CASE WHEN from_user_id = ? THEN to_user_id ELSE from_user_id END AS other_id,
+				ROW_NUMBER() OVER (
+					PARTITION BY CASE WHEN from_user_id = ? THEN to_user_id ELSE from_user_id END
+					ORDER BY lamport DESC, created_at DESC, id DESC
+				) AS rn
+			FROM messages
+			WHERE (from_user_id = ? OR to_user_id = ?) AND hidden = 0
+		)
+		SELECT `+qualifyColumns("last", messageColumns)+`, u.id, u.username, u.full_name, u.peer_id,
+			(SELECT COUNT(*) FROM messages m
+				WHERE m.from_user_id = u.id AND m.to_user_id = ?
+				AND m.read = 0 AND m.kind = 'user' AND m.hidden = 0) AS unread_count
+		FROM (SELECT * FROM ranked WHERE rn = 1) AS last
+		JOIN users u ON u.id = last.other_id
+		ORDER BY last.created_at DESC, last.id DESC
+	`, userID, userID, userID, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	online := make(map[string]bool, len(onlinePeerIDs))
+	for _, id := range onlinePeerIDs {
+		online[id] = true
+	}
+
+	conversations := []*ConversationSummary{}
+	for rows.Next() {
+		conv := &ConversationSummary{}
+		msg, err := scanMessageRow(rows, &conv.UserID, &conv.Username, &conv.FullName, &conv.PeerID, &conv.UnreadCount)
+		if err != nil {
+			return nil, err
+		}
+		conv.LastMessage = msg
+		conv.Snippet = msg.Preview
+		conv.Online = online[conv.PeerID]
+		conversations = append(conversations, conv)
+	}
+	return conversations, rows.Err()
+}
+
+// conversationID returns the key shared by every message between two users,
+// whichever of them sent it
+func conversationID(userID, otherUserID int64) string {
+	if otherUserID < userID {
+		userID, otherUserID = otherUserID, userID
+	}
+	return fmt.Sprintf("%d:%d", userID, otherUserID)
+}
+
+// qualifyColumns prefixes each column in a comma-separated list with a table alias
+func qualifyColumns(alias, columns string) string {
+	return alias + "." + strings.ReplaceAll(columns, ", ", ", "+alias+".")
+}
+
+// snippet shortens content to at most n runes on a single line
+func snippet(content string, n int) string {
+	content = strings.Join(strings.Fields(content), " ")
+	runes := []rune(content)
+	if len(runes) <= n {
+		return content
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+func (s *SQLiteStorage) SaveMessage(ctx context.Context, message *Message) error {
+	defer s.observe("SaveMessage", time.Now())
+	if err := s.checkQuota(QuotaMessages); err != nil {
+		return err
+	}
+	// Assign the next logical clock value if the caller didn't supply one
+	if message.Lamport == 0 {
+		lamport, err := s.NextMessageLamport(ctx, message.FromUserID, message.ToUserID)
+		if err != nil {
+			return err
+		}
+		message.Lamport = lamport
+	}
+
+	forwarded, quote := "", ""
+	if message.Forwarded != nil {
+		data, err := json.Marshal(message.Forwarded)
+		if err != nil {
+			return fmt.Errorf("failed to encode forward info: %w", err)
+		}
+		forwarded = string(data)
+	}
+	if message.Quote != nil {
+		data, err := json.Marshal(message.Quote)
+		if err != nil {
+			return fmt.Errorf("failed to encode quote: %w", err)
+		}
+		quote = string(data)
+	}
+
+	message.Preview = snippet(message.Content, ConversationSnippetLength)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO messages (from_user_id, to_user_id, conversation_id, from_peer_id, to_peer_id, content, preview, kind, lamport, seq, forwarded_from, quote, delivered, read, expires_at, received_at)
+		VALUES (?, ?, ?, ?, ?, '', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, message.FromUserID, message.ToUserID, conversationID(message.FromUserID, message.ToUserID), message.FromPeerID, message.ToPeerID, message.Preview, NormalizeKind(message.Kind), message.Lamport, message.Seq, forwarded, quote, message.Delivered, message.Read, sql.NullTime{Time: message.ExpiresAt, Valid: !message.ExpiresAt.IsZero()}, sql.NullTime{Time: message.ReceivedAt, Valid: !message.ReceivedAt.IsZero()})
+	if err != nil {
+		return err
+	}
+	id, _ := result.LastInsertId()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO message_bodies (message_id, content) VALUES (?, ?)
+	`, id, message.Content); err != nil {
+		return err
+	}
+	if message.Seq > 0 {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO message_seqs (from_user_id, to_user_id, high_seq) VALUES (?, ?, ?)
+			ON CONFLICT(from_user_id, to_user_id) DO UPDATE SET high_seq = MAX(high_seq, excluded.high_seq)
+		`, message.FromUserID, message.ToUserID, message.Seq); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	message.ID = id
+	return nil
+}
+
+// GetMessage returns one direct message the user sent or received, or nil if there is none
+func (s *SQLiteStorage) GetMessage(ctx context.Context, userID, messageID int64) (*Message, error) {
+	defer s.observe("GetMessage", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		`+messageBodyJoin+`
+		WHERE id = ? AND (from_user_id = ? OR to_user_id = ?) AND hidden = 0
+	`, messageID, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := scanMessages(rows)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return messages[0], nil
+}
+
+func (s *SQLiteStorage) GetMessages(ctx context.Context, userID, otherUserID int64, limit int) ([]*Message, error) {
+	defer s.observe("GetMessages", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		`+messageBodyJoin+`
+		WHERE conversation_id = ? AND hidden = 0
+		ORDER BY lamport DESC, created_at DESC
+		LIMIT ?
+	`, conversationID(userID, otherUserID), limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+// StreamConversationRecord calls fn for every message of a direct
+// conversation, oldest first, including the ones the user hid, a page at a
+// time so long conversations never sit in memory. An error from fn stops the
+// stream and is returned.
+func (s *SQLiteStorage) StreamConversationRecord(ctx context.Context, userID, otherUserID int64, fn func(msg *Message, hidden bool) error) error {
+	defer s.observe("StreamConversationRecord", time.Now())
+	var lastLamport, lastID int64
+	for {
+		rows, err := s.db.QueryContext(ctx, `
+			SELECT `+messageColumns+`, COALESCE(b.content, ''), messages.hidden
+			FROM messages
+			LEFT JOIN message_bodies b ON b.message_id = messages.id
+			WHERE conversation_id = ?
+				AND (lamport > ? OR (lamport = ? AND id > ?))
+			ORDER BY lamport ASC, id ASC
+			LIMIT ?
+		`, conversationID(userID, otherUserID), lastLamport, lastLamport, lastID, transcriptPageSize)
+		if err != nil {
+			return err
+		}
+
+		// Read the whole page before calling fn, so no query is open while it runs
+		var page []*Message
+		var hidden []bool
+		for rows.Next() {
+			var content string
+			var isHidden bool
+			msg, err := scanMessageRow(rows, &content, &isHidden)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			msg.Content = content
+			page = append(page, msg)
+			hidden = append(hidden, isHidden)
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return err
+		}
+		rows.Close()
+
+		for i, msg := range page {
+			if err := fn(msg, hidden[i]); err != nil {
+				return err
+			}
+		}
+		if len(page) < transcriptPageSize {
+			return nil
+		}
+		last := page[len(page)-1]
+		lastLamport, lastID = last.Lamport, last.ID
+	}
+}
+
+// HideMessage hides a direct message from the user's history ("delete for me").
+// Only messages the user sent or received can be hidden; the peer is not told.
+func (s *SQLiteStorage) HideMessage(ctx context.Context, userID, messageID int64) error {
+	defer s.observe("HideMessage", time.Now())
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE messages SET hidden = 1
+		WHERE id = ? AND (from_user_id = ? OR to_user_id = ?) AND hidden = 0
+	`, messageID, userID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
+// NextMessageLamport returns the next logical clock value for a direct conversation
+func (s *SQLiteStorage) NextMessageLamport(ctx context.Context, userID, otherUserID int64) (int64, error) {
+	defer s.observe("NextMessageLamport", time.Now())
+	var lamport int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(lamport), 0) + 1
+		FROM messages
+		WHERE conversation_id = ?
+	`, conversationID(userID, otherUserID)).Scan(&lamport)
+	return lamport, err
+}
+
+// NextMessageSeq returns the next sequence number for messages sent from one
+// user to another. It counts pruned messages, so the sequence never restarts.
+func (s *SQLiteStorage) NextMessageSeq(ctx context.Context, fromUserID, toUserID int64) (int64, error) {
+	defer s.observe("NextMessageSeq", time.Now())
+	var seq int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT MAX(
+			COALESCE((SELECT high_seq FROM message_seqs WHERE from_user_id = ?1 AND to_user_id = ?2), 0),
+			COALESCE((SELECT MAX(seq) FROM messages WHERE from_user_id = ?1 AND to_user_id = ?2), 0)
+		) + 1
+	`, fromUserID, toUserID).Scan(&seq)
+	return seq, err
+}
+
+// messageLowWater returns the sequence number at or below which every
+// message from one user to another was received or pruned
+func (s *SQLiteStorage) messageLowWater(ctx context.Context, fromUserID, toUserID int64) (int64, error) {
+	var lowWater int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COALESCE((SELECT low_water FROM message_seqs WHERE from_user_id = ? AND to_user_id = ?), 0)
+	`, fromUserID, toUserID).Scan(&lowWater)
+	return lowWater, err
+}
+
+// GetMissingMessageSeqs returns sequence numbers below upTo that were never
+// received from a sender. Pruned ones are not missing.
+func (s *SQLiteStorage) GetMissingMessageSeqs(ctx context.Context, fromUserID, toUserID, upTo int64) ([]int64, error) {
+	defer s.observe("GetMissingMessageSeqs", time.Now())
+	lowWater, err := s.messageLowWater(ctx, fromUserID, toUserID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT DISTINCT seq
+		FROM messages
+		WHERE from_user_id = ? AND to_user_id = ? AND seq > ? AND seq < ?
+		ORDER BY seq ASC
+	`, fromUserID, toUserID, lowWater, upTo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	missing := []int64{}
+	next := lowWater + 1
+	for rows.Next() {
+		var seq int64
+		if err := rows.Scan(&seq); err != nil {
+			return nil, err
+		}
+		for ; next < seq; next++ {
+			missing = append(missing, next)
+		}
+		next = seq + 1
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for ; next < upTo; next++ {
+		missing = append(missing, next)
+	}
+	return missing, nil
+}
+
+// GetMessagesBySeq returns messages sent from one user to another with the given sequence numbers
+func (s *SQLiteStorage) GetMessagesBySeq(ctx context.Context, fromUserID, toUserID int64, seqs []int64) ([]*Message, error) {
+	defer s.observe("GetMessagesBySeq", time.Now())
+	if len(seqs) == 0 {
+		return []*Message{}, nil
+	}
+
+	placeholders := make([]string, len(seqs))
+	args := []interface{}{fromUserID, toUserID}
+	for i, seq := range seqs {
+		placeholders[i] = "?"
+		args = append(args, seq)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		`+messageBodyJoin+`
+		WHERE from_user_id = ? AND to_user_id = ? AND seq IN (`+strings.Join(placeholders, ", ")+`)
+		ORDER BY seq ASC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+// HasMessageSeq reports whether a message with the sequence number was
+// already stored, including one since pruned
+func (s *SQLiteStorage) HasMessageSeq(ctx context.Context, fromUserID, toUserID, seq int64) (bool, error) {
+	defer s.observe("HasMessageSeq", time.Now())
+	var count int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM messages
+		WHERE from_user_id = ?1 AND to_user_id = ?2 AND seq = ?3
+	`, fromUserID, toUserID, seq).Scan(&count)
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+	lowWater, err := s.messageLowWater(ctx, fromUserID, toUserID)
+	return seq <= lowWater, err
+}
+
+// GetUndeliveredMessages returns messages the user sent that were never
+// delivered and are still worth delivering: not past their deadline or given
+// up on, and not to contacts who have since deleted their account
+func (s *SQLiteStorage) GetUndeliveredMessages(ctx context.Context, userID int64) ([]*Message, error) {
+	defer s.observe("GetUndeliveredMessages", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		`+messageBodyJoin+`
+		WHERE from_user_id = ? AND delivered = 0 AND failed = 0 AND kind = 'user'
+		AND (expires_at IS NULL OR expires_at > ?)
+		AND to_user_id NOT IN (SELECT friend_id FROM friends WHERE user_id = ? AND status = 'deleted')
+		ORDER BY lamport ASC, created_at ASC
+	`, userID, time.Now(), userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+func (s *SQLiteStorage) MarkMessageDelivered(ctx context.Context, messageID int64) error {
+	defer s.observe("MarkMessageDelivered", time.Now())
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE messages SET delivered = 1, delivered_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, messageID)
+	if err != nil {
+		return err
+	}
+
+	// Why earlier tries failed no longer matters
+	_, err = s.db.ExecContext(ctx, `DELETE FROM delivery_attempts WHERE message_id = ?`, messageID)
+	return err
+}
+
+// FailExpiredMessages marks the user's undelivered messages whose delivery
+// deadline has passed as failed, and returns them
+func (s *SQLiteStorage) FailExpiredMessages(ctx context.Context, userID int64) ([]*Message, error) {
+	defer s.observe("FailExpiredMessages", time.Now())
+	now := time.Now()
+	rows, err := s.db.QueryContext(ctx, `
+		`+messageBodyJoin+`
+		WHERE from_user_id = ? AND delivered = 0 AND failed = 0
+		AND expires_at IS NOT NULL AND expires_at <= ?
+		ORDER BY lamport ASC, created_at ASC
+	`, userID, now)
+	if err != nil {
+		return nil, err
+	}
+	expired, err := scanMessages(rows)
+	if err != nil || len(expired) == 0 {
+		return expired, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for _, msg := range expired {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE messages SET failed = 1, failed_at = ? WHERE id = ? AND delivered = 0
+		`, now, msg.ID); err != nil {
+			return nil, err
+		}
+		msg.Failed, msg.FailedAt = true, now
+	}
+	return expired, tx.Commit()
+}
+
+func (s *SQLiteStorage) MarkMessageRead(ctx context.Context, messageID int64) error {
+	defer s.observe("MarkMessageRead", time.Now())
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE messages SET read = 1, read_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, messageID)
+	return err
+}
+
+// Conference operations
+func (s *SQLiteStorage) CreateConference(ctx context.Context, conference *Conference) error {
+	defer s.observe("CreateConference", time.Now())
+	if conference.ID != 0 {
+		// Joining someone else's conference keeps the ID it was invited under
+		_, err := s.db.ExecContext(ctx, `
+			INSERT INTO conferences (id, name, creator_id, max_participants)
+			VALUES (?, ?, ?, ?)
+		`, conference.ID, conference.Name, conference.CreatorID, conference.MaxParticipants)
+		return err
+	}
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO conferences (name, creator_id, max_participants)
+		VALUES (?, ?, ?)
+	`, conference.Name, conference.CreatorID, conference.MaxParticipants)
+	if err != nil {
+		return err
+	}
+	conference.ID, _ = result.LastInsertId()
+	return nil
+}
+
+func (s *SQLiteStorage) GetConference(ctx context.Context, id int64) (*Conference, error) {
+	defer s.observe("GetConference", time.Now())
+	conf := &Conference{}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, name, creator_id, max_participants, created_at
+		FROM conferences WHERE id = ?
+	`, id).Scan(&conf.ID, &conf.Name, &conf.CreatorID, &conf.MaxParticipants, &conf.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return conf, err
+}
+
+func (s *SQLiteStorage) SetConferenceMaxParticipants(ctx context.Context, id int64, max int) error {
+	defer s.observe("SetConferenceMaxParticipants", time.Now())
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE conferences SET max_participants = ? WHERE id = ?
+	`, max, id)
+	return err
+}
+
+func (s *SQLiteStorage) GetUserConferences(ctx context.Context, userID int64) ([]*Conference, error) {
+	defer s.observe("GetUserConferences", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT c.id, c.name, c.creator_id, c.max_participants, c.created_at
+		FROM conferences c
+		INNER JOIN conference_participants cp ON c.id = cp.conference_id
+		WHERE cp.user_id = ? AND cp.active = 1
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conferences := []*Conference{}
+	for rows.Next() {
+		conf := &Conference{}
+		if err := rows.Scan(&conf.ID, &conf.Name, &conf.CreatorID, &conf.MaxParticipants, &conf.CreatedAt); err != nil {
+			return nil, err
+		}
+		conferences = append(conferences, conf)
+	}
+	return conferences, rows.Err()
+}
+
+func (s *SQLiteStorage) AddConferenceParticipant(ctx context.Context, participant *ConferenceParticipant) error {
+	defer s.observe("AddConferenceParticipant", time.Now())
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO conference_participants (conference_id, user_id, peer_id, username, active)
+		VALUES (?, ?, ?, ?, ?)
+	`, participant.ConferenceID, participant.UserID, participant.PeerID, participant.Username, participant.Active)
+	if err != nil {
+		return err
+	}
+	participant.ID, _ = result.LastInsertId()
+	return nil
+}
+
+func (s *SQLiteStorage) RemoveConferenceParticipant(ctx context.Context, conferenceID, userID int64) error {
+	defer s.observe("RemoveConferenceParticipant", time.Now())
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE conference_participants
+		SET active = 0, left_at = CURRENT_TIMESTAMP
+		WHERE conference_id = ? AND user_id = ?
+	`, conferenceID, userID)
+	return err
+}
+
+func (s *SQLiteStorage) GetConferenceParticipants(ctx context.Context, conferenceID int64) ([]*ConferenceParticipant, error) {
+	defer s.observe("GetConferenceParticipants", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, conference_id, user_id, peer_id, username, joined_at, left_at, active
+		FROM conference_participants
+		WHERE conference_id = ? AND active = 1
+	`, conferenceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	participants := []*ConferenceParticipant{}
+	for rows.Next() {
+		p, err := scanConferenceParticipant(rows)
+		if err != nil {
+			return nil, err
+		}
+		participants = append(participants, p)
+	}
+	return participants, rows.Err()
+}
+
+// GetConferenceParticipant returns a user's participant row in a conference,
+// whether or not they are still active
+func (s *SQLiteStorage) GetConferenceParticipant(ctx context.Context, conferenceID, userID int64) (*ConferenceParticipant, error) {
+	defer s.observe("GetConferenceParticipant", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, conference_id, user_id, peer_id, username, joined_at, left_at, active
+		FROM conference_participants
+		WHERE conference_id = ? AND user_id = ?
+		ORDER BY id DESC
+		LIMIT 1
+	`, conferenceID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return scanConferenceParticipant(rows)
+}
+
+// UpdateConferenceParticipant saves changes to an existing participant row
+func (s *SQLiteStorage) UpdateConferenceParticipant(ctx context.Context, participant *ConferenceParticipant) error {
+	defer s.observe("UpdateConferenceParticipant", time.Now())
+	var leftAt interface{}
+	if !participant.LeftAt.IsZero() {
+		leftAt = participant.LeftAt
+	}
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE conference_participants
+		SET peer_id = ?, username = ?, left_at = ?, active = ?
+		WHERE id = ?
+	`, participant.PeerID, participant.Username, leftAt, participant.Active, participant.ID)
+	return err
+}
+
+// scanConferenceParticipant scans a participant row, allowing a NULL left_at
+func scanConferenceParticipant(rows *sql.Rows) (*ConferenceParticipant, error) {
+	p := &ConferenceParticipant{}
+	var leftAt sql.NullTime
+	if err := rows.Scan(&p.ID, &p.ConferenceID, &p.UserID, &p.PeerID, &p.Username, &p.JoinedAt, &leftAt, &p.Active); err != nil {
+		return nil, err
+	}
+	if leftAt.Valid {
+		p.LeftAt = leftAt.Time
+	}
+	return p, nil
+}
+
+func (s *SQLiteStorage) SaveConferenceMessage(ctx context.Context, message *ConferenceMessage) error {
+	defer s.observe("SaveConferenceMessage", time.Now())
+	if err := s.checkQuota(QuotaConferences); err != nil {
+		return err
+	}
+	// Assign the next logical clock value if the caller didn't supply one
+	if message.Lamport == 0 {
+		lamport, err := s.NextConferenceLamport(ctx, message.ConferenceID)
+		if err != nil {
+			return err
+		}
+		message.Lamport = lamport
+	}
+
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO conference_messages (conference_id, channel, from_user_id, from_peer_id, content, kind, lamport)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, message.ConferenceID, message.Channel, message.FromUserID, message.FromPeerID, message.Content, NormalizeKind(message.Kind), message.Lamport)
+	if err != nil {
+		return err
+	}
+	message.ID, _ = result.LastInsertId()
+	return nil
+}
+
+// SaveConferenceMessages inserts a batch of conference messages in one transaction
+func (s *SQLiteStorage) SaveConferenceMessages(ctx context.Context, messages []*ConferenceMessage) error {
+	defer s.observe("SaveConferenceMessages", time.Now())
+	if err := s.checkQuota(QuotaConferences); err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO conference_messages (conference_id, channel, from_user_id, from_peer_id, content, kind, lamport)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, message := range messages {
+		if message.Lamport == 0 {
+			if err := tx.QueryRowContext(ctx, nextConferenceLamportQuery, message.ConferenceID).Scan(&message.Lamport); err != nil {
+				return err
+			}
+		}
+
+		result, err := stmt.ExecContext(ctx, message.ConferenceID, message.Channel, message.FromUserID, message.FromPeerID, message.Content, NormalizeKind(message.Kind), message.Lamport)
+		if err != nil {
+			return err
+		}
+		message.ID, _ = result.LastInsertId()
+	}
+	return tx.Commit()
+}
+
+// GetConferenceMessagesSince returns conference messages after a logical clock value, oldest first,
+// across every channel. Messages hidden locally are included: hiding only affects this user's own view.
+func (s *SQLiteStorage) GetConferenceMessagesSince(ctx context.Context, conferenceID, sinceLamport int64, limit int) ([]*ConferenceMessage, error) {
+	defer s.observe("GetConferenceMessagesSince", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, conference_id, channel, from_user_id, from_peer_id, content, kind, lamport, created_at
+		FROM conference_messages
+		WHERE conference_id = ? AND lamport > ?
+		ORDER BY lamport ASC, created_at ASC
+		LIMIT ?
+	`, conferenceID, sinceLamport, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*ConferenceMessage{}
+	for rows.Next() {
+		msg := &ConferenceMessage{}
+		if err := rows.Scan(&msg.ID, &msg.ConferenceID, &msg.Channel, &msg.FromUserID, &msg.FromPeerID, &msg.Content, &msg.Kind, &msg.Lamport, &msg.CreatedAt); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// transcriptPageSize is how many messages StreamConferenceTranscript reads per query
+const transcriptPageSize = 500
+
+// StreamConferenceTranscript calls fn for each visible conference message across
+// every channel, oldest first, with the sender's username and full name
+// resolved from known users or the conference's membership list. Messages are
+// read a page at a time so large rooms never sit in memory, and no query is
+// open while fn runs. An error from fn stops the stream and is returned.
+func (s *SQLiteStorage) StreamConferenceTranscript(ctx context.Context, conferenceID int64, fn func(*TranscriptEntry) error) error {
+	defer s.observe("StreamConferenceTranscript", time.Now())
+	return s.streamTranscript(ctx, conferenceID, false, fn)
+}
+
+// StreamConferenceRecord is StreamConferenceTranscript including the messages
+// the user hid, which are marked as such, for a complete record of the conference
+func (s *SQLiteStorage) StreamConferenceRecord(ctx context.Context, conferenceID int64, fn func(*TranscriptEntry) error) error {
+	defer s.observe("StreamConferenceRecord", time.Now())
+	return s.streamTranscript(ctx, conferenceID, true, fn)
+}
+
+// streamTranscript pages through a conference's messages for fn, oldest first
+func (s *SQLiteStorage) streamTranscript(ctx context.Context, conferenceID int64, includeHidden bool, fn func(*TranscriptEntry) error) error {
+	var lastLamport, lastID int64
+	for {
+		page, err := s.transcriptPage(ctx, conferenceID, includeHidden, lastLamport, lastID)
+		if err != nil {
+			return err
+		}
+		for _, entry := range page {
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+		if len(page) < transcriptPageSize {
+			return nil
+		}
+		last := page[len(page)-1]
+		lastLamport, lastID = last.Lamport, last.ID
+	}
+}
+
+// transcriptPage reads the transcript entries that follow (lamport, id)
+func (s *SQLiteStorage) transcriptPage(ctx context.Context, conferenceID int64, includeHidden bool, lamport, id int64) ([]*TranscriptEntry, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT m.id, m.conference_id, m.channel, m.from_user_id, m.from_peer_id, m.content, m.kind, m.lamport, m.created_at, m.hidden,
+			COALESCE(byid.username, bypeer.username, (
+				SELECT username FROM conference_membership
+				WHERE conference_id = m.conference_id AND peer_id = m.from_peer_id
+				ORDER BY id DESC LIMIT 1
+			), ''),
+			COALESCE(byid.full_name, bypeer.full_name, '')
+		FROM conference_messages m
+		LEFT JOIN users byid ON m.from_user_id != 0 AND byid.id = m.from_user_id
+		LEFT JOIN users bypeer ON bypeer.peer_id = m.from_peer_id
+		WHERE m.conference_id = ? AND (m.hidden = 0 OR ?)
+			AND (m.lamport > ? OR (m.lamport = ? AND m.id > ?))
+		ORDER BY m.lamport ASC, m.id ASC
+		LIMIT ?
+	`, conferenceID, includeHidden, lamport, lamport, id, transcriptPageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*TranscriptEntry{}
+	for rows.Next() {
+		msg := &ConferenceMessage{}
+		entry := &TranscriptEntry{ConferenceMessage: msg}
+		if err := rows.Scan(&msg.ID, &msg.ConferenceID, &msg.Channel, &msg.FromUserID, &msg.FromPeerID, &msg.Content, &msg.Kind, &msg.Lamport, &msg.CreatedAt, &entry.Hidden, &entry.Username, &entry.FullName); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// HasConferenceMessage reports whether a sender's message at a logical clock value is already stored
+func (s *SQLiteStorage) HasConferenceMessage(ctx context.Context, conferenceID int64, fromPeerID string, lamport int64) (bool, error) {
+	defer s.observe("HasConferenceMessage", time.Now())
+	var count int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM conference_messages
+		WHERE conference_id = ? AND from_peer_id = ? AND lamport = ?
+	`, conferenceID, fromPeerID, lamport).Scan(&count)
+	return count > 0, err
+}
+
+// nextConferenceLamportQuery gives the next logical clock value for a
+// conference; summaries count, so the clock never goes back once the newest
+// messages have been compacted away
+const nextConferenceLamportQuery = `
+	SELECT MAX(
+		(SELECT COALESCE(MAX(lamport), 0) FROM conference_messages WHERE conference_id = ?1),
+		(SELECT COALESCE(MAX(to_lamport), 0) FROM conference_summaries WHERE conference_id = ?1)
+	) + 1
+`
+
+// NextConferenceLamport returns the next logical clock value for a conference
+func (s *SQLiteStorage) NextConferenceLamport(ctx context.Context, conferenceID int64) (int64, error) {
+	defer s.observe("NextConferenceLamport", time.Now())
+	var lamport int64
+	err := s.db.QueryRowContext(ctx, nextConferenceLamportQuery, conferenceID).Scan(&lamport)
+	return lamport, err
+}
+
+// GetConferenceMessages returns the latest messages in a conference's main channel
+func (s *SQLiteStorage) GetConferenceMessages(ctx context.Context, conferenceID int64, limit int) ([]*ConferenceMessage, error) {
+	defer s.observe("GetConferenceMessages", time.Now())
+	return s.GetChannelMessages(ctx, conferenceID, "", limit)
+}
+
+// GetChannelMessages returns the latest messages in one channel of a conference
+func (s *SQLiteStorage) GetChannelMessages(ctx context.Context, conferenceID int64, channel string, limit int) ([]*ConferenceMessage, error) {
+	defer s.observe("GetChannelMessages", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, conference_id, channel, from_user_id, from_peer_id, content, kind, lamport, created_at
+		FROM conference_messages
+		WHERE conference_id = ? AND channel = ? AND hidden = 0
+		ORDER BY lamport DESC, created_at DESC
+		LIMIT ?
+	`, conferenceID, channel, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*ConferenceMessage{}
+	for rows.Next() {
+		msg := &ConferenceMessage{}
+		if err := rows.Scan(&msg.ID, &msg.ConferenceID, &msg.Channel, &msg.FromUserID, &msg.FromPeerID, &msg.Content, &msg.Kind, &msg.Lamport, &msg.CreatedAt); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// HideConferenceMessage hides a conference message from this user's history
+// ("delete for me"). Other members keep their copies.
+func (s *SQLiteStorage) HideConferenceMessage(ctx context.Context, conferenceID, messageID int64) error {
+	defer s.observe("HideConferenceMessage", time.Now())
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE conference_messages SET hidden = 1
+		WHERE id = ? AND conference_id = ? AND hidden = 0
+	`, messageID, conferenceID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) RemoveConferenceParticipantByPeerID(ctx context.Context, conferenceID int64, peerID string) error {
+	defer s.observe("RemoveConferenceParticipantByPeerID", time.Now())
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE conference_participants
+		SET active = 0, left_at = CURRENT_TIMESTAMP
+		WHERE conference_id = ? AND peer_id = ? AND active = 1
+	`, conferenceID, peerID)
+	return err
+}
+
+// Conference channel operations
+
+// AddConferenceChannel records a channel, reporting whether it was new
+func (s *SQLiteStorage) AddConferenceChannel(ctx context.Context, conferenceID int64, name string) (bool, error) {
+	defer s.observe("AddConferenceChannel", time.Now())
+	result, err := s.db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO conference_channels (conference_id, name)
+		VALUES (?, ?)
+	`, conferenceID, name)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *SQLiteStorage) GetConferenceChannels(ctx context.Context, conferenceID int64) ([]*ConferenceChannel, error) {
+	defer s.observe("GetConferenceChannels", time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, conference_id, name, created_at
+		FROM conference_channels
+		WHERE conference_id = ?
+		ORDER BY name
+	`, conferenceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	channels := []*ConferenceChannel{}
+	for rows.Next() {
+		ch := &ConferenceChannel{}
+		if err := rows.Scan(&ch.ID, &ch.ConferenceID, &ch.Name, &ch.CreatedAt); err != nil {
+			return nil, err
+		}
+		channels = append(channels, ch)
+	}
+	return channels, rows.Err()
+}
+
+// SaveConferenceRateLimit stores a conference's posting limits unless a newer
+// version is already stored, and reports whether it did
+func (s *SQLiteStorage) SaveConferenceRateLimit(ctx context.Context, limit *ConferenceRateLimit) (bool, error) {
+	defer s.observe("SaveConferenceRateLimit", time.Now())
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO conference_rate_limits (conference_id, messages, window_seconds, slow_mode_seconds, slow_mode_until, version)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(conference_id) DO UPDATE SET
+			messages = excluded.messages,
+			window_seconds = excluded.window_seconds,
+			slow_mode_seconds = excluded.slow_mode_seconds,
+			slow_mode_until = excluded.slow_mode_until,
+			version = excluded.version
+		WHERE excluded.version > conference_rate_limits.version
+	`, limit.ConferenceID, limit.Messages, limit.WindowSeconds, limit.SlowModeSeconds,
+		sql.NullTime{Time: limit.SlowModeUntil, Valid: !limit.SlowModeUntil.IsZero()}, limit.Version)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
 }
 
-func (s *SQLiteStorage) GetPendingFriendRequests(ctx context.Context, userID int64) ([]*Friend, error) {
-	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, user_id, friend_id, peer_id, username, full_name, status, created_at, accepted_at
-		FROM friends WHERE friend_id = ? AND status = 'pending'
-	`, userID)
+// GetConferenceRateLimit returns a conference's posting limits, or nil if none were set
+func (s *SQLiteStorage) GetConferenceRateLimit(ctx context.Context, conferenceID int64) (*ConferenceRateLimit, error) {
+	defer s.observe("GetConferenceRateLimit", time.Now())
+	limit := &ConferenceRateLimit{}
+	var slowModeUntil sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+		SELECT conference_id, messages, window_seconds, slow_mode_seconds, slow_mode_until, version
+		FROM conference_rate_limits
+		WHERE conference_id = ?
+	`, conferenceID).Scan(&limit.ConferenceID, &limit.Messages, &limit.WindowSeconds, &limit.SlowModeSeconds, &slowModeUntil, &limit.Version)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	limit.SlowModeUntil = slowModeUntil.Time
+	return limit, nil
+}
 
-	requests := []*Friend{}
-	for rows.Next() {
-		friend := &Friend{}
-		var acceptedAt sql.NullTime
-		if err := rows.Scan(&friend.ID, &friend.UserID, &friend.FriendID, &friend.PeerID, &friend.Username, &friend.FullName, &friend.Status, &friend.CreatedAt, &acceptedAt); err != nil {
-			return nil, err
-		}
-		if acceptedAt.Valid {
-			friend.AcceptedAt = acceptedAt.Time
-		}
-		requests = append(requests, friend)
+// SaveConferenceObservers stores a conference's observers unless a newer
+// version is already stored, and reports whether it did
+func (s *SQLiteStorage) SaveConferenceObservers(ctx context.Context, observers *ConferenceObservers) (bool, error) {
+	defer s.observe("SaveConferenceObservers", time.Now())
+	peerIDs := observers.PeerIDs
+	if peerIDs == nil {
+		peerIDs = []string{}
+	}
+	data, err := json.Marshal(peerIDs)
+	if err != nil {
+		return false, err
 	}
-	return requests, rows.Err()
-}
 
-// Message operations
-func (s *SQLiteStorage) SaveMessage(ctx context.Context, message *Message) error {
 	result, err := s.db.ExecContext(ctx, `
-		INSERT INTO messages (from_user_id, to_user_id, from_peer_id, to_peer_id, content, delivered, read)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, message.FromUserID, message.ToUserID, message.FromPeerID, message.ToPeerID, message.Content, message.Delivered, message.Read)
+		INSERT INTO conference_observers (conference_id, peer_ids, version)
+		VALUES (?, ?, ?)
+		ON CONFLICT(conference_id) DO UPDATE SET
+			peer_ids = excluded.peer_ids,
+			version = excluded.version
+		WHERE excluded.version > conference_observers.version
+	`, observers.ConferenceID, string(data), observers.Version)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// GetConferenceObservers returns a conference's observers, or nil if the owner
+// never named any
+func (s *SQLiteStorage) GetConferenceObservers(ctx context.Context, conferenceID int64) (*ConferenceObservers, error) {
+	defer s.observe("GetConferenceObservers", time.Now())
+	observers := &ConferenceObservers{}
+	var peerIDs string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT conference_id, peer_ids, version
+		FROM conference_observers
+		WHERE conference_id = ?
+	`, conferenceID).Scan(&observers.ConferenceID, &peerIDs, &observers.Version)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(peerIDs), &observers.PeerIDs); err != nil {
+		return nil, err
+	}
+	return observers, nil
+}
+
+// Conference membership (OR-Set) operations
+func (s *SQLiteStorage) SaveConferenceMembership(ctx context.Context, entries []*ConferenceMembershipEntry) error {
+	defer s.observe("SaveConferenceMembership", time.Now())
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	message.ID, _ = result.LastInsertId()
-	return nil
+	defer tx.Rollback()
+
+	for _, entry := range entries {
+		// Tombstones are sticky: once removed, a tag never becomes live again
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO conference_membership (conference_id, peer_id, username, tag, removed)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(tag) DO UPDATE SET removed = (removed OR excluded.removed)
+		`, entry.ConferenceID, entry.PeerID, entry.Username, entry.Tag, entry.Removed); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func (s *SQLiteStorage) GetMessages(ctx context.Context, userID, otherUserID int64, limit int) ([]*Message, error) {
+func (s *SQLiteStorage) GetConferenceMembership(ctx context.Context, conferenceID int64) ([]*ConferenceMembershipEntry, error) {
+	defer s.observe("GetConferenceMembership", time.Now())
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, from_user_id, to_user_id, from_peer_id, to_peer_id, content, delivered, read, created_at, delivered_at, read_at
-		FROM messages
-		WHERE (from_user_id = ? AND to_user_id = ?) OR (from_user_id = ? AND to_user_id = ?)
-		ORDER BY created_at DESC
-		LIMIT ?
-	`, userID, otherUserID, otherUserID, userID, limit)
+		SELECT id, conference_id, peer_id, username, tag, removed, created_at
+		FROM conference_membership
+		WHERE conference_id = ?
+	`, conferenceID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	messages := []*Message{}
+	entries := []*ConferenceMembershipEntry{}
 	for rows.Next() {
-		msg := &Message{}
-		var deliveredAt, readAt sql.NullTime
-		if err := rows.Scan(&msg.ID, &msg.FromUserID, &msg.ToUserID, &msg.FromPeerID, &msg.ToPeerID, &msg.Content, &msg.Delivered, &msg.Read, &msg.CreatedAt, &deliveredAt, &readAt); err != nil {
+		e := &ConferenceMembershipEntry{}
+		if err := rows.Scan(&e.ID, &e.ConferenceID, &e.PeerID, &e.Username, &e.Tag, &e.Removed, &e.CreatedAt); err != nil {
 			return nil, err
 		}
-		if deliveredAt.Valid {
-			msg.DeliveredAt = deliveredAt.Time
-		}
-		if readAt.Valid {
-			msg.ReadAt = readAt.Time
-		}
-		messages = append(messages, msg)
+		entries = append(entries, e)
 	}
-	return messages, rows.Err()
+	return entries, rows.Err()
 }
 
-func (s *SQLiteStorage) GetUndeliveredMessages(ctx context.Context, userID int64) ([]*Message, error) {
+// Known peers operations
+func (s *SQLiteStorage) SaveKnownPeer(ctx context.Context, peer *KnownPeer) error {
+	defer s.observe("SaveKnownPeer", time.Now())
+	// Updated in place so the peer's reputation survives
+	return s.db.QueryRowContext(ctx, `
+		INSERT INTO known_peers (peer_id, username, addrs, version, platform, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(peer_id) DO UPDATE SET
+			username = excluded.username, addrs = excluded.addrs, version = excluded.version,
+			platform = excluded.platform, last_seen = excluded.last_seen
+		RETURNING id
+	`, peer.PeerID, peer.Username, peer.Addrs, peer.Version, peer.Platform, peer.LastSeen).Scan(&peer.ID)
+}
+
+func (s *SQLiteStorage) GetKnownPeers(ctx context.Context) ([]*KnownPeer, error) {
+	defer s.observe("GetKnownPeers", time.Now())
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, from_user_id, to_user_id, from_peer_id, to_peer_id, content, delivered, read, created_at, delivered_at, read_at
-		FROM messages
-		WHERE to_user_id = ? AND delivered = 0
-		ORDER BY created_at ASC
-	`, userID)
+		SELECT id, peer_id, username, addrs, version, platform, last_seen, created_at
+		FROM known_peers
+		ORDER BY last_seen DESC
+	`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	messages := []*Message{}
+	peers := []*KnownPeer{}
 	for rows.Next() {
-		msg := &Message{}
-		var deliveredAt, readAt sql.NullTime
-		if err := rows.Scan(&msg.ID, &msg.FromUserID, &msg.ToUserID, &msg.FromPeerID, &msg.ToPeerID, &msg.Content, &msg.Delivered, &msg.Read, &msg.CreatedAt, &deliveredAt, &readAt); err != nil {
+		peer := &KnownPeer{}
+		if err := rows.Scan(&peer.ID, &peer.PeerID, &peer.Username, &peer.Addrs, &peer.Version, &peer.Platform, &peer.LastSeen, &peer.CreatedAt); err != nil {
 			return nil, err
 		}
-		messages = append(messages, msg)
+		peers = append(peers, peer)
 	}
-	return messages, rows.Err()
+	return peers, rows.Err()
 }
 
-func (s *SQLiteStorage) MarkMessageDelivered(ctx context.Context, messageID int64) error {
+func (s *SQLiteStorage) UpdateKnownPeer(ctx context.Context, peer *KnownPeer) error {
+	defer s.observe("UpdateKnownPeer", time.Now())
 	_, err := s.db.ExecContext(ctx, `
-		UPDATE messages SET delivered = 1, delivered_at = CURRENT_TIMESTAMP
-		WHERE id = ?
-	`, messageID)
+		UPDATE known_peers
+		SET username = ?, addrs = ?, version = ?, platform = ?, last_seen = ?
+		WHERE peer_id = ?
+	`, peer.Username, peer.Addrs, peer.Version, peer.Platform, peer.LastSeen, peer.PeerID)
 	return err
 }
 
-func (s *SQLiteStorage) MarkMessageRead(ctx context.Context, messageID int64) error {
-	_, err := s.db.ExecContext(ctx, `
-		UPDATE messages SET read = 1, read_at = CURRENT_TIMESTAMP
-		WHERE id = ?
-	`, messageID)
-	return err
+func (s *SQLiteStorage) GetKnownPeer(ctx context.Context, peerID string) (*KnownPeer, error) {
+	defer s.observe("GetKnownPeer", time.Now())
+	peer := &KnownPeer{}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, peer_id, username, addrs, version, platform, last_seen, created_at
+		FROM known_peers
+		WHERE peer_id = ?
+	`, peerID).Scan(&peer.ID, &peer.PeerID, &peer.Username, &peer.Addrs, &peer.Version, &peer.Platform, &peer.LastSeen, &peer.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return peer, nil
 }
 
-// Conference operations
-func (s *SQLiteStorage) CreateConference(ctx context.Context, conference *Conference) error {
-	result, err := s.db.ExecContext(ctx, `
-		INSERT INTO conferences (name, creator_id)
-		VALUES (?, ?)
-	`, conference.Name, conference.CreatorID)
+// TouchKnownPeer records that a peer was online at seen. The stored time only
+// moves forward, so a stale DHT record can't hide a more recent connection.
+func (s *SQLiteStorage) TouchKnownPeer(ctx context.Context, peerID string, seen time.Time) error {
+	defer s.observe("TouchKnownPeer", time.Now())
+	existing, err := s.GetKnownPeer(ctx, peerID)
 	if err != nil {
 		return err
 	}
-	conference.ID, _ = result.LastInsertId()
-	return nil
+	if existing == nil {
+		_, err := s.db.ExecContext(ctx, `
+			INSERT OR IGNORE INTO known_peers (peer_id, username, addrs, last_seen)
+			VALUES (?, '', '[]', ?)
+		`, peerID, seen)
+		return err
+	}
+	if !seen.After(existing.LastSeen) {
+		return nil
+	}
+	_, err = s.db.ExecContext(ctx, `UPDATE known_peers SET last_seen = ? WHERE peer_id = ?`, seen, peerID)
+	return err
 }
 
-func (s *SQLiteStorage) GetConference(ctx context.Context, id int64) (*Conference, error) {
-	conf := &Conference{}
-	err := s.db.QueryRowContext(ctx, `
-		SELECT id, name, creator_id, created_at
-		FROM conferences WHERE id = ?
-	`, id).Scan(&conf.ID, &conf.Name, &conf.CreatorID, &conf.CreatedAt)
-	if err == sql.ErrNoRows {
-		return nil, nil
+// RecordDialSuccess records that dialing a peer at addr worked at, counting
+// successes per address. Only the MaxDialAddrs most recently successful
+// addresses of a peer are kept. The peer counts as seen at that time too.
+func (s *SQLiteStorage) RecordDialSuccess(ctx context.Context, peerID, addr string, at time.Time) error {
+	defer s.observe("RecordDialSuccess", time.Now())
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
-	return conf, err
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO known_peer_addrs (peer_id, addr, successes, first_success, last_success)
+		VALUES (?, ?, 1, ?, ?)
+		ON CONFLICT(peer_id, addr) DO UPDATE SET
+			successes = successes + 1,
+			last_success = excluded.last_success
+	`, peerID, addr, at, at); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM known_peer_addrs
+		WHERE peer_id = ?1 AND addr NOT IN (
+			SELECT addr FROM known_peer_addrs WHERE peer_id = ?1
+			ORDER BY last_success DESC LIMIT ?2
+		)
+	`, peerID, MaxDialAddrs); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return s.TouchKnownPeer(ctx, peerID, at)
 }
 
-func (s *SQLiteStorage) GetUserConferences(ctx context.Context, userID int64) ([]*Conference, error) {
+// GetDialAddrs returns the addresses dialing a peer has worked on, the most
+// recently successful first
+func (s *SQLiteStorage) GetDialAddrs(ctx context.Context, peerID string) ([]*DialAddr, error) {
+	defer s.observe("GetDialAddrs", time.Now())
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT c.id, c.name, c.creator_id, c.created_at
-		FROM conferences c
-		INNER JOIN conference_participants cp ON c.id = cp.conference_id
-		WHERE cp.user_id = ? AND cp.active = 1
-	`, userID)
+		SELECT peer_id, addr, successes, first_success, last_success
+		FROM known_peer_addrs
+		WHERE peer_id = ?
+		ORDER BY last_success DESC, successes DESC
+	`, peerID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	conferences := []*Conference{}
+	addrs := []*DialAddr{}
 	for rows.Next() {
-		conf := &Conference{}
-		if err := rows.Scan(&conf.ID, &conf.Name, &conf.CreatorID, &conf.CreatedAt); err != nil {
+		addr := &DialAddr{}
+		if err := rows.Scan(&addr.PeerID, &addr.Addr, &addr.Successes, &addr.FirstSuccess, &addr.LastSuccess); err != nil {
 			return nil, err
 		}
-		conferences = append(conferences, conf)
+		addrs = append(addrs, addr)
 	}
-	return conferences, rows.Err()
+	return addrs, rows.Err()
 }
 
-func (s *SQLiteStorage) AddConferenceParticipant(ctx context.Context, participant *ConferenceParticipant) error {
-	result, err := s.db.ExecContext(ctx, `
-		INSERT INTO conference_participants (conference_id, user_id, peer_id, username, active)
-		VALUES (?, ?, ?, ?, ?)
-	`, participant.ConferenceID, participant.UserID, participant.PeerID, participant.Username, participant.Active)
+// Identity operations
+func (s *SQLiteStorage) GetIdentityKey(ctx context.Context) ([]byte, error) {
+	defer s.observe("GetIdentityKey", time.Now())
+	var key []byte
+	err := s.db.QueryRowContext(ctx, `SELECT private_key FROM node_identity WHERE id = 1`).Scan(&key)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	participant.ID, _ = result.LastInsertId()
-	return nil
+	return key, nil
 }
 
-func (s *SQLiteStorage) RemoveConferenceParticipant(ctx context.Context, conferenceID, userID int64) error {
+func (s *SQLiteStorage) SaveIdentityKey(ctx context.Context, key []byte) error {
+	defer s.observe("SaveIdentityKey", time.Now())
 	_, err := s.db.ExecContext(ctx, `
-		UPDATE conference_participants
-		SET active = 0, left_at = CURRENT_TIMESTAMP
-		WHERE conference_id = ? AND user_id = ?
-	`, conferenceID, userID)
+		INSERT OR REPLACE INTO node_identity (id, private_key) VALUES (1, ?)
+	`, key)
 	return err
 }
 
-func (s *SQLiteStorage) GetConferenceParticipants(ctx context.Context, conferenceID int64) ([]*ConferenceParticipant, error) {
-	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, conference_id, user_id, peer_id, username, joined_at, left_at, active
-		FROM conference_participants
-		WHERE conference_id = ? AND active = 1
-	`, conferenceID)
+// GetAccountKey returns the identity key a local account has of its own, or
+// nil if it is bound to the node identity
+func (s *SQLiteStorage) GetAccountKey(ctx context.Context, userID int64) ([]byte, error) {
+	defer s.observe("GetAccountKey", time.Now())
+	var key []byte
+	err := s.db.QueryRowContext(ctx, `SELECT private_key FROM account_keys WHERE user_id = ?`, userID).Scan(&key)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// SaveAccountKey stores the identity key of a local account that has one of its own
+func (s *SQLiteStorage) SaveAccountKey(ctx context.Context, userID int64, key []byte) error {
+	defer s.observe("SaveAccountKey", time.Now())
+	_, err := s.db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO account_keys (user_id, private_key) VALUES (?, ?)
+	`, userID, key)
+	return err
+}
+
+// Peer score operations
+func (s *SQLiteStorage) GetPeerScores(ctx context.Context) (map[string]float64, error) {
+	defer s.observe("GetPeerScores", time.Now())
+	rows, err := s.db.QueryContext(ctx, `SELECT peer_id, score FROM peer_scores`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	participants := []*ConferenceParticipant{}
+	scores := make(map[string]float64)
 	for rows.Next() {
-		p := &ConferenceParticipant{}
-		if err := rows.Scan(&p.ID, &p.ConferenceID, &p.UserID, &p.PeerID, &p.Username, &p.JoinedAt, &p.LeftAt, &p.Active); err != nil {
+		var peerID string
+		var score float64
+		if err := rows.Scan(&peerID, &score); err != nil {
 			return nil, err
 		}
-		participants = append(participants, p)
+		scores[peerID] = score
 	}
-	return participants, rows.Err()
+	return scores, rows.Err()
 }
 
-func (s *SQLiteStorage) SaveConferenceMessage(ctx context.Context, message *ConferenceMessage) error {
-	result, err := s.db.ExecContext(ctx, `
-		INSERT INTO conference_messages (conference_id, from_user_id, from_peer_id, content)
-		VALUES (?, ?, ?, ?)
-	`, message.ConferenceID, message.FromUserID, message.FromPeerID, message.Content)
+// SavePeerScores upserts the given scores; a zero score removes the peer's row
+func (s *SQLiteStorage) SavePeerScores(ctx context.Context, scores map[string]float64) error {
+	defer s.observe("SavePeerScores", time.Now())
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	message.ID, _ = result.LastInsertId()
-	return nil
+	defer tx.Rollback()
+
+	for peerID, score := range scores {
+		if score == 0 {
+			_, err = tx.ExecContext(ctx, `DELETE FROM peer_scores WHERE peer_id = ?`, peerID)
+		} else {
+			_, err = tx.ExecContext(ctx, `
+				INSERT OR REPLACE INTO peer_scores (peer_id, score, updated_at)
+				VALUES (?, ?, CURRENT_TIMESTAMP)
+			`, peerID, score)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func (s *SQLiteStorage) GetConferenceMessages(ctx context.Context, conferenceID int64, limit int) ([]*ConferenceMessage, error) {
+// Settings operations
+func (s *SQLiteStorage) GetSettings(ctx context.Context, userID int64) ([]*Setting, error) {
+	defer s.observe("GetSettings", time.Now())
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, conference_id, from_user_id, from_peer_id, content, created_at
-		FROM conference_messages
-		WHERE conference_id = ?
-		ORDER BY created_at DESC
-		LIMIT ?
-	`, conferenceID, limit)
+		SELECT user_id, friend_id, name, value, updated_at FROM settings
+		WHERE user_id = ? ORDER BY friend_id, name
+	`, userID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	messages := []*ConferenceMessage{}
+	settings := []*Setting{}
 	for rows.Next() {
-		msg := &ConferenceMessage{}
-		if err := rows.Scan(&msg.ID, &msg.ConferenceID, &msg.FromUserID, &msg.FromPeerID, &msg.Content, &msg.CreatedAt); err != nil {
+		setting := &Setting{}
+		if err := rows.Scan(&setting.UserID, &setting.FriendID, &setting.Name, &setting.Value, &setting.UpdatedAt); err != nil {
 			return nil, err
 		}
-		messages = append(messages, msg)
+		settings = append(settings, setting)
 	}
-	return messages, rows.Err()
+	return settings, rows.Err()
 }
 
-// Known peers operations
-func (s *SQLiteStorage) SaveKnownPeer(ctx context.Context, peer *KnownPeer) error {
-	result, err := s.db.ExecContext(ctx, `
-		INSERT OR REPLACE INTO known_peers (peer_id, username, addrs, last_seen)
-		VALUES (?, ?, ?, ?)
-	`, peer.PeerID, peer.Username, peer.Addrs, peer.LastSeen)
+// GetSetting returns one setting, or nil if it was never set
+func (s *SQLiteStorage) GetSetting(ctx context.Context, userID, friendID int64, name string) (*Setting, error) {
+	defer s.observe("GetSetting", time.Now())
+	setting := &Setting{UserID: userID, FriendID: friendID, Name: name}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT value, updated_at FROM settings WHERE user_id = ? AND friend_id = ? AND name = ?
+	`, userID, friendID, name).Scan(&setting.Value, &setting.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	peer.ID, _ = result.LastInsertId()
-	return nil
+	return setting, nil
 }
 
-func (s *SQLiteStorage) GetKnownPeers(ctx context.Context) ([]*KnownPeer, error) {
-	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, peer_id, username, addrs, last_seen, created_at
-		FROM known_peers
-		ORDER BY last_seen DESC
-	`)
+func (s *SQLiteStorage) SaveSetting(ctx context.Context, setting *Setting) error {
+	defer s.observe("SaveSetting", time.Now())
+	_, err := s.db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO settings (user_id, friend_id, name, value, updated_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`, setting.UserID, setting.FriendID, setting.Name, setting.Value)
+	return err
+}
+
+func (s *SQLiteStorage) DeleteSetting(ctx context.Context, userID, friendID int64, name string) error {
+	defer s.observe("DeleteSetting", time.Now())
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM settings WHERE user_id = ? AND friend_id = ? AND name = ?
+	`, userID, friendID, name)
+	return err
+}
+
+// Push endpoint operations
+func (s *SQLiteStorage) SavePushEndpoint(ctx context.Context, endpoint *PushEndpoint) error {
+	defer s.observe("SavePushEndpoint", time.Now())
+	_, err := s.db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO push_endpoints (peer_id, relay, token, key, updated_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`, endpoint.PeerID, endpoint.Relay, endpoint.Token, endpoint.Key)
+	return err
+}
+
+// GetPushEndpoint returns a peer's push endpoint, or nil if they haven't shared one
+func (s *SQLiteStorage) GetPushEndpoint(ctx context.Context, peerID string) (*PushEndpoint, error) {
+	defer s.observe("GetPushEndpoint", time.Now())
+	endpoint := &PushEndpoint{PeerID: peerID}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT relay, token, key, updated_at FROM push_endpoints WHERE peer_id = ?
+	`, peerID).Scan(&endpoint.Relay, &endpoint.Token, &endpoint.Key, &endpoint.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return endpoint, nil
+}
 
-	peers := []*KnownPeer{}
-	for rows.Next() {
-		peer := &KnownPeer{}
-		if err := rows.Scan(&peer.ID, &peer.PeerID, &peer.Username, &peer.Addrs, &peer.LastSeen, &peer.CreatedAt); err != nil {
-			return nil, err
-		}
-		peers = append(peers, peer)
+func (s *SQLiteStorage) DeletePushEndpoint(ctx context.Context, peerID string) error {
+	defer s.observe("DeletePushEndpoint", time.Now())
+	_, err := s.db.ExecContext(ctx, `DELETE FROM push_endpoints WHERE peer_id = ?`, peerID)
+	return err
+}
+
+// MarkContactDeleted records that a contact deleted their account: friend
+// rows with them are marked deleted and their push endpoint is forgotten
+func (s *SQLiteStorage) MarkContactDeleted(ctx context.Context, peerID string) error {
+	defer s.observe("MarkContactDeleted", time.Now())
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
-	return peers, rows.Err()
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE friends SET status = 'deleted' WHERE peer_id = ?
+	`, peerID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM push_endpoints WHERE peer_id = ?`, peerID); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (s *SQLiteStorage) UpdateKnownPeer(ctx context.Context, peer *KnownPeer) error {
+// Deletion notice operations
+func (s *SQLiteStorage) SaveDeletionNotice(ctx context.Context, notice *DeletionNotice) error {
+	defer s.observe("SaveDeletionNotice", time.Now())
 	_, err := s.db.ExecContext(ctx, `
-		UPDATE known_peers
-		SET username = ?, addrs = ?, last_seen = ?
-		WHERE peer_id = ?
-	`, peer.Username, peer.Addrs, peer.LastSeen, peer.PeerID)
+		INSERT OR REPLACE INTO deletion_notices (peer_id, notice, created_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP)
+	`, notice.PeerID, notice.Notice)
+	return err
+}
+
+// GetDeletionNotice returns the notice waiting for a peer, or nil if there is none
+func (s *SQLiteStorage) GetDeletionNotice(ctx context.Context, peerID string) (*DeletionNotice, error) {
+	defer s.observe("GetDeletionNotice", time.Now())
+	notice := &DeletionNotice{PeerID: peerID}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT notice, created_at FROM deletion_notices WHERE peer_id = ?
+	`, peerID).Scan(&notice.Notice, &notice.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return notice, nil
+}
+
+func (s *SQLiteStorage) DeleteDeletionNotice(ctx context.Context, peerID string) error {
+	defer s.observe("DeleteDeletionNotice", time.Now())
+	_, err := s.db.ExecContext(ctx, `DELETE FROM deletion_notices WHERE peer_id = ?`, peerID)
 	return err
 }
 
+// Close checkpoints the WAL so the database file is self-contained, then closes it
 func (s *SQLiteStorage) Close() error {
+	if err := s.checkpoint(); err != nil {
+		fmt.Printf("Warning: Failed to checkpoint database: %v\n", err)
+	}
 	return s.db.Close()
 }
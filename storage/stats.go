@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxSlowQueries is how many slow queries are kept for diagnostics
+const maxSlowQueries = 20
+
+// DefaultSlowQueryThreshold is used until SetSlowQueryThreshold is called
+const DefaultSlowQueryThreshold = 200 * time.Millisecond
+
+// statsTables are the tables whose row counts Stats reports
+var statsTables = []string{
+	"users", "friends", "messages", "message_bodies", "conferences",
+	"conference_participants", "conference_messages", "group_messages", "known_peers",
+}
+
+// OpStat accumulates the timings of one storage operation
+type OpStat struct {
+	Op    string        `json:"op"` // Method name, e.g. GetMessages
+	Count int64         `json:"count"`
+	Slow  int64         `json:"slow"` // Calls at or over the slow query threshold
+	Total time.Duration `json:"total"`
+	Max   time.Duration `json:"max"`
+}
+
+// Avg returns the mean duration of the operation
+func (o OpStat) Avg() time.Duration {
+	if o.Count == 0 {
+		return 0
+	}
+	return o.Total / time.Duration(o.Count)
+}
+
+// SlowQuery records one call that took at least the slow query threshold
+type SlowQuery struct {
+	Op       string        `json:"op"`
+	Duration time.Duration `json:"duration"`
+	Time     time.Time     `json:"time"`
+}
+
+// DBStats summarizes storage activity since startup and the size of each table
+type DBStats struct {
+	SlowThreshold time.Duration `json:"slow_threshold"`
+	Ops           []OpStat      `json:"ops"`          // Slowest total time first
+	SlowQueries   []SlowQuery   `json:"slow_queries"` // Newest first
+	Tables        []TableStat   `json:"tables"`
+}
+
+// TableStat is the number of rows in one table
+type TableStat struct {
+	Name string `json:"name"`
+	Rows int64  `json:"rows"`
+}
+
+// queryStats collects per-operation timings for a SQLiteStorage
+type queryStats struct {
+	mu        sync.Mutex
+	threshold time.Duration
+	ops       map[string]*OpStat
+	slow      []SlowQuery
+}
+
+// newQueryStats creates an empty collector using the default threshold
+func newQueryStats() *queryStats {
+	return &queryStats{
+		threshold: DefaultSlowQueryThreshold,
+		ops:       make(map[string]*OpStat),
+	}
+}
+
+// SetSlowQueryThreshold sets how long an operation may take before it is logged
+// as slow (0 disables the log; timings are still collected)
+func (s *SQLiteStorage) SetSlowQueryThreshold(threshold time.Duration) {
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	s.stats.threshold = threshold
+}
+
+// observe records how long an operation took; use as
+// defer s.observe("Op", time.Now())
+func (s *SQLiteStorage) observe(op string, started time.Time) {
+	elapsed := time.Since(started)
+
+	s.stats.mu.Lock()
+	stat, ok := s.stats.ops[op]
+	if !ok {
+		stat = &OpStat{Op: op}
+		s.stats.ops[op] = stat
+	}
+	stat.Count++
+	stat.Total += elapsed
+	if elapsed > stat.Max {
+		stat.Max = elapsed
+	}
+	slow := s.stats.threshold > 0 && elapsed >= s.stats.threshold
+	if slow {
+		stat.Slow++
+		s.stats.slow = append(s.stats.slow, SlowQuery{Op: op, Duration: elapsed, Time: started})
+		if len(s.stats.slow) > maxSlowQueries {
+			s.stats.slow = s.stats.slow[len(s.stats.slow)-maxSlowQueries:]
+		}
+	}
+	s.stats.mu.Unlock()
+
+	if slow {
+		fmt.Printf("Warning: Slow query: %s took %s\n", op, elapsed.Round(time.Millisecond))
+	}
+}
+
+// Stats returns per-operation timings, recent slow queries and table row counts
+func (s *SQLiteStorage) Stats(ctx context.Context) (*DBStats, error) {
+	stats := &DBStats{}
+
+	s.stats.mu.Lock()
+	stats.SlowThreshold = s.stats.threshold
+	for _, op := range s.stats.ops {
+		stats.Ops = append(stats.Ops, *op)
+	}
+	for i := len(s.stats.slow) - 1; i >= 0; i-- {
+		stats.SlowQueries = append(stats.SlowQueries, s.stats.slow[i])
+	}
+	s.stats.mu.Unlock()
+
+	sort.Slice(stats.Ops, func(i, j int) bool {
+		return stats.Ops[i].Total > stats.Ops[j].Total
+	})
+
+	for _, table := range statsTables {
+		var count int64
+		if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(&count); err != nil {
+			return nil, fmt.Errorf("failed to count %s: %w", table, err)
+		}
+		stats.Tables = append(stats.Tables, TableStat{Name: table, Rows: count})
+	}
+	return stats, nil
+}
+
+// Ping checks that the database file can still be read
+func (s *SQLiteStorage) Ping(ctx context.Context) error {
+	defer s.observe("Ping", time.Now())
+	var tables int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master").Scan(&tables); err != nil {
+		return fmt.Errorf("database unreachable: %w", err)
+	}
+	return nil
+}
@@ -1,6 +1,29 @@
 package storage
 
-import "context"
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by the single-row user, conference and group
+// lookups (GetUserByID, GetUserByUsername, GetUserByPeerID, GetUserByAlias,
+// GetConference, GetGroup and GetGroupByUID) when there is no such row; they never return a nil result
+// without an error
+var ErrNotFound = errors.New("not found")
+
+// ErrMessageNotFound is returned when a message doesn't exist or isn't visible to the user
+var ErrMessageNotFound = errors.New("message not found")
+
+// ErrNotFriends is returned when a friend setting is changed for someone who isn't a friend
+var ErrNotFriends = errors.New("not friends")
+
+// Contact naming errors
+var (
+	ErrHandleTaken = errors.New("that name is already used by another user")
+	ErrNotContact  = errors.New("only contacts from other peers can be renamed")
+	ErrNotAccount  = errors.New("not an account on this node")
+)
 
 // Storage defines the interface for data persistence
 type Storage interface {
@@ -11,35 +34,173 @@ type Storage interface {
 	GetUserByPeerID(ctx context.Context, peerID string) (*User, error)
 	UpdateUser(ctx context.Context, user *User) error
 	SearchUsersByName(ctx context.Context, name string) ([]*User, error)
+	GetUsersByUsernameFold(ctx context.Context, username string) ([]*User, error)
+	SearchUsersByUsernamePrefix(ctx context.Context, prefix string, limit int) ([]*User, error)
+	GetLocalUsers(ctx context.Context) ([]*User, error)
+	ContactHandle(ctx context.Context, username, peerID string) (string, error)
+	RenameContact(ctx context.Context, userID int64, handle string) error
+	UpdateContactProfile(ctx context.Context, userID int64, fullName, statusMessage string) error
+	RenameAccount(ctx context.Context, userID int64, username string) error
+	RecordContactRename(ctx context.Context, userID int64, remoteName, handle string) error
+	GetUserByAlias(ctx context.Context, username string) (*User, error)
+	GetUsernameAliases(ctx context.Context, userID int64) ([]*UsernameAlias, error)
+	GetUsernameCollisions(ctx context.Context) ([]*User, error)
 
 	// Friend operations
 	CreateFriendRequest(ctx context.Context, friend *Friend) error
 	GetFriendRequest(ctx context.Context, userID, friendID int64) (*Friend, error)
+	GetFriendRequestByID(ctx context.Context, id int64) (*Friend, error)
 	UpdateFriendRequest(ctx context.Context, friend *Friend) error
 	GetFriends(ctx context.Context, userID int64) ([]*Friend, error)
+	GetFriendsFiltered(ctx context.Context, userID int64, filter FriendFilter) ([]*FriendSummary, error)
 	GetPendingFriendRequests(ctx context.Context, userID int64) ([]*Friend, error)
+	AcceptAllFriendRequests(ctx context.Context, userID int64) ([]*Friend, error)
+	RejectAllFriendRequests(ctx context.Context, userID int64) ([]*Friend, error)
+	GetOutgoingFriendRequests(ctx context.Context, userID int64) ([]*Friend, error)
+	SetFriendAutoDial(ctx context.Context, userID, friendID int64, enabled bool) error
 
 	// Message operations
 	SaveMessage(ctx context.Context, message *Message) error
+	GetMessage(ctx context.Context, userID, messageID int64) (*Message, error)
 	GetMessages(ctx context.Context, userID, otherUserID int64, limit int) ([]*Message, error)
+	GetConversations(ctx context.Context, userID int64, onlinePeerIDs []string) ([]*ConversationSummary, error)
 	GetUndeliveredMessages(ctx context.Context, userID int64) ([]*Message, error)
 	MarkMessageDelivered(ctx context.Context, messageID int64) error
+	FailExpiredMessages(ctx context.Context, userID int64) ([]*Message, error)
+	RecordDeliveryAttempt(ctx context.Context, attempt *DeliveryAttempt) error
+	GetDeliveryAttempts(ctx context.Context, messageID int64) ([]*DeliveryAttempt, error)
 	MarkMessageRead(ctx context.Context, messageID int64) error
+	MarkConversationRead(ctx context.Context, userID, otherUserID int64) ([]*Message, error)
+	MarkMessagesReadBySeq(ctx context.Context, fromUserID, toUserID int64, seqs []int64) (int64, error)
+	HideConversation(ctx context.Context, userID, otherUserID int64) (int64, error)
+	NextMessageLamport(ctx context.Context, userID, otherUserID int64) (int64, error)
+	NextMessageSeq(ctx context.Context, fromUserID, toUserID int64) (int64, error)
+	GetMissingMessageSeqs(ctx context.Context, fromUserID, toUserID, upTo int64) ([]int64, error)
+	GetMessagesBySeq(ctx context.Context, fromUserID, toUserID int64, seqs []int64) ([]*Message, error)
+	HasMessageSeq(ctx context.Context, fromUserID, toUserID, seq int64) (bool, error)
+	HideMessage(ctx context.Context, userID, messageID int64) error
+	StreamConversationRecord(ctx context.Context, userID, otherUserID int64, fn func(msg *Message, hidden bool) error) error
+	GetConversationStats(ctx context.Context, userID, otherUserID int64, since time.Time) (*ConversationStats, error)
+
+	// Identity change operations
+	SetIdentityCandidate(ctx context.Context, contactID int64, peerID string) (bool, error)
+	GetIdentityCandidate(ctx context.Context, contactID int64) (*IdentityCandidate, error)
+	ClearIdentityCandidate(ctx context.Context, contactID int64) error
+	QuarantineMessage(ctx context.Context, msg *QuarantinedMessage) error
+	TakeQuarantinedMessages(ctx context.Context, contactID int64, peerID string) ([]*QuarantinedMessage, error)
 
 	// Conference operations
 	CreateConference(ctx context.Context, conference *Conference) error
 	GetConference(ctx context.Context, id int64) (*Conference, error)
+	SetConferenceMaxParticipants(ctx context.Context, id int64, max int) error
 	GetUserConferences(ctx context.Context, userID int64) ([]*Conference, error)
 	AddConferenceParticipant(ctx context.Context, participant *ConferenceParticipant) error
+	GetConferenceParticipant(ctx context.Context, conferenceID, userID int64) (*ConferenceParticipant, error)
+	UpdateConferenceParticipant(ctx context.Context, participant *ConferenceParticipant) error
 	RemoveConferenceParticipant(ctx context.Context, conferenceID, userID int64) error
+	RemoveConferenceParticipantByPeerID(ctx context.Context, conferenceID int64, peerID string) error
 	GetConferenceParticipants(ctx context.Context, conferenceID int64) ([]*ConferenceParticipant, error)
 	SaveConferenceMessage(ctx context.Context, message *ConferenceMessage) error
+	SaveConferenceMessages(ctx context.Context, messages []*ConferenceMessage) error
+	HideConferenceMessage(ctx context.Context, conferenceID, messageID int64) error
 	GetConferenceMessages(ctx context.Context, conferenceID int64, limit int) ([]*ConferenceMessage, error)
+	GetChannelMessages(ctx context.Context, conferenceID int64, channel string, limit int) ([]*ConferenceMessage, error)
+	GetConferenceMessagesSince(ctx context.Context, conferenceID, sinceLamport int64, limit int) ([]*ConferenceMessage, error)
+	StreamConferenceTranscript(ctx context.Context, conferenceID int64, fn func(*TranscriptEntry) error) error
+	StreamConferenceRecord(ctx context.Context, conferenceID int64, fn func(*TranscriptEntry) error) error
+	GetConferenceStats(ctx context.Context, conferenceID int64, since time.Time) (*ConversationStats, error)
+	HasConferenceMessage(ctx context.Context, conferenceID int64, fromPeerID string, lamport int64) (bool, error)
+	GetConferenceMessagesBefore(ctx context.Context, conferenceID int64, before time.Time, limit int) ([]*ConferenceMessage, error)
+	ReplaceConferenceMessages(ctx context.Context, summary *ConferenceSummary) error
+	GetConferenceSummaries(ctx context.Context, conferenceID int64) ([]*ConferenceSummary, error)
+	NextConferenceLamport(ctx context.Context, conferenceID int64) (int64, error)
+	SaveConferenceMembership(ctx context.Context, entries []*ConferenceMembershipEntry) error
+	GetConferenceMembership(ctx context.Context, conferenceID int64) ([]*ConferenceMembershipEntry, error)
+	AddConferenceChannel(ctx context.Context, conferenceID int64, name string) (bool, error)
+	GetConferenceChannels(ctx context.Context, conferenceID int64) ([]*ConferenceChannel, error)
+	SaveConferenceRateLimit(ctx context.Context, limit *ConferenceRateLimit) (bool, error)
+	GetConferenceRateLimit(ctx context.Context, conferenceID int64) (*ConferenceRateLimit, error)
+	SaveConferenceObservers(ctx context.Context, observers *ConferenceObservers) (bool, error)
+	GetConferenceObservers(ctx context.Context, conferenceID int64) (*ConferenceObservers, error)
+	MarkConferenceRead(ctx context.Context, userID, conferenceID int64) error
+
+	// Group operations
+	CreateGroup(ctx context.Context, group *Group) error
+	GetGroup(ctx context.Context, userID, groupID int64) (*Group, error)
+	GetGroupByUID(ctx context.Context, userID int64, uid string) (*Group, error)
+	GetGroups(ctx context.Context, userID int64) ([]*Group, error)
+	SetGroupMembers(ctx context.Context, groupID int64, members []*GroupMember) error
+	LeaveGroup(ctx context.Context, groupID int64) error
+	SaveGroupMessage(ctx context.Context, message *GroupMessage, recipients []*GroupMember) error
+	HasGroupMessage(ctx context.Context, groupID int64, fromPeerID string, remoteID int64) (bool, error)
+	GetGroupMessages(ctx context.Context, groupID int64, limit int) ([]*GroupMessage, error)
+	GetGroupMessage(ctx context.Context, userID, messageID int64) (*GroupMessage, error)
+	GetGroupDeliveries(ctx context.Context, messageID int64) ([]*GroupDelivery, error)
+	GetPendingGroupDeliveries(ctx context.Context, userID int64) ([]*GroupDelivery, error)
+	MarkGroupDelivered(ctx context.Context, userID, messageID int64, peerID string) (bool, error)
+	RecordGroupDeliveryFailure(ctx context.Context, messageID int64, peerID, reason string) error
 
 	// Known peers operations
 	SaveKnownPeer(ctx context.Context, peer *KnownPeer) error
 	GetKnownPeers(ctx context.Context) ([]*KnownPeer, error)
 	UpdateKnownPeer(ctx context.Context, peer *KnownPeer) error
+	GetKnownPeer(ctx context.Context, peerID string) (*KnownPeer, error)
+	TouchKnownPeer(ctx context.Context, peerID string, seen time.Time) error
+	GetPeerReputation(ctx context.Context, peerID string) (*PeerReputation, error)
+	GetPeerReputations(ctx context.Context) ([]*PeerReputation, error)
+	RecordPeerOffense(ctx context.Context, peerID, offense string, score float64, at time.Time) (*PeerReputation, error)
+	RecordDialSuccess(ctx context.Context, peerID, addr string, at time.Time) error
+	GetDialAddrs(ctx context.Context, peerID string) ([]*DialAddr, error)
+
+	// Friend list copies kept for friends
+	SaveRosterCopy(ctx context.Context, roster *RosterCopy) error
+	GetRosterCopies(ctx context.Context, userID int64) ([]*RosterCopy, error)
+
+	// Activity feed operations
+	RecordActivity(ctx context.Context, activity *Activity) error
+	GetActivityFeed(ctx context.Context, userID, beforeID int64, limit int) ([]*Activity, error)
+	MarkActivitySeen(ctx context.Context, userID, upToID int64) error
+	GetCatchUpSummary(ctx context.Context, userID int64) (*CatchUpSummary, error)
+
+	// Identity operations
+	GetIdentityKey(ctx context.Context) ([]byte, error)
+	SaveIdentityKey(ctx context.Context, key []byte) error
+	GetAccountKey(ctx context.Context, userID int64) ([]byte, error)
+	SaveAccountKey(ctx context.Context, userID int64, key []byte) error
+
+	// Peer score operations
+	GetPeerScores(ctx context.Context) (map[string]float64, error)
+	SavePeerScores(ctx context.Context, scores map[string]float64) error
+
+	// Settings operations
+	GetSettings(ctx context.Context, userID int64) ([]*Setting, error)
+	GetSetting(ctx context.Context, userID, friendID int64, name string) (*Setting, error)
+	SaveSetting(ctx context.Context, setting *Setting) error
+	DeleteSetting(ctx context.Context, userID, friendID int64, name string) error
+
+	// Push endpoint operations
+	SavePushEndpoint(ctx context.Context, endpoint *PushEndpoint) error
+	GetPushEndpoint(ctx context.Context, peerID string) (*PushEndpoint, error)
+	DeletePushEndpoint(ctx context.Context, peerID string) error
+
+	// Account deletion
+	DeleteAccount(ctx context.Context, userID int64) error
+	ExportAccount(ctx context.Context, userID int64, destPath string, keepIdentity bool) error
+	MarkContactDeleted(ctx context.Context, peerID string) error
+	SaveDeletionNotice(ctx context.Context, notice *DeletionNotice) error
+	GetDeletionNotice(ctx context.Context, peerID string) (*DeletionNotice, error)
+	DeleteDeletionNotice(ctx context.Context, peerID string) error
+
+	// Maintenance
+	Backup(ctx context.Context, destPath, passphrase string) error
+	DefaultBackupPath() string
+	GetQuotaUsage(ctx context.Context) ([]*QuotaUsage, error)
+	EnforceQuotas(ctx context.Context) (map[QuotaCategory]int64, error)
+
+	// Diagnostics
+	Stats(ctx context.Context) (*DBStats, error)
+	SetSlowQueryThreshold(threshold time.Duration)
+	Ping(ctx context.Context) error
 
 	// Lifecycle
 	Close() error
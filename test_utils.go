@@ -19,7 +19,7 @@ func NewTestApp(t *testing.T) *App {
 	ctx, cancel := context.WithCancel(context.Background())
 	t.Cleanup(cancel)
 
-	p2pHost, _ := p2p.NewP2PHost(ctx, 0, nil) // Port 0 = random free port
+	p2pHost, _ := p2p.NewP2PHost(ctx, 0, nil, p2p.Options{}) // Port 0 = random free port
 
 	return &App{
 		config: &config.Config{
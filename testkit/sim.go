@@ -0,0 +1,204 @@
+package testkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// whisperProtocolPrefix selects the streams that simulated drops apply to; GossipSub
+// and DHT streams are long-lived, so use Disconnect to disturb conferences
+const whisperProtocolPrefix = "/whisper/"
+
+// dhtProtocolPrefix excludes whisper's DHT, which shares the /whisper prefix
+const dhtProtocolPrefix = p2p.DHTProtocolPrefix + "/kad/"
+
+// ErrStreamDropped is returned when the simulation drops a stream
+var ErrStreamDropped = errors.New("testkit: stream dropped by simulated network")
+
+// simulation holds the controllable state of a simulated network
+type simulation struct {
+	mock mocknet.Mocknet
+
+	mu       sync.Mutex
+	rng      *rand.Rand         // Seeded, so drop decisions repeat run to run
+	dropRate float64            // Probability each whisper stream is dropped
+	dropNext map[[2]peer.ID]int // from,to -> streams left to drop
+	dropped  int                // Streams dropped so far
+}
+
+// flakyHost wraps a simulated host and drops outbound streams as instructed
+type flakyHost struct {
+	host.Host
+	sim *simulation
+}
+
+// NewStream opens a stream unless the simulation decides to drop it
+func (h *flakyHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	if h.sim.shouldDrop(h.ID(), p, pids) {
+		return nil, ErrStreamDropped
+	}
+	return h.Host.NewStream(ctx, p, pids...)
+}
+
+// shouldDrop decides whether a stream from -> to is dropped
+func (s *simulation) shouldDrop(from, to peer.ID, pids []protocol.ID) bool {
+	whisper := false
+	for _, pid := range pids {
+		if strings.HasPrefix(string(pid), whisperProtocolPrefix) && !strings.HasPrefix(string(pid), dhtProtocolPrefix) {
+			whisper = true
+		}
+	}
+	if !whisper {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := [2]peer.ID{from, to}
+	if s.dropNext[key] > 0 {
+		s.dropNext[key]--
+		s.dropped++
+		return true
+	}
+	if s.dropRate > 0 && s.rng.Float64() < s.dropRate {
+		s.dropped++
+		return true
+	}
+	return false
+}
+
+// NewSimNetwork starts n nodes on a simulated in-memory swarm whose latency,
+// stream drops and connectivity are controlled by the test. Random drops use
+// seed, so a failing run can be replayed exactly. Nodes are not connected;
+// see ConnectAll.
+func NewSimNetwork(t testing.TB, n int, seed int64) *Network {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	mock := mocknet.New()
+	t.Cleanup(func() { mock.Close() })
+
+	net := &Network{
+		t:   t,
+		ctx: ctx,
+		sim: &simulation{
+			mock:     mock,
+			rng:      rand.New(rand.NewSource(seed)),
+			dropNext: make(map[[2]peer.ID]int),
+		},
+	}
+	for i := 0; i < n; i++ {
+		net.AddSimNode(fmt.Sprintf("node%d", i))
+	}
+	return net
+}
+
+// AddSimNode starts another node on the simulated swarm
+func (net *Network) AddSimNode(name string) *Node {
+	net.t.Helper()
+	net.requireSim()
+
+	return net.addNode(name, func(privKey crypto.PrivKey) host.Host {
+		addr, _ := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/10.0.0.%d/tcp/4001", len(net.Nodes)+1))
+		h, err := net.sim.mock.AddPeer(privKey, addr)
+		if err != nil {
+			net.t.Fatalf("testkit: %s: simulated host: %v", name, err)
+		}
+		return &flakyHost{Host: h, sim: net.sim}
+	})
+}
+
+// SetLatency applies a one-way delay to every current and future link
+func (net *Network) SetLatency(latency time.Duration) {
+	net.requireSim()
+
+	opts := mocknet.LinkOptions{Latency: latency}
+	net.sim.mock.SetLinkDefaults(opts)
+	for _, byPeer := range net.sim.mock.Links() {
+		for _, links := range byPeer {
+			for link := range links {
+				link.SetOptions(opts)
+			}
+		}
+	}
+}
+
+// SetDropRate makes each whisper protocol stream fail with the given probability
+func (net *Network) SetDropRate(rate float64) {
+	net.requireSim()
+
+	net.sim.mu.Lock()
+	defer net.sim.mu.Unlock()
+	net.sim.dropRate = rate
+}
+
+// DropNext makes the next count whisper protocol streams from a to b fail
+func (net *Network) DropNext(from, to *Node, count int) {
+	net.requireSim()
+
+	net.sim.mu.Lock()
+	defer net.sim.mu.Unlock()
+	net.sim.dropNext[[2]peer.ID{from.Host.PeerID(), to.Host.PeerID()}] = count
+}
+
+// DroppedStreams returns how many streams the simulation has dropped
+func (net *Network) DroppedStreams() int {
+	net.requireSim()
+
+	net.sim.mu.Lock()
+	defer net.sim.mu.Unlock()
+	return net.sim.dropped
+}
+
+// Disconnect cuts the link between a and b, closing their connections; they
+// cannot reach each other again until Reconnect
+func (net *Network) Disconnect(a, b *Node) {
+	net.t.Helper()
+	net.requireSim()
+
+	net.sim.mock.UnlinkPeers(a.Host.PeerID(), b.Host.PeerID())
+	if err := net.sim.mock.DisconnectPeers(a.Host.PeerID(), b.Host.PeerID()); err != nil {
+		net.t.Fatalf("testkit: disconnect %s / %s: %v", a.Name, b.Name, err)
+	}
+}
+
+// Reconnect restores the link between a and b and connects them
+func (net *Network) Reconnect(a, b *Node) {
+	net.t.Helper()
+	net.requireSim()
+
+	if len(net.sim.mock.LinksBetweenPeers(a.Host.PeerID(), b.Host.PeerID())) == 0 {
+		if _, err := net.sim.mock.LinkPeers(a.Host.PeerID(), b.Host.PeerID()); err != nil {
+			net.t.Fatalf("testkit: link %s / %s: %v", a.Name, b.Name, err)
+		}
+	}
+	if _, err := net.sim.mock.ConnectPeers(a.Host.PeerID(), b.Host.PeerID()); err != nil {
+		net.t.Fatalf("testkit: connect %s -> %s: %v", a.Name, b.Name, err)
+	}
+}
+
+// requireSim fails the test when network conditions are used on a real network
+func (net *Network) requireSim() {
+	net.t.Helper()
+	if net.sim == nil {
+		net.t.Fatalf("testkit: network conditions need a network from NewSimNetwork")
+	}
+}
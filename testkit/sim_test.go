@@ -0,0 +1,150 @@
+package testkit_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/austinwklein/whisper/storage"
+	"github.com/austinwklein/whisper/testkit"
+)
+
+// simSeed fixes the simulated network's random drops so failures replay
+const simSeed = 1160
+
+// delivered reports whether every message from a to b is marked delivered
+func delivered(a, b *testkit.Node) bool {
+	for _, msg := range a.Conversation(b) {
+		if msg.FromUserID == a.User.ID && !msg.Delivered {
+			return false
+		}
+	}
+	return true
+}
+
+// newSimPair starts two connected friends on a simulated network
+func newSimPair(t *testing.T) (*testkit.Network, *testkit.Node, *testkit.Node) {
+	t.Helper()
+	net := testkit.NewSimNetwork(t, 2, simSeed)
+	alice, bob := net.Nodes[0], net.Nodes[1]
+	net.ConnectAll()
+	net.MakeFriends(alice, bob)
+	return net, alice, bob
+}
+
+// TestRetryDeliversDroppedMessage checks a message whose stream is dropped
+// stays undelivered and goes through on the next retry
+func TestRetryDeliversDroppedMessage(t *testing.T) {
+	net, alice, bob := newSimPair(t)
+	ctx := net.Context()
+
+	net.DropNext(alice, bob, 1)
+	if err := alice.Messages.SendMessage(ctx, alice.User, bob.Name, "are you there?"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if got := net.DroppedStreams(); got != 1 {
+		t.Fatalf("dropped %d streams, want 1", got)
+	}
+	if delivered(alice, bob) {
+		t.Fatal("dropped message marked delivered")
+	}
+	if bob.HasMessage(alice, "are you there?") {
+		t.Fatal("bob received a dropped message")
+	}
+
+	if err := alice.Messages.RetryUndeliveredMessages(ctx, alice.User.ID); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	net.Eventually(func() bool { return bob.HasMessage(alice, "are you there?") }, "bob receives the retried message")
+	if !delivered(alice, bob) {
+		t.Fatal("retried message not marked delivered")
+	}
+}
+
+// TestRetryDeliversAfterReconnect checks messages sent while disconnected
+// wait and are delivered once the link comes back
+func TestRetryDeliversAfterReconnect(t *testing.T) {
+	net, alice, bob := newSimPair(t)
+	ctx := net.Context()
+
+	net.Disconnect(alice, bob)
+	for i := 1; i <= 3; i++ {
+		if err := alice.Messages.SendMessage(ctx, alice.User, bob.Name, fmt.Sprintf("offline %d", i)); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+
+	// Retrying while still disconnected leaves them waiting
+	if err := alice.Messages.RetryUndeliveredMessages(ctx, alice.User.ID); err != nil {
+		t.Fatalf("retry while disconnected: %v", err)
+	}
+	if delivered(alice, bob) {
+		t.Fatal("messages marked delivered while disconnected")
+	}
+
+	net.Reconnect(alice, bob)
+	if err := alice.Messages.RetryUndeliveredMessages(ctx, alice.User.ID); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		content := fmt.Sprintf("offline %d", i)
+		net.Eventually(func() bool { return bob.HasMessage(alice, content) }, "bob receives %q", content)
+	}
+	if !delivered(alice, bob) {
+		t.Fatal("messages not marked delivered after reconnect")
+	}
+
+	// Stored in the order they were sent
+	var got []string
+	conversation := bob.Conversation(alice)
+	for i := len(conversation) - 1; i >= 0; i-- {
+		if msg := conversation[i]; msg.Kind == storage.MessageKindUser {
+			got = append(got, msg.Content)
+		}
+	}
+	want := []string{"offline 1", "offline 2", "offline 3"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("bob stored %q, want %q", got, want)
+	}
+}
+
+// TestRetryDeliversUnderRandomDrops checks every message gets through
+// exactly once when a share of streams fail at random
+func TestRetryDeliversUnderRandomDrops(t *testing.T) {
+	net, alice, bob := newSimPair(t)
+	ctx := net.Context()
+
+	const count = 10
+	net.SetDropRate(0.3)
+	for i := 1; i <= count; i++ {
+		if err := alice.Messages.SendMessage(ctx, alice.User, bob.Name, fmt.Sprintf("message %d", i)); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	if net.DroppedStreams() == 0 {
+		t.Fatalf("seed %d dropped no streams; pick one that does", simSeed)
+	}
+
+	for attempt := 0; attempt < 20 && !delivered(alice, bob); attempt++ {
+		if err := alice.Messages.RetryUndeliveredMessages(ctx, alice.User.ID); err != nil {
+			t.Fatalf("retry: %v", err)
+		}
+	}
+	if !delivered(alice, bob) {
+		t.Fatalf("messages still undelivered after 20 retries (%d streams dropped)", net.DroppedStreams())
+	}
+
+	net.SetDropRate(0)
+	for i := 1; i <= count; i++ {
+		content := fmt.Sprintf("message %d", i)
+		net.Eventually(func() bool { return bob.HasMessage(alice, content) }, "bob receives %q", content)
+	}
+	seen := make(map[string]int)
+	for _, msg := range bob.Conversation(alice) {
+		seen[msg.Content]++
+	}
+	for content, n := range seen {
+		if n > 1 {
+			t.Errorf("bob stored %q %d times", content, n)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Package testkit runs several whisper nodes in one process so tests can drive
+// the real friend, message and conference protocols end to end. Each node has
+// in-memory storage and a libp2p host listening on loopback.
+package testkit
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/austinwklein/whisper/auth"
+	"github.com/austinwklein/whisper/conference"
+	"github.com/austinwklein/whisper/friends"
+	"github.com/austinwklein/whisper/messages"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/storage"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// DefaultTimeout bounds how long Eventually waits for a condition
+var DefaultTimeout = 10 * time.Second
+
+// Password is the password every testkit account is registered with
+const Password = "testkit-password"
+
+// Node is one in-process whisper node with a logged-in account
+type Node struct {
+	Name        string
+	Storage     *storage.SQLiteStorage
+	Host        *p2p.P2PHost
+	Auth        *auth.AuthService
+	Friends     *friends.Manager
+	Messages    *messages.Manager
+	Conferences *conference.Manager
+	User        *storage.User // The node's logged-in account
+}
+
+// Network is a set of nodes that are torn down together when the test ends
+type Network struct {
+	t     testing.TB
+	ctx   context.Context
+	Nodes []*Node
+
+	sim *simulation // Set for simulated networks; see NewSimNetwork
+}
+
+// NewNetwork starts n nodes named node0..node(n-1), each logged in to an
+// account of the same name. Nodes are not connected; see ConnectAll.
+func NewNetwork(t testing.TB, n int) *Network {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	net := &Network{t: t, ctx: ctx}
+	for i := 0; i < n; i++ {
+		net.AddNode(fmt.Sprintf("node%d", i))
+	}
+	return net
+}
+
+// Context returns the network's context, canceled when the test ends
+func (net *Network) Context() context.Context {
+	return net.ctx
+}
+
+// AddNode starts another node with an account called name
+func (net *Network) AddNode(name string) *Node {
+	net.t.Helper()
+	return net.addNode(name, nil)
+}
+
+// addNode starts a node, on a host built by inject if given
+func (net *Network) addNode(name string, inject func(privKey crypto.PrivKey) host.Host) *Node {
+	t := net.t
+	t.Helper()
+
+	store, err := storage.NewMemoryStorage()
+	if err != nil {
+		t.Fatalf("testkit: %s: storage: %v", name, err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	privKey, err := p2p.LoadOrCreateIdentity(net.ctx, store)
+	if err != nil {
+		t.Fatalf("testkit: %s: identity: %v", name, err)
+	}
+
+	// Port 0 picks a free port; client mode keeps the DHT out of the way
+	opts := p2p.Options{
+		DHTMode:    p2p.DHTModeClient,
+		ScoreStore: store,
+	}
+	if inject != nil {
+		opts.Host = inject(privKey)
+	}
+	p2pHost, err := p2p.NewP2PHost(net.ctx, 0, privKey, opts)
+	if err != nil {
+		t.Fatalf("testkit: %s: host: %v", name, err)
+	}
+	t.Cleanup(func() { p2pHost.Close() })
+
+	node := &Node{
+		Name:        name,
+		Storage:     store,
+		Host:        p2pHost,
+		Auth:        auth.NewAuthService(store),
+		Friends:     friends.NewManager(store, p2pHost.Host()),
+		Messages:    messages.NewManager(store, p2pHost.Host()),
+		Conferences: conference.NewManager(store, p2pHost.Host(), p2pHost.PubSub()),
+	}
+
+	if err := node.Auth.Register(net.ctx, name, Password, name, p2pHost.PeerID().String()); err != nil {
+		t.Fatalf("testkit: %s: register: %v", name, err)
+	}
+	node.User, err = node.Auth.Login(net.ctx, name, Password)
+	if err != nil {
+		t.Fatalf("testkit: %s: login: %v", name, err)
+	}
+	node.Friends.SetCurrentUser(node.User.ID)
+	node.Messages.SetCurrentUser(node.User.ID)
+	node.Conferences.SetCurrentUser(node.User.ID)
+	t.Cleanup(func() { node.Conferences.UnsubscribeAll() })
+
+	net.Nodes = append(net.Nodes, node)
+	return node
+}
+
+// Connect dials b from a over loopback (or the simulated swarm)
+func (net *Network) Connect(a, b *Node) {
+	net.t.Helper()
+
+	if net.sim != nil {
+		net.Reconnect(a, b)
+		return
+	}
+
+	info := peer.AddrInfo{ID: b.Host.PeerID(), Addrs: b.Host.Addrs()}
+	if err := a.Host.Host().Connect(net.ctx, info); err != nil {
+		net.t.Fatalf("testkit: connect %s -> %s: %v", a.Name, b.Name, err)
+	}
+}
+
+// ConnectAll connects every pair of nodes
+func (net *Network) ConnectAll() {
+	net.t.Helper()
+
+	for i, a := range net.Nodes {
+		for _, b := range net.Nodes[i+1:] {
+			net.Connect(a, b)
+		}
+	}
+}
+
+// MakeFriends runs the friend request protocol from a to b and waits until
+// both sides have an accepted friendship
+func (net *Network) MakeFriends(a, b *Node) {
+	net.t.Helper()
+
+	if err := a.Friends.SendFriendRequest(net.ctx, a.User, b.Host.PeerID()); err != nil {
+		net.t.Fatalf("testkit: %s friend request to %s: %v", a.Name, b.Name, err)
+	}
+	net.Eventually(func() bool {
+		pending, err := b.Friends.GetPendingRequests(net.ctx, b.User.ID)
+		return err == nil && len(pending) > 0
+	}, "%s receives friend request from %s", b.Name, a.Name)
+
+	if err := b.Friends.AcceptFriendRequest(net.ctx, b.User, a.Name); err != nil {
+		net.t.Fatalf("testkit: %s accept %s: %v", b.Name, a.Name, err)
+	}
+	net.Eventually(func() bool {
+		return a.IsFriendOf(b) && b.IsFriendOf(a)
+	}, "%s and %s become friends", a.Name, b.Name)
+}
+
+// Eventually fails the test unless cond becomes true within DefaultTimeout
+func (net *Network) Eventually(cond func() bool, format string, args ...interface{}) {
+	net.t.Helper()
+
+	deadline := time.Now().Add(DefaultTimeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	net.t.Fatalf("testkit: timed out waiting for: "+format, args...)
+}
+
+// IsFriendOf reports whether n has an accepted friendship with other, recorded
+// in either direction (the requester's copy is stored from the accepter's side)
+func (n *Node) IsFriendOf(other *Node) bool {
+	ctx := context.Background()
+	contact, err := n.Storage.GetUserByPeerID(ctx, other.Host.PeerID().String())
+	if err != nil {
+		return false
+	}
+	for _, pair := range [][2]int64{{n.User.ID, contact.ID}, {contact.ID, n.User.ID}} {
+		friendship, err := n.Storage.GetFriendRequest(ctx, pair[0], pair[1])
+		if err == nil && friendship != nil && friendship.Status == "accepted" {
+			return true
+		}
+	}
+	return false
+}
+
+// Conversation returns the direct messages n has stored with other, newest first
+func (n *Node) Conversation(other *Node) []*storage.Message {
+	ctx := context.Background()
+	contact, err := n.Storage.GetUserByPeerID(ctx, other.Host.PeerID().String())
+	if err != nil {
+		return nil
+	}
+	msgs, err := n.Messages.GetConversation(ctx, n.User.ID, contact.ID, 1000)
+	if err != nil {
+		return nil
+	}
+	return msgs
+}
+
+// HasMessage reports whether n has stored a direct message from other with the given content
+func (n *Node) HasMessage(from *Node, content string) bool {
+	for _, msg := range n.Conversation(from) {
+		if msg.FromPeerID == from.Host.PeerID().String() && msg.Content == content {
+			return true
+		}
+	}
+	return false
+}
+
+// HasConferenceMessage reports whether n has stored a conference message with the given content
+func (n *Node) HasConferenceMessage(conferenceID int64, content string) bool {
+	msgs, err := n.Conferences.GetConferenceMessages(context.Background(), conferenceID, 1000)
+	if err != nil {
+		return false
+	}
+	for _, msg := range msgs {
+		if msg.Content == content {
+			return true
+		}
+	}
+	return false
+}
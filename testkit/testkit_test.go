@@ -0,0 +1,69 @@
+package testkit_test
+
+import (
+	"testing"
+
+	"github.com/austinwklein/whisper/storage"
+	"github.com/austinwklein/whisper/testkit"
+)
+
+// TestFriendMessageConferenceRoundTrip drives two real nodes through
+// becoming friends, a direct message each way and a conference conversation
+func TestFriendMessageConferenceRoundTrip(t *testing.T) {
+	net := testkit.NewNetwork(t, 2)
+	alice, bob := net.Nodes[0], net.Nodes[1]
+	ctx := net.Context()
+
+	net.ConnectAll()
+	net.MakeFriends(alice, bob)
+
+	if err := alice.Messages.SendMessage(ctx, alice.User, bob.Name, "hello bob"); err != nil {
+		t.Fatalf("alice send: %v", err)
+	}
+	net.Eventually(func() bool { return bob.HasMessage(alice, "hello bob") }, "bob receives alice's message")
+	if err := bob.Messages.SendMessage(ctx, bob.User, alice.Name, "hello alice"); err != nil {
+		t.Fatalf("bob send: %v", err)
+	}
+	net.Eventually(func() bool { return alice.HasMessage(bob, "hello alice") }, "alice receives bob's reply")
+	net.Eventually(func() bool {
+		conversation := alice.Conversation(bob)
+		for _, msg := range conversation {
+			if msg.Content == "hello bob" && !msg.Delivered {
+				return false
+			}
+		}
+		return len(conversation) > 0
+	}, "alice's message is acknowledged")
+
+	conf, err := alice.Conferences.CreateConference(ctx, alice.User, "book club")
+	if err != nil {
+		t.Fatalf("create conference: %v", err)
+	}
+	if err := alice.Conferences.InviteToConference(ctx, alice.User, conf.ID, bob.Name); err != nil {
+		t.Fatalf("invite: %v", err)
+	}
+	net.Eventually(func() bool {
+		feed, err := bob.Storage.GetActivityFeed(ctx, bob.User.ID, 0, 10)
+		if err != nil {
+			return false
+		}
+		for _, activity := range feed {
+			if activity.Kind == storage.ActivityConferenceInvite && activity.ConferenceID == conf.ID {
+				return true
+			}
+		}
+		return false
+	}, "bob receives the invite")
+	if err := bob.Conferences.JoinConference(ctx, bob.User, conf.ID); err != nil {
+		t.Fatalf("join: %v", err)
+	}
+
+	if err := bob.Conferences.SendMessage(ctx, bob.User, conf.ID, "first chapter done"); err != nil {
+		t.Fatalf("bob conference send: %v", err)
+	}
+	net.Eventually(func() bool { return alice.HasConferenceMessage(conf.ID, "first chapter done") }, "alice receives bob's conference message")
+	if err := alice.Conferences.SendMessage(ctx, alice.User, conf.ID, "no spoilers"); err != nil {
+		t.Fatalf("alice conference send: %v", err)
+	}
+	net.Eventually(func() bool { return bob.HasConferenceMessage(conf.ID, "no spoilers") }, "bob receives alice's conference message")
+}
@@ -0,0 +1,168 @@
+// Command notfoundcheck reports call sites that mishandle storage lookups
+// returning storage.ErrNotFound. The user, conference and group getters never return
+// a nil result without an error, so a caller must not discard the error or
+// test the result against nil to find out whether the row exists.
+//
+// Its test checks the whole module as part of `go test ./...`. It can also be
+// run from the module root with `make check-notfound`, exiting non-zero when
+// it finds anything.
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// lookups are the storage getters that return ErrNotFound
+var lookups = map[string]bool{
+	"GetUserByID":       true,
+	"GetUserByUsername": true,
+	"GetUserByPeerID":   true,
+	"GetUserByAlias":    true,
+	"GetConference":     true,
+	"GetGroup":          true,
+	"GetGroupByUID":     true,
+}
+
+func main() {
+	root := "."
+	if len(os.Args) > 1 {
+		root = os.Args[1]
+	}
+
+	problems, err := checkTree(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "notfoundcheck: %v\n", err)
+		os.Exit(2)
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// checkTree checks every Go file under root, skipping hidden and vendor
+// directories
+func checkTree(root string) ([]string, error) {
+	fset := token.NewFileSet()
+	var problems []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if name := d.Name(); path != root && (strings.HasPrefix(name, ".") || name == "vendor") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") {
+			return nil
+		}
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, checkFile(fset, file)...)
+		return nil
+	})
+	return problems, err
+}
+
+// checkFile checks every function in a file
+func checkFile(fset *token.FileSet, file *ast.File) []string {
+	var problems []string
+	ast.Inspect(file, func(n ast.Node) bool {
+		var body *ast.BlockStmt
+		switch fn := n.(type) {
+		case *ast.FuncDecl:
+			body = fn.Body
+		case *ast.FuncLit:
+			body = fn.Body
+		}
+		if body != nil {
+			problems = append(problems, checkBody(fset, body)...)
+		}
+		return true
+	})
+	return problems
+}
+
+// checkBody finds lookups in a function body whose error is discarded, and
+// nil checks on the results of lookups made earlier in the same body
+func checkBody(fset *token.FileSet, body *ast.BlockStmt) []string {
+	var problems []string
+	results := make(map[string]token.Pos) // Result variable -> where it was looked up
+
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch node := n.(type) {
+		case *ast.FuncLit:
+			return false // Checked on its own by checkFile
+		case *ast.ExprStmt:
+			if name := lookupName(node.X); name != "" {
+				problems = append(problems, fmt.Sprintf("%s: result and error of %s discarded", fset.Position(node.Pos()), name))
+			}
+		case *ast.AssignStmt:
+			if len(node.Rhs) != 1 || len(node.Lhs) != 2 {
+				return true
+			}
+			name := lookupName(node.Rhs[0])
+			if name == "" {
+				return true
+			}
+			if isBlank(node.Lhs[1]) {
+				problems = append(problems, fmt.Sprintf("%s: error of %s discarded; it returns storage.ErrNotFound for missing rows", fset.Position(node.Pos()), name))
+			}
+			if id, ok := node.Lhs[0].(*ast.Ident); ok && id.Name != "_" {
+				results[id.Name] = node.Pos()
+			}
+		case *ast.BinaryExpr:
+			if node.Op != token.EQL && node.Op != token.NEQ {
+				return true
+			}
+			for _, pair := range [][2]ast.Expr{{node.X, node.Y}, {node.Y, node.X}} {
+				id, ok := pair[0].(*ast.Ident)
+				if !ok || !isNil(pair[1]) {
+					continue
+				}
+				if pos, ok := results[id.Name]; ok && pos < node.Pos() {
+					problems = append(problems, fmt.Sprintf("%s: %s compared with nil; check for storage.ErrNotFound instead", fset.Position(node.Pos()), id.Name))
+				}
+			}
+		}
+		return true
+	})
+	return problems
+}
+
+// lookupName returns the getter name if expr calls one of the lookups
+func lookupName(expr ast.Expr) string {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok {
+		return ""
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || !lookups[sel.Sel.Name] {
+		return ""
+	}
+	return sel.Sel.Name
+}
+
+func isBlank(expr ast.Expr) bool {
+	id, ok := expr.(*ast.Ident)
+	return ok && id.Name == "_"
+}
+
+func isNil(expr ast.Expr) bool {
+	id, ok := expr.(*ast.Ident)
+	return ok && id.Name == "nil"
+}
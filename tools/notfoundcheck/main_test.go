@@ -0,0 +1,86 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+// TestModule fails when any code in the module mishandles a lookup
+func TestModule(t *testing.T) {
+	problems, err := checkTree("../..")
+	if err != nil {
+		t.Fatalf("failed to check the module: %v", err)
+	}
+	for _, problem := range problems {
+		t.Error(strings.TrimPrefix(problem, "../../"))
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string // Substrings of the problems reported, in order
+	}{
+		{
+			name: "error checked",
+			body: `user, err := s.GetUserByID(ctx, id)
+				if errors.Is(err, storage.ErrNotFound) { return }
+				use(user)`,
+		},
+		{
+			name: "error discarded",
+			body: `user, _ := s.GetUserByUsername(ctx, name)
+				use(user)`,
+			want: []string{"error of GetUserByUsername discarded"},
+		},
+		{
+			name: "result and error discarded",
+			body: `s.GetConference(ctx, id)`,
+			want: []string{"result and error of GetConference discarded"},
+		},
+		{
+			name: "result compared with nil",
+			body: `group, err := s.GetGroup(ctx, userID, id)
+				if err != nil || group == nil { return }`,
+			want: []string{"group compared with nil"},
+		},
+		{
+			name: "nil check before the lookup",
+			body: `var user *storage.User
+				if user == nil { user, err = s.GetUserByPeerID(ctx, id) }`,
+		},
+		{
+			name: "other getters may return nil",
+			body: `friendship, _ := s.GetFriendRequest(ctx, a, b)
+				if friendship == nil { return }`,
+		},
+		{
+			name: "function literals checked on their own",
+			body: `user, err := s.GetUserByAlias(ctx, name)
+				fn := func() { if user == nil { return } }
+				fn()`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := "package p\n\nfunc f() {\n" + tt.body + "\n}\n"
+			fset := token.NewFileSet()
+			file, err := parser.ParseFile(fset, "p.go", src, 0)
+			if err != nil {
+				t.Fatalf("bad test source: %v", err)
+			}
+			problems := checkFile(fset, file)
+			if len(problems) != len(tt.want) {
+				t.Fatalf("got problems %q, want %d", problems, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(problems[i], want) {
+					t.Errorf("problem %q doesn't mention %q", problems[i], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+// Command releasefeed writes the signed release feed whisper nodes check when
+// WHISPER_UPDATE_CHECK=feed. Publishers create a key pair once:
+//
+//	go run ./tools/releasefeed -genkey release.key
+//
+// which prints the public key to give users as WHISPER_UPDATE_KEY, and then
+// for each release:
+//
+//	go run ./tools/releasefeed -key release.key -version v1.5.0 -url https://... -notes "..." > feed.json
+//
+// and serve feed.json at the WHISPER_UPDATE_FEED URL.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/austinwklein/whisper/update"
+)
+
+func main() {
+	genKey := flag.String("genkey", "", "write a new private key to this file and print its public key")
+	keyFile := flag.String("key", "", "private key file made with -genkey")
+	version := flag.String("version", "", "release version, e.g. v1.5.0")
+	url := flag.String("url", "", "where to download the release")
+	notes := flag.String("notes", "", "short summary of what changed")
+	flag.Parse()
+
+	if *genKey != "" {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			fail("failed to generate key: %v", err)
+		}
+		if err := os.WriteFile(*genKey, []byte(base64.StdEncoding.EncodeToString(private)+"\n"), 0600); err != nil {
+			fail("failed to write key: %v", err)
+		}
+		fmt.Printf("WHISPER_UPDATE_KEY=%s\n", base64.StdEncoding.EncodeToString(public))
+		return
+	}
+
+	if *keyFile == "" || *version == "" {
+		fail("usage: releasefeed -genkey <file> | -key <file> -version <v> [-url <url>] [-notes <text>]")
+	}
+	data, err := os.ReadFile(*keyFile)
+	if err != nil {
+		fail("failed to read key: %v", err)
+	}
+	private, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(private) != ed25519.PrivateKeySize {
+		fail("%s is not a key made with -genkey", *keyFile)
+	}
+
+	release := &update.Release{Version: *version, URL: *url, Notes: *notes, Published: time.Now().Unix()}
+	feed, err := update.SignFeed(release, ed25519.PrivateKey(private))
+	if err != nil {
+		fail("%v", err)
+	}
+	// Check the feed the way nodes will before it is published
+	if _, err := update.VerifyFeed(feed, ed25519.PrivateKey(private).Public().(ed25519.PublicKey)); err != nil {
+		fail("%v", err)
+	}
+	fmt.Println(string(feed))
+}
+
+// fail prints an error and exits non-zero
+func fail(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
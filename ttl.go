@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/messages"
+	"github.com/austinwklein/whisper/storage"
+)
+
+// messageExpiryInterval is how often queued messages are checked against
+// their delivery deadlines
+const messageExpiryInterval = time.Minute
+
+// parseTTL parses a delivery deadline such as 90m, 2h or 3d
+func parseTTL(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("%q is not a positive number of days", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("%q is not a positive duration", value)
+	}
+	return ttl, nil
+}
+
+// expireQueuedMessages gives up on queued messages as their delivery
+// deadlines pass, until the session ends
+func (a *App) expireQueuedMessages(ctx context.Context, user *storage.User) {
+	ticker := time.NewTicker(messageExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := a.messageManager.ExpireUndeliveredMessages(ctx, user.ID); err != nil {
+			i18n.Printf("\nWarning: %v\n> ", err)
+		}
+	}
+}
+
+// onMessageFailed tells the user a message missed its delivery deadline
+func (a *App) onMessageFailed(ctx context.Context, msg *storage.Message, contact *storage.User) {
+	waited := msg.ExpiresAt.Sub(msg.CreatedAt).Round(time.Minute)
+	if a.auth.IsLocked() {
+		i18n.Printf("\n✗ Message #%d wasn't delivered within %s and won't be retried\n> ", msg.ID, waited)
+		return
+	}
+	i18n.Printf("\n✗ Message #%d to %s wasn't delivered within %s and won't be retried: %s\n> ", msg.ID, contact.Username, waited, msg.Preview)
+	if attempts, err := a.storage.GetDeliveryAttempts(ctx, msg.ID); err == nil && len(attempts) > 0 {
+		i18n.Printf("  Last try: %s\n> ", messages.DeliveryHint(attempts[len(attempts)-1].Reason, contact.Username))
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+
+	"github.com/austinwklein/whisper/i18n"
+	"github.com/austinwklein/whisper/p2p"
+	"github.com/austinwklein/whisper/update"
+)
+
+// onUpdateAvailable tells the user a newer release exists. Nothing is
+// downloaded; they update themselves.
+func (a *App) onUpdateAvailable(release *update.Available) {
+	if release.Source == update.SourcePeer {
+		i18n.Printf("\n🆕 %s runs Whisper %s, newer than your %s\n> ", release.From, release.Version, p2p.Version)
+		return
+	}
+	i18n.Printf("\n🆕 Whisper %s is available (you run %s) - 'update' for details\n> ", release.Version, p2p.Version)
+}
+
+// noticePeerRelease lets the update checker learn from the version a newly
+// identified contact runs; strangers could claim anything
+func (a *App) noticePeerRelease(ctx context.Context, info *p2p.PeerInfo) {
+	if info.Version == "" {
+		return
+	}
+	contact, err := a.storage.GetUserByPeerID(ctx, info.ID.String())
+	if err != nil || !contact.IsRemote() {
+		return
+	}
+	a.updates.ObservePeer(contact.Username, info.Version)
+}
+
+// runUpdate handles `update`, showing this build's version and the newest
+// release found, and `update check`, fetching the release feed now
+func (a *App) runUpdate(ctx context.Context, args []string) {
+	if len(args) > 0 && args[0] != "check" {
+		i18n.Println("Usage: update [check]")
+		return
+	}
+	if len(args) > 0 {
+		release, err := a.updates.Check(ctx)
+		if err != nil {
+			i18n.Printf("Failed to check for updates: %v\n", err)
+			return
+		}
+		if !update.Newer(release.Version, p2p.Version) {
+			i18n.Printf("✓ You run the latest release (%s)\n", release.Version)
+			return
+		}
+	}
+
+	status := a.updates.Status()
+	i18n.Printf("\n=== Whisper %s (%s) ===\n", status.Current, p2p.Platform)
+	switch status.Mode {
+	case update.ModeOff:
+		i18n.Println("Update checks: off (set WHISPER_UPDATE_CHECK to peers or feed)")
+	case update.ModePeers:
+		i18n.Println("Update checks: versions friends run")
+	case update.ModeFeed:
+		i18n.Println("Update checks: release feed and versions friends run")
+	}
+	if !status.LastCheck.IsZero() {
+		i18n.Printf("Feed checked: %s\n", status.LastCheck.Local().Format("Jan 2 15:04"))
+	}
+	if status.LastError != nil {
+		i18n.Printf("Last check failed: %v\n", status.LastError)
+	}
+
+	latest := status.Latest
+	switch {
+	case latest == nil:
+		i18n.Println("No newer release seen")
+	case latest.Source == update.SourcePeer:
+		i18n.Printf("Newer release: %s (%s runs it)\n", latest.Version, latest.From)
+	default:
+		i18n.Printf("Newer release: %s\n", latest.Version)
+		if latest.URL != "" {
+			i18n.Printf("  Get it at %s\n", latest.URL)
+		}
+		if latest.Notes != "" {
+			i18n.Printf("  %s\n", latest.Notes)
+		}
+	}
+	i18n.Println()
+}
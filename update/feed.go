@@ -0,0 +1,99 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"golang.org/x/mod/semver"
+)
+
+const (
+	// maxFeedSize bounds the release feed document
+	maxFeedSize = 64 * 1024
+
+	// maxNotesLength bounds the release notes shown to the user
+	maxNotesLength = 1024
+)
+
+// ErrBadSignature is returned when the release feed isn't signed by the
+// configured key
+var ErrBadSignature = errors.New("release feed signature doesn't match the configured key")
+
+// Release is the newest whisper release, as the feed describes it
+type Release struct {
+	Version   string `json:"version"`             // Semantic version, e.g. v1.5.0
+	URL       string `json:"url,omitempty"`       // Where to download it
+	Notes     string `json:"notes,omitempty"`     // A short summary of what changed
+	Published int64  `json:"published,omitempty"` // Unix seconds
+}
+
+// SignedFeed is the document served at the release feed URL. Signature is
+// the ed25519 signature of the Release bytes exactly as they appear.
+type SignedFeed struct {
+	Release   json.RawMessage `json:"release"`
+	Signature []byte          `json:"signature"` // base64 in JSON
+}
+
+// SignFeed builds a feed document for release, signed with key; release
+// publishers serve its output at the feed URL
+func SignFeed(release *Release, key ed25519.PrivateKey) ([]byte, error) {
+	data, err := json.Marshal(release)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal release: %w", err)
+	}
+	return json.Marshal(&SignedFeed{Release: data, Signature: ed25519.Sign(key, data)})
+}
+
+// VerifyFeed checks a feed document's signature against key and returns the
+// release it describes
+func VerifyFeed(data []byte, key ed25519.PublicKey) (*Release, error) {
+	var feed SignedFeed
+	if err := json.Unmarshal(data, &feed); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal release feed: %w", err)
+	}
+	if !ed25519.Verify(key, feed.Release, feed.Signature) {
+		return nil, ErrBadSignature
+	}
+
+	var release Release
+	if err := json.Unmarshal(feed.Release, &release); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal release: %w", err)
+	}
+	if !semver.IsValid(release.Version) {
+		return nil, fmt.Errorf("release version %q isn't a semantic version", release.Version)
+	}
+	if len(release.Notes) > maxNotesLength {
+		release.Notes = release.Notes[:maxNotesLength]
+	}
+	return &release, nil
+}
+
+// fetchRelease downloads and verifies the release feed
+func fetchRelease(ctx context.Context, client *http.Client, feedURL string, key ed25519.PublicKey) (*Release, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create feed request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch release feed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("release feed answered %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFeedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read release feed: %w", err)
+	}
+	if len(data) > maxFeedSize {
+		return nil, fmt.Errorf("release feed is larger than %d bytes", maxFeedSize)
+	}
+	return VerifyFeed(data, key)
+}
@@ -0,0 +1,168 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newKey returns a fresh release signing key
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return public, private
+}
+
+// signedFeed signs release with key
+func signedFeed(t *testing.T, release *Release, key ed25519.PrivateKey) []byte {
+	t.Helper()
+	data, err := SignFeed(release, key)
+	if err != nil {
+		t.Fatalf("failed to sign feed: %v", err)
+	}
+	return data
+}
+
+// tamper rewrites the signed release inside a feed document, keeping its signature
+func tamper(t *testing.T, data []byte, edit func(*Release)) []byte {
+	t.Helper()
+	var feed SignedFeed
+	if err := json.Unmarshal(data, &feed); err != nil {
+		t.Fatalf("failed to unmarshal feed: %v", err)
+	}
+	var release Release
+	if err := json.Unmarshal(feed.Release, &release); err != nil {
+		t.Fatalf("failed to unmarshal release: %v", err)
+	}
+	edit(&release)
+	var err error
+	if feed.Release, err = json.Marshal(&release); err != nil {
+		t.Fatalf("failed to marshal release: %v", err)
+	}
+	if data, err = json.Marshal(&feed); err != nil {
+		t.Fatalf("failed to marshal feed: %v", err)
+	}
+	return data
+}
+
+func TestVerifyFeed(t *testing.T) {
+	public, private := newKey(t)
+	_, otherKey := newKey(t)
+	release := &Release{Version: "v1.5.0", URL: "https://example.com/whisper/v1.5.0", Notes: "Faster sync", Published: 1790000000}
+	good := signedFeed(t, release, private)
+
+	flipped := func() []byte {
+		var feed SignedFeed
+		if err := json.Unmarshal(good, &feed); err != nil {
+			t.Fatalf("failed to unmarshal feed: %v", err)
+		}
+		feed.Signature[0] ^= 1
+		data, _ := json.Marshal(&feed)
+		return data
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error // nil for any error
+	}{
+		{"version raised", tamper(t, good, func(r *Release) { r.Version = "v9.0.0" }), ErrBadSignature},
+		{"download moved", tamper(t, good, func(r *Release) { r.URL = "https://attacker.example/whisper" }), ErrBadSignature},
+		{"signature altered", flipped(), ErrBadSignature},
+		{"signed by another key", signedFeed(t, release, otherKey), ErrBadSignature},
+		{"signature missing", []byte(`{"release":{"version":"v1.5.0"}}`), ErrBadSignature},
+		{"not JSON", []byte("<html>moved</html>"), nil},
+		{"signed but not a semantic version", signedFeed(t, &Release{Version: "1.5"}, private), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := VerifyFeed(tt.data, public)
+			if err == nil {
+				t.Fatalf("VerifyFeed accepted %+v", got)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyFeed error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("genuine", func(t *testing.T) {
+		got, err := VerifyFeed(good, public)
+		if err != nil {
+			t.Fatalf("VerifyFeed: %v", err)
+		}
+		if *got != *release {
+			t.Errorf("VerifyFeed = %+v, want %+v", *got, *release)
+		}
+	})
+
+	t.Run("long notes cut", func(t *testing.T) {
+		got, err := VerifyFeed(signedFeed(t, &Release{Version: "v1.5.0", Notes: strings.Repeat("n", maxNotesLength*2)}, private), public)
+		if err != nil {
+			t.Fatalf("VerifyFeed: %v", err)
+		}
+		if len(got.Notes) != maxNotesLength {
+			t.Errorf("notes are %d bytes, want %d", len(got.Notes), maxNotesLength)
+		}
+	})
+}
+
+func TestCheckVerifiesFetchedFeed(t *testing.T) {
+	public, private := newKey(t)
+	good := signedFeed(t, &Release{Version: "v1.5.0", URL: "https://example.com/v1.5.0"}, private)
+
+	tests := []struct {
+		name    string
+		status  int
+		body    []byte
+		offered bool
+	}{
+		{"genuine feed", http.StatusOK, good, true},
+		{"tampered feed", http.StatusOK, tamper(t, good, func(r *Release) { r.Version = "v2.0.0" }), false},
+		{"oversized feed", http.StatusOK, append(good, make([]byte, maxFeedSize)...), false},
+		{"feed missing", http.StatusNotFound, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write(tt.body)
+			}))
+			t.Cleanup(server.Close)
+
+			c := NewChecker("v1.4.0")
+			if err := c.Configure(ModeFeed, server.URL, base64.StdEncoding.EncodeToString(public)); err != nil {
+				t.Fatalf("Configure: %v", err)
+			}
+			var offered []*Available
+			c.SetHandler(func(a *Available) { offered = append(offered, a) })
+
+			_, err := c.Check(context.Background())
+			status := c.Status()
+			if tt.offered {
+				if err != nil || len(offered) != 1 || offered[0].Version != "v1.5.0" || offered[0].Source != SourceFeed {
+					t.Fatalf("Check = %v, offered %+v; want v1.5.0 from the feed", err, offered)
+				}
+				if status.Latest == nil || status.LastError != nil {
+					t.Errorf("status %+v, want the release and no error", status)
+				}
+				return
+			}
+			if err == nil || len(offered) != 0 {
+				t.Fatalf("Check = %v, offered %+v; want an error and nothing offered", err, offered)
+			}
+			if status.Latest != nil || status.LastError == nil || status.LastCheck.IsZero() {
+				t.Errorf("status %+v, want the failure recorded and no release", status)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+// Package update notices when a newer whisper release exists, from a signed
+// release feed or from the versions friends' nodes report. It never downloads
+// or installs anything; it only tells the user.
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/semver"
+)
+
+// Where a checker looks for newer releases
+const (
+	ModeOff   = "off"   // Nowhere; the default
+	ModePeers = "peers" // Only the versions friends run
+	ModeFeed  = "feed"  // The signed release feed, and the versions friends run
+)
+
+// Where a newer release was learned from
+const (
+	SourceFeed = "feed"
+	SourcePeer = "peer"
+)
+
+const (
+	// checkInterval is how often the release feed is fetched
+	checkInterval = 24 * time.Hour
+
+	// requestTimeout bounds one fetch of the release feed
+	requestTimeout = 30 * time.Second
+)
+
+// Available is a release newer than the running build
+type Available struct {
+	Version string
+	Source  string // SourceFeed or SourcePeer
+	From    string // Username of the friend running it, for SourcePeer
+	URL     string // Where to get it, for SourceFeed
+	Notes   string // What changed, for SourceFeed
+	At      time.Time
+}
+
+// Status is what a checker has found so far
+type Status struct {
+	Mode      string
+	Current   string     // This build's version
+	Latest    *Available // Newest release seen; nil if none is newer
+	LastCheck time.Time  // When the feed was last fetched; zero if never
+	LastError error      // Why the last fetch failed; nil if it worked
+}
+
+// Checker looks for releases newer than the running build and reports each
+// newer one once
+type Checker struct {
+	current string
+	client  *http.Client
+
+	mu        sync.Mutex
+	mode      string
+	feed      *url.URL
+	key       ed25519.PublicKey
+	latest    *Available
+	lastCheck time.Time
+	lastErr   error
+	handler   func(*Available)
+	changed   chan struct{} // Closed and replaced when the configuration changes
+}
+
+// NewChecker creates a checker for a build running version current. It looks
+// nowhere until configured. A build whose version isn't a release, such as
+// "dev", is never told about updates.
+func NewChecker(current string) *Checker {
+	return &Checker{
+		current: current,
+		client:  &http.Client{Timeout: requestTimeout},
+		mode:    ModeOff,
+		changed: make(chan struct{}),
+	}
+}
+
+// Configure sets where the checker looks: mode is one of the Mode* values,
+// and feed mode needs the feed URL and the base64 or hex ed25519 public key
+// its releases are signed with. On error the configuration is left as it was.
+func (c *Checker) Configure(mode, feedURL, key string) error {
+	if mode == "" {
+		mode = ModeOff
+	}
+	var feed *url.URL
+	var publicKey ed25519.PublicKey
+	switch mode {
+	case ModeOff, ModePeers:
+	case ModeFeed:
+		parsed, err := url.Parse(feedURL)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			return fmt.Errorf("release feed %q must be an http(s) URL", feedURL)
+		}
+		if publicKey, err = ParseKey(key); err != nil {
+			return err
+		}
+		feed = parsed
+	default:
+		return fmt.Errorf("unknown update check mode %q (want off, peers or feed)", mode)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mode = mode
+	c.feed = feed
+	c.key = publicKey
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return nil
+}
+
+// ParseKey decodes an ed25519 public key given in base64 or hex
+func ParseKey(key string) (ed25519.PublicKey, error) {
+	if key == "" {
+		return nil, fmt.Errorf("the release feed needs a signing key")
+	}
+	data, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(data) != ed25519.PublicKeySize {
+		data, err = hex.DecodeString(key)
+	}
+	if err != nil || len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("release feed key must be a %d-byte ed25519 public key in base64 or hex", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(data), nil
+}
+
+// SetHandler sets the callback told about each newer release, once per version
+func (c *Checker) SetHandler(handler func(*Available)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handler = handler
+}
+
+// Status returns what the checker has found so far
+func (c *Checker) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Status{Mode: c.mode, Current: c.current, Latest: c.latest, LastCheck: c.lastCheck, LastError: c.lastErr}
+}
+
+// Run fetches the release feed now and every checkInterval while in feed
+// mode, until ctx is cancelled. A configuration change starts over.
+func (c *Checker) Run(ctx context.Context) {
+	for {
+		c.mu.Lock()
+		mode := c.mode
+		changed := c.changed
+		c.mu.Unlock()
+
+		if mode == ModeFeed {
+			c.Check(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-time.After(checkInterval):
+		}
+	}
+}
+
+// Check fetches the release feed once and reports its release if it is
+// newer. It returns the release found.
+func (c *Checker) Check(ctx context.Context) (*Release, error) {
+	c.mu.Lock()
+	feed, key := c.feed, c.key
+	c.mu.Unlock()
+	if feed == nil {
+		return nil, fmt.Errorf("no release feed configured (set WHISPER_UPDATE_CHECK=feed)")
+	}
+
+	release, err := fetchRelease(ctx, c.client, feed.String(), key)
+	c.mu.Lock()
+	c.lastCheck = time.Now()
+	c.lastErr = err
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	c.offer(&Available{Version: release.Version, Source: SourceFeed, URL: release.URL, Notes: release.Notes, At: time.Now()})
+	return release, nil
+}
+
+// ObservePeer notes the version a friend's node runs. Pre-releases and
+// development builds are ignored, so a friend testing one isn't taken for a
+// release.
+func (c *Checker) ObservePeer(username, version string) {
+	if semver.Prerelease(version) != "" || semver.Build(version) != "" {
+		return
+	}
+	c.mu.Lock()
+	mode := c.mode
+	c.mu.Unlock()
+	if mode == ModeOff {
+		return
+	}
+	c.offer(&Available{Version: version, Source: SourcePeer, From: username, At: time.Now()})
+}
+
+// offer reports a release if it is newer than both the running build and
+// every release reported before
+func (c *Checker) offer(release *Available) {
+	if !Newer(release.Version, c.current) {
+		return
+	}
+	c.mu.Lock()
+	if c.latest != nil && !Newer(release.Version, c.latest.Version) {
+		c.mu.Unlock()
+		return
+	}
+	c.latest = release
+	handler := c.handler
+	c.mu.Unlock()
+
+	if handler != nil {
+		handler(release)
+	}
+}
+
+// Newer reports whether version is a later release than current; either
+// not being a semantic version (e.g. "dev") makes it false
+func Newer(version, current string) bool {
+	if !semver.IsValid(version) || !semver.IsValid(current) {
+		return false
+	}
+	return semver.Compare(version, current) > 0
+}
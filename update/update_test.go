@@ -0,0 +1,126 @@
+package update_test
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"github.com/austinwklein/whisper/update"
+)
+
+func TestNewer(t *testing.T) {
+	tests := []struct {
+		version, current string
+		want             bool
+	}{
+		{"v1.5.0", "v1.4.0", true},
+		{"v1.4.1", "v1.4.0", true},
+		{"v2.0.0", "v1.9.9", true},
+		{"v1.10.0", "v1.9.0", true}, // Compared as numbers, not strings
+		{"v1.4.0", "v1.4.0", false},
+		{"v1.3.0", "v1.4.0", false},
+		{"v1.4.0", "v1.4.0-rc.1", true},
+		{"v1.4.0-rc.1", "v1.4.0", false},
+		{"v1.4", "v1.3.9", true}, // Short forms are valid semantic versions
+		{"1.5.0", "v1.4.0", false},
+		{"v1.5.0", "dev", false},
+		{"dev", "v1.4.0", false},
+		{"", "v1.4.0", false},
+	}
+	for _, tt := range tests {
+		if got := update.Newer(tt.version, tt.current); got != tt.want {
+			t.Errorf("Newer(%q, %q) = %v, want %v", tt.version, tt.current, got, tt.want)
+		}
+	}
+}
+
+func TestObservePeer(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		mode    string
+		seen    []string
+		offered []string
+	}{
+		{"off", "v1.4.0", update.ModeOff, []string{"v1.5.0"}, nil},
+		{"newer once", "v1.4.0", update.ModePeers, []string{"v1.5.0", "v1.5.0", "v1.4.2"}, []string{"v1.5.0"}},
+		{"each newer release", "v1.4.0", update.ModePeers, []string{"v1.4.1", "v1.5.0"}, []string{"v1.4.1", "v1.5.0"}},
+		{"older and same ignored", "v1.4.0", update.ModePeers, []string{"v1.3.0", "v1.4.0"}, nil},
+		{"pre-releases and builds ignored", "v1.4.0", update.ModePeers, []string{"v1.5.0-beta.1", "v1.5.0+local", "dev"}, nil},
+		{"dev build never told", "dev", update.ModePeers, []string{"v9.0.0"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := update.NewChecker(tt.current)
+			if err := c.Configure(tt.mode, "", ""); err != nil {
+				t.Fatalf("Configure: %v", err)
+			}
+			var offered []string
+			c.SetHandler(func(a *update.Available) {
+				if a.Source != update.SourcePeer || a.From != "bob" {
+					t.Errorf("offered %+v, want bob's version", a)
+				}
+				offered = append(offered, a.Version)
+			})
+			for _, version := range tt.seen {
+				c.ObservePeer("bob", version)
+			}
+			if len(offered) != len(tt.offered) {
+				t.Fatalf("offered %v, want %v", offered, tt.offered)
+			}
+			for i := range offered {
+				if offered[i] != tt.offered[i] {
+					t.Fatalf("offered %v, want %v", offered, tt.offered)
+				}
+			}
+		})
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	for _, valid := range []string{base64.StdEncoding.EncodeToString(key), hex.EncodeToString(key)} {
+		got, err := update.ParseKey(valid)
+		if err != nil || string(got) != string(key) {
+			t.Errorf("ParseKey(%q) = %x, %v; want the key", valid, got, err)
+		}
+	}
+	for _, invalid := range []string{"", "not a key", base64.StdEncoding.EncodeToString(key[:31]), hex.EncodeToString(append(key, 0))} {
+		if _, err := update.ParseKey(invalid); err == nil {
+			t.Errorf("ParseKey(%q) accepted", invalid)
+		}
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	tests := []struct {
+		name           string
+		mode, url, key string
+		ok             bool
+	}{
+		{"default off", "", "", "", true},
+		{"peers", update.ModePeers, "", "", true},
+		{"feed", update.ModeFeed, "https://example.com/feed.json", key, true},
+		{"feed without key", update.ModeFeed, "https://example.com/feed.json", "", false},
+		{"feed without URL", update.ModeFeed, "", key, false},
+		{"feed over ftp", update.ModeFeed, "ftp://example.com/feed.json", key, false},
+		{"unknown mode", "always", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := update.NewChecker("v1.4.0")
+			err := c.Configure(tt.mode, tt.url, tt.key)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Configure = %v, want ok %v", err, tt.ok)
+			}
+			if !tt.ok && c.Status().Mode != update.ModeOff {
+				t.Errorf("failed Configure changed the mode to %q", c.Status().Mode)
+			}
+		})
+	}
+}